@@ -1,13 +1,19 @@
 package config
 
 import (
+	"crypto/tls"
+	"errors"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"regexp"
+	"time"
 
 	"fmt"
 
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
 	"github.com/allegro/akubra/log"
 	logconfig "github.com/allegro/akubra/log/config"
 	"github.com/allegro/akubra/metrics"
@@ -29,10 +35,41 @@ type YamlConfig struct {
 	Listen                  string `yaml:"Listen,omitempty" validate:"regexp=^(([0-9]+[.][0-9]+[.][0-9]+[.][0-9]+)?[:][0-9]+)$"`
 	TechnicalEndpointListen string `yaml:"TechnicalEndpointListen,omitempty" validate:"regexp=^(([0-9]+[.][0-9]+[.][0-9]+[.][0-9]+)?[:][0-9]+)$"`
 	HealthCheckEndpoint     string `yaml:"HealthCheckEndpoint,omitempty" validate:"regexp=^([/a-z0-9]+)$"`
+	// Retry binding Listen address if it's in use
+	ListenRetry httphandlerconfig.ListenRetryConfig `yaml:"ListenRetry,omitempty"`
+	// Probe backends after binding Listen address, health check endpoint
+	// responds with 503 STARTING until probe is finished
+	StartupProbe bool `yaml:"StartupProbe,omitempty"`
+	// Health probes forwarded to backends but excluded from access log
+	HealthProbes httphandlerconfig.HealthProbesConfig `yaml:"HealthProbes,omitempty"`
+	// Access log fields written per response status class, e.g. "2xx"
+	AccessLogFields httphandlerconfig.AccessLogFieldsConfig `yaml:"AccessLogFields,omitempty"`
+	// Count request and response body bytes for access log and metrics
+	CountBodyBytes bool `yaml:"CountBodyBytes,omitempty"`
 	// List of backend URI's e.g. "http://s3.mydatacenter.org"
 	Backends []shardingconfig.YAMLUrl `yaml:"Backends,omitempty,flow"`
 	// Maximum accepted body size
 	BodyMaxSize shardingconfig.HumanSizeUnits `yaml:"BodyMaxSize,omitempty"`
+	// Maximum size of backend response headers, responses exceeding it are treated
+	// as backend failures. Default 0 (net/http default, 10MB)
+	MaxBackendHeaderBytes shardingconfig.HumanSizeUnits `yaml:"MaxBackendHeaderBytes,omitempty"`
+	// Backend responses with body larger than LargeObjectThreshold are counted
+	// as large objects
+	LargeObjectThreshold shardingconfig.HumanSizeUnits `yaml:"LargeObjectThreshold,omitempty"`
+	// Identical GET requests in progress share single backend request if
+	// response body is not bigger than CoalesceReadsMaxSize, zero disables it
+	CoalesceReadsMaxSize shardingconfig.HumanSizeUnits `yaml:"CoalesceReadsMaxSize,omitempty"`
+	// Identical HEAD requests share single backend request and its response
+	// is shared for CoalesceHeadsWindow after it completed, zero disables it
+	CoalesceHeadsWindow metrics.Interval `yaml:"CoalesceHeadsWindow,omitempty"`
+	// Successful writes with Idempotency-Key header are cached, retries with
+	// the same key are answered from cache
+	Idempotency httphandlerconfig.IdempotencyConfig `yaml:"Idempotency,omitempty"`
+	// Request bodies are verified against Content-MD5 header before they
+	// are replicated
+	ContentMD5 httphandlerconfig.ContentMD5Config `yaml:"ContentMD5,omitempty"`
+	// Post summary of every PUT, POST and DELETE request to audit webhook
+	Audit httphandlerconfig.AuditConfig `yaml:"Audit,omitempty"`
 	// MaxIdleConns see: https://golang.org/pkg/net/http/#Transport
 	// Default 0 (no limit)
 	MaxIdleConns int `yaml:"MaxIdleConns" validate:"min=0"`
@@ -45,19 +82,225 @@ type YamlConfig struct {
 	// ResponseHeaderTimeout see: https://golang.org/pkg/net/http/#Transport
 	// Default 5s (no limit)
 	ResponseHeaderTimeout metrics.Interval `yaml:"ResponseHeaderTimeout"`
+	// ExpectContinueTimeout see: https://golang.org/pkg/net/http/#Transport, default 1s
+	ExpectContinueTimeout metrics.Interval `yaml:"ExpectContinueTimeout,omitempty"`
+	// Fail "Expect: 100-continue" requests instead of sending body after ExpectContinueTimeout
+	FailOnExpectContinueTimeout bool `yaml:"FailOnExpectContinueTimeout,omitempty"`
+	// Keep resolved backend addresses for given time and use them if resolver fails,
+	// zero disables cache
+	BackendDNSCacheTTL metrics.Interval `yaml:"BackendDNSCacheTTL,omitempty"`
+	// Local IP address backend connections are made from, e.g. on multi-homed
+	// hosts. Empty lets system choose it
+	BackendSourceAddress string `yaml:"BackendSourceAddress,omitempty"`
+	// Add Server-Timing header with backend dial, backend time to first byte
+	// and total proxy time to responses
+	EmitServerTiming bool `yaml:"EmitServerTiming,omitempty"`
+	// Set Accept-Ranges: bytes on successful GET and HEAD responses instead of
+	// passing backend Accept-Ranges
+	ForceAcceptRanges bool `yaml:"ForceAcceptRanges,omitempty"`
+	// Send HEAD requests to backends without Range header and answer range
+	// with 206 or 416 by akubra
+	EmulateHeadRange bool `yaml:"EmulateHeadRange,omitempty"`
+	// Count backend responses by request method and status class
+	MethodStatusMetrics bool `yaml:"MethodStatusMetrics,omitempty"`
+	// Count backend requests sent over new and reused connections
+	ConnectionReuseMetrics bool `yaml:"ConnectionReuseMetrics,omitempty"`
+	// Gzip GET responses for clients accepting it
+	CompressResponses bool `yaml:"CompressResponses,omitempty"`
+	// Keys with these extensions are not compressed, nil means
+	// httphandler.DefaultCompressSkipExtensions
+	CompressSkipExtensions []string `yaml:"CompressSkipExtensions,omitempty"`
+	// Block writes with 503 until health checks confirm at least
+	// WriteQuorum healthy backends, reads are served anyway
+	WriteSafeMode bool `yaml:"WriteSafeMode,omitempty"`
+	// Interval of backend health checks in write safe mode. Default 5s
+	HealthCheckInterval metrics.Interval `yaml:"HealthCheckInterval,omitempty"`
+	// Maximum duration of reading whole client request, including body.
+	// Default 5s
+	ReadTimeout metrics.Interval `yaml:"ReadTimeout,omitempty"`
+	// Maximum duration of writing response to client. Default 10s
+	WriteTimeout metrics.Interval `yaml:"WriteTimeout,omitempty"`
+	// Client which does not send any request body bytes for given time is
+	// disconnected, zero disables it
+	BodyReadIdleTimeout metrics.Interval `yaml:"BodyReadIdleTimeout,omitempty"`
+	// Client connections idle between requests for given time are closed,
+	// zero disables it
+	ClientIdleTimeout metrics.Interval `yaml:"ClientIdleTimeout,omitempty"`
+	// Maximum duration of serving whole GET, HEAD and OPTIONS request, replaces
+	// ReadTimeout and WriteTimeout for them. Zero keeps ReadTimeout and WriteTimeout
+	ReadRequestTimeout metrics.Interval `yaml:"ReadRequestTimeout,omitempty"`
+	// Maximum duration of serving whole request of other methods (uploads)
+	WriteRequestTimeout metrics.Interval `yaml:"WriteRequestTimeout,omitempty"`
+	// Highest timeout trusted clients may set with X-Akubra-Timeout header,
+	// zero ignores the header
+	MaxTimeoutOverride metrics.Interval `yaml:"MaxTimeoutOverride,omitempty"`
+	// Networks (CIDR) of trusted clients, they may also enable features with
+	// X-Akubra-Feature header
+	TrustedNetworks []string `yaml:"TrustedNetworks,omitempty"`
+	// Close every HTTP/1.0 client connection after response, even if client
+	// asked for keep-alive
+	ForceCloseHTTP10 bool `yaml:"ForceCloseHTTP10,omitempty"`
+	// Client connections start with PROXY protocol (v1 or v2) header sent by
+	// load balancer, which carries real client address
+	AcceptProxyProtocol bool `yaml:"AcceptProxyProtocol,omitempty"`
+	// Certificate and key files (PEM) of TLS served on Listen, plain HTTP is
+	// served if not set
+	TLSCertFile string `yaml:"TLSCertFile,omitempty"`
+	TLSKeyFile  string `yaml:"TLSKeyFile,omitempty"`
+	// Cipher suites (crypto/tls names) accepted by TLS listener,
+	// DefaultTLSCipherSuites if not set
+	TLSCipherSuites []string `yaml:"TLSCipherSuites,omitempty"`
+	// Reload TLSCertFile and TLSKeyFile on SIGHUP, new connections get
+	// reloaded certificate
+	TLSCertReload bool `yaml:"TLSCertReload,omitempty"`
+	// Maximum number of open connections from single client IP, zero means
+	// no limit
+	MaxConnsPerIP int `yaml:"MaxConnsPerIP,omitempty" validate:"min=0"`
+	// Maximum number of open client connections, zero means no limit
+	ClientConnLimit int `yaml:"ClientConnLimit,omitempty" validate:"min=0"`
+	// Log requests rejected as malformed before reaching handler
+	LogMalformedRequests bool `yaml:"LogMalformedRequests,omitempty"`
+	// Reject requests with conflicting Content-Length headers or both
+	// Content-Length and Transfer-Encoding before reaching handler
+	StrictContentLength bool `yaml:"StrictContentLength,omitempty"`
 	// Max number of incoming requests to process in parallel
 	MaxConcurrentRequests int32 `yaml:"MaxConcurrentRequests" validate:"min=1"`
+	// Process at most RequestQueue.Workers requests at once and let at most
+	// RequestQueue.QueueSize requests wait, others are rejected with 503
+	RequestQueue httphandlerconfig.RequestQueueConfig `yaml:"RequestQueue,omitempty"`
+	// ClientAccounting counts requests and errors of client IPs, top clients
+	// are listed by /admin/clients technical endpoint
+	ClientAccounting httphandlerconfig.ClientAccountingConfig `yaml:"ClientAccounting,omitempty"`
+	// Fraction of requests completed under SLOThreshold is tracked over
+	// SLOWindow, overall and per backend. Zero threshold disables it
+	SLOThreshold metrics.Interval `yaml:"SLOThreshold,omitempty"`
+	SLOWindow    metrics.Interval `yaml:"SLOWindow,omitempty"`
+	// Client request latencies are counted in cumulative buckets of these
+	// ascending upper bounds. Empty disables it
+	MetricsLatencyBuckets []metrics.Interval `yaml:"MetricsLatencyBuckets,omitempty"`
+	// Reject requests between high and low watermark of in-flight requests
+	LoadShed httphandlerconfig.LoadShedConfig `yaml:"LoadShed,omitempty"`
+	// Flush every chunk of response body to client as soon as it is read
+	// from backend
+	StreamImmediately bool `yaml:"StreamImmediately,omitempty"`
+	// Flush response body to client at least that often, ignored with
+	// StreamImmediately
+	StreamFlushInterval metrics.Interval `yaml:"StreamFlushInterval,omitempty"`
+	// Chaos injects latency and errors, requires AKUBRA_CHAOS=true environment variable
+	Chaos httphandlerconfig.ChaosConfig `yaml:"Chaos,omitempty"`
 
 	Clusters map[string]shardingconfig.ClusterConfig `yaml:"Clusters,omitempty"`
 	Regions  map[string]shardingconfig.RegionConfig  `yaml:"Regions,omitempty"`
+	// Maximum number of backends single write is sent to at once, 0 means all
+	WriteConcurrency int `yaml:"WriteConcurrency,omitempty" validate:"min=0"`
+	// Number of backends which have to accept write, 0 means any single backend
+	WriteQuorum int `yaml:"WriteQuorum,omitempty" validate:"min=0"`
+	// Abort in-flight writes and respond as soon as WriteQuorum is unreachable
+	FailFastWrites bool `yaml:"FailFastWrites,omitempty"`
+	// Abort in-flight writes to all backends when client cancels request before it's responded
+	PropagateClientCancellation bool `yaml:"PropagateClientCancellation,omitempty"`
+	// Send conditional requests to all backends and respond with state agreed by their majority
+	ConsistentPreconditions bool `yaml:"ConsistentPreconditions,omitempty"`
+	// AutoReconcile copies authoritative object version to backends which
+	// disagree on ETag in conditional requests, requires ConsistentPreconditions
+	AutoReconcile shardingconfig.AutoReconcileConfig `yaml:"AutoReconcile,omitempty"`
+	// WriteHealing re-attempts plain PUT and DELETE writes which failed on
+	// some backends once these backends accept another write
+	WriteHealing shardingconfig.WriteHealingConfig `yaml:"WriteHealing,omitempty"`
+	// AbortOrphanedParts sends AbortMultipartUpload to backends which failed
+	// CompleteMultipartUpload succeeded on other backends
+	AbortOrphanedParts bool `yaml:"AbortOrphanedParts,omitempty"`
+	// MultipartTracking bounds number of tracked multipart uploads in
+	// progress and evicts (optionally aborts) abandoned ones
+	MultipartTracking httphandlerconfig.MultipartTrackingConfig `yaml:"MultipartTracking,omitempty"`
+	// Send bucket listings to all backends and merge their results
+	MergeListings bool `yaml:"MergeListings,omitempty"`
+	// Send ACL and policy subresource requests (?acl, ?policy) and versioned
+	// requests only to backend with given host instead of replicating them
+	AuthoritativeBackend string `yaml:"AuthoritativeBackend,omitempty"`
+	// HEAD requests report object only if HeadQuorum.Quorum backends have it
+	HeadQuorum shardingconfig.HeadQuorumConfig `yaml:"HeadQuorum,omitempty"`
+	// Temporarily exclude backends failing repeatedly from reads
+	OutlierEjection shardingconfig.OutlierEjectionConfig `yaml:"OutlierEjection,omitempty"`
+	// Temporarily exclude backends timing out repeatedly from reads
+	Quarantine shardingconfig.QuarantineConfig `yaml:"Quarantine,omitempty"`
+	// ErrorBodies treats backend responses carrying S3 error documents as failed
+	ErrorBodies shardingconfig.ErrorBodyConfig `yaml:"ErrorBodies,omitempty"`
+	// Send reads to ReadFanout backends at once and pass the fastest response
+	ReadFanout int `yaml:"ReadFanout,omitempty" validate:"min=0"`
+	// Locality makes reads prefer backends placed in akubra region
+	Locality shardingconfig.LocalityConfig `yaml:"Locality,omitempty"`
+	// Retries on regression clusters limits
+	Retries shardingconfig.RetriesConfig `yaml:"Retries,omitempty"`
 	// Additional not amazon specific headers proxy will add to original request
 	AdditionalRequestHeaders shardingconfig.AdditionalHeaders `yaml:"AdditionalRequestHeaders,omitempty"`
 	// Additional headers added to backend response
 	AdditionalResponseHeaders shardingconfig.AdditionalHeaders `yaml:"AdditionalResponseHeaders,omitempty"`
+	// Maximum total size of AdditionalResponseHeaders names and values, default 8KB
+	AdditionalResponseHeadersMaxSize shardingconfig.HumanSizeUnits `yaml:"AdditionalResponseHeadersMaxSize,omitempty"`
+	// Allows protected headers (e.g. Content-Length, Content-Type) in AdditionalResponseHeaders
+	AllowOverrideProtectedHeaders bool `yaml:"AllowOverrideProtectedHeaders,omitempty"`
+	// Canonicalize object keys encoding before forwarding requests to backends
+	NormalizeKeys bool `yaml:"NormalizeKeys,omitempty"`
+	// Forward bucket root requests without ("strip") or with ("append")
+	// trailing slash, empty leaves paths unchanged
+	NormalizeBucketRoot string `yaml:"NormalizeBucketRoot,omitempty"`
+	// Append akubra to Via header of requests and responses ("add"), remove
+	// it ("strip") or pass it unchanged ("passthrough"), default "add"
+	ViaHeader string `yaml:"ViaHeader,omitempty"`
+	// Request path rewrite rules evaluated in order before backend selection
+	RewriteRules []httphandlerconfig.RewriteRule `yaml:"RewriteRules,omitempty"`
+	// Apply only first matching rewrite rule ("first") or all matching ones
+	// ("all"), default "first"
+	RewriteRulesMode string `yaml:"RewriteRulesMode,omitempty"`
+	// Requests without "Authorization: Bearer <AuthToken>" header are rejected,
+	// empty token disables authentication
+	AuthToken string `yaml:"AuthToken,omitempty"`
+	// Replace backend host in Location response header with host requested
+	// by client, RewriteHeaders lists other headers to rewrite
+	RewriteLocationHeader bool     `yaml:"RewriteLocationHeader,omitempty"`
+	RewriteHeaders        []string `yaml:"RewriteHeaders,omitempty"`
+	// S3 operations (e.g. CompleteMultipartUpload) which get backend host
+	// replaced in Location elements of XML response bodies
+	RewriteXMLOperations []string `yaml:"RewriteXMLOperations,omitempty"`
+	// Region returned in GET bucket location responses instead of backend value
+	LocationConstraint string `yaml:"LocationConstraint,omitempty"`
+	// Hop-by-hop headers which should be forwarded verbatim instead of being dropped
+	ForwardHeaders []string `yaml:"ForwardHeaders,omitempty"`
 	// Read timeout on outgoing connections
 
+	// Hosts of backends rejecting chunked uploads, chunked bodies are
+	// buffered and sent to them with Content-Length
+	RequireContentLength []string `yaml:"RequireContentLength,omitempty"`
+	// Chunked request bodies bigger than this are rejected with 413, default 64MB
+	RechunkBufferLimit shardingconfig.HumanSizeUnits `yaml:"RechunkBufferLimit,omitempty"`
+	// PUT requests with body larger than AutoMultipartThreshold are sent to
+	// backends as multipart uploads, zero disables it
+	AutoMultipartThreshold shardingconfig.HumanSizeUnits `yaml:"AutoMultipartThreshold,omitempty"`
+	// Part size of automatic multipart uploads, default 64MB
+	AutoMultipartPartSize shardingconfig.HumanSizeUnits `yaml:"AutoMultipartPartSize,omitempty"`
 	// Backend in maintenance mode. Akubra will not send data there
 	MaintainedBackends []shardingconfig.YAMLUrl `yaml:"MaintainedBackends,omitempty"`
+	// VerificationSampleRate fraction of GET responses is compared with
+	// response of VerificationBackend, mismatches are logged
+	VerificationBackend    shardingconfig.YAMLUrl `yaml:"VerificationBackend,omitempty"`
+	VerificationSampleRate float64                `yaml:"VerificationSampleRate,omitempty" validate:"min=0,max=1"`
+	// Response status code sent when no backend is available, 503 (default) or 502
+	NoBackendResponse int `yaml:"NoBackendResponse,omitempty"`
+	// Delay of GET and HEAD responses failing on all backends, they get
+	// Retry-After header too. Zero disables it
+	AllFailBackoff metrics.Interval `yaml:"AllFailBackoff,omitempty"`
+	// DisablePanicRecovery lets request handler panics close client
+	// connection instead of responding with 500 InternalError
+	DisablePanicRecovery bool `yaml:"DisablePanicRecovery,omitempty"`
+	// Page served instead of error response when all backends are maintained
+	MaintenancePageFile string `yaml:"MaintenancePageFile,omitempty"`
+	// Maintenance page response status code, default 503
+	MaintenancePageStatus int `yaml:"MaintenancePageStatus,omitempty"`
+	// Maintenance page Retry-After (and cache max-age), default 60s
+	MaintenancePageRetryAfter metrics.Interval `yaml:"MaintenancePageRetryAfter,omitempty"`
+	// Daily maintenance windows. Backend is treated as maintained within its window
+	MaintenanceSchedule []shardingconfig.MaintenanceWindow `yaml:"MaintenanceSchedule,omitempty"`
 
 	// List request methods to be logged in synclog in case of backend failure
 	SyncLogMethods []shardingconfig.SyncLogMethod `yaml:"SyncLogMethods,omitempty"`
@@ -65,6 +308,78 @@ type YamlConfig struct {
 	Metrics        metrics.Config                 `yaml:"Metrics,omitempty"`
 	// Should we keep alive connections with backend servers
 	DisableKeepAlives bool `yaml:"DisableKeepAlives"`
+	// Send HEAD request to every backend in given interval to keep pooled
+	// connections warm, zero disables pinger
+	KeepAlivePingInterval metrics.Interval `yaml:"KeepAlivePingInterval,omitempty"`
+	// Probe backends for supported S3 features at startup and warn about
+	// differences between backends of the same cluster
+	ProbeBackendCapabilities bool `yaml:"ProbeBackendCapabilities,omitempty"`
+	// Number of idle connections opened to every backend at startup, zero
+	// disables prewarming
+	PrewarmConns int `yaml:"PrewarmConns,omitempty" validate:"min=0"`
+	// Client certificate and key files (PEM) presented to https backends
+	BackendClientCertFile string `yaml:"BackendClientCertFile,omitempty"`
+	BackendClientKeyFile  string `yaml:"BackendClientKeyFile,omitempty"`
+	// Health check of given backend (keyed by backend host) used instead of
+	// HEAD request passing with any status lower than 500
+	BackendHealthChecks map[string]shardingconfig.HealthCheckConfig `yaml:"BackendHealthChecks,omitempty"`
+	// Request rate limit of given backend (keyed by backend host). Limited
+	// backend is skipped by reads and fails writes
+	BackendRateLimits map[string]shardingconfig.RateLimitConfig `yaml:"BackendRateLimits,omitempty"`
+	// Concurrent requests limit of given backend (keyed by backend host),
+	// low priority requests get smaller share of it
+	BackendConnLimits map[string]shardingconfig.ConnLimitConfig `yaml:"BackendConnLimits,omitempty"`
+	// Retries of failed requests on given backend (keyed by backend host)
+	// instead of Retries.BackendAttempts
+	BackendRetries map[string]shardingconfig.BackendRetryConfig `yaml:"BackendRetries,omitempty"`
+	// Whether replication failures of given backend (keyed by backend host)
+	// are written to sync log, default true
+	BackendSyncLog map[string]bool `yaml:"BackendSyncLog,omitempty"`
+	// Addressing style of given backend (keyed by backend host), "path"
+	// (default) or "virtual-hosted"
+	BackendAddressingStyles map[string]string `yaml:"BackendAddressingStyles,omitempty"`
+	// Follow backend 301/307/308 redirects (e.g. S3 region redirects)
+	// instead of passing them to client
+	FollowBackendRedirects httphandlerconfig.BackendRedirectsConfig `yaml:"FollowBackendRedirects,omitempty"`
+	// Respond 404 to reads of objects deleted on some backends only
+	DeleteTombstones shardingconfig.TombstonesConfig `yaml:"DeleteTombstones,omitempty"`
+	// Send reads of client session to the same backend
+	SessionAffinity shardingconfig.SessionAffinityConfig `yaml:"SessionAffinity,omitempty"`
+	// Limit concurrent requests of backends responding with 429 or 503 SlowDown
+	AdaptiveThrottling shardingconfig.AdaptiveThrottlingConfig `yaml:"AdaptiveThrottling,omitempty"`
+	// Send fewer object writes to backends reporting little free capacity
+	CapacityWeights shardingconfig.CapacityWeightsConfig `yaml:"CapacityWeights,omitempty"`
+	// TLS server name (SNI) sent to given backend (keyed by backend host) instead of its host
+	BackendTLSServerNames map[string]string `yaml:"BackendTLSServerNames,omitempty"`
+	// HTTP proxy backend requests are sent through, https backends are
+	// reached with CONNECT tunnel
+	BackendProxy shardingconfig.YAMLUrl `yaml:"BackendProxy,omitempty"`
+	// Optional credentials sent to BackendProxy (Basic Proxy-Authorization)
+	BackendProxyUser     string `yaml:"BackendProxyUser,omitempty"`
+	BackendProxyPassword string `yaml:"BackendProxyPassword,omitempty"`
+	// EnablePprof registers net/http/pprof handlers on technical endpoint
+	EnablePprof bool `yaml:"EnablePprof,omitempty"`
+	// ReadOnly rejects writes with 503 on startup, it's switched with
+	// /admin/readonly and /admin/readwrite technical endpoints
+	ReadOnly bool `yaml:"ReadOnly,omitempty"`
+	// Drain mode is on while DrainSentinelFile exists, file is checked every
+	// DrainSentinelInterval (default 1s)
+	DrainSentinelFile     string           `yaml:"DrainSentinelFile,omitempty"`
+	DrainSentinelInterval metrics.Interval `yaml:"DrainSentinelInterval,omitempty"`
+	// POST /admin/prestop technical endpoint turns drain mode on and waits
+	// for in-flight requests, requires AdminToken
+	PreStop httphandlerconfig.PreStopConfig `yaml:"PreStop,omitempty"`
+	// Report how in-flight requests drained during shutdown in
+	// reqs.global.drain.* metrics and Mainlog
+	DrainMetrics bool `yaml:"DrainMetrics,omitempty"`
+	// AdminToken protects administrative technical endpoints
+	// (required as "Authorization: Bearer <AdminToken>" header)
+	AdminToken string `yaml:"AdminToken,omitempty"`
+	// CORS preflight requests handling
+	CORS httphandlerconfig.CORSConfig `yaml:"CORS,omitempty"`
+	// Methods of client requests passed to backends, others are rejected
+	// with 405 status. All methods are allowed if empty
+	AllowedMethods []string `yaml:"AllowedMethods,omitempty"`
 }
 
 // Config contains processed YamlConfig data
@@ -75,6 +390,13 @@ type Config struct {
 	Accesslog         log.Logger
 	Mainlog           log.Logger
 	ClusterSyncLog    log.Logger
+	// Routinglog records backend selection of every request, nil if not
+	// configured
+	Routinglog log.Logger
+	// SLO tracks requests completed under SLOThreshold, nil if disabled
+	SLO *metrics.SLOTracker
+	// LatencyBuckets counts requests in MetricsLatencyBuckets, nil if disabled
+	LatencyBuckets *metrics.LatencyBuckets
 }
 
 // Parse json config
@@ -132,7 +454,14 @@ func setupLoggers(conf *Config) (err error) {
 	}
 
 	conf.ClusterSyncLog, err = log.NewLogger(conf.Logging.ClusterSyncLog)
+	if err != nil {
+		return err
+	}
 
+	// routing log is written only if configured
+	if conf.Logging.Routinglog != emptyLoggerConfig {
+		conf.Routinglog, err = log.NewLogger(conf.Logging.Routinglog)
+	}
 	return err
 }
 
@@ -152,12 +481,140 @@ func Configure(configFilePath string) (conf Config, err error) {
 	}
 	conf.YamlConfig = yconf
 
+	err = checkBackendsConfigured(conf.YamlConfig)
+	if err != nil {
+		log.Fatalf("[ ERROR ] Problem with backends: %v !", err)
+		return conf, err
+	}
+
+	err = checkBackendClientCertificate(conf.YamlConfig)
+	if err != nil {
+		log.Fatalf("[ ERROR ] Problem with backend client certificate: %v !", err)
+		return conf, err
+	}
+
+	err = checkListenerTLS(conf.YamlConfig)
+	if err != nil {
+		log.Fatalf("[ ERROR ] Problem with listener TLS: %v !", err)
+		return conf, err
+	}
+
+	err = checkBackendProxy(conf.YamlConfig)
+	if err != nil {
+		log.Fatalf("[ ERROR ] Problem with backend proxy: %v !", err)
+		return conf, err
+	}
+
+	err = checkBackendSourceAddress(conf.YamlConfig)
+	if err != nil {
+		log.Fatalf("[ ERROR ] Problem with backend source address: %v !", err)
+		return conf, err
+	}
+
+	err = checkRewriteRules(conf.YamlConfig)
+	if err != nil {
+		log.Fatalf("[ ERROR ] Problem with rewrite rules: %v !", err)
+		return conf, err
+	}
+
 	setupSyncLogThread(&conf, []interface{}{"PUT", "GET", "HEAD", "DELETE", "OPTIONS"})
+	conf.SLO = metrics.NewSLOTracker(conf.SLOThreshold.Duration, conf.SLOWindow.Duration)
+	conf.LatencyBuckets = metrics.NewLatencyBuckets(latencyBucketBounds(conf.MetricsLatencyBuckets))
 
 	err = setupLoggers(&conf)
 	return conf, err
 }
 
+// errNoBackends is returned if neither Backends nor any of Clusters lists or
+// discovers backends, every request would fail otherwise
+var errNoBackends = errors.New("no backends configured")
+
+func checkBackendsConfigured(conf YamlConfig) error {
+	if len(conf.Backends) > 0 {
+		return nil
+	}
+	for _, clusterConf := range conf.Clusters {
+		if len(clusterConf.Backends) > 0 || clusterConf.SRV.Record != "" {
+			return nil
+		}
+	}
+	return errNoBackends
+}
+
+func checkBackendClientCertificate(conf YamlConfig) error {
+	if conf.BackendClientCertFile == "" && conf.BackendClientKeyFile == "" {
+		return nil
+	}
+	if conf.BackendClientCertFile == "" || conf.BackendClientKeyFile == "" {
+		return errors.New("both BackendClientCertFile and BackendClientKeyFile have to be set")
+	}
+	_, err := tls.LoadX509KeyPair(conf.BackendClientCertFile, conf.BackendClientKeyFile)
+	return err
+}
+
+func checkBackendProxy(conf YamlConfig) error {
+	if conf.BackendProxy.URL == nil {
+		if conf.BackendProxyUser != "" || conf.BackendProxyPassword != "" {
+			return errors.New("BackendProxyUser and BackendProxyPassword require BackendProxy")
+		}
+		return nil
+	}
+	if scheme := conf.BackendProxy.Scheme; scheme != "http" && scheme != "https" {
+		return fmt.Errorf("BackendProxy scheme should be http or https, got %q", scheme)
+	}
+	if conf.BackendProxyPassword != "" && conf.BackendProxyUser == "" {
+		return errors.New("BackendProxyPassword requires BackendProxyUser")
+	}
+	if len(conf.BackendTLSServerNames) > 0 {
+		// tunnelled TLS connections are not dialed by server name dialer
+		return errors.New("BackendProxy can't be combined with BackendTLSServerNames")
+	}
+	return nil
+}
+
+// checkBackendSourceAddress makes sure BackendSourceAddress is IP address
+// of this host, binding to it fails otherwise
+func checkBackendSourceAddress(conf YamlConfig) error {
+	if conf.BackendSourceAddress == "" {
+		return nil
+	}
+	ip := net.ParseIP(conf.BackendSourceAddress)
+	if ip == nil {
+		return fmt.Errorf("BackendSourceAddress should be IP address, got %q", conf.BackendSourceAddress)
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return fmt.Errorf("BackendSourceAddress %s is not local address: %s", ip, err)
+	}
+	return listener.Close()
+}
+
+func checkRewriteRules(conf YamlConfig) error {
+	switch conf.RewriteRulesMode {
+	case "", httphandlerconfig.RewriteFirstMatch, httphandlerconfig.RewriteAllMatches:
+	default:
+		return fmt.Errorf("RewriteRulesMode should be %q or %q, got %q",
+			httphandlerconfig.RewriteFirstMatch, httphandlerconfig.RewriteAllMatches, conf.RewriteRulesMode)
+	}
+	for i, rule := range conf.RewriteRules {
+		if rule.Match == "" {
+			return fmt.Errorf("rewrite rule %d has empty Match", i)
+		}
+		if _, err := regexp.Compile(rule.Match); err != nil {
+			return fmt.Errorf("rewrite rule %d: %s", i, err)
+		}
+	}
+	return nil
+}
+
+func latencyBucketBounds(buckets []metrics.Interval) []time.Duration {
+	bounds := make([]time.Duration, 0, len(buckets))
+	for _, bucket := range buckets {
+		bounds = append(bounds, bucket.Duration)
+	}
+	return bounds
+}
+
 func setupSyncLogThread(conf *Config, methods []interface{}) {
 	if len(conf.SyncLogMethods) > 0 {
 		conf.SyncLogMethodsSet = set.NewThreadUnsafeSet()
@@ -169,23 +626,76 @@ func setupSyncLogThread(conf *Config, methods []interface{}) {
 	}
 }
 
+// logicalValidators lists validators checking relations between configuration fields
+func (c *YamlConfig) logicalValidators() []func(*bool, *map[string][]error) {
+	return []func(*bool, *map[string][]error){
+		c.ListenPortsLogicalValidator,
+		c.MaintenanceScheduleLogicalValidator,
+		c.NoBackendResponseLogicalValidator,
+		c.NormalizeBucketRootLogicalValidator,
+		c.ViaHeaderLogicalValidator,
+		c.AuditLogicalValidator,
+		c.AccessLogFieldsLogicalValidator,
+		c.MaintenancePageLogicalValidator,
+		c.AdditionalResponseHeadersLogicalValidator,
+		c.AdminEndpointsLogicalValidator,
+		c.TimeoutOverrideLogicalValidator,
+		c.ClusterDiscoveryLogicalValidator,
+		c.AuthoritativeBackendLogicalValidator,
+		c.RequireContentLengthLogicalValidator,
+		c.AutoMultipartLogicalValidator,
+		c.LoadShedLogicalValidator,
+		c.LocalityLogicalValidator,
+		c.AutoReconcileLogicalValidator,
+		c.ReadFanoutLogicalValidator,
+		c.RewriteXMLOperationsLogicalValidator,
+		c.BackendTLSServerNamesLogicalValidator,
+		c.BackendHealthChecksLogicalValidator,
+		c.AllowedMethodsLogicalValidator,
+		c.BackendRateLimitsLogicalValidator,
+		c.BackendConnLimitsLogicalValidator,
+		c.BackendRetriesLogicalValidator,
+		c.BackendAddressingStylesLogicalValidator,
+		c.AdaptiveThrottlingLogicalValidator,
+		c.CapacityWeightsLogicalValidator,
+		c.MetricsLatencyBucketsLogicalValidator,
+	}
+}
+
 // ValidateConf validate configuration from YAML file
 func ValidateConf(conf YamlConfig, enableLogicalValidator bool) (bool, map[string][]error) {
 	validator.SetValidationFunc("NoEmptyValuesSlice", NoEmptyValuesInSliceValidator)
 	validator.SetValidationFunc("UniqueValuesSlice", UniqueValuesInSliceValidator)
 	valid, validationErrors := validator.Validate(conf)
 	if valid && enableLogicalValidator {
-		var validListenPorts bool
 		conf.RegionsEntryLogicalValidator(&valid, &validationErrors)
-		conf.ListenPortsLogicalValidator(&validListenPorts, &validationErrors)
-		valid = valid && validListenPorts
+		for _, logicalValidator := range conf.logicalValidators() {
+			var validPart bool
+			logicalValidator(&validPart, &validationErrors)
+			valid = valid && validPart
+		}
 	}
 	for propertyName, validatorMessage := range validationErrors {
 		log.Printf("[ ERROR ] YAML config validation -> propertyName: '%s', validatorMessage: '%s'\n", propertyName, validatorMessage)
 	}
+	markValidation(valid, validationErrors)
 	return valid, validationErrors
 }
 
+// markValidation counts configuration validation outcomes, failures are
+// counted per failed property or validator
+func markValidation(valid bool, validationErrors map[string][]error) {
+	if valid {
+		metrics.Mark("config.validation.ok")
+		metrics.UpdateGauge("config.validation.last_ok", time.Now().Unix())
+		return
+	}
+	metrics.Mark("config.validation.failed")
+	for propertyName := range validationErrors {
+		metrics.Mark("config.validation.failed." + metrics.Clean(propertyName))
+	}
+}
+
 // ValidateConfigurationHTTPHandler is used in technical HTTP endpoint for config file validation
 func ValidateConfigurationHTTPHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"crypto/tls"
 	"net/url"
 	"testing"
 	"time"
@@ -10,12 +11,18 @@ import (
 	"net/http"
 	"net/http/httptest"
 
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+	"github.com/allegro/akubra/log"
 	logconfig "github.com/allegro/akubra/log/config"
 	"github.com/allegro/akubra/metrics"
 	shardingconfig "github.com/allegro/akubra/sharding/config"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -193,6 +200,28 @@ func TestAdditionalHeadersYamlParsingSuccessful(t *testing.T) {
 	assert.NoError(t, err, "Should be correct")
 }
 
+func TestClusterBackendsYamlParsingWithAdditionalRequestHeaders(t *testing.T) {
+	correct := []byte(`Backends:
+  - http://127.0.0.1:9001
+  - URL: http://127.0.0.1:9002
+    AdditionalRequestHeaders:
+      'X-Routing-Token': 'token'`)
+	testyaml := shardingconfig.ClusterConfig{}
+	err := yaml.Unmarshal(correct, &testyaml)
+	require.NoError(t, err)
+	require.Len(t, testyaml.Backends, 2)
+	assert.Equal(t, "127.0.0.1:9001", testyaml.Backends[0].Host)
+	assert.Empty(t, testyaml.Backends[0].AdditionalRequestHeaders)
+	assert.Equal(t, "127.0.0.1:9002", testyaml.Backends[1].Host)
+	assert.Equal(t, shardingconfig.AdditionalHeaders{"X-Routing-Token": "token"}, testyaml.Backends[1].AdditionalRequestHeaders)
+
+	incorrect := []byte(`Backends:
+  - URL: http://127.0.0.1:9002
+    AdditionalRequestHeaders:
+      'X-Routing-Token': ''`)
+	assert.Error(t, yaml.Unmarshal(incorrect, &shardingconfig.ClusterConfig{}), "Empty header value should return error")
+}
+
 func TestAdditionalHeadersYamlParsingFailureWhenKeyIsEmpty(t *testing.T) {
 	incorrect := []byte(`
 'Access-Control-Allow-Credentials': "true"
@@ -231,6 +260,66 @@ func TestDurationYamlParsingWithIncorrectValue(t *testing.T) {
 	assert.Error(t, err, "Missing duration should return error")
 }
 
+func TestMaintenanceWindowYamlParsingWithSuccess(t *testing.T) {
+	correct := []byte(`
+Backend: http://127.0.0.1:9001
+Start: "01:30"
+End: "03:00"
+`)
+	testyaml := shardingconfig.MaintenanceWindow{}
+	err := yaml.Unmarshal(correct, &testyaml)
+
+	assert.NoError(t, err, "Should be correct")
+	assert.Equal(t, 90*time.Minute, testyaml.Start.Duration)
+	assert.Equal(t, 3*time.Hour, testyaml.End.Duration)
+}
+
+func TestMaintenanceWindowYamlParsingWithIncorrectTime(t *testing.T) {
+	incorrect := []byte(`
+Backend: http://127.0.0.1:9001
+Start: "25:61"
+End: "03:00"
+`)
+	testyaml := shardingconfig.MaintenanceWindow{}
+	err := yaml.Unmarshal(incorrect, &testyaml)
+
+	assert.Error(t, err, "Incorrect day time should return error")
+}
+
+func TestShouldNotValidateMaintenanceWindowWithEqualStartAndEnd(t *testing.T) {
+	var testConf YamlConfigTest
+	backendURL := &url.URL{Scheme: "http", Host: "127.0.0.1:8080"}
+	testConf.NewYamlConfigTest().MaintenanceSchedule = []shardingconfig.MaintenanceWindow{{
+		Backend: shardingconfig.YAMLUrl{URL: backendURL},
+		Start:   shardingconfig.DayTime{Duration: time.Hour},
+		End:     shardingconfig.DayTime{Duration: time.Hour},
+	}}
+	valid := true
+	validationErrors := make(map[string][]error)
+
+	testConf.MaintenanceScheduleLogicalValidator(&valid, &validationErrors)
+
+	assert.False(t, valid)
+	assert.Len(t, validationErrors["MaintenanceScheduleLogicalValidator"], 1)
+}
+
+func TestShouldNotValidateMaintenanceWindowOfUnknownBackend(t *testing.T) {
+	var testConf YamlConfigTest
+	backendURL := &url.URL{Scheme: "http", Host: "127.0.0.1:9090"}
+	testConf.NewYamlConfigTest().MaintenanceSchedule = []shardingconfig.MaintenanceWindow{{
+		Backend: shardingconfig.YAMLUrl{URL: backendURL},
+		Start:   shardingconfig.DayTime{Duration: time.Hour},
+		End:     shardingconfig.DayTime{Duration: 2 * time.Hour},
+	}}
+	valid := true
+	validationErrors := make(map[string][]error)
+
+	testConf.MaintenanceScheduleLogicalValidator(&valid, &validationErrors)
+
+	assert.False(t, valid)
+	assert.Len(t, validationErrors["MaintenanceScheduleLogicalValidator"], 1)
+}
+
 func TestShouldValidateBodyMaxSizeWithCorrectSize(t *testing.T) {
 	correct := []byte(`10MB`)
 	testyaml := shardingconfig.HumanSizeUnits{}
@@ -391,3 +480,148 @@ func callConfigValidateRequest(data string) (writer *httptest.ResponseRecorder,
 	writer = httptest.NewRecorder()
 	return
 }
+
+func TestShouldFailWithoutBackends(t *testing.T) {
+	backendURL, _ := url.Parse("http://127.0.0.1:9001")
+	backends := []shardingconfig.YAMLUrl{{URL: backendURL}}
+	for _, testData := range []struct {
+		name  string
+		conf  YamlConfig
+		valid bool
+	}{
+		{"backends", YamlConfig{Backends: backends}, true},
+		{"cluster backends", YamlConfig{Clusters: map[string]shardingconfig.ClusterConfig{
+			"empty": {}, "cluster1": {Backends: backends}}}, true},
+		{"cluster discovered with SRV", YamlConfig{Clusters: map[string]shardingconfig.ClusterConfig{
+			"cluster1": {SRV: shardingconfig.SRVConfig{Record: "_s3._tcp.storage.internal"}}}}, true},
+		{"no backends", YamlConfig{}, false},
+		{"empty backends lists", YamlConfig{Backends: []shardingconfig.YAMLUrl{},
+			Clusters: map[string]shardingconfig.ClusterConfig{"cluster1": {Backends: []shardingconfig.YAMLUrl{}}}}, false},
+	} {
+		err := checkBackendsConfigured(testData.conf)
+		assert.Equal(t, testData.valid, err == nil, "%s: %v", testData.name, err)
+		if !testData.valid {
+			assert.EqualError(t, err, "no backends configured", testData.name)
+		}
+	}
+}
+
+func TestShouldCheckBackendProxy(t *testing.T) {
+	proxyURL, _ := url.Parse("http://proxy.example.com:3128")
+	socksURL, _ := url.Parse("socks5://proxy.example.com:1080")
+	for _, testData := range []struct {
+		name  string
+		conf  YamlConfig
+		valid bool
+	}{
+		{"no proxy", YamlConfig{}, true},
+		{"http proxy", YamlConfig{BackendProxy: shardingconfig.YAMLUrl{URL: proxyURL}}, true},
+		{"with credentials", YamlConfig{BackendProxy: shardingconfig.YAMLUrl{URL: proxyURL},
+			BackendProxyUser: "akubra", BackendProxyPassword: "secret"}, true},
+		{"unsupported scheme", YamlConfig{BackendProxy: shardingconfig.YAMLUrl{URL: socksURL}}, false},
+		{"password without user", YamlConfig{BackendProxy: shardingconfig.YAMLUrl{URL: proxyURL},
+			BackendProxyPassword: "secret"}, false},
+		{"credentials without proxy", YamlConfig{BackendProxyUser: "akubra"}, false},
+		{"with TLS server names", YamlConfig{BackendProxy: shardingconfig.YAMLUrl{URL: proxyURL},
+			BackendTLSServerNames: map[string]string{"10.0.0.1:443": "s3.example.com"}}, false},
+	} {
+		err := checkBackendProxy(testData.conf)
+		assert.Equal(t, testData.valid, err == nil, "%s: %v", testData.name, err)
+	}
+}
+
+func TestShouldCheckRewriteRules(t *testing.T) {
+	for _, testData := range []struct {
+		name  string
+		conf  YamlConfig
+		valid bool
+	}{
+		{"no rules", YamlConfig{}, true},
+		{"valid rules", YamlConfig{RewriteRules: []httphandlerconfig.RewriteRule{
+			{Match: "^/legacy/(.*)$", Replace: "/bucket/$1"}, {Match: "^/(?P<b>[^/]+)/v1/", Replace: "/${b}/"}}}, true},
+		{"all matches mode", YamlConfig{RewriteRulesMode: httphandlerconfig.RewriteAllMatches}, true},
+		{"unknown mode", YamlConfig{RewriteRulesMode: "last"}, false},
+		{"invalid regexp", YamlConfig{RewriteRules: []httphandlerconfig.RewriteRule{
+			{Match: "^/legacy/(.*$", Replace: "/bucket/$1"}}}, false},
+		{"empty match", YamlConfig{RewriteRules: []httphandlerconfig.RewriteRule{{Replace: "/bucket"}}}, false},
+	} {
+		err := checkRewriteRules(testData.conf)
+		assert.Equal(t, testData.valid, err == nil, "%s: %v", testData.name, err)
+	}
+}
+
+func TestShouldValidateBackendSourceAddress(t *testing.T) {
+	for _, testData := range []struct {
+		address string
+		valid   bool
+	}{
+		{"", true},
+		{"127.0.0.1", true},
+		{"localhost", false},
+		{"192.0.2.1", false},
+	} {
+		err := checkBackendSourceAddress(YamlConfig{BackendSourceAddress: testData.address})
+		assert.Equal(t, testData.valid, err == nil, "%s: %v", testData.address, err)
+	}
+}
+
+func TestShouldMapTLSCipherSuiteNames(t *testing.T) {
+	ids, err := TLSCipherSuiteIDs([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_RSA_WITH_AES_256_GCM_SHA384"})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_RSA_WITH_AES_256_GCM_SHA384}, ids)
+
+	defaults, err := TLSCipherSuiteIDs(nil)
+	assert.NoError(t, err)
+	assert.Len(t, defaults, len(DefaultTLSCipherSuites))
+
+	_, err = TLSCipherSuiteIDs([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_RSA_WITH_NULL_MD5"})
+	assert.EqualError(t, err, `unknown TLS cipher suite "TLS_RSA_WITH_NULL_MD5"`)
+}
+
+func TestShouldCheckListenerTLS(t *testing.T) {
+	for _, testData := range []struct {
+		name  string
+		conf  YamlConfig
+		valid bool
+	}{
+		{"no TLS", YamlConfig{}, true},
+		{"cipher suites without certificate", YamlConfig{TLSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}, false},
+		{"reload without certificate", YamlConfig{TLSCertReload: true}, false},
+		{"certificate without key", YamlConfig{TLSCertFile: "/etc/akubra/server.crt"}, false},
+		{"unknown cipher suite", YamlConfig{TLSCertFile: "/etc/akubra/server.crt", TLSKeyFile: "/etc/akubra/server.key",
+			TLSCipherSuites: []string{"TLS_UNKNOWN"}}, false},
+		{"missing certificate file", YamlConfig{TLSCertFile: "/nonexistent/server.crt", TLSKeyFile: "/nonexistent/server.key"}, false},
+	} {
+		err := checkListenerTLS(testData.conf)
+		assert.Equal(t, testData.valid, err == nil, "%s: %v", testData.name, err)
+	}
+}
+
+func TestRoutinglogIsSetUpOnlyIfConfigured(t *testing.T) {
+	dir, err := ioutil.TempDir("", "akubra-logs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defaultLogger := log.DefaultLogger
+	defer func() { log.DefaultLogger = defaultLogger }()
+	fileLogger := func(name string) log.LoggerConfig {
+		return log.LoggerConfig{File: filepath.Join(dir, name), PlainText: true}
+	}
+	conf := Config{YamlConfig: YamlConfig{Logging: logconfig.LoggingConfig{
+		Accesslog:      fileLogger("access.log"),
+		Synclog:        fileLogger("sync.log"),
+		Mainlog:        fileLogger("main.log"),
+		ClusterSyncLog: fileLogger("clustersync.log"),
+	}}}
+
+	assert.NoError(t, setupLoggers(&conf))
+	assert.Nil(t, conf.Routinglog)
+
+	conf.Logging.Routinglog = fileLogger("routing.log")
+	assert.NoError(t, setupLoggers(&conf))
+	if assert.NotNil(t, conf.Routinglog) {
+		conf.Routinglog.Println(`{"mode":"all"}`)
+		content, err := ioutil.ReadFile(filepath.Join(dir, "routing.log"))
+		assert.NoError(t, err)
+		assert.Contains(t, string(content), `{"mode":"all"}`)
+	}
+}
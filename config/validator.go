@@ -4,14 +4,34 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"regexp"
 	"strings"
 
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
 	set "github.com/deckarep/golang-set"
 )
 
+// DefaultAdditionalResponseHeadersMaxSize limits AdditionalResponseHeaders total size
+const DefaultAdditionalResponseHeadersMaxSize = 8 * 1024
+
+// ProtectedResponseHeaders describe backend response content and should not
+// be set by AdditionalResponseHeaders unless AllowOverrideProtectedHeaders is set
+var ProtectedResponseHeaders = []string{
+	"Content-Length",
+	"Content-Type",
+	"Content-Encoding",
+	"Content-Range",
+	"ETag",
+	"Last-Modified",
+	"Transfer-Encoding",
+}
+
 // NoEmptyValuesInSliceValidator for strings in slice
 func NoEmptyValuesInSliceValidator(v interface{}, param string) error {
 	val := reflect.ValueOf(v)
@@ -110,6 +130,621 @@ func (c *YamlConfig) ListenPortsLogicalValidator(valid *bool, validationErrors *
 	*validationErrors = mergeErrors(*validationErrors, errorsList)
 }
 
+// MaintenanceScheduleLogicalValidator checks if maintenance windows are well defined
+func (c *YamlConfig) MaintenanceScheduleLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	errList := make([]error, 0)
+	backends := c.clusterBackendHosts()
+	for _, window := range c.MaintenanceSchedule {
+		if window.Backend.URL == nil {
+			errList = append(errList, errors.New("Maintenance window without backend"))
+			continue
+		}
+		if !backends[window.Backend.Host] {
+			errList = append(errList, fmt.Errorf("Maintenance window for unknown backend \"%s\"", window.Backend.Host))
+		}
+		if window.Start == window.End {
+			errList = append(errList, fmt.Errorf("Maintenance window for backend \"%s\" has equal start and end", window.Backend.Host))
+		}
+	}
+	if len(errList) > 0 {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["MaintenanceScheduleLogicalValidator"] = errList
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+	} else {
+		*valid = true
+	}
+}
+
+// NoBackendResponseLogicalValidator checks if NoBackendResponse is one of supported status codes
+func (c *YamlConfig) NoBackendResponseLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	switch c.NoBackendResponse {
+	case 0, http.StatusServiceUnavailable, http.StatusBadGateway:
+		*valid = true
+	default:
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["NoBackendResponseLogicalValidator"] = []error{
+			fmt.Errorf("NoBackendResponse should be %d or %d - got %d",
+				http.StatusServiceUnavailable, http.StatusBadGateway, c.NoBackendResponse)}
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+	}
+}
+
+// NormalizeBucketRootLogicalValidator checks if NormalizeBucketRoot is one of supported modes
+func (c *YamlConfig) NormalizeBucketRootLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	switch c.NormalizeBucketRoot {
+	case "", httphandlerconfig.BucketRootWithoutSlash, httphandlerconfig.BucketRootWithSlash:
+		*valid = true
+	default:
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["NormalizeBucketRootLogicalValidator"] = []error{
+			fmt.Errorf("NormalizeBucketRoot should be %q or %q - got %q",
+				httphandlerconfig.BucketRootWithoutSlash, httphandlerconfig.BucketRootWithSlash, c.NormalizeBucketRoot)}
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+	}
+}
+
+// AuditLogicalValidator checks if audit webhook is absolute http or https URL
+func (c *YamlConfig) AuditLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	if c.Audit.WebhookURL == "" {
+		*valid = true
+		return
+	}
+	webhookURL, err := url.Parse(c.Audit.WebhookURL)
+	if err == nil && (webhookURL.Scheme == "http" || webhookURL.Scheme == "https") && webhookURL.Host != "" {
+		*valid = true
+		return
+	}
+	*valid = false
+	errorsList := make(map[string][]error)
+	errorsList["AuditLogicalValidator"] = []error{fmt.Errorf("Audit WebhookURL %q is not http nor https URL", c.Audit.WebhookURL)}
+	*validationErrors = mergeErrors(*validationErrors, errorsList)
+}
+
+// ViaHeaderLogicalValidator checks if ViaHeader is one of supported modes
+func (c *YamlConfig) ViaHeaderLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	switch c.ViaHeader {
+	case "", httphandlerconfig.ViaAdd, httphandlerconfig.ViaStrip, httphandlerconfig.ViaPassthrough:
+		*valid = true
+	default:
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["ViaHeaderLogicalValidator"] = []error{
+			fmt.Errorf("ViaHeader should be %q, %q or %q - got %q",
+				httphandlerconfig.ViaAdd, httphandlerconfig.ViaStrip, httphandlerconfig.ViaPassthrough, c.ViaHeader)}
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+	}
+}
+
+// RewriteXMLOperationsLogicalValidator checks if RewriteXMLOperations lists
+// supported operations
+func (c *YamlConfig) RewriteXMLOperationsLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	var errs []error
+	for _, operation := range c.RewriteXMLOperations {
+		switch operation {
+		case httphandlerconfig.CompleteMultipartUpload, httphandlerconfig.PostObject:
+		default:
+			errs = append(errs, fmt.Errorf("RewriteXMLOperations entry should be %q or %q - got %q",
+				httphandlerconfig.CompleteMultipartUpload, httphandlerconfig.PostObject, operation))
+		}
+	}
+	if len(errs) > 0 {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["RewriteXMLOperationsLogicalValidator"] = errs
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+		return
+	}
+	*valid = true
+}
+
+// AccessLogFieldsLogicalValidator checks if AccessLogFields keys are status classes
+func (c *YamlConfig) AccessLogFieldsLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	errList := make([]error, 0)
+	for class := range c.AccessLogFields {
+		switch class {
+		case "1xx", "2xx", "3xx", "4xx", "5xx":
+		default:
+			errList = append(errList, fmt.Errorf("AccessLogFields key should be status class like \"2xx\" - got %q", class))
+		}
+	}
+	if len(errList) > 0 {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["AccessLogFieldsLogicalValidator"] = errList
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+		return
+	}
+	*valid = true
+}
+
+// MaintenancePageLogicalValidator checks maintenance page status code
+func (c *YamlConfig) MaintenancePageLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	status := c.MaintenancePageStatus
+	if status != 0 && (status < 200 || status > 599) {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["MaintenancePageLogicalValidator"] = []error{
+			fmt.Errorf("MaintenancePageStatus should be valid http status code - got %d", status)}
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+		return
+	}
+	*valid = true
+}
+
+// AdditionalResponseHeadersLogicalValidator checks AdditionalResponseHeaders size
+// and usage of protected headers
+func (c *YamlConfig) AdditionalResponseHeadersLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	errList := make([]error, 0)
+	maxSize := c.AdditionalResponseHeadersMaxSize.SizeInBytes
+	if maxSize == 0 {
+		maxSize = DefaultAdditionalResponseHeadersMaxSize
+	}
+	totalSize := int64(0)
+	for name, value := range c.AdditionalResponseHeaders {
+		totalSize += int64(len(name) + len(value))
+		if c.AllowOverrideProtectedHeaders {
+			continue
+		}
+		for _, protected := range ProtectedResponseHeaders {
+			if strings.EqualFold(name, protected) {
+				errList = append(errList, fmt.Errorf("Header \"%s\" is protected, set AllowOverrideProtectedHeaders to use it in AdditionalResponseHeaders", name))
+			}
+		}
+	}
+	if totalSize > maxSize {
+		errList = append(errList, fmt.Errorf("AdditionalResponseHeaders size %d exceeds limit %d", totalSize, maxSize))
+	}
+	if len(errList) > 0 {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["AdditionalResponseHeadersLogicalValidator"] = errList
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+	} else {
+		*valid = true
+	}
+}
+
+// AdminEndpointsLogicalValidator makes sure administrative endpoints are protected with AdminToken
+func (c *YamlConfig) AdminEndpointsLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	if c.EnablePprof && strings.TrimSpace(c.AdminToken) == "" {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["AdminEndpointsLogicalValidator"] = []error{errors.New("EnablePprof requires AdminToken")}
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+		return
+	}
+	*valid = true
+}
+
+// TimeoutOverrideLogicalValidator checks TrustedNetworks and makes sure
+// timeout override can be used by some trusted clients
+func (c *YamlConfig) TimeoutOverrideLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	var errs []error
+	for _, cidr := range c.TrustedNetworks {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errs = append(errs, fmt.Errorf("TrustedNetworks entry %q is not valid CIDR", cidr))
+		}
+	}
+	if c.MaxTimeoutOverride.Duration > 0 && len(c.TrustedNetworks) == 0 && strings.TrimSpace(c.AdminToken) == "" {
+		errs = append(errs, errors.New("MaxTimeoutOverride requires TrustedNetworks or AdminToken"))
+	}
+	if len(errs) > 0 {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["TimeoutOverrideLogicalValidator"] = errs
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+		return
+	}
+	*valid = true
+}
+
+// ClusterDiscoveryLogicalValidator makes sure clusters discovered with SRV
+// record do not define static backends and use http or https scheme
+func (c *YamlConfig) ClusterDiscoveryLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	var errs []error
+	for name, clusterConf := range c.Clusters {
+		if clusterConf.SRV.Record == "" {
+			continue
+		}
+		if len(clusterConf.Backends) > 0 {
+			errs = append(errs, fmt.Errorf("cluster %q defines both Backends and SRV record", name))
+		}
+		if scheme := clusterConf.SRV.Scheme; scheme != "" && scheme != "http" && scheme != "https" {
+			errs = append(errs, fmt.Errorf("cluster %q SRV scheme %q is not http nor https", name, scheme))
+		}
+		if clusterConf.SRV.RefreshInterval.Duration < 0 {
+			errs = append(errs, fmt.Errorf("cluster %q SRV refresh interval is negative", name))
+		}
+	}
+	if len(errs) > 0 {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["ClusterDiscoveryLogicalValidator"] = errs
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+		return
+	}
+	*valid = true
+}
+
+// LoadShedLogicalValidator makes sure low watermark is not higher than high watermark
+func (c *YamlConfig) LoadShedLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	if c.LoadShed.HighWatermark > 0 && c.LoadShed.LowWatermark > c.LoadShed.HighWatermark {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["LoadShedLogicalValidator"] = []error{errors.New("LoadShed LowWatermark is higher than HighWatermark")}
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+		return
+	}
+	*valid = true
+}
+
+// LocalityLogicalValidator checks if backends regions are defined along with akubra Region
+func (c *YamlConfig) LocalityLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	if len(c.Locality.BackendRegions) > 0 && c.Locality.Region == "" {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["LocalityLogicalValidator"] = []error{errors.New("Locality BackendRegions requires Region")}
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+		return
+	}
+	*valid = true
+}
+
+// AutoReconcileLogicalValidator checks reconciliation policy and if divergent
+// replicas can be detected at all
+func (c *YamlConfig) AutoReconcileLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	if !c.AutoReconcile.Enabled {
+		*valid = true
+		return
+	}
+	var errs []error
+	switch c.AutoReconcile.Policy {
+	case "", shardingconfig.ReconcileNewest, shardingconfig.ReconcileMajority:
+	default:
+		errs = append(errs, fmt.Errorf("AutoReconcile Policy %q is not one of %q, %q",
+			c.AutoReconcile.Policy, shardingconfig.ReconcileNewest, shardingconfig.ReconcileMajority))
+	}
+	if !c.ConsistentPreconditions {
+		errs = append(errs, errors.New("AutoReconcile requires ConsistentPreconditions"))
+	}
+	if len(errs) > 0 {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["AutoReconcileLogicalValidator"] = errs
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+		return
+	}
+	*valid = true
+}
+
+// ReadFanoutLogicalValidator checks if reads are not configured to be sent
+// both at once and one by one
+func (c *YamlConfig) ReadFanoutLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	if c.ReadFanout > 0 && c.Retries.AcrossBackends {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["ReadFanoutLogicalValidator"] = []error{
+			errors.New("ReadFanout can't be combined with Retries.AcrossBackends")}
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+		return
+	}
+	*valid = true
+}
+
+var hostnameRegexp = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+// BackendTLSServerNamesLogicalValidator checks if backends TLS server names are valid hostnames
+func (c *YamlConfig) BackendTLSServerNamesLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	var errs []error
+	for backend, serverName := range c.BackendTLSServerNames {
+		if len(serverName) > 253 || !hostnameRegexp.MatchString(serverName) {
+			errs = append(errs, fmt.Errorf("BackendTLSServerNames entry %q for backend %s is not valid hostname", serverName, backend))
+		}
+	}
+	if len(errs) > 0 {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["BackendTLSServerNamesLogicalValidator"] = errs
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+		return
+	}
+	*valid = true
+}
+
+func (c *YamlConfig) clusterBackendHosts() map[string]bool {
+	backends := make(map[string]bool)
+	for _, clusterConf := range c.Clusters {
+		for _, backend := range clusterConf.Backends {
+			if backend.URL != nil {
+				backends[backend.Host] = true
+			}
+		}
+	}
+	return backends
+}
+
+// BackendAdditionalRequestHeaders collects AdditionalRequestHeaders of
+// cluster backends keyed by backend host
+func (c *YamlConfig) BackendAdditionalRequestHeaders() map[string]shardingconfig.AdditionalHeaders {
+	headers := make(map[string]shardingconfig.AdditionalHeaders)
+	for _, clusterConf := range c.Clusters {
+		for _, backend := range clusterConf.Backends {
+			if backend.URL != nil && len(backend.AdditionalRequestHeaders) > 0 {
+				headers[backend.Host] = backend.AdditionalRequestHeaders
+			}
+		}
+	}
+	return headers
+}
+
+// BackendHealthChecksLogicalValidator checks if health checks are defined for
+// configured backends and have valid method, path and expected status
+func (c *YamlConfig) BackendHealthChecksLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	backends := c.clusterBackendHosts()
+	var errs []error
+	for backend, check := range c.BackendHealthChecks {
+		if !backends[backend] {
+			errs = append(errs, fmt.Errorf("BackendHealthChecks entry for unknown backend %s", backend))
+		}
+		switch check.Method {
+		case "", http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			errs = append(errs, fmt.Errorf("BackendHealthChecks method %q for backend %s is not one of GET, HEAD and OPTIONS", check.Method, backend))
+		}
+		if check.Path != "" && !strings.HasPrefix(check.Path, "/") {
+			errs = append(errs, fmt.Errorf("BackendHealthChecks path %q for backend %s has to start with /", check.Path, backend))
+		}
+		if check.ExpectedStatus != 0 && (check.ExpectedStatus < 100 || check.ExpectedStatus > 599) {
+			errs = append(errs, fmt.Errorf("BackendHealthChecks expected status %d for backend %s is not valid HTTP status", check.ExpectedStatus, backend))
+		}
+	}
+	if len(errs) > 0 {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["BackendHealthChecksLogicalValidator"] = errs
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+		return
+	}
+	*valid = true
+}
+
+// BackendRateLimitsLogicalValidator checks if rate limits are defined for
+// configured backends and allow some requests
+func (c *YamlConfig) BackendRateLimitsLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	backends := c.clusterBackendHosts()
+	var errs []error
+	for backend, limit := range c.BackendRateLimits {
+		if !backends[backend] {
+			errs = append(errs, fmt.Errorf("BackendRateLimits entry for unknown backend %s", backend))
+		}
+		if limit.RequestsPerSecond <= 0 {
+			errs = append(errs, fmt.Errorf("BackendRateLimits RequestsPerSecond of backend %s has to be positive", backend))
+		}
+		if limit.Burst < 0 {
+			errs = append(errs, fmt.Errorf("BackendRateLimits Burst of backend %s can't be negative", backend))
+		}
+	}
+	if len(errs) > 0 {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["BackendRateLimitsLogicalValidator"] = errs
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+		return
+	}
+	*valid = true
+}
+
+// BackendConnLimitsLogicalValidator checks if connection limits are defined
+// for configured backends and leave some slots to low priority requests
+func (c *YamlConfig) BackendConnLimitsLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	backends := c.clusterBackendHosts()
+	var errs []error
+	for backend, limit := range c.BackendConnLimits {
+		if !backends[backend] {
+			errs = append(errs, fmt.Errorf("BackendConnLimits entry for unknown backend %s", backend))
+		}
+		if limit.ConnLimit <= 0 {
+			errs = append(errs, fmt.Errorf("BackendConnLimits ConnLimit of backend %s has to be positive", backend))
+		}
+		if limit.LowPriorityShare < 0 || limit.LowPriorityShare > 1 {
+			errs = append(errs, fmt.Errorf("BackendConnLimits LowPriorityShare of backend %s has to be in range (0, 1]", backend))
+		}
+	}
+	if len(errs) > 0 {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["BackendConnLimitsLogicalValidator"] = errs
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+		return
+	}
+	*valid = true
+}
+
+// BackendRetriesLogicalValidator checks if retry policies are defined for
+// configured backends
+func (c *YamlConfig) BackendRetriesLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	backends := c.clusterBackendHosts()
+	var errs []error
+	for backend, retries := range c.BackendRetries {
+		if !backends[backend] {
+			errs = append(errs, fmt.Errorf("BackendRetries entry for unknown backend %s", backend))
+		}
+		if retries.Attempts < 0 {
+			errs = append(errs, fmt.Errorf("BackendRetries Attempts of backend %s can't be negative", backend))
+		}
+	}
+	if len(errs) > 0 {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["BackendRetriesLogicalValidator"] = errs
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+		return
+	}
+	*valid = true
+}
+
+// BackendAddressingStylesLogicalValidator checks if addressing styles are
+// defined for configured backends and are supported
+func (c *YamlConfig) BackendAddressingStylesLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	backends := c.clusterBackendHosts()
+	var errs []error
+	for backend, style := range c.BackendAddressingStyles {
+		if !backends[backend] {
+			errs = append(errs, fmt.Errorf("BackendAddressingStyles entry for unknown backend %s", backend))
+		}
+		if style != httphandlerconfig.PathStyle && style != httphandlerconfig.VirtualHostedStyle {
+			errs = append(errs, fmt.Errorf("BackendAddressingStyles of backend %s should be %q or %q - got %q",
+				backend, httphandlerconfig.PathStyle, httphandlerconfig.VirtualHostedStyle, style))
+		}
+	}
+	if len(errs) > 0 {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["BackendAddressingStylesLogicalValidator"] = errs
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+		return
+	}
+	*valid = true
+}
+
+// CapacityWeightsLogicalValidator makes sure capacity header comes with
+// positive LowWatermark
+func (c *YamlConfig) CapacityWeightsLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	conf := c.CapacityWeights
+	var errs []error
+	if conf.Header != "" && conf.LowWatermark.SizeInBytes <= 0 {
+		errs = append(errs, errors.New("CapacityWeights requires positive LowWatermark"))
+	}
+	if conf.Window.Duration < 0 {
+		errs = append(errs, errors.New("CapacityWeights Window can't be negative"))
+	}
+	if len(errs) > 0 {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["CapacityWeightsLogicalValidator"] = errs
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+		return
+	}
+	*valid = true
+}
+
+// RequireContentLengthLogicalValidator checks if RequireContentLength lists
+// configured backends
+func (c *YamlConfig) RequireContentLengthLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	backends := c.clusterBackendHosts()
+	var errs []error
+	for _, backend := range c.RequireContentLength {
+		if !backends[backend] {
+			errs = append(errs, fmt.Errorf("RequireContentLength entry for unknown backend %s", backend))
+		}
+	}
+	if len(errs) > 0 {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["RequireContentLengthLogicalValidator"] = errs
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+		return
+	}
+	*valid = true
+}
+
+// AutoMultipartLogicalValidator checks if part size of automatic multipart
+// uploads is accepted by backends
+func (c *YamlConfig) AutoMultipartLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	partSize := c.AutoMultipartPartSize.SizeInBytes
+	if c.AutoMultipartThreshold.SizeInBytes > 0 && partSize != 0 && partSize < httphandlerconfig.MinAutoMultipartPartSize {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["AutoMultipartLogicalValidator"] = []error{
+			fmt.Errorf("AutoMultipartPartSize should be at least %d bytes, got %d",
+				httphandlerconfig.MinAutoMultipartPartSize, partSize)}
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+		return
+	}
+	*valid = true
+}
+
+// AuthoritativeBackendLogicalValidator checks if AuthoritativeBackend is
+// one of configured backends
+func (c *YamlConfig) AuthoritativeBackendLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	if c.AuthoritativeBackend != "" && !c.clusterBackendHosts()[c.AuthoritativeBackend] {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["AuthoritativeBackendLogicalValidator"] = []error{
+			fmt.Errorf("AuthoritativeBackend %s is not configured in any cluster", c.AuthoritativeBackend)}
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+		return
+	}
+	*valid = true
+}
+
+// AdaptiveThrottlingLogicalValidator checks if concurrency limits are
+// consistent and DecreaseFactor lowers the limit
+func (c *YamlConfig) AdaptiveThrottlingLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	conf := c.AdaptiveThrottling
+	var errs []error
+	if conf.DecreaseFactor < 0 || conf.DecreaseFactor >= 1 {
+		errs = append(errs, fmt.Errorf("AdaptiveThrottling DecreaseFactor has to be in range (0, 1)"))
+	}
+	if conf.MaxConcurrency > 0 && conf.MinConcurrency > conf.MaxConcurrency {
+		errs = append(errs, fmt.Errorf("AdaptiveThrottling MinConcurrency can't exceed MaxConcurrency"))
+	}
+	if len(errs) > 0 {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["AdaptiveThrottlingLogicalValidator"] = errs
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+		return
+	}
+	*valid = true
+}
+
+// AllowedMethodsLogicalValidator checks if allowed methods are HTTP methods
+func (c *YamlConfig) AllowedMethodsLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	var errs []error
+	for _, method := range c.AllowedMethods {
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+			http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		default:
+			errs = append(errs, fmt.Errorf("AllowedMethods entry %q is not HTTP method", method))
+		}
+	}
+	if len(errs) > 0 {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["AllowedMethodsLogicalValidator"] = errs
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+		return
+	}
+	*valid = true
+}
+
+// MetricsLatencyBucketsLogicalValidator checks if latency bucket bounds are
+// positive and ascending
+func (c *YamlConfig) MetricsLatencyBucketsLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	var errs []error
+	for i, bucket := range c.MetricsLatencyBuckets {
+		if bucket.Duration <= 0 {
+			errs = append(errs, fmt.Errorf("MetricsLatencyBuckets entry %s has to be positive", bucket.Duration))
+		} else if i > 0 && bucket.Duration <= c.MetricsLatencyBuckets[i-1].Duration {
+			errs = append(errs, fmt.Errorf("MetricsLatencyBuckets entry %s has to be greater than %s",
+				bucket.Duration, c.MetricsLatencyBuckets[i-1].Duration))
+		}
+	}
+	if len(errs) > 0 {
+		*valid = false
+		errorsList := make(map[string][]error)
+		errorsList["MetricsLatencyBucketsLogicalValidator"] = errs
+		*validationErrors = mergeErrors(*validationErrors, errorsList)
+		return
+	}
+	*valid = true
+}
+
 func mergeErrors(maps ...map[string][]error) (output map[string][]error) {
 	size := len(maps)
 	if size == 0 {
@@ -127,8 +762,47 @@ func mergeErrors(maps ...map[string][]error) (output map[string][]error) {
 	return output
 }
 
-// RequestHeaderContentLengthValidator for Content-Length header in request
+// DecodedContentLengthHeader holds object length of aws-chunked upload, its
+// Content-Length includes chunk signatures
+const DecodedContentLengthHeader = "X-Amz-Decoded-Content-Length"
+
+// IsAWSChunked tells if request body is aws-chunked encoded (streaming
+// SigV4 upload)
+func IsAWSChunked(req http.Request) bool {
+	if strings.HasPrefix(req.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return true
+	}
+	for _, encoding := range strings.Split(req.Header.Get("Content-Encoding"), ",") {
+		if strings.EqualFold(strings.TrimSpace(encoding), "aws-chunked") {
+			return true
+		}
+	}
+	return false
+}
+
+// DecodedContentLength returns object length of aws-chunked upload, ok is
+// false if request is not aws-chunked or its decoded length is invalid
+func DecodedContentLength(req http.Request) (length int64, ok bool) {
+	if !IsAWSChunked(req) {
+		return 0, false
+	}
+	length, err := strconv.ParseInt(req.Header.Get(DecodedContentLengthHeader), 10, 64)
+	return length, err == nil && length >= 0
+}
+
+// RequestHeaderContentLengthValidator for Content-Length header in request,
+// object length of aws-chunked upload is checked instead of its encoded body
 func RequestHeaderContentLengthValidator(req http.Request, bodyMaxSize int64) int {
+	if IsAWSChunked(req) {
+		decodedLength, ok := DecodedContentLength(req)
+		if !ok {
+			return http.StatusBadRequest
+		}
+		if decodedLength > bodyMaxSize {
+			return http.StatusRequestEntityTooLarge
+		}
+		return 0
+	}
 	var contentLength int64
 	contentLengthHeader := req.Header.Get("Content-Length")
 	if contentLengthHeader != "" {
@@ -144,6 +818,17 @@ func RequestHeaderContentLengthValidator(req http.Request, bodyMaxSize int64) in
 	return 0
 }
 
+// RequestHeaderExpectValidator for Expect header in request, 100-continue is
+// the only expectation defined (RFC 7231 section 5.1.1)
+func RequestHeaderExpectValidator(req http.Request) int {
+	for _, expect := range req.Header["Expect"] {
+		if !strings.EqualFold(strings.TrimSpace(expect), "100-continue") {
+			return http.StatusExpectationFailed
+		}
+	}
+	return 0
+}
+
 // RequestHeaderContentTypeValidator for Content-Type header in request
 func RequestHeaderContentTypeValidator(req http.Request, requiredContentType string) int {
 	contentTypeHeader := req.Header.Get("Content-Type")
@@ -2,12 +2,16 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"net/http"
 	"net/http/httptest"
 
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+	"github.com/allegro/akubra/metrics"
 	shardingconfig "github.com/allegro/akubra/sharding/config"
 	"github.com/go-validator/validator"
+	gometrics "github.com/rcrowley/go-metrics"
 
 	"errors"
 
@@ -118,6 +122,32 @@ func TestShouldNotPassHeaderContentLengthValidatorAndReturnBadRequestOnUnparsabl
 	assert.Equal(t, http.StatusBadRequest, result)
 }
 
+func TestHeaderContentLengthValidatorChecksDecodedLengthOfAWSChunkedUpload(t *testing.T) {
+	var bodySizeLimit int64 = 1024
+	for _, testData := range []struct {
+		contentSha256 string
+		encoding      string
+		decodedLength string
+		expected      int
+	}{
+		// signatures make encoded body larger than object
+		{"STREAMING-AWS4-HMAC-SHA256-PAYLOAD", "", "1024", 0},
+		{"", "aws-chunked", "1024", 0},
+		{"STREAMING-AWS4-HMAC-SHA256-PAYLOAD", "aws-chunked,gzip", "1025", http.StatusRequestEntityTooLarge},
+		{"STREAMING-AWS4-HMAC-SHA256-PAYLOAD", "", "", http.StatusBadRequest},
+		{"STREAMING-AWS4-HMAC-SHA256-PAYLOAD", "", "-1", http.StatusBadRequest},
+		{"UNSIGNED-PAYLOAD", "", "", http.StatusRequestEntityTooLarge},
+	} {
+		request := httptest.NewRequest("PUT", "http://somepath", nil)
+		request.Header.Set("Content-Length", "1200")
+		request.Header.Set("X-Amz-Content-Sha256", testData.contentSha256)
+		request.Header.Set("Content-Encoding", testData.encoding)
+		request.Header.Set(DecodedContentLengthHeader, testData.decodedLength)
+		result := RequestHeaderContentLengthValidator(*request, bodySizeLimit)
+		assert.Equal(t, testData.expected, result, "%+v", testData)
+	}
+}
+
 func TestShouldPassRequestHeaderContentTypeValidator(t *testing.T) {
 	requiredContentType := "application/yaml"
 	request := httptest.NewRequest("POST", "http://somepath", nil)
@@ -247,3 +277,570 @@ func TestValidatorShouldFailWithMissingClusterDefinition(t *testing.T) {
 		errors.New("No clusters defined for region \"testregion\""),
 		validationErrors["RegionsEntryLogicalValidator"][0])
 }
+
+func TestValidatorShouldFailWithProtectedAdditionalResponseHeader(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", nil)
+	yamlConfig.AdditionalResponseHeaders["content-type"] = "text/plain"
+	valid := true
+	validationErrors := make(map[string][]error)
+
+	yamlConfig.AdditionalResponseHeadersLogicalValidator(&valid, &validationErrors)
+
+	assert.False(t, valid)
+	assert.Equal(
+		t,
+		errors.New("Header \"content-type\" is protected, set AllowOverrideProtectedHeaders to use it in AdditionalResponseHeaders"),
+		validationErrors["AdditionalResponseHeadersLogicalValidator"][0])
+}
+
+func TestValidatorShouldPassWithProtectedAdditionalResponseHeaderWhenOverrideAllowed(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", nil)
+	yamlConfig.AdditionalResponseHeaders["Content-Length"] = "0"
+	yamlConfig.AllowOverrideProtectedHeaders = true
+	valid := false
+	validationErrors := make(map[string][]error)
+
+	yamlConfig.AdditionalResponseHeadersLogicalValidator(&valid, &validationErrors)
+
+	assert.True(t, valid)
+	assert.Empty(t, validationErrors["AdditionalResponseHeadersLogicalValidator"])
+}
+
+func TestValidatorShouldFailWithTooBigAdditionalResponseHeaders(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", nil)
+	yamlConfig.AdditionalResponseHeadersMaxSize = shardingconfig.HumanSizeUnits{SizeInBytes: 16}
+	valid := true
+	validationErrors := make(map[string][]error)
+
+	yamlConfig.AdditionalResponseHeadersLogicalValidator(&valid, &validationErrors)
+
+	assert.False(t, valid)
+	assert.Len(t, validationErrors["AdditionalResponseHeadersLogicalValidator"], 1)
+}
+
+func TestValidatorShouldFailWithInvalidBackendTLSServerName(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", nil)
+	yamlConfig.BackendTLSServerNames = map[string]string{
+		"127.0.0.1:9001": "s3.internal.example.com",
+		"127.0.0.1:9002": "not a hostname",
+	}
+	valid := true
+	validationErrors := make(map[string][]error)
+
+	yamlConfig.BackendTLSServerNamesLogicalValidator(&valid, &validationErrors)
+
+	assert.False(t, valid)
+	assert.Len(t, validationErrors["BackendTLSServerNamesLogicalValidator"], 1)
+}
+
+func TestValidatorShouldFailWithInvalidBackendHealthChecks(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	for _, testData := range []struct {
+		name   string
+		checks map[string]shardingconfig.HealthCheckConfig
+		errors int
+	}{
+		{"valid check", map[string]shardingconfig.HealthCheckConfig{
+			"127.0.0.1:8080": {Method: "GET", Path: "/healthz", ExpectedStatus: 204}}, 0},
+		{"unknown backend", map[string]shardingconfig.HealthCheckConfig{
+			"127.0.0.1:9001": {Path: "/healthz"}}, 1},
+		{"writing method", map[string]shardingconfig.HealthCheckConfig{
+			"127.0.0.1:8080": {Method: "PUT"}}, 1},
+		{"relative path and invalid status", map[string]shardingconfig.HealthCheckConfig{
+			"127.0.0.1:8080": {Path: "healthz", ExpectedStatus: 2000}}, 2},
+	} {
+		yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", nil)
+		yamlConfig.BackendHealthChecks = testData.checks
+		valid := false
+		validationErrors := make(map[string][]error)
+
+		yamlConfig.BackendHealthChecksLogicalValidator(&valid, &validationErrors)
+
+		assert.Equal(t, testData.errors == 0, valid, testData.name)
+		assert.Len(t, validationErrors["BackendHealthChecksLogicalValidator"], testData.errors, testData.name)
+	}
+}
+
+func TestValidatorShouldFailWithUnknownAllowedMethod(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", nil)
+	yamlConfig.AllowedMethods = []string{"GET", "get", "PUT", "PURGE"}
+	valid := true
+	validationErrors := make(map[string][]error)
+
+	yamlConfig.AllowedMethodsLogicalValidator(&valid, &validationErrors)
+
+	assert.False(t, valid)
+	assert.Len(t, validationErrors["AllowedMethodsLogicalValidator"], 2)
+}
+
+func TestValidatorShouldFailWithUnknownNormalizeBucketRootMode(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", nil)
+	yamlConfig.NormalizeBucketRoot = "remove"
+	valid := true
+	validationErrors := make(map[string][]error)
+
+	yamlConfig.NormalizeBucketRootLogicalValidator(&valid, &validationErrors)
+
+	assert.False(t, valid)
+	assert.Len(t, validationErrors["NormalizeBucketRootLogicalValidator"], 1)
+}
+
+func TestValidatorShouldFailWithUnknownViaHeaderMode(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", nil)
+	yamlConfig.ViaHeader = "hide"
+	valid := true
+	validationErrors := make(map[string][]error)
+
+	yamlConfig.ViaHeaderLogicalValidator(&valid, &validationErrors)
+
+	assert.False(t, valid)
+	assert.Len(t, validationErrors["ViaHeaderLogicalValidator"], 1)
+}
+
+func TestValidatorShouldFailWithInvalidAutoReconcile(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	for _, testData := range []struct {
+		autoReconcile           shardingconfig.AutoReconcileConfig
+		consistentPreconditions bool
+		errorsCount             int
+	}{
+		{shardingconfig.AutoReconcileConfig{Enabled: false, Policy: "oldest"}, false, 0},
+		{shardingconfig.AutoReconcileConfig{Enabled: true}, true, 0},
+		{shardingconfig.AutoReconcileConfig{Enabled: true, Policy: shardingconfig.ReconcileMajority}, true, 0},
+		{shardingconfig.AutoReconcileConfig{Enabled: true, Policy: "oldest"}, true, 1},
+		{shardingconfig.AutoReconcileConfig{Enabled: true, Policy: "oldest"}, false, 2},
+	} {
+		yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", nil)
+		yamlConfig.AutoReconcile = testData.autoReconcile
+		yamlConfig.ConsistentPreconditions = testData.consistentPreconditions
+		valid := false
+		validationErrors := make(map[string][]error)
+
+		yamlConfig.AutoReconcileLogicalValidator(&valid, &validationErrors)
+
+		assert.Equal(t, testData.errorsCount == 0, valid, "%v", testData)
+		assert.Len(t, validationErrors["AutoReconcileLogicalValidator"], testData.errorsCount, "%v", testData)
+	}
+}
+
+func TestValidatorShouldFailWithReadFanoutAndSequentialRetries(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	for _, testData := range []struct {
+		readFanout     int
+		acrossBackends bool
+		valid          bool
+	}{
+		{0, true, true},
+		{2, false, true},
+		{2, true, false},
+	} {
+		yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", nil)
+		yamlConfig.ReadFanout = testData.readFanout
+		yamlConfig.Retries.AcrossBackends = testData.acrossBackends
+		valid := false
+		validationErrors := make(map[string][]error)
+
+		yamlConfig.ReadFanoutLogicalValidator(&valid, &validationErrors)
+
+		assert.Equal(t, testData.valid, valid, "%v", testData)
+	}
+}
+
+func TestValidatorShouldFailWithUnknownRewriteXMLOperation(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	for _, testData := range []struct {
+		operations []string
+		valid      bool
+	}{
+		{nil, true},
+		{[]string{httphandlerconfig.CompleteMultipartUpload, httphandlerconfig.PostObject}, true},
+		{[]string{httphandlerconfig.CompleteMultipartUpload, "ListObjects"}, false},
+	} {
+		yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", nil)
+		yamlConfig.RewriteXMLOperations = testData.operations
+		valid := false
+		validationErrors := make(map[string][]error)
+
+		yamlConfig.RewriteXMLOperationsLogicalValidator(&valid, &validationErrors)
+
+		assert.Equal(t, testData.valid, valid, "%v", testData)
+	}
+}
+
+func validationMeterCount(name string) int64 {
+	if meter, ok := gometrics.Get(name).(gometrics.Meter); ok {
+		return meter.Count()
+	}
+	return 0
+}
+
+func TestValidateConfShouldCountValidationOutcomes(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	regions := map[string]shardingconfig.RegionConfig{"region": {}}
+	yamlConfig := PrepareYamlConfig(size, 21, 32, "127.0.0.1:85", ":80", ":81", regions)
+	okBefore := validationMeterCount("config.validation.ok")
+	failedBefore := validationMeterCount("config.validation.failed")
+	reasonBefore := validationMeterCount("config.validation.failed.listen")
+
+	valid, _ := ValidateConf(yamlConfig, false)
+	assert.True(t, valid)
+	yamlConfig.Listen = "aaa"
+	valid, _ = ValidateConf(yamlConfig, false)
+	assert.False(t, valid)
+
+	assert.Equal(t, okBefore+1, validationMeterCount("config.validation.ok"))
+	assert.Equal(t, failedBefore+1, validationMeterCount("config.validation.failed"))
+	assert.Equal(t, reasonBefore+1, validationMeterCount("config.validation.failed.listen"))
+	lastOK, ok := gometrics.Get("config.validation.last_ok").(gometrics.Gauge)
+	assert.True(t, ok)
+	assert.NotZero(t, lastOK.Value())
+}
+
+func TestValidatorShouldFailWithInvalidBackendRateLimits(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	for _, testData := range []struct {
+		name   string
+		limits map[string]shardingconfig.RateLimitConfig
+		errors int
+	}{
+		{"valid limit", map[string]shardingconfig.RateLimitConfig{
+			"127.0.0.1:8080": {RequestsPerSecond: 10, Burst: 20}}, 0},
+		{"unknown backend", map[string]shardingconfig.RateLimitConfig{
+			"127.0.0.1:9001": {RequestsPerSecond: 10}}, 1},
+		{"no requests allowed", map[string]shardingconfig.RateLimitConfig{
+			"127.0.0.1:8080": {RequestsPerSecond: 0, Burst: -1}}, 2},
+	} {
+		yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", nil)
+		yamlConfig.BackendRateLimits = testData.limits
+		valid := false
+		validationErrors := make(map[string][]error)
+
+		yamlConfig.BackendRateLimitsLogicalValidator(&valid, &validationErrors)
+
+		assert.Equal(t, testData.errors == 0, valid, testData.name)
+		assert.Len(t, validationErrors["BackendRateLimitsLogicalValidator"], testData.errors, testData.name)
+	}
+}
+
+func TestValidatorShouldFailWithInvalidAdaptiveThrottling(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	for _, testData := range []struct {
+		name   string
+		conf   shardingconfig.AdaptiveThrottlingConfig
+		errors int
+	}{
+		{"defaults", shardingconfig.AdaptiveThrottlingConfig{Enabled: true}, 0},
+		{"valid limits", shardingconfig.AdaptiveThrottlingConfig{Enabled: true, MaxConcurrency: 10, MinConcurrency: 2, DecreaseFactor: 0.7}, 0},
+		{"factor not decreasing", shardingconfig.AdaptiveThrottlingConfig{Enabled: true, DecreaseFactor: 1.5}, 1},
+		{"min above max", shardingconfig.AdaptiveThrottlingConfig{Enabled: true, MaxConcurrency: 2, MinConcurrency: 5, DecreaseFactor: -1}, 2},
+	} {
+		yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", nil)
+		yamlConfig.AdaptiveThrottling = testData.conf
+		valid := false
+		validationErrors := make(map[string][]error)
+
+		yamlConfig.AdaptiveThrottlingLogicalValidator(&valid, &validationErrors)
+
+		assert.Equal(t, testData.errors == 0, valid, testData.name)
+		assert.Len(t, validationErrors["AdaptiveThrottlingLogicalValidator"], testData.errors, testData.name)
+	}
+}
+
+func TestValidatorShouldFailWithUntrustedTimeoutOverride(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	for _, testData := range []struct {
+		name     string
+		networks []string
+		token    string
+		errors   int
+	}{
+		{"trusted networks", []string{"10.0.0.0/8", "fd00::/8"}, "", 0},
+		{"admin token", nil, "secret", 0},
+		{"nobody trusted", nil, "", 1},
+		{"invalid network", []string{"10.0.0.1"}, "secret", 1},
+	} {
+		yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", nil)
+		yamlConfig.MaxTimeoutOverride = metrics.Interval{Duration: time.Hour}
+		yamlConfig.TrustedNetworks = testData.networks
+		yamlConfig.AdminToken = testData.token
+		valid := false
+		validationErrors := make(map[string][]error)
+
+		yamlConfig.TimeoutOverrideLogicalValidator(&valid, &validationErrors)
+
+		assert.Equal(t, testData.errors == 0, valid, testData.name)
+		assert.Len(t, validationErrors["TimeoutOverrideLogicalValidator"], testData.errors, testData.name)
+	}
+}
+
+func TestValidatorShouldFailWithInvalidClusterDiscovery(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	for _, testData := range []struct {
+		name      string
+		srv       shardingconfig.SRVConfig
+		withHosts bool
+		errors    int
+	}{
+		{"static backends", shardingconfig.SRVConfig{}, true, 0},
+		{"srv record", shardingconfig.SRVConfig{Record: "_s3._tcp.storage.internal", Scheme: "https"}, false, 0},
+		{"srv record with static backends", shardingconfig.SRVConfig{Record: "_s3._tcp.storage.internal"}, true, 1},
+		{"invalid scheme", shardingconfig.SRVConfig{Record: "_s3._tcp.storage.internal", Scheme: "ftp"}, false, 1},
+	} {
+		yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", nil)
+		for name, clusterConf := range yamlConfig.Clusters {
+			clusterConf.SRV = testData.srv
+			if !testData.withHosts {
+				clusterConf.Backends = nil
+			}
+			yamlConfig.Clusters[name] = clusterConf
+		}
+		valid := false
+		validationErrors := make(map[string][]error)
+
+		yamlConfig.ClusterDiscoveryLogicalValidator(&valid, &validationErrors)
+
+		assert.Equal(t, testData.errors == 0, valid, testData.name)
+		assert.Len(t, validationErrors["ClusterDiscoveryLogicalValidator"], testData.errors, testData.name)
+	}
+}
+
+func TestValidatorShouldFailWithUnknownAuthoritativeBackend(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	for _, testData := range []struct {
+		backend string
+		valid   bool
+	}{
+		{"", true},
+		{"127.0.0.1:8080", true},
+		{"127.0.0.1:9999", false},
+	} {
+		yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", nil)
+		yamlConfig.AuthoritativeBackend = testData.backend
+		valid := false
+		validationErrors := make(map[string][]error)
+
+		yamlConfig.AuthoritativeBackendLogicalValidator(&valid, &validationErrors)
+
+		assert.Equal(t, testData.valid, valid, testData.backend)
+	}
+}
+
+func TestValidatorShouldFailWithCapacityWeightsWithoutLowWatermark(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	for _, testData := range []struct {
+		name   string
+		conf   shardingconfig.CapacityWeightsConfig
+		errors int
+	}{
+		{"disabled", shardingconfig.CapacityWeightsConfig{}, 0},
+		{"enabled", shardingconfig.CapacityWeightsConfig{Header: "X-Storage-Free-Bytes", LowWatermark: size}, 0},
+		{"no low watermark", shardingconfig.CapacityWeightsConfig{Header: "X-Storage-Free-Bytes"}, 1},
+		{"negative window", shardingconfig.CapacityWeightsConfig{Header: "X-Storage-Free-Bytes", LowWatermark: size,
+			Window: metrics.Interval{Duration: -time.Second}}, 1},
+	} {
+		yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", nil)
+		yamlConfig.CapacityWeights = testData.conf
+		valid := false
+		validationErrors := make(map[string][]error)
+
+		yamlConfig.CapacityWeightsLogicalValidator(&valid, &validationErrors)
+
+		assert.Equal(t, testData.errors == 0, valid, testData.name)
+		assert.Len(t, validationErrors["CapacityWeightsLogicalValidator"], testData.errors, testData.name)
+	}
+}
+
+func TestValidatorShouldFailWithInvalidAuditWebhook(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	for _, testData := range []struct {
+		webhookURL string
+		valid      bool
+	}{
+		{"", true},
+		{"https://audit.internal/akubra", true},
+		{"audit.internal/akubra", false},
+		{"ftp://audit.internal", false},
+	} {
+		yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", nil)
+		yamlConfig.Audit = httphandlerconfig.AuditConfig{WebhookURL: testData.webhookURL}
+		valid := false
+		validationErrors := make(map[string][]error)
+
+		yamlConfig.AuditLogicalValidator(&valid, &validationErrors)
+
+		assert.Equal(t, testData.valid, valid, testData.webhookURL)
+	}
+}
+
+func TestValidatorShouldFailWithTooSmallAutoMultipartPartSize(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	for _, testData := range []struct {
+		threshold int64
+		partSize  int64
+		valid     bool
+	}{
+		{0, 0, true},
+		{0, 1 << 20, true},
+		{5 << 30, 0, true},
+		{5 << 30, 5 << 20, true},
+		{5 << 30, 1 << 20, false},
+	} {
+		yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", nil)
+		yamlConfig.AutoMultipartThreshold.SizeInBytes = testData.threshold
+		yamlConfig.AutoMultipartPartSize.SizeInBytes = testData.partSize
+		valid := false
+		validationErrors := make(map[string][]error)
+
+		yamlConfig.AutoMultipartLogicalValidator(&valid, &validationErrors)
+
+		assert.Equal(t, testData.valid, valid, "threshold %d part size %d", testData.threshold, testData.partSize)
+	}
+}
+
+func TestValidatorShouldFailWithUnknownRequireContentLengthBackend(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	for _, testData := range []struct {
+		backends []string
+		valid    bool
+	}{
+		{nil, true},
+		{[]string{"127.0.0.1:8080"}, true},
+		{[]string{"127.0.0.1:8080", "127.0.0.1:9999"}, false},
+	} {
+		yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", nil)
+		yamlConfig.RequireContentLength = testData.backends
+		valid := false
+		validationErrors := make(map[string][]error)
+
+		yamlConfig.RequireContentLengthLogicalValidator(&valid, &validationErrors)
+
+		assert.Equal(t, testData.valid, valid, testData.backends)
+	}
+}
+
+func TestValidatorShouldFailWithNotAscendingMetricsLatencyBuckets(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	for _, testData := range []struct {
+		buckets []time.Duration
+		valid   bool
+	}{
+		{nil, true},
+		{[]time.Duration{time.Second, time.Minute, 10 * time.Minute}, true},
+		{[]time.Duration{time.Minute, time.Second}, false},
+		{[]time.Duration{time.Second, time.Second}, false},
+		{[]time.Duration{0, time.Second}, false},
+	} {
+		yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", nil)
+		for _, bucket := range testData.buckets {
+			yamlConfig.MetricsLatencyBuckets = append(yamlConfig.MetricsLatencyBuckets, metrics.Interval{Duration: bucket})
+		}
+		valid := false
+		validationErrors := make(map[string][]error)
+
+		yamlConfig.MetricsLatencyBucketsLogicalValidator(&valid, &validationErrors)
+
+		assert.Equal(t, testData.valid, valid, testData.buckets)
+	}
+}
+
+func TestValidatorShouldFailWithInvalidBackendRetries(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	for _, testData := range []struct {
+		backend string
+		retries shardingconfig.BackendRetryConfig
+		valid   bool
+	}{
+		{"127.0.0.1:8080", shardingconfig.BackendRetryConfig{Attempts: 2}, true},
+		{"127.0.0.1:8080", shardingconfig.BackendRetryConfig{}, true},
+		{"127.0.0.1:9999", shardingconfig.BackendRetryConfig{Attempts: 2}, false},
+		{"127.0.0.1:8080", shardingconfig.BackendRetryConfig{Attempts: -1}, false},
+	} {
+		yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", nil)
+		yamlConfig.BackendRetries = map[string]shardingconfig.BackendRetryConfig{testData.backend: testData.retries}
+		valid := false
+		validationErrors := make(map[string][]error)
+
+		yamlConfig.BackendRetriesLogicalValidator(&valid, &validationErrors)
+
+		assert.Equal(t, testData.valid, valid, "%s %+v", testData.backend, testData.retries)
+	}
+}
+
+func TestValidatorShouldFailWithInvalidBackendAddressingStyles(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	for _, testData := range []struct {
+		backend string
+		style   string
+		valid   bool
+	}{
+		{"127.0.0.1:8080", httphandlerconfig.PathStyle, true},
+		{"127.0.0.1:8080", httphandlerconfig.VirtualHostedStyle, true},
+		{"127.0.0.1:9999", httphandlerconfig.VirtualHostedStyle, false},
+		{"127.0.0.1:8080", "virtual", false},
+	} {
+		yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", nil)
+		yamlConfig.BackendAddressingStyles = map[string]string{testData.backend: testData.style}
+		valid := false
+		validationErrors := make(map[string][]error)
+
+		yamlConfig.BackendAddressingStylesLogicalValidator(&valid, &validationErrors)
+
+		assert.Equal(t, testData.valid, valid, "%s %s", testData.backend, testData.style)
+	}
+}
+
+func TestValidatorShouldFailWithInvalidBackendConnLimits(t *testing.T) {
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	for _, testData := range []struct {
+		backend string
+		limit   shardingconfig.ConnLimitConfig
+		valid   bool
+	}{
+		{"127.0.0.1:8080", shardingconfig.ConnLimitConfig{ConnLimit: 10}, true},
+		{"127.0.0.1:8080", shardingconfig.ConnLimitConfig{ConnLimit: 10, LowPriorityShare: 0.5}, true},
+		{"127.0.0.1:9999", shardingconfig.ConnLimitConfig{ConnLimit: 10}, false},
+		{"127.0.0.1:8080", shardingconfig.ConnLimitConfig{}, false},
+		{"127.0.0.1:8080", shardingconfig.ConnLimitConfig{ConnLimit: 10, LowPriorityShare: 1.5}, false},
+	} {
+		yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", nil)
+		yamlConfig.BackendConnLimits = map[string]shardingconfig.ConnLimitConfig{testData.backend: testData.limit}
+		valid := false
+		validationErrors := make(map[string][]error)
+
+		yamlConfig.BackendConnLimitsLogicalValidator(&valid, &validationErrors)
+
+		assert.Equal(t, testData.valid, valid, "%s %+v", testData.backend, testData.limit)
+	}
+}
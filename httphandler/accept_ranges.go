@@ -0,0 +1,35 @@
+package httphandler
+
+import (
+	"net/http"
+)
+
+type acceptRangesAdvertiser struct {
+	roundTripper http.RoundTripper
+}
+
+func (ara *acceptRangesAdvertiser) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := ara.roundTripper.RoundTrip(req)
+	if err != nil || req.Method != http.MethodGet && req.Method != http.MethodHead ||
+		(resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent) {
+		return resp, err
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	resp.Header.Set("Accept-Ranges", "bytes")
+	return resp, nil
+}
+
+// AcceptRangesAdvertiser creates Decorator which sets Accept-Ranges: bytes
+// on successful GET and HEAD responses, so range support probes get the same
+// answer whichever backend responded. Otherwise backend Accept-Ranges is
+// passed unchanged
+func AcceptRangesAdvertiser(force bool) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if !force {
+			return roundTripper
+		}
+		return &acceptRangesAdvertiser{roundTripper: roundTripper}
+	}
+}
@@ -0,0 +1,63 @@
+package httphandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func acceptRangesTransport(force bool, backendAcceptRanges string) (http.RoundTripper, func()) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bucket/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if backendAcceptRanges != "" {
+			w.Header().Set("Accept-Ranges", backendAcceptRanges)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	backendURL, _ := url.Parse(srv.URL)
+	transp := transport.NewMultiTransport(http.DefaultTransport, []url.URL{*backendURL},
+		LateResponseHandler(config.Config{}), transport.MultiTransportOptions{})
+	return AcceptRangesAdvertiser(force)(transp), srv.Close
+}
+
+func TestAcceptRangesOfBackendIsForwarded(t *testing.T) {
+	for _, backendAcceptRanges := range []string{"bytes", "none", ""} {
+		rt, closeBackend := acceptRangesTransport(false, backendAcceptRanges)
+		req, _ := http.NewRequest(http.MethodHead, "http://localhost/bucket/key", nil)
+
+		resp, err := rt.RoundTrip(req)
+
+		assert.NoError(t, err)
+		assert.Equal(t, backendAcceptRanges, resp.Header.Get("Accept-Ranges"))
+		closeBackend()
+	}
+}
+
+func TestAcceptRangesCanBeForced(t *testing.T) {
+	rt, closeBackend := acceptRangesTransport(true, "")
+	defer closeBackend()
+	for _, testData := range []struct {
+		method, path string
+		expected     string
+	}{
+		{http.MethodHead, "/bucket/key", "bytes"},
+		{http.MethodGet, "/bucket/key", "bytes"},
+		{http.MethodHead, "/bucket/missing", ""},
+		{http.MethodPut, "/bucket/key", ""},
+	} {
+		req, _ := http.NewRequest(testData.method, "http://localhost"+testData.path, nil)
+
+		resp, err := rt.RoundTrip(req)
+
+		assert.NoError(t, err)
+		assert.Equal(t, testData.expected, resp.Header.Get("Accept-Ranges"), "%s %s", testData.method, testData.path)
+	}
+}
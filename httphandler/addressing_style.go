@@ -0,0 +1,58 @@
+package httphandler
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+)
+
+// dnsBucketRegexp matches bucket names usable as host label, others are
+// always addressed in path
+var dnsBucketRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,61}[a-z0-9]$`)
+
+type virtualHostedAddresser struct {
+	hosts        map[string]bool
+	roundTripper http.RoundTripper
+}
+
+func (va *virtualHostedAddresser) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !va.hosts[req.URL.Host] {
+		return va.roundTripper.RoundTrip(req)
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	bucket := strings.SplitN(path, "/", 2)[0]
+	if !dnsBucketRegexp.MatchString(bucket) {
+		return va.roundTripper.RoundTrip(req)
+	}
+	rewritten := req.WithContext(req.Context())
+	reqURL := *req.URL
+	reqURL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(path, bucket), "/")
+	if reqURL.RawPath != "" {
+		reqURL.RawPath = "/" + strings.TrimPrefix(strings.TrimPrefix(strings.TrimPrefix(reqURL.RawPath, "/"), bucket), "/")
+	}
+	rewritten.URL = &reqURL
+	rewritten.Host = bucket + "." + req.URL.Host
+	return va.roundTripper.RoundTrip(rewritten)
+}
+
+// BackendAddressingStyles creates Decorator which addresses bucket in Host
+// header of requests to backends (keyed by host) using
+// httphandlerconfig.VirtualHostedStyle, connections still go to configured
+// backend address. Other backends get path style requests unchanged, so do
+// requests without bucket or with bucket name which is not valid host label
+func BackendAddressingStyles(styles map[string]string) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		hosts := make(map[string]bool, len(styles))
+		for host, style := range styles {
+			if style == httphandlerconfig.VirtualHostedStyle {
+				hosts[host] = true
+			}
+		}
+		if len(hosts) == 0 {
+			return roundTripper
+		}
+		return &virtualHostedAddresser{hosts: hosts, roundTripper: roundTripper}
+	}
+}
@@ -0,0 +1,72 @@
+package httphandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+	"github.com/allegro/akubra/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type addressingRecorder struct {
+	mx      sync.Mutex
+	hosts   []string
+	targets []string
+}
+
+func (ar *addressingRecorder) backend() url.URL {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ar.mx.Lock()
+		defer ar.mx.Unlock()
+		ar.hosts = append(ar.hosts, r.Host)
+		ar.targets = append(ar.targets, r.URL.RequestURI())
+	}))
+	tsURL, _ := url.Parse(ts.URL)
+	return *tsURL
+}
+
+func (ar *addressingRecorder) requests() int {
+	ar.mx.Lock()
+	defer ar.mx.Unlock()
+	return len(ar.hosts)
+}
+
+func TestBackendAddressingStylesRewriteRequestsPerBackend(t *testing.T) {
+	for _, testData := range []struct {
+		target        string
+		virtualHost   string
+		virtualTarget string
+	}{
+		{"/bucket/dir/key?uploads", "bucket.", "/dir/key?uploads"},
+		{"/bucket", "bucket.", "/"},
+		{"/bucket/", "bucket.", "/"},
+		{"/Upper.Case/key", "", "/Upper.Case/key"},
+	} {
+		pathRecorder, virtualRecorder := &addressingRecorder{}, &addressingRecorder{}
+		pathBackend, virtualBackend := pathRecorder.backend(), virtualRecorder.backend()
+		rt := BackendAddressingStyles(map[string]string{
+			pathBackend.Host:    httphandlerconfig.PathStyle,
+			virtualBackend.Host: httphandlerconfig.VirtualHostedStyle,
+		})(http.DefaultTransport)
+		transp := transport.NewMultiTransport(rt, []url.URL{pathBackend, virtualBackend}, nil,
+			transport.MultiTransportOptions{})
+
+		req, _ := http.NewRequest(http.MethodPut, "http://akubra.example.com"+testData.target, strings.NewReader("data"))
+		resp, err := transp.RoundTrip(req)
+		require.NoError(t, err, testData.target)
+		require.NoError(t, resp.Body.Close())
+		waitFor(t, func() bool { return pathRecorder.requests() == 1 && virtualRecorder.requests() == 1 },
+			"request should be replicated to both backends")
+
+		assert.Equal(t, []string{pathBackend.Host}, pathRecorder.hosts, testData.target)
+		assert.Equal(t, []string{testData.target}, pathRecorder.targets, testData.target)
+		assert.Equal(t, []string{testData.virtualHost + virtualBackend.Host}, virtualRecorder.hosts, testData.target)
+		assert.Equal(t, []string{testData.virtualTarget}, virtualRecorder.targets, testData.target)
+	}
+}
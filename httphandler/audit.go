@@ -0,0 +1,136 @@
+package httphandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+const (
+	// DefaultAuditBufferSize is used if Audit.BufferSize is not set
+	DefaultAuditBufferSize = 1000
+	// DefaultAuditTimeout is used if Audit.Timeout is not set
+	DefaultAuditTimeout = 5 * time.Second
+)
+
+// AuditEvent summarizes mutating client request
+type AuditEvent struct {
+	Method     string `json:"method"`
+	Host       string `json:"host"`
+	Path       string `json:"path"`
+	ClientIP   string `json:"clientip"`
+	ReqID      string `json:"reqID"`
+	StatusCode int    `json:"status"`
+	Error      string `json:"error,omitempty"`
+	Time       string `json:"ts"`
+}
+
+// webhookAuditSink posts audit events to webhook one by one, events which
+// do not fit in buffer are dropped
+type webhookAuditSink struct {
+	url    string
+	client *http.Client
+	events chan AuditEvent
+}
+
+func newWebhookAuditSink(conf httphandlerconfig.AuditConfig) *webhookAuditSink {
+	bufferSize := conf.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = DefaultAuditBufferSize
+	}
+	timeout := conf.Timeout.Duration
+	if timeout <= 0 {
+		timeout = DefaultAuditTimeout
+	}
+	sink := &webhookAuditSink{
+		url:    conf.WebhookURL,
+		client: &http.Client{Timeout: timeout},
+		events: make(chan AuditEvent, bufferSize),
+	}
+	go sink.deliver()
+	return sink
+}
+
+func (sink *webhookAuditSink) send(event AuditEvent) {
+	select {
+	case sink.events <- event:
+	default:
+		metrics.Mark("audit.dropped")
+	}
+}
+
+func (sink *webhookAuditSink) deliver() {
+	for event := range sink.events {
+		since := time.Now()
+		if err := sink.post(event); err != nil {
+			metrics.Mark("audit.errors")
+			log.Debugf("Cannot deliver audit event of request %s: %s", event.ReqID, err)
+			continue
+		}
+		metrics.UpdateSince("audit.delivered", since)
+	}
+}
+
+func (sink *webhookAuditSink) post(event AuditEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := sink.client.Post(sink.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	discardResponseBody(resp)
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+type auditRoundTripper struct {
+	sink         *webhookAuditSink
+	roundTripper http.RoundTripper
+}
+
+func (art *auditRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isReadMethod(req.Method) {
+		return art.roundTripper.RoundTrip(req)
+	}
+	resp, err := art.roundTripper.RoundTrip(req)
+	event := AuditEvent{
+		Method:     req.Method,
+		Host:       req.Host,
+		Path:       req.URL.Path,
+		StatusCode: http.StatusServiceUnavailable,
+		Time:       time.Now().Format(time.RFC3339Nano),
+	}
+	event.ClientIP, _, _ = net.SplitHostPort(req.RemoteAddr)
+	event.ReqID, _ = req.Context().Value(log.ContextreqIDKey).(string)
+	if resp != nil {
+		event.StatusCode = resp.StatusCode
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	art.sink.send(event)
+	return resp, err
+}
+
+// AuditWebhook creates Decorator which posts summary of every mutating
+// request (PUT, POST, DELETE) to webhook asynchronously. Empty WebhookURL
+// disables it
+func AuditWebhook(conf httphandlerconfig.AuditConfig) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if conf.WebhookURL == "" {
+			return roundTripper
+		}
+		return &auditRoundTripper{sink: newWebhookAuditSink(conf), roundTripper: roundTripper}
+	}
+}
@@ -0,0 +1,102 @@
+package httphandler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+	"github.com/allegro/akubra/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mkAuditWebhook(events chan AuditEvent, release <-chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		event := AuditEvent{}
+		if err := json.NewDecoder(r.Body).Decode(&event); err == nil {
+			events <- event
+		}
+	}))
+}
+
+func sendAudited(t *testing.T, rt http.RoundTripper, method, path string) {
+	req := httptest.NewRequest(method, "http://s3.internal"+path, strings.NewReader(""))
+	req.RemoteAddr = "10.0.0.1:5555"
+	req = req.WithContext(context.WithValue(req.Context(), log.ContextreqIDKey, "req-"+method))
+	_, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+}
+
+func TestAuditWebhookReceivesMutatingRequests(t *testing.T) {
+	events := make(chan AuditEvent, 10)
+	release := make(chan struct{})
+	close(release)
+	webhook := mkAuditWebhook(events, release)
+	defer webhook.Close()
+	rt := AuditWebhook(httphandlerconfig.AuditConfig{WebhookURL: webhook.URL})(
+		roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			status := http.StatusOK
+			if req.Method == http.MethodDelete {
+				status = http.StatusNoContent
+			}
+			return &http.Response{StatusCode: status, Header: http.Header{}}, nil
+		}))
+
+	sendAudited(t, rt, http.MethodGet, "/bucket/key")
+	sendAudited(t, rt, http.MethodPut, "/bucket/key")
+	sendAudited(t, rt, http.MethodDelete, "/bucket/key")
+
+	for _, expected := range []AuditEvent{
+		{Method: http.MethodPut, Host: "s3.internal", Path: "/bucket/key", ClientIP: "10.0.0.1", ReqID: "req-PUT", StatusCode: http.StatusOK},
+		{Method: http.MethodDelete, Host: "s3.internal", Path: "/bucket/key", ClientIP: "10.0.0.1", ReqID: "req-DELETE", StatusCode: http.StatusNoContent},
+	} {
+		select {
+		case event := <-events:
+			assert.NotEmpty(t, event.Time)
+			event.Time = ""
+			assert.Equal(t, expected, event)
+		case <-time.After(time.Second):
+			t.Fatalf("audit event of %s not delivered", expected.Method)
+		}
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected audit event %v", event)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestAuditWebhookDropsEventsAboveBuffer(t *testing.T) {
+	events := make(chan AuditEvent, 10)
+	release := make(chan struct{})
+	webhook := mkAuditWebhook(events, release)
+	defer webhook.Close()
+	rt := AuditWebhook(httphandlerconfig.AuditConfig{WebhookURL: webhook.URL, BufferSize: 1})(
+		roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}, nil
+		}))
+	dropped := meterCount("audit.dropped")
+
+	// first event is being delivered, second waits in buffer
+	sendAudited(t, rt, http.MethodPut, "/bucket/key")
+	waitFor(t, func() bool { return len(rt.(*auditRoundTripper).sink.events) == 0 }, "first event should be taken for delivery")
+	for i := 0; i < 3; i++ {
+		sendAudited(t, rt, http.MethodPut, "/bucket/key")
+	}
+	close(release)
+
+	assert.Equal(t, dropped+2, meterCount("audit.dropped"))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-events:
+		case <-time.After(time.Second):
+			t.Fatal("buffered audit event not delivered")
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package httphandler
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// ErrAccessDenied is returned by Authenticator if request is not authorized
+var ErrAccessDenied = errors.New("access denied")
+
+// Authenticator decides if request may be passed to backends
+type Authenticator interface {
+	Authenticate(*http.Request) error
+}
+
+// NoopAuthenticator accepts all requests
+type NoopAuthenticator struct{}
+
+// Authenticate implements Authenticator
+func (NoopAuthenticator) Authenticate(*http.Request) error {
+	return nil
+}
+
+// BearerTokenAuthenticator accepts requests with
+// "Authorization: Bearer <Token>" header. Header is removed from accepted
+// requests, as backends expect S3 signature there
+type BearerTokenAuthenticator struct {
+	Token string
+}
+
+// Authenticate implements Authenticator
+func (bta BearerTokenAuthenticator) Authenticate(req *http.Request) error {
+	const prefix = "Bearer "
+	authorization := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, prefix) {
+		return ErrAccessDenied
+	}
+	token := strings.TrimPrefix(authorization, prefix)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(bta.Token)) != 1 {
+		return ErrAccessDenied
+	}
+	req.Header.Del("Authorization")
+	return nil
+}
+
+// NewAuthenticator returns BearerTokenAuthenticator if token is set,
+// NoopAuthenticator otherwise
+func NewAuthenticator(token string) Authenticator {
+	if token == "" {
+		return NoopAuthenticator{}
+	}
+	return BearerTokenAuthenticator{Token: token}
+}
+
+type authenticationHandler struct {
+	authenticator Authenticator
+	roundTripper  http.RoundTripper
+}
+
+func (ah *authenticationHandler) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := ah.authenticator.Authenticate(req); err != nil {
+		log.Debugf("Rejected request from %s: %s", req.RemoteAddr, err)
+		metrics.Mark("reqs.global.auth_denied")
+		return s3ErrorResponse(req, http.StatusForbidden, "AccessDenied", err.Error()), nil
+	}
+	return ah.roundTripper.RoundTrip(req)
+}
+
+// Authentication creates Decorator which answers 403 to requests rejected by
+// authenticator. Being regular Decorator it can be stacked with other request
+// filters, e.g. rate limiters or IP filters
+func Authentication(authenticator Authenticator) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if _, noop := authenticator.(NoopAuthenticator); authenticator == nil || noop {
+			return roundTripper
+		}
+		return &authenticationHandler{authenticator: authenticator, roundTripper: roundTripper}
+	}
+}
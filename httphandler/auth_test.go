@@ -0,0 +1,64 @@
+package httphandler
+
+import (
+	"encoding/xml"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type authRecordingRoundTripper struct {
+	reqs []*http.Request
+}
+
+func (rt *authRecordingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.reqs = append(rt.reqs, req)
+	return &http.Response{StatusCode: http.StatusOK, Request: req}, nil
+}
+
+func TestAuthenticationAllowsAndDeniesRequests(t *testing.T) {
+	for _, testData := range []struct {
+		authorization string
+		status        int
+	}{
+		{"Bearer secret", http.StatusOK},
+		{"Bearer wrong", http.StatusForbidden},
+		{"AWS access:signature", http.StatusForbidden},
+		{"", http.StatusForbidden},
+	} {
+		backend := &authRecordingRoundTripper{}
+		rt := Authentication(NewAuthenticator("secret"))(backend)
+		req, _ := http.NewRequest("GET", "http://localhost/bucket/key", nil)
+		if testData.authorization != "" {
+			req.Header.Set("Authorization", testData.authorization)
+		}
+
+		resp, err := rt.RoundTrip(req)
+
+		assert.NoError(t, err)
+		assert.Equal(t, testData.status, resp.StatusCode, testData.authorization)
+		if testData.status == http.StatusOK {
+			assert.Len(t, backend.reqs, 1)
+			assert.Empty(t, backend.reqs[0].Header.Get("Authorization"), "token should not reach backends")
+			continue
+		}
+		assert.Empty(t, backend.reqs, testData.authorization)
+		s3Error := S3Error{}
+		assert.NoError(t, xml.NewDecoder(resp.Body).Decode(&s3Error))
+		assert.Equal(t, "AccessDenied", s3Error.Code)
+	}
+}
+
+func TestAuthenticationIsSkippedWithoutToken(t *testing.T) {
+	backend := &authRecordingRoundTripper{}
+	rt := Authentication(NewAuthenticator(""))(backend)
+	req, _ := http.NewRequest("GET", "http://localhost/bucket/key", nil)
+	req.Header.Set("Authorization", "AWS access:signature")
+
+	resp, err := rt.RoundTrip(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "AWS access:signature", backend.reqs[0].Header.Get("Authorization"))
+}
@@ -0,0 +1,236 @@
+package httphandler
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+const (
+	// DefaultAutoMultipartPartSize is size of parts large uploads are split
+	// into if AutoMultipartPartSize is not set
+	DefaultAutoMultipartPartSize = 64 << 20
+	// maxMultipartParts is the highest part number backends accept
+	maxMultipartParts = 10000
+)
+
+// initiateMultipartUploadResult is InitiateMultipartUpload response body
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// completeMultipartUpload is CompleteMultipartUpload request body
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// completedUploadResult is CompleteMultipartUpload response body,
+// backend may respond with 200 and Error body
+type completedUploadResult struct {
+	XMLName xml.Name
+	ETag    string `xml:"ETag"`
+}
+
+// singlePutHeaders are not forwarded with requests of multipart upload, they
+// describe body or signature of single PUT. Content-MD5 is verified by
+// autoMultipart itself while parts are read
+var singlePutHeaders = []string{"Authorization", "Content-Length", "Content-Md5", "Expect",
+	"Transfer-Encoding", "X-Amz-Content-Sha256", "X-Amz-Date", "X-Amz-Decoded-Content-Length"}
+
+type autoMultipart struct {
+	threshold    int64
+	partSize     int64
+	roundTripper http.RoundTripper
+}
+
+func (am *autoMultipart) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPut || req.URL.RawQuery != "" || req.Body == nil ||
+		req.ContentLength <= am.threshold || req.Header.Get("X-Amz-Copy-Source") != "" ||
+		// signed chunks of aws-chunked body cannot be split
+		config.IsAWSChunked(*req) {
+		return am.roundTripper.RoundTrip(req)
+	}
+	metrics.Mark("reqs.backend." + metrics.Clean(req.URL.Host) + ".auto_multipart")
+	resp, err := am.upload(req)
+	if err != nil || resp.StatusCode >= http.StatusMultipleChoices {
+		metrics.Mark("reqs.backend." + metrics.Clean(req.URL.Host) + ".auto_multipart_errors")
+	}
+	return resp, err
+}
+
+// subrequest creates request of multipart upload to object of req, headers
+// are copied if withHeaders is set
+func subrequest(req *http.Request, method, rawQuery string, body []byte, withHeaders bool) (*http.Request, error) {
+	u := *req.URL
+	u.RawQuery = rawQuery
+	subreq, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	subreq.Host = req.Host
+	if withHeaders {
+		for name, values := range req.Header {
+			subreq.Header[name] = values
+		}
+		for _, name := range singlePutHeaders {
+			subreq.Header.Del(name)
+		}
+	} else if userAgent := req.Header.Get("User-Agent"); userAgent != "" {
+		subreq.Header.Set("User-Agent", userAgent)
+	}
+	return subreq.WithContext(req.Context()), nil
+}
+
+func (am *autoMultipart) send(req *http.Request, method, rawQuery string, body []byte, withHeaders bool) (*http.Response, error) {
+	subreq, err := subrequest(req, method, rawQuery, body, withHeaders)
+	if err != nil {
+		return nil, err
+	}
+	return am.roundTripper.RoundTrip(subreq)
+}
+
+// upload sends req body as multipart upload, parts are read from body one
+// by one, so at most one part is buffered. Failed upload is aborted and
+// backend response or error is returned. Upload of body not matching its
+// Content-MD5 is aborted before completion
+func (am *autoMultipart) upload(req *http.Request) (*http.Response, error) {
+	defer func() { _ = req.Body.Close() }()
+	var verifier *digestVerifier
+	if header := req.Header.Get("Content-Md5"); header != "" {
+		expected, ok := decodeContentMD5(header)
+		if !ok {
+			return s3ErrorResponse(req, http.StatusBadRequest, "InvalidDigest",
+				"The Content-MD5 you specified was invalid."), nil
+		}
+		verifier = &digestVerifier{ReadCloser: req.Body, hash: md5.New(), expected: expected, length: req.ContentLength}
+		req.Body = verifier
+	}
+	resp, err := am.send(req, http.MethodPost, "uploads", nil, true)
+	if err != nil || resp.StatusCode >= http.StatusMultipleChoices {
+		return resp, err
+	}
+	initiated := initiateMultipartUploadResult{}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	discardResponseBody(resp)
+	if err != nil || initiated.UploadID == "" {
+		return nil, fmt.Errorf("cannot read upload id of %s: %v", req.URL.Path, err)
+	}
+
+	partSize := am.partSize
+	if minSize := (req.ContentLength + maxMultipartParts - 1) / maxMultipartParts; partSize < minSize {
+		partSize = minSize
+	}
+	parts := make([]completedPart, 0, req.ContentLength/partSize+1)
+	for remaining := req.ContentLength; remaining > 0; {
+		// part buffer is not reused, transport may still hold previous one
+		buf := make([]byte, partSize)
+		if remaining < partSize {
+			buf = buf[:remaining]
+		}
+		remaining -= int64(len(buf))
+		if _, err = io.ReadFull(req.Body, buf); err != nil {
+			am.abort(req, initiated.UploadID)
+			return nil, err
+		}
+		// digest is verified once last part is read, before it's sent
+		if verifier != nil && verifier.mismatch {
+			am.abort(req, initiated.UploadID)
+			return s3ErrorResponse(req, http.StatusBadRequest, "BadDigest",
+				"The Content-MD5 you specified did not match what we received."), nil
+		}
+		partNumber := len(parts) + 1
+		resp, err = am.send(req, http.MethodPut, url.Values{
+			"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {initiated.UploadID}}.Encode(), buf, false)
+		if err != nil || resp.StatusCode >= http.StatusMultipleChoices {
+			am.abort(req, initiated.UploadID)
+			return resp, err
+		}
+		discardResponseBody(resp)
+		parts = append(parts, completedPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+	}
+	return am.complete(req, initiated.UploadID, parts)
+}
+
+// complete sends CompleteMultipartUpload and translates its result to
+// response of single PUT
+func (am *autoMultipart) complete(req *http.Request, uploadID string, parts []completedPart) (*http.Response, error) {
+	body, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := am.send(req, http.MethodPost, uploadIDQuery(uploadID), body, false)
+	if err != nil || resp.StatusCode >= http.StatusMultipleChoices {
+		am.abort(req, uploadID)
+		return resp, err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		am.abort(req, uploadID)
+		return nil, err
+	}
+	result := completedUploadResult{}
+	if err = xml.Unmarshal(respBody, &result); err != nil || result.XMLName.Local != "CompleteMultipartUploadResult" {
+		am.abort(req, uploadID)
+		// error reported in body of 200 response
+		resp.StatusCode = http.StatusInternalServerError
+		resp.Status = http.StatusText(http.StatusInternalServerError)
+		resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+		resp.ContentLength = int64(len(respBody))
+		return resp, nil
+	}
+	resp.Header.Set("ETag", result.ETag)
+	resp.Header.Del("Content-Type")
+	resp.Body = ioutil.NopCloser(bytes.NewReader(nil))
+	resp.ContentLength = 0
+	resp.Header.Set("Content-Length", "0")
+	return resp, nil
+}
+
+func uploadIDQuery(uploadID string) string {
+	return url.Values{"uploadId": {uploadID}}.Encode()
+}
+
+func (am *autoMultipart) abort(req *http.Request, uploadID string) {
+	resp, err := am.send(req, http.MethodDelete, uploadIDQuery(uploadID), nil, false)
+	if err == nil {
+		discardResponseBody(resp)
+		if resp.StatusCode >= http.StatusMultipleChoices {
+			err = fmt.Errorf("backend responded with status %d", resp.StatusCode)
+		}
+	}
+	if err != nil {
+		log.Printf("Cannot abort multipart upload %s of %s on %s: %s", uploadID, req.URL.Path, req.URL.Host, err)
+	}
+}
+
+// AutoMultipart creates Decorator which sends PUT requests with body larger
+// than threshold to backend as multipart upload of partSize parts. Zero
+// threshold disables it
+func AutoMultipart(threshold, partSize int64) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if threshold <= 0 {
+			return roundTripper
+		}
+		if partSize <= 0 {
+			partSize = DefaultAutoMultipartPartSize
+		}
+		return &autoMultipart{threshold: threshold, partSize: partSize, roundTripper: roundTripper}
+	}
+}
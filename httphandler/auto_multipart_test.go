@@ -0,0 +1,203 @@
+package httphandler
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// multipartStore backend keeps objects and multipart upload parts in memory
+type multipartStore struct {
+	*httptest.Server
+	mx        sync.Mutex
+	objects   map[string][]byte
+	parts     map[int][]byte
+	partSizes []int
+	aborted   bool
+	failPart  int
+	headers   http.Header
+}
+
+func mkMultipartStore() *multipartStore {
+	store := &multipartStore{objects: make(map[string][]byte), parts: make(map[int][]byte)}
+	store.Server = httptest.NewServer(http.HandlerFunc(store.serve))
+	return store
+}
+
+func (store *multipartStore) serve(w http.ResponseWriter, r *http.Request) {
+	store.mx.Lock()
+	defer store.mx.Unlock()
+	query := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+	switch {
+	case r.Method == http.MethodPost && r.URL.RawQuery == "uploads":
+		store.headers = r.Header
+		_, _ = w.Write([]byte("<InitiateMultipartUploadResult><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>"))
+	case r.Method == http.MethodPut && query.Get("uploadId") == "upload-1":
+		var partNumber int
+		_, _ = fmt.Sscan(query.Get("partNumber"), &partNumber)
+		if partNumber == store.failPart {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		store.parts[partNumber] = body
+		store.partSizes = append(store.partSizes, len(body))
+		sum := md5.Sum(body)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	case r.Method == http.MethodPost && query.Get("uploadId") == "upload-1":
+		complete := completeMultipartUpload{}
+		_ = xml.Unmarshal(body, &complete)
+		object := []byte{}
+		for i, part := range complete.Parts {
+			sum := md5.Sum(store.parts[part.PartNumber])
+			if part.PartNumber != i+1 || part.ETag != `"`+hex.EncodeToString(sum[:])+`"` {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			object = append(object, store.parts[part.PartNumber]...)
+		}
+		store.objects[r.URL.Path] = object
+		_, _ = w.Write([]byte(`<CompleteMultipartUploadResult><ETag>"multipart-2"</ETag></CompleteMultipartUploadResult>`))
+	case r.Method == http.MethodDelete && query.Get("uploadId") == "upload-1":
+		store.aborted = true
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.URL.RawQuery == "":
+		store.objects[r.URL.Path] = body
+		w.Header().Set("ETag", `"single"`)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (store *multipartStore) state() (map[string][]byte, []int, bool) {
+	store.mx.Lock()
+	defer store.mx.Unlock()
+	return store.objects, store.partSizes, store.aborted
+}
+
+func autoMultipartPut(t *testing.T, rt http.RoundTripper, url string, body []byte) *http.Response {
+	req, _ := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "video/mp4")
+	req.Header.Set("X-Amz-Meta-Owner", "akubra")
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestAutoMultipartSplitsLargeUploadIntoParts(t *testing.T) {
+	store := mkMultipartStore()
+	defer store.Close()
+	body := bytes.Repeat([]byte("0123456789abcdef"), 3<<16)
+	rt := AutoMultipart(1<<20, 1<<20)(http.DefaultTransport)
+
+	resp := autoMultipartPut(t, rt, store.URL+"/bucket/large", body)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `"multipart-2"`, resp.Header.Get("ETag"))
+	assert.Equal(t, int64(0), resp.ContentLength)
+	objects, partSizes, aborted := store.state()
+	assert.Equal(t, []int{1 << 20, 1 << 20, 1 << 20}, partSizes)
+	assert.Equal(t, body, objects["/bucket/large"])
+	assert.False(t, aborted)
+	assert.Equal(t, "video/mp4", store.headers.Get("Content-Type"))
+	assert.Equal(t, "akubra", store.headers.Get("X-Amz-Meta-Owner"))
+	assert.Empty(t, store.headers.Get("Content-Md5"))
+}
+
+func TestAutoMultipartSendsLastPartWithRemainder(t *testing.T) {
+	store := mkMultipartStore()
+	defer store.Close()
+	body := bytes.Repeat([]byte("x"), 5<<20+123)
+
+	resp := autoMultipartPut(t, AutoMultipart(1<<20, 2<<20)(http.DefaultTransport), store.URL+"/bucket/large", body)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	objects, partSizes, _ := store.state()
+	assert.Equal(t, []int{2 << 20, 2 << 20, 1<<20 + 123}, partSizes)
+	assert.Equal(t, body, objects["/bucket/large"])
+}
+
+func TestAutoMultipartPassesSmallUploadsAsSinglePut(t *testing.T) {
+	store := mkMultipartStore()
+	defer store.Close()
+	body := bytes.Repeat([]byte("x"), 1<<20)
+
+	resp := autoMultipartPut(t, AutoMultipart(1<<20, 1<<20)(http.DefaultTransport), store.URL+"/bucket/small", body)
+
+	assert.Equal(t, `"single"`, resp.Header.Get("ETag"))
+	objects, partSizes, _ := store.state()
+	assert.Empty(t, partSizes)
+	assert.Equal(t, body, objects["/bucket/small"])
+}
+
+func TestAutoMultipartPassesAWSChunkedUploadsAsSinglePut(t *testing.T) {
+	store := mkMultipartStore()
+	defer store.Close()
+	body := bytes.Repeat([]byte("x"), 2<<20)
+	req, _ := http.NewRequest(http.MethodPut, store.URL+"/bucket/streamed", bytes.NewReader(body))
+	req.Header.Set("X-Amz-Content-Sha256", "STREAMING-AWS4-HMAC-SHA256-PAYLOAD")
+	req.Header.Set("Content-Encoding", "aws-chunked")
+	req.Header.Set("X-Amz-Decoded-Content-Length", strconv.Itoa(len(body)-1024))
+
+	resp, err := AutoMultipart(1<<20, 1<<20)(http.DefaultTransport).RoundTrip(req)
+
+	require.NoError(t, err)
+	assert.Equal(t, `"single"`, resp.Header.Get("ETag"))
+	objects, partSizes, _ := store.state()
+	assert.Empty(t, partSizes)
+	assert.Equal(t, body, objects["/bucket/streamed"])
+}
+
+func TestAutoMultipartAbortsUploadOnFailedPart(t *testing.T) {
+	store := mkMultipartStore()
+	defer store.Close()
+	store.failPart = 2
+
+	resp := autoMultipartPut(t, AutoMultipart(1<<20, 1<<20)(http.DefaultTransport), store.URL+"/bucket/large",
+		bytes.Repeat([]byte("x"), 3<<20))
+
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	objects, partSizes, aborted := store.state()
+	assert.Equal(t, []int{1 << 20}, partSizes)
+	assert.Empty(t, objects)
+	assert.True(t, aborted)
+}
+
+func TestAutoMultipartVerifiesContentMD5OfSplitUpload(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 3<<20)
+	sum := md5.Sum(body)
+	for _, testCase := range []struct {
+		contentMD5 string
+		status     int
+		partSizes  []int
+	}{
+		{base64.StdEncoding.EncodeToString(sum[:]), http.StatusOK, []int{1 << 20, 1 << 20, 1 << 20}},
+		{base64.StdEncoding.EncodeToString(make([]byte, md5.Size)), http.StatusBadRequest, []int{1 << 20, 1 << 20}},
+		{"invalid", http.StatusBadRequest, nil},
+	} {
+		store := mkMultipartStore()
+		req, _ := http.NewRequest(http.MethodPut, store.URL+"/bucket/large", bytes.NewReader(body))
+		req.Header.Set("Content-Md5", testCase.contentMD5)
+
+		resp, err := AutoMultipart(1<<20, 1<<20)(http.DefaultTransport).RoundTrip(req)
+
+		require.NoError(t, err)
+		assert.Equal(t, testCase.status, resp.StatusCode, testCase.contentMD5)
+		objects, partSizes, _ := store.state()
+		assert.Equal(t, testCase.partSizes, partSizes, testCase.contentMD5)
+		assert.Equal(t, testCase.status == http.StatusOK, objects["/bucket/large"] != nil, testCase.contentMD5)
+		store.Close()
+	}
+}
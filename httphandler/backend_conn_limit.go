@@ -0,0 +1,151 @@
+package httphandler
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+
+	"github.com/allegro/akubra/metrics"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/allegro/akubra/transport"
+)
+
+// DefaultLowPriorityShare of backend ConnLimit is available to low priority
+// requests if LowPriorityShare is not set
+const DefaultLowPriorityShare = 0.25
+
+// prioritySemaphore admits at most limit requests at once, at most lowLimit
+// of them low priority. High priority requests wait for free slot, low
+// priority ones are shed once their share is used up or high priority
+// requests are waiting
+type prioritySemaphore struct {
+	mx          sync.Mutex
+	limit       int
+	lowLimit    int
+	inFlight    int
+	lowInFlight int
+	highWaiting int
+	// released is closed and replaced whenever request slot frees up
+	released chan struct{}
+}
+
+func newPrioritySemaphore(conf shardingconfig.ConnLimitConfig) *prioritySemaphore {
+	share := conf.LowPriorityShare
+	if share == 0 {
+		share = DefaultLowPriorityShare
+	}
+	return &prioritySemaphore{
+		limit:    conf.ConnLimit,
+		lowLimit: int(math.Max(1, math.Ceil(float64(conf.ConnLimit)*share))),
+		released: make(chan struct{}),
+	}
+}
+
+func (ps *prioritySemaphore) acquire(ctx context.Context, low bool) error {
+	ps.mx.Lock()
+	defer ps.mx.Unlock()
+	if low {
+		if ps.inFlight >= ps.limit || ps.lowInFlight >= ps.lowLimit || ps.highWaiting > 0 {
+			return transport.ErrBackendConnLimited
+		}
+		ps.inFlight++
+		ps.lowInFlight++
+		return nil
+	}
+	for ps.inFlight >= ps.limit {
+		ps.highWaiting++
+		released := ps.released
+		ps.mx.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+		}
+		ps.mx.Lock()
+		ps.highWaiting--
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	ps.inFlight++
+	return nil
+}
+
+func (ps *prioritySemaphore) release(low bool) {
+	ps.mx.Lock()
+	defer ps.mx.Unlock()
+	ps.inFlight--
+	if low {
+		ps.lowInFlight--
+	}
+	close(ps.released)
+	ps.released = make(chan struct{})
+}
+
+// releaseOnCloseBody holds backend request slot until response body is
+// closed
+type releaseOnCloseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (rb *releaseOnCloseBody) Close() error {
+	err := rb.ReadCloser.Close()
+	rb.once.Do(rb.release)
+	return err
+}
+
+type backendConnLimiter struct {
+	semaphores   map[string]*prioritySemaphore
+	roundTripper http.RoundTripper
+}
+
+func (bl *backendConnLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	low := transport.IsLowPriority(req)
+	if req.Header.Get(transport.PriorityHeader) != "" {
+		stripped := *req
+		stripped.Header = make(http.Header, len(req.Header))
+		for name, values := range req.Header {
+			stripped.Header[name] = values
+		}
+		stripped.Header.Del(transport.PriorityHeader)
+		req = &stripped
+	}
+	semaphore, ok := bl.semaphores[req.URL.Host]
+	if !ok {
+		return bl.roundTripper.RoundTrip(req)
+	}
+	if err := semaphore.acquire(req.Context(), low); err != nil {
+		if err == transport.ErrBackendConnLimited {
+			metrics.Mark("reqs.backend." + metrics.Clean(req.URL.Host) + ".low_priority_shed")
+		}
+		return nil, err
+	}
+	resp, err := bl.roundTripper.RoundTrip(req)
+	if err != nil || resp.Body == nil {
+		semaphore.release(low)
+		return resp, err
+	}
+	resp.Body = &releaseOnCloseBody{ReadCloser: resp.Body, release: func() { semaphore.release(low) }}
+	return resp, nil
+}
+
+// BackendConnLimits creates Decorator which limits concurrent requests of
+// configured backends (keyed by host) until their response bodies are
+// closed. Low priority requests (see transport.IsLowPriority) get only
+// LowPriorityShare of ConnLimit and are shed with
+// transport.ErrBackendConnLimited while high priority ones wait
+func BackendConnLimits(conf map[string]shardingconfig.ConnLimitConfig) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if len(conf) == 0 {
+			return roundTripper
+		}
+		semaphores := make(map[string]*prioritySemaphore, len(conf))
+		for host, limit := range conf {
+			semaphores[host] = newPrioritySemaphore(limit)
+		}
+		return &backendConnLimiter{semaphores: semaphores, roundTripper: roundTripper}
+	}
+}
@@ -0,0 +1,79 @@
+package httphandler
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/allegro/akubra/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func connLimitedRequest(ctx context.Context, priority string) *http.Request {
+	req, _ := http.NewRequest(http.MethodGet, "http://s3.dc1.internal/bucket/key", nil)
+	if priority != "" {
+		req.Header.Set(transport.PriorityHeader, priority)
+	}
+	return req.WithContext(ctx)
+}
+
+func TestBackendConnLimitsPreferHighPriorityRequests(t *testing.T) {
+	sent := make(chan *http.Request, 10)
+	backend := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		sent <- req
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(nil)), Request: req}, nil
+	})
+	limited := Decorate(backend, BackendConnLimits(map[string]shardingconfig.ConnLimitConfig{
+		"s3.dc1.internal": {ConnLimit: 2, LowPriorityShare: 0.5},
+	}))
+
+	low, err := limited.RoundTrip(connLimitedRequest(context.Background(), transport.PriorityLow))
+	require.NoError(t, err)
+	assert.Empty(t, (<-sent).Header.Get(transport.PriorityHeader), "priority header should not reach backend")
+	_, err = limited.RoundTrip(connLimitedRequest(transport.WithLowPriority(context.Background()), ""))
+	assert.Equal(t, transport.ErrBackendConnLimited, err, "low priority share should be used up")
+	high, err := limited.RoundTrip(connLimitedRequest(context.Background(), ""))
+	require.NoError(t, err, "high priority request should get remaining slot")
+	<-sent
+
+	waitingHigh := make(chan error)
+	go func() {
+		_, err := limited.RoundTrip(connLimitedRequest(context.Background(), ""))
+		waitingHigh <- err
+	}()
+	select {
+	case <-sent:
+		t.Fatal("high priority request should wait for free slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.NoError(t, low.Body.Close())
+	_, err = limited.RoundTrip(connLimitedRequest(context.Background(), transport.PriorityLow))
+	assert.Equal(t, transport.ErrBackendConnLimited, err, "freed slot should go to waiting high priority request")
+	require.NoError(t, <-waitingHigh)
+	<-sent
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = limited.RoundTrip(connLimitedRequest(ctx, ""))
+	assert.Equal(t, context.DeadlineExceeded, err)
+	require.NoError(t, high.Body.Close())
+}
+
+func TestBackendConnLimitsSkipUnlimitedBackends(t *testing.T) {
+	assert.Equal(t, http.DefaultTransport, Decorate(http.DefaultTransport, BackendConnLimits(nil)))
+	backend := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(nil)), Request: req}, nil
+	})
+	limited := Decorate(backend, BackendConnLimits(map[string]shardingconfig.ConnLimitConfig{
+		"s3.dc2.internal": {ConnLimit: 1},
+	}))
+	for i := 0; i < 3; i++ {
+		_, err := limited.RoundTrip(connLimitedRequest(context.Background(), transport.PriorityLow))
+		require.NoError(t, err)
+	}
+}
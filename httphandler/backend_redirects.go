@@ -0,0 +1,124 @@
+package httphandler
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// redirectBodyMaxSize limits redirect response body read for S3 Endpoint
+const redirectBodyMaxSize = 64 * 1024
+
+// redirectError is S3 PermanentRedirect error document, it names endpoint
+// of bucket region instead of Location header
+type redirectError struct {
+	Endpoint string `xml:"Endpoint"`
+}
+
+func isFollowedRedirect(status int) bool {
+	return status == http.StatusMovedPermanently || status == http.StatusTemporaryRedirect ||
+		status == http.StatusPermanentRedirect
+}
+
+type redirectsFollower struct {
+	maxHops      int
+	roundTripper http.RoundTripper
+}
+
+func (rf *redirectsFollower) RoundTrip(req *http.Request) (*http.Response, error) {
+	origin := req.URL.Host
+	resp, err := rf.roundTripper.RoundTrip(req)
+	for hop := 0; hop < rf.maxHops && err == nil && isFollowedRedirect(resp.StatusCode); hop++ {
+		target, ok := redirectTarget(req, resp)
+		if !ok {
+			return resp, nil
+		}
+		redirected, ok := redirectedRequest(req, target)
+		if !ok {
+			log.Debugf("Cannot follow redirect of %s %s to %s, body cannot be resent", req.Method, req.URL, target)
+			return resp, nil
+		}
+		discardResponseBody(resp)
+		metrics.Mark("reqs.backend." + metrics.Clean(origin) + ".redirects_followed")
+		log.Debugf("Following redirect %d of %s %s to %s", resp.StatusCode, req.Method, req.URL, target)
+		req = redirected
+		resp, err = rf.roundTripper.RoundTrip(req)
+	}
+	return resp, err
+}
+
+// redirectTarget returns URL from Location header of redirect or, if it's
+// missing, from Endpoint of S3 error document. Response body is left
+// readable
+func redirectTarget(req *http.Request, resp *http.Response) (*url.URL, bool) {
+	if location := resp.Header.Get("Location"); location != "" {
+		target, err := req.URL.Parse(location)
+		return target, err == nil
+	}
+	if resp.Body == nil || resp.ContentLength > redirectBodyMaxSize {
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, redirectBodyMaxSize))
+	if closeErr := resp.Body.Close(); closeErr != nil {
+		log.Debugf("Cannot close response body %s", closeErr)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	redirect := redirectError{}
+	if err != nil || xml.Unmarshal(body, &redirect) != nil || redirect.Endpoint == "" {
+		return nil, false
+	}
+	target := *req.URL
+	target.Host = redirect.Endpoint
+	// path style request is addressed virtual-hosted style by endpoint of
+	// bucket subdomain
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	bucket := strings.SplitN(path, "/", 2)[0]
+	if bucket != "" && strings.HasPrefix(redirect.Endpoint, bucket+".") && !strings.HasPrefix(req.Host, bucket+".") {
+		target.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(path, bucket), "/")
+		target.RawPath = ""
+	}
+	return &target, true
+}
+
+// redirectedRequest copies req to target, body is recreated with GetBody
+func redirectedRequest(req *http.Request, target *url.URL) (*http.Request, bool) {
+	redirected := req.WithContext(req.Context())
+	redirected.URL = target
+	redirected.Host = target.Host
+	if req.Body == nil || req.Body == http.NoBody {
+		return redirected, true
+	}
+	if req.GetBody == nil {
+		return nil, false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, false
+	}
+	redirected.Body = body
+	return redirected, true
+}
+
+// BackendRedirectsFollower creates Decorator which follows 301, 307 and 308
+// redirects of backends (e.g. S3 redirect to bucket region endpoint) up to
+// MaxHops times, so client gets response of redirect target
+func BackendRedirectsFollower(conf httphandlerconfig.BackendRedirectsConfig) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if !conf.Enabled {
+			return roundTripper
+		}
+		maxHops := conf.MaxHops
+		if maxHops <= 0 {
+			maxHops = httphandlerconfig.DefaultBackendRedirectHops
+		}
+		return &redirectsFollower{maxHops: maxHops, roundTripper: roundTripper}
+	}
+}
@@ -0,0 +1,92 @@
+package httphandler
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mkRegionBackend() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Received-Body", string(body))
+		w.Header().Set("X-Received-Host", r.Host)
+		_, _ = fmt.Fprintf(w, "%s %s", r.Method, r.URL.RequestURI())
+	}))
+}
+
+func TestBackendRedirectsFollowerFollowsS3RegionRedirect(t *testing.T) {
+	region := mkRegionBackend()
+	defer region.Close()
+	regionURL, _ := url.Parse(region.URL)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amz-Bucket-Region", "eu-west-1")
+		w.WriteHeader(http.StatusMovedPermanently)
+		_, _ = fmt.Fprintf(w, "<Error><Code>PermanentRedirect</Code><Endpoint>%s</Endpoint></Error>", regionURL.Host)
+	}))
+	defer origin.Close()
+	rt := BackendRedirectsFollower(httphandlerconfig.BackendRedirectsConfig{Enabled: true})(http.DefaultTransport)
+
+	req, _ := http.NewRequest(http.MethodPut, origin.URL+"/bucket/key?acl", bytes.NewBufferString("content"))
+	resp, err := rt.RoundTrip(req)
+
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "PUT /bucket/key?acl", string(body))
+	assert.Equal(t, "content", resp.Header.Get("X-Received-Body"), "body should be resent to redirect target")
+	assert.Equal(t, regionURL.Host, resp.Header.Get("X-Received-Host"))
+}
+
+func TestBackendRedirectsFollowerFollowsLocationOfTemporaryRedirect(t *testing.T) {
+	region := mkRegionBackend()
+	defer region.Close()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", region.URL+"/bucket/key")
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	}))
+	defer origin.Close()
+	rt := BackendRedirectsFollower(httphandlerconfig.BackendRedirectsConfig{Enabled: true})(http.DefaultTransport)
+
+	req, _ := http.NewRequest(http.MethodGet, origin.URL+"/bucket/key", nil)
+	resp, err := rt.RoundTrip(req)
+
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "GET /bucket/key", string(body))
+}
+
+func TestBackendRedirectsFollowerPassesRedirectAfterMaxHops(t *testing.T) {
+	var hits int32
+	var loop *httptest.Server
+	loop = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Location", loop.URL+r.URL.Path)
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	}))
+	defer loop.Close()
+	rt := BackendRedirectsFollower(httphandlerconfig.BackendRedirectsConfig{Enabled: true, MaxHops: 2})(http.DefaultTransport)
+
+	req, _ := http.NewRequest(http.MethodGet, loop.URL+"/bucket/key", nil)
+	resp, err := rt.RoundTrip(req)
+
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits))
+}
+
+func TestBackendRedirectsAreNotFollowedByDefault(t *testing.T) {
+	rt := BackendRedirectsFollower(httphandlerconfig.BackendRedirectsConfig{})(http.DefaultTransport)
+
+	assert.Equal(t, http.DefaultTransport, rt)
+}
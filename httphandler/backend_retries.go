@@ -0,0 +1,93 @@
+package httphandler
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/allegro/akubra/transport"
+)
+
+// retriedMethods are idempotent (RFC 7231 section 4.2.2), so repeating them
+// on the same backend does not change outcome
+var retriedMethods = map[string]bool{
+	http.MethodGet:    true,
+	http.MethodHead:   true,
+	http.MethodPut:    true,
+	http.MethodDelete: true,
+}
+
+type backendRetrier struct {
+	attempts     int
+	perBackend   map[string]shardingconfig.BackendRetryConfig
+	roundTripper http.RoundTripper
+}
+
+func (br *backendRetrier) backendAttempts(host string) int {
+	if retries, ok := br.perBackend[host]; ok {
+		return retries.Attempts
+	}
+	return br.attempts
+}
+
+// retryable tells if request can be sent again, its body has to be
+// replayable
+func retryable(req *http.Request) bool {
+	return retriedMethods[req.Method] && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil)
+}
+
+func backendFailed(resp *http.Response, err error) bool {
+	if err != nil {
+		// shed request would be shed again
+		return err != transport.ErrBackendConnLimited
+	}
+	return resp.StatusCode >= http.StatusInternalServerError
+}
+
+func discardResponse(resp *http.Response) {
+	if resp == nil || resp.Body == nil {
+		return
+	}
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		log.Debugf("Could not discard failed backend response body: %s", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		log.Debugf("Could not close failed backend response body: %s", err)
+	}
+}
+
+func (br *backendRetrier) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempts := br.backendAttempts(req.URL.Host)
+	resp, err := br.roundTripper.RoundTrip(req)
+	for attempt := 1; attempt <= attempts && backendFailed(resp, err) && retryable(req) && req.Context().Err() == nil; attempt++ {
+		retry := *req
+		if req.GetBody != nil {
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				break
+			}
+			retry.Body = body
+		}
+		discardResponse(resp)
+		metrics.Mark("reqs.backend." + metrics.Clean(req.URL.Host) + ".retries")
+		log.Debugf("Retrying request %s on backend %s, attempt %d/%d",
+			req.Context().Value(log.ContextreqIDKey), req.URL.Host, attempt, attempts)
+		resp, err = br.roundTripper.RoundTrip(&retry)
+	}
+	return resp, err
+}
+
+// BackendRetries creates Decorator which retries idempotent requests failed
+// by backend (with error or 5xx status) on the same backend, attempts times
+// or as configured for backend (keyed by host) in perBackend
+func BackendRetries(attempts int, perBackend map[string]shardingconfig.BackendRetryConfig) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if attempts == 0 && len(perBackend) == 0 {
+			return roundTripper
+		}
+		return &backendRetrier{attempts: attempts, perBackend: perBackend, roundTripper: roundTripper}
+	}
+}
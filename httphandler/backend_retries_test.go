@@ -0,0 +1,75 @@
+package httphandler
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func mkAlwaysFailingBackend(calls *int32) (*httptest.Server, string) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method == http.MethodPut && string(body) != "data" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	backendURL, _ := url.Parse(srv.URL)
+	return srv, backendURL.Host
+}
+
+func TestBackendRetriesUsePolicyOfBackend(t *testing.T) {
+	var primaryCalls, flakyCalls, otherCalls int32
+	primary, primaryHost := mkAlwaysFailingBackend(&primaryCalls)
+	defer primary.Close()
+	flaky, flakyHost := mkAlwaysFailingBackend(&flakyCalls)
+	defer flaky.Close()
+	other, _ := mkAlwaysFailingBackend(&otherCalls)
+	defer other.Close()
+	rt := BackendRetries(1, map[string]shardingconfig.BackendRetryConfig{
+		primaryHost: {Attempts: 0},
+		flakyHost:   {Attempts: 3},
+	})(http.DefaultTransport)
+
+	for _, testData := range []struct {
+		backend  *httptest.Server
+		calls    *int32
+		expected int32
+	}{
+		{primary, &primaryCalls, 1},
+		{flaky, &flakyCalls, 4},
+		{other, &otherCalls, 2},
+	} {
+		req, _ := http.NewRequest(http.MethodPut, testData.backend.URL+"/bucket/key", strings.NewReader("data"))
+
+		resp, err := rt.RoundTrip(req)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "body should be replayed on retries")
+		assert.NoError(t, resp.Body.Close())
+		assert.Equal(t, testData.expected, atomic.LoadInt32(testData.calls), testData.backend.URL)
+	}
+}
+
+func TestBackendRetriesSkipNonIdempotentRequests(t *testing.T) {
+	var calls int32
+	backend, _ := mkAlwaysFailingBackend(&calls)
+	defer backend.Close()
+	rt := BackendRetries(2, nil)(http.DefaultTransport)
+	req, _ := http.NewRequest(http.MethodPost, backend.URL+"/bucket/key?uploads", nil)
+
+	resp, err := rt.RoundTrip(req)
+
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
@@ -0,0 +1,135 @@
+package httphandler
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// ConnectionRegistry tracks server connections by client address, so
+// handlers can set deadlines on raw connection. Its ConnState method has to be
+// set as http.Server ConnState hook
+type ConnectionRegistry struct {
+	mx    sync.Mutex
+	conns map[string]net.Conn
+}
+
+// NewConnectionRegistry creates empty ConnectionRegistry
+func NewConnectionRegistry() *ConnectionRegistry {
+	return &ConnectionRegistry{conns: make(map[string]net.Conn)}
+}
+
+// ConnState registers active connections and forgets closed ones. New
+// connections are not registered yet, RemoteAddr of PROXY protocol connection
+// is known only after its header is read
+func (cr *ConnectionRegistry) ConnState(conn net.Conn, state http.ConnState) {
+	cr.mx.Lock()
+	defer cr.mx.Unlock()
+	switch state {
+	case http.StateActive:
+		cr.conns[conn.RemoteAddr().String()] = conn
+	case http.StateHijacked, http.StateClosed:
+		delete(cr.conns, conn.RemoteAddr().String())
+	}
+}
+
+func (cr *ConnectionRegistry) conn(remoteAddr string) (net.Conn, bool) {
+	cr.mx.Lock()
+	defer cr.mx.Unlock()
+	conn, ok := cr.conns[remoteAddr]
+	return conn, ok
+}
+
+// idleBody moves connection read deadline forward on every read, so client
+// which stops sending body is disconnected after idle timeout
+type idleBody struct {
+	io.ReadCloser
+	conn     net.Conn
+	idle     time.Duration
+	deadline time.Time
+	remote   string
+	closed   bool
+}
+
+func (ib *idleBody) Read(p []byte) (int, error) {
+	deadline := time.Now().Add(ib.idle)
+	if !ib.deadline.IsZero() && ib.deadline.Before(deadline) {
+		deadline = ib.deadline
+	}
+	if err := ib.conn.SetReadDeadline(deadline); err != nil {
+		log.Debugf("Cannot set read deadline for %s: %s", ib.remote, err)
+	}
+	n, err := ib.ReadCloser.Read(p)
+	if err == io.EOF {
+		// body is read, leftover deadline would break waiting for backend
+		ib.resetDeadline()
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		metrics.Mark("reqs.global.body_idle_timeouts")
+		log.Printf("Client %s stalled sending request body, disconnecting", ib.remote)
+		// server would try to discard rest of body before closing connection
+		ib.closed = true
+		if closeErr := ib.conn.Close(); closeErr != nil {
+			log.Debugf("Cannot close connection of %s: %s", ib.remote, closeErr)
+		}
+	}
+	return n, err
+}
+
+func (ib *idleBody) resetDeadline() {
+	if ib.closed {
+		return
+	}
+	if err := ib.conn.SetReadDeadline(ib.deadline); err != nil {
+		log.Debugf("Cannot reset read deadline for %s: %s", ib.remote, err)
+	}
+}
+
+type bodyIdleTimeoutHandler struct {
+	handler     http.Handler
+	registry    *ConnectionRegistry
+	idle        time.Duration
+	readTimeout time.Duration
+}
+
+func (bh *bodyIdleTimeoutHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	conn, ok := bh.registry.conn(req.RemoteAddr)
+	if ok && req.Body != nil && req.Body != http.NoBody {
+		body := &idleBody{
+			ReadCloser: req.Body,
+			conn:       conn,
+			idle:       bh.idle,
+			remote:     req.RemoteAddr,
+		}
+		// server sets ReadTimeout deadline when it starts reading request,
+		// idle deadline must not extend it. MethodTimeouts deadline replaces it
+		if deadline, ok := req.Context().Deadline(); ok {
+			body.deadline = deadline
+		} else if bh.readTimeout > 0 {
+			body.deadline = time.Now().Add(bh.readTimeout)
+		}
+		req.Body = body
+		defer body.resetDeadline()
+	}
+	bh.handler.ServeHTTP(w, req)
+}
+
+// BodyReadIdleTimeout wraps handler, requests which do not send any body
+// bytes for idle duration are aborted and their connection is closed.
+// readTimeout is http.Server ReadTimeout. Zero idle returns handler unchanged
+func BodyReadIdleTimeout(handler http.Handler, registry *ConnectionRegistry, idle, readTimeout time.Duration) http.Handler {
+	if idle <= 0 {
+		return handler
+	}
+	return &bodyIdleTimeoutHandler{
+		handler:     handler,
+		registry:    registry,
+		idle:        idle,
+		readTimeout: readTimeout,
+	}
+}
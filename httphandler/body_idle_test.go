@@ -0,0 +1,80 @@
+package httphandler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBodyReadIdleTimeoutClosesStalledUpload(t *testing.T) {
+	idle := 100 * time.Millisecond
+	readErrors := make(chan error, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := ioutil.ReadAll(r.Body)
+		readErrors <- err
+	})
+	registry := NewConnectionRegistry()
+	srv := httptest.NewUnstartedServer(BodyReadIdleTimeout(handler, registry, idle, time.Minute))
+	srv.Config.ConnState = registry.ConnState
+	srv.Start()
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "PUT /bucket/key HTTP/1.1\r\nHost: localhost\r\nContent-Length: 100\r\n\r\n0123456789")
+	require.NoError(t, err)
+	started := time.Now()
+
+	select {
+	case err := <-readErrors:
+		assert.Error(t, err)
+	case <-time.After(5 * idle):
+		t.Fatal("stalled body read was not aborted")
+	}
+	assert.True(t, time.Since(started) >= idle, "aborted before idle timeout")
+
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*idle)))
+	_, err = ioutil.ReadAll(conn)
+	netErr, isNetErr := err.(net.Error)
+	assert.False(t, isNetErr && netErr.Timeout(), "connection should be closed by server")
+}
+
+func TestBodyReadIdleTimeoutPassesSteadyUpload(t *testing.T) {
+	idle := 100 * time.Millisecond
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		_, err = w.Write(body)
+		assert.NoError(t, err)
+	})
+	registry := NewConnectionRegistry()
+	srv := httptest.NewUnstartedServer(BodyReadIdleTimeout(handler, registry, idle, time.Minute))
+	srv.Config.ConnState = registry.ConnState
+	srv.Start()
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "PUT /bucket/key HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\n")
+	require.NoError(t, err)
+	for _, chunk := range []string{"ab", "cd"} {
+		time.Sleep(idle / 2)
+		_, err = conn.Write([]byte(chunk))
+		require.NoError(t, err)
+	}
+
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, 1024)
+	n, _ := conn.Read(buf)
+	assert.Contains(t, string(buf[:n]), "200 OK")
+	assert.Contains(t, string(buf[:n]), "abcd")
+}
@@ -0,0 +1,66 @@
+package httphandler
+
+import (
+	"crypto/tls"
+	"os"
+	"os/signal"
+	"sync"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// CertificateReloader serves listener certificate loaded from files. Reload
+// swaps it for new handshakes, established connections keep their
+// certificate
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+}
+
+// NewCertificateReloader loads certificate and key (PEM) files
+func NewCertificateReloader(certFile, keyFile string) (*CertificateReloader, error) {
+	cr := &CertificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.Reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Reload loads certificate files again, previous certificate is kept if
+// they are invalid
+func (cr *CertificateReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.mu.Unlock()
+	return nil
+}
+
+// GetCertificate implements tls.Config GetCertificate
+func (cr *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// ReloadOnSignal reloads certificate whenever one of signals is received
+func (cr *CertificateReloader) ReloadOnSignal(signals ...os.Signal) {
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, signals...)
+	go func() {
+		for sig := range received {
+			if err := cr.Reload(); err != nil {
+				metrics.Mark("reqs.global.tls_reload.failed")
+				log.Printf("Cannot reload TLS certificate on %s, serving previous one: %s", sig, err)
+				continue
+			}
+			log.Printf("Reloaded TLS certificate %s on %s", cr.certFile, sig)
+		}
+	}()
+}
@@ -0,0 +1,69 @@
+package httphandler
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func servedCertificate(t *testing.T, addr string) (*tls.Conn, *x509.Certificate) {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	return conn, conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestCertificateReloaderSwapsCertificateForNewConnections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "akubra-cert-reload")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile, oldCert := writeClientCertificate(t, dir)
+
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	require.NoError(t, err)
+	reloader.ReloadOnSignal(syscall.SIGHUP)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go func() {
+		_ = srv.Serve(tls.NewListener(listener, &tls.Config{GetCertificate: reloader.GetCertificate}))
+	}()
+	defer srv.Close()
+	addr := listener.Addr().String()
+
+	established, served := servedCertificate(t, addr)
+	defer established.Close()
+	assert.Equal(t, oldCert.Raw, served.Raw)
+
+	// same files are overwritten by renewal
+	_, _, newCert := writeClientCertificate(t, dir)
+	process, err := os.FindProcess(os.Getpid())
+	require.NoError(t, err)
+	require.NoError(t, process.Signal(syscall.SIGHUP))
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn, served := servedCertificate(t, addr)
+		assert.NoError(t, conn.Close())
+		if bytes.Equal(newCert.Raw, served.Raw) {
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "new handshakes should use reloaded certificate")
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, oldCert.Raw, established.ConnectionState().PeerCertificates[0].Raw)
+
+	require.NoError(t, ioutil.WriteFile(certFile, []byte("not a certificate"), 0600))
+	assert.Error(t, reloader.Reload())
+	conn, served := servedCertificate(t, addr)
+	assert.NoError(t, conn.Close())
+	assert.Equal(t, newCert.Raw, served.Raw, "previous certificate should be kept")
+}
@@ -0,0 +1,265 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+)
+
+const (
+	// DefaultClientAccountingWindow is sliding window of client counters if
+	// Window is not set
+	DefaultClientAccountingWindow = 5 * time.Minute
+	// DefaultMaxAccountedClients limits number of client IPs counted at once
+	// if MaxClients is not set
+	DefaultMaxAccountedClients = 10000
+	// DefaultTopClients is number of clients listed by admin endpoint if
+	// request doesn't set limit
+	DefaultTopClients = 10
+	// clientAccountingSlots is number of buckets window is divided into
+	clientAccountingSlots = 10
+)
+
+type clientSlot struct {
+	slot     int64
+	requests int64
+	errors   int64
+}
+
+// clientCounters counts requests of single client in window slots, slot of
+// older window is reused
+type clientCounters struct {
+	slots    [clientAccountingSlots]clientSlot
+	lastSeen time.Time
+}
+
+func (cc *clientCounters) totals(current int64) (requests, errors int64) {
+	for _, s := range cc.slots {
+		if s.slot > current-clientAccountingSlots {
+			requests += s.requests
+			errors += s.errors
+		}
+	}
+	return requests, errors
+}
+
+// ClientStats are counts of client requests in window
+type ClientStats struct {
+	IP       string `json:"ip"`
+	Requests int64  `json:"requests"`
+	Errors   int64  `json:"errors"`
+}
+
+// ClientAccounting counts requests and error responses (status 400 and
+// above) of client IPs over sliding window. At most maxClients IPs are
+// counted, least active one is evicted to make room for new IP
+type ClientAccounting struct {
+	mx         sync.Mutex
+	slotWidth  time.Duration
+	window     time.Duration
+	maxClients int
+	clients    map[string]*clientCounters
+	now        func() time.Time
+}
+
+// NewClientAccounting creates ClientAccounting, it's nil if accounting is
+// not enabled
+func NewClientAccounting(conf httphandlerconfig.ClientAccountingConfig) *ClientAccounting {
+	if !conf.Enabled {
+		return nil
+	}
+	window := conf.Window.Duration
+	if window <= 0 {
+		window = DefaultClientAccountingWindow
+	}
+	maxClients := conf.MaxClients
+	if maxClients <= 0 {
+		maxClients = DefaultMaxAccountedClients
+	}
+	return &ClientAccounting{
+		slotWidth:  window / clientAccountingSlots,
+		window:     window,
+		maxClients: maxClients,
+		clients:    make(map[string]*clientCounters),
+		now:        time.Now,
+	}
+}
+
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+func (ca *ClientAccounting) currentSlot(now time.Time) int64 {
+	return now.UnixNano() / int64(ca.slotWidth)
+}
+
+// Record counts request of client, failed if response status is 400 or
+// above
+func (ca *ClientAccounting) Record(ip string, failed bool) {
+	ca.mx.Lock()
+	defer ca.mx.Unlock()
+	now := ca.now()
+	current := ca.currentSlot(now)
+	counters, ok := ca.clients[ip]
+	if !ok {
+		if len(ca.clients) >= ca.maxClients {
+			ca.evictLeastActive(current)
+		}
+		counters = &clientCounters{}
+		ca.clients[ip] = counters
+	}
+	counters.lastSeen = now
+	slot := &counters.slots[current%clientAccountingSlots]
+	if slot.slot != current {
+		*slot = clientSlot{slot: current}
+	}
+	slot.requests++
+	if failed {
+		slot.errors++
+	}
+}
+
+// evictLeastActive removes client with fewest requests in window, the one
+// seen longest ago if there are more of them
+func (ca *ClientAccounting) evictLeastActive(current int64) {
+	var evicted string
+	var evictedRequests int64
+	var evictedSeen time.Time
+	for ip, counters := range ca.clients {
+		requests, _ := counters.totals(current)
+		if evicted == "" || requests < evictedRequests ||
+			requests == evictedRequests && counters.lastSeen.Before(evictedSeen) {
+			evicted, evictedRequests, evictedSeen = ip, requests, counters.lastSeen
+		}
+	}
+	delete(ca.clients, evicted)
+}
+
+// Stats returns counts of clients active in window
+func (ca *ClientAccounting) Stats() []ClientStats {
+	ca.mx.Lock()
+	defer ca.mx.Unlock()
+	current := ca.currentSlot(ca.now())
+	stats := make([]ClientStats, 0, len(ca.clients))
+	for ip, counters := range ca.clients {
+		requests, errors := counters.totals(current)
+		if requests == 0 {
+			// client was not seen in window
+			delete(ca.clients, ip)
+			continue
+		}
+		stats = append(stats, ClientStats{IP: ip, Requests: requests, Errors: errors})
+	}
+	return stats
+}
+
+func topClients(stats []ClientStats, limit int, less func(a, b ClientStats) bool) []ClientStats {
+	sorted := make([]ClientStats, len(stats))
+	copy(sorted, stats)
+	// most active first, ties are ordered by IP
+	sort.Slice(sorted, func(i, j int) bool {
+		switch {
+		case less(sorted[j], sorted[i]):
+			return true
+		case less(sorted[i], sorted[j]):
+			return false
+		}
+		return sorted[i].IP < sorted[j].IP
+	})
+	if len(sorted) > limit {
+		sorted = sorted[:limit]
+	}
+	return sorted
+}
+
+type clientsReport struct {
+	Window     string        `json:"window"`
+	ByRequests []ClientStats `json:"byRequests"`
+	ByErrors   []ClientStats `json:"byErrors"`
+}
+
+// AdminHandler responds to GET request with top clients by request count
+// and by error count, limit query parameter sets number of listed clients
+func (ca *ClientAccounting) AdminHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	limit := DefaultTopClients
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		parsed, err := strconv.Atoi(limitParam)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "limit should be positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	stats := ca.Stats()
+	report := clientsReport{
+		Window:     ca.window.String(),
+		ByRequests: topClients(stats, limit, func(a, b ClientStats) bool { return a.Requests < b.Requests }),
+		ByErrors: topClients(stats, limit, func(a, b ClientStats) bool {
+			return a.Errors < b.Errors || a.Errors == b.Errors && a.Requests < b.Requests
+		}),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// statusRecorder keeps status of response written by handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(p)
+}
+
+// Flush lets streamed responses be flushed through recorder
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+type clientAccountingHandler struct {
+	handler    http.Handler
+	accounting *ClientAccounting
+}
+
+func (cah *clientAccountingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	recorder := &statusRecorder{ResponseWriter: w}
+	cah.handler.ServeHTTP(recorder, req)
+	cah.accounting.Record(clientIP(req.RemoteAddr), recorder.status >= http.StatusBadRequest)
+}
+
+// ClientAccountingHandler wraps handler, requests are counted by
+// accounting. Nil accounting disables it
+func ClientAccountingHandler(handler http.Handler, accounting *ClientAccounting) http.Handler {
+	if accounting == nil {
+		return handler
+	}
+	return &clientAccountingHandler{handler: handler, accounting: accounting}
+}
@@ -0,0 +1,106 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+	"github.com/allegro/akubra/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mkAccountedHandler(conf httphandlerconfig.ClientAccountingConfig, now *time.Time) (http.Handler, *ClientAccounting) {
+	accounting := NewClientAccounting(conf)
+	accounting.now = func() time.Time { return *now }
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+	return ClientAccountingHandler(handler, accounting), accounting
+}
+
+func sendFrom(handler http.Handler, ip, path string, count int) {
+	for i := 0; i < count; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost"+path, nil)
+		req.RemoteAddr = ip + ":" + fmt.Sprint(40000+i)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+func fetchClientsReport(t *testing.T, accounting *ClientAccounting, query string) clientsReport {
+	writer := httptest.NewRecorder()
+	accounting.AdminHandler(writer, httptest.NewRequest(http.MethodGet, "http://localhost/admin/clients"+query, nil))
+	require.Equal(t, http.StatusOK, writer.Code)
+	report := clientsReport{}
+	require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &report))
+	return report
+}
+
+func TestClientsEndpointListsTopClientsByRequestsAndErrors(t *testing.T) {
+	now := time.Now()
+	handler, accounting := mkAccountedHandler(httphandlerconfig.ClientAccountingConfig{Enabled: true}, &now)
+	sendFrom(handler, "10.0.0.1", "/bucket/key", 5)
+	sendFrom(handler, "10.0.0.2", "/missing", 3)
+	sendFrom(handler, "10.0.0.2", "/bucket/key", 1)
+	sendFrom(handler, "10.0.0.3", "/bucket/key", 2)
+	sendFrom(handler, "10.0.0.3", "/missing", 1)
+
+	report := fetchClientsReport(t, accounting, "?limit=2")
+
+	assert.Equal(t, "5m0s", report.Window)
+	assert.Equal(t, []ClientStats{{IP: "10.0.0.1", Requests: 5}, {IP: "10.0.0.2", Requests: 4, Errors: 3}}, report.ByRequests)
+	assert.Equal(t, []ClientStats{{IP: "10.0.0.2", Requests: 4, Errors: 3}, {IP: "10.0.0.3", Requests: 3, Errors: 1}}, report.ByErrors)
+}
+
+func TestClientAccountingForgetsRequestsOutsideWindow(t *testing.T) {
+	now := time.Now()
+	conf := httphandlerconfig.ClientAccountingConfig{Enabled: true, Window: metrics.Interval{Duration: time.Minute}}
+	handler, accounting := mkAccountedHandler(conf, &now)
+	sendFrom(handler, "10.0.0.1", "/bucket/key", 5)
+	now = now.Add(30 * time.Second)
+	sendFrom(handler, "10.0.0.1", "/missing", 2)
+	sendFrom(handler, "10.0.0.2", "/bucket/key", 1)
+
+	now = now.Add(40 * time.Second)
+	assert.Equal(t, []ClientStats{{IP: "10.0.0.1", Requests: 2, Errors: 2}, {IP: "10.0.0.2", Requests: 1}},
+		fetchClientsReport(t, accounting, "").ByRequests)
+
+	now = now.Add(time.Minute)
+	assert.Empty(t, fetchClientsReport(t, accounting, "").ByRequests)
+}
+
+func TestClientAccountingEvictsLeastActiveClient(t *testing.T) {
+	now := time.Now()
+	handler, accounting := mkAccountedHandler(httphandlerconfig.ClientAccountingConfig{Enabled: true, MaxClients: 2}, &now)
+	sendFrom(handler, "10.0.0.1", "/bucket/key", 3)
+	sendFrom(handler, "10.0.0.2", "/bucket/key", 1)
+	sendFrom(handler, "10.0.0.3", "/bucket/key", 2)
+
+	assert.Equal(t, []ClientStats{{IP: "10.0.0.1", Requests: 3}, {IP: "10.0.0.3", Requests: 2}},
+		fetchClientsReport(t, accounting, "").ByRequests)
+}
+
+func TestClientsEndpointRejectsInvalidRequests(t *testing.T) {
+	accounting := NewClientAccounting(httphandlerconfig.ClientAccountingConfig{Enabled: true})
+	writer := httptest.NewRecorder()
+	accounting.AdminHandler(writer, httptest.NewRequest(http.MethodPost, "http://localhost/admin/clients", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, writer.Code)
+
+	writer = httptest.NewRecorder()
+	accounting.AdminHandler(writer, httptest.NewRequest(http.MethodGet, "http://localhost/admin/clients?limit=x", nil))
+	assert.Equal(t, http.StatusBadRequest, writer.Code)
+}
+
+func TestClientAccountingIsDisabledByDefault(t *testing.T) {
+	assert.Nil(t, NewClientAccounting(httphandlerconfig.ClientAccountingConfig{}))
+	handler := http.RedirectHandler("/", http.StatusFound)
+	assert.Equal(t, handler, ClientAccountingHandler(handler, nil))
+}
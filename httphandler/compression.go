@@ -0,0 +1,116 @@
+package httphandler
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// DefaultCompressSkipExtensions lists formats which are already compressed
+var DefaultCompressSkipExtensions = []string{
+	".jpg", ".jpeg", ".png", ".gif", ".webp", ".heic",
+	".zip", ".gz", ".tgz", ".bz2", ".xz", ".zst", ".7z", ".rar",
+	".mp3", ".mp4", ".m4a", ".mkv", ".mov", ".avi", ".webm", ".ogg",
+	".woff", ".woff2", ".jar", ".docx", ".xlsx", ".pptx",
+}
+
+// acceptsGzip checks if gzip is listed in Accept-Encoding with non zero quality
+func acceptsGzip(req *http.Request) bool {
+	for _, encoding := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(encoding, ";")
+		if name := strings.TrimSpace(params[0]); name != "gzip" && name != "*" {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.Replace(param, " ", "", -1)
+			if strings.HasPrefix(param, "q=0") && strings.Trim(param[3:], ".0") == "" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipBody compresses upstream body while it is read
+type gzipBody struct {
+	*io.PipeReader
+	upstream io.ReadCloser
+}
+
+func newGzipBody(upstream io.ReadCloser) *gzipBody {
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(pw)
+		_, err := io.Copy(gz, upstream)
+		if closeErr := gz.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+	return &gzipBody{PipeReader: pr, upstream: upstream}
+}
+
+func (gb *gzipBody) Close() error {
+	if err := gb.PipeReader.Close(); err != nil {
+		log.Debugf("Cannot close compressed body: %s", err)
+	}
+	return gb.upstream.Close()
+}
+
+type responseCompressor struct {
+	skipExtensions map[string]bool
+	roundTripper   http.RoundTripper
+}
+
+func (rc *responseCompressor) skipped(req *http.Request) bool {
+	return rc.skipExtensions[strings.ToLower(path.Ext(req.URL.Path))]
+}
+
+func (rc *responseCompressor) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rc.roundTripper.RoundTrip(req)
+	if err != nil || req.Method != http.MethodGet || !acceptsGzip(req) || req.Header.Get("Range") != "" ||
+		resp.StatusCode != http.StatusOK || resp.ContentLength == 0 ||
+		resp.Header.Get("Content-Encoding") != "" || resp.Body == nil {
+		return resp, err
+	}
+	if rc.skipped(req) {
+		metrics.Mark("reqs.global.compression_skipped")
+		return resp, nil
+	}
+	metrics.Mark("reqs.global.compressed")
+	resp.Body = newGzipBody(resp.Body)
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Header.Add("Vary", "Accept-Encoding")
+	// compressed representation differs from stored object
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	return resp, nil
+}
+
+// ResponseCompressor creates Decorator which gzips GET responses for clients
+// accepting gzip. Keys with one of skipExtensions (e.g. ".jpg") are passed
+// uncompressed, nil skipExtensions means DefaultCompressSkipExtensions
+func ResponseCompressor(enabled bool, skipExtensions []string) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if !enabled {
+			return roundTripper
+		}
+		if skipExtensions == nil {
+			skipExtensions = DefaultCompressSkipExtensions
+		}
+		skip := make(map[string]bool, len(skipExtensions))
+		for _, extension := range skipExtensions {
+			skip["."+strings.TrimPrefix(strings.ToLower(extension), ".")] = true
+		}
+		return &responseCompressor{skipExtensions: skip, roundTripper: roundTripper}
+	}
+}
@@ -0,0 +1,137 @@
+package httphandler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/allegro/akubra/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mkContentServer(content string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"etag"`)
+		_, _ = w.Write([]byte(content))
+	}))
+}
+
+func getCompressed(t *testing.T, rt http.RoundTripper, url, acceptEncoding string) (*http.Response, string) {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func gunzip(t *testing.T, body string) string {
+	reader, err := gzip.NewReader(strings.NewReader(body))
+	require.NoError(t, err)
+	content, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	return string(content)
+}
+
+func TestResponseCompressorSkipsListedExtensions(t *testing.T) {
+	content := strings.Repeat("akubra ", 100)
+	srv := mkContentServer(content)
+	defer srv.Close()
+
+	for _, testData := range []struct {
+		skipExtensions []string
+		key            string
+		compressed     bool
+	}{
+		{nil, "/bucket/notes.txt", true},
+		{nil, "/bucket/photo.jpg", false},
+		{nil, "/bucket/ARCHIVE.ZIP", false},
+		{nil, "/bucket/logs.tar.gz", false},
+		{nil, "/bucket/key", true},
+		{[]string{"log", ".TXT"}, "/bucket/notes.txt", false},
+		{[]string{"log", ".TXT"}, "/bucket/app.log", false},
+		{[]string{"log", ".TXT"}, "/bucket/photo.jpg", true},
+		{[]string{}, "/bucket/photo.jpg", true},
+	} {
+		rt := ResponseCompressor(true, testData.skipExtensions)(http.DefaultTransport)
+
+		resp, body := getCompressed(t, rt, srv.URL+testData.key, "gzip, deflate")
+
+		if !testData.compressed {
+			assert.Empty(t, resp.Header.Get("Content-Encoding"), "%v", testData)
+			assert.Equal(t, content, body, "%v", testData)
+			assert.Equal(t, `"etag"`, resp.Header.Get("ETag"), "%v", testData)
+			continue
+		}
+		assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"), "%v", testData)
+		assert.Equal(t, int64(-1), resp.ContentLength, "%v", testData)
+		assert.Equal(t, `W/"etag"`, resp.Header.Get("ETag"), "%v", testData)
+		assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"), "%v", testData)
+		assert.Equal(t, content, gunzip(t, body), "%v", testData)
+	}
+}
+
+func TestResponseCompressorCompressesOnlyForAcceptingClients(t *testing.T) {
+	srv := mkContentServer("content")
+	defer srv.Close()
+	rt := ResponseCompressor(true, nil)(http.DefaultTransport)
+
+	for _, testData := range []struct {
+		acceptEncoding string
+		compressed     bool
+	}{
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"*", true},
+		{"", false},
+		{"deflate", false},
+		{"gzip;q=0", false},
+		{"gzip; q=0.000", false},
+	} {
+		resp, _ := getCompressed(t, rt, srv.URL+"/bucket/key", testData.acceptEncoding)
+		assert.Equal(t, testData.compressed, resp.Header.Get("Content-Encoding") == "gzip", testData.acceptEncoding)
+	}
+}
+
+func TestResponseCompressorIsDisabledByDefault(t *testing.T) {
+	srv := mkContentServer("content")
+	defer srv.Close()
+	rt := ResponseCompressor(false, nil)(http.DefaultTransport)
+
+	resp, body := getCompressed(t, rt, srv.URL+"/bucket/key", "gzip")
+
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "content", body)
+}
+
+func TestGzipEncodedBackendResponsesPassUntouched(t *testing.T) {
+	var stored bytes.Buffer
+	gz := gzip.NewWriter(&stored)
+	_, _ = gz.Write([]byte(strings.Repeat("akubra ", 100)))
+	require.NoError(t, gz.Close())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("ETag", `"etag"`)
+		_, _ = w.Write(stored.Bytes())
+	}))
+	defer srv.Close()
+	httpTransport, err := ConfigureHTTPTransport(config.Config{})
+	require.NoError(t, err)
+	rt := ResponseCompressor(true, nil)(httpTransport)
+
+	for _, acceptEncoding := range []string{"gzip", ""} {
+		resp, body := getCompressed(t, rt, srv.URL+"/bucket/notes.txt", acceptEncoding)
+
+		assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"), acceptEncoding)
+		assert.Equal(t, `"etag"`, resp.Header.Get("ETag"), acceptEncoding)
+		assert.Equal(t, int64(stored.Len()), resp.ContentLength, acceptEncoding)
+		assert.Equal(t, stored.String(), body, "encoded body should not be compressed again nor decoded")
+	}
+}
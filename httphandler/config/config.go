@@ -0,0 +1,250 @@
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/allegro/akubra/metrics"
+)
+
+const (
+	// BucketRootWithoutSlash maps "/bucket/" requests to "/bucket"
+	BucketRootWithoutSlash = "strip"
+	// BucketRootWithSlash maps "/bucket" requests to "/bucket/"
+	BucketRootWithSlash = "append"
+)
+
+const (
+	// PathStyle addresses bucket in request path (host/bucket/key)
+	PathStyle = "path"
+	// VirtualHostedStyle addresses bucket in request host (bucket.host/key)
+	VirtualHostedStyle = "virtual-hosted"
+)
+
+const (
+	// ViaAdd appends akubra to Via header of requests and responses
+	ViaAdd = "add"
+	// ViaStrip removes Via header from requests and responses
+	ViaStrip = "strip"
+	// ViaPassthrough forwards Via header unchanged
+	ViaPassthrough = "passthrough"
+)
+
+// MinAutoMultipartPartSize is the smallest part size backends accept for
+// parts of multipart upload other than the last one
+const MinAutoMultipartPartSize = 5 << 20
+
+const (
+	// RewriteFirstMatch applies only first rewrite rule matching path
+	RewriteFirstMatch = "first"
+	// RewriteAllMatches applies every matching rewrite rule in order, each
+	// to path rewritten by previous ones
+	RewriteAllMatches = "all"
+)
+
+// RewriteRule replaces request path matching regular expression Match with
+// Replace template, $1 or ${name} refer to capture groups. Requests matching
+// rule are counted as reqs.rules.<MetricLabel>, requests matching no rule or
+// rule without MetricLabel as reqs.rules.other
+type RewriteRule struct {
+	Match       string `yaml:"Match"`
+	Replace     string `yaml:"Replace"`
+	MetricLabel string `yaml:"MetricLabel,omitempty"`
+}
+
+// DefaultRuleMetricLabel counts requests not matching any labeled rewrite rule
+const DefaultRuleMetricLabel = "other"
+
+const (
+	// CompleteMultipartUpload operation responds with object Location
+	CompleteMultipartUpload = "CompleteMultipartUpload"
+	// PostObject (browser form upload) operation responds with object Location
+	PostObject = "PostObject"
+)
+
+const (
+	// DefaultIdempotencyTTL is used if Idempotency.TTL is not set
+	DefaultIdempotencyTTL = 10 * time.Minute
+	// DefaultIdempotencyMaxKeys is used if Idempotency.MaxKeys is not set
+	DefaultIdempotencyMaxKeys = 10000
+	// DefaultMultipartTrackingTTL is used if MultipartTracking.TTL is not set
+	DefaultMultipartTrackingTTL = 24 * time.Hour
+	// DefaultBackendRedirectHops is used if FollowBackendRedirects.MaxHops is not set
+	DefaultBackendRedirectHops = 3
+)
+
+// CORSConfig defines how CORS preflight requests are handled
+type CORSConfig struct {
+	// Enabled makes akubra answer OPTIONS preflight requests by itself
+	// instead of passing them to backends
+	Enabled bool `yaml:"Enabled"`
+	// AllowedOrigins list, "*" matches any origin
+	AllowedOrigins []string `yaml:"AllowedOrigins,omitempty"`
+	// AllowedMethods list, e.g. GET, PUT, preflight requesting other method
+	// is answered with 403
+	AllowedMethods []string `yaml:"AllowedMethods,omitempty"`
+	// AllowedHeaders list, preflight requesting other headers is answered
+	// with 403
+	AllowedHeaders []string `yaml:"AllowedHeaders,omitempty"`
+	// MaxAge determines how long preflight response may be cached by client
+	MaxAge metrics.Interval `yaml:"MaxAge,omitempty"`
+}
+
+// IdempotencyConfig defines caching of write results for requests with
+// Idempotency-Key header, so retried writes are not replicated again
+type IdempotencyConfig struct {
+	// Enabled turns caching on
+	Enabled bool `yaml:"Enabled"`
+	// TTL of cached result, DefaultIdempotencyTTL if not set
+	TTL metrics.Interval `yaml:"TTL,omitempty"`
+	// MaxKeys is number of cached results, least recently used results are
+	// dropped above it. DefaultIdempotencyMaxKeys if not set
+	MaxKeys int `yaml:"MaxKeys,omitempty" validate:"min=0"`
+}
+
+// MultipartTrackingConfig defines tracking of multipart uploads in progress
+// (upload ID and backends it was initiated on), so uploads abandoned by
+// clients can be forgotten and aborted
+type MultipartTrackingConfig struct {
+	// MaxTrackedMultipartUploads is number of tracked uploads, least
+	// recently used uploads are evicted above it. Zero disables tracking
+	MaxTrackedMultipartUploads int `yaml:"MaxTrackedMultipartUploads,omitempty" validate:"min=0"`
+	// TTL after last request of upload it's evicted, DefaultMultipartTrackingTTL if not set
+	TTL metrics.Interval `yaml:"TTL,omitempty"`
+	// AbortEvicted sends AbortMultipartUpload of evicted uploads to their backends
+	AbortEvicted bool `yaml:"AbortEvicted,omitempty"`
+}
+
+// BackendRedirectsConfig defines following of backend redirects (e.g. S3
+// region redirects) by akubra instead of passing them to client
+type BackendRedirectsConfig struct {
+	Enabled bool `yaml:"Enabled,omitempty"`
+	// MaxHops is number of redirects followed for single request, last
+	// redirect is passed to client. DefaultBackendRedirectHops if not set
+	MaxHops int `yaml:"MaxHops,omitempty" validate:"min=0"`
+}
+
+// ContentMD5Config defines verification of request bodies against their
+// Content-MD5 header
+type ContentMD5Config struct {
+	// Validate rejects requests with body not matching Content-MD5
+	Validate bool `yaml:"Validate,omitempty"`
+	// Forward sends Content-MD5 header to backends along with verified body
+	Forward bool `yaml:"Forward,omitempty"`
+}
+
+// AuditConfig defines webhook receiving summary of every mutating request
+type AuditConfig struct {
+	// WebhookURL events are posted to as JSON, empty disables audit
+	WebhookURL string `yaml:"WebhookURL,omitempty"`
+	// BufferSize is number of events waiting for delivery, events above it
+	// are dropped. DefaultAuditBufferSize if not set
+	BufferSize int `yaml:"BufferSize,omitempty" validate:"min=0"`
+	// Timeout of single webhook request, DefaultAuditTimeout if not set
+	Timeout metrics.Interval `yaml:"Timeout,omitempty"`
+}
+
+// LoadShedConfig defines when requests should be rejected to protect service
+// from overload
+type LoadShedConfig struct {
+	// HighWatermark is number of in-flight requests above which new requests
+	// are rejected, zero disables load shedding
+	HighWatermark int32 `yaml:"HighWatermark,omitempty" validate:"min=0"`
+	// LowWatermark is number of in-flight requests below which akubra starts
+	// accepting requests again
+	LowWatermark int32 `yaml:"LowWatermark,omitempty" validate:"min=0"`
+}
+
+// ListenRetryConfig defines how binding Listen address is retried, e.g. while
+// previous instance still holds the port during restart
+type ListenRetryConfig struct {
+	// Attempts is number of retries after first failed bind, zero disables
+	// retrying
+	Attempts int `yaml:"Attempts,omitempty" validate:"min=0"`
+	// Delay between attempts, default 1s
+	Delay metrics.Interval `yaml:"Delay,omitempty"`
+}
+
+// RequestQueueConfig bounds number of requests processed at once and waiting
+// for processing
+type RequestQueueConfig struct {
+	// Workers is number of requests processed at once, zero disables queue
+	Workers int `yaml:"Workers,omitempty" validate:"min=0"`
+	// QueueSize is number of requests waiting for free worker, requests
+	// above it are rejected with 503
+	QueueSize int `yaml:"QueueSize,omitempty" validate:"min=0"`
+	// RetryAfter sent with rejected requests, default 1s
+	RetryAfter metrics.Interval `yaml:"RetryAfter,omitempty"`
+}
+
+// ClientAccountingConfig enables counting requests of client IPs, top
+// clients are listed by /admin/clients technical endpoint
+type ClientAccountingConfig struct {
+	Enabled bool `yaml:"Enabled,omitempty"`
+	// Window is sliding window requests are counted in, default 5m
+	Window metrics.Interval `yaml:"Window,omitempty"`
+	// MaxClients limits number of counted IPs, least active one is evicted
+	// for new IP, default 10000
+	MaxClients int `yaml:"MaxClients,omitempty" validate:"min=0"`
+}
+
+// PreStopConfig defines POST /admin/prestop endpoint of technical endpoint,
+// which turns drain mode on and answers once in-flight requests drained
+type PreStopConfig struct {
+	Enabled bool `yaml:"Enabled,omitempty"`
+	// MaxInFlight is number of in-flight requests considered drained
+	MaxInFlight int `yaml:"MaxInFlight,omitempty" validate:"min=0"`
+	// Timeout of waiting for drain, default 30s
+	Timeout metrics.Interval `yaml:"Timeout,omitempty"`
+}
+
+// ChaosConfig defines faults injected into requests for resilience testing,
+// it takes effect only if AKUBRA_CHAOS environment variable is set to "true"
+type ChaosConfig struct {
+	// Enabled turns chaos mode on
+	Enabled bool `yaml:"Enabled"`
+	// LatencyMs is delay in milliseconds added to delayed requests
+	LatencyMs int `yaml:"LatencyMs,omitempty" validate:"min=0"`
+	// LatencyRate is fraction of requests delayed by LatencyMs
+	LatencyRate float64 `yaml:"LatencyRate,omitempty" validate:"min=0,max=1"`
+	// ErrorRate is fraction of requests failed without contacting backends
+	ErrorRate float64 `yaml:"ErrorRate,omitempty" validate:"min=0,max=1"`
+}
+
+// HealthProbesConfig recognizes load balancer health probes, which are served
+// as any other request but are not written to access log
+type HealthProbesConfig struct {
+	// Paths of probe requests, matched exactly
+	Paths []string `yaml:"Paths,omitempty"`
+	// UserAgents of probe requests, matched by prefix (e.g. "ELB-HealthChecker")
+	UserAgents []string `yaml:"UserAgents,omitempty"`
+}
+
+// AccessLogFieldsConfig lists access log fields (by their JSON names) written
+// for responses of status class ("2xx", "3xx", "4xx", "5xx"). Classes without
+// entry are logged with all fields
+type AccessLogFieldsConfig map[string][]string
+
+// StatusClass returns class of given status code, e.g. "2xx"
+func StatusClass(statusCode int) string {
+	return fmt.Sprintf("%dxx", statusCode/100)
+}
+
+// Fields returns fields selected for status code, ok is false if all fields
+// should be logged
+func (alf AccessLogFieldsConfig) Fields(statusCode int) (fields []string, ok bool) {
+	fields, ok = alf[StatusClass(statusCode)]
+	return fields, ok
+}
+
+// Includes checks if field is selected for any status class
+func (alf AccessLogFieldsConfig) Includes(field string) bool {
+	for _, fields := range alf {
+		for _, selected := range fields {
+			if selected == field {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package httphandler
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// ErrTooManyConnections is returned by connections exceeding per IP limit
+var ErrTooManyConnections = errors.New("too many connections from client IP")
+
+// ipConnCounter tracks number of open connections per client IP
+type ipConnCounter struct {
+	mx    sync.Mutex
+	limit int
+	conns map[string]int
+}
+
+func (cc *ipConnCounter) acquire(ip string) bool {
+	cc.mx.Lock()
+	defer cc.mx.Unlock()
+	if cc.conns[ip] >= cc.limit {
+		return false
+	}
+	cc.conns[ip]++
+	return true
+}
+
+func (cc *ipConnCounter) release(ip string) {
+	cc.mx.Lock()
+	defer cc.mx.Unlock()
+	cc.conns[ip]--
+	if cc.conns[ip] <= 0 {
+		delete(cc.conns, ip)
+	}
+}
+
+// limitedConn is admitted on first read, when http.Server starts reading
+// request. RemoteAddr of PROXY protocol connections is known only then
+type limitedConn struct {
+	net.Conn
+	counter   *ipConnCounter
+	admission sync.Once
+	ip        string
+	admitted  bool
+	closing   sync.Once
+}
+
+func (lc *limitedConn) admit() {
+	lc.admission.Do(func() {
+		addr := lc.Conn.RemoteAddr().String()
+		ip, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			ip = addr
+		}
+		lc.ip = ip
+		lc.admitted = lc.counter.acquire(ip)
+		if !lc.admitted {
+			metrics.Mark("reqs.global.conns_per_ip_refused")
+			log.Printf("Refusing connection from %s, limit of %d connections reached", addr, lc.counter.limit)
+			if closeErr := lc.Conn.Close(); closeErr != nil {
+				log.Debugf("Cannot close connection of %s: %s", addr, closeErr)
+			}
+		}
+	})
+}
+
+func (lc *limitedConn) Read(p []byte) (int, error) {
+	lc.admit()
+	if !lc.admitted {
+		return 0, ErrTooManyConnections
+	}
+	return lc.Conn.Read(p)
+}
+
+func (lc *limitedConn) Close() error {
+	// connection closed before first read is never admitted
+	lc.admission.Do(func() {})
+	lc.closing.Do(func() {
+		if lc.admitted {
+			lc.counter.release(lc.ip)
+		}
+	})
+	return lc.Conn.Close()
+}
+
+type connLimitListener struct {
+	net.Listener
+	counter *ipConnCounter
+}
+
+func (cl *connLimitListener) Accept() (net.Conn, error) {
+	conn, err := cl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &limitedConn{Conn: conn, counter: cl.counter}, nil
+}
+
+// ConnLimitListener wraps listener, connections from client IP which already
+// has limit connections open are closed. Zero limit returns listener unchanged
+func ConnLimitListener(listener net.Listener, limit int) net.Listener {
+	if limit <= 0 {
+		return listener
+	}
+	return &connLimitListener{
+		Listener: listener,
+		counter:  &ipConnCounter{limit: limit, conns: make(map[string]int)},
+	}
+}
+
+// clientConn frees its slot of clientConnLimitListener once closed
+type clientConn struct {
+	net.Conn
+	listener *clientConnLimitListener
+	closing  sync.Once
+}
+
+func (cc *clientConn) Close() error {
+	cc.closing.Do(cc.listener.release)
+	return cc.Conn.Close()
+}
+
+type clientConnLimitListener struct {
+	net.Listener
+	slots   chan struct{}
+	done    chan struct{}
+	closing sync.Once
+	open    int64
+}
+
+func (cl *clientConnLimitListener) acquire() bool {
+	select {
+	case cl.slots <- struct{}{}:
+		return true
+	default:
+	}
+	metrics.Mark("reqs.global.client_conns_delayed")
+	select {
+	case cl.slots <- struct{}{}:
+		return true
+	case <-cl.done:
+		return false
+	}
+}
+
+func (cl *clientConnLimitListener) release() {
+	metrics.UpdateGauge("conns.client.open", atomic.AddInt64(&cl.open, -1))
+	<-cl.slots
+}
+
+func (cl *clientConnLimitListener) Accept() (net.Conn, error) {
+	if !cl.acquire() {
+		// listener is closed, Accept returns its error
+		return cl.Listener.Accept()
+	}
+	conn, err := cl.Listener.Accept()
+	if err != nil {
+		<-cl.slots
+		return nil, err
+	}
+	metrics.UpdateGauge("conns.client.open", atomic.AddInt64(&cl.open, 1))
+	return &clientConn{Conn: conn, listener: cl}, nil
+}
+
+func (cl *clientConnLimitListener) Close() error {
+	cl.closing.Do(func() { close(cl.done) })
+	return cl.Listener.Close()
+}
+
+// ClientConnLimitListener wraps listener, once limit client connections are
+// open accepting next one waits until one of them is closed. Waiting clients
+// are kept in listen backlog, so they do not use file descriptors. Zero limit
+// returns listener unchanged
+func ClientConnLimitListener(listener net.Listener, limit int) net.Listener {
+	if limit <= 0 {
+		return listener
+	}
+	return &clientConnLimitListener{
+		Listener: listener,
+		slots:    make(chan struct{}, limit),
+		done:     make(chan struct{}),
+	}
+}
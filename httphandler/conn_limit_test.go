@@ -0,0 +1,124 @@
+package httphandler
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	gometrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mkConnLimitServer(t *testing.T, limit int) (addr string, stop func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go func() { _ = srv.Serve(ConnLimitListener(listener, limit)) }()
+	return listener.Addr().String(), func() { _ = srv.Close() }
+}
+
+// openConn sends request on new keep-alive connection, conn is nil if
+// connection was refused
+func openConn(t *testing.T, addr string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("GET /bucket/key HTTP/1.1\r\nHost: akubra.internal\r\n\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		assert.NoError(t, conn.Close())
+		return nil
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	return conn
+}
+
+func TestConnLimitListenerRefusesConnectionsAboveLimit(t *testing.T) {
+	addr, stop := mkConnLimitServer(t, 3)
+	defer stop()
+
+	var conns []net.Conn
+	for i := 0; i < 5; i++ {
+		if conn := openConn(t, addr); conn != nil {
+			conns = append(conns, conn)
+		}
+	}
+	assert.Len(t, conns, 3)
+
+	// closed connection frees slot for new one
+	assert.NoError(t, conns[0].Close())
+	deadline := time.Now().Add(time.Second)
+	conn := openConn(t, addr)
+	for conn == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		conn = openConn(t, addr)
+	}
+	assert.NotNil(t, conn)
+	assert.Nil(t, openConn(t, addr))
+	for _, c := range append(conns[1:], conn) {
+		if c != nil {
+			assert.NoError(t, c.Close())
+		}
+	}
+}
+
+func TestConnLimitListenerIsDisabledWithoutLimit(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	assert.Equal(t, listener, ConnLimitListener(listener, 0))
+}
+
+func openClientConns() int64 {
+	if gauge, ok := gometrics.Get("conns.client.open").(gometrics.Gauge); ok {
+		return gauge.Value()
+	}
+	return 0
+}
+
+func TestClientConnLimitListenerDelaysConnectionsAboveLimit(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go func() { _ = srv.Serve(ClientConnLimitListener(listener, 3)) }()
+	defer srv.Close()
+	addr := listener.Addr().String()
+
+	var conns []net.Conn
+	for i := 0; i < 5; i++ {
+		if conn := openConn(t, addr); conn != nil {
+			conns = append(conns, conn)
+		}
+	}
+	assert.Len(t, conns, 3, "connections above limit should not be served")
+	assert.Equal(t, int64(3), openClientConns())
+
+	// waiting connection is accepted once open one is closed
+	waiting, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer waiting.Close()
+	_, err = waiting.Write([]byte("GET /bucket/key HTTP/1.1\r\nHost: akubra.internal\r\n\r\n"))
+	require.NoError(t, err)
+	assert.NoError(t, conns[0].Close())
+	require.NoError(t, waiting.SetReadDeadline(time.Now().Add(time.Second)))
+	resp, err := http.ReadResponse(bufio.NewReader(waiting), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(3), openClientConns())
+	for _, conn := range conns[1:] {
+		assert.NoError(t, conn.Close())
+	}
+}
+
+func TestClientConnLimitListenerIsDisabledWithoutLimit(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	assert.Equal(t, listener, ClientConnLimitListener(listener, 0))
+}
@@ -0,0 +1,42 @@
+package httphandler
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"time"
+
+	"github.com/allegro/akubra/metrics"
+)
+
+type connReuseMetrics struct {
+	roundTripper http.RoundTripper
+}
+
+func (crm *connReuseMetrics) RoundTrip(req *http.Request) (*http.Response, error) {
+	prefix := "reqs.backend." + metrics.Clean(req.URL.Host) + ".conns."
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if !info.Reused {
+				metrics.Mark(prefix + "new")
+				return
+			}
+			metrics.Mark(prefix + "reused")
+			if info.WasIdle {
+				metrics.UpdateHistogram(prefix+"idle_ms", int64(info.IdleTime/time.Millisecond))
+			}
+		},
+	}
+	return crm.roundTripper.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+// ConnectionReuseMetrics creates Decorator which counts requests sent over
+// new and reused (keep-alive) connections of every backend, and how long
+// reused connections were idle
+func ConnectionReuseMetrics(enabled bool) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if !enabled {
+			return roundTripper
+		}
+		return &connReuseMetrics{roundTripper: roundTripper}
+	}
+}
@@ -0,0 +1,52 @@
+package httphandler
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/allegro/akubra/metrics"
+	gometrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func meterCount(name string) int64 {
+	if meter, ok := gometrics.Get(name).(gometrics.Meter); ok {
+		return meter.Count()
+	}
+	return 0
+}
+
+func TestConnectionReuseMetricsCountNewAndReusedConnections(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	backendURL, _ := url.Parse(srv.URL)
+	prefix := "reqs.backend." + metrics.Clean(backendURL.Host) + ".conns."
+	httpTransport := &http.Transport{}
+	defer httpTransport.CloseIdleConnections()
+	rt := ConnectionReuseMetrics(true)(httpTransport)
+	get := func() {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/bucket/key", nil)
+		resp, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		_, _ = ioutil.ReadAll(resp.Body)
+		require.NoError(t, resp.Body.Close())
+	}
+
+	get()
+	assert.Equal(t, int64(1), meterCount(prefix+"new"))
+	assert.Equal(t, int64(0), meterCount(prefix+"reused"))
+
+	get()
+	assert.Equal(t, int64(1), meterCount(prefix+"new"))
+	assert.Equal(t, int64(1), meterCount(prefix+"reused"))
+}
+
+func TestConnectionReuseMetricsCanBeDisabled(t *testing.T) {
+	assert.Equal(t, http.DefaultTransport, ConnectionReuseMetrics(false)(http.DefaultTransport))
+}
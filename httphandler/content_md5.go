@@ -0,0 +1,104 @@
+package httphandler
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// ErrBadDigest is returned by request body reader if body doesn't match its
+// Content-MD5 header
+var ErrBadDigest = errors.New("request body does not match Content-MD5")
+
+// digestVerifier computes MD5 of body as it's read and fails the read which
+// completes body if digest doesn't match. Body is complete at EOF or once
+// expected length is read, as transport doesn't read past Content-Length
+type digestVerifier struct {
+	io.ReadCloser
+	hash     hash.Hash
+	expected []byte
+	length   int64
+	read     int64
+	verified bool
+	mismatch bool
+}
+
+func (dv *digestVerifier) Read(p []byte) (int, error) {
+	if dv.mismatch {
+		return 0, ErrBadDigest
+	}
+	n, err := dv.ReadCloser.Read(p)
+	dv.read += int64(n)
+	_, _ = dv.hash.Write(p[:n])
+	if err == io.EOF || dv.length >= 0 && dv.read >= dv.length {
+		if !dv.verified && !bytes.Equal(dv.hash.Sum(nil), dv.expected) {
+			dv.mismatch = true
+			return n, ErrBadDigest
+		}
+		dv.verified = true
+	}
+	return n, err
+}
+
+// decodeContentMD5 decodes Content-MD5 header, ok is false if it's malformed
+func decodeContentMD5(header string) (digest []byte, ok bool) {
+	digest, err := base64.StdEncoding.DecodeString(header)
+	return digest, err == nil && len(digest) == md5.Size
+}
+
+type contentMD5Validator struct {
+	forward      bool
+	roundTripper http.RoundTripper
+}
+
+func (cmv *contentMD5Validator) RoundTrip(req *http.Request) (*http.Response, error) {
+	header := req.Header.Get("Content-Md5")
+	if header == "" {
+		return cmv.roundTripper.RoundTrip(req)
+	}
+	expected, ok := decodeContentMD5(header)
+	if !ok {
+		return s3ErrorResponse(req, http.StatusBadRequest, "InvalidDigest",
+			"The Content-MD5 you specified was invalid."), nil
+	}
+	if !cmv.forward {
+		req.Header.Del("Content-Md5")
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return cmv.roundTripper.RoundTrip(req)
+	}
+	verifier := &digestVerifier{ReadCloser: req.Body, hash: md5.New(), expected: expected, length: req.ContentLength}
+	req.Body = verifier
+	resp, err := cmv.roundTripper.RoundTrip(req)
+	if !verifier.mismatch {
+		return resp, err
+	}
+	if err == nil {
+		discardResponseBody(resp)
+	}
+	metrics.Mark("reqs.global.bad_digest")
+	log.Debugf("Rejected request %s %s%s, body does not match Content-MD5", req.Method, req.Host, req.URL.Path)
+	return s3ErrorResponse(req, http.StatusBadRequest, "BadDigest",
+		"The Content-MD5 you specified did not match what we received."), nil
+}
+
+// ContentMD5Validator creates Decorator which verifies request body against
+// its Content-MD5 header while body is buffered for replication, so
+// mismatching body isn't sent to backends and client gets 400 BadDigest.
+// Header is forwarded to backends if conf.Forward is set
+func ContentMD5Validator(conf httphandlerconfig.ContentMD5Config) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if !conf.Validate {
+			return roundTripper
+		}
+		return &contentMD5Validator{forward: conf.Forward, roundTripper: roundTripper}
+	}
+}
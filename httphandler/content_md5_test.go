@@ -0,0 +1,144 @@
+package httphandler
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+	"github.com/allegro/akubra/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type uploadRecorder struct {
+	mx      sync.Mutex
+	bodies  []string
+	digests []string
+}
+
+func (ur *uploadRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	ur.mx.Lock()
+	defer ur.mx.Unlock()
+	ur.bodies = append(ur.bodies, string(body))
+	ur.digests = append(ur.digests, r.Header.Get("Content-Md5"))
+}
+
+func (ur *uploadRecorder) recorded() ([]string, []string) {
+	ur.mx.Lock()
+	defer ur.mx.Unlock()
+	return ur.bodies, ur.digests
+}
+
+func contentMD5(body string) string {
+	sum := md5.Sum([]byte(body))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func mkDigestTransport(conf httphandlerconfig.ContentMD5Config, backends ...*httptest.Server) http.RoundTripper {
+	urls := make([]url.URL, 0, len(backends))
+	for _, backend := range backends {
+		backendURL, _ := url.Parse(backend.URL)
+		urls = append(urls, *backendURL)
+	}
+	return ContentMD5Validator(conf)(transport.NewMultiTransport(http.DefaultTransport, urls, nil,
+		transport.MultiTransportOptions{}))
+}
+
+func digestPut(t *testing.T, rt http.RoundTripper, body, digest string, chunked bool) *http.Response {
+	req, _ := http.NewRequest(http.MethodPut, "http://akubra.internal/bucket/key", strings.NewReader(body))
+	req.Header.Set("Content-MD5", digest)
+	if chunked {
+		req.ContentLength = -1
+	}
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func s3ErrorCode(t *testing.T, resp *http.Response) string {
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	s3Error := S3Error{}
+	require.NoError(t, xml.Unmarshal(body, &s3Error))
+	return s3Error.Code
+}
+
+func TestContentMD5ValidatorReplicatesMatchingBody(t *testing.T) {
+	for _, forward := range []bool{false, true} {
+		first, second := &uploadRecorder{}, &uploadRecorder{}
+		firstSrv, secondSrv := httptest.NewServer(first), httptest.NewServer(second)
+		rt := mkDigestTransport(httphandlerconfig.ContentMD5Config{Validate: true, Forward: forward}, firstSrv, secondSrv)
+
+		resp := digestPut(t, rt, "object data", contentMD5("object data"), false)
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		expectedDigest := ""
+		if forward {
+			expectedDigest = contentMD5("object data")
+		}
+		for _, recorder := range []*uploadRecorder{first, second} {
+			// response is sent once quorum of backends responded
+			waitFor(t, func() bool {
+				bodies, _ := recorder.recorded()
+				return len(bodies) > 0
+			}, "upload was not replicated to every backend")
+			bodies, digests := recorder.recorded()
+			assert.Equal(t, []string{"object data"}, bodies)
+			assert.Equal(t, []string{expectedDigest}, digests, "forward %t", forward)
+		}
+		firstSrv.Close()
+		secondSrv.Close()
+	}
+}
+
+func TestContentMD5ValidatorRejectsMismatchingBody(t *testing.T) {
+	for _, chunked := range []bool{false, true} {
+		recorder := &uploadRecorder{}
+		backend := httptest.NewServer(recorder)
+		rt := mkDigestTransport(httphandlerconfig.ContentMD5Config{Validate: true}, backend)
+
+		resp := digestPut(t, rt, "corrupted data", contentMD5("object data"), chunked)
+
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, "BadDigest", s3ErrorCode(t, resp))
+		bodies, _ := recorder.recorded()
+		assert.Empty(t, bodies, "chunked %t", chunked)
+		backend.Close()
+	}
+}
+
+func TestContentMD5ValidatorRejectsMalformedDigest(t *testing.T) {
+	recorder := &uploadRecorder{}
+	backend := httptest.NewServer(recorder)
+	defer backend.Close()
+	rt := mkDigestTransport(httphandlerconfig.ContentMD5Config{Validate: true}, backend)
+
+	resp := digestPut(t, rt, "object data", "bm90IG1kNQ==", false)
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "InvalidDigest", s3ErrorCode(t, resp))
+	bodies, _ := recorder.recorded()
+	assert.Empty(t, bodies)
+}
+
+func TestContentMD5ValidatorPassesHeaderWhenDisabled(t *testing.T) {
+	recorder := &uploadRecorder{}
+	backend := httptest.NewServer(recorder)
+	defer backend.Close()
+	rt := mkDigestTransport(httphandlerconfig.ContentMD5Config{}, backend)
+
+	resp := digestPut(t, rt, "corrupted data", contentMD5("object data"), false)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, digests := recorder.recorded()
+	assert.Equal(t, []string{contentMD5("object data")}, digests)
+}
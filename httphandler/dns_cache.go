@@ -0,0 +1,92 @@
+package httphandler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// hostResolver resolves host names, satisfied by *net.Resolver
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+type dnsCacheEntry struct {
+	addrs      []string
+	resolvedAt time.Time
+}
+
+// dnsCache keeps resolved backend addresses for ttl. Once ttl passes host is
+// resolved again, but if resolution fails last known addresses are used
+type dnsCache struct {
+	resolver hostResolver
+	ttl      time.Duration
+	now      func() time.Time
+	mx       sync.Mutex
+	entries  map[string]dnsCacheEntry
+}
+
+func newDNSCache(resolver hostResolver, ttl time.Duration) *dnsCache {
+	return &dnsCache{
+		resolver: resolver,
+		ttl:      ttl,
+		now:      time.Now,
+		entries:  make(map[string]dnsCacheEntry),
+	}
+}
+
+func (dc *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	dc.mx.Lock()
+	entry, cached := dc.entries[host]
+	dc.mx.Unlock()
+	if cached && dc.now().Sub(entry.resolvedAt) < dc.ttl {
+		return entry.addrs, nil
+	}
+
+	addrs, err := dc.resolver.LookupHost(ctx, host)
+	if err != nil {
+		if cached {
+			metrics.Mark("reqs.backend." + metrics.Clean(host) + ".dns_stale")
+			log.Printf("Cannot resolve %s, using cached addresses %v, reason: %q", host, entry.addrs, err.Error())
+			return entry.addrs, nil
+		}
+		return nil, err
+	}
+
+	dc.mx.Lock()
+	dc.entries[host] = dnsCacheEntry{addrs: addrs, resolvedAt: dc.now()}
+	dc.mx.Unlock()
+	return addrs, nil
+}
+
+// dialContext resolves address host with cache and dials resolved addresses
+// one by one until connection succeeds
+func (dc *dnsCache) dialContext(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, address)
+		}
+		addrs, err := dc.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		lastErr := fmt.Errorf("no addresses resolved for %s", host)
+		for _, addr := range addrs {
+			conn, dialErr := dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+			if dialErr == nil {
+				return conn, nil
+			}
+			lastErr = dialErr
+		}
+		return nil, lastErr
+	}
+}
@@ -0,0 +1,93 @@
+package httphandler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type flakyResolver struct {
+	addrs   []string
+	failing bool
+	calls   int
+}
+
+func (fr *flakyResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	fr.calls++
+	if fr.failing {
+		return nil, errors.New("temporary resolver failure")
+	}
+	return fr.addrs, nil
+}
+
+func TestDNSCacheServesCachedAddressesWithinTTL(t *testing.T) {
+	resolver := &flakyResolver{addrs: []string{"10.0.0.1"}}
+	cache := newDNSCache(resolver, time.Minute)
+	moment := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	cache.now = func() time.Time { return moment }
+
+	for i := 0; i < 3; i++ {
+		addrs, err := cache.lookup(context.Background(), "backend.test")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"10.0.0.1"}, addrs)
+	}
+	assert.Equal(t, 1, resolver.calls)
+
+	moment = moment.Add(2 * time.Minute)
+	resolver.addrs = []string{"10.0.0.2"}
+	addrs, err := cache.lookup(context.Background(), "backend.test")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.2"}, addrs)
+	assert.Equal(t, 2, resolver.calls)
+}
+
+func TestDNSCacheUsesStaleAddressesOnResolverFailure(t *testing.T) {
+	resolver := &flakyResolver{addrs: []string{"10.0.0.1"}}
+	cache := newDNSCache(resolver, time.Minute)
+	moment := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	cache.now = func() time.Time { return moment }
+
+	_, err := cache.lookup(context.Background(), "backend.test")
+	assert.NoError(t, err)
+
+	moment = moment.Add(2 * time.Minute)
+	resolver.failing = true
+	addrs, err := cache.lookup(context.Background(), "backend.test")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1"}, addrs)
+
+	_, err = cache.lookup(context.Background(), "unknown.test")
+	assert.Error(t, err)
+}
+
+func TestDNSCacheDialsResolvedAddressDuringResolverFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	resolver := &flakyResolver{addrs: []string{srvURL.Hostname()}}
+	cache := newDNSCache(resolver, time.Nanosecond)
+	client := &http.Client{Transport: &http.Transport{
+		DialContext:       cache.dialContext(&net.Dialer{Timeout: time.Second}),
+		DisableKeepAlives: true,
+	}}
+	backendURL := "http://backend.test:" + srvURL.Port() + "/bucket/key"
+
+	resp, err := client.Get(backendURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resolver.failing = true
+	resp, err = client.Get(backendURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, resolver.calls)
+}
@@ -0,0 +1,127 @@
+package httphandler
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// DefaultDrainSentinelInterval is how often sentinel file is checked if
+// DrainSentinelInterval is not set
+const DefaultDrainSentinelInterval = time.Second
+
+// DrainSentinel turns drain mode on while sentinel file exists or after
+// Force
+type DrainSentinel struct {
+	path     string
+	interval time.Duration
+	draining int32
+	forced   int32
+}
+
+// NewDrainSentinel creates DrainSentinel of file at path, it's nil if path
+// is empty
+func NewDrainSentinel(path string, interval time.Duration) *DrainSentinel {
+	if path == "" {
+		return nil
+	}
+	if interval <= 0 {
+		interval = DefaultDrainSentinelInterval
+	}
+	return &DrainSentinel{path: path, interval: interval}
+}
+
+// NewForcedDrainSentinel creates DrainSentinel without sentinel file, its
+// drain mode is turned on only by Force
+func NewForcedDrainSentinel() *DrainSentinel {
+	return &DrainSentinel{interval: DefaultDrainSentinelInterval}
+}
+
+// Draining tells if drain mode is on
+func (ds *DrainSentinel) Draining() bool {
+	return ds != nil && (atomic.LoadInt32(&ds.draining) == 1 || atomic.LoadInt32(&ds.forced) == 1)
+}
+
+// Force turns drain mode on until restart, whether sentinel file exists or
+// not
+func (ds *DrainSentinel) Force() {
+	if atomic.SwapInt32(&ds.forced, 1) == 0 {
+		log.Println("Drain mode forced on")
+	}
+	metrics.UpdateGauge("reqs.global.draining", 1)
+}
+
+// check updates drain mode according to sentinel file existence
+func (ds *DrainSentinel) check() {
+	if ds.path == "" {
+		return
+	}
+	_, err := os.Stat(ds.path)
+	value := int32(0)
+	if err == nil {
+		value = 1
+	}
+	if atomic.SwapInt32(&ds.draining, value) != value {
+		log.Printf("Drain mode switched by sentinel file %s, draining: %t", ds.path, value == 1)
+	}
+	if atomic.LoadInt32(&ds.forced) == 1 {
+		value = 1
+	}
+	metrics.UpdateGauge("reqs.global.draining", int64(value))
+}
+
+// Watch checks sentinel file every interval until stop is closed
+func (ds *DrainSentinel) Watch(stop <-chan struct{}) {
+	ds.check()
+	ticker := time.NewTicker(ds.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ds.check()
+		case <-stop:
+			return
+		}
+	}
+}
+
+type drainHandler struct {
+	handler             http.Handler
+	sentinel            *DrainSentinel
+	healthCheckEndpoint string
+}
+
+func (dh *drainHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !dh.sentinel.Draining() {
+		dh.handler.ServeHTTP(w, req)
+		return
+	}
+	if strings.ToLower(req.URL.Path) == dh.healthCheckEndpoint {
+		w.Header().Set("Cache-Control", "no-cache, no-store")
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = io.WriteString(w, "DRAINING")
+		return
+	}
+	// requests are still served, but clients are moved off keep-alive
+	// connections
+	w.Header().Set("Connection", "close")
+	dh.handler.ServeHTTP(w, req)
+}
+
+// DrainMode wraps handler, while sentinel is draining health check endpoint
+// responds with 503, so load balancer stops sending new clients, and
+// connections are closed after in-flight requests are served. Nil sentinel
+// disables it
+func DrainMode(handler http.Handler, sentinel *DrainSentinel, healthCheckEndpoint string) http.Handler {
+	if sentinel == nil {
+		return handler
+	}
+	return &drainHandler{handler: handler, sentinel: sentinel, healthCheckEndpoint: healthCheckEndpoint}
+}
@@ -0,0 +1,116 @@
+package httphandler
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// DrainSummary describes how requests in flight drained during shutdown
+type DrainSummary struct {
+	Started  time.Time
+	Finished time.Time
+	// PeakInFlight is the highest number of requests in flight during drain
+	PeakInFlight int64
+	// Completed requests finished during drain
+	Completed int64
+	// CutOff requests were still in flight when drain ended, their
+	// connections are closed at shutdown timeout
+	CutOff int64
+}
+
+// DrainMetrics counts client requests in flight and reports how they were
+// drained once shutdown started
+type DrainMetrics struct {
+	mx       sync.Mutex
+	mainlog  log.Logger
+	now      func() time.Time
+	inFlight int64
+	draining bool
+	summary  DrainSummary
+}
+
+// NewDrainMetrics creates DrainMetrics logging drain summary to mainlog, it
+// returns nil if not enabled
+func NewDrainMetrics(enabled bool, mainlog log.Logger) *DrainMetrics {
+	if !enabled {
+		return nil
+	}
+	return &DrainMetrics{mainlog: mainlog, now: time.Now}
+}
+
+func (dm *DrainMetrics) begin() {
+	dm.mx.Lock()
+	defer dm.mx.Unlock()
+	dm.inFlight++
+	if dm.draining && dm.inFlight > dm.summary.PeakInFlight {
+		dm.summary.PeakInFlight = dm.inFlight
+	}
+}
+
+func (dm *DrainMetrics) end() {
+	dm.mx.Lock()
+	defer dm.mx.Unlock()
+	dm.inFlight--
+	if dm.draining {
+		dm.summary.Completed++
+	}
+}
+
+// Start records drain start, it's called once shutdown begins
+func (dm *DrainMetrics) Start() {
+	if dm == nil {
+		return
+	}
+	dm.mx.Lock()
+	defer dm.mx.Unlock()
+	if dm.draining {
+		return
+	}
+	dm.draining = true
+	dm.summary = DrainSummary{Started: dm.now(), PeakInFlight: dm.inFlight}
+	metrics.UpdateGauge("reqs.global.drain.started", dm.summary.Started.Unix())
+	dm.mainlog.Printf("Drain started with %d requests in flight", dm.inFlight)
+}
+
+// Finish records drain end once server stopped, reports summary to metrics
+// and mainlog and returns it. Zero summary is returned if drain was not
+// started
+func (dm *DrainMetrics) Finish() DrainSummary {
+	if dm == nil {
+		return DrainSummary{}
+	}
+	dm.mx.Lock()
+	defer dm.mx.Unlock()
+	if !dm.draining {
+		return DrainSummary{}
+	}
+	dm.draining = false
+	summary := dm.summary
+	summary.Finished = dm.now()
+	summary.CutOff = dm.inFlight
+	metrics.UpdateGauge("reqs.global.drain.finished", summary.Finished.Unix())
+	metrics.UpdateGauge("reqs.global.drain.peak_in_flight", summary.PeakInFlight)
+	metrics.UpdateGauge("reqs.global.drain.completed", summary.Completed)
+	metrics.UpdateGauge("reqs.global.drain.cut_off", summary.CutOff)
+	metrics.UpdateSince("reqs.global.drain.duration", summary.Started)
+	dm.mainlog.Printf("Drain finished in %s, peak in-flight %d, completed %d, cut off %d",
+		summary.Finished.Sub(summary.Started), summary.PeakInFlight, summary.Completed, summary.CutOff)
+	return summary
+}
+
+// DrainTracking counts requests in flight of handler for drainMetrics,
+// handler is returned unchanged if drainMetrics is nil
+func DrainTracking(handler http.Handler, drainMetrics *DrainMetrics) http.Handler {
+	if drainMetrics == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		drainMetrics.begin()
+		defer drainMetrics.end()
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,71 @@
+package httphandler
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrainMetricsReportCompletedAndCutOffRequestsOfShutdown(t *testing.T) {
+	var mainlog lockedBuffer
+	logger := &logrus.Logger{Out: &mainlog, Formatter: log.PlainTextFormatter{}, Hooks: make(logrus.LevelHooks), Level: logrus.DebugLevel}
+	drainMetrics := NewDrainMetrics(true, logger)
+	release := make(chan struct{})
+	started := sync.WaitGroup{}
+	started.Add(3)
+	srv := &http.Server{Handler: DrainTracking(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started.Done()
+		if r.URL.Path == "/bucket/stuck" {
+			<-r.Context().Done()
+			return
+		}
+		<-release
+	}), drainMetrics)}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = srv.Serve(listener) }()
+	for _, key := range []string{"first", "second", "stuck"} {
+		go func(key string) {
+			resp, err := http.Get("http://" + listener.Addr().String() + "/bucket/" + key)
+			if err == nil {
+				_ = resp.Body.Close()
+			}
+		}(key)
+	}
+	started.Wait()
+
+	drainMetrics.Start()
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.Error(t, srv.Shutdown(ctx), "stuck request should outlive shutdown timeout")
+	summary := drainMetrics.Finish()
+	assert.NoError(t, srv.Close())
+
+	assert.Equal(t, int64(3), summary.PeakInFlight)
+	assert.Equal(t, int64(2), summary.Completed)
+	assert.Equal(t, int64(1), summary.CutOff)
+	assert.True(t, summary.Finished.Sub(summary.Started) >= 200*time.Millisecond)
+	assert.True(t, strings.Contains(string(mainlog.Bytes()), "peak in-flight 3, completed 2, cut off 1"),
+		"drain summary should be logged, got %q", mainlog.Bytes())
+}
+
+func TestDrainMetricsAreNotReportedWithoutDrain(t *testing.T) {
+	var mainlog lockedBuffer
+	logger := &logrus.Logger{Out: &mainlog, Formatter: log.PlainTextFormatter{}, Hooks: make(logrus.LevelHooks), Level: logrus.DebugLevel}
+
+	assert.Equal(t, DrainSummary{}, NewDrainMetrics(true, logger).Finish())
+	assert.Empty(t, mainlog.Bytes())
+	assert.Nil(t, NewDrainMetrics(false, logger))
+	handler := http.NewServeMux()
+	assert.Equal(t, handler, DrainTracking(handler, nil))
+}
@@ -0,0 +1,71 @@
+package httphandler
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrainSentinelFollowsSentinelFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "akubra-drain")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "drain")
+	sentinel := NewDrainSentinel(path, 5*time.Millisecond)
+	stop := make(chan struct{})
+	defer close(stop)
+	go sentinel.Watch(stop)
+
+	assert.False(t, sentinel.Draining())
+	require.NoError(t, ioutil.WriteFile(path, nil, 0600))
+	waitFor(t, sentinel.Draining, "sentinel file should turn drain mode on")
+	require.NoError(t, os.Remove(path))
+	waitFor(t, func() bool { return !sentinel.Draining() }, "removed sentinel file should turn drain mode off")
+}
+
+func TestDrainModeFailsHealthCheckAndClosesConnections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "akubra-drain")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "drain")
+	sentinel := NewDrainSentinel(path, time.Second)
+	handler := DrainMode(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}), sentinel, "/status/ping")
+	call := func(path string) *httptest.ResponseRecorder {
+		writer := httptest.NewRecorder()
+		handler.ServeHTTP(writer, httptest.NewRequest(http.MethodGet, path, nil))
+		return writer
+	}
+
+	assert.Equal(t, http.StatusOK, call("/status/ping").Code)
+	assert.Empty(t, call("/bucket/key").Header().Get("Connection"))
+
+	require.NoError(t, ioutil.WriteFile(path, nil, 0600))
+	sentinel.check()
+	health := call("/status/ping")
+	assert.Equal(t, http.StatusServiceUnavailable, health.Code)
+	assert.Equal(t, "DRAINING", health.Body.String())
+	object := call("/bucket/key")
+	assert.Equal(t, http.StatusOK, object.Code, "requests should be served while draining")
+	assert.Equal(t, "close", object.Header().Get("Connection"))
+
+	require.NoError(t, os.Remove(path))
+	sentinel.check()
+	assert.Equal(t, http.StatusOK, call("/status/ping").Code)
+}
+
+func TestDrainModeIsDisabledWithoutSentinelFile(t *testing.T) {
+	handler := http.RedirectHandler("/", http.StatusFound)
+	sentinel := NewDrainSentinel("", 0)
+	assert.Nil(t, sentinel)
+	assert.False(t, sentinel.Draining())
+	assert.Equal(t, handler, DrainMode(handler, sentinel, "/status/ping"))
+}
@@ -0,0 +1,51 @@
+package httphandler
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+	"github.com/allegro/akubra/transport"
+)
+
+type featureFlagsHandler struct {
+	handler         http.Handler
+	trustedNetworks []*net.IPNet
+}
+
+func (fh *featureFlagsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	values := req.Header[transport.FeatureHeader]
+	if len(values) == 0 {
+		fh.handler.ServeHTTP(w, req)
+		return
+	}
+	req.Header.Del(transport.FeatureHeader)
+	if !fromNetworks(req.RemoteAddr, fh.trustedNetworks) {
+		metrics.Mark("reqs.global.features.untrusted")
+		log.Debugf("Ignoring %s of untrusted client %s", transport.FeatureHeader, req.RemoteAddr)
+		fh.handler.ServeHTTP(w, req)
+		return
+	}
+	var features []string
+	for _, value := range values {
+		for _, feature := range strings.Split(value, ",") {
+			feature = strings.ToLower(strings.TrimSpace(feature))
+			if !transport.Features[feature] {
+				log.Debugf("Ignoring unknown feature %q of %s", feature, req.RemoteAddr)
+				continue
+			}
+			metrics.Mark("reqs.global.features." + feature)
+			features = append(features, feature)
+		}
+	}
+	fh.handler.ServeHTTP(w, req.WithContext(transport.WithFeatures(req.Context(), features)))
+}
+
+// FeatureFlags wraps handler, features listed in transport.FeatureHeader of
+// clients connecting from trustedNetworks are enabled for their requests.
+// Header is not passed to backends, it's ignored for other clients
+func FeatureFlags(handler http.Handler, trustedNetworks []*net.IPNet) http.Handler {
+	return &featureFlagsHandler{handler: handler, trustedNetworks: trustedNetworks}
+}
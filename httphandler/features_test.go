@@ -0,0 +1,81 @@
+package httphandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/allegro/akubra/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mkFeatureBackend(status int, delay time.Duration, headers chan<- http.Header) url.URL {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		time.Sleep(delay)
+		w.WriteHeader(status)
+	}))
+	tsURL, _ := url.Parse(ts.URL)
+	return *tsURL
+}
+
+func TestFeatureFlagsChangeBehaviourOnlyForTrustedClients(t *testing.T) {
+	trusted, err := ParseNetworks([]string{"192.0.2.0/24"})
+	require.NoError(t, err)
+	headers := make(chan http.Header, 10)
+	// missing object answers later, so first response passed without quorum
+	// is found one
+	urls := []url.URL{mkFeatureBackend(http.StatusOK, 0, headers),
+		mkFeatureBackend(http.StatusNotFound, 50*time.Millisecond, headers)}
+	transp := transport.NewMultiTransport(http.DefaultTransport, urls, nil, transport.MultiTransportOptions{
+		HeadQuorum: shardingconfig.HeadQuorumConfig{Quorum: 2},
+	})
+	handler := FeatureFlags(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, err := transp.RoundTrip(r)
+		require.NoError(t, err)
+		w.WriteHeader(resp.StatusCode)
+	}), trusted)
+
+	for _, testData := range []struct {
+		name       string
+		remoteAddr string
+		feature    string
+		expected   int
+		// backends is number of backends request is sent to
+		backends int
+	}{
+		{"trusted client", "192.0.2.10:4321", "no-head-quorum", http.StatusOK, 2},
+		{"trusted client with other features", "192.0.2.10:4321", "sequential-reads, No-Head-Quorum", http.StatusOK, 1},
+		{"trusted client with unknown feature", "192.0.2.10:4321", "no-quorum", http.StatusNotFound, 2},
+		{"untrusted client", "198.51.100.10:4321", "no-head-quorum", http.StatusNotFound, 2},
+		{"no feature", "192.0.2.10:4321", "", http.StatusNotFound, 2},
+	} {
+		req := httptest.NewRequest(http.MethodHead, "http://example.com/bucket/key", nil)
+		req.RemoteAddr = testData.remoteAddr
+		if testData.feature != "" {
+			req.Header.Set(transport.FeatureHeader, testData.feature)
+		}
+		recorder := httptest.NewRecorder()
+
+		handler.ServeHTTP(recorder, req)
+
+		assert.Equal(t, testData.expected, recorder.Code, testData.name)
+		for i := 0; i < testData.backends; i++ {
+			select {
+			case backendHeaders := <-headers:
+				assert.Empty(t, backendHeaders.Get(transport.FeatureHeader), "%s: header should not reach backends", testData.name)
+			case <-time.After(time.Second):
+				t.Fatalf("%s: request should reach %d backends", testData.name, testData.backends)
+			}
+		}
+		select {
+		case <-headers:
+			t.Errorf("%s: request should reach only %d backends", testData.name, testData.backends)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
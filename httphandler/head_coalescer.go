@@ -0,0 +1,122 @@
+package httphandler
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+	"github.com/allegro/akubra/transport"
+)
+
+type headCoalescer struct {
+	window       time.Duration
+	roundTripper http.RoundTripper
+	mx           sync.Mutex
+	flights      map[string]*flight
+	afterFunc    func(time.Duration, func()) *time.Timer
+}
+
+// headFlightKey identifies HEAD requests which may share response, like
+// flightKey of GET requests
+func headFlightKey(req *http.Request) (string, bool) {
+	if req.Method != http.MethodHead || req.Header.Get("Cache-Control") == "no-cache" {
+		return "", false
+	}
+	return req.Host + " " + req.URL.RequestURI() + " " + req.Header.Get("Authorization"), true
+}
+
+func (hc *headCoalescer) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, ok := headFlightKey(req)
+	if !ok {
+		resp, err := hc.roundTripper.RoundTrip(req)
+		if invalidatesReads(req, resp, err) {
+			hc.mx.Lock()
+			forgetInvalidated(hc.flights, req)
+			hc.mx.Unlock()
+		}
+		return resp, err
+	}
+	hc.mx.Lock()
+	if f, shared := hc.flights[key]; shared {
+		f.waiters++
+		hc.mx.Unlock()
+		return hc.wait(f, req)
+	}
+	f := &flight{done: make(chan struct{}), object: coalescedObjectKey(req)}
+	hc.flights[key] = f
+	hc.mx.Unlock()
+	return hc.lead(f, key, req)
+}
+
+func (hc *headCoalescer) wait(f *flight, req *http.Request) (*http.Response, error) {
+	select {
+	case <-f.done:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	if f.unshared {
+		return hc.roundTripper.RoundTrip(req)
+	}
+	metrics.Mark("reqs.global.coalesced_heads")
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.response(req), nil
+}
+
+func (hc *headCoalescer) forget(f *flight, key string) {
+	hc.mx.Lock()
+	defer hc.mx.Unlock()
+	if hc.flights[key] == f {
+		delete(hc.flights, key)
+	}
+}
+
+func (hc *headCoalescer) lead(f *flight, key string, req *http.Request) (*http.Response, error) {
+	resp, err := hc.roundTripper.RoundTrip(req)
+	if err != nil {
+		f.err = err
+		f.unshared = req.Context().Err() != nil
+		hc.forget(f, key)
+		close(f.done)
+		return nil, err
+	}
+	if resp.Body != nil {
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			log.Debugf("Cannot close response body %s", closeErr)
+		}
+	}
+	f.resp = resp
+	close(f.done)
+	if resp.Header.Get(transport.ReplicasHeader) != "" {
+		// backends disagree, next request checks them again
+		metrics.Mark("reqs.global.coalesced.invalidated")
+		hc.forget(f, key)
+		return f.response(req), nil
+	}
+	// response keeps being shared with requests coming within window
+	hc.afterFunc(hc.window, func() { hc.forget(f, key) })
+	return f.response(req), nil
+}
+
+// HeadCoalescer creates Decorator which sends only one backend request for
+// identical HEAD requests (same URL and Authorization header) and passes its
+// response to all of them, also to requests coming within window after it
+// completed. Failed requests, responses of backends reporting different
+// replicas and objects changed by successful writes are not shared after
+// completion. Zero window disables coalescing
+func HeadCoalescer(window time.Duration) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if window <= 0 {
+			return roundTripper
+		}
+		return &headCoalescer{
+			window:       window,
+			roundTripper: roundTripper,
+			flights:      make(map[string]*flight),
+			afterFunc:    time.AfterFunc,
+		}
+	}
+}
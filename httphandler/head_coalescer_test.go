@@ -0,0 +1,119 @@
+package httphandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func (hc *headCoalescer) waitersFor(req *http.Request) int {
+	key, _ := headFlightKey(req)
+	hc.mx.Lock()
+	defer hc.mx.Unlock()
+	if f, ok := hc.flights[key]; ok {
+		return f.waiters
+	}
+	return -1
+}
+
+func TestHeadCoalescerSendsSingleBackendRequest(t *testing.T) {
+	var backendRequests int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&backendRequests, 1)
+		<-release
+		w.Header().Set("ETag", `"etag"`)
+	}))
+	defer srv.Close()
+	hc := HeadCoalescer(time.Minute)(http.DefaultTransport).(*headCoalescer)
+	var expire func()
+	hc.afterFunc = func(d time.Duration, f func()) *time.Timer {
+		assert.Equal(t, time.Minute, d)
+		expire = f
+		return nil
+	}
+	head := func() *http.Response {
+		req, _ := http.NewRequest(http.MethodHead, srv.URL+"/bucket/key", nil)
+		resp, err := hc.RoundTrip(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	const clients = 10
+	etags := make([]string, clients)
+	wg := sync.WaitGroup{}
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			etags[i] = head().Header.Get("ETag")
+		}(i)
+	}
+	probe, _ := http.NewRequest(http.MethodHead, srv.URL+"/bucket/key", nil)
+	waitFor(t, func() bool { return hc.waitersFor(probe) == clients-1 }, "clients should wait for leader")
+	close(release)
+	wg.Wait()
+
+	for _, etag := range etags {
+		assert.Equal(t, `"etag"`, etag)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&backendRequests))
+
+	assert.Equal(t, http.StatusOK, head().StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&backendRequests), "response should be shared within window")
+	require.NotNil(t, expire)
+	expire()
+	head()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&backendRequests), "request after window should reach backend")
+}
+
+func TestHeadCoalescerIsDisabledWithoutWindow(t *testing.T) {
+	assert.Equal(t, http.DefaultTransport, HeadCoalescer(0)(http.DefaultTransport))
+}
+
+func TestHeadCoalescerForgetsResponsesOfWrittenObjects(t *testing.T) {
+	var heads int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			atomic.AddInt32(&heads, 1)
+		}
+		if r.URL.Path == "/bucket/divergent" {
+			w.Header().Set(transport.ReplicasHeader, "1/2")
+		}
+	}))
+	defer srv.Close()
+	hc := HeadCoalescer(time.Minute)(http.DefaultTransport).(*headCoalescer)
+	hc.afterFunc = func(time.Duration, func()) *time.Timer { return nil }
+	send := func(method, path string) {
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		resp, err := hc.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	send(http.MethodHead, "/bucket/key")
+	send(http.MethodHead, "/bucket/other")
+	send(http.MethodPut, "/bucket/other")
+	send(http.MethodHead, "/bucket/key")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&heads), "response of unchanged object should be shared")
+
+	send(http.MethodPut, "/bucket/key")
+	send(http.MethodHead, "/bucket/key")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&heads), "written object should be checked again")
+
+	send(http.MethodPost, "/bucket?delete")
+	send(http.MethodHead, "/bucket/key")
+	send(http.MethodHead, "/bucket/other")
+	assert.Equal(t, int32(5), atomic.LoadInt32(&heads), "objects of multi-object delete should be checked again")
+
+	send(http.MethodHead, "/bucket/divergent")
+	send(http.MethodHead, "/bucket/divergent")
+	assert.Equal(t, int32(7), atomic.LoadInt32(&heads), "divergent response should not be shared")
+}
@@ -0,0 +1,76 @@
+package httphandler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/allegro/akubra/metrics"
+)
+
+type headRangeEmulator struct {
+	roundTripper http.RoundTripper
+}
+
+// rangeApplies tells if If-Range validator of request matches response, so
+// range is served instead of whole object
+func rangeApplies(req *http.Request, resp *http.Response) bool {
+	ifRange := req.Header.Get("If-Range")
+	return ifRange == "" || ifRange == resp.Header.Get("ETag") || ifRange == resp.Header.Get("Last-Modified")
+}
+
+func (he *headRangeEmulator) RoundTrip(req *http.Request) (*http.Response, error) {
+	rangeHeader := req.Header.Get("Range")
+	if req.Method != http.MethodHead || rangeHeader == "" {
+		return he.roundTripper.RoundTrip(req)
+	}
+	stripped := req.WithContext(req.Context())
+	stripped.Header = make(http.Header, len(req.Header))
+	for name, values := range req.Header {
+		stripped.Header[name] = values
+	}
+	stripped.Header.Del("Range")
+	stripped.Header.Del("If-Range")
+	resp, err := he.roundTripper.RoundTrip(stripped)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	size, parseErr := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if parseErr != nil || size < 0 || !rangeApplies(req, resp) {
+		return resp, nil
+	}
+	start, end, ok := parseByteRange(rangeHeader, size)
+	if !ok {
+		return resp, nil
+	}
+	metrics.Mark("reqs.global.head_range_emulated")
+	if start >= size {
+		resp.StatusCode = http.StatusRequestedRangeNotSatisfiable
+		resp.Status = http.StatusText(http.StatusRequestedRangeNotSatisfiable)
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		resp.Header.Set("Content-Length", "0")
+		resp.ContentLength = 0
+		return resp, nil
+	}
+	length := end - start + 1
+	resp.StatusCode = http.StatusPartialContent
+	resp.Status = http.StatusText(http.StatusPartialContent)
+	resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	resp.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	resp.ContentLength = length
+	return resp, nil
+}
+
+// HeadRangeEmulator creates Decorator which sends HEAD requests to backends
+// without Range header and answers single range itself, with 206 and
+// Content-Range of range or 416 if it starts past object end, as GET would
+// be answered. Backends handle range on HEAD differently otherwise.
+// Unsupported ranges and mismatched If-Range get full 200 response
+func HeadRangeEmulator(enabled bool) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if !enabled {
+			return roundTripper
+		}
+		return &headRangeEmulator{roundTripper: roundTripper}
+	}
+}
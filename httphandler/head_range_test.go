@@ -0,0 +1,90 @@
+package httphandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// headRangeBackend serves 10 bytes object, honoring Range of HEAD requests
+// like http.ServeContent or ignoring it
+func headRangeBackend(honorRange bool, ranges chan<- string) (url.URL, func()) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges <- r.Header.Get("Range")
+		w.Header().Set("ETag", `"etag"`)
+		if honorRange {
+			http.ServeContent(w, r, "key", time.Time{}, strings.NewReader("0123456789"))
+			return
+		}
+		w.Header().Set("Content-Length", "10")
+	}))
+	backendURL, _ := url.Parse(srv.URL)
+	return *backendURL, srv.Close
+}
+
+func TestHeadRangeIsAnsweredConsistentlyAcrossBackends(t *testing.T) {
+	for _, honorRange := range []bool{true, false} {
+		ranges := make(chan string, 1)
+		backendURL, closeBackend := headRangeBackend(honorRange, ranges)
+		transp := transport.NewMultiTransport(http.DefaultTransport, []url.URL{backendURL},
+			LateResponseHandler(config.Config{}), transport.MultiTransportOptions{})
+		rt := HeadRangeEmulator(true)(transp)
+
+		for _, testData := range []struct {
+			rangeHeader  string
+			ifRange      string
+			status       int
+			contentRange string
+			length       int64
+		}{
+			{"bytes=2-4", "", http.StatusPartialContent, "bytes 2-4/10", 3},
+			{"bytes=-3", `"etag"`, http.StatusPartialContent, "bytes 7-9/10", 3},
+			{"bytes=5-100", "", http.StatusPartialContent, "bytes 5-9/10", 5},
+			{"bytes=20-", "", http.StatusRequestedRangeNotSatisfiable, "bytes */10", 0},
+			{"bytes=0-1,4-5", "", http.StatusOK, "", 10},
+			{"bytes=2-4", `"other"`, http.StatusOK, "", 10},
+		} {
+			req, _ := http.NewRequest(http.MethodHead, "http://localhost/bucket/key", nil)
+			req.Header.Set("Range", testData.rangeHeader)
+			if testData.ifRange != "" {
+				req.Header.Set("If-Range", testData.ifRange)
+			}
+
+			resp, err := rt.RoundTrip(req)
+
+			require.NoError(t, err)
+			msg := []interface{}{"honorRange %t, %s", honorRange, testData.rangeHeader}
+			assert.Empty(t, <-ranges, msg...)
+			assert.Equal(t, testData.status, resp.StatusCode, msg...)
+			assert.Equal(t, testData.contentRange, resp.Header.Get("Content-Range"), msg...)
+			assert.Equal(t, testData.length, resp.ContentLength, msg...)
+			assert.Equal(t, testData.rangeHeader, req.Header.Get("Range"), "client request should not change")
+		}
+		closeBackend()
+	}
+}
+
+func TestHeadRangeIsForwardedIfEmulationIsDisabled(t *testing.T) {
+	ranges := make(chan string, 1)
+	backendURL, closeBackend := headRangeBackend(true, ranges)
+	defer closeBackend()
+	transp := transport.NewMultiTransport(http.DefaultTransport, []url.URL{backendURL},
+		LateResponseHandler(config.Config{}), transport.MultiTransportOptions{})
+	rt := HeadRangeEmulator(false)(transp)
+	req, _ := http.NewRequest(http.MethodHead, "http://localhost/bucket/key", nil)
+	req.Header.Set("Range", "bytes=2-4")
+
+	resp, err := rt.RoundTrip(req)
+
+	require.NoError(t, err)
+	assert.Equal(t, "bytes=2-4", <-ranges)
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+}
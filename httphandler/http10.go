@@ -0,0 +1,85 @@
+package httphandler
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/allegro/akubra/metrics"
+)
+
+// wantsKeepAlive tells if HTTP/1.0 request asks to keep connection open
+func wantsKeepAlive(req *http.Request) bool {
+	for _, value := range req.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "keep-alive") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// http10ResponseWriter fixes connection headers of response before they
+// are written
+type http10ResponseWriter struct {
+	http.ResponseWriter
+	close       bool
+	wroteHeader bool
+}
+
+func (hw *http10ResponseWriter) fixHeaders() {
+	if hw.wroteHeader {
+		return
+	}
+	hw.wroteHeader = true
+	header := hw.ResponseWriter.Header()
+	// connection headers forwarded from backend are not valid for client
+	// connection, server adds keep-alive itself if it can keep it
+	header.Del("Keep-Alive")
+	header.Del("Connection")
+	if hw.close {
+		header.Set("Connection", "close")
+	}
+}
+
+func (hw *http10ResponseWriter) WriteHeader(status int) {
+	hw.fixHeaders()
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+func (hw *http10ResponseWriter) Write(p []byte) (int, error) {
+	hw.fixHeaders()
+	return hw.ResponseWriter.Write(p)
+}
+
+// Flush lets streamed responses be flushed through writer
+func (hw *http10ResponseWriter) Flush() {
+	hw.fixHeaders()
+	if flusher, ok := hw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+type http10Connections struct {
+	handler    http.Handler
+	forceClose bool
+}
+
+func (hc *http10Connections) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.ProtoAtLeast(1, 1) {
+		hc.handler.ServeHTTP(w, req)
+		return
+	}
+	metrics.Mark("reqs.global.http10")
+	writer := &http10ResponseWriter{ResponseWriter: w, close: hc.forceClose || !wantsKeepAlive(req)}
+	hc.handler.ServeHTTP(writer, req)
+	writer.fixHeaders()
+}
+
+// HTTP10Connections wraps handler, so HTTP/1.0 clients get Connection: close
+// unless they asked for keep-alive, Keep-Alive and Connection headers of
+// backend responses are dropped. With forceClose every HTTP/1.0 connection is
+// closed after response
+func HTTP10Connections(handler http.Handler, forceClose bool) http.Handler {
+	return &http10Connections{handler: handler, forceClose: forceClose}
+}
@@ -0,0 +1,103 @@
+package httphandler
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mkHTTP10Server(t *testing.T, forceClose bool) (addr string, stop func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// headers of backend response
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Content-Length", "2")
+		_, _ = w.Write([]byte("ok"))
+	})
+	srv := &http.Server{Handler: HTTP10Connections(handler, forceClose)}
+	go func() { _ = srv.Serve(listener) }()
+	return listener.Addr().String(), func() { _ = srv.Close() }
+}
+
+// sendHTTP10 sends request on conn and reads its response
+func sendHTTP10(t *testing.T, conn net.Conn, reader *bufio.Reader, request string) *http.Response {
+	_, err := conn.Write([]byte(request))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(body))
+	return resp
+}
+
+func assertClosed(t *testing.T, reader *bufio.Reader) {
+	_, err := reader.ReadByte()
+	assert.Equal(t, io.EOF, err, "server should close connection")
+}
+
+func TestHTTP10ConnectionIsClosedWithoutKeepAlive(t *testing.T) {
+	addr, stop := mkHTTP10Server(t, false)
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(time.Second)))
+	reader := bufio.NewReader(conn)
+
+	resp := sendHTTP10(t, conn, reader, "GET /bucket/key HTTP/1.0\r\nHost: akubra.internal\r\n\r\n")
+	assert.Equal(t, "close", resp.Header.Get("Connection"))
+	assert.Empty(t, resp.Header.Get("Keep-Alive"))
+	assertClosed(t, reader)
+}
+
+func TestHTTP10KeepAliveConnectionIsReused(t *testing.T) {
+	addr, stop := mkHTTP10Server(t, false)
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(time.Second)))
+	reader := bufio.NewReader(conn)
+
+	request := "GET /bucket/key HTTP/1.0\r\nHost: akubra.internal\r\nConnection: Keep-Alive\r\n\r\n"
+	resp := sendHTTP10(t, conn, reader, request)
+	assert.Equal(t, "keep-alive", resp.Header.Get("Connection"))
+	assert.Empty(t, resp.Header.Get("Keep-Alive"))
+	resp = sendHTTP10(t, conn, reader, request)
+	assert.Equal(t, "keep-alive", resp.Header.Get("Connection"))
+}
+
+func TestHTTP10ConnectionIsForcedToClose(t *testing.T) {
+	addr, stop := mkHTTP10Server(t, true)
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(time.Second)))
+	reader := bufio.NewReader(conn)
+
+	resp := sendHTTP10(t, conn, reader, "GET /bucket/key HTTP/1.0\r\nHost: akubra.internal\r\nConnection: keep-alive\r\n\r\n")
+	assert.Equal(t, "close", resp.Header.Get("Connection"))
+	assertClosed(t, reader)
+
+	// HTTP/1.1 connections are kept
+	conn11, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn11.Close()
+	require.NoError(t, conn11.SetDeadline(time.Now().Add(time.Second)))
+	reader11 := bufio.NewReader(conn11)
+	request := "GET /bucket/key HTTP/1.1\r\nHost: akubra.internal\r\n\r\n"
+	resp = sendHTTP10(t, conn11, reader11, request)
+	assert.NotEqual(t, "close", resp.Header.Get("Connection"))
+	sendHTTP10(t, conn11, reader11, request)
+}
@@ -3,19 +3,34 @@ package httphandler
 import (
 	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/hex"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/allegro/akubra/config"
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
 	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/allegro/akubra/transport"
 )
 
 const (
 	defaultMaxIdleConnsPerHost   = 100
 	defaultResponseHeaderTimeout = 5 * time.Second
+	// same as http.DefaultTransport
+	defaultExpectContinueTimeout = 1 * time.Second
+	defaultNoBackendStatus       = http.StatusServiceUnavailable
+	noBackendWarningInterval     = 10 * time.Second
 )
 
 func randomStr(length int) string {
@@ -27,17 +42,114 @@ func randomStr(length int) string {
 	return hex.EncodeToString(randomID)
 }
 
+// clientWriter remembers errors which occurred while writing to client
+type clientWriter struct {
+	io.Writer
+	err error
+}
+
+func (cw *clientWriter) Write(p []byte) (int, error) {
+	n, err := cw.Writer.Write(p)
+	if err != nil {
+		cw.err = err
+	}
+	return n, err
+}
+
 // Handler implements http.Handler interface
 type Handler struct {
 	roundTripper          http.RoundTripper
 	bodyMaxSize           int64
 	maxConcurrentRequests int32
 	runningRequestCount   int32
+	noBackendStatus       int
+	lastNoBackendWarning  int64
+	loadShed              httphandlerconfig.LoadShedConfig
+	shedding              int32
+	maintenancePage       *maintenancePage
+	streamImmediately     bool
+	flushInterval         time.Duration
+	recoverPanics         bool
+	allFailBackoff        time.Duration
+}
+
+// shouldShed decides if request should be rejected. Once number of running
+// requests exceeds high watermark requests are rejected until it drops to low watermark
+func (h *Handler) shouldShed(running int32) bool {
+	if h.loadShed.HighWatermark == 0 {
+		return false
+	}
+	if atomic.LoadInt32(&h.shedding) == 1 {
+		if running <= h.loadShed.LowWatermark {
+			if atomic.CompareAndSwapInt32(&h.shedding, 1, 0) {
+				log.Printf("Load shedding stopped, %d requests in progress", running)
+			}
+			return false
+		}
+		return true
+	}
+	if running > h.loadShed.HighWatermark {
+		if atomic.CompareAndSwapInt32(&h.shedding, 0, 1) {
+			log.Printf("Load shedding started, %d requests in progress", running)
+		}
+		return true
+	}
+	return false
+}
+
+func (h *Handler) warnNoBackend(req *http.Request) {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&h.lastNoBackendWarning)
+	if now-last < int64(noBackendWarningInterval) {
+		return
+	}
+	if atomic.CompareAndSwapInt64(&h.lastNoBackendWarning, last, now) {
+		log.Printf("No backend available to handle request %s %s%s", req.Method, req.Host, req.URL.Path)
+	}
+}
+
+// backOffAllFailed delays answer to read which failed on all backends by
+// allFailBackoff and suggests clients to retry after it, so they do not
+// retry at once during outage
+func (h *Handler) backOffAllFailed(w http.ResponseWriter, req *http.Request, resp *http.Response, err error) {
+	if h.allFailBackoff <= 0 || req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return
+	}
+	if err == nil && resp.StatusCode < http.StatusInternalServerError {
+		return
+	}
+	metrics.Mark("reqs.global.all_fail_backoff")
+	timer := time.NewTimer(h.allFailBackoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-req.Context().Done():
+	}
+	seconds := int64(math.Ceil(h.allFailBackoff.Seconds()))
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+}
+
+func (h *Handler) writeNoBackendResponse(w http.ResponseWriter, req *http.Request, reqID string) {
+	h.warnNoBackend(req)
+	if h.maintenancePage != nil {
+		h.maintenancePage.write(w, req)
+		return
+	}
+	statusCode := h.noBackendStatus
+	if statusCode == 0 {
+		statusCode = defaultNoBackendStatus
+	}
+	code := "ServiceUnavailable"
+	if statusCode == http.StatusBadGateway {
+		code = "BadGateway"
+	}
+	writeS3Error(w, statusCode, code, "No backend available.", req.URL.Path, reqID)
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	canServe := true
-	if atomic.AddInt32(&h.runningRequestCount, 1) > h.maxConcurrentRequests {
+	running := atomic.AddInt32(&h.runningRequestCount, 1)
+	if running > h.maxConcurrentRequests {
 		canServe = false
 	}
 	defer atomic.AddInt32(&h.runningRequestCount, -1)
@@ -46,6 +158,11 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, "Too many requests in progress.", http.StatusServiceUnavailable)
 		return
 	}
+	if h.shouldShed(running) {
+		metrics.Mark("reqs.global.shed")
+		http.Error(w, "Service overloaded.", http.StatusServiceUnavailable)
+		return
+	}
 
 	randomIDStr := randomStr(12)
 	validationCode := h.validateIncomingRequest(req)
@@ -57,9 +174,31 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	randomIDContext := context.WithValue(req.Context(), log.ContextreqIDKey, randomIDStr)
 	log.Debugf("Request id %s", randomIDStr)
+	headersWritten := false
+	if h.recoverPanics {
+		var cancel context.CancelFunc
+		randomIDContext, cancel = context.WithCancel(randomIDContext)
+		defer cancel()
+		defer h.recoverPanic(w, req, randomIDStr, &headersWritten, cancel)
+	}
 
 	resp, err := h.roundTripper.RoundTrip(req.WithContext(randomIDContext))
+	h.backOffAllFailed(w, req, resp, err)
 
+	if err == transport.ErrNoBackendAvailable {
+		h.writeNoBackendResponse(w, req, randomIDStr)
+		return
+	}
+	if err == transport.ErrChunkedBodyTooLarge {
+		writeS3Error(w, http.StatusRequestEntityTooLarge, "EntityTooLarge",
+			"Your proposed upload exceeds the maximum allowed size", req.URL.Path, randomIDStr)
+		return
+	}
+	if err == transport.ErrWritesBlocked {
+		writeS3Error(w, http.StatusServiceUnavailable, "ServiceUnavailable",
+			"Writes are temporarily blocked, please retry later", req.URL.Path, randomIDStr)
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -74,22 +213,90 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	wh := w.Header()
 	for k, v := range resp.Header {
-		wh[k] = v
+		if !backendConnectionHeaders[k] {
+			wh[k] = v
+		}
 	}
+	setContentLength(wh, req.Method, resp)
 
+	headersWritten = true
 	w.WriteHeader(resp.StatusCode)
-	if _, copyErr := io.Copy(w, resp.Body); copyErr != nil {
+	out, stopFlushing := h.responseWriter(w)
+	defer stopFlushing()
+	cw := &clientWriter{Writer: out}
+	if _, copyErr := io.Copy(cw, resp.Body); copyErr != nil {
+		if cw.err != nil || req.Context().Err() == context.Canceled {
+			// client went away, closing response body cancels backend read
+			metrics.Mark("reqs.global.client_disconnects")
+			log.Printf("Client %s disconnected during request %s, reason: %q",
+				req.RemoteAddr, randomIDStr, copyErr.Error())
+			return
+		}
 		log.Printf("Cannot send response body reason: %q",
 			copyErr.Error())
 	}
 }
 
+// recoverPanic logs panic of request with its stack and responds with 500
+// InternalError. Backend requests still in flight are cancelled. If response
+// headers were already sent, client connection is aborted instead
+func (h *Handler) recoverPanic(w http.ResponseWriter, req *http.Request, reqID string, headersWritten *bool, cancel context.CancelFunc) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	cancel()
+	metrics.Mark("reqs.global.panics")
+	log.Printf("Recovered panic of request %s %s%s, request id %s: %v\n%s",
+		req.Method, req.Host, req.URL.Path, reqID, recovered, debug.Stack())
+	if *headersWritten {
+		panic(http.ErrAbortHandler)
+	}
+	writeS3Error(w, http.StatusInternalServerError, "InternalError",
+		"We encountered an internal error. Please try again.", req.URL.Path, reqID)
+}
+
+// backendConnectionHeaders of backend response are not passed to client, even
+// if they are listed in ForwardHeaders. They describe backend connection,
+// which may be closed after every request with DisableKeepAlives, while
+// http.Server keeps client connection alive on its own
+var backendConnectionHeaders = map[string]bool{"Connection": true, "Keep-Alive": true}
+
+// setContentLength keeps client response framing in line with response body.
+// Backend may stream response with chunked encoding and decorators may replace
+// body, so Content-Length header is taken from resp.ContentLength. Responses
+// of unknown length are sent chunked by http.Server
+func setContentLength(header http.Header, method string, resp *http.Response) {
+	header.Del("Transfer-Encoding")
+	if method == http.MethodHead || resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified {
+		return
+	}
+	switch {
+	case resp.ContentLength > 0:
+		header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	case resp.ContentLength < 0:
+		header.Del("Content-Length")
+	}
+}
+
 func (h *Handler) validateIncomingRequest(req *http.Request) int {
+	if code := config.RequestHeaderExpectValidator(*req); code > 0 {
+		return code
+	}
 	return config.RequestHeaderContentLengthValidator(*req, h.bodyMaxSize)
 }
 
+func configuredExpectContinueTimeout(conf config.Config) time.Duration {
+	if conf.ExpectContinueTimeout.Duration != 0 {
+		return conf.ExpectContinueTimeout.Duration
+	}
+	return defaultExpectContinueTimeout
+}
+
 // ConfigureHTTPTransport returns http.Transport with customized dialer,
-// MaxIdleConnsPerHost and DisableKeepAlives
+// MaxIdleConnsPerHost, DisableKeepAlives, backend response headers limit,
+// DNS cache, source address, client certificate and TLS server names
 func ConfigureHTTPTransport(conf config.Config) (*http.Transport, error) {
 	maxIdleConnsPerHost := defaultMaxIdleConnsPerHost
 	responseHeaderTimeout := defaultResponseHeaderTimeout
@@ -102,33 +309,212 @@ func ConfigureHTTPTransport(conf config.Config) (*http.Transport, error) {
 		responseHeaderTimeout = conf.ResponseHeaderTimeout.Duration
 	}
 
+	expectContinueTimeout := configuredExpectContinueTimeout(conf)
+	if conf.FailOnExpectContinueTimeout {
+		// let ExpectContinueGuard fail request before transport sends body anyway
+		expectContinueTimeout *= 2
+	}
+
 	httpTransport := &http.Transport{
-		MaxIdleConns:          conf.MaxIdleConns,
-		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
-		IdleConnTimeout:       conf.IdleConnTimeout.Duration,
-		ResponseHeaderTimeout: responseHeaderTimeout,
-		DisableKeepAlives:     conf.DisableKeepAlives,
+		MaxIdleConns:           conf.MaxIdleConns,
+		MaxIdleConnsPerHost:    maxIdleConnsPerHost,
+		IdleConnTimeout:        conf.IdleConnTimeout.Duration,
+		ResponseHeaderTimeout:  responseHeaderTimeout,
+		ExpectContinueTimeout:  expectContinueTimeout,
+		MaxResponseHeaderBytes: conf.MaxBackendHeaderBytes.SizeInBytes,
+		DisableKeepAlives:      conf.DisableKeepAlives,
+		// objects stored with Content-Encoding are passed to clients as
+		// stored, transport must not ask for gzip and decompress it
+		DisableCompression: true,
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if conf.BackendSourceAddress != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(conf.BackendSourceAddress)}
+		httpTransport.DialContext = dialer.DialContext
+	}
+
+	if conf.BackendDNSCacheTTL.Duration > 0 {
+		httpTransport.DialContext = newDNSCache(net.DefaultResolver, conf.BackendDNSCacheTTL.Duration).dialContext(dialer)
+	}
+
+	if conf.BackendClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.BackendClientCertFile, conf.BackendClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		httpTransport.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	if len(conf.BackendTLSServerNames) > 0 {
+		httpTransport.DialTLS = tlsServerNameDialer(httpTransport, conf.BackendTLSServerNames)
+	}
+
+	if conf.BackendProxy.URL != nil {
+		httpTransport.Proxy = http.ProxyURL(backendProxyURL(conf))
 	}
 
 	return httpTransport, nil
 }
 
+// backendProxyURL returns BackendProxy with configured credentials, which
+// http.Transport sends as Proxy-Authorization
+func backendProxyURL(conf config.Config) *url.URL {
+	proxyURL := *conf.BackendProxy.URL
+	if conf.BackendProxyUser != "" {
+		proxyURL.User = url.UserPassword(conf.BackendProxyUser, conf.BackendProxyPassword)
+	}
+	return &proxyURL
+}
+
+// ConfigureListenerTLS creates TLS configuration of client listener, nil
+// if TLS is not configured. With TLSCertReload certificate is reloaded on
+// SIGHUP
+func ConfigureListenerTLS(conf config.Config) (*tls.Config, error) {
+	if conf.TLSCertFile == "" {
+		return nil, nil
+	}
+	reloader, err := NewCertificateReloader(conf.TLSCertFile, conf.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cipherSuites, err := config.TLSCipherSuiteIDs(conf.TLSCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	if conf.TLSCertReload {
+		reloader.ReloadOnSignal(syscall.SIGHUP)
+	}
+	return &tls.Config{
+		GetCertificate:           reloader.GetCertificate,
+		CipherSuites:             cipherSuites,
+		MinVersion:               tls.VersionTLS12,
+		PreferServerCipherSuites: true,
+	}, nil
+}
+
+// tlsServerNameDialer dials TLS connections presenting server name (SNI)
+// configured for backend host instead of the host itself
+func tlsServerNameDialer(httpTransport *http.Transport, serverNames map[string]string) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		dial := httpTransport.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+		}
+		conn, err := dial(context.Background(), network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig := &tls.Config{}
+		if httpTransport.TLSClientConfig != nil {
+			tlsConfig = httpTransport.TLSClientConfig.Clone()
+		}
+		tlsConfig.ServerName = host
+		if serverName, ok := serverNames[addr]; ok {
+			tlsConfig.ServerName = serverName
+		} else if serverName, ok := serverNames[host]; ok {
+			tlsConfig.ServerName = serverName
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
 // DecorateRoundTripper applies common http.RoundTripper decorators
 func DecorateRoundTripper(conf config.Config, rt http.RoundTripper) http.RoundTripper {
 	return Decorate(
 		rt,
+		ChaosInjector(conf.Chaos),
+		ContentMD5Validator(conf.ContentMD5),
+		HopByHopHeadersFilter(conf.ForwardHeaders),
+		ViaHeader(conf.ViaHeader),
+		ReadCoalescer(conf.CoalesceReadsMaxSize.SizeInBytes),
+		HeadCoalescer(conf.CoalesceHeadsWindow.Duration),
+		IdempotentWrites(conf.Idempotency),
+		KeyNormalizer(conf.NormalizeKeys),
+		BucketRootNormalizer(conf.NormalizeBucketRoot),
+		PathRewriter(conf.RewriteRules, conf.RewriteRulesMode),
+		LocationConstraintRewriter(conf.LocationConstraint),
+		BackendHostRewriter(rewrittenHeaders(conf), conf.RewriteXMLOperations, configuredBackends(conf)),
+		HeadRangeEmulator(conf.EmulateHeadRange),
+		AcceptRangesAdvertiser(conf.ForceAcceptRanges),
+		ResponseCompressor(conf.CompressResponses, conf.CompressSkipExtensions),
 		HeadersSuplier(conf.AdditionalRequestHeaders, conf.AdditionalResponseHeaders),
-		AccessLogging(conf.Accesslog),
+		Authentication(NewAuthenticator(conf.AuthToken)),
+		ClientSLOTracking(conf.SLO),
+		LatencyBucketsRecording(conf.LatencyBuckets),
+		AccessLogging(conf.Accesslog, conf.HealthProbes, conf.AccessLogFields, conf.CountBodyBytes),
+		AuditWebhook(conf.Audit),
 		OptionsHandler,
+		CORSHandler(conf.CORS),
+		MethodAllowlist(conf.AllowedMethods),
+		ServerTimingHeader(conf.EmitServerTiming),
 		HealthCheckHandler(conf.HealthCheckEndpoint),
 	)
 }
 
+func rewrittenHeaders(conf config.Config) []string {
+	if !conf.RewriteLocationHeader {
+		return nil
+	}
+	return append([]string{"Location"}, conf.RewriteHeaders...)
+}
+
+func configuredBackends(conf config.Config) []shardingconfig.YAMLUrl {
+	backends := append([]shardingconfig.YAMLUrl{}, conf.Backends...)
+	for _, clusterConf := range conf.Clusters {
+		backends = append(backends, clusterConf.Backends...)
+	}
+	return backends
+}
+
+// DecorateBackendRoundTripper applies decorators to http.RoundTripper
+// used for communication with single backend
+func DecorateBackendRoundTripper(conf config.Config, rt http.RoundTripper) http.RoundTripper {
+	return Decorate(
+		rt,
+		BackendAddressingStyles(conf.BackendAddressingStyles),
+		BackendRedirectsFollower(conf.FollowBackendRedirects),
+		BackendTimingCollector(conf.EmitServerTiming || conf.AccessLogFields.Includes("backends")),
+		BackendSLOTracking(conf.SLO),
+		ConnectionReuseMetrics(conf.ConnectionReuseMetrics),
+		MethodStatusMetrics(conf.MethodStatusMetrics),
+		ResponseSizeMetrics(conf.LargeObjectThreshold.SizeInBytes),
+		RangeEmulator,
+		ExpectContinueGuard(configuredExpectContinueTimeout(conf), conf.FailOnExpectContinueTimeout),
+		BackendConnLimits(conf.BackendConnLimits),
+		BackendRetries(conf.Retries.BackendAttempts, conf.BackendRetries),
+		BackendHeadersSuplier(conf.BackendAdditionalRequestHeaders()),
+		AutoMultipart(conf.AutoMultipartThreshold.SizeInBytes, conf.AutoMultipartPartSize.SizeInBytes),
+		MultipartTracking(conf.MultipartTracking),
+	)
+}
+
 // NewHandlerWithRoundTripper returns Handler, but will not construct transport.MultiTransport by itself
-func NewHandlerWithRoundTripper(roundTripper http.RoundTripper, bodyMaxSize int64, maxConcurrentRequests int32) (http.Handler, error) {
+func NewHandlerWithRoundTripper(roundTripper http.RoundTripper, conf config.Config) (http.Handler, error) {
+	page, err := loadMaintenancePage(conf.MaintenancePageFile, conf.MaintenancePageStatus,
+		conf.MaintenancePageRetryAfter.Duration)
+	if err != nil {
+		return nil, err
+	}
 	return &Handler{
 		roundTripper:          roundTripper,
-		bodyMaxSize:           bodyMaxSize,
-		maxConcurrentRequests: maxConcurrentRequests,
+		bodyMaxSize:           conf.BodyMaxSize.SizeInBytes,
+		maxConcurrentRequests: conf.MaxConcurrentRequests,
+		noBackendStatus:       conf.NoBackendResponse,
+		loadShed:              conf.LoadShed,
+		maintenancePage:       page,
+		streamImmediately:     conf.StreamImmediately,
+		flushInterval:         conf.StreamFlushInterval.Duration,
+		recoverPanics:         !conf.DisablePanicRecovery,
+		allFailBackoff:        conf.AllFailBackoff.Duration,
 	}, nil
 }
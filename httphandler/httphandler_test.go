@@ -1,10 +1,40 @@
 package httphandler
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/allegro/akubra/config"
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/allegro/akubra/transport"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -26,6 +56,63 @@ func TestShouldReturnBadRequestOnUnparsableContentLengthHeader(t *testing.T) {
 	assert.Equal(t, http.StatusBadRequest, writer.Code)
 }
 
+func TestShouldReturnExpectationFailedOnUnsupportedExpectation(t *testing.T) {
+	for _, testData := range []struct {
+		expect         string
+		expectedStatus int
+	}{
+		{"something-weird", http.StatusExpectationFailed},
+		{"100-continue", http.StatusOK},
+		{"100-Continue", http.StatusOK},
+	} {
+		backendCalled := false
+		request := httptest.NewRequest("PUT", "http://somepath/bucket/key", strings.NewReader("data"))
+		request.Header.Set("Expect", testData.expect)
+		handler := &Handler{
+			roundTripper: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				backendCalled = true
+				return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+			}),
+			bodyMaxSize:           1024,
+			maxConcurrentRequests: 10,
+		}
+		writer := httptest.NewRecorder()
+		handler.ServeHTTP(writer, request)
+		assert.Equal(t, testData.expectedStatus, writer.Code, testData.expect)
+		assert.Equal(t, testData.expectedStatus == http.StatusOK, backendCalled, testData.expect)
+	}
+}
+
+func TestShouldLimitAWSChunkedUploadByDecodedContentLength(t *testing.T) {
+	for _, testData := range []struct {
+		decodedLength  string
+		expectedStatus int
+	}{
+		{"1024", http.StatusOK},
+		{"1025", http.StatusRequestEntityTooLarge},
+	} {
+		var forwardedLength string
+		request := httptest.NewRequest("PUT", "http://somepath/bucket/key", strings.NewReader(strings.Repeat("x", 1200)))
+		request.Header.Set("Content-Length", "1200")
+		request.Header.Set("X-Amz-Content-Sha256", "STREAMING-AWS4-HMAC-SHA256-PAYLOAD")
+		request.Header.Set("X-Amz-Decoded-Content-Length", testData.decodedLength)
+		handler := &Handler{
+			roundTripper: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				forwardedLength = req.Header.Get("X-Amz-Decoded-Content-Length")
+				return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+			}),
+			bodyMaxSize:           1024,
+			maxConcurrentRequests: 10,
+		}
+		writer := httptest.NewRecorder()
+		handler.ServeHTTP(writer, request)
+		assert.Equal(t, testData.expectedStatus, writer.Code, testData.decodedLength)
+		if testData.expectedStatus == http.StatusOK {
+			assert.Equal(t, testData.decodedLength, forwardedLength)
+		}
+	}
+}
+
 func TestShouldReturnServiceNotAvailableOnTooManyRequests(t *testing.T) {
 	request := httptest.NewRequest("GET", "http://somepath", nil)
 	handler := &Handler{bodyMaxSize: 1024, maxConcurrentRequests: 0}
@@ -57,3 +144,786 @@ func TestShouldReturnStatusOKOnHealthCheckEndpoint(t *testing.T) {
 	assert.Equal(t, expectedStatusCode, writer.Code)
 	assert.Equal(t, expectedBody, bodyStr)
 }
+
+type endlessBody struct {
+	closed chan struct{}
+}
+
+func (eb *endlessBody) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'a'
+	}
+	return len(p), nil
+}
+
+func (eb *endlessBody) Close() error {
+	close(eb.closed)
+	return nil
+}
+
+type endlessBodyRoundTripper struct {
+	body *endlessBody
+}
+
+func (rt endlessBodyRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       rt.body,
+	}, nil
+}
+
+func TestShouldCloseBackendBodyWhenClientDisconnects(t *testing.T) {
+	body := &endlessBody{closed: make(chan struct{})}
+	handler := &Handler{
+		roundTripper:          endlessBodyRoundTripper{body: body},
+		bodyMaxSize:           1024,
+		maxConcurrentRequests: 1,
+	}
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	assert.NoError(t, err)
+	_, err = resp.Body.Read(make([]byte, 16))
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+
+	select {
+	case <-body.closed:
+	case <-time.After(5 * time.Second):
+		t.Error("Backend response body should be closed after client disconnect")
+	}
+}
+
+func TestShouldBackOffReadsFailedOnAllBackends(t *testing.T) {
+	backoff := 100 * time.Millisecond
+	for _, testData := range []struct {
+		method   string
+		status   int
+		err      error
+		expected int
+		delayed  bool
+	}{
+		{http.MethodGet, http.StatusServiceUnavailable, nil, http.StatusServiceUnavailable, true},
+		{http.MethodHead, http.StatusInternalServerError, nil, http.StatusInternalServerError, true},
+		{http.MethodGet, 0, errors.New("connection refused"), http.StatusInternalServerError, true},
+		{http.MethodGet, 0, transport.ErrNoBackendAvailable, http.StatusServiceUnavailable, true},
+		{http.MethodGet, http.StatusNotFound, nil, http.StatusNotFound, false},
+		{http.MethodGet, http.StatusOK, nil, http.StatusOK, false},
+		{http.MethodPut, http.StatusServiceUnavailable, nil, http.StatusServiceUnavailable, false},
+	} {
+		testData := testData
+		handler := &Handler{
+			roundTripper: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				if testData.err != nil {
+					return nil, testData.err
+				}
+				return &http.Response{StatusCode: testData.status, Header: make(http.Header),
+					Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+			}),
+			bodyMaxSize:           1024,
+			maxConcurrentRequests: 10,
+			allFailBackoff:        backoff,
+		}
+		writer := httptest.NewRecorder()
+		started := time.Now()
+
+		handler.ServeHTTP(writer, httptest.NewRequest(testData.method, "http://localhost/bucket/key", nil))
+
+		msg := fmt.Sprintf("%s %d %v", testData.method, testData.status, testData.err)
+		assert.Equal(t, testData.expected, writer.Code, msg)
+		if testData.delayed {
+			assert.True(t, time.Since(started) >= backoff, "%s: response should be delayed", msg)
+			assert.Equal(t, "1", writer.Header().Get("Retry-After"), msg)
+		} else {
+			assert.True(t, time.Since(started) < backoff, "%s: response should not be delayed", msg)
+			assert.Empty(t, writer.Header().Get("Retry-After"), msg)
+		}
+	}
+}
+
+func TestShouldReturnConfiguredStatusWhenNoBackendAvailable(t *testing.T) {
+	var logBuffer bytes.Buffer
+	defaultLogger := log.DefaultLogger
+	log.DefaultLogger = &logrus.Logger{
+		Out:       &logBuffer,
+		Formatter: log.PlainTextFormatter{},
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.DebugLevel,
+	}
+	defer func() { log.DefaultLogger = defaultLogger }()
+
+	backendURL, _ := url.Parse("http://127.0.0.1:9999")
+	maintained := []shardingconfig.YAMLUrl{{URL: backendURL}}
+	multiTransport := transport.NewMultiTransport(http.DefaultTransport, []url.URL{*backendURL}, nil,
+		transport.MultiTransportOptions{MaintainedBackends: maintained})
+
+	for _, testData := range []struct {
+		configured int
+		expected   int
+		code       string
+	}{
+		{0, http.StatusServiceUnavailable, "ServiceUnavailable"},
+		{http.StatusBadGateway, http.StatusBadGateway, "BadGateway"},
+	} {
+		handler := &Handler{
+			roundTripper:          multiTransport,
+			bodyMaxSize:           1024,
+			maxConcurrentRequests: 10,
+			noBackendStatus:       testData.configured,
+		}
+		for i := 0; i < 3; i++ {
+			writer := httptest.NewRecorder()
+			handler.ServeHTTP(writer, httptest.NewRequest("GET", "http://localhost/bucket/key", nil))
+
+			assert.Equal(t, testData.expected, writer.Code)
+			s3Error := S3Error{}
+			assert.NoError(t, xml.Unmarshal(writer.Body.Bytes(), &s3Error))
+			assert.Equal(t, testData.code, s3Error.Code)
+			assert.Equal(t, "/bucket/key", s3Error.Resource)
+		}
+	}
+	assert.Equal(t, 2, strings.Count(logBuffer.String(), "No backend available"))
+}
+
+func TestShouldRecoverHandlerPanicWithInternalError(t *testing.T) {
+	var logBuffer bytes.Buffer
+	defaultLogger := log.DefaultLogger
+	log.DefaultLogger = &logrus.Logger{
+		Out:       &logBuffer,
+		Formatter: log.PlainTextFormatter{},
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.DebugLevel,
+	}
+	defer func() { log.DefaultLogger = defaultLogger }()
+	var backendCtx context.Context
+	handler := &Handler{
+		roundTripper: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			backendCtx = req.Context()
+			var routing map[string]string
+			routing["bucket"] = "cluster1"
+			return nil, nil
+		}),
+		bodyMaxSize:           1024,
+		maxConcurrentRequests: 10,
+		recoverPanics:         true,
+	}
+	writer := httptest.NewRecorder()
+
+	handler.ServeHTTP(writer, httptest.NewRequest("GET", "http://localhost/bucket/key", nil))
+
+	assert.Equal(t, http.StatusInternalServerError, writer.Code)
+	s3Error := S3Error{}
+	assert.NoError(t, xml.Unmarshal(writer.Body.Bytes(), &s3Error))
+	assert.Equal(t, "InternalError", s3Error.Code)
+	assert.Equal(t, "/bucket/key", s3Error.Resource)
+	reqID, _ := backendCtx.Value(log.ContextreqIDKey).(string)
+	assert.Equal(t, reqID, s3Error.RequestID)
+	assert.Error(t, backendCtx.Err(), "backend requests should be cancelled")
+	assert.Contains(t, logBuffer.String(), "Recovered panic of request GET localhost/bucket/key, request id "+reqID)
+	assert.Contains(t, logBuffer.String(), "assignment to entry in nil map")
+	assert.Contains(t, logBuffer.String(), "TestShouldRecoverHandlerPanicWithInternalError")
+}
+
+func TestShouldAbortClientConnectionOnPanicAfterResponseStarted(t *testing.T) {
+	handler := &Handler{
+		roundTripper: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: panickingBody{}}, nil
+		}),
+		bodyMaxSize:           1024,
+		maxConcurrentRequests: 10,
+		recoverPanics:         true,
+	}
+
+	assert.Panics(t, func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/bucket/key", nil))
+	})
+}
+
+type panickingBody struct{}
+
+func (panickingBody) Read(p []byte) (int, error) { panic("broken body") }
+
+func (panickingBody) Close() error { return nil }
+
+func TestShouldServeMaintenancePageOnlyWhenAllBackendsAreMaintained(t *testing.T) {
+	dir, err := ioutil.TempDir("", "akubra-maintenance")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	pageFile := filepath.Join(dir, "maintenance.html")
+	assert.NoError(t, ioutil.WriteFile(pageFile, []byte("<h1>Back soon</h1>"), 0600))
+	page, err := loadMaintenancePage(pageFile, 0, 2*time.Minute)
+	assert.NoError(t, err)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	maintainedURL, _ := url.Parse("http://127.0.0.1:9999")
+	maintained := []shardingconfig.YAMLUrl{{URL: maintainedURL}}
+
+	for _, testData := range []struct {
+		backends       []url.URL
+		expectedStatus int
+		expectedPage   bool
+	}{
+		{[]url.URL{*maintainedURL}, http.StatusServiceUnavailable, true},
+		{[]url.URL{*maintainedURL, *backendURL}, http.StatusOK, false},
+	} {
+		handler := &Handler{
+			roundTripper: transport.NewMultiTransport(http.DefaultTransport, testData.backends, nil,
+				transport.MultiTransportOptions{MaintainedBackends: maintained}),
+			bodyMaxSize:           1024,
+			maxConcurrentRequests: 10,
+			maintenancePage:       page,
+		}
+		writer := httptest.NewRecorder()
+		handler.ServeHTTP(writer, httptest.NewRequest("GET", "http://localhost/bucket/key", nil))
+
+		assert.Equal(t, testData.expectedStatus, writer.Code)
+		if testData.expectedPage {
+			assert.Equal(t, "<h1>Back soon</h1>", writer.Body.String())
+			assert.Equal(t, "120", writer.Header().Get("Retry-After"))
+			assert.Equal(t, "public, max-age=120", writer.Header().Get("Cache-Control"))
+			assert.Contains(t, writer.Header().Get("Content-Type"), "text/html")
+		} else {
+			assert.Empty(t, writer.Body.String())
+		}
+	}
+}
+
+func writeClientCertificate(t *testing.T, dir string) (certFile, keyFile string, cert *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "akubra"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err = x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile = filepath.Join(dir, "client.crt")
+	keyFile = filepath.Join(dir, "client.key")
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile, cert
+}
+
+func TestShouldPresentClientCertificateToBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "akubra-mtls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile, clientCert := writeClientCertificate(t, dir)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+
+	conf := config.Config{YamlConfig: config.YamlConfig{
+		BackendClientCertFile: certFile,
+		BackendClientKeyFile:  keyFile,
+	}}
+	httpTransport, err := ConfigureHTTPTransport(conf)
+	assert.NoError(t, err)
+	serverCAs := x509.NewCertPool()
+	serverCAs.AddCert(srv.Certificate())
+	httpTransport.TLSClientConfig.RootCAs = serverCAs
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	resp, err := httpTransport.RoundTrip(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	withoutCertTransport, err := ConfigureHTTPTransport(config.Config{})
+	assert.NoError(t, err)
+	withoutCertTransport.TLSClientConfig = &tls.Config{RootCAs: serverCAs}
+	_, err = withoutCertTransport.RoundTrip(req)
+	assert.Error(t, err)
+}
+
+func TestShouldSendConfiguredTLSServerNameToBackend(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if hello.ServerName != "example.com" {
+			return nil, fmt.Errorf("unexpected server name %q", hello.ServerName)
+		}
+		return nil, nil
+	}}
+	srv.StartTLS()
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	serverCAs := x509.NewCertPool()
+	serverCAs.AddCert(srv.Certificate())
+
+	conf := config.Config{YamlConfig: config.YamlConfig{
+		BackendTLSServerNames: map[string]string{srvURL.Host: "example.com"},
+	}}
+	httpTransport, err := ConfigureHTTPTransport(conf)
+	assert.NoError(t, err)
+	httpTransport.TLSClientConfig = &tls.Config{RootCAs: serverCAs}
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	resp, err := httpTransport.RoundTrip(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	withoutServerNameTransport, err := ConfigureHTTPTransport(config.Config{})
+	assert.NoError(t, err)
+	withoutServerNameTransport.TLSClientConfig = &tls.Config{RootCAs: serverCAs}
+	_, err = withoutServerNameTransport.RoundTrip(req)
+	assert.Error(t, err)
+}
+
+// mkConnectProxy tunnels CONNECT requests and answers proxy form requests
+// itself, requested hosts and Proxy-Authorization values are recorded
+func mkConnectProxy(t *testing.T) (proxy *httptest.Server, requests chan string) {
+	requests = make(chan string, 10)
+	proxy = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.Method + " " + r.Host + " " + r.Header.Get("Proxy-Authorization")
+		if r.Method != http.MethodConnect {
+			_, _ = w.Write([]byte("from proxy"))
+			return
+		}
+		backendConn, err := net.Dial("tcp", r.Host)
+		if !assert.NoError(t, err) {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		clientConn, _, err := w.(http.Hijacker).Hijack()
+		if !assert.NoError(t, err) {
+			_ = backendConn.Close()
+			return
+		}
+		go func() {
+			_, _ = io.Copy(backendConn, clientConn)
+			_ = backendConn.Close()
+		}()
+		_, _ = io.Copy(clientConn, backendConn)
+		_ = clientConn.Close()
+	}))
+	return proxy, requests
+}
+
+func TestShouldDialBackendsFromSourceAddress(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.RemoteAddr))
+	}))
+	defer backend.Close()
+
+	for _, ttl := range []time.Duration{0, time.Minute} {
+		conf := config.Config{YamlConfig: config.YamlConfig{
+			BackendSourceAddress: "127.0.0.2",
+			BackendDNSCacheTTL:   metrics.Interval{Duration: ttl},
+		}}
+		httpTransport, err := ConfigureHTTPTransport(conf)
+		assert.NoError(t, err)
+
+		req, _ := http.NewRequest("GET", backend.URL+"/bucket/key", nil)
+		resp, err := httpTransport.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		remoteAddr, _ := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, resp.Body.Close())
+		host, _, _ := net.SplitHostPort(string(remoteAddr))
+		assert.Equal(t, "127.0.0.2", host, "DNS cache TTL %s", ttl)
+	}
+}
+
+func TestShouldSendBackendRequestsThroughProxy(t *testing.T) {
+	proxy, requests := mkConnectProxy(t)
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	tlsBackend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("from backend"))
+	}))
+	defer tlsBackend.Close()
+	tlsBackendURL, _ := url.Parse(tlsBackend.URL)
+	serverCAs := x509.NewCertPool()
+	serverCAs.AddCert(tlsBackend.Certificate())
+
+	conf := config.Config{YamlConfig: config.YamlConfig{
+		BackendProxy:         shardingconfig.YAMLUrl{URL: proxyURL},
+		BackendProxyUser:     "akubra",
+		BackendProxyPassword: "secret",
+	}}
+	httpTransport, err := ConfigureHTTPTransport(conf)
+	assert.NoError(t, err)
+	httpTransport.TLSClientConfig = &tls.Config{RootCAs: serverCAs}
+	expectedAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte("akubra:secret"))
+
+	for _, testData := range []struct {
+		url     string
+		request string
+		body    string
+	}{
+		{tlsBackend.URL + "/bucket/key", "CONNECT " + tlsBackendURL.Host, "from backend"},
+		{"http://backend.internal/bucket/key", "GET backend.internal", "from proxy"},
+	} {
+		req, _ := http.NewRequest("GET", testData.url, nil)
+		resp, err := httpTransport.RoundTrip(req)
+		if !assert.NoError(t, err, testData.url) {
+			continue
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, resp.Body.Close())
+		assert.Equal(t, testData.body, string(body))
+		assert.Equal(t, testData.request+" "+expectedAuth, <-requests)
+	}
+}
+
+func TestShouldAcceptOnlyConfiguredListenerCipherSuites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "akubra-listener-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// ECDSA certificate, verification is skipped by client
+	certFile, keyFile, _ := writeClientCertificate(t, dir)
+
+	tlsConfig, err := ConfigureListenerTLS(config.Config{YamlConfig: config.YamlConfig{
+		TLSCertFile:     certFile,
+		TLSKeyFile:      keyFile,
+		TLSCipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+	}})
+	assert.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go func() { _ = srv.Serve(tls.NewListener(listener, tlsConfig)) }()
+	defer srv.Close()
+
+	for _, testData := range []struct {
+		cipherSuite uint16
+		accepted    bool
+	}{
+		{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, true},
+		{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA, false},
+	} {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			// TLS 1.3 suites are not configurable
+			MaxVersion:   tls.VersionTLS12,
+			CipherSuites: []uint16{testData.cipherSuite},
+		})
+		if !testData.accepted {
+			assert.Error(t, err, "cipher suite %x", testData.cipherSuite)
+			continue
+		}
+		if assert.NoError(t, err) {
+			assert.Equal(t, testData.cipherSuite, conn.ConnectionState().CipherSuite)
+			assert.NoError(t, conn.Close())
+		}
+	}
+
+	withoutTLS, err := ConfigureListenerTLS(config.Config{})
+	assert.NoError(t, err)
+	assert.Nil(t, withoutTLS)
+}
+
+func mkExpectContinueServer(delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// server sends 100 Continue once handler starts reading body
+		time.Sleep(delay)
+		body, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+}
+
+func sendExpectContinue(rt http.RoundTripper, url string) (*http.Response, error) {
+	req, _ := http.NewRequest("PUT", url, bytes.NewReader([]byte("payload")))
+	req.Header.Set("Expect", "100-continue")
+	return rt.RoundTrip(req)
+}
+
+func TestShouldSendBodyAfterExpectContinueTimeout(t *testing.T) {
+	srv := mkExpectContinueServer(300 * time.Millisecond)
+	defer srv.Close()
+	conf := config.Config{YamlConfig: config.YamlConfig{
+		ExpectContinueTimeout: metrics.Interval{Duration: 50 * time.Millisecond},
+	}}
+	httpTransport, err := ConfigureHTTPTransport(conf)
+	assert.NoError(t, err)
+	rt := DecorateBackendRoundTripper(conf, httpTransport)
+
+	resp, err := sendExpectContinue(rt, srv.URL)
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "payload", string(body))
+}
+
+func TestShouldFailOnExpectContinueTimeoutIfConfigured(t *testing.T) {
+	conf := config.Config{YamlConfig: config.YamlConfig{
+		ExpectContinueTimeout:       metrics.Interval{Duration: 50 * time.Millisecond},
+		FailOnExpectContinueTimeout: true,
+	}}
+	httpTransport, err := ConfigureHTTPTransport(conf)
+	assert.NoError(t, err)
+	rt := DecorateBackendRoundTripper(conf, httpTransport)
+
+	slowSrv := mkExpectContinueServer(300 * time.Millisecond)
+	defer slowSrv.Close()
+	_, err = sendExpectContinue(rt, slowSrv.URL)
+	assert.Equal(t, ErrExpectContinueTimeout, err)
+
+	fastSrv := mkExpectContinueServer(0)
+	defer fastSrv.Close()
+	resp, err := sendExpectContinue(rt, fastSrv.URL)
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "payload", string(body))
+}
+
+func TestShouldDropBackendResponseWithOversizedHeaders(t *testing.T) {
+	oversized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Garbage", strings.Repeat("x", 64*1024))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer oversized.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+	oversizedURL, _ := url.Parse(oversized.URL)
+	healthyURL, _ := url.Parse(healthy.URL)
+
+	conf := config.Config{YamlConfig: config.YamlConfig{
+		MaxBackendHeaderBytes: shardingconfig.HumanSizeUnits{SizeInBytes: 16 * 1024},
+	}}
+	httpTransport, err := ConfigureHTTPTransport(conf)
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", oversized.URL, nil)
+	_, err = httpTransport.RoundTrip(req)
+	assert.Error(t, err)
+
+	multiTransport := transport.NewMultiTransport(httpTransport, []url.URL{*oversizedURL, *healthyURL},
+		EarliestResponseHandler(conf), transport.MultiTransportOptions{})
+	req, _ = http.NewRequest("GET", "http://localhost/bucket/key", nil)
+	resp, err := multiTransport.RoundTrip(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("X-Garbage"))
+}
+
+type okRoundTripper struct{}
+
+func (rt okRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader("OK")),
+	}, nil
+}
+
+func TestShouldShedLoadBetweenWatermarks(t *testing.T) {
+	handler := &Handler{
+		roundTripper:          okRoundTripper{},
+		bodyMaxSize:           1024,
+		maxConcurrentRequests: 100,
+		loadShed:              httphandlerconfig.LoadShedConfig{HighWatermark: 4, LowWatermark: 2},
+	}
+	for _, testData := range []struct {
+		inFlight       int32
+		expectedStatus int
+	}{
+		{2, http.StatusOK},
+		{4, http.StatusServiceUnavailable},
+		{3, http.StatusServiceUnavailable},
+		{1, http.StatusOK},
+		{3, http.StatusOK},
+	} {
+		atomic.StoreInt32(&handler.runningRequestCount, testData.inFlight)
+		writer := httptest.NewRecorder()
+
+		handler.ServeHTTP(writer, httptest.NewRequest("GET", "http://localhost/bucket/key", nil))
+
+		assert.Equal(t, testData.expectedStatus, writer.Code, "in flight: %d", testData.inFlight)
+	}
+}
+
+func mkChunkedServer(parts ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, part := range parts {
+			_, _ = w.Write([]byte(part))
+			w.(http.Flusher).Flush()
+		}
+	}))
+}
+
+func TestShouldProxyChunkedBackendResponse(t *testing.T) {
+	// parts exceed http.Server write buffer, so proxied response stays chunked
+	parts := []string{strings.Repeat("a", 4096), strings.Repeat("b", 4096), "c"}
+	backend := mkChunkedServer(parts...)
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	toBackend := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		req.URL.Scheme = backendURL.Scheme
+		req.URL.Host = backendURL.Host
+		return http.DefaultTransport.RoundTrip(req)
+	})
+	handler := &Handler{
+		roundTripper:          RangeEmulator(toBackend),
+		bodyMaxSize:           1024,
+		maxConcurrentRequests: 1,
+	}
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/bucket/key", nil)
+	req.Header.Set("Range", "bytes=0-4")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, strings.Join(parts, ""), string(body))
+	assert.Equal(t, int64(-1), resp.ContentLength)
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+}
+
+func TestShouldKeepClientConnectionAliveWithBackendKeepAlivesDisabled(t *testing.T) {
+	var backendConns int32
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Keep-Alive", "timeout=5")
+		_, _ = w.Write([]byte("ok"))
+	}))
+	backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&backendConns, 1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	httpTransport, err := ConfigureHTTPTransport(config.Config{YamlConfig: config.YamlConfig{DisableKeepAlives: true}})
+	assert.NoError(t, err)
+	multiTransport := transport.NewMultiTransport(httpTransport, []url.URL{*backendURL}, nil, transport.MultiTransportOptions{})
+	handler := &Handler{
+		roundTripper:          Decorate(multiTransport, HopByHopHeadersFilter([]string{"Connection", "Keep-Alive"})),
+		bodyMaxSize:           1024,
+		maxConcurrentRequests: 10,
+	}
+	var clientConns int32
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&clientConns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+	client := &http.Client{Transport: &http.Transport{}}
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(srv.URL + "/bucket/key")
+		assert.NoError(t, err)
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, resp.Body.Close())
+		assert.False(t, resp.Close, "client connection should be kept alive")
+		assert.Empty(t, resp.Header.Get("Keep-Alive"))
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&clientConns))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&backendConns))
+}
+
+type staleContentLengthRoundTripper struct{}
+
+func (rt staleContentLengthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	header := make(http.Header)
+	header.Set("Content-Length", "3")
+	header.Set("Transfer-Encoding", "chunked")
+	return &http.Response{
+		StatusCode:       http.StatusOK,
+		Header:           header,
+		Body:             ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 4096))),
+		ContentLength:    -1,
+		TransferEncoding: []string{"chunked"},
+	}, nil
+}
+
+func TestShouldNotPassStaleContentLengthOfUnknownLengthResponse(t *testing.T) {
+	handler := &Handler{
+		roundTripper:          staleContentLengthRoundTripper{},
+		bodyMaxSize:           1024,
+		maxConcurrentRequests: 1,
+	}
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/bucket/key")
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+
+	assert.Equal(t, 4096, len(body))
+	assert.Empty(t, resp.Header.Get("Content-Length"))
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+}
+
+func TestShouldForwardRawQueryUnchanged(t *testing.T) {
+	received := make(chan string, 2)
+	var backends []url.URL
+	for i := 0; i < 2; i++ {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received <- r.URL.RawQuery
+		}))
+		defer backend.Close()
+		backendURL, _ := url.Parse(backend.URL)
+		backends = append(backends, *backendURL)
+	}
+	multiTransport := transport.NewMultiTransport(http.DefaultTransport, backends, nil, transport.MultiTransportOptions{})
+	handler := &Handler{
+		roundTripper:          Decorate(multiTransport, KeyNormalizer(true)),
+		bodyMaxSize:           1024,
+		maxConcurrentRequests: 10,
+	}
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	for _, rawQuery := range []string{
+		// pre-signed URL, signature is not the last parameter
+		"X-Amz-Signature=4f0e5f7d&X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Date=20171001T120000Z" +
+			"&X-Amz-Credential=AKIAEXAMPLE%2F20171001%2Fus-east-1%2Fs3%2Faws4_request&X-Amz-Expires=300&X-Amz-SignedHeaders=host",
+		"b=2&a=1&a=0&empty=&flag",
+		"response-content-disposition=attachment%3B%20filename%3D%22a+b.txt%22&key=a%20b+c%2Bd",
+	} {
+		resp, err := http.Get(srv.URL + "/bucket/key?" + rawQuery)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.NoError(t, resp.Body.Close())
+		for i := 0; i < len(backends); i++ {
+			select {
+			case forwarded := <-received:
+				assert.Equal(t, rawQuery, forwarded)
+			case <-time.After(time.Second):
+				t.Fatalf("Backend did not receive request with query %q", rawQuery)
+			}
+		}
+	}
+}
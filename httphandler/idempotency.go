@@ -0,0 +1,272 @@
+package httphandler
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// idempotencyMaxBodySize limits size of cached response body, write
+// responses are small, results with bigger bodies are not cached
+const idempotencyMaxBodySize = 64 * 1024
+
+// idempotentResult is outcome of first write with given key. Retries wait
+// for done and replay result if it was cached
+type idempotentResult struct {
+	key     string
+	done    chan struct{}
+	resp    *http.Response
+	body    []byte
+	digest  []byte
+	cached  bool
+	expires time.Time
+	element *list.Element
+}
+
+type idempotentWrites struct {
+	ttl          time.Duration
+	maxKeys      int
+	now          func() time.Time
+	roundTripper http.RoundTripper
+	mx           sync.Mutex
+	// lru keeps results from most to least recently used
+	lru     *list.List
+	results map[string]*idempotentResult
+}
+
+// requestAccessKey returns access key of signed request (from Authorization
+// header or presigned URL), empty for anonymous ones
+func requestAccessKey(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	switch {
+	case strings.HasPrefix(auth, "AWS4-HMAC-SHA256 "):
+		idx := strings.Index(auth, "Credential=")
+		if idx < 0 {
+			return ""
+		}
+		return strings.SplitN(auth[idx+len("Credential="):], "/", 2)[0]
+	case strings.HasPrefix(auth, "AWS "):
+		return strings.SplitN(strings.TrimPrefix(auth, "AWS "), ":", 2)[0]
+	}
+	query := req.URL.Query()
+	if credential := query.Get("X-Amz-Credential"); credential != "" {
+		return strings.SplitN(credential, "/", 2)[0]
+	}
+	return query.Get("AWSAccessKeyId")
+}
+
+// idempotencyKey scopes client key to access key, method and resource, so
+// the same key sent by another client or with another write is not answered
+// with unrelated result
+func idempotencyKey(req *http.Request) (string, bool) {
+	key := req.Header.Get("Idempotency-Key")
+	if key == "" {
+		return "", false
+	}
+	switch req.Method {
+	case http.MethodPut, http.MethodPost, http.MethodDelete:
+	default:
+		return "", false
+	}
+	return key + " " + requestAccessKey(req) + " " + req.Method + " " + req.Host + " " + req.URL.RequestURI(), true
+}
+
+func (iw *idempotentWrites) remove(result *idempotentResult) {
+	if iw.results[result.key] != result {
+		return
+	}
+	delete(iw.results, result.key)
+	iw.lru.Remove(result.element)
+}
+
+func (iw *idempotentWrites) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, ok := idempotencyKey(req)
+	if !ok {
+		return iw.roundTripper.RoundTrip(req)
+	}
+	iw.mx.Lock()
+	result, found := iw.results[key]
+	if found && result.isExpired(iw.now()) {
+		iw.remove(result)
+		found = false
+	}
+	if found {
+		iw.lru.MoveToFront(result.element)
+		iw.mx.Unlock()
+		return iw.replay(result, req)
+	}
+	result = &idempotentResult{key: key, done: make(chan struct{})}
+	result.element = iw.lru.PushFront(result)
+	iw.results[key] = result
+	// writes still in progress are kept, their retries have to wait for them
+	for element := iw.lru.Back(); element != nil && iw.lru.Len() > iw.maxKeys; {
+		prev := element.Prev()
+		if oldest := element.Value.(*idempotentResult); oldest.finished() {
+			iw.remove(oldest)
+		}
+		element = prev
+	}
+	iw.mx.Unlock()
+	return iw.record(result, req)
+}
+
+func (result *idempotentResult) finished() bool {
+	select {
+	case <-result.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (result *idempotentResult) isExpired(now time.Time) bool {
+	return result.finished() && now.After(result.expires)
+}
+
+// digestingBody computes digest of request body while it is sent to backends
+type digestingBody struct {
+	io.ReadCloser
+	mx   sync.Mutex
+	hash hash.Hash
+	read int64
+	eof  bool
+}
+
+func (db *digestingBody) Read(p []byte) (int, error) {
+	n, err := db.ReadCloser.Read(p)
+	db.mx.Lock()
+	_, _ = db.hash.Write(p[:n])
+	db.read += int64(n)
+	db.eof = db.eof || err == io.EOF
+	db.mx.Unlock()
+	return n, err
+}
+
+// digest returns digest of body, if it was read completely
+func (db *digestingBody) digest(contentLength int64) ([]byte, bool) {
+	db.mx.Lock()
+	defer db.mx.Unlock()
+	if !db.eof && (contentLength < 0 || db.read < contentLength) {
+		return nil, false
+	}
+	return db.hash.Sum(nil), true
+}
+
+// bodyDigest reads body of retried request and returns its digest
+func bodyDigest(req *http.Request) ([]byte, error) {
+	digest := sha256.New()
+	if req.Body != nil && req.Body != http.NoBody {
+		if _, err := io.Copy(digest, req.Body); err != nil {
+			return nil, err
+		}
+	}
+	return digest.Sum(nil), nil
+}
+
+func (iw *idempotentWrites) replay(result *idempotentResult, req *http.Request) (*http.Response, error) {
+	select {
+	case <-result.done:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	if !result.cached {
+		return iw.roundTripper.RoundTrip(req)
+	}
+	digest, err := bodyDigest(req)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(digest, result.digest) {
+		metrics.Mark("reqs.global.idempotent_conflicts")
+		log.Debugf("Body of %s %s differs from first request with Idempotency-Key %q",
+			req.Method, req.URL.Path, req.Header.Get("Idempotency-Key"))
+		return s3ErrorResponse(req, http.StatusUnprocessableEntity, "IdempotencyKeyMismatch",
+			"The request body differs from the first request with this Idempotency-Key."), nil
+	}
+	metrics.Mark("reqs.global.idempotent_replays")
+	log.Debugf("Replaying cached result of %s %s for Idempotency-Key %q",
+		req.Method, req.URL.Path, req.Header.Get("Idempotency-Key"))
+	return copyResponse(result.resp, result.body, req), nil
+}
+
+// record sends write to backends and caches its result if it succeeded
+func (iw *idempotentWrites) record(result *idempotentResult, req *http.Request) (*http.Response, error) {
+	defer func() {
+		iw.mx.Lock()
+		if result.cached {
+			result.expires = iw.now().Add(iw.ttl)
+		} else {
+			iw.remove(result)
+		}
+		iw.mx.Unlock()
+		close(result.done)
+	}()
+	var body *digestingBody
+	if req.Body != nil && req.Body != http.NoBody {
+		body = &digestingBody{ReadCloser: req.Body, hash: sha256.New()}
+		req.Body = body
+	}
+	resp, err := iw.roundTripper.RoundTrip(req)
+	if err != nil || resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices ||
+		resp.ContentLength > idempotencyMaxBodySize {
+		return resp, err
+	}
+	respBody, readErr := ioutil.ReadAll(io.LimitReader(resp.Body, idempotencyMaxBodySize+1))
+	if closeErr := resp.Body.Close(); closeErr != nil {
+		log.Debugf("Cannot close response body %s", closeErr)
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	emptyDigest := sha256.Sum256(nil)
+	digest, complete := emptyDigest[:], true
+	if body != nil {
+		digest, complete = body.digest(req.ContentLength)
+	}
+	result.resp = resp
+	result.body = respBody
+	result.digest = digest
+	result.cached = complete && len(respBody) <= idempotencyMaxBodySize
+	if !result.cached {
+		log.Debugf("Result of %s %s cannot be cached for Idempotency-Key", req.Method, req.URL.Path)
+	}
+	return copyResponse(resp, respBody, req), nil
+}
+
+// IdempotentWrites creates Decorator which caches successful results of
+// writes with Idempotency-Key header and answers retries with the same key
+// with cached result, without sending them to backends again
+func IdempotentWrites(conf httphandlerconfig.IdempotencyConfig) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if !conf.Enabled {
+			return roundTripper
+		}
+		ttl := conf.TTL.Duration
+		if ttl <= 0 {
+			ttl = httphandlerconfig.DefaultIdempotencyTTL
+		}
+		maxKeys := conf.MaxKeys
+		if maxKeys <= 0 {
+			maxKeys = httphandlerconfig.DefaultIdempotencyMaxKeys
+		}
+		return &idempotentWrites{
+			ttl:          ttl,
+			maxKeys:      maxKeys,
+			now:          time.Now,
+			roundTripper: roundTripper,
+			lru:          list.New(),
+			results:      make(map[string]*idempotentResult),
+		}
+	}
+}
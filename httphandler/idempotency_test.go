@@ -0,0 +1,190 @@
+package httphandler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type writeBackend struct {
+	*httptest.Server
+	writes int32
+	status int32
+}
+
+func mkWriteBackend(status int32) *writeBackend {
+	wb := &writeBackend{status: status}
+	wb.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		n := atomic.AddInt32(&wb.writes, 1)
+		w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, n))
+		w.WriteHeader(int(atomic.LoadInt32(&wb.status)))
+	}))
+	return wb
+}
+
+func (wb *writeBackend) count() int32 {
+	return atomic.LoadInt32(&wb.writes)
+}
+
+func sendWrite(t *testing.T, rt http.RoundTripper, url, key string) *http.Response {
+	return sendSignedWrite(t, rt, url, key, "", "content")
+}
+
+func sendSignedWrite(t *testing.T, rt http.RoundTripper, url, key, accessKey, body string) *http.Response {
+	req, _ := http.NewRequest(http.MethodPut, url, strings.NewReader(body))
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	if accessKey != "" {
+		req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+
+			"/20170101/us-east-1/s3/aws4_request, SignedHeaders=host, Signature=abc")
+	}
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	return resp
+}
+
+func TestIdempotentWritesReplayResultOfRepeatedKey(t *testing.T) {
+	backend := mkWriteBackend(http.StatusOK)
+	defer backend.Close()
+	rt := IdempotentWrites(httphandlerconfig.IdempotencyConfig{Enabled: true})(http.DefaultTransport)
+
+	first := sendWrite(t, rt, backend.URL+"/bucket/key", "key-1")
+	retry := sendWrite(t, rt, backend.URL+"/bucket/key", "key-1")
+
+	assert.Equal(t, int32(1), backend.count())
+	assert.Equal(t, http.StatusOK, retry.StatusCode)
+	assert.Equal(t, first.Header.Get("ETag"), retry.Header.Get("ETag"))
+}
+
+func TestIdempotentWritesSendWritesWithoutKeyOrWithOtherKey(t *testing.T) {
+	backend := mkWriteBackend(http.StatusOK)
+	defer backend.Close()
+	rt := IdempotentWrites(httphandlerconfig.IdempotencyConfig{Enabled: true})(http.DefaultTransport)
+
+	sendWrite(t, rt, backend.URL+"/bucket/key", "")
+	sendWrite(t, rt, backend.URL+"/bucket/key", "")
+	sendWrite(t, rt, backend.URL+"/bucket/key", "key-1")
+	sendWrite(t, rt, backend.URL+"/bucket/key", "key-2")
+	sendWrite(t, rt, backend.URL+"/bucket/other", "key-2")
+
+	assert.Equal(t, int32(5), backend.count())
+}
+
+func TestIdempotentWritesScopeKeyToAccessKey(t *testing.T) {
+	backend := mkWriteBackend(http.StatusOK)
+	defer backend.Close()
+	rt := IdempotentWrites(httphandlerconfig.IdempotencyConfig{Enabled: true})(http.DefaultTransport)
+
+	sendSignedWrite(t, rt, backend.URL+"/bucket/key", "key-1", "access-1", "content")
+	sendSignedWrite(t, rt, backend.URL+"/bucket/key", "key-1", "access-2", "content")
+	sendSignedWrite(t, rt, backend.URL+"/bucket/key", "key-1", "access-1", "content")
+
+	assert.Equal(t, int32(2), backend.count())
+}
+
+func TestIdempotentWritesRejectRetryWithOtherBody(t *testing.T) {
+	backend := mkWriteBackend(http.StatusOK)
+	defer backend.Close()
+	rt := IdempotentWrites(httphandlerconfig.IdempotencyConfig{Enabled: true})(http.DefaultTransport)
+
+	sendSignedWrite(t, rt, backend.URL+"/bucket/key", "key-1", "access-1", "content")
+	retry := sendSignedWrite(t, rt, backend.URL+"/bucket/key", "key-1", "access-1", "other content")
+
+	assert.Equal(t, int32(1), backend.count())
+	assert.Equal(t, http.StatusUnprocessableEntity, retry.StatusCode)
+}
+
+func TestIdempotentWritesDoNotEvictWritesInProgress(t *testing.T) {
+	release := make(chan struct{})
+	received := make(chan struct{}, 1)
+	var writes int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&writes, 1)
+		if r.URL.Path == "/bucket/slow" {
+			received <- struct{}{}
+			<-release
+		}
+	}))
+	defer backend.Close()
+	rt := IdempotentWrites(httphandlerconfig.IdempotencyConfig{Enabled: true, MaxKeys: 1})(http.DefaultTransport)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sendWrite(t, rt, backend.URL+"/bucket/slow", "key-1")
+	}()
+	<-received
+	sendWrite(t, rt, backend.URL+"/bucket/key", "key-2")
+	sendWrite(t, rt, backend.URL+"/bucket/key", "key-3")
+	retried := make(chan struct{})
+	go func() {
+		defer close(retried)
+		sendWrite(t, rt, backend.URL+"/bucket/slow", "key-1")
+	}()
+	close(release)
+	<-done
+	<-retried
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&writes))
+}
+
+func TestIdempotentWritesDoNotCacheFailedWrites(t *testing.T) {
+	backend := mkWriteBackend(http.StatusServiceUnavailable)
+	defer backend.Close()
+	rt := IdempotentWrites(httphandlerconfig.IdempotencyConfig{Enabled: true})(http.DefaultTransport)
+
+	sendWrite(t, rt, backend.URL+"/bucket/key", "key-1")
+	atomic.StoreInt32(&backend.status, http.StatusOK)
+	retry := sendWrite(t, rt, backend.URL+"/bucket/key", "key-1")
+	sendWrite(t, rt, backend.URL+"/bucket/key", "key-1")
+
+	assert.Equal(t, int32(2), backend.count())
+	assert.Equal(t, http.StatusOK, retry.StatusCode)
+}
+
+func TestIdempotentWritesForgetExpiredAndLeastRecentlyUsedKeys(t *testing.T) {
+	backend := mkWriteBackend(http.StatusOK)
+	defer backend.Close()
+	now := time.Now()
+	rt := IdempotentWrites(httphandlerconfig.IdempotencyConfig{Enabled: true, MaxKeys: 2})(http.DefaultTransport)
+	rt.(*idempotentWrites).now = func() time.Time { return now }
+
+	sendWrite(t, rt, backend.URL+"/bucket/key", "key-1")
+	sendWrite(t, rt, backend.URL+"/bucket/key", "key-2")
+	sendWrite(t, rt, backend.URL+"/bucket/key", "key-1")
+	// key-2 is least recently used one
+	sendWrite(t, rt, backend.URL+"/bucket/key", "key-3")
+	sendWrite(t, rt, backend.URL+"/bucket/key", "key-1")
+	assert.Equal(t, int32(3), backend.count())
+	sendWrite(t, rt, backend.URL+"/bucket/key", "key-2")
+	assert.Equal(t, int32(4), backend.count())
+
+	now = now.Add(httphandlerconfig.DefaultIdempotencyTTL + time.Second)
+	sendWrite(t, rt, backend.URL+"/bucket/key", "key-2")
+	assert.Equal(t, int32(5), backend.count())
+}
+
+func TestIdempotentWritesAreDisabledByDefault(t *testing.T) {
+	backend := mkWriteBackend(http.StatusOK)
+	defer backend.Close()
+	rt := IdempotentWrites(httphandlerconfig.IdempotencyConfig{})(http.DefaultTransport)
+
+	sendWrite(t, rt, backend.URL+"/bucket/key", "key-1")
+	sendWrite(t, rt, backend.URL+"/bucket/key", "key-1")
+
+	assert.Equal(t, int32(2), backend.count())
+}
@@ -0,0 +1,96 @@
+package httphandler
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// minReapInterval limits how often idle connections are checked for short
+// timeouts
+const minReapInterval = 10 * time.Millisecond
+
+// IdleConnectionReaper tracks client connections and closes ones idle (not
+// serving any request) longer than timeout. Number of tracked connections is
+// reported in reqs.global.client_connections gauge. Its ConnState method has
+// to be set as http.Server ConnState hook
+type IdleConnectionReaper struct {
+	mx      sync.Mutex
+	timeout time.Duration
+	// conns maps connection to time it became idle, zero if it's active
+	conns map[net.Conn]time.Time
+}
+
+// NewIdleConnectionReaper creates IdleConnectionReaper, zero timeout only
+// tracks connections
+func NewIdleConnectionReaper(timeout time.Duration) *IdleConnectionReaper {
+	return &IdleConnectionReaper{timeout: timeout, conns: make(map[net.Conn]time.Time)}
+}
+
+// ConnState registers new and idle connections with time they became idle
+// and forgets closed ones
+func (ir *IdleConnectionReaper) ConnState(conn net.Conn, state http.ConnState) {
+	ir.mx.Lock()
+	defer ir.mx.Unlock()
+	switch state {
+	case http.StateNew, http.StateIdle:
+		ir.conns[conn] = time.Now()
+	case http.StateActive:
+		ir.conns[conn] = time.Time{}
+	case http.StateHijacked, http.StateClosed:
+		delete(ir.conns, conn)
+	}
+	metrics.UpdateGauge("reqs.global.client_connections", int64(len(ir.conns)))
+}
+
+// Tracked returns number of tracked connections
+func (ir *IdleConnectionReaper) Tracked() int {
+	ir.mx.Lock()
+	defer ir.mx.Unlock()
+	return len(ir.conns)
+}
+
+// reap closes connections idle longer than timeout at now, server forgets
+// them when their reads fail
+func (ir *IdleConnectionReaper) reap(now time.Time) {
+	ir.mx.Lock()
+	defer ir.mx.Unlock()
+	for conn, idleSince := range ir.conns {
+		if idleSince.IsZero() || now.Sub(idleSince) < ir.timeout {
+			continue
+		}
+		metrics.Mark("reqs.global.idle_connections_reaped")
+		log.Debugf("Closing connection of %s idle since %s", conn.RemoteAddr(), idleSince)
+		if err := conn.Close(); err != nil {
+			log.Debugf("Cannot close idle connection of %s: %s", conn.RemoteAddr(), err)
+		}
+		delete(ir.conns, conn)
+	}
+	metrics.UpdateGauge("reqs.global.client_connections", int64(len(ir.conns)))
+}
+
+// Run reaps idle connections every half of timeout until stop is closed,
+// it returns at once if timeout is zero
+func (ir *IdleConnectionReaper) Run(stop <-chan struct{}) {
+	if ir.timeout <= 0 {
+		return
+	}
+	interval := ir.timeout / 2
+	if interval < minReapInterval {
+		interval = minReapInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			ir.reap(now)
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package httphandler
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdleConnectionReaperClosesIdleConnections(t *testing.T) {
+	timeout := 100 * time.Millisecond
+	reaper := NewIdleConnectionReaper(timeout)
+	stop := make(chan struct{})
+	defer close(stop)
+	go reaper.Run(stop)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ConnState = reaper.ConnState
+	srv.Start()
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "GET /bucket/key HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	waitFor(t, func() bool { return reaper.Tracked() == 1 }, "connection should be tracked")
+	started := time.Now()
+
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(10*timeout)))
+	_, err = ioutil.ReadAll(conn)
+	netErr, isNetErr := err.(net.Error)
+	assert.False(t, isNetErr && netErr.Timeout(), "idle connection should be closed by server")
+	assert.True(t, time.Since(started) >= timeout/2, "closed before idle timeout")
+	waitFor(t, func() bool { return reaper.Tracked() == 0 }, "closed connection should be forgotten")
+	assert.True(t, meterCount("reqs.global.idle_connections_reaped") > 0)
+}
+
+func TestIdleConnectionReaperKeepsActiveConnections(t *testing.T) {
+	reaper := NewIdleConnectionReaper(time.Millisecond)
+	active, activePeer := net.Pipe()
+	defer activePeer.Close()
+	idle, idlePeer := net.Pipe()
+	defer idlePeer.Close()
+	reaper.ConnState(active, http.StateNew)
+	reaper.ConnState(active, http.StateActive)
+	reaper.ConnState(idle, http.StateNew)
+
+	reaper.reap(time.Now().Add(time.Second))
+
+	assert.Equal(t, 1, reaper.Tracked())
+	reaper.ConnState(active, http.StateClosed)
+	assert.Equal(t, 0, reaper.Tracked())
+}
@@ -0,0 +1,31 @@
+package httphandler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/allegro/akubra/metrics"
+)
+
+type latencyBucketsRecorder struct {
+	buckets      *metrics.LatencyBuckets
+	roundTripper http.RoundTripper
+}
+
+func (lbr *latencyBucketsRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	since := time.Now()
+	resp, err := lbr.roundTripper.RoundTrip(req)
+	lbr.buckets.Observe(time.Since(since))
+	return resp, err
+}
+
+// LatencyBucketsRecording creates Decorator which counts time until response
+// headers of client requests in latency buckets. Nil buckets disable it
+func LatencyBucketsRecording(buckets *metrics.LatencyBuckets) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if buckets == nil {
+			return roundTripper
+		}
+		return &latencyBucketsRecorder{buckets: buckets, roundTripper: roundTripper}
+	}
+}
@@ -0,0 +1,52 @@
+package httphandler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/metrics"
+	gometrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func latencyBucketCount(t *testing.T, name string) int64 {
+	counter, ok := gometrics.DefaultRegistry.Get(name).(gometrics.Counter)
+	require.True(t, ok, name)
+	return counter.Count()
+}
+
+func TestLatencyBucketsRecordingCountsClientRequests(t *testing.T) {
+	buckets := metrics.NewLatencyBuckets([]time.Duration{30 * time.Millisecond, time.Minute})
+	// counters are global, other tests may have already counted requests
+	names := []string{"reqs.global.latency.le_30ms", "reqs.global.latency.le_1m0s", "reqs.global.latency.le_inf"}
+	initial := make(map[string]int64, len(names))
+	for _, name := range names {
+		initial[name] = latencyBucketCount(t, name)
+	}
+	slow := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host == "slow.internal" {
+			time.Sleep(40 * time.Millisecond)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(nil)), Request: req}, nil
+	})
+	client := Decorate(slow, LatencyBucketsRecording(buckets))
+
+	for _, host := range []string{"fast.internal", "slow.internal"} {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+host+"/bucket/key", nil)
+		_, err := client.RoundTrip(req)
+		require.NoError(t, err)
+	}
+
+	for name, expected := range map[string]int64{
+		"reqs.global.latency.le_30ms": 1,
+		"reqs.global.latency.le_1m0s": 2,
+		"reqs.global.latency.le_inf":  2,
+	} {
+		assert.Equal(t, expected, latencyBucketCount(t, name)-initial[name], name)
+	}
+	assert.Equal(t, http.DefaultTransport, Decorate(http.DefaultTransport, LatencyBucketsRecording(nil)))
+}
@@ -0,0 +1,232 @@
+package httphandler
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/transport"
+)
+
+// DefaultMaxKeys is number of listed entries if request does not set max-keys
+const DefaultMaxKeys = 1000
+
+// ListBucketResult is S3 ListObjects (V1) response body. XMLName keeps root
+// element (with namespace) of backend response
+type ListBucketResult struct {
+	XMLName        xml.Name
+	Name           string             `xml:"Name"`
+	Prefix         string             `xml:"Prefix"`
+	Marker         string             `xml:"Marker"`
+	NextMarker     string             `xml:"NextMarker,omitempty"`
+	MaxKeys        int                `xml:"MaxKeys"`
+	Delimiter      string             `xml:"Delimiter,omitempty"`
+	IsTruncated    bool               `xml:"IsTruncated"`
+	EncodingType   string             `xml:"EncodingType,omitempty"`
+	Contents       []ListBucketObject `xml:"Contents"`
+	CommonPrefixes []ListBucketPrefix `xml:"CommonPrefixes"`
+}
+
+// ListBucketObject is single key of ListBucketResult
+type ListBucketObject struct {
+	Key          string           `xml:"Key"`
+	LastModified string           `xml:"LastModified"`
+	ETag         string           `xml:"ETag"`
+	Size         int64            `xml:"Size"`
+	StorageClass string           `xml:"StorageClass,omitempty"`
+	Owner        *ListBucketOwner `xml:"Owner,omitempty"`
+}
+
+// ListBucketOwner is owner of listed object
+type ListBucketOwner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName,omitempty"`
+}
+
+// ListBucketPrefix is keys prefix rolled up by delimiter
+type ListBucketPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// listingEntry is either object or common prefix, name is used for ordering
+type listingEntry struct {
+	name   string
+	object *ListBucketObject
+	prefix *ListBucketPrefix
+}
+
+func (le listingEntry) marker() string {
+	if le.object != nil {
+		return le.object.Key
+	}
+	return le.prefix.Prefix
+}
+
+type listingMerger struct{}
+
+func maxKeys(req *http.Request) int {
+	limit, err := strconv.Atoi(req.URL.Query().Get("max-keys"))
+	if err != nil || limit < 0 || limit > DefaultMaxKeys {
+		return DefaultMaxKeys
+	}
+	return limit
+}
+
+// entryName returns key in S3 ordering, url encoded keys are decoded
+func entryName(key, encodingType string) string {
+	if encodingType != "url" {
+		return key
+	}
+	decoded, err := url.QueryUnescape(key)
+	if err != nil {
+		return key
+	}
+	return decoded
+}
+
+func readListings(tups []transport.ReqResErrTuple) ([]ListBucketResult, []byte, error) {
+	var results []ListBucketResult
+	var firstBody []byte
+	for _, r := range tups {
+		body, err := ioutil.ReadAll(r.Res.Body)
+		if firstBody == nil {
+			firstBody = body
+		}
+		if err != nil {
+			return nil, firstBody, err
+		}
+		result := ListBucketResult{}
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, firstBody, err
+		}
+		if result.XMLName.Local != "ListBucketResult" {
+			return nil, firstBody, fmt.Errorf("unexpected %s response", result.XMLName.Local)
+		}
+		results = append(results, result)
+	}
+	return results, firstBody, nil
+}
+
+// mergeListings sorts unique entries of all listings. Entries following the
+// last entry of any truncated listing are left for the next page, as
+// backend which truncated its listing may have entries preceding them
+func mergeListings(results []ListBucketResult, limit int) ListBucketResult {
+	merged := results[0]
+	merged.Contents, merged.CommonPrefixes = nil, nil
+	merged.NextMarker, merged.IsTruncated, merged.MaxKeys = "", false, limit
+
+	entries := make(map[string]listingEntry)
+	var bound string
+	bounded := false
+	for i := range results {
+		last := ""
+		for j := range results[i].Contents {
+			object := &results[i].Contents[j]
+			name := entryName(object.Key, merged.EncodingType)
+			if _, ok := entries[name]; !ok {
+				entries[name] = listingEntry{name: name, object: object}
+			}
+			if name > last {
+				last = name
+			}
+		}
+		for j := range results[i].CommonPrefixes {
+			prefix := &results[i].CommonPrefixes[j]
+			name := entryName(prefix.Prefix, merged.EncodingType)
+			if _, ok := entries[name]; !ok {
+				entries[name] = listingEntry{name: name, prefix: prefix}
+			}
+			if name > last {
+				last = name
+			}
+		}
+		if results[i].IsTruncated && (!bounded || last < bound) {
+			bound, bounded = last, true
+		}
+	}
+
+	sorted := make([]listingEntry, 0, len(entries))
+	for _, entry := range entries {
+		if !bounded || entry.name <= bound {
+			sorted = append(sorted, entry)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+	merged.IsTruncated = bounded || len(sorted) > limit
+	if len(sorted) > limit {
+		sorted = sorted[:limit]
+	}
+	for _, entry := range sorted {
+		if entry.object != nil {
+			merged.Contents = append(merged.Contents, *entry.object)
+			continue
+		}
+		merged.CommonPrefixes = append(merged.CommonPrefixes, *entry.prefix)
+	}
+	if merged.IsTruncated && len(sorted) > 0 {
+		merged.NextMarker = sorted[len(sorted)-1].marker()
+	}
+	return merged
+}
+
+func (lm *listingMerger) merge(tups []transport.ReqResErrTuple) transport.ReqResErrTuple {
+	var successfulTups []transport.ReqResErrTuple
+	for _, r := range tups {
+		if r.Failed {
+			discardResponseBody(r.Res)
+			continue
+		}
+		successfulTups = append(successfulTups, r)
+	}
+	if len(successfulTups) == 0 {
+		return tups[0]
+	}
+	successful := successfulTups[0]
+	results, firstBody, err := readListings(successfulTups)
+	for _, r := range successfulTups {
+		discardResponseBody(r.Res)
+	}
+	body := firstBody
+	if err != nil {
+		log.Printf("Cannot parse bucket listing, passing backend response as is: %s", err)
+	} else {
+		merged := mergeListings(results, maxKeys(successful.Req))
+		if body, err = xml.Marshal(merged); err != nil {
+			return transport.ReqResErrTuple{Req: successful.Req, Err: err, Failed: true}
+		}
+		body = append([]byte(xml.Header), body...)
+		successful.Res.Header.Set("Content-Type", "application/xml")
+	}
+	res := successful.Res
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return successful
+}
+
+// ListingResponseHandler merges bucket listings of all backends if
+// MergeListings is enabled, other requests are handled by next handler
+func ListingResponseHandler(conf config.Config, next transport.MultipleResponsesHandler) transport.MultipleResponsesHandler {
+	if !conf.MergeListings {
+		return next
+	}
+	lm := &listingMerger{}
+	return func(in <-chan transport.ReqResErrTuple) transport.ReqResErrTuple {
+		first, ok := <-in
+		if !ok || !transport.IsBucketListing(first.Req) {
+			return replayResponses(first, ok, in, next)
+		}
+		tups := []transport.ReqResErrTuple{first}
+		for r := range in {
+			tups = append(tups, r)
+		}
+		return lm.merge(tups)
+	}
+}
@@ -0,0 +1,167 @@
+package httphandler
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mkListingBackend lists given keys with S3 ListObjects (V1) semantics
+func mkListingBackend(keys ...string) url.URL {
+	sort.Strings(keys)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		prefix, delimiter, marker := query.Get("prefix"), query.Get("delimiter"), query.Get("marker")
+		limit := maxKeys(r)
+		result := ListBucketResult{
+			XMLName:   xml.Name{Space: "http://s3.amazonaws.com/doc/2006-03-01/", Local: "ListBucketResult"},
+			Name:      strings.Trim(r.URL.Path, "/"),
+			Prefix:    prefix,
+			Marker:    marker,
+			MaxKeys:   limit,
+			Delimiter: delimiter,
+		}
+		last := ""
+		for _, key := range keys {
+			if key <= marker || !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			entry := key
+			if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+				entry = key[:len(prefix)+i+len(delimiter)]
+			}
+			if entry <= marker || entry == last {
+				continue
+			}
+			if len(result.Contents)+len(result.CommonPrefixes) == limit {
+				result.IsTruncated = true
+				break
+			}
+			if entry == key {
+				result.Contents = append(result.Contents, ListBucketObject{Key: key, ETag: `"etag"`, Size: 4})
+			} else {
+				result.CommonPrefixes = append(result.CommonPrefixes, ListBucketPrefix{entry})
+			}
+			last = entry
+		}
+		body, _ := xml.Marshal(result)
+		w.Header().Set("Content-Type", "application/xml")
+		_, _ = w.Write(body)
+	}))
+	backendURL, _ := url.Parse(srv.URL)
+	return *backendURL
+}
+
+func mkListingTransport(backends ...url.URL) http.RoundTripper {
+	conf := config.Config{YamlConfig: config.YamlConfig{MergeListings: true}}
+	handler := ListingResponseHandler(conf, LateResponseHandler(conf))
+	return transport.NewMultiTransport(http.DefaultTransport, backends, handler,
+		transport.MultiTransportOptions{MergeListings: true})
+}
+
+func listPage(t *testing.T, transp http.RoundTripper, query url.Values) ListBucketResult {
+	req, _ := http.NewRequest("GET", "http://localhost/bucket?"+query.Encode(), nil)
+	resp, err := transp.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Equal(t, strconv.Itoa(len(body)), resp.Header.Get("Content-Length"))
+	result := ListBucketResult{}
+	require.NoError(t, xml.Unmarshal(body, &result))
+	assert.Equal(t, "ListBucketResult", result.XMLName.Local)
+	assert.Equal(t, "http://s3.amazonaws.com/doc/2006-03-01/", result.XMLName.Space)
+	return result
+}
+
+// listAll follows NextMarker and returns all listed entries in order
+func listAll(t *testing.T, transp http.RoundTripper, query url.Values, limit int) []string {
+	var entries []string
+	query.Set("max-keys", strconv.Itoa(limit))
+	for page := 0; page < 100; page++ {
+		result := listPage(t, transp, query)
+		var pageEntries []string
+		for _, object := range result.Contents {
+			pageEntries = append(pageEntries, object.Key)
+		}
+		for _, prefix := range result.CommonPrefixes {
+			pageEntries = append(pageEntries, prefix.Prefix)
+		}
+		sort.Strings(pageEntries)
+		assert.True(t, len(pageEntries) <= limit, "page should respect max-keys")
+		entries = append(entries, pageEntries...)
+		if !result.IsTruncated {
+			return entries
+		}
+		require.NotEmpty(t, result.NextMarker)
+		require.Equal(t, pageEntries[len(pageEntries)-1], result.NextMarker)
+		query.Set("marker", result.NextMarker)
+	}
+	t.Fatal("listing should end")
+	return nil
+}
+
+func TestListingMergeSortsUniqueKeysOfAllBackends(t *testing.T) {
+	transp := mkListingTransport(mkListingBackend("e", "a", "c"), mkListingBackend("d", "c", "b"))
+
+	result := listPage(t, transp, url.Values{})
+
+	var keys []string
+	for _, object := range result.Contents {
+		keys = append(keys, object.Key)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, keys)
+	assert.False(t, result.IsTruncated)
+	assert.Empty(t, result.NextMarker)
+	assert.Equal(t, "bucket", result.Name)
+}
+
+func TestListingMergePagesThroughTruncatedBackends(t *testing.T) {
+	var even, odd, all []string
+	for i := 0; i < 20; i++ {
+		key := "key" + strconv.Itoa(100+i)
+		all = append(all, key)
+		if i%2 == 0 || i%5 == 0 {
+			even = append(even, key)
+		}
+		if i%2 == 1 || i%5 == 0 {
+			odd = append(odd, key)
+		}
+	}
+	transp := mkListingTransport(mkListingBackend(even...), mkListingBackend(odd...), mkListingBackend("key105"))
+
+	for _, limit := range []int{1, 3, 7, 1000} {
+		assert.Equal(t, all, listAll(t, transp, url.Values{}, limit), "max-keys %d", limit)
+	}
+}
+
+func TestListingMergeRollsUpCommonPrefixesAcrossBackends(t *testing.T) {
+	transp := mkListingTransport(
+		mkListingBackend("a/1", "b", "c/2", "c/3", "photos/2017/x", "photos/z"),
+		mkListingBackend("a/2", "c/1", "d", "photos/2018/y"))
+
+	for _, limit := range []int{1, 2, 1000} {
+		delimited := listAll(t, transp, url.Values{"delimiter": {"/"}}, limit)
+		assert.Equal(t, []string{"a/", "b", "c/", "d", "photos/"}, delimited, "max-keys %d", limit)
+
+		prefixed := listAll(t, transp, url.Values{"delimiter": {"/"}, "prefix": {"photos/"}}, limit)
+		assert.Equal(t, []string{"photos/2017/", "photos/2018/", "photos/z"}, prefixed, "max-keys %d", limit)
+	}
+
+	result := listPage(t, transp, url.Values{"delimiter": {"/"}, "max-keys": {"3"}})
+	assert.Equal(t, []ListBucketPrefix{{"a/"}, {"c/"}}, result.CommonPrefixes)
+	assert.Equal(t, []string{"b"}, []string{result.Contents[0].Key})
+	assert.True(t, result.IsTruncated)
+	assert.Equal(t, "c/", result.NextMarker)
+}
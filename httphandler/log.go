@@ -1,11 +1,15 @@
 package httphandler
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"time"
 
+	"github.com/allegro/akubra/config"
 	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/transport"
 )
 
 // AccessMessageData holds all important informations
@@ -15,11 +19,74 @@ type AccessMessageData struct {
 	Host       string  `json:"host"`
 	Path       string  `json:"path"`
 	UserAgent  string  `json:"useragent"`
+	RemoteAddr string  `json:"remoteaddr"`
 	StatusCode int     `json:"status"`
 	Duration   float64 `json:"duration"`
 	RespErr    string  `json:"error"`
 	ReqID      string  `json:"reqID"`
 	Time       string  `json:"ts"`
+	// Bytes is response content length, -1 if unknown. With body byte
+	// counting it's number of response body bytes sent to client
+	Bytes int64 `json:"bytes"`
+	// RequestBytes is number of request body bytes read, counted only
+	// with body byte counting
+	RequestBytes int64 `json:"reqbytes"`
+	// ObjectBytes is object length of aws-chunked upload, its request body
+	// includes chunk signatures
+	ObjectBytes int64 `json:"objbytes,omitempty"`
+	// Routing decision details
+	Strategy   string `json:"strategy,omitempty"`
+	Retry      bool   `json:"retry"`
+	Hedge      bool   `json:"hedge"`
+	Canary     bool   `json:"canary"`
+	Candidates int    `json:"candidates"`
+	// Backends requests details, collected only if backend timings are enabled
+	Backends []BackendAccessData `json:"backends,omitempty"`
+}
+
+// BackendAccessData describes single backend request made for client request
+type BackendAccessData struct {
+	Host       string  `json:"host"`
+	StatusCode int     `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	Dial       float64 `json:"dial"`
+	TTFB       float64 `json:"ttfb"`
+}
+
+func newBackendAccessData(timings []transport.BackendTiming) []BackendAccessData {
+	backends := make([]BackendAccessData, 0, len(timings))
+	for _, timing := range timings {
+		backend := BackendAccessData{
+			Host:       timing.Host,
+			StatusCode: timing.StatusCode,
+			Dial:       timing.Dial.Seconds() * 1000,
+			TTFB:       timing.TTFB.Seconds() * 1000,
+		}
+		if timing.Err != nil {
+			backend.Error = timing.Err.Error()
+		}
+		backends = append(backends, backend)
+	}
+	return backends
+}
+
+// selectFields returns JSON of message limited to given fields
+func (amd AccessMessageData) selectFields(fields []string) ([]byte, error) {
+	all, err := json.Marshal(amd)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(all, &values); err != nil {
+		return nil, err
+	}
+	selected := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		if value, ok := values[field]; ok {
+			selected[field] = value
+		}
+	}
+	return json.Marshal(selected)
 }
 
 // String produces data in csv format with fields in following order:
@@ -35,13 +102,28 @@ func NewAccessLogMessage(req http.Request,
 	statusCode int, duration float64, respErr string) *AccessMessageData {
 	ts := time.Now().Format(time.RFC3339Nano)
 	reqID, _ := req.Context().Value(log.ContextreqIDKey).(string)
-	return &AccessMessageData{
-		req.Method,
-		req.Host,
-		req.URL.Path,
-		req.Header.Get("User-Agent"),
-		statusCode, duration * 1000, respErr,
-		reqID, ts}
+	amd := &AccessMessageData{
+		Method:     req.Method,
+		Host:       req.Host,
+		Path:       req.URL.Path,
+		UserAgent:  req.Header.Get("User-Agent"),
+		RemoteAddr: req.RemoteAddr,
+		StatusCode: statusCode,
+		Duration:   duration * 1000,
+		RespErr:    respErr,
+		ReqID:      reqID,
+		Time:       ts}
+	if objectBytes, ok := config.DecodedContentLength(req); ok {
+		amd.ObjectBytes = objectBytes
+	}
+	if decision := transport.RoutingDecisionFromContext(&req); decision != nil {
+		amd.Strategy = decision.Strategy
+		amd.Retry = decision.Retry
+		amd.Hedge = decision.Hedge
+		amd.Canary = decision.Canary
+		amd.Candidates = decision.Candidates
+	}
+	return amd
 }
 
 // ScanCSVAccessLogMessage will scan csv string and return AccessMessageData.
@@ -82,6 +164,29 @@ func (slmd SyncLogMessageData) String() string {
 		slmd.ErrorMsg)
 }
 
+// syncLoggedSubresources are object subresources replicated separately
+// from object data, they have to be kept in synclog path
+var syncLoggedSubresources = []string{"tagging"}
+
+// syncLogPath returns request path with subresource if request modifies
+// object subresource instead of object itself
+func syncLogPath(u *url.URL) string {
+	query := u.Query()
+	for _, subresource := range syncLoggedSubresources {
+		if _, ok := query[subresource]; ok {
+			return u.Path + "?" + subresource
+		}
+	}
+	return u.Path
+}
+
+// syncLogged tells whether replication failures of backend host are written
+// to sync log, backends missing in backendSyncLog are
+func syncLogged(backendSyncLog map[string]bool, host string) bool {
+	enabled, ok := backendSyncLog[host]
+	return !ok || enabled
+}
+
 // NewSyncLogMessageData creates new SyncLogMessageData
 func NewSyncLogMessageData(method, failedHost, path, successHost, userAgent,
 	reqID, errorMsg string, contentLength int64) *SyncLogMessageData {
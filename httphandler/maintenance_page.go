@@ -0,0 +1,61 @@
+package httphandler
+
+import (
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultMaintenancePageStatus     = http.StatusServiceUnavailable
+	defaultMaintenancePageRetryAfter = 60 * time.Second
+)
+
+// maintenancePage is served instead of error when all backends are maintained
+type maintenancePage struct {
+	body        []byte
+	contentType string
+	statusCode  int
+	retryAfter  time.Duration
+}
+
+func loadMaintenancePage(file string, statusCode int, retryAfter time.Duration) (*maintenancePage, error) {
+	if file == "" {
+		return nil, nil
+	}
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(file))
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	if statusCode == 0 {
+		statusCode = defaultMaintenancePageStatus
+	}
+	if retryAfter == 0 {
+		retryAfter = defaultMaintenancePageRetryAfter
+	}
+	return &maintenancePage{
+		body:        body,
+		contentType: contentType,
+		statusCode:  statusCode,
+		retryAfter:  retryAfter,
+	}, nil
+}
+
+func (mp *maintenancePage) write(w http.ResponseWriter, req *http.Request) {
+	seconds := strconv.FormatInt(int64(mp.retryAfter/time.Second), 10)
+	w.Header().Set("Content-Type", mp.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(mp.body)))
+	w.Header().Set("Cache-Control", "public, max-age="+seconds)
+	w.Header().Set("Retry-After", seconds)
+	w.WriteHeader(mp.statusCode)
+	if req.Method != http.MethodHead {
+		_, _ = w.Write(mp.body)
+	}
+}
@@ -0,0 +1,65 @@
+package httphandler
+
+import (
+	"bytes"
+	"net"
+	"strings"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// serverErrorHeaders follow status line of responses http.Server writes by
+// itself for requests it cannot parse. Responses written by handlers always
+// have Date header, so they never contain this sequence
+var serverErrorHeaders = []byte("\r\nContent-Type: text/plain; charset=utf-8\r\nConnection: close\r\n\r\n")
+
+// malformedRequestReason extracts reason from http.Server parse error
+// response, ok is false for any other write
+func malformedRequestReason(p []byte) (reason string, ok bool) {
+	if !bytes.HasPrefix(p, []byte("HTTP/1.1 ")) {
+		return "", false
+	}
+	end := bytes.Index(p, serverErrorHeaders)
+	if end < 0 || bytes.Contains(p[:end], []byte("\r\n")) {
+		return "", false
+	}
+	status := string(p[len("HTTP/1.1 "):end])
+	if body := string(p[end+len(serverErrorHeaders):]); body != "" && !strings.HasPrefix(status, body) {
+		return status + ": " + body, true
+	}
+	return status, true
+}
+
+// malformedRequestConn logs rejections of malformed requests, which never
+// reach handlers
+type malformedRequestConn struct {
+	net.Conn
+}
+
+func (mc *malformedRequestConn) Write(p []byte) (int, error) {
+	if reason, ok := malformedRequestReason(p); ok {
+		metrics.Mark("reqs.global.malformed_requests")
+		log.Printf("Rejected malformed request from %s: %s", mc.Conn.RemoteAddr(), reason)
+	}
+	return mc.Conn.Write(p)
+}
+
+type malformedRequestListener struct {
+	net.Listener
+}
+
+func (ml *malformedRequestListener) Accept() (net.Conn, error) {
+	conn, err := ml.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &malformedRequestConn{Conn: conn}, nil
+}
+
+// MalformedRequestListener wraps listener, requests rejected by http.Server
+// as malformed (invalid headers, unsupported transfer encoding, too large
+// headers) are logged with client address and counted
+func MalformedRequestListener(listener net.Listener) net.Listener {
+	return &malformedRequestListener{Listener: listener}
+}
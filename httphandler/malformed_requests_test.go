@@ -0,0 +1,85 @@
+package httphandler
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/allegro/akubra/log"
+	gometrics "github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func malformedRequestsCount() int64 {
+	if meter, ok := gometrics.Get("reqs.global.malformed_requests").(gometrics.Meter); ok {
+		return meter.Count()
+	}
+	return 0
+}
+
+func sendRaw(t *testing.T, addr, request string) *http.Response {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(request))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestMalformedRequestListenerLogsRejectedRequests(t *testing.T) {
+	logBuffer := &lockedBuffer{}
+	defaultLogger := log.DefaultLogger
+	log.DefaultLogger = &logrus.Logger{
+		Out:       logBuffer,
+		Formatter: log.PlainTextFormatter{},
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.DebugLevel,
+	}
+	defer func() { log.DefaultLogger = defaultLogger }()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+	})}
+	go func() { _ = srv.Serve(MalformedRequestListener(listener)) }()
+	defer srv.Close()
+	addr := listener.Addr().String()
+
+	for _, testData := range []struct {
+		name     string
+		request  string
+		status   int
+		reason   string
+		rejected bool
+	}{
+		{"handler response", "GET /bucket/key HTTP/1.1\r\nHost: akubra.internal\r\nConnection: close\r\n\r\n",
+			http.StatusBadRequest, "", false},
+		{"invalid header", "GET /bucket/key HTTP/1.1\r\nHost: akubra.internal\r\nBad Header\r\n\r\n",
+			http.StatusBadRequest, "400 Bad Request", true},
+		{"missing host", "GET /bucket/key HTTP/1.1\r\n\r\n",
+			http.StatusBadRequest, "400 Bad Request: missing required Host header", true},
+		{"unsupported transfer encoding", "PUT /bucket/key HTTP/1.1\r\nHost: akubra.internal\r\nTransfer-Encoding: foo\r\n\r\n",
+			http.StatusNotImplemented, "501 Not Implemented: Unsupported transfer encoding", true},
+	} {
+		before := malformedRequestsCount()
+		resp := sendRaw(t, addr, testData.request)
+		assert.Equal(t, testData.status, resp.StatusCode, testData.name)
+		logged := string(logBuffer.Bytes())
+		if !testData.rejected {
+			assert.Equal(t, before, malformedRequestsCount(), testData.name)
+			assert.NotContains(t, logged, "Rejected malformed request", testData.name)
+			continue
+		}
+		assert.Equal(t, before+1, malformedRequestsCount(), testData.name)
+		assert.Contains(t, logged, "Rejected malformed request from 127.0.0.1:", testData.name)
+		lines := strings.Split(strings.TrimSpace(logged), "\n")
+		assert.True(t, strings.HasSuffix(lines[len(lines)-1], testData.reason), "%s: %s", testData.name, logged)
+	}
+}
@@ -0,0 +1,280 @@
+package httphandler
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// maxFramingLine limits request head and chunk size line buffered while
+// checking framing, longer ones are passed to http.Server unchecked
+const maxFramingLine = http.DefaultMaxHeaderBytes + 4096
+
+type framingState int
+
+const (
+	framingHead framingState = iota
+	framingBody
+	framingChunkSize
+	framingChunkData
+	framingTrailer
+	// framingUnchecked passes rest of connection to http.Server, which
+	// rejects anything it cannot parse itself
+	framingUnchecked
+)
+
+var (
+	errConflictingContentLength = errors.New("conflicting Content-Length headers")
+	errContentLengthAndChunked  = errors.New("both Content-Length and Transfer-Encoding headers")
+	errUncheckedFraming         = errors.New("unchecked framing")
+)
+
+// requestFraming returns body length declared by raw request head, -1 for
+// chunked body. errUncheckedFraming is returned for heads http.Server has
+// to judge by itself
+func requestFraming(head []byte) (int64, error) {
+	var contentLengths, transferEncodings []string
+	lines := strings.Split(strings.TrimRight(string(head), "\r\n"), "\n")
+	for _, line := range lines[1:] {
+		line = strings.TrimSuffix(line, "\r")
+		colon := strings.IndexByte(line, ':')
+		if colon <= 0 || line[0] == ' ' || line[0] == '\t' {
+			return 0, errUncheckedFraming
+		}
+		name, value := line[:colon], strings.TrimSpace(line[colon+1:])
+		switch http.CanonicalHeaderKey(name) {
+		case "Content-Length":
+			for _, length := range strings.Split(value, ",") {
+				contentLengths = append(contentLengths, strings.TrimSpace(length))
+			}
+		case "Transfer-Encoding":
+			for _, coding := range strings.Split(value, ",") {
+				transferEncodings = append(transferEncodings, strings.ToLower(strings.TrimSpace(coding)))
+			}
+		}
+	}
+	for _, length := range contentLengths {
+		if length != contentLengths[0] {
+			return 0, errConflictingContentLength
+		}
+	}
+	if len(transferEncodings) > 0 {
+		if len(contentLengths) > 0 {
+			return 0, errContentLengthAndChunked
+		}
+		if len(transferEncodings) != 1 || transferEncodings[0] != "chunked" {
+			return 0, errUncheckedFraming
+		}
+		return -1, nil
+	}
+	if len(contentLengths) == 0 {
+		return 0, nil
+	}
+	length, err := strconv.ParseInt(contentLengths[0], 10, 64)
+	if err != nil || length < 0 {
+		return 0, errUncheckedFraming
+	}
+	return length, nil
+}
+
+// strictFramingConn follows request boundaries on connection and rejects
+// requests with ambiguous body length before http.Server parses them, as it
+// silently prefers Transfer-Encoding over Content-Length
+type strictFramingConn struct {
+	net.Conn
+	writeMx   sync.Mutex
+	state     framingState
+	remaining int64
+	in        []byte
+	out       []byte
+	// buf is reused by reads from connection, read data is copied to in
+	buf      []byte
+	rejected bool
+}
+
+func (fc *strictFramingConn) Write(p []byte) (int, error) {
+	fc.writeMx.Lock()
+	defer fc.writeMx.Unlock()
+	return fc.Conn.Write(p)
+}
+
+func (fc *strictFramingConn) Read(p []byte) (int, error) {
+	if len(fc.buf) < len(p) {
+		fc.buf = make([]byte, len(p))
+	}
+	buf := fc.buf[:len(p)]
+	for len(fc.out) == 0 {
+		if fc.rejected {
+			return 0, io.EOF
+		}
+		n, err := fc.Conn.Read(buf)
+		fc.in = append(fc.in, buf[:n]...)
+		fc.process()
+		if err == io.EOF {
+			// incomplete request is passed on, so http.Server sees what
+			// client sent before connection ended
+			fc.forward(len(fc.in))
+		}
+		if err != nil {
+			if len(fc.out) == 0 {
+				return 0, err
+			}
+			break
+		}
+	}
+	n := copy(p, fc.out)
+	fc.out = fc.out[n:]
+	return n, nil
+}
+
+func (fc *strictFramingConn) forward(n int) {
+	fc.out = append(fc.out, fc.in[:n]...)
+	fc.in = fc.in[n:]
+}
+
+func (fc *strictFramingConn) forwardBody(next framingState) bool {
+	if len(fc.in) == 0 {
+		return false
+	}
+	n := int64(len(fc.in))
+	if n > fc.remaining {
+		n = fc.remaining
+	}
+	fc.forward(int(n))
+	if fc.remaining -= n; fc.remaining == 0 {
+		fc.state = next
+	}
+	return true
+}
+
+// line returns end of line buffered in in, ok is false if more data is
+// needed
+func (fc *strictFramingConn) line() (end int, ok bool) {
+	end = bytes.IndexByte(fc.in, '\n')
+	if end < 0 && len(fc.in) > maxFramingLine {
+		fc.state = framingUnchecked
+		return end, true
+	}
+	return end, end >= 0
+}
+
+// process moves checked bytes from in to out
+func (fc *strictFramingConn) process() {
+	for {
+		switch fc.state {
+		case framingHead:
+			end := bytes.Index(fc.in, []byte("\r\n\r\n"))
+			if end < 0 {
+				if len(fc.in) > maxFramingLine {
+					fc.state = framingUnchecked
+					continue
+				}
+				return
+			}
+			head := fc.in[:end+4]
+			if bytes.HasPrefix(head, []byte("PRI * HTTP/2.0")) {
+				fc.state = framingUnchecked
+				continue
+			}
+			length, err := requestFraming(head)
+			if err == errUncheckedFraming {
+				fc.state = framingUnchecked
+				continue
+			}
+			if err != nil {
+				fc.reject(err)
+				return
+			}
+			fc.forward(len(head))
+			switch {
+			case length < 0:
+				fc.state = framingChunkSize
+			case length > 0:
+				fc.state, fc.remaining = framingBody, length
+			}
+		case framingBody:
+			if !fc.forwardBody(framingHead) {
+				return
+			}
+		case framingChunkSize:
+			end, ok := fc.line()
+			if !ok {
+				return
+			}
+			if end < 0 {
+				continue
+			}
+			sizeLine := strings.TrimSpace(strings.SplitN(string(fc.in[:end]), ";", 2)[0])
+			size, err := strconv.ParseInt(sizeLine, 16, 64)
+			if err != nil || size < 0 {
+				fc.state = framingUnchecked
+				continue
+			}
+			fc.forward(end + 1)
+			fc.state, fc.remaining = framingChunkData, size+2
+			if size == 0 {
+				fc.state = framingTrailer
+			}
+		case framingChunkData:
+			if !fc.forwardBody(framingChunkSize) {
+				return
+			}
+		case framingTrailer:
+			end, ok := fc.line()
+			if !ok {
+				return
+			}
+			if end < 0 {
+				continue
+			}
+			if len(bytes.TrimSpace(fc.in[:end])) == 0 {
+				fc.state = framingHead
+			}
+			fc.forward(end + 1)
+		case framingUnchecked:
+			fc.forward(len(fc.in))
+			return
+		}
+	}
+}
+
+// reject responds like http.Server to requests it cannot parse and ends
+// connection
+func (fc *strictFramingConn) reject(reason error) {
+	metrics.Mark("reqs.global.ambiguous_framing")
+	log.Printf("Rejected request with %s from %s", reason, fc.Conn.RemoteAddr())
+	fc.writeMx.Lock()
+	_, _ = io.WriteString(fc.Conn, "HTTP/1.1 400 Bad Request\r\nContent-Type: text/plain; charset=utf-8\r\n"+
+		"Connection: close\r\n\r\n400 Bad Request: "+reason.Error())
+	fc.writeMx.Unlock()
+	fc.in = nil
+	fc.rejected = true
+}
+
+type strictFramingListener struct {
+	net.Listener
+}
+
+func (fl *strictFramingListener) Accept() (net.Conn, error) {
+	conn, err := fl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &strictFramingConn{Conn: conn}, nil
+}
+
+// StrictFramingListener wraps listener, requests with conflicting
+// Content-Length headers or both Content-Length and Transfer-Encoding
+// (RFC 7230 3.3.3) are rejected with 400, logged with client address and
+// counted, and their connections closed
+func StrictFramingListener(listener net.Listener) net.Listener {
+	return &strictFramingListener{Listener: listener}
+}
@@ -0,0 +1,96 @@
+package httphandler
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/allegro/akubra/log"
+	gometrics "github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ambiguousFramingCount() int64 {
+	if meter, ok := gometrics.Get("reqs.global.ambiguous_framing").(gometrics.Meter); ok {
+		return meter.Count()
+	}
+	return 0
+}
+
+func mkStrictFramingServer(t *testing.T) (addr string, stop func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	})}
+	go func() { _ = srv.Serve(StrictFramingListener(listener)) }()
+	return listener.Addr().String(), func() { _ = srv.Close() }
+}
+
+func TestStrictFramingListenerRejectsAmbiguousRequests(t *testing.T) {
+	logBuffer := &lockedBuffer{}
+	defaultLogger := log.DefaultLogger
+	log.DefaultLogger = &logrus.Logger{
+		Out:       logBuffer,
+		Formatter: log.PlainTextFormatter{},
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.DebugLevel,
+	}
+	defer func() { log.DefaultLogger = defaultLogger }()
+	addr, stop := mkStrictFramingServer(t)
+	defer stop()
+
+	for _, testData := range []struct {
+		name    string
+		request string
+		reason  string
+	}{
+		{"conflicting content lengths",
+			"PUT /bucket/key HTTP/1.1\r\nHost: akubra.internal\r\nContent-Length: 4\r\nContent-Length: 5\r\n\r\ndata",
+			"conflicting Content-Length headers"},
+		{"conflicting content length list",
+			"PUT /bucket/key HTTP/1.1\r\nHost: akubra.internal\r\nContent-Length: 4, 5\r\n\r\ndata",
+			"conflicting Content-Length headers"},
+		{"content length and chunked",
+			"PUT /bucket/key HTTP/1.1\r\nHost: akubra.internal\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n4\r\ndata\r\n0\r\n\r\n",
+			"both Content-Length and Transfer-Encoding headers"},
+	} {
+		before := ambiguousFramingCount()
+		resp := sendRaw(t, addr, testData.request)
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, testData.name)
+		assert.Equal(t, "400 Bad Request: "+testData.reason, string(body), testData.name)
+		assert.Equal(t, before+1, ambiguousFramingCount(), testData.name)
+		assert.Contains(t, string(logBuffer.Bytes()), "Rejected request with "+testData.reason+" from 127.0.0.1:", testData.name)
+	}
+}
+
+func TestStrictFramingListenerPassesKeepAliveRequests(t *testing.T) {
+	addr, stop := mkStrictFramingServer(t)
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	// body of first request pretends to be request with ambiguous framing
+	smuggled := "PUT / HTTP/1.1\r\nHost: a\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\n"
+	_, err = conn.Write([]byte(
+		"PUT /bucket/key HTTP/1.1\r\nHost: akubra.internal\r\nContent-Length: 4\r\nContent-Length: 4\r\n\r\ndata" +
+			"PUT /bucket/key HTTP/1.1\r\nHost: akubra.internal\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"5;ext=1\r\nchunk\r\n" + "41\r\n" + smuggled + "\r\n0\r\nTrailer: value\r\n\r\n" +
+			"GET /bucket/key HTTP/1.1\r\nHost: akubra.internal\r\n\r\n"))
+	require.NoError(t, err)
+
+	reader := bufio.NewReader(conn)
+	for _, expected := range []string{"data", "chunk" + smuggled, ""} {
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, expected, string(body))
+	}
+}
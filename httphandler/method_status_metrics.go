@@ -0,0 +1,59 @@
+package httphandler
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/allegro/akubra/metrics"
+)
+
+// metricMethods are methods counted under their own name, others are
+// counted as "other" to keep number of metrics bounded
+var metricMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPut:     true,
+	http.MethodPost:    true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// statusClass returns class of status code, e.g. "2xx"
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "other"
+	}
+	return string(rune('0'+status/100)) + "xx"
+}
+
+type methodStatusMetrics struct {
+	roundTripper http.RoundTripper
+}
+
+func (msm *methodStatusMetrics) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := msm.roundTripper.RoundTrip(req)
+	method := "other"
+	if metricMethods[req.Method] {
+		method = strings.ToLower(req.Method)
+	}
+	class := "err"
+	if err == nil {
+		class = statusClass(resp.StatusCode)
+	}
+	metrics.Mark("reqs.backend." + metrics.Clean(req.URL.Host) + ".by_method." + method + "." + class)
+	return resp, err
+}
+
+// MethodStatusMetrics creates Decorator which counts backend responses by
+// request method and response status class in
+// reqs.backend.<host>.by_method.<method>.<class> meters, e.g.
+// reqs.backend.s3_local.by_method.get.2xx. Failed requests are counted with
+// "err" class
+func MethodStatusMetrics(enabled bool) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if !enabled {
+			return roundTripper
+		}
+		return &methodStatusMetrics{roundTripper: roundTripper}
+	}
+}
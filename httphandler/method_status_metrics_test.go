@@ -0,0 +1,60 @@
+package httphandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/allegro/akubra/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMethodStatusMetricsCountResponsesByMethodAndStatusClass(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(r.URL.Query().Get("status"))
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	backendURL, _ := url.Parse(srv.URL)
+	prefix := "reqs.backend." + metrics.Clean(backendURL.Host) + ".by_method."
+	rt := MethodStatusMetrics(true)(http.DefaultTransport)
+
+	for _, testData := range []struct {
+		method string
+		status int
+		metric string
+	}{
+		{http.MethodGet, http.StatusOK, "get.2xx"},
+		{http.MethodGet, http.StatusPartialContent, "get.2xx"},
+		{http.MethodHead, http.StatusNotFound, "head.4xx"},
+		{http.MethodPut, http.StatusServiceUnavailable, "put.5xx"},
+		{http.MethodDelete, http.StatusNoContent, "delete.2xx"},
+		{"PROPFIND", http.StatusMethodNotAllowed, "other.4xx"},
+	} {
+		before := meterCount(prefix + testData.metric)
+		req, _ := http.NewRequest(testData.method, srv.URL+"/bucket/key?status="+strconv.Itoa(testData.status), nil)
+
+		resp, err := rt.RoundTrip(req)
+
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		assert.Equal(t, before+1, meterCount(prefix+testData.metric), "%s %d", testData.method, testData.status)
+	}
+	assert.Equal(t, int64(2), meterCount(prefix+"get.2xx"))
+}
+
+func TestMethodStatusMetricsCountFailedRequests(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Close()
+	backendURL, _ := url.Parse(srv.URL)
+	rt := MethodStatusMetrics(true)(http.DefaultTransport)
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/bucket/key", nil)
+
+	_, err := rt.RoundTrip(req)
+
+	assert.Error(t, err)
+	assert.Equal(t, int64(1), meterCount("reqs.backend."+metrics.Clean(backendURL.Host)+".by_method.get.err"))
+}
@@ -0,0 +1,157 @@
+package httphandler
+
+import (
+	"context"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// TimeoutHeader sets timeout of request sent by trusted client, as duration
+// (e.g. "10m") or number of seconds
+const TimeoutHeader = "X-Akubra-Timeout"
+
+// AdminTokenHeader carries AdminToken of trusted client, it is not passed to
+// backends
+const AdminTokenHeader = "X-Akubra-Admin-Token"
+
+// TimeoutOverride lets trusted clients set their request timeout with
+// TimeoutHeader, up to Max. Clients connecting from TrustedNetworks or
+// sending AdminToken in AdminTokenHeader are trusted. Zero Max disables it
+type TimeoutOverride struct {
+	Max             time.Duration
+	TrustedNetworks []*net.IPNet
+	AdminToken      string
+}
+
+// ParseNetworks parses networks in CIDR notation
+func ParseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (to TimeoutOverride) trusted(req *http.Request, token string) bool {
+	if to.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(to.AdminToken)) == 1 {
+		return true
+	}
+	return fromNetworks(req.RemoteAddr, to.TrustedNetworks)
+}
+
+// fromNetworks tells if client address belongs to any of networks
+func fromNetworks(remoteAddr string, networks []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, network := range networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTimeout(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// timeout returns timeout requested by trusted client clamped to Max, false
+// if there is none. Header of untrusted client is ignored
+func (to TimeoutOverride) timeout(req *http.Request) (time.Duration, bool) {
+	token := req.Header.Get(AdminTokenHeader)
+	req.Header.Del(AdminTokenHeader)
+	value := req.Header.Get(TimeoutHeader)
+	if to.Max <= 0 || value == "" {
+		return 0, false
+	}
+	if !to.trusted(req, token) {
+		metrics.Mark("reqs.global.timeout_override.untrusted")
+		log.Debugf("Ignoring %s of untrusted client %s", TimeoutHeader, req.RemoteAddr)
+		return 0, false
+	}
+	timeout, err := parseTimeout(value)
+	if err != nil || timeout <= 0 {
+		log.Debugf("Ignoring invalid %s %q", TimeoutHeader, value)
+		return 0, false
+	}
+	if timeout > to.Max {
+		timeout = to.Max
+	}
+	metrics.Mark("reqs.global.timeout_override.applied")
+	return timeout, true
+}
+
+type methodTimeoutsHandler struct {
+	handler      http.Handler
+	registry     *ConnectionRegistry
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	override     TimeoutOverride
+}
+
+// timeout returns deadline duration of request method class, zero if server
+// timeouts apply
+func (mh *methodTimeoutsHandler) timeout(method string) time.Duration {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return mh.readTimeout
+	}
+	return mh.writeTimeout
+}
+
+func (mh *methodTimeoutsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	timeout := mh.timeout(req.Method)
+	if override, ok := mh.override.timeout(req); ok {
+		timeout = override
+	}
+	conn, ok := mh.registry.conn(req.RemoteAddr)
+	if timeout <= 0 || !ok {
+		mh.handler.ServeHTTP(w, req)
+		return
+	}
+	// server set ReadTimeout and WriteTimeout deadlines before calling handler
+	deadline := time.Now().Add(timeout)
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		log.Debugf("Cannot set read deadline for %s: %s", req.RemoteAddr, err)
+	}
+	if err := conn.SetWriteDeadline(deadline); err != nil {
+		log.Debugf("Cannot set write deadline for %s: %s", req.RemoteAddr, err)
+	}
+	ctx, cancel := context.WithDeadline(req.Context(), deadline)
+	defer cancel()
+	mh.handler.ServeHTTP(w, req.WithContext(ctx))
+}
+
+// MethodTimeouts wraps handler, whole request (reading it and writing
+// response) has to be served within readTimeout for GET, HEAD and OPTIONS
+// methods and within writeTimeout for other methods. They override
+// http.Server ReadTimeout and WriteTimeout, zero keeps server timeouts.
+// Trusted clients may set their own timeout as allowed by override
+func MethodTimeouts(handler http.Handler, registry *ConnectionRegistry, readTimeout, writeTimeout time.Duration, override TimeoutOverride) http.Handler {
+	if readTimeout <= 0 && writeTimeout <= 0 && override.Max <= 0 {
+		return handler
+	}
+	return &methodTimeoutsHandler{
+		handler:      handler,
+		registry:     registry,
+		readTimeout:  readTimeout,
+		writeTimeout: writeTimeout,
+		override:     override,
+	}
+}
@@ -0,0 +1,149 @@
+package httphandler
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMethodTimeoutsPicksTimeoutByMethodClass(t *testing.T) {
+	handler := MethodTimeouts(http.NotFoundHandler(), NewConnectionRegistry(), time.Second, time.Minute, TimeoutOverride{}).(*methodTimeoutsHandler)
+	for _, testData := range []struct {
+		method   string
+		expected time.Duration
+	}{
+		{http.MethodGet, time.Second},
+		{http.MethodHead, time.Second},
+		{http.MethodOptions, time.Second},
+		{http.MethodPut, time.Minute},
+		{http.MethodPost, time.Minute},
+		{http.MethodDelete, time.Minute},
+	} {
+		assert.Equal(t, testData.expected, handler.timeout(testData.method), testData.method)
+	}
+}
+
+func mkMethodTimeoutsServer(handler http.Handler, readTimeout, writeTimeout time.Duration, override ...TimeoutOverride) *httptest.Server {
+	registry := NewConnectionRegistry()
+	timeoutOverride := TimeoutOverride{}
+	if len(override) > 0 {
+		timeoutOverride = override[0]
+	}
+	srv := httptest.NewUnstartedServer(MethodTimeouts(handler, registry, readTimeout, writeTimeout, timeoutOverride))
+	srv.Config.ConnState = registry.ConnState
+	// server timeouts would abort slow upload
+	srv.Config.ReadTimeout = 100 * time.Millisecond
+	srv.Config.WriteTimeout = 100 * time.Millisecond
+	srv.Start()
+	return srv
+}
+
+func TestMethodTimeoutsLetSlowUploadOutliveServerReadTimeout(t *testing.T) {
+	srv := mkMethodTimeoutsServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		_, err = w.Write(body)
+		assert.NoError(t, err)
+	}), 100*time.Millisecond, 5*time.Second)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "PUT /bucket/key HTTP/1.1\r\nHost: localhost\r\nContent-Length: 6\r\n\r\n")
+	require.NoError(t, err)
+	for _, chunk := range []string{"ab", "cd", "ef"} {
+		time.Sleep(80 * time.Millisecond)
+		_, err = conn.Write([]byte(chunk))
+		require.NoError(t, err)
+	}
+
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "abcdef", string(body))
+}
+
+func TestMethodTimeoutsCutHungRead(t *testing.T) {
+	cancelled := make(chan bool, 1)
+	srv := mkMethodTimeoutsServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cancelled <- true
+		case <-time.After(time.Second):
+			cancelled <- false
+		}
+	}), 100*time.Millisecond, 5*time.Second)
+	defer srv.Close()
+
+	started := time.Now()
+	resp, err := http.Get(srv.URL + "/bucket/key")
+	if err == nil {
+		_, err = ioutil.ReadAll(resp.Body)
+		assert.NoError(t, resp.Body.Close())
+	}
+	assert.Error(t, err, "response should not be written after read timeout")
+	assert.True(t, <-cancelled, "handler context should be cancelled")
+	assert.True(t, time.Since(started) < time.Second)
+}
+
+func TestTimeoutOverrideIsHonoredOnlyForTrustedClients(t *testing.T) {
+	loopback, err := ParseNetworks([]string{"127.0.0.0/8"})
+	require.NoError(t, err)
+	other, err := ParseNetworks([]string{"10.0.0.0/8", "192.168.0.0/16"})
+	require.NoError(t, err)
+	tokenHeaders := make(chan string, 10)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenHeaders <- r.Header.Get(AdminTokenHeader)
+		deadline, _ := r.Context().Deadline()
+		_, _ = w.Write([]byte(time.Until(deadline).String()))
+	})
+
+	for _, testData := range []struct {
+		name     string
+		override TimeoutOverride
+		headers  map[string]string
+		expected time.Duration
+	}{
+		{"trusted network", TimeoutOverride{Max: time.Hour, TrustedNetworks: loopback},
+			map[string]string{TimeoutHeader: "30m"}, 30 * time.Minute},
+		{"seconds clamped to max", TimeoutOverride{Max: time.Minute, TrustedNetworks: loopback},
+			map[string]string{TimeoutHeader: "3600"}, time.Minute},
+		{"admin token", TimeoutOverride{Max: time.Hour, TrustedNetworks: other, AdminToken: "secret"},
+			map[string]string{TimeoutHeader: "30m", AdminTokenHeader: "secret"}, 30 * time.Minute},
+		{"untrusted network", TimeoutOverride{Max: time.Hour, TrustedNetworks: other, AdminToken: "secret"},
+			map[string]string{TimeoutHeader: "30m", AdminTokenHeader: "guess"}, 10 * time.Second},
+		{"invalid timeout", TimeoutOverride{Max: time.Hour, TrustedNetworks: loopback},
+			map[string]string{TimeoutHeader: "soon"}, 10 * time.Second},
+		{"override disabled", TimeoutOverride{TrustedNetworks: loopback},
+			map[string]string{TimeoutHeader: "30m"}, 10 * time.Second},
+	} {
+		srv := mkMethodTimeoutsServer(handler, 10*time.Second, time.Minute, testData.override)
+		req, _ := http.NewRequest("GET", srv.URL+"/bucket/key", nil)
+		for name, value := range testData.headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err, testData.name)
+		body, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		srv.Close()
+
+		remaining, err := time.ParseDuration(string(body))
+		require.NoError(t, err, testData.name)
+		assert.True(t, remaining <= testData.expected && remaining > testData.expected-5*time.Second,
+			"%s: expected %s timeout, got %s", testData.name, testData.expected, remaining)
+		assert.Empty(t, <-tokenHeaders, "admin token should not be forwarded")
+	}
+}
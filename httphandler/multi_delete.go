@@ -0,0 +1,275 @@
+package httphandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+	"github.com/allegro/akubra/transport"
+	set "github.com/deckarep/golang-set"
+)
+
+// MultiDeleteRequest is S3 multi-object delete (POST /bucket?delete) request body
+type MultiDeleteRequest struct {
+	XMLName xml.Name            `xml:"Delete"`
+	Quiet   bool                `xml:"Quiet"`
+	Objects []MultiDeleteObject `xml:"Object"`
+}
+
+// MultiDeleteObject is single key of MultiDeleteRequest
+type MultiDeleteObject struct {
+	Key       string `xml:"Key"`
+	VersionID string `xml:"VersionId,omitempty"`
+}
+
+// MultiDeleteError describes key which could not be deleted
+type MultiDeleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// MultiDeleteResult is S3 multi-object delete response body
+type MultiDeleteResult struct {
+	XMLName xml.Name            `xml:"DeleteResult"`
+	Deleted []MultiDeleteObject `xml:"Deleted"`
+	Errors  []MultiDeleteError  `xml:"Error"`
+}
+
+func isMultiDelete(req *http.Request) bool {
+	_, ok := req.URL.Query()["delete"]
+	return req.Method == http.MethodPost && ok
+}
+
+type keyOutcome struct {
+	deletedOn []string
+	failures  []MultiDeleteError
+	failedOn  []string
+}
+
+type multiDeleteMerger struct {
+	syncerrlog      log.Logger
+	methodSetFilter set.Set
+	backendSyncLog  map[string]bool
+	quorum          int
+}
+
+func readMultiDeleteRequest(req *http.Request) (MultiDeleteRequest, error) {
+	deleteReq := MultiDeleteRequest{}
+	if req.GetBody == nil {
+		return deleteReq, fmt.Errorf("request body cannot be read again")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return deleteReq, err
+	}
+	defer body.Close()
+	err = xml.NewDecoder(body).Decode(&deleteReq)
+	return deleteReq, err
+}
+
+func discardResponseBody(res *http.Response) {
+	if res == nil || res.Body == nil {
+		return
+	}
+	if _, err := io.Copy(ioutil.Discard, res.Body); err != nil {
+		log.Printf("Could not discard body %s", err)
+	}
+	if err := res.Body.Close(); err != nil {
+		log.Printf("Could not close body %s", err)
+	}
+}
+
+// backendFailure reads error reported by failed backend for all keys
+func backendFailure(r transport.ReqResErrTuple) (code, message string) {
+	if r.Err != nil {
+		return "InternalError", r.Err.Error()
+	}
+	s3Error := S3Error{}
+	if r.Res != nil && r.Res.Body != nil {
+		if err := xml.NewDecoder(r.Res.Body).Decode(&s3Error); err == nil && s3Error.Code != "" {
+			return s3Error.Code, s3Error.Message
+		}
+	}
+	return "InternalError", fmt.Sprintf("Backend responded with status %d", r.Res.StatusCode)
+}
+
+func (mdm *multiDeleteMerger) collectOutcomes(deleteReq MultiDeleteRequest, tups []transport.ReqResErrTuple) map[string]*keyOutcome {
+	outcomes := make(map[string]*keyOutcome, len(deleteReq.Objects))
+	for _, object := range deleteReq.Objects {
+		outcomes[object.Key] = &keyOutcome{}
+	}
+	for _, r := range tups {
+		host := r.Req.URL.Host
+		if r.Failed {
+			code, message := backendFailure(r)
+			for key, outcome := range outcomes {
+				outcome.failures = append(outcome.failures, MultiDeleteError{key, code, message})
+				outcome.failedOn = append(outcome.failedOn, host)
+			}
+			continue
+		}
+		result := MultiDeleteResult{}
+		if err := xml.NewDecoder(r.Res.Body).Decode(&result); err != nil {
+			for key, outcome := range outcomes {
+				outcome.failures = append(outcome.failures, MultiDeleteError{key, "InternalError", err.Error()})
+				outcome.failedOn = append(outcome.failedOn, host)
+			}
+			continue
+		}
+		failedKeys := make(map[string]MultiDeleteError, len(result.Errors))
+		for _, keyError := range result.Errors {
+			failedKeys[keyError.Key] = keyError
+		}
+		// in quiet mode backends report only failed keys
+		for key, outcome := range outcomes {
+			if keyError, failed := failedKeys[key]; failed {
+				outcome.failures = append(outcome.failures, keyError)
+				outcome.failedOn = append(outcome.failedOn, host)
+				continue
+			}
+			outcome.deletedOn = append(outcome.deletedOn, host)
+		}
+	}
+	return outcomes
+}
+
+func (mdm *multiDeleteMerger) synclog(req *http.Request, key string, outcome *keyOutcome) {
+	if mdm.methodSetFilter == nil || !mdm.methodSetFilter.Contains(http.MethodDelete) {
+		return
+	}
+	if len(outcome.deletedOn) == 0 {
+		return
+	}
+	reqID, _ := req.Context().Value(log.ContextreqIDKey).(string)
+	path := "/" + strings.Trim(req.URL.Path, "/") + "/" + key
+	for i, failedHost := range outcome.failedOn {
+		if !syncLogged(mdm.backendSyncLog, failedHost) {
+			continue
+		}
+		syncLogMsg := NewSyncLogMessageData(
+			http.MethodDelete,
+			failedHost,
+			path,
+			outcome.deletedOn[0],
+			req.Header.Get("User-Agent"),
+			reqID,
+			outcome.failures[i].Code,
+			0)
+		metrics.Mark(fmt.Sprintf("reqs.inconsistencies.%s.method-%s", metrics.Clean(failedHost), http.MethodDelete))
+		logMsg, err := json.Marshal(syncLogMsg)
+		if err != nil {
+			continue
+		}
+		mdm.syncerrlog.Println(string(logMsg))
+	}
+}
+
+// merge reports key as deleted if it was deleted on at least quorum backends
+func (mdm *multiDeleteMerger) merge(tups []transport.ReqResErrTuple) transport.ReqResErrTuple {
+	var successful *transport.ReqResErrTuple
+	for i := range tups {
+		if !tups[i].Failed {
+			successful = &tups[i]
+			break
+		}
+	}
+	if successful == nil {
+		for _, r := range tups[1:] {
+			discardResponseBody(r.Res)
+		}
+		return tups[0]
+	}
+	deleteReq, err := readMultiDeleteRequest(successful.Req)
+	if err != nil {
+		log.Printf("Cannot parse multi-object delete request, passing backend response as is: %s", err)
+		for _, r := range tups {
+			if r.Res != successful.Res {
+				discardResponseBody(r.Res)
+			}
+		}
+		return *successful
+	}
+
+	outcomes := mdm.collectOutcomes(deleteReq, tups)
+	quorum := mdm.quorum
+	if quorum < 1 {
+		quorum = 1
+	}
+	result := MultiDeleteResult{}
+	for _, object := range deleteReq.Objects {
+		outcome := outcomes[object.Key]
+		mdm.synclog(successful.Req, object.Key, outcome)
+		if len(outcome.deletedOn) >= quorum {
+			if !deleteReq.Quiet {
+				result.Deleted = append(result.Deleted, object)
+			}
+			continue
+		}
+		keyError := outcome.failures[0]
+		keyError.Key = object.Key
+		result.Errors = append(result.Errors, keyError)
+	}
+	for _, r := range tups {
+		discardResponseBody(r.Res)
+	}
+
+	body, err := xml.Marshal(result)
+	if err != nil {
+		return transport.ReqResErrTuple{Req: successful.Req, Err: err, Failed: true}
+	}
+	body = append([]byte(xml.Header), body...)
+	res := successful.Res
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	res.Header.Set("Content-Type", "application/xml")
+	return *successful
+}
+
+// replayResponses hands already received first response (if channel was not
+// closed) along with remaining ones to next handler
+func replayResponses(first transport.ReqResErrTuple, ok bool, in <-chan transport.ReqResErrTuple, next transport.MultipleResponsesHandler) transport.ReqResErrTuple {
+	replayed := make(chan transport.ReqResErrTuple, 1)
+	go func() {
+		if ok {
+			replayed <- first
+		}
+		for r := range in {
+			replayed <- r
+		}
+		close(replayed)
+	}()
+	return next(replayed)
+}
+
+// MultiDeleteResponseHandler merges multi-object delete results of all
+// backends, other requests are handled by next handler
+func MultiDeleteResponseHandler(conf config.Config, next transport.MultipleResponsesHandler) transport.MultipleResponsesHandler {
+	mdm := &multiDeleteMerger{
+		syncerrlog:      conf.Synclog,
+		methodSetFilter: conf.SyncLogMethodsSet,
+		backendSyncLog:  conf.BackendSyncLog,
+		quorum:          conf.WriteQuorum,
+	}
+	return func(in <-chan transport.ReqResErrTuple) transport.ReqResErrTuple {
+		first, ok := <-in
+		if !ok || !isMultiDelete(first.Req) {
+			return replayResponses(first, ok, in, next)
+		}
+		tups := []transport.ReqResErrTuple{first}
+		for r := range in {
+			tups = append(tups, r)
+		}
+		return mdm.merge(tups)
+	}
+}
@@ -0,0 +1,103 @@
+package httphandler
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/transport"
+	set "github.com/deckarep/golang-set"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func mkMultiDeleteBackend(failedKeys ...string) url.URL {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deleteReq := MultiDeleteRequest{}
+		_ = xml.NewDecoder(r.Body).Decode(&deleteReq)
+		result := MultiDeleteResult{}
+		for _, object := range deleteReq.Objects {
+			failed := false
+			for _, key := range failedKeys {
+				failed = failed || key == object.Key
+			}
+			if failed {
+				result.Errors = append(result.Errors, MultiDeleteError{object.Key, "AccessDenied", "Access Denied"})
+			} else if !deleteReq.Quiet {
+				result.Deleted = append(result.Deleted, object)
+			}
+		}
+		body, _ := xml.Marshal(result)
+		_, _ = w.Write(body)
+	}))
+	backendURL, _ := url.Parse(srv.URL)
+	return *backendURL
+}
+
+func mkFailingBackend() url.URL {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error", r.URL.Path, "")
+	}))
+	backendURL, _ := url.Parse(srv.URL)
+	return *backendURL
+}
+
+func multiDelete(t *testing.T, backends []url.URL, quorum int, quiet bool) (MultiDeleteResult, string) {
+	var synclog bytes.Buffer
+	conf := config.Config{
+		YamlConfig: config.YamlConfig{WriteQuorum: quorum},
+		Synclog: &logrus.Logger{
+			Out:       &synclog,
+			Formatter: log.PlainTextFormatter{},
+			Hooks:     make(logrus.LevelHooks),
+			Level:     logrus.DebugLevel,
+		},
+		SyncLogMethodsSet: set.NewSetFromSlice([]interface{}{"DELETE"}),
+	}
+	handler := MultiDeleteResponseHandler(conf, LateResponseHandler(conf))
+	transp := transport.NewMultiTransport(http.DefaultTransport, backends, handler, transport.MultiTransportOptions{})
+
+	body := fmt.Sprintf(`<Delete><Quiet>%t</Quiet><Object><Key>a</Key></Object><Object><Key>b</Key></Object></Delete>`, quiet)
+	req, _ := http.NewRequest("POST", "http://localhost/bucket?delete", strings.NewReader(body))
+	resp, err := transp.RoundTrip(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	result := MultiDeleteResult{}
+	assert.NoError(t, xml.Unmarshal(respBody, &result))
+	return result, synclog.String()
+}
+
+func TestMultiDeleteReportsKeysDeletedOnQuorum(t *testing.T) {
+	healthy := mkMultiDeleteBackend()
+	partial := mkMultiDeleteBackend("b")
+	failing := mkFailingBackend()
+
+	result, synclog := multiDelete(t, []url.URL{healthy, partial, failing}, 2, false)
+
+	assert.Equal(t, []MultiDeleteObject{{Key: "a"}}, result.Deleted)
+	assert.Len(t, result.Errors, 1)
+	assert.Equal(t, "b", result.Errors[0].Key)
+	// a failed on one backend, b on two
+	assert.Equal(t, 3, strings.Count(synclog, `"method":"DELETE"`))
+	assert.Contains(t, synclog, "/bucket/a")
+	assert.Contains(t, synclog, "/bucket/b")
+	assert.Contains(t, synclog, failing.Host)
+}
+
+func TestMultiDeleteInQuietModeReportsOnlyErrors(t *testing.T) {
+	result, _ := multiDelete(t, []url.URL{mkMultiDeleteBackend(), mkMultiDeleteBackend("b")}, 2, true)
+
+	assert.Empty(t, result.Deleted)
+	assert.Len(t, result.Errors, 1)
+	assert.Equal(t, "b", result.Errors[0].Key)
+	assert.Equal(t, "AccessDenied", result.Errors[0].Code)
+}
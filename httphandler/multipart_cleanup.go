@@ -0,0 +1,117 @@
+package httphandler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+	"github.com/allegro/akubra/transport"
+)
+
+// OrphanedPartsAborter aborts multipart uploads on backends which failed to
+// complete them while other backends succeeded, so parts uploaded to them
+// don't waste space
+type OrphanedPartsAborter struct {
+	roundTripper http.RoundTripper
+	syncLog      log.Logger
+}
+
+// NewOrphanedPartsAborter creates OrphanedPartsAborter sending requests with
+// given backend roundTripper
+func NewOrphanedPartsAborter(roundTripper http.RoundTripper, syncLog log.Logger) *OrphanedPartsAborter {
+	return &OrphanedPartsAborter{roundTripper: roundTripper, syncLog: syncLog}
+}
+
+// isCompleteMultipartUpload tells if request completes multipart upload
+func isCompleteMultipartUpload(req *http.Request) bool {
+	return req.Method == http.MethodPost && req.URL.Query().Get("uploadId") != ""
+}
+
+// WriteDone implements transport.WriteHealer
+func (opa *OrphanedPartsAborter) WriteDone(outcomes []transport.WriteOutcome) {
+	if len(outcomes) == 0 || !isCompleteMultipartUpload(outcomes[0].Request) {
+		return
+	}
+	var source *http.Request
+	for _, outcome := range outcomes {
+		if !outcome.Failed {
+			source = outcome.Request
+			break
+		}
+	}
+	// upload is not completed anywhere, client may still retry it
+	if source == nil {
+		return
+	}
+	for _, outcome := range outcomes {
+		if outcome.Failed {
+			opa.abort(outcome.Request, source)
+		}
+	}
+}
+
+func (opa *OrphanedPartsAborter) abort(target, source *http.Request) {
+	host := target.URL.Host
+	err := opa.sendAbort(target)
+	opa.synclog(target, source, err)
+	if err != nil {
+		metrics.Mark("reqs.backend." + metrics.Clean(host) + ".multipart_abort_errors")
+		log.Printf("Cannot abort multipart upload of %s on %s: %s", target.URL.Path, host, err)
+		return
+	}
+	metrics.Mark("reqs.backend." + metrics.Clean(host) + ".multipart_aborted")
+}
+
+// sendAbort sends AbortMultipartUpload of completed upload, upload already
+// gone (404 NoSuchUpload) is not an error
+func (opa *OrphanedPartsAborter) sendAbort(target *http.Request) error {
+	u := *target.URL
+	u.RawQuery = url.Values{"uploadId": {target.URL.Query().Get("uploadId")}}.Encode()
+	req, err := http.NewRequest(http.MethodDelete, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Host = target.Host
+	if userAgent := target.Header.Get("User-Agent"); userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	ctx := context.WithValue(context.Background(), log.ContextreqIDKey, target.Context().Value(log.ContextreqIDKey))
+	resp, err := opa.roundTripper.RoundTrip(req.WithContext(transport.WithLowPriority(ctx)))
+	if err != nil {
+		return err
+	}
+	defer discardResponseBody(resp)
+	if resp.StatusCode >= http.StatusMultipleChoices && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("backend responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (opa *OrphanedPartsAborter) synclog(target, source *http.Request, err error) {
+	if opa.syncLog == nil {
+		return
+	}
+	errorMsg := "Aborted orphaned multipart upload"
+	if err != nil {
+		errorMsg = fmt.Sprintf("Aborting orphaned multipart upload failed: %s", err)
+	}
+	reqID, _ := target.Context().Value(log.ContextreqIDKey).(string)
+	syncLogMsg := NewSyncLogMessageData(
+		http.MethodDelete,
+		target.URL.Host,
+		target.URL.Path,
+		source.URL.Host,
+		target.Header.Get("User-Agent"),
+		reqID,
+		errorMsg,
+		-1)
+	logMsg, marshalErr := json.Marshal(syncLogMsg)
+	if marshalErr != nil {
+		return
+	}
+	opa.syncLog.Println(string(logMsg))
+}
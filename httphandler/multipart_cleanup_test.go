@@ -0,0 +1,112 @@
+package httphandler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/transport"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// multipartBackend initiates multipart uploads with consecutive upload IDs,
+// completes them with given status and records abort requests
+type multipartBackend struct {
+	*httptest.Server
+	mx        sync.Mutex
+	initiated int
+	aborts    []string
+}
+
+func mkMultipartBackend(completeStatus int) *multipartBackend {
+	backend := &multipartBackend{}
+	backend.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isInitiateMultipartUpload(r) {
+			backend.mx.Lock()
+			backend.initiated++
+			uploadID := fmt.Sprintf("upload-%d", backend.initiated)
+			backend.mx.Unlock()
+			_, _ = fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadID)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			backend.mx.Lock()
+			backend.aborts = append(backend.aborts, r.URL.RequestURI())
+			backend.mx.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(completeStatus)
+	}))
+	return backend
+}
+
+func (backend *multipartBackend) recordedAborts() []string {
+	backend.mx.Lock()
+	defer backend.mx.Unlock()
+	return append([]string{}, backend.aborts...)
+}
+
+func TestOrphanedPartsAreAbortedOnBackendsFailingToCompleteUpload(t *testing.T) {
+	completed, other := mkMultipartBackend(http.StatusOK), mkMultipartBackend(http.StatusOK)
+	failed := mkMultipartBackend(http.StatusInternalServerError)
+	defer completed.Close()
+	defer other.Close()
+	defer failed.Close()
+	synclog := &lockedBuffer{}
+	logger := &logrus.Logger{
+		Out:       synclog,
+		Formatter: log.PlainTextFormatter{},
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.DebugLevel,
+	}
+	urls := make([]url.URL, 0, 3)
+	for _, backend := range []*multipartBackend{completed, other, failed} {
+		backendURL, _ := url.Parse(backend.URL)
+		urls = append(urls, *backendURL)
+	}
+	transp := transport.NewMultiTransport(http.DefaultTransport, urls, nil, transport.MultiTransportOptions{
+		WriteHealer: NewOrphanedPartsAborter(http.DefaultTransport, logger),
+		WriteQuorum: 2,
+	})
+
+	req, _ := http.NewRequest(http.MethodPost, "http://akubra.internal/bucket/key?uploadId=abc",
+		strings.NewReader("<CompleteMultipartUpload/>"))
+	resp, err := transp.RoundTrip(req)
+	require.NoError(t, err)
+	discardResponseBody(resp)
+
+	waitFor(t, func() bool { return len(failed.recordedAborts()) == 1 }, "upload should be aborted on failed backend")
+	assert.Equal(t, []string{"/bucket/key?uploadId=abc"}, failed.recordedAborts())
+	assert.Empty(t, completed.recordedAborts())
+	assert.Empty(t, other.recordedAborts())
+	waitFor(t, func() bool { return len(synclog.Bytes()) > 0 }, "abort should be written to synclog")
+	assert.Contains(t, string(synclog.Bytes()), "Aborted orphaned multipart upload")
+	assert.Contains(t, string(synclog.Bytes()), `"failedhost":"`+failed.Listener.Addr().String()+`"`)
+}
+
+func TestOrphanedPartsAborterIgnoresOtherWrites(t *testing.T) {
+	backend := mkMultipartBackend(http.StatusOK)
+	defer backend.Close()
+	aborter := NewOrphanedPartsAborter(http.DefaultTransport, nil)
+	req := func(method, query string) *http.Request {
+		r, _ := http.NewRequest(method, backend.URL+"/bucket/key"+query, nil)
+		return r
+	}
+
+	// upload completed nowhere
+	aborter.WriteDone([]transport.WriteOutcome{{Request: req(http.MethodPost, "?uploadId=abc"), Failed: true}})
+	// plain object write
+	aborter.WriteDone([]transport.WriteOutcome{{Request: req(http.MethodPut, ""), Failed: true}, {Request: req(http.MethodPut, "")}})
+	// multipart upload initiation
+	aborter.WriteDone([]transport.WriteOutcome{{Request: req(http.MethodPost, "?uploads"), Failed: true}, {Request: req(http.MethodPost, "?uploads")}})
+
+	assert.Empty(t, backend.recordedAborts())
+}
@@ -0,0 +1,243 @@
+package httphandler
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+	"github.com/allegro/akubra/transport"
+)
+
+// initiateResultMaxSize limits InitiateMultipartUpload response body read
+// for upload ID, bigger responses are passed on untracked
+const initiateResultMaxSize = 64 * 1024
+
+// uploadTarget is object upload was initiated for on backend
+type uploadTarget struct {
+	url       url.URL
+	host      string
+	userAgent string
+}
+
+// trackedUpload is multipart upload in progress and backends it was
+// initiated on
+type trackedUpload struct {
+	uploadID string
+	// targets maps backend host to object upload was initiated for
+	targets  map[string]uploadTarget
+	lastSeen time.Time
+	element  *list.Element
+}
+
+type multipartTracker struct {
+	maxUploads   int
+	ttl          time.Duration
+	abortEvicted bool
+	now          func() time.Time
+	roundTripper http.RoundTripper
+	mx           sync.Mutex
+	// lru keeps uploads from most to least recently used
+	lru     *list.List
+	uploads map[string]*trackedUpload
+}
+
+func isInitiateMultipartUpload(req *http.Request) bool {
+	_, ok := req.URL.Query()["uploads"]
+	return ok && req.Method == http.MethodPost
+}
+
+func (mt *multipartTracker) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isInitiateMultipartUpload(req) {
+		return mt.initiate(req)
+	}
+	uploadID := req.URL.Query().Get("uploadId")
+	if uploadID == "" {
+		return mt.roundTripper.RoundTrip(req)
+	}
+	resp, err := mt.roundTripper.RoundTrip(req)
+	finishing := isCompleteMultipartUpload(req) || req.Method == http.MethodDelete
+	if finishing && err == nil && (resp.StatusCode < http.StatusMultipleChoices || resp.StatusCode == http.StatusNotFound) {
+		mt.forget(uploadID, req.URL.Host)
+		return resp, err
+	}
+	mt.touch(uploadID)
+	return resp, err
+}
+
+// initiate sends InitiateMultipartUpload and tracks upload ID of successful
+// response
+func (mt *multipartTracker) initiate(req *http.Request) (*http.Response, error) {
+	resp, err := mt.roundTripper.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK || resp.ContentLength > initiateResultMaxSize {
+		return resp, err
+	}
+	body, readErr := ioutil.ReadAll(io.LimitReader(resp.Body, initiateResultMaxSize+1))
+	if closeErr := resp.Body.Close(); closeErr != nil {
+		log.Debugf("Cannot close response body %s", closeErr)
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	initiated := initiateMultipartUploadResult{}
+	if len(body) > initiateResultMaxSize || xml.Unmarshal(body, &initiated) != nil || initiated.UploadID == "" {
+		return resp, nil
+	}
+	u := *req.URL
+	u.RawQuery = ""
+	mt.track(initiated.UploadID, uploadTarget{url: u, host: req.Host, userAgent: req.Header.Get("User-Agent")})
+	return resp, nil
+}
+
+func (mt *multipartTracker) track(uploadID string, target uploadTarget) {
+	mt.mx.Lock()
+	upload, ok := mt.uploads[uploadID]
+	if !ok {
+		upload = &trackedUpload{uploadID: uploadID, targets: make(map[string]uploadTarget)}
+		upload.element = mt.lru.PushFront(upload)
+		mt.uploads[uploadID] = upload
+	}
+	upload.targets[target.url.Host] = target
+	upload.lastSeen = mt.now()
+	mt.lru.MoveToFront(upload.element)
+	evicted := mt.evict()
+	mt.mx.Unlock()
+	mt.evicted(evicted)
+}
+
+func (mt *multipartTracker) touch(uploadID string) {
+	mt.mx.Lock()
+	if upload, ok := mt.uploads[uploadID]; ok {
+		upload.lastSeen = mt.now()
+		mt.lru.MoveToFront(upload.element)
+	}
+	evicted := mt.evict()
+	mt.mx.Unlock()
+	mt.evicted(evicted)
+}
+
+// forget stops tracking upload on backend which completed or aborted it
+func (mt *multipartTracker) forget(uploadID, host string) {
+	mt.mx.Lock()
+	if upload, ok := mt.uploads[uploadID]; ok {
+		delete(upload.targets, host)
+		if len(upload.targets) == 0 {
+			mt.remove(upload)
+		}
+	}
+	evicted := mt.evict()
+	mt.mx.Unlock()
+	mt.evicted(evicted)
+}
+
+func (mt *multipartTracker) remove(upload *trackedUpload) {
+	delete(mt.uploads, upload.uploadID)
+	mt.lru.Remove(upload.element)
+}
+
+// evict removes uploads above maxUploads and ones not seen for ttl, it has
+// to be called with mx held
+func (mt *multipartTracker) evict() []*trackedUpload {
+	var evicted []*trackedUpload
+	expiry := mt.now().Add(-mt.ttl)
+	for back := mt.lru.Back(); back != nil; back = mt.lru.Back() {
+		upload := back.Value.(*trackedUpload)
+		if mt.lru.Len() <= mt.maxUploads && !upload.lastSeen.Before(expiry) {
+			break
+		}
+		mt.remove(upload)
+		evicted = append(evicted, upload)
+	}
+	metrics.UpdateGauge("reqs.global.multipart.tracked", int64(mt.lru.Len()))
+	return evicted
+}
+
+func (mt *multipartTracker) evicted(uploads []*trackedUpload) {
+	for _, upload := range uploads {
+		metrics.Mark("reqs.global.multipart.evicted")
+		log.Debugf("Evicted multipart upload %s last seen at %s", upload.uploadID, upload.lastSeen)
+		if mt.abortEvicted {
+			go mt.abort(upload)
+		}
+	}
+}
+
+// abort sends AbortMultipartUpload of evicted upload to its backends,
+// upload already gone (404 NoSuchUpload) is not an error
+func (mt *multipartTracker) abort(upload *trackedUpload) {
+	for host, target := range upload.targets {
+		err := mt.sendAbort(upload.uploadID, target)
+		if err != nil {
+			metrics.Mark("reqs.backend." + metrics.Clean(host) + ".multipart_abort_errors")
+			log.Printf("Cannot abort abandoned multipart upload %s of %s on %s: %s", upload.uploadID, target.url.Path, host, err)
+			continue
+		}
+		metrics.Mark("reqs.backend." + metrics.Clean(host) + ".multipart_aborted")
+		log.Printf("Aborted abandoned multipart upload %s of %s on %s", upload.uploadID, target.url.Path, host)
+	}
+}
+
+func (mt *multipartTracker) sendAbort(uploadID string, target uploadTarget) error {
+	u := target.url
+	u.RawQuery = uploadIDQuery(uploadID)
+	req, err := http.NewRequest(http.MethodDelete, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Host = target.host
+	if target.userAgent != "" {
+		req.Header.Set("User-Agent", target.userAgent)
+	}
+	resp, err := mt.roundTripper.RoundTrip(req.WithContext(transport.WithLowPriority(context.Background())))
+	if err != nil {
+		return err
+	}
+	defer discardResponseBody(resp)
+	if resp.StatusCode >= http.StatusMultipleChoices && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("backend responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// tracked returns number of tracked uploads
+func (mt *multipartTracker) tracked() int {
+	mt.mx.Lock()
+	defer mt.mx.Unlock()
+	return mt.lru.Len()
+}
+
+// MultipartTracking creates Decorator which tracks multipart uploads
+// initiated on backends until they are completed or aborted. Least recently
+// used uploads above MaxTrackedMultipartUploads and ones idle for TTL are
+// evicted and, with AbortEvicted, aborted on their backends
+func MultipartTracking(conf httphandlerconfig.MultipartTrackingConfig) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if conf.MaxTrackedMultipartUploads <= 0 {
+			return roundTripper
+		}
+		ttl := conf.TTL.Duration
+		if ttl <= 0 {
+			ttl = httphandlerconfig.DefaultMultipartTrackingTTL
+		}
+		return &multipartTracker{
+			maxUploads:   conf.MaxTrackedMultipartUploads,
+			ttl:          ttl,
+			abortEvicted: conf.AbortEvicted,
+			now:          time.Now,
+			roundTripper: roundTripper,
+			lru:          list.New(),
+			uploads:      make(map[string]*trackedUpload),
+		}
+	}
+}
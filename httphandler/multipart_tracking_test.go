@@ -0,0 +1,77 @@
+package httphandler
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+	"github.com/allegro/akubra/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sendMultipart(t *testing.T, rt http.RoundTripper, backend *multipartBackend, method, uri string) string {
+	req, _ := http.NewRequest(method, backend.URL+"/bucket/key"+uri, nil)
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	return string(body)
+}
+
+func mkMultipartTracker(conf httphandlerconfig.MultipartTrackingConfig) *multipartTracker {
+	return MultipartTracking(conf)(http.DefaultTransport).(*multipartTracker)
+}
+
+func TestMultipartTrackingEvictsAndAbortsLeastRecentlyUsedUploadsOnOverflow(t *testing.T) {
+	backend := mkMultipartBackend(http.StatusOK)
+	defer backend.Close()
+	tracker := mkMultipartTracker(httphandlerconfig.MultipartTrackingConfig{
+		MaxTrackedMultipartUploads: 2, AbortEvicted: true})
+	evicted := meterCount("reqs.global.multipart.evicted")
+
+	body := sendMultipart(t, tracker, backend, http.MethodPost, "?uploads")
+	sendMultipart(t, tracker, backend, http.MethodPost, "?uploads")
+	sendMultipart(t, tracker, backend, http.MethodPut, "?partNumber=1&uploadId=upload-1")
+	sendMultipart(t, tracker, backend, http.MethodPost, "?uploads")
+
+	assert.Contains(t, body, "<UploadId>upload-1</UploadId>", "initiate response should be passed to client")
+	assert.Equal(t, 2, tracker.tracked())
+	assert.Equal(t, int64(1), meterCount("reqs.global.multipart.evicted")-evicted)
+	waitFor(t, func() bool { return len(backend.recordedAborts()) == 1 }, "evicted upload should be aborted")
+	assert.Equal(t, []string{"/bucket/key?uploadId=upload-2"}, backend.recordedAborts())
+}
+
+func TestMultipartTrackingEvictsUploadsIdleForTTL(t *testing.T) {
+	backend := mkMultipartBackend(http.StatusOK)
+	defer backend.Close()
+	tracker := mkMultipartTracker(httphandlerconfig.MultipartTrackingConfig{
+		MaxTrackedMultipartUploads: 10, TTL: metrics.Interval{Duration: time.Hour}})
+	moment := time.Now()
+	tracker.now = func() time.Time { return moment }
+
+	sendMultipart(t, tracker, backend, http.MethodPost, "?uploads")
+	moment = moment.Add(time.Hour + time.Second)
+	sendMultipart(t, tracker, backend, http.MethodPost, "?uploads")
+
+	assert.Equal(t, 1, tracker.tracked())
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, backend.recordedAborts(), "uploads should be aborted only with AbortEvicted")
+}
+
+func TestMultipartTrackingForgetsCompletedAndAbortedUploads(t *testing.T) {
+	backend := mkMultipartBackend(http.StatusOK)
+	defer backend.Close()
+	tracker := mkMultipartTracker(httphandlerconfig.MultipartTrackingConfig{MaxTrackedMultipartUploads: 10})
+
+	sendMultipart(t, tracker, backend, http.MethodPost, "?uploads")
+	sendMultipart(t, tracker, backend, http.MethodPost, "?uploads")
+	assert.Equal(t, 2, tracker.tracked())
+	sendMultipart(t, tracker, backend, http.MethodPost, "?uploadId=upload-1")
+	sendMultipart(t, tracker, backend, http.MethodDelete, "?uploadId=upload-2")
+
+	assert.Equal(t, 0, tracker.tracked())
+}
@@ -0,0 +1,111 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+	"github.com/allegro/akubra/log"
+)
+
+// DefaultPreStopTimeout limits waiting for drain if Timeout is not set
+const DefaultPreStopTimeout = 30 * time.Second
+
+// preStopPollInterval is how often in-flight requests are checked
+const preStopPollInterval = 50 * time.Millisecond
+
+// PreStop counts in-flight client requests and drains them before
+// termination, e.g. in Kubernetes preStop hook
+type PreStop struct {
+	sentinel    *DrainSentinel
+	maxInFlight int64
+	timeout     time.Duration
+	inFlight    int64
+}
+
+type preStopState struct {
+	Drained  bool  `json:"drained"`
+	InFlight int64 `json:"inFlight"`
+}
+
+// NewPreStop creates PreStop forcing drain mode of sentinel, it's nil if
+// pre-stop is not enabled
+func NewPreStop(conf httphandlerconfig.PreStopConfig, sentinel *DrainSentinel) *PreStop {
+	if !conf.Enabled {
+		return nil
+	}
+	timeout := conf.Timeout.Duration
+	if timeout <= 0 {
+		timeout = DefaultPreStopTimeout
+	}
+	return &PreStop{sentinel: sentinel, maxInFlight: int64(conf.MaxInFlight), timeout: timeout}
+}
+
+// Timeout is longest time AdminHandler waits for drain
+func (ps *PreStop) Timeout() time.Duration {
+	return ps.timeout
+}
+
+// InFlight returns number of client requests in progress
+func (ps *PreStop) InFlight() int64 {
+	return atomic.LoadInt64(&ps.inFlight)
+}
+
+// drain turns drain mode on and waits until at most maxInFlight requests
+// are in progress, it's false if timeout elapsed first
+func (ps *PreStop) drain(stop <-chan struct{}) bool {
+	ps.sentinel.Force()
+	deadline := time.NewTimer(ps.timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(preStopPollInterval)
+	defer ticker.Stop()
+	for ps.InFlight() > ps.maxInFlight {
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			return false
+		case <-stop:
+			return false
+		}
+	}
+	return true
+}
+
+// AdminHandler turns drain mode on and responds with 200 once in-flight
+// requests drained or timeout elapsed, so orchestrator may terminate akubra
+func (ps *PreStop) AdminHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	log.Printf("Pre-stop requested by %s, draining %d in-flight requests", r.RemoteAddr, ps.InFlight())
+	drained := ps.drain(r.Context().Done())
+	if !drained {
+		log.Printf("Pre-stop timed out after %s with %d in-flight requests", ps.timeout, ps.InFlight())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(preStopState{Drained: drained, InFlight: ps.InFlight()})
+}
+
+type preStopHandler struct {
+	handler http.Handler
+	preStop *PreStop
+}
+
+func (ph *preStopHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	atomic.AddInt64(&ph.preStop.inFlight, 1)
+	defer atomic.AddInt64(&ph.preStop.inFlight, -1)
+	ph.handler.ServeHTTP(w, req)
+}
+
+// PreStopTracking wraps handler, its in-flight requests are counted by
+// preStop. Nil preStop disables it
+func PreStopTracking(handler http.Handler, preStop *PreStop) http.Handler {
+	if preStop == nil {
+		return handler
+	}
+	return &preStopHandler{handler: handler, preStop: preStop}
+}
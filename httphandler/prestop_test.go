@@ -0,0 +1,97 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+	"github.com/allegro/akubra/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func preStopRequest(preStop *PreStop) (*httptest.ResponseRecorder, time.Duration) {
+	writer := httptest.NewRecorder()
+	started := time.Now()
+	preStop.AdminHandler(writer, httptest.NewRequest(http.MethodPost, "http://localhost/admin/prestop", nil))
+	return writer, time.Since(started)
+}
+
+func TestPreStopWaitsForInFlightRequestsToDrain(t *testing.T) {
+	sentinel := NewForcedDrainSentinel()
+	preStop := NewPreStop(httphandlerconfig.PreStopConfig{Enabled: true, Timeout: metrics.Interval{Duration: 5 * time.Second}}, sentinel)
+	release := make(chan struct{})
+	started := sync.WaitGroup{}
+	handler := PreStopTracking(DrainMode(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started.Done()
+		<-release
+	}), sentinel, "/status/ping"), preStop)
+	const inFlight = 3
+	started.Add(inFlight)
+	served := sync.WaitGroup{}
+	for i := 0; i < inFlight; i++ {
+		served.Add(1)
+		go func() {
+			defer served.Done()
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/bucket/key", nil))
+		}()
+	}
+	started.Wait()
+	assert.Equal(t, int64(inFlight), preStop.InFlight())
+
+	delay := 100 * time.Millisecond
+	time.AfterFunc(delay, func() { close(release) })
+	writer, took := preStopRequest(preStop)
+
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.True(t, took >= delay, "pre-stop should wait for in-flight requests, took %s", took)
+	state := preStopState{}
+	require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &state))
+	assert.Equal(t, preStopState{Drained: true, InFlight: 0}, state)
+	assert.True(t, sentinel.Draining())
+	served.Wait()
+
+	health := httptest.NewRecorder()
+	handler.ServeHTTP(health, httptest.NewRequest(http.MethodGet, "http://localhost/status/ping", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, health.Code)
+}
+
+func TestPreStopRespondsAfterTimeoutIfRequestsDoNotDrain(t *testing.T) {
+	timeout := 100 * time.Millisecond
+	preStop := NewPreStop(httphandlerconfig.PreStopConfig{Enabled: true, MaxInFlight: 1,
+		Timeout: metrics.Interval{Duration: timeout}}, NewForcedDrainSentinel())
+	release := make(chan struct{})
+	defer close(release)
+	started := sync.WaitGroup{}
+	started.Add(2)
+	handler := PreStopTracking(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started.Done()
+		<-release
+	}), preStop)
+	for i := 0; i < 2; i++ {
+		go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/bucket/key", nil))
+	}
+	started.Wait()
+
+	writer, took := preStopRequest(preStop)
+
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.True(t, took >= timeout, "pre-stop should wait until timeout, took %s", took)
+	state := preStopState{}
+	require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &state))
+	assert.Equal(t, preStopState{Drained: false, InFlight: 2}, state)
+}
+
+func TestPreStopAcceptsOnlyPost(t *testing.T) {
+	preStop := NewPreStop(httphandlerconfig.PreStopConfig{Enabled: true}, NewForcedDrainSentinel())
+	writer := httptest.NewRecorder()
+
+	preStop.AdminHandler(writer, httptest.NewRequest(http.MethodGet, "http://localhost/admin/prestop", nil))
+
+	assert.Equal(t, http.StatusMethodNotAllowed, writer.Code)
+	assert.Nil(t, NewPreStop(httphandlerconfig.PreStopConfig{}, nil))
+}
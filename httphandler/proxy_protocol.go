@@ -0,0 +1,174 @@
+package httphandler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// ProxyHeaderTimeout limits time for reading PROXY protocol header
+const ProxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature starts PROXY protocol version 2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrInvalidProxyHeader is returned if connection does not start with valid
+// PROXY protocol header
+var ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+// maxProxyV1HeaderLen is defined by PROXY protocol specification
+const maxProxyV1HeaderLen = 107
+
+// readProxyV1Header parses "PROXY TCP4 <src> <dst> <srcport> <dstport>\r\n"
+// line, nil address is returned for UNKNOWN protocol
+func readProxyV1Header(reader *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, maxProxyV1HeaderLen)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == maxProxyV1HeaderLen {
+			return nil, ErrInvalidProxyHeader
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[0] == "PROXY" && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[0] != "PROXY" || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, ErrInvalidProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, ErrInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2Header parses binary header, nil address is returned for LOCAL
+// command and not TCP/IP address families
+func readProxyV2Header(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+		return nil, ErrInvalidProxyHeader
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	command, family := header[12]&0x0f, header[13]>>4
+	if command == 0 {
+		return nil, nil
+	}
+	switch {
+	case family == 1 && len(payload) >= 12:
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case family == 2 && len(payload) >= 36:
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	case family == 1 || family == 2:
+		return nil, ErrInvalidProxyHeader
+	}
+	return nil, nil
+}
+
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		return readProxyV1Header(reader)
+	case proxyV2Signature[0]:
+		return readProxyV2Header(reader)
+	}
+	return nil, ErrInvalidProxyHeader
+}
+
+// proxyConn reads PROXY protocol header before first read or RemoteAddr
+// call, so accepting connections is not blocked by slow clients
+type proxyConn struct {
+	net.Conn
+	reader        *bufio.Reader
+	headerTimeout time.Duration
+	once          sync.Once
+	remoteAddr    net.Addr
+	err           error
+}
+
+func (pc *proxyConn) readHeader() {
+	pc.once.Do(func() {
+		if err := pc.Conn.SetReadDeadline(time.Now().Add(pc.headerTimeout)); err != nil {
+			log.Debugf("Cannot set PROXY header deadline for %s: %s", pc.Conn.RemoteAddr(), err)
+		}
+		pc.remoteAddr, pc.err = readProxyHeader(pc.reader)
+		if err := pc.Conn.SetReadDeadline(time.Time{}); err != nil {
+			log.Debugf("Cannot reset PROXY header deadline for %s: %s", pc.Conn.RemoteAddr(), err)
+		}
+		if pc.err != nil {
+			metrics.Mark("reqs.global.proxy_protocol_errors")
+			log.Printf("Cannot read PROXY protocol header from %s: %s", pc.Conn.RemoteAddr(), pc.err)
+			// nothing should be answered to client which does not speak PROXY protocol
+			if closeErr := pc.Conn.Close(); closeErr != nil {
+				log.Debugf("Cannot close connection of %s: %s", pc.Conn.RemoteAddr(), closeErr)
+			}
+		}
+	})
+}
+
+func (pc *proxyConn) Read(p []byte) (int, error) {
+	pc.readHeader()
+	if pc.err != nil {
+		return 0, pc.err
+	}
+	return pc.reader.Read(p)
+}
+
+// RemoteAddr returns client address sent in PROXY header, or load balancer
+// address if header has no client address
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	pc.readHeader()
+	if pc.remoteAddr != nil {
+		return pc.remoteAddr
+	}
+	return pc.Conn.RemoteAddr()
+}
+
+type proxyListener struct {
+	net.Listener
+	headerTimeout time.Duration
+}
+
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	conn, err := pl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn), headerTimeout: pl.headerTimeout}, nil
+}
+
+// ProxyProtocolListener wraps listener, accepted connections have to start
+// with PROXY protocol (version 1 or 2) header, which sets their RemoteAddr.
+// Connections without valid header are closed
+func ProxyProtocolListener(listener net.Listener, headerTimeout time.Duration) net.Listener {
+	if headerTimeout <= 0 {
+		headerTimeout = ProxyHeaderTimeout
+	}
+	return &proxyListener{Listener: listener, headerTimeout: headerTimeout}
+}
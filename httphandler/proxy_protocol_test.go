@@ -0,0 +1,140 @@
+package httphandler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+	"github.com/allegro/akubra/log"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func proxyV2Header(command byte, family byte, addresses []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family<<4|1, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func ipv4Addresses(src, dst string, srcPort, dstPort uint16) []byte {
+	addresses := append(append([]byte{}, net.ParseIP(src).To4()...), net.ParseIP(dst).To4()...)
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:2], srcPort)
+	binary.BigEndian.PutUint16(ports[2:4], dstPort)
+	return append(addresses, ports...)
+}
+
+func ipv6Addresses(src, dst string, srcPort, dstPort uint16) []byte {
+	addresses := append(append([]byte{}, net.ParseIP(src).To16()...), net.ParseIP(dst).To16()...)
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:2], srcPort)
+	binary.BigEndian.PutUint16(ports[2:4], dstPort)
+	return append(addresses, ports...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, testData := range []struct {
+		name     string
+		header   []byte
+		expected string
+		err      bool
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 40000 80\r\n"), "203.0.113.7:40000", false},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 40000 80\r\n"), "[2001:db8::7]:40000", false},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 malformed", []byte("PROXY TCP4 203.0.113.7\r\n"), "", true},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"), "", true},
+		{"v2 TCP4", proxyV2Header(1, 1, ipv4Addresses("203.0.113.7", "10.0.0.1", 40000, 80)), "203.0.113.7:40000", false},
+		{"v2 TCP6", proxyV2Header(1, 2, ipv6Addresses("2001:db8::7", "2001:db8::1", 40000, 80)), "[2001:db8::7]:40000", false},
+		{"v2 TCP4 with TLVs", proxyV2Header(1, 1, append(ipv4Addresses("203.0.113.7", "10.0.0.1", 40000, 80), 0x04, 0, 1, 0)),
+			"203.0.113.7:40000", false},
+		{"v2 LOCAL", proxyV2Header(0, 0, nil), "", false},
+		{"v2 truncated addresses", proxyV2Header(1, 1, []byte{203, 0, 113}), "", true},
+		{"no header", []byte("GET / HTTP/1.1\r\n"), "", true},
+	} {
+		addr, err := readProxyHeader(bufio.NewReader(bytes.NewReader(testData.header)))
+		if testData.err {
+			assert.Error(t, err, testData.name)
+			continue
+		}
+		require.NoError(t, err, testData.name)
+		if testData.expected == "" {
+			assert.Nil(t, addr, testData.name)
+			continue
+		}
+		assert.Equal(t, testData.expected, addr.String(), testData.name)
+	}
+}
+
+func mkProxyProtocolServer(t *testing.T, accessLog *lockedBuffer) (addr string, stop func()) {
+	logger := &logrus.Logger{
+		Out:       accessLog,
+		Formatter: log.PlainTextFormatter{},
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.DebugLevel,
+	}
+	handler := &Handler{
+		roundTripper:          Decorate(okRoundTripper{}, AccessLogging(logger, httphandlerconfig.HealthProbesConfig{}, nil, false)),
+		bodyMaxSize:           1024,
+		maxConcurrentRequests: 10,
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{Handler: handler}
+	go func() { _ = srv.Serve(ProxyProtocolListener(listener, time.Second)) }()
+	return listener.Addr().String(), func() { _ = srv.Close() }
+}
+
+func sendWithProxyHeader(t *testing.T, addr string, header []byte) (*http.Response, error) {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	request := "GET /bucket/key HTTP/1.1\r\nHost: akubra.internal\r\nConnection: close\r\n\r\n"
+	_, err = conn.Write(append(append([]byte{}, header...), request...))
+	require.NoError(t, err)
+	return http.ReadResponse(bufio.NewReader(conn), nil)
+}
+
+func TestProxyProtocolListenerSetsClientAddress(t *testing.T) {
+	for _, testData := range []struct {
+		name     string
+		header   []byte
+		expected string
+	}{
+		{"v1", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 40000 80\r\n"), "203.0.113.7:40000"},
+		{"v2", proxyV2Header(1, 1, ipv4Addresses("198.51.100.9", "10.0.0.1", 41000, 80)), "198.51.100.9:41000"},
+		{"v2 IPv6", proxyV2Header(1, 2, ipv6Addresses("2001:db8::7", "2001:db8::1", 42000, 80)), "[2001:db8::7]:42000"},
+	} {
+		accessLog := &lockedBuffer{}
+		addr, stop := mkProxyProtocolServer(t, accessLog)
+
+		resp, err := sendWithProxyHeader(t, addr, testData.header)
+		require.NoError(t, err, testData.name)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, testData.name)
+		stop()
+
+		amd := &AccessMessageData{}
+		require.NoError(t, json.Unmarshal(bytes.TrimSpace(accessLog.Bytes()), amd), testData.name)
+		assert.Equal(t, testData.expected, amd.RemoteAddr, testData.name)
+	}
+}
+
+func TestProxyProtocolListenerRejectsConnectionsWithoutHeader(t *testing.T) {
+	accessLog := &lockedBuffer{}
+	addr, stop := mkProxyProtocolServer(t, accessLog)
+	defer stop()
+
+	_, err := sendWithProxyHeader(t, addr, nil)
+
+	assert.Error(t, err)
+	assert.Empty(t, accessLog.Bytes())
+}
@@ -0,0 +1,199 @@
+package httphandler
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// flight is single backend request shared by identical client requests
+type flight struct {
+	done chan struct{}
+	// waiters counts requests waiting for leader's response
+	waiters int
+	resp    *http.Response
+	body    []byte
+	err     error
+	// unshared is set if body exceeded size limit or leader's request was
+	// canceled, waiters have to issue own requests then
+	unshared bool
+	// object is host and path of read object
+	object string
+}
+
+// coalescedObjectKey identifies object of coalesced read or write
+func coalescedObjectKey(req *http.Request) string {
+	return req.Host + " " + req.URL.Path
+}
+
+// invalidatedBy tells if write changes object read by flight, multi-object
+// delete changes all objects of its bucket
+func (f *flight) invalidatedBy(write *http.Request) bool {
+	if isMultiDelete(write) {
+		return strings.HasPrefix(f.object, strings.TrimSuffix(coalescedObjectKey(write), "/")+"/")
+	}
+	return f.object == coalescedObjectKey(write)
+}
+
+// invalidatesReads tells if request successfully changed objects
+func invalidatesReads(req *http.Request, resp *http.Response, err error) bool {
+	switch req.Method {
+	case http.MethodPut, http.MethodPost, http.MethodDelete:
+		return err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300
+	}
+	return false
+}
+
+// forgetInvalidated removes flights of objects changed by write from
+// flights, so reads coming after write do not get response read before it.
+// Requests already waiting for them still get it
+func forgetInvalidated(flights map[string]*flight, write *http.Request) {
+	for key, f := range flights {
+		if f.invalidatedBy(write) {
+			metrics.Mark("reqs.global.coalesced.invalidated")
+			delete(flights, key)
+		}
+	}
+}
+
+func (f *flight) response(req *http.Request) *http.Response {
+	return copyResponse(f.resp, f.body, req)
+}
+
+// copyResponse returns copy of already read response with given body, which
+// can be passed to another request
+func copyResponse(original *http.Response, body []byte, req *http.Request) *http.Response {
+	resp := *original
+	resp.Header = make(http.Header, len(original.Header))
+	for k, v := range original.Header {
+		resp.Header[k] = append([]string{}, v...)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.Request = req
+	return &resp
+}
+
+type readCoalescer struct {
+	maxSize      int64
+	roundTripper http.RoundTripper
+	mx           sync.Mutex
+	flights      map[string]*flight
+}
+
+// flightKey identifies requests which may share response. Authorization is
+// part of the key, so responses are shared only between requests with the
+// same credentials
+func flightKey(req *http.Request) (string, bool) {
+	if req.Method != http.MethodGet || req.Header.Get("Cache-Control") == "no-cache" {
+		return "", false
+	}
+	return req.Host + " " + req.URL.RequestURI() + " " + req.Header.Get("Range") + " " +
+		req.Header.Get("Authorization"), true
+}
+
+func (rc *readCoalescer) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, ok := flightKey(req)
+	if !ok {
+		resp, err := rc.roundTripper.RoundTrip(req)
+		if invalidatesReads(req, resp, err) {
+			rc.mx.Lock()
+			forgetInvalidated(rc.flights, req)
+			rc.mx.Unlock()
+		}
+		return resp, err
+	}
+	rc.mx.Lock()
+	if f, inFlight := rc.flights[key]; inFlight {
+		f.waiters++
+		rc.mx.Unlock()
+		return rc.wait(f, req)
+	}
+	f := &flight{done: make(chan struct{}), object: coalescedObjectKey(req)}
+	rc.flights[key] = f
+	rc.mx.Unlock()
+	return rc.lead(f, key, req)
+}
+
+func (rc *readCoalescer) wait(f *flight, req *http.Request) (*http.Response, error) {
+	select {
+	case <-f.done:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	if f.unshared {
+		return rc.roundTripper.RoundTrip(req)
+	}
+	metrics.Mark("reqs.global.coalesced")
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.response(req), nil
+}
+
+func (rc *readCoalescer) lead(f *flight, key string, req *http.Request) (*http.Response, error) {
+	defer func() {
+		rc.mx.Lock()
+		if rc.flights[key] == f {
+			delete(rc.flights, key)
+		}
+		rc.mx.Unlock()
+		close(f.done)
+	}()
+	resp, err := rc.roundTripper.RoundTrip(req)
+	if err != nil {
+		f.err = err
+		f.unshared = req.Context().Err() != nil
+		return nil, err
+	}
+	if resp.ContentLength > rc.maxSize {
+		f.unshared = true
+		return resp, nil
+	}
+	body, readErr := ioutil.ReadAll(io.LimitReader(resp.Body, rc.maxSize+1))
+	if readErr != nil {
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			log.Debugf("Cannot close response body %s", closeErr)
+		}
+		f.err = readErr
+		f.unshared = req.Context().Err() != nil
+		return nil, readErr
+	}
+	if int64(len(body)) > rc.maxSize {
+		f.unshared = true
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	if closeErr := resp.Body.Close(); closeErr != nil {
+		log.Debugf("Cannot close response body %s", closeErr)
+	}
+	f.resp = resp
+	f.body = body
+	return f.response(req), nil
+}
+
+// ReadCoalescer creates Decorator which sends only one backend request for
+// identical GET requests in progress and passes its response to all of them.
+// Responses with body bigger than maxSize are not shared. Successful write
+// of object makes later reads of it use new backend request. Zero maxSize
+// disables coalescing
+func ReadCoalescer(maxSize int64) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if maxSize <= 0 {
+			return roundTripper
+		}
+		return &readCoalescer{
+			maxSize:      maxSize,
+			roundTripper: roundTripper,
+			flights:      make(map[string]*flight),
+		}
+	}
+}
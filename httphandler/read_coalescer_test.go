@@ -0,0 +1,156 @@
+package httphandler
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func (rc *readCoalescer) waitersFor(req *http.Request) int {
+	key, _ := flightKey(req)
+	rc.mx.Lock()
+	defer rc.mx.Unlock()
+	if f, ok := rc.flights[key]; ok {
+		return f.waiters
+	}
+	return -1
+}
+
+// coalescedReads sends identical reads by clients at once, chunked backend
+// flushes body in two parts without Content-Length
+func coalescedReads(t *testing.T, body string, maxSize int64, clients int, chunked bool) (int32, []string) {
+	var backendRequests int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&backendRequests, 1)
+		<-release
+		if !chunked {
+			_, err := w.Write([]byte(body))
+			assert.NoError(t, err)
+			return
+		}
+		for _, part := range []string{body[:len(body)/2], body[len(body)/2:]} {
+			_, err := w.Write([]byte(part))
+			assert.NoError(t, err)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+	rc := ReadCoalescer(maxSize)(http.DefaultTransport).(*readCoalescer)
+
+	bodies := make([]string, clients)
+	wg := sync.WaitGroup{}
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", srv.URL+"/bucket/key", nil)
+			resp, err := rc.RoundTrip(req)
+			require.NoError(t, err)
+			b, _ := ioutil.ReadAll(resp.Body)
+			assert.NoError(t, resp.Body.Close())
+			bodies[i] = string(b)
+		}(i)
+	}
+	req, _ := http.NewRequest("GET", srv.URL+"/bucket/key", nil)
+	deadline := time.Now().Add(time.Second)
+	for rc.waitersFor(req) != clients-1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	return atomic.LoadInt32(&backendRequests), bodies
+}
+
+func TestReadCoalescerSendsSingleBackendRequestForIdenticalReads(t *testing.T) {
+	backendRequests, bodies := coalescedReads(t, "content", 1024, 10, false)
+
+	assert.Equal(t, int32(1), backendRequests)
+	for _, body := range bodies {
+		assert.Equal(t, "content", body)
+	}
+}
+
+func TestReadCoalescerSharesChunkedResponses(t *testing.T) {
+	backendRequests, bodies := coalescedReads(t, "chunked content", 1024, 10, true)
+
+	assert.Equal(t, int32(1), backendRequests)
+	for _, body := range bodies {
+		assert.Equal(t, "chunked content", body)
+	}
+}
+
+func TestReadCoalescerDoesNotShareLargeChunkedResponses(t *testing.T) {
+	body := strings.Repeat("x", 100)
+
+	backendRequests, bodies := coalescedReads(t, body, 10, 5, true)
+
+	assert.Equal(t, int32(5), backendRequests)
+	for _, b := range bodies {
+		assert.Equal(t, body, b)
+	}
+}
+
+func TestReadCoalescerDoesNotShareLargeBodies(t *testing.T) {
+	body := strings.Repeat("x", 100)
+
+	backendRequests, bodies := coalescedReads(t, body, 10, 5, false)
+
+	assert.Equal(t, int32(5), backendRequests)
+	for _, b := range bodies {
+		assert.Equal(t, body, b)
+	}
+}
+
+func TestReadCoalescerDoesNotJoinReadsStartedBeforeWrite(t *testing.T) {
+	var mx sync.Mutex
+	content := "old"
+	var backendReads int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		if r.Method == http.MethodPut {
+			content = "new"
+		}
+		read := content
+		mx.Unlock()
+		if r.Method == http.MethodGet && atomic.AddInt32(&backendReads, 1) == 1 {
+			<-release
+		}
+		_, err := w.Write([]byte(read))
+		assert.NoError(t, err)
+	}))
+	defer srv.Close()
+	rc := ReadCoalescer(1024)(http.DefaultTransport).(*readCoalescer)
+	get := func() string {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/bucket/key", nil)
+		resp, err := rc.RoundTrip(req)
+		require.NoError(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, resp.Body.Close())
+		return string(body)
+	}
+
+	early := make(chan string, 1)
+	go func() { early <- get() }()
+	probe, _ := http.NewRequest(http.MethodGet, srv.URL+"/bucket/key", nil)
+	waitFor(t, func() bool { return atomic.LoadInt32(&backendReads) == 1 && rc.waitersFor(probe) == 0 },
+		"early read should reach backend")
+	put, _ := http.NewRequest(http.MethodPut, srv.URL+"/bucket/key", strings.NewReader("new"))
+	resp, err := rc.RoundTrip(put)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	assert.Equal(t, "new", get(), "read after write should not get response of earlier read")
+	close(release)
+	assert.Equal(t, "old", <-early)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&backendReads))
+}
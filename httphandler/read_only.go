@@ -0,0 +1,85 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// ReadOnlySwitch holds read-only mode state, writes are rejected while it's
+// on and reads are served as usual
+type ReadOnlySwitch struct {
+	readOnly int32
+}
+
+// NewReadOnlySwitch creates ReadOnlySwitch in given mode
+func NewReadOnlySwitch(readOnly bool) *ReadOnlySwitch {
+	ros := &ReadOnlySwitch{}
+	ros.Set(readOnly)
+	return ros
+}
+
+// Set turns read-only mode on or off
+func (ros *ReadOnlySwitch) Set(readOnly bool) {
+	value := int32(0)
+	if readOnly {
+		value = 1
+	}
+	atomic.StoreInt32(&ros.readOnly, value)
+	metrics.UpdateGauge("reqs.global.read_only", int64(value))
+}
+
+// ReadOnly tells if read-only mode is on
+func (ros *ReadOnlySwitch) ReadOnly() bool {
+	return atomic.LoadInt32(&ros.readOnly) == 1
+}
+
+type readOnlyState struct {
+	ReadOnly bool `json:"readOnly"`
+}
+
+// AdminHandler switches read-only mode on POST request and responds with
+// current mode
+func (ros *ReadOnlySwitch) AdminHandler(readOnly bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if ros.ReadOnly() != readOnly {
+			log.Printf("Read-only mode switched by %s, read-only: %t", r.RemoteAddr, readOnly)
+		}
+		ros.Set(readOnly)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(readOnlyState{ReadOnly: ros.ReadOnly()})
+	}
+}
+
+func isReadMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+type readOnlyHandler struct {
+	handler  http.Handler
+	readOnly *ReadOnlySwitch
+}
+
+func (roh *readOnlyHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if isReadMethod(req.Method) || !roh.readOnly.ReadOnly() {
+		roh.handler.ServeHTTP(w, req)
+		return
+	}
+	metrics.Mark("reqs.global.read_only.rejected")
+	writeS3Error(w, http.StatusServiceUnavailable, "ServiceUnavailable",
+		"Service is in read-only mode, please retry the write later.", req.URL.Path, "")
+}
+
+// ReadOnlyMode wraps handler, writes (methods other than GET, HEAD and
+// OPTIONS) are rejected with 503 while readOnly switch is on
+func ReadOnlyMode(handler http.Handler, readOnly *ReadOnlySwitch) http.Handler {
+	return &readOnlyHandler{handler: handler, readOnly: readOnly}
+}
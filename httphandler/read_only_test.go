@@ -0,0 +1,34 @@
+package httphandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadOnlyModeRejectsWritesAndServesReads(t *testing.T) {
+	readOnly := NewReadOnlySwitch(true)
+	handler := ReadOnlyMode(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), readOnly)
+	serve := func(method string) *httptest.ResponseRecorder {
+		writer := httptest.NewRecorder()
+		handler.ServeHTTP(writer, httptest.NewRequest(method, "http://localhost/bucket/key", strings.NewReader("")))
+		return writer
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodOptions} {
+		assert.Equal(t, http.StatusOK, serve(method).Code, method)
+	}
+	for _, method := range []string{http.MethodPut, http.MethodPost, http.MethodDelete} {
+		writer := serve(method)
+		assert.Equal(t, http.StatusServiceUnavailable, writer.Code, method)
+		assert.Contains(t, writer.Body.String(), "<Code>ServiceUnavailable</Code>", method)
+	}
+
+	readOnly.Set(false)
+	assert.Equal(t, http.StatusOK, serve(http.MethodPut).Code)
+}
@@ -0,0 +1,208 @@
+package httphandler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/allegro/akubra/transport"
+)
+
+// reconciledHeaders describe object content and are copied along with it
+var reconciledHeaders = []string{
+	"Content-Type",
+	"Content-Encoding",
+	"Content-Disposition",
+	"Content-Language",
+	"Cache-Control",
+	"Expires",
+}
+
+// ETagReconciler copies authoritative object version to backends holding
+// different one. Every copy is written to synclog
+type ETagReconciler struct {
+	policy       string
+	roundTripper http.RoundTripper
+	syncLog      log.Logger
+}
+
+// NewETagReconciler creates ETagReconciler sending requests with given
+// backend roundTripper
+func NewETagReconciler(conf shardingconfig.AutoReconcileConfig, roundTripper http.RoundTripper, syncLog log.Logger) *ETagReconciler {
+	policy := conf.Policy
+	if policy == "" {
+		policy = shardingconfig.ReconcileNewest
+	}
+	return &ETagReconciler{policy: policy, roundTripper: roundTripper, syncLog: syncLog}
+}
+
+// newestVersion picks version with most recent Last-Modified, ok is false if
+// other version was modified at the same time
+func newestVersion(versions []transport.ReplicaVersion) (newest transport.ReplicaVersion, ok bool) {
+	for _, version := range versions {
+		switch {
+		case version.LastModified.After(newest.LastModified):
+			newest, ok = version, true
+		case version.LastModified.Equal(newest.LastModified) && version.ETag != newest.ETag:
+			ok = false
+		}
+	}
+	return newest, ok && !newest.LastModified.IsZero()
+}
+
+// majorityVersion picks version held by most backends, newest of them wins
+// if several versions are held by the same number of backends
+func majorityVersion(versions []transport.ReplicaVersion) (transport.ReplicaVersion, bool) {
+	counts := make(map[string]int)
+	best := 0
+	for _, version := range versions {
+		counts[version.ETag]++
+		if counts[version.ETag] > best {
+			best = counts[version.ETag]
+		}
+	}
+	var candidates []transport.ReplicaVersion
+	candidateETags := make(map[string]bool)
+	for _, version := range versions {
+		if counts[version.ETag] == best {
+			candidates = append(candidates, version)
+			candidateETags[version.ETag] = true
+		}
+	}
+	if len(candidates) == 0 {
+		return transport.ReplicaVersion{}, false
+	}
+	if len(candidateETags) > 1 {
+		return newestVersion(candidates)
+	}
+	return candidates[0], true
+}
+
+func (er *ETagReconciler) authoritativeVersion(versions []transport.ReplicaVersion) (transport.ReplicaVersion, bool) {
+	if er.policy == shardingconfig.ReconcileMajority {
+		return majorityVersion(versions)
+	}
+	return newestVersion(versions)
+}
+
+// Reconcile copies authoritative version to backends holding another one.
+// Only plain object reads are reconciled, subresources have their own ETags
+func (er *ETagReconciler) Reconcile(versions []transport.ReplicaVersion) {
+	if len(versions) == 0 {
+		return
+	}
+	req := versions[0].Request
+	if req.Method != http.MethodGet && req.Method != http.MethodHead || req.URL.RawQuery != "" {
+		return
+	}
+	authoritative, ok := er.authoritativeVersion(versions)
+	if !ok {
+		metrics.Mark("reqs.global.reconcile_undecided")
+		log.Printf("Cannot choose authoritative version of %s with %s policy", req.URL.Path, er.policy)
+		return
+	}
+	for _, version := range versions {
+		if version.ETag == authoritative.ETag {
+			continue
+		}
+		err := copyObject(er.roundTripper, authoritative, version)
+		er.synclog(authoritative, version, err)
+		if err != nil {
+			metrics.Mark("reqs.backend." + metrics.Clean(version.Request.URL.Host) + ".reconcile_errors")
+			log.Printf("Cannot reconcile %s on %s: %s", req.URL.Path, version.Request.URL.Host, err)
+			continue
+		}
+		metrics.Mark("reqs.backend." + metrics.Clean(version.Request.URL.Host) + ".reconciled")
+	}
+}
+
+func objectRequest(ctx context.Context, method string, version transport.ReplicaVersion) (*http.Request, error) {
+	u := *version.Request.URL
+	u.RawQuery = ""
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = version.Request.Host
+	return req.WithContext(ctx), nil
+}
+
+// copyObject streams source version from its backend to target backend.
+// If-Match makes sure source version has not changed since, if its ETag is
+// known
+func copyObject(roundTripper http.RoundTripper, source, target transport.ReplicaVersion) error {
+	ctx := transport.WithLowPriority(context.WithValue(context.Background(), log.ContextreqIDKey,
+		source.Request.Context().Value(log.ContextreqIDKey)))
+	getReq, err := objectRequest(ctx, http.MethodGet, source)
+	if err != nil {
+		return err
+	}
+	if source.ETag != "" {
+		getReq.Header.Set("If-Match", source.ETag)
+	}
+	getResp, err := roundTripper.RoundTrip(getReq)
+	if err != nil {
+		return err
+	}
+	defer discardResponseBody(getResp)
+	if getResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("source backend %s responded with status %d", source.Request.URL.Host, getResp.StatusCode)
+	}
+
+	putReq, err := objectRequest(ctx, http.MethodPut, target)
+	if err != nil {
+		return err
+	}
+	putReq.Body = ioutil.NopCloser(getResp.Body)
+	putReq.ContentLength = getResp.ContentLength
+	for _, header := range reconciledHeaders {
+		if value := getResp.Header.Get(header); value != "" {
+			putReq.Header.Set(header, value)
+		}
+	}
+	for header, values := range getResp.Header {
+		if strings.HasPrefix(strings.ToLower(header), "x-amz-meta-") {
+			putReq.Header[header] = values
+		}
+	}
+	putResp, err := roundTripper.RoundTrip(putReq)
+	if err != nil {
+		return err
+	}
+	defer discardResponseBody(putResp)
+	if putResp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("target backend responded with status %d", putResp.StatusCode)
+	}
+	return nil
+}
+
+func (er *ETagReconciler) synclog(source, target transport.ReplicaVersion, err error) {
+	if er.syncLog == nil {
+		return
+	}
+	errorMsg := fmt.Sprintf("Reconciled ETag %s to %s", target.ETag, source.ETag)
+	if err != nil {
+		errorMsg = fmt.Sprintf("Reconciliation of ETag %s to %s failed: %s", target.ETag, source.ETag, err)
+	}
+	reqID, _ := source.Request.Context().Value(log.ContextreqIDKey).(string)
+	syncLogMsg := NewSyncLogMessageData(
+		http.MethodPut,
+		target.Request.URL.Host,
+		source.Request.URL.Path,
+		source.Request.URL.Host,
+		source.Request.Header.Get("User-Agent"),
+		reqID,
+		errorMsg,
+		-1)
+	logMsg, marshalErr := json.Marshal(syncLogMsg)
+	if marshalErr != nil {
+		return
+	}
+	er.syncLog.Println(string(logMsg))
+}
@@ -0,0 +1,165 @@
+package httphandler
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/allegro/akubra/transport"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// replicaBackend holds single object version
+type replicaBackend struct {
+	*httptest.Server
+	mx          sync.Mutex
+	content     string
+	contentType string
+	etag        string
+	modified    time.Time
+}
+
+func mkReplicaBackend(content string, modified time.Time) *replicaBackend {
+	rb := &replicaBackend{content: content, contentType: "text/plain", etag: `"` + content + `"`, modified: modified}
+	rb.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rb.mx.Lock()
+		defer rb.mx.Unlock()
+		if r.Method == http.MethodPut {
+			body, _ := ioutil.ReadAll(r.Body)
+			rb.content = string(body)
+			rb.contentType = r.Header.Get("Content-Type")
+			rb.etag = `"` + rb.content + `"`
+			rb.modified = time.Now()
+			return
+		}
+		if match := r.Header.Get("If-Match"); match != "" && match != rb.etag {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		w.Header().Set("Content-Type", rb.contentType)
+		w.Header().Set("ETag", rb.etag)
+		_, _ = w.Write([]byte(rb.content))
+	}))
+	return rb
+}
+
+func (rb *replicaBackend) object() (content, contentType string) {
+	rb.mx.Lock()
+	defer rb.mx.Unlock()
+	return rb.content, rb.contentType
+}
+
+func (rb *replicaBackend) version() transport.ReplicaVersion {
+	backendURL, _ := url.Parse(rb.URL + "/bucket/key")
+	req, _ := http.NewRequest(http.MethodGet, backendURL.String(), nil)
+	req.Host = "akubra.internal"
+	ctx := context.WithValue(req.Context(), log.ContextreqIDKey, "reqID")
+	return transport.ReplicaVersion{Request: req.WithContext(ctx), ETag: rb.etag, LastModified: rb.modified}
+}
+
+func reconcileVersions(policy string, versions ...transport.ReplicaVersion) string {
+	var synclog bytes.Buffer
+	logger := &logrus.Logger{
+		Out:       &synclog,
+		Formatter: log.PlainTextFormatter{},
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.DebugLevel,
+	}
+	reconciler := NewETagReconciler(shardingconfig.AutoReconcileConfig{Enabled: true, Policy: policy},
+		http.DefaultTransport, logger)
+	reconciler.Reconcile(versions)
+	return synclog.String()
+}
+
+func reconcile(policy string, backends ...*replicaBackend) string {
+	var versions []transport.ReplicaVersion
+	for _, backend := range backends {
+		versions = append(versions, backend.version())
+	}
+	return reconcileVersions(policy, versions...)
+}
+
+func TestETagReconcilerCopiesNewestVersion(t *testing.T) {
+	older := mkReplicaBackend("old", time.Date(2017, 10, 1, 10, 0, 0, 0, time.UTC))
+	defer older.Close()
+	newer := mkReplicaBackend("new", time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC))
+	defer newer.Close()
+	older.contentType = "application/octet-stream"
+
+	synclog := reconcile("", older, newer, older)
+
+	content, contentType := older.object()
+	assert.Equal(t, "new", content)
+	assert.Equal(t, "text/plain", contentType)
+	content, _ = newer.object()
+	assert.Equal(t, "new", content)
+	assert.Equal(t, 2, strings.Count(synclog, `Reconciled ETag \"old\" to \"new\"`))
+	assert.Contains(t, synclog, `"failedhost":"`+older.Listener.Addr().String()+`"`)
+	assert.Contains(t, synclog, `"successhost":"`+newer.Listener.Addr().String()+`"`)
+}
+
+func TestETagReconcilerCopiesMajorityVersion(t *testing.T) {
+	first := mkReplicaBackend("old", time.Date(2017, 10, 1, 10, 0, 0, 0, time.UTC))
+	defer first.Close()
+	second := mkReplicaBackend("old", time.Date(2017, 10, 1, 10, 0, 0, 0, time.UTC))
+	defer second.Close()
+	newer := mkReplicaBackend("new", time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC))
+	defer newer.Close()
+
+	synclog := reconcile(shardingconfig.ReconcileMajority, first, second, newer)
+
+	for _, backend := range []*replicaBackend{first, second, newer} {
+		content, _ := backend.object()
+		assert.Equal(t, "old", content)
+	}
+	assert.Equal(t, 1, strings.Count(synclog, `Reconciled ETag \"new\" to \"old\"`))
+}
+
+func TestETagReconcilerSkipsUndecidedVersions(t *testing.T) {
+	modified := time.Date(2017, 10, 1, 10, 0, 0, 0, time.UTC)
+	first := mkReplicaBackend("first", modified)
+	defer first.Close()
+	second := mkReplicaBackend("second", modified)
+	defer second.Close()
+
+	synclog := reconcile(shardingconfig.ReconcileNewest, first, second)
+
+	content, _ := first.object()
+	assert.Equal(t, "first", content)
+	content, _ = second.object()
+	assert.Equal(t, "second", content)
+	assert.Empty(t, synclog)
+}
+
+func TestMajorityVersionOfNoVersionsIsUndecided(t *testing.T) {
+	_, ok := majorityVersion(nil)
+	assert.False(t, ok)
+}
+
+func TestETagReconcilerLogsFailedCopy(t *testing.T) {
+	older := mkReplicaBackend("old", time.Date(2017, 10, 1, 10, 0, 0, 0, time.UTC))
+	defer older.Close()
+	newer := mkReplicaBackend("new", time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC))
+	defer newer.Close()
+	newerVersion := newer.version()
+	// newest version changed since divergence was found
+	newer.mx.Lock()
+	newer.etag = `"newest"`
+	newer.mx.Unlock()
+
+	synclog := reconcileVersions("", older.version(), newerVersion)
+
+	content, _ := older.object()
+	assert.Equal(t, "old", content)
+	assert.Contains(t, synclog, "failed: source backend")
+}
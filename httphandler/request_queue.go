@@ -0,0 +1,91 @@
+package httphandler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// DefaultQueueRetryAfter is Retry-After of requests rejected by full queue
+// if RetryAfter is not set
+const DefaultQueueRetryAfter = time.Second
+
+// requestQueue lets at most workers requests be processed at once, at most
+// queueSize others wait for free worker. Requests above are rejected
+type requestQueue struct {
+	handler    http.Handler
+	workers    chan struct{}
+	queue      chan struct{}
+	retryAfter string
+}
+
+func (rq *requestQueue) reject(w http.ResponseWriter, req *http.Request) {
+	metrics.Mark("reqs.global.queue.rejected")
+	log.Debugf("Request queue is full, rejecting request from %s", req.RemoteAddr)
+	w.Header().Set("Retry-After", rq.retryAfter)
+	writeS3Error(w, http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate.", req.URL.Path, "")
+}
+
+func (rq *requestQueue) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	select {
+	case rq.workers <- struct{}{}:
+	default:
+		if !rq.wait(w, req) {
+			return
+		}
+	}
+	defer func() { <-rq.workers }()
+	rq.handler.ServeHTTP(w, req)
+}
+
+// wait queues request until worker is free, it's false if request was
+// rejected or client request ended
+func (rq *requestQueue) wait(w http.ResponseWriter, req *http.Request) bool {
+	select {
+	case rq.queue <- struct{}{}:
+	default:
+		rq.reject(w, req)
+		return false
+	}
+	metrics.UpdateGauge("reqs.global.queue.depth", int64(len(rq.queue)))
+	defer func() {
+		<-rq.queue
+		metrics.UpdateGauge("reqs.global.queue.depth", int64(len(rq.queue)))
+	}()
+	since := time.Now()
+	select {
+	case rq.workers <- struct{}{}:
+		metrics.UpdateSince("reqs.global.queue.wait", since)
+		return true
+	case <-req.Context().Done():
+		metrics.Mark("reqs.global.queue.abandoned")
+		return false
+	}
+}
+
+// RequestQueue wraps handler, requests are processed by at most Workers at
+// once and at most QueueSize requests wait for free worker. Other requests
+// get 503 response with Retry-After header. Zero Workers disables queue
+func RequestQueue(handler http.Handler, conf httphandlerconfig.RequestQueueConfig) http.Handler {
+	if conf.Workers <= 0 {
+		return handler
+	}
+	retryAfter := conf.RetryAfter.Duration
+	if retryAfter <= 0 {
+		retryAfter = DefaultQueueRetryAfter
+	}
+	seconds := int(retryAfter / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return &requestQueue{
+		handler:    handler,
+		workers:    make(chan struct{}, conf.Workers),
+		queue:      make(chan struct{}, conf.QueueSize),
+		retryAfter: strconv.Itoa(seconds),
+	}
+}
@@ -0,0 +1,67 @@
+package httphandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+	gometrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func queueDepth() int64 {
+	if gauge, ok := gometrics.Get("reqs.global.queue.depth").(gometrics.Gauge); ok {
+		return gauge.Value()
+	}
+	return 0
+}
+
+func TestRequestQueueRejectsRequestsAboveQueueSize(t *testing.T) {
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	handler := RequestQueue(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}), httphandlerconfig.RequestQueueConfig{Workers: 1, QueueSize: 2})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(srv.URL + "/bucket/key")
+			if err == nil {
+				statuses <- resp.StatusCode
+				_ = resp.Body.Close()
+			}
+		}()
+	}
+	<-started
+	waitFor(t, func() bool { return queueDepth() == 2 }, "two requests should wait in queue")
+
+	resp, err := http.Get(srv.URL + "/bucket/key")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+	assert.NoError(t, resp.Body.Close())
+
+	close(release)
+	wg.Wait()
+	close(statuses)
+	for status := range statuses {
+		assert.Equal(t, http.StatusOK, status)
+	}
+	assert.Equal(t, int64(0), queueDepth())
+}
+
+func TestRequestQueueIsDisabledWithoutWorkers(t *testing.T) {
+	handler := RequestQueue(http.NotFoundHandler(), httphandlerconfig.RequestQueueConfig{QueueSize: 10})
+	_, queued := handler.(*requestQueue)
+	assert.False(t, queued)
+}
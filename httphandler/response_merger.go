@@ -16,6 +16,7 @@ import (
 type responseMerger struct {
 	syncerrlog      log.Logger
 	methodSetFilter set.Set
+	backendSyncLog  map[string]bool
 	fifo            bool
 }
 
@@ -32,6 +33,10 @@ func (rd *responseMerger) synclog(r, successfulTup transport.ReqResErrTuple) {
 	if (successfulTup == transport.ReqResErrTuple{}) {
 		return
 	}
+	// do not log failures of backends excluded from sync log
+	if !syncLogged(rd.backendSyncLog, r.Req.URL.Host) {
+		return
+	}
 	// log error entry
 	errorMsg := "No error"
 	if r.Err != nil {
@@ -44,7 +49,7 @@ func (rd *responseMerger) synclog(r, successfulTup transport.ReqResErrTuple) {
 	syncLogMsg := NewSyncLogMessageData(
 		r.Req.Method,
 		r.Req.Host,
-		successfulTup.Req.URL.Path,
+		syncLogPath(successfulTup.Req.URL),
 		successfulTup.Req.Host,
 		r.Req.Header.Get("User-Agent"),
 		reqID,
@@ -153,6 +158,7 @@ func EarliestResponseHandler(conf config.Config) transport.MultipleResponsesHand
 	rh := responseMerger{
 		conf.Synclog,
 		conf.SyncLogMethodsSet,
+		conf.BackendSyncLog,
 		true,
 	}
 	return rh.handleResponses
@@ -165,6 +171,7 @@ func LateResponseHandler(conf config.Config) transport.MultipleResponsesHandler
 	rh := responseMerger{
 		conf.Synclog,
 		conf.SyncLogMethodsSet,
+		conf.BackendSyncLog,
 		false,
 	}
 	return rh.handleResponses
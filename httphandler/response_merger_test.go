@@ -0,0 +1,134 @@
+package httphandler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/transport"
+	set "github.com/deckarep/golang-set"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// lockedBuffer collects log written from other goroutines
+type lockedBuffer struct {
+	mx  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (lb *lockedBuffer) Write(p []byte) (int, error) {
+	lb.mx.Lock()
+	defer lb.mx.Unlock()
+	return lb.buf.Write(p)
+}
+
+func (lb *lockedBuffer) Bytes() []byte {
+	lb.mx.Lock()
+	defer lb.mx.Unlock()
+	return append([]byte{}, lb.buf.Bytes()...)
+}
+
+// closeCountingBody counts closed bodies, response merger closes bodies of
+// failed responses once they are synclogged
+type closeCountingBody struct {
+	io.ReadCloser
+	closed *int32
+}
+
+func (cb *closeCountingBody) Close() error {
+	atomic.AddInt32(cb.closed, 1)
+	return cb.ReadCloser.Close()
+}
+
+func TestSynclogKeepsTaggingSubresourceInPath(t *testing.T) {
+	okBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer okBackend.Close()
+	okURL, _ := url.Parse(okBackend.URL)
+	var synclog lockedBuffer
+	conf := config.Config{
+		Synclog: &logrus.Logger{
+			Out:       &synclog,
+			Formatter: log.PlainTextFormatter{},
+			Hooks:     make(logrus.LevelHooks),
+			Level:     logrus.DebugLevel,
+		},
+		SyncLogMethodsSet: set.NewSetFromSlice([]interface{}{"PUT"}),
+	}
+	transp := transport.NewMultiTransport(http.DefaultTransport, []url.URL{*okURL, mkFailingBackend()},
+		LateResponseHandler(conf), transport.MultiTransportOptions{})
+
+	req, _ := http.NewRequest("PUT", "http://localhost/bucket/key?tagging", strings.NewReader("<Tagging><TagSet/></Tagging>"))
+	req = req.WithContext(context.WithValue(req.Context(), log.ContextreqIDKey, "reqid"))
+	resp, err := transp.RoundTrip(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	// failures are synclogged once response is returned
+	deadline := time.Now().Add(time.Second)
+	for len(synclog.Bytes()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	entry := SyncLogMessageData{}
+	assert.NoError(t, json.Unmarshal(bytes.TrimSpace(synclog.Bytes()), &entry))
+	assert.Equal(t, "/bucket/key?tagging", entry.Path)
+	assert.Equal(t, "PUT", entry.Method)
+}
+
+func TestSynclogSkipsFailuresOfBackendsExcludedFromSyncLog(t *testing.T) {
+	okBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer okBackend.Close()
+	okURL, _ := url.Parse(okBackend.URL)
+	primary, experimental := mkFailingBackend(), mkFailingBackend()
+	var synclog lockedBuffer
+	conf := config.Config{
+		YamlConfig: config.YamlConfig{
+			BackendSyncLog: map[string]bool{primary.Host: true, experimental.Host: false},
+		},
+		Synclog: &logrus.Logger{
+			Out:       &synclog,
+			Formatter: log.PlainTextFormatter{},
+			Hooks:     make(logrus.LevelHooks),
+			Level:     logrus.DebugLevel,
+		},
+		SyncLogMethodsSet: set.NewSetFromSlice([]interface{}{"PUT"}),
+	}
+	var closed int32
+	backendTransport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err == nil {
+			resp.Body = &closeCountingBody{resp.Body, &closed}
+		}
+		return resp, err
+	})
+	transp := transport.NewMultiTransport(backendTransport, []url.URL{*okURL, primary, experimental},
+		LateResponseHandler(conf), transport.MultiTransportOptions{})
+
+	req, _ := http.NewRequest("PUT", "http://localhost/bucket/key", strings.NewReader("data"))
+	req = req.WithContext(context.WithValue(req.Context(), log.ContextreqIDKey, "reqid"))
+	resp, err := transp.RoundTrip(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	waitFor(t, func() bool { return atomic.LoadInt32(&closed) == 2 }, "failed responses should be handled")
+	lines := strings.Split(strings.TrimSpace(string(synclog.Bytes())), "\n")
+	assert.Len(t, lines, 1)
+	entry := SyncLogMessageData{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, primary.Host, entry.FailedHost)
+}
@@ -0,0 +1,150 @@
+package httphandler
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// verifiedBody hashes response body as client reads it, verification is
+// started once body read completely is closed
+type verifiedBody struct {
+	io.ReadCloser
+	hash     hash.Hash
+	size     int64
+	complete bool
+	once     sync.Once
+	verify   func(sum []byte, size int64)
+}
+
+func (vb *verifiedBody) Read(p []byte) (int, error) {
+	n, err := vb.ReadCloser.Read(p)
+	_, _ = vb.hash.Write(p[:n])
+	vb.size += int64(n)
+	if err == io.EOF {
+		vb.complete = true
+	}
+	return n, err
+}
+
+func (vb *verifiedBody) Close() error {
+	err := vb.ReadCloser.Close()
+	vb.once.Do(func() {
+		if !vb.complete {
+			metrics.Mark("reqs.global.verification.skipped")
+			return
+		}
+		go vb.verify(vb.hash.Sum(nil), vb.size)
+	})
+	return err
+}
+
+type responseVerifier struct {
+	backend      *url.URL
+	sampleRate   float64
+	random       func() float64
+	verifier     http.RoundTripper
+	roundTripper http.RoundTripper
+}
+
+func (rv *responseVerifier) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || rv.random() >= rv.sampleRate {
+		return rv.roundTripper.RoundTrip(req)
+	}
+	verificationReq, err := rv.verificationRequest(req)
+	resp, respErr := rv.roundTripper.RoundTrip(req)
+	if err != nil || respErr != nil ||
+		resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return resp, respErr
+	}
+	status, encoding := resp.StatusCode, resp.Header.Get("Content-Encoding")
+	resp.Body = &verifiedBody{ReadCloser: resp.Body, hash: md5.New(), verify: func(sum []byte, size int64) {
+		rv.verify(verificationReq, status, encoding, sum, size)
+	}}
+	return resp, nil
+}
+
+// verificationRequest copies req, addressed to verification backend. It
+// doesn't share context of req, so it outlives client request
+func (rv *responseVerifier) verificationRequest(req *http.Request) (*http.Request, error) {
+	u := *req.URL
+	u.Scheme = rv.backend.Scheme
+	u.Host = rv.backend.Host
+	verificationReq, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range req.Header {
+		verificationReq.Header[name] = values
+	}
+	verificationReq.Host = req.Host
+	ctx := context.WithValue(context.Background(), log.ContextreqIDKey, req.Context().Value(log.ContextreqIDKey))
+	return verificationReq.WithContext(ctx), nil
+}
+
+// verify compares response bodies as sent by backends, encoded ones (e.g.
+// Content-Encoding: gzip) are compared without decoding
+func (rv *responseVerifier) verify(req *http.Request, status int, encoding string, sum []byte, size int64) {
+	reqID, _ := req.Context().Value(log.ContextreqIDKey).(string)
+	resp, err := rv.verifier.RoundTrip(req)
+	if err != nil {
+		metrics.Mark("reqs.global.verification.errors")
+		log.Printf("Cannot verify response of %s on %s: %s, request %s", req.URL.Path, rv.backend.Host, err, reqID)
+		return
+	}
+	defer func() { _ = resp.Body.Close() }()
+	verificationHash := md5.New()
+	verificationSize, err := io.Copy(verificationHash, resp.Body)
+	if err != nil {
+		metrics.Mark("reqs.global.verification.errors")
+		log.Printf("Cannot verify response of %s on %s: %s, request %s", req.URL.Path, rv.backend.Host, err, reqID)
+		return
+	}
+	var mismatch string
+	switch verificationSum := verificationHash.Sum(nil); {
+	case resp.StatusCode != status:
+		mismatch = fmt.Sprintf("status %d, verification status %d", status, resp.StatusCode)
+	case resp.Header.Get("Content-Encoding") != encoding:
+		mismatch = fmt.Sprintf("encoding %q, verification encoding %q", encoding, resp.Header.Get("Content-Encoding"))
+	case verificationSize != size:
+		mismatch = fmt.Sprintf("size %d, verification size %d", size, verificationSize)
+	case !bytes.Equal(verificationSum, sum):
+		mismatch = fmt.Sprintf("md5 %x, verification md5 %x", sum, verificationSum)
+	}
+	if mismatch == "" {
+		metrics.Mark("reqs.global.verification.matched")
+		return
+	}
+	metrics.Mark("reqs.global.verification.mismatched")
+	log.Printf("Response of %s differs from verification backend %s, %s, request %s",
+		req.URL.Path, rv.backend.Host, mismatch, reqID)
+}
+
+// ResponseVerifier creates Decorator which compares sampleRate fraction of
+// GET responses with responses of verification backend. Verification backend
+// is requested with verifier only after client read whole response, so client
+// doesn't wait for it. Mismatches are logged to Mainlog. Nil backend disables it
+func ResponseVerifier(backend *url.URL, sampleRate float64, verifier http.RoundTripper) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if backend == nil || sampleRate <= 0 {
+			return roundTripper
+		}
+		return &responseVerifier{
+			backend:      backend,
+			sampleRate:   sampleRate,
+			random:       rand.Float64,
+			verifier:     verifier,
+			roundTripper: roundTripper,
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package httphandler
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/log"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mkCountingServer(content string, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		_, _ = w.Write([]byte(content))
+	}))
+}
+
+func verifiedGet(t *testing.T, primary *httptest.Server, verification string, sampleRate float64) (*lockedBuffer, func()) {
+	logBuffer := &lockedBuffer{}
+	defaultLogger := log.DefaultLogger
+	log.DefaultLogger = &logrus.Logger{
+		Out:       logBuffer,
+		Formatter: log.PlainTextFormatter{},
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.DebugLevel,
+	}
+	verificationURL, _ := url.Parse(verification)
+	// backend transport passes encoded bodies as stored
+	backendTransport, err := ConfigureHTTPTransport(config.Config{})
+	require.NoError(t, err)
+	rt := Decorate(backendTransport, ResponseVerifier(verificationURL, sampleRate, backendTransport))
+
+	req, _ := http.NewRequest(http.MethodGet, primary.URL+"/bucket/key", nil)
+	req = req.WithContext(context.WithValue(req.Context(), log.ContextreqIDKey, "reqid"))
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(body))
+	require.NoError(t, resp.Body.Close())
+	return logBuffer, func() { log.DefaultLogger = defaultLogger }
+}
+
+func TestResponseVerifierAcceptsMatchingResponse(t *testing.T) {
+	var primaryCalls, verificationCalls int32
+	primary, verification := mkCountingServer("data", &primaryCalls), mkCountingServer("data", &verificationCalls)
+	defer primary.Close()
+	defer verification.Close()
+
+	logBuffer, restore := verifiedGet(t, primary, verification.URL, 1)
+	defer restore()
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&verificationCalls) == 1 }, "response should be verified")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&primaryCalls))
+	assert.NotContains(t, string(logBuffer.Bytes()), "differs")
+}
+
+func TestResponseVerifierLogsMismatchingResponse(t *testing.T) {
+	var primaryCalls, verificationCalls int32
+	primary, verification := mkCountingServer("data", &primaryCalls), mkCountingServer("dat4", &verificationCalls)
+	defer primary.Close()
+	defer verification.Close()
+
+	logBuffer, restore := verifiedGet(t, primary, verification.URL, 1)
+	defer restore()
+
+	waitFor(t, func() bool { return len(logBuffer.Bytes()) > 0 }, "mismatch should be logged")
+	verificationURL, _ := url.Parse(verification.URL)
+	assert.Contains(t, string(logBuffer.Bytes()),
+		"Response of /bucket/key differs from verification backend "+verificationURL.Host+", md5")
+	assert.Contains(t, string(logBuffer.Bytes()), "request reqid")
+}
+
+func TestResponseVerifierSkipsUnsampledRequests(t *testing.T) {
+	var primaryCalls, verificationCalls int32
+	primary, verification := mkCountingServer("data", &primaryCalls), mkCountingServer("data", &verificationCalls)
+	defer primary.Close()
+	defer verification.Close()
+	verificationURL, _ := url.Parse(verification.URL)
+	verifier := ResponseVerifier(verificationURL, 0.5, http.DefaultTransport)(http.DefaultTransport).(*responseVerifier)
+	verifier.random = func() float64 { return 0.7 }
+
+	req, _ := http.NewRequest(http.MethodGet, primary.URL+"/bucket/key", nil)
+	resp, err := verifier.RoundTrip(req)
+	require.NoError(t, err)
+	_, _ = ioutil.ReadAll(resp.Body)
+	require.NoError(t, resp.Body.Close())
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&verificationCalls))
+	assert.Equal(t, http.DefaultTransport, Decorate(http.DefaultTransport, ResponseVerifier(nil, 1, http.DefaultTransport)))
+}
+
+func TestResponseVerifierComparesContentEncoding(t *testing.T) {
+	encoded := func(encoding string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if encoding != "" {
+				w.Header().Set("Content-Encoding", encoding)
+			}
+			_, _ = w.Write([]byte("data"))
+		}))
+	}
+	primary, verification := encoded("gzip"), encoded("")
+	defer primary.Close()
+	defer verification.Close()
+
+	logBuffer, restore := verifiedGet(t, primary, verification.URL, 1)
+	defer restore()
+
+	waitFor(t, func() bool { return len(logBuffer.Bytes()) > 0 }, "mismatch should be logged")
+	assert.Contains(t, string(logBuffer.Bytes()), `encoding "gzip", verification encoding ""`)
+}
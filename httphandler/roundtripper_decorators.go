@@ -1,15 +1,32 @@
 package httphandler
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"io/ioutil"
 
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
 	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
 	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/allegro/akubra/transport"
 )
 
 // Decorator is http.RoundTripper interface wrapper
@@ -18,11 +35,77 @@ type Decorator func(http.RoundTripper) http.RoundTripper
 type loggingRoundTripper struct {
 	roundTripper http.RoundTripper
 	accessLog    log.Logger
+	healthProbes httphandlerconfig.HealthProbesConfig
+	fields       httphandlerconfig.AccessLogFieldsConfig
+	countBytes   bool
+}
+
+// countingBody counts bytes read through it. onClose is called once, with
+// number of bytes read, when body is closed
+type countingBody struct {
+	io.ReadCloser
+	bytes   int64
+	onClose func(int64)
+	once    sync.Once
+}
+
+func (cb *countingBody) Read(p []byte) (int, error) {
+	n, err := cb.ReadCloser.Read(p)
+	atomic.AddInt64(&cb.bytes, int64(n))
+	return n, err
+}
+
+func (cb *countingBody) count() int64 {
+	if cb == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&cb.bytes)
+}
+
+func (cb *countingBody) Close() error {
+	err := cb.ReadCloser.Close()
+	cb.once.Do(func() {
+		if cb.onClose != nil {
+			cb.onClose(cb.count())
+		}
+	})
+	return err
+}
+
+func (lrt *loggingRoundTripper) isHealthProbe(req *http.Request) bool {
+	for _, path := range lrt.healthProbes.Paths {
+		if req.URL.Path == path {
+			return true
+		}
+	}
+	userAgent := req.UserAgent()
+	for _, prefix := range lrt.healthProbes.UserAgents {
+		if strings.HasPrefix(userAgent, prefix) {
+			return true
+		}
+	}
+	return false
 }
 
 func (lrt *loggingRoundTripper) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	if lrt.isHealthProbe(req) {
+		metrics.Mark("reqs.global.health_probes")
+		return lrt.roundTripper.RoundTrip(req)
+	}
 
 	timeStart := time.Now()
+	ctx := context.WithValue(req.Context(), transport.ContextRoutingDecisionKey, &transport.RoutingDecision{})
+	timing, ok := ctx.Value(transport.ContextServerTimingKey).(*transport.ServerTiming)
+	if !ok && lrt.fields.Includes("backends") {
+		timing = &transport.ServerTiming{}
+		ctx = context.WithValue(ctx, transport.ContextServerTimingKey, timing)
+	}
+	req = req.WithContext(ctx)
+	var requestBody *countingBody
+	if lrt.countBytes && req.Body != nil && req.Body != http.NoBody {
+		requestBody = &countingBody{ReadCloser: req.Body}
+		req.Body = requestBody
+	}
 	resp, err = lrt.roundTripper.RoundTrip(req)
 
 	duration := time.Since(timeStart).Seconds()
@@ -40,19 +123,57 @@ func (lrt *loggingRoundTripper) RoundTrip(req *http.Request) (resp *http.Respons
 		statusCode,
 		duration,
 		errStr)
-	jsonb, almerr := json.Marshal(accessLogMessage)
+	accessLogMessage.Bytes = -1
+	if resp != nil {
+		accessLogMessage.Bytes = resp.ContentLength
+	}
+	if timing != nil {
+		accessLogMessage.Backends = newBackendAccessData(timing.Timings())
+	}
+	if !lrt.countBytes {
+		lrt.write(accessLogMessage, statusCode)
+		return
+	}
+	accessLogMessage.RequestBytes = requestBody.count()
+	if resp == nil || resp.Body == nil {
+		lrt.write(accessLogMessage, statusCode)
+		return
+	}
+	// entry is written once client got whole response body
+	resp.Body = &countingBody{ReadCloser: resp.Body, onClose: func(sent int64) {
+		accessLogMessage.Bytes = sent
+		accessLogMessage.RequestBytes = requestBody.count()
+		metrics.UpdateHistogram("reqs.global.request_bytes", accessLogMessage.RequestBytes)
+		metrics.UpdateHistogram("reqs.global.response_bytes", sent)
+		lrt.write(accessLogMessage, statusCode)
+	}}
+	return
+}
+
+func (lrt *loggingRoundTripper) write(accessLogMessage *AccessMessageData, statusCode int) {
+	var jsonb []byte
+	var almerr error
+	if fields, selected := lrt.fields.Fields(statusCode); selected {
+		jsonb, almerr = accessLogMessage.selectFields(fields)
+	} else {
+		jsonb, almerr = json.Marshal(accessLogMessage)
+	}
 	if almerr != nil {
 		log.Printf("Cannot marshal access log message %s", almerr.Error())
 		return
 	}
 	lrt.accessLog.Printf("%s", jsonb)
-	return
 }
 
-// AccessLogging creares Decorator with access log collector
-func AccessLogging(logger log.Logger) Decorator {
+// AccessLogging creares Decorator with access log collector, health probes
+// are passed without logging. Logged fields may be limited per status class.
+// With countBytes bodies are counted and entry is written when response
+// body is closed, so it holds bytes actually transferred
+func AccessLogging(logger log.Logger, healthProbes httphandlerconfig.HealthProbesConfig,
+	fields httphandlerconfig.AccessLogFieldsConfig, countBytes bool) Decorator {
 	return func(rt http.RoundTripper) http.RoundTripper {
-		return &loggingRoundTripper{roundTripper: rt, accessLog: logger}
+		return &loggingRoundTripper{roundTripper: rt, accessLog: logger, healthProbes: healthProbes,
+			fields: fields, countBytes: countBytes}
 	}
 }
 
@@ -106,6 +227,664 @@ func HeadersSuplier(requestHeaders, responseHeaders shardingconfig.AdditionalHea
 	}
 }
 
+// hopByHopHeaders are defined in RFC 7230 section 6.1
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type backendHeadersSuplier struct {
+	requestHeaders map[string]shardingconfig.AdditionalHeaders
+	roundTripper   http.RoundTripper
+}
+
+func (bhs *backendHeadersSuplier) RoundTrip(req *http.Request) (*http.Response, error) {
+	for k, v := range bhs.requestHeaders[req.URL.Host] {
+		req.Header.Set(k, v)
+	}
+	return bhs.roundTripper.RoundTrip(req)
+}
+
+// BackendHeadersSuplier creates Decorator which adds headers specific
+// for backend (matched by host) to request
+func BackendHeadersSuplier(requestHeaders map[string]shardingconfig.AdditionalHeaders) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		return &backendHeadersSuplier{
+			requestHeaders: requestHeaders,
+			roundTripper:   roundTripper}
+	}
+}
+
+type hopByHopFilter struct {
+	forwardHeaders map[string]bool
+	roundTripper   http.RoundTripper
+}
+
+func (hf *hopByHopFilter) strip(header http.Header) {
+	if header == nil {
+		return
+	}
+	for _, connectionValue := range header["Connection"] {
+		for _, token := range strings.Split(connectionValue, ",") {
+			token = http.CanonicalHeaderKey(strings.TrimSpace(token))
+			// user metadata has to reach every replica unchanged
+			if token != "" && !hf.forwardHeaders[token] && !strings.HasPrefix(token, "X-Amz-Meta-") {
+				header.Del(token)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		if !hf.forwardHeaders[name] {
+			header.Del(name)
+		}
+	}
+}
+
+func (hf *hopByHopFilter) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	hf.strip(req.Header)
+	resp, err = hf.roundTripper.RoundTrip(req)
+	if resp != nil {
+		hf.strip(resp.Header)
+	}
+	return
+}
+
+// HopByHopHeadersFilter creates Decorator which removes hop-by-hop headers
+// from request and response. Headers listed in forwardHeaders are passed verbatim
+func HopByHopHeadersFilter(forwardHeaders []string) Decorator {
+	allowed := make(map[string]bool, len(forwardHeaders))
+	for _, name := range forwardHeaders {
+		allowed[http.CanonicalHeaderKey(name)] = true
+	}
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		return &hopByHopFilter{forwardHeaders: allowed, roundTripper: roundTripper}
+	}
+}
+
+// viaPseudonym identifies akubra in Via header
+const viaPseudonym = "akubra"
+
+type viaHeader struct {
+	mode         string
+	roundTripper http.RoundTripper
+}
+
+// via updates Via header of message received with given protocol version
+func (vh *viaHeader) via(header http.Header, protoMajor, protoMinor int) {
+	switch vh.mode {
+	case httphandlerconfig.ViaStrip:
+		header.Del("Via")
+	case httphandlerconfig.ViaPassthrough:
+	default:
+		header.Add("Via", fmt.Sprintf("%d.%d %s", protoMajor, protoMinor, viaPseudonym))
+	}
+}
+
+func (vh *viaHeader) RoundTrip(req *http.Request) (*http.Response, error) {
+	vh.via(req.Header, req.ProtoMajor, req.ProtoMinor)
+	resp, err := vh.roundTripper.RoundTrip(req)
+	if resp != nil {
+		vh.via(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+	}
+	return resp, err
+}
+
+// ViaHeader creates Decorator which appends akubra to Via header of requests
+// and responses (RFC 7230 section 5.7.1), strips it or passes it unchanged,
+// depending on mode. Empty mode adds Via
+func ViaHeader(mode string) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if mode == httphandlerconfig.ViaPassthrough {
+			return roundTripper
+		}
+		return &viaHeader{mode: mode, roundTripper: roundTripper}
+	}
+}
+
+// sizeCountingBody counts bytes read from backend response body
+// and reports them once body is fully read or closed
+type sizeCountingBody struct {
+	io.ReadCloser
+	host                 string
+	largeObjectThreshold int64
+	size                 int64
+	once                 sync.Once
+}
+
+func (scb *sizeCountingBody) report() {
+	scb.once.Do(func() {
+		metricsPrefix := "reqs.backend." + metrics.Clean(scb.host)
+		metrics.UpdateHistogram(metricsPrefix+".response_bytes", scb.size)
+		if scb.largeObjectThreshold > 0 && scb.size > scb.largeObjectThreshold {
+			metrics.Mark(metricsPrefix + ".large_objects")
+		}
+	})
+}
+
+func (scb *sizeCountingBody) Read(p []byte) (int, error) {
+	n, err := scb.ReadCloser.Read(p)
+	scb.size += int64(n)
+	if err == io.EOF {
+		scb.report()
+	}
+	return n, err
+}
+
+func (scb *sizeCountingBody) Close() error {
+	scb.report()
+	return scb.ReadCloser.Close()
+}
+
+type responseSizeMetrics struct {
+	largeObjectThreshold int64
+	roundTripper         http.RoundTripper
+}
+
+func (rsm *responseSizeMetrics) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	resp, err = rsm.roundTripper.RoundTrip(req)
+	if err != nil || resp == nil || resp.Body == nil {
+		return
+	}
+	resp.Body = &sizeCountingBody{
+		ReadCloser:           resp.Body,
+		host:                 req.URL.Host,
+		largeObjectThreshold: rsm.largeObjectThreshold,
+	}
+	return
+}
+
+// ResponseSizeMetrics creates Decorator which collects backend response body
+// sizes and counts responses larger than largeObjectThreshold
+func ResponseSizeMetrics(largeObjectThreshold int64) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		return &responseSizeMetrics{
+			largeObjectThreshold: largeObjectThreshold,
+			roundTripper:         roundTripper,
+		}
+	}
+}
+
+// parseByteRange parses single range Range header value (e.g. "bytes=0-1023",
+// "bytes=100-", "bytes=-500") against content of given size and returns
+// first and last byte position. Multiple ranges are not supported
+func parseByteRange(header string, size int64) (start, end int64, ok bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) || strings.Contains(header, ",") {
+		return 0, 0, false
+	}
+	bounds := strings.SplitN(strings.TrimSpace(header[len(prefix):]), "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, false
+	}
+	startStr, endStr := strings.TrimSpace(bounds[0]), strings.TrimSpace(bounds[1])
+	if startStr == "" {
+		suffix, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || suffix <= 0 {
+			return 0, 0, false
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, size - 1, true
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	end = size - 1
+	if endStr != "" {
+		end, err = strconv.ParseInt(endStr, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
+
+type rangeEmulator struct {
+	roundTripper http.RoundTripper
+}
+
+func (re *rangeEmulator) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := re.roundTripper.RoundTrip(req)
+	rangeHeader := req.Header.Get("Range")
+	if err != nil || rangeHeader == "" || req.Method != http.MethodGet ||
+		resp.StatusCode != http.StatusOK || resp.ContentLength < 0 {
+		return resp, err
+	}
+	size := resp.ContentLength
+	start, end, ok := parseByteRange(rangeHeader, size)
+	if !ok {
+		return resp, err
+	}
+	if start >= size {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+		resp.StatusCode = http.StatusRequestedRangeNotSatisfiable
+		resp.Status = http.StatusText(http.StatusRequestedRangeNotSatisfiable)
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		resp.Header.Set("Content-Length", "0")
+		resp.ContentLength = 0
+		resp.Body = ioutil.NopCloser(strings.NewReader(""))
+		return resp, nil
+	}
+	if _, err = io.CopyN(ioutil.Discard, resp.Body, start); err != nil {
+		_ = resp.Body.Close()
+		return nil, err
+	}
+	length := end - start + 1
+	log.Debugf("Backend %s ignored Range header, serving bytes %d-%d/%d by akubra",
+		req.URL.Host, start, end, size)
+	metrics.Mark("reqs.backend." + metrics.Clean(req.URL.Host) + ".range_emulated")
+	resp.StatusCode = http.StatusPartialContent
+	resp.Status = http.StatusText(http.StatusPartialContent)
+	resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	resp.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	resp.ContentLength = length
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(resp.Body, length), resp.Body}
+	return resp, nil
+}
+
+// RangeEmulator serves requested byte range from full body if backend
+// answered Range request with 200 instead of 206
+func RangeEmulator(roundTripper http.RoundTripper) http.RoundTripper {
+	return &rangeEmulator{roundTripper: roundTripper}
+}
+
+// ErrExpectContinueTimeout is returned if backend did not answer
+// "Expect: 100-continue" request in time
+var ErrExpectContinueTimeout = errors.New("Backend did not send 100 Continue in time")
+
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (cb *cancelOnCloseBody) Close() error {
+	err := cb.ReadCloser.Close()
+	cb.cancel()
+	return err
+}
+
+type expectContinueGuard struct {
+	timeout      time.Duration
+	roundTripper http.RoundTripper
+}
+
+func (ecg *expectContinueGuard) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		return ecg.roundTripper.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	var timedOut int32
+	var mx sync.Mutex
+	var timer *time.Timer
+	stopTimer := func() {
+		mx.Lock()
+		defer mx.Unlock()
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	trace := &httptrace.ClientTrace{
+		Wait100Continue: func() {
+			mx.Lock()
+			defer mx.Unlock()
+			timer = time.AfterFunc(ecg.timeout, func() {
+				atomic.StoreInt32(&timedOut, 1)
+				cancel()
+			})
+		},
+		Got100Continue:       stopTimer,
+		GotFirstResponseByte: stopTimer,
+	}
+	resp, err := ecg.roundTripper.RoundTrip(req.WithContext(httptrace.WithClientTrace(ctx, trace)))
+	stopTimer()
+	if atomic.LoadInt32(&timedOut) == 1 {
+		if resp != nil && resp.Body != nil {
+			_ = resp.Body.Close()
+		}
+		cancel()
+		metrics.Mark("reqs.backend." + metrics.Clean(req.URL.Host) + ".continue_timeouts")
+		return nil, ErrExpectContinueTimeout
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnCloseBody{resp.Body, cancel}
+	return resp, nil
+}
+
+// ExpectContinueGuard creates Decorator which fails "Expect: 100-continue"
+// requests if backend did not answer them within timeout, instead of sending body anyway
+func ExpectContinueGuard(timeout time.Duration, enabled bool) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if !enabled {
+			return roundTripper
+		}
+		return &expectContinueGuard{timeout: timeout, roundTripper: roundTripper}
+	}
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '_' || c == '.' || c == '~'
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// s3NormalizeEscapedPath re-encodes escaped path the way S3 does for request
+// signing: all bytes except unreserved characters (RFC 3986) and slash are
+// percent-encoded. Encoded slash (%2F) is part of key, it's kept encoded
+func s3NormalizeEscapedPath(path string) string {
+	const upperhex = "0123456789ABCDEF"
+	escaped := make([]byte, 0, len(path))
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c == '%' && i+2 < len(path) {
+			hi, hiOk := unhex(path[i+1])
+			lo, loOk := unhex(path[i+2])
+			if hiOk && loOk {
+				c = hi<<4 | lo
+				i += 2
+				if isUnreserved(c) {
+					escaped = append(escaped, c)
+				} else {
+					escaped = append(escaped, '%', upperhex[c>>4], upperhex[c&15])
+				}
+				continue
+			}
+		}
+		if isUnreserved(c) || c == '/' {
+			escaped = append(escaped, c)
+			continue
+		}
+		escaped = append(escaped, '%', upperhex[c>>4], upperhex[c&15])
+	}
+	return string(escaped)
+}
+
+type keyNormalizer struct {
+	roundTripper http.RoundTripper
+}
+
+func (kn *keyNormalizer) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.RawPath = s3NormalizeEscapedPath(req.URL.EscapedPath())
+	return kn.roundTripper.RoundTrip(req)
+}
+
+// KeyNormalizer creates Decorator which canonicalizes request path encoding,
+// so equivalently encoded object keys are forwarded identically to all backends
+func KeyNormalizer(enabled bool) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if !enabled {
+			return roundTripper
+		}
+		return &keyNormalizer{roundTripper: roundTripper}
+	}
+}
+
+// bucketRootPath maps "/bucket" and "/bucket/" paths to form given by mode,
+// other paths, including object keys ending with slash, are not changed
+func bucketRootPath(path, mode string) string {
+	if !strings.HasPrefix(path, "/") {
+		return path
+	}
+	bucket := strings.TrimSuffix(path[1:], "/")
+	if bucket == "" || strings.Contains(bucket, "/") {
+		return path
+	}
+	if mode == httphandlerconfig.BucketRootWithSlash {
+		return "/" + bucket + "/"
+	}
+	return "/" + bucket
+}
+
+type bucketRootNormalizer struct {
+	mode         string
+	roundTripper http.RoundTripper
+}
+
+func (brn *bucketRootNormalizer) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Path = bucketRootPath(req.URL.Path, brn.mode)
+	if req.URL.RawPath != "" {
+		req.URL.RawPath = bucketRootPath(req.URL.RawPath, brn.mode)
+	}
+	return brn.roundTripper.RoundTrip(req)
+}
+
+// BucketRootNormalizer creates Decorator which forwards bucket root requests
+// with or without trailing slash, depending on mode. Empty mode disables it
+func BucketRootNormalizer(mode string) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if mode == "" {
+			return roundTripper
+		}
+		return &bucketRootNormalizer{mode: mode, roundTripper: roundTripper}
+	}
+}
+
+type compiledRewriteRule struct {
+	match       *regexp.Regexp
+	replace     string
+	metricLabel string
+}
+
+type pathRewriter struct {
+	rules []compiledRewriteRule
+	all   bool
+	// labeled is true if any rule has MetricLabel, otherwise requests are
+	// not counted
+	labeled      bool
+	roundTripper http.RoundTripper
+}
+
+// rewrite returns path rewritten by matching rules and MetricLabel of first
+// of them
+func (pr *pathRewriter) rewrite(path string) (string, string) {
+	label := ""
+	for _, rule := range pr.rules {
+		if !rule.match.MatchString(path) {
+			continue
+		}
+		path = rule.match.ReplaceAllString(path, rule.replace)
+		if label == "" {
+			label = rule.metricLabel
+		}
+		if !pr.all {
+			break
+		}
+	}
+	return path, label
+}
+
+func (pr *pathRewriter) RoundTrip(req *http.Request) (*http.Response, error) {
+	rewritten, label := pr.rewrite(req.URL.Path)
+	if pr.labeled {
+		if label == "" {
+			label = httphandlerconfig.DefaultRuleMetricLabel
+		}
+		metrics.Mark("reqs.rules." + metrics.Clean(label))
+	}
+	if rewritten != req.URL.Path {
+		log.Debugf("Rewrote request path %s to %s", req.URL.Path, rewritten)
+		req.URL.Path = rewritten
+		req.URL.RawPath = ""
+	}
+	return pr.roundTripper.RoundTrip(req)
+}
+
+// PathRewriter creates Decorator which rewrites request path with rules in
+// order, mode tells if only first matching rule is applied or all of them.
+// If any rule has MetricLabel, requests are counted per label of first
+// matching rule, so metrics cardinality is bounded by number of labels.
+// Rules are validated by config.Configure
+func PathRewriter(rules []httphandlerconfig.RewriteRule, mode string) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if len(rules) == 0 {
+			return roundTripper
+		}
+		compiled := make([]compiledRewriteRule, 0, len(rules))
+		labeled := false
+		for _, rule := range rules {
+			compiled = append(compiled, compiledRewriteRule{
+				match:       regexp.MustCompile(rule.Match),
+				replace:     rule.Replace,
+				metricLabel: rule.MetricLabel,
+			})
+			labeled = labeled || rule.MetricLabel != ""
+		}
+		return &pathRewriter{rules: compiled, all: mode == httphandlerconfig.RewriteAllMatches,
+			labeled: labeled, roundTripper: roundTripper}
+	}
+}
+
+type locationRewriter struct {
+	location     string
+	roundTripper http.RoundTripper
+}
+
+func isLocationRequest(req *http.Request) bool {
+	_, ok := req.URL.Query()["location"]
+	bucket := strings.Trim(req.URL.Path, "/")
+	return ok && req.Method == http.MethodGet && bucket != "" && !strings.Contains(bucket, "/")
+}
+
+func (lr *locationRewriter) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := lr.roundTripper.RoundTrip(req)
+	if err == nil && transport.IsBucketHead(req) && resp.StatusCode == http.StatusOK {
+		resp.Header.Set("X-Amz-Bucket-Region", lr.location)
+		return resp, nil
+	}
+	if err != nil || resp.StatusCode != http.StatusOK || !isLocationRequest(req) {
+		return resp, err
+	}
+	if _, discardErr := io.Copy(ioutil.Discard, resp.Body); discardErr != nil {
+		log.Debugf("Could not discard location response body: %s", discardErr)
+	}
+	if closeErr := resp.Body.Close(); closeErr != nil {
+		log.Debugf("Could not close location response body: %s", closeErr)
+	}
+	body, err := xml.Marshal(LocationConstraint{
+		XMLNS:    "http://s3.amazonaws.com/doc/2006-03-01/",
+		Location: lr.location,
+	})
+	if err != nil {
+		return nil, err
+	}
+	body = append([]byte(xml.Header), body...)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Set("Content-Type", "application/xml")
+	return resp, nil
+}
+
+// LocationConstraint is S3 GET bucket location response body
+type LocationConstraint struct {
+	XMLName  xml.Name `xml:"LocationConstraint"`
+	XMLNS    string   `xml:"xmlns,attr"`
+	Location string   `xml:",chardata"`
+}
+
+// LocationConstraintRewriter creates Decorator which replaces backend answer
+// to GET bucket location request with configured location, which is also
+// reported in X-Amz-Bucket-Region header of HEAD bucket responses. Empty
+// location disables rewriting
+func LocationConstraintRewriter(location string) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if location == "" {
+			return roundTripper
+		}
+		return &locationRewriter{location: location, roundTripper: roundTripper}
+	}
+}
+
+type backendHostRewriter struct {
+	headers       []string
+	xmlOperations map[string]bool
+	backendHosts  map[string]bool
+	roundTripper  http.RoundTripper
+}
+
+func publicScheme(req *http.Request) string {
+	if proto := req.Header.Get("X-Forwarded-Proto"); proto != "" {
+		return proto
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func (bhr *backendHostRewriter) RoundTrip(req *http.Request) (*http.Response, error) {
+	publicHost := req.Host
+	scheme := publicScheme(req)
+	resp, err := bhr.roundTripper.RoundTrip(req)
+	if err != nil || resp == nil || publicHost == "" {
+		return resp, err
+	}
+	for _, header := range bhr.headers {
+		values := resp.Header[http.CanonicalHeaderKey(header)]
+		for i, value := range values {
+			u, parseErr := url.Parse(value)
+			if parseErr != nil || !bhr.backendHosts[u.Host] {
+				continue
+			}
+			u.Host = publicHost
+			u.Scheme = scheme
+			values[i] = u.String()
+		}
+	}
+	bhr.rewriteXMLBody(req, resp, publicHost, scheme)
+	return resp, nil
+}
+
+// BackendHostRewriter creates Decorator which replaces backend host in given
+// response headers (e.g. redirect Location) with host requested by client.
+// Location elements of XML responses of xmlOperations (e.g.
+// CompleteMultipartUpload) are rewritten as well
+func BackendHostRewriter(headers []string, xmlOperations []string, backends []shardingconfig.YAMLUrl) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if len(headers) == 0 && len(xmlOperations) == 0 {
+			return roundTripper
+		}
+		backendHosts := make(map[string]bool, len(backends))
+		for _, backend := range backends {
+			backendHosts[backend.Host] = true
+		}
+		operations := make(map[string]bool, len(xmlOperations))
+		for _, operation := range xmlOperations {
+			operations[operation] = true
+		}
+		return &backendHostRewriter{headers: headers, xmlOperations: operations, backendHosts: backendHosts,
+			roundTripper: roundTripper}
+	}
+}
+
 type optionsHandler struct {
 	roundTripper http.RoundTripper
 }
@@ -131,6 +910,182 @@ func OptionsHandler(roundTripper http.RoundTripper) http.RoundTripper {
 	return optionsHandler{roundTripper: roundTripper}
 }
 
+type corsHandler struct {
+	conf         httphandlerconfig.CORSConfig
+	roundTripper http.RoundTripper
+}
+
+func (ch corsHandler) originAllowed(origin string) bool {
+	for _, allowed := range ch.conf.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ch corsHandler) methodAllowed(method string) bool {
+	for _, allowed := range ch.conf.AllowedMethods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ch corsHandler) headersAllowed(requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+		allowed := false
+		for _, allowedHeader := range ch.conf.AllowedHeaders {
+			if strings.EqualFold(allowedHeader, header) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+func (ch corsHandler) RoundTrip(req *http.Request) (*http.Response, error) {
+	origin := req.Header.Get("Origin")
+	isPreflight := req.Method == http.MethodOptions &&
+		origin != "" &&
+		req.Header.Get("Access-Control-Request-Method") != ""
+	if !isPreflight {
+		return ch.roundTripper.RoundTrip(req)
+	}
+
+	resp := &http.Response{
+		Proto:      req.Proto,
+		Request:    req,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		StatusCode: http.StatusForbidden,
+	}
+	if !ch.originAllowed(origin) ||
+		!ch.methodAllowed(req.Header.Get("Access-Control-Request-Method")) ||
+		!ch.headersAllowed(req.Header.Get("Access-Control-Request-Headers")) {
+		return resp, nil
+	}
+	allowedHeaders := strings.Join(ch.conf.AllowedHeaders, ", ")
+	resp.StatusCode = http.StatusOK
+	resp.Header.Set("Access-Control-Allow-Origin", origin)
+	resp.Header.Set("Access-Control-Allow-Methods", strings.Join(ch.conf.AllowedMethods, ", "))
+	if allowedHeaders != "" {
+		resp.Header.Set("Access-Control-Allow-Headers", allowedHeaders)
+	}
+	if ch.conf.MaxAge.Duration > 0 {
+		resp.Header.Set("Access-Control-Max-Age", fmt.Sprintf("%d", int64(ch.conf.MaxAge.Seconds())))
+	}
+	resp.Header.Set("Vary", "Origin")
+	resp.Header.Set("Content-Length", "0")
+	return resp, nil
+}
+
+// CORSHandler answers CORS preflight requests according to configuration,
+// if CORS handling is disabled requests are passed unchanged
+func CORSHandler(conf httphandlerconfig.CORSConfig) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if !conf.Enabled {
+			return roundTripper
+		}
+		return corsHandler{conf: conf, roundTripper: roundTripper}
+	}
+}
+
+type methodAllowlist struct {
+	allowed      map[string]bool
+	allow        string
+	roundTripper http.RoundTripper
+}
+
+func (ma methodAllowlist) RoundTrip(req *http.Request) (*http.Response, error) {
+	if ma.allowed[req.Method] {
+		return ma.roundTripper.RoundTrip(req)
+	}
+	metrics.Mark("reqs.global.method_not_allowed")
+	log.Debugf("Rejected %s request from %s, method not allowed", req.Method, req.RemoteAddr)
+	resp := &http.Response{
+		Proto:      req.Proto,
+		Request:    req,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		StatusCode: http.StatusMethodNotAllowed,
+	}
+	resp.Header.Set("Allow", ma.allow)
+	return resp, nil
+}
+
+// MethodAllowlist Decorator rejects requests with methods other than allowed
+// with 405 status and Allow header, all methods are allowed if list is empty
+func MethodAllowlist(allowed []string) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if len(allowed) == 0 {
+			return roundTripper
+		}
+		ma := methodAllowlist{allowed: make(map[string]bool, len(allowed)), roundTripper: roundTripper}
+		for _, method := range allowed {
+			ma.allowed[method] = true
+		}
+		ma.allow = strings.Join(allowed, ", ")
+		return ma
+	}
+}
+
+// ChaosEnvVar has to be set to "true" in order to enable chaos mode
+const ChaosEnvVar = "AKUBRA_CHAOS"
+
+// ErrChaosInjected is returned from requests failed on purpose in chaos mode
+var ErrChaosInjected = errors.New("Chaos injected error")
+
+type chaosInjector struct {
+	conf         httphandlerconfig.ChaosConfig
+	roundTripper http.RoundTripper
+	random       func() float64
+	sleep        func(time.Duration)
+}
+
+func (ci *chaosInjector) RoundTrip(req *http.Request) (*http.Response, error) {
+	if ci.conf.LatencyMs > 0 && ci.random() < ci.conf.LatencyRate {
+		metrics.Mark("reqs.global.chaos.latency")
+		ci.sleep(time.Duration(ci.conf.LatencyMs) * time.Millisecond)
+	}
+	if ci.random() < ci.conf.ErrorRate {
+		metrics.Mark("reqs.global.chaos.errors")
+		return nil, ErrChaosInjected
+	}
+	return ci.roundTripper.RoundTrip(req)
+}
+
+// ChaosInjector delays and fails fraction of requests. It's active only if
+// enabled in configuration and ChaosEnvVar environment variable is "true"
+func ChaosInjector(conf httphandlerconfig.ChaosConfig) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if !conf.Enabled {
+			return roundTripper
+		}
+		if os.Getenv(ChaosEnvVar) != "true" {
+			log.Printf("Chaos mode configured but %s environment variable is not set, ignoring", ChaosEnvVar)
+			return roundTripper
+		}
+		log.Printf("Chaos mode enabled: latency %dms on %.2f of requests, error rate %.2f",
+			conf.LatencyMs, conf.LatencyRate, conf.ErrorRate)
+		return &chaosInjector{
+			conf:         conf,
+			roundTripper: roundTripper,
+			random:       rand.Float64,
+			sleep:        time.Sleep,
+		}
+	}
+}
+
 type statusHandler struct {
 	healthCheckEndpoint string
 	roundTripper        http.RoundTripper
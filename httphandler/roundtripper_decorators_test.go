@@ -3,16 +3,31 @@ package httphandler
 import (
 	"bytes"
 	"encoding/json"
+	"encoding/xml"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"net/textproto"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	gometrics "github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
 	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/allegro/akubra/transport"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -96,7 +111,7 @@ func TestAccessLogging(t *testing.T) {
 		Hooks:     make(logrus.LevelHooks),
 		Level:     logrus.DebugLevel,
 	}
-	rt := Decorate(http.DefaultTransport, AccessLogging(logger))
+	rt := Decorate(http.DefaultTransport, AccessLogging(logger, httphandlerconfig.HealthProbesConfig{}, nil, false))
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		_, err := w.Write([]byte("OK"))
 		assert.Nil(t, err)
@@ -113,3 +128,857 @@ func TestAccessLogging(t *testing.T) {
 	}
 	assert.Equal(t, http.StatusOK, amd.StatusCode)
 }
+
+func TestAccessLoggingCountsChunkedBodies(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &logrus.Logger{
+		Out:       &buf,
+		Formatter: log.PlainTextFormatter{},
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.DebugLevel,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, []string{"chunked"}, r.TransferEncoding)
+		received, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			_, err := w.Write(received)
+			assert.NoError(t, err)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+	rt := Decorate(http.DefaultTransport, AccessLogging(logger, httphandlerconfig.HealthProbesConfig{}, nil, true))
+
+	// body of unknown length is sent chunked
+	body := struct{ io.Reader }{strings.NewReader(strings.Repeat("a", 5000))}
+	resp := sendReq(t, srv, "PUT", body, rt)
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	assert.Empty(t, buf.String(), "entry should be written after response body is sent")
+	sent, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.NoError(t, resp.Body.Close())
+
+	amd := &AccessMessageData{}
+	assert.NoError(t, json.Unmarshal(bytes.TrimSpace(buf.Bytes()), amd))
+	assert.Equal(t, int64(5000), amd.RequestBytes)
+	assert.Equal(t, int64(len(sent)), amd.Bytes)
+	assert.Equal(t, int64(15000), amd.Bytes)
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"), "entry should be written once")
+}
+
+func TestAccessLoggingReportsObjectBytesOfAWSChunkedUpload(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &logrus.Logger{
+		Out:       &buf,
+		Formatter: log.PlainTextFormatter{},
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.DebugLevel,
+	}
+	// 5 bytes object in single signed chunk and final empty chunk
+	encoded := "5;chunk-signature=" + strings.Repeat("a", 64) + "\r\nhello\r\n" +
+		"0;chunk-signature=" + strings.Repeat("b", 64) + "\r\n\r\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, encoded, string(received))
+		assert.Equal(t, "5", r.Header.Get("X-Amz-Decoded-Content-Length"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	rt := Decorate(http.DefaultTransport, AccessLogging(logger, httphandlerconfig.HealthProbesConfig{}, nil, true))
+	req, _ := http.NewRequest("PUT", srv.URL+"/bucket/key", strings.NewReader(encoded))
+	req.Header.Set("Content-Encoding", "aws-chunked")
+	req.Header.Set("X-Amz-Content-Sha256", "STREAMING-AWS4-HMAC-SHA256-PAYLOAD")
+	req.Header.Set("X-Amz-Decoded-Content-Length", "5")
+
+	resp, err := rt.RoundTrip(req)
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+
+	amd := &AccessMessageData{}
+	assert.NoError(t, json.Unmarshal(bytes.TrimSpace(buf.Bytes()), amd))
+	assert.Equal(t, int64(len(encoded)), amd.RequestBytes)
+	assert.Equal(t, int64(5), amd.ObjectBytes)
+}
+
+func TestAccessLoggingSkipsHealthProbes(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &logrus.Logger{
+		Out:       &buf,
+		Formatter: log.PlainTextFormatter{},
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.DebugLevel,
+	}
+	probes := httphandlerconfig.HealthProbesConfig{
+		Paths:      []string{"/probe"},
+		UserAgents: []string{"ELB-HealthChecker"},
+	}
+	rt := Decorate(okRoundTripper{}, AccessLogging(logger, probes, nil, false))
+
+	pathProbe, _ := http.NewRequest("GET", "http://example.com/probe", nil)
+	agentProbe, _ := http.NewRequest("GET", "http://example.com/bucket", nil)
+	agentProbe.Header.Set("User-Agent", "ELB-HealthChecker/2.0")
+	for _, req := range []*http.Request{pathProbe, agentProbe} {
+		resp, err := rt.RoundTrip(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	assert.Empty(t, buf.String())
+
+	req, _ := http.NewRequest("GET", "http://example.com/bucket", nil)
+	_, err := rt.RoundTrip(req)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, buf.String())
+}
+
+func TestAccessLoggingIncludesRoutingDecision(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &logrus.Logger{
+		Out:       &buf,
+		Formatter: log.PlainTextFormatter{},
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.DebugLevel,
+	}
+	routingRoundTripper := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		decision := transport.RoutingDecisionFromContext(req)
+		decision.Strategy = "consistent-hashing"
+		decision.Retry = true
+		decision.Hedge = true
+		decision.Candidates = 3
+		return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header)}, nil
+	})
+	rt := Decorate(routingRoundTripper, AccessLogging(logger, httphandlerconfig.HealthProbesConfig{}, nil, false))
+	req, _ := http.NewRequest("GET", "http://localhost/b/o", nil)
+
+	_, err := rt.RoundTrip(req)
+
+	assert.NoError(t, err)
+	amd := &AccessMessageData{}
+	assert.NoError(t, json.Unmarshal(bytes.Trim(buf.Bytes(), "\n"), amd))
+	assert.Equal(t, "consistent-hashing", amd.Strategy)
+	assert.True(t, amd.Retry)
+	assert.True(t, amd.Hedge)
+	assert.False(t, amd.Canary)
+	assert.Equal(t, 3, amd.Candidates)
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestCORSHandlerAnswersPreflight(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Preflight request should not reach backend")
+	}))
+	defer srv.Close()
+	conf := httphandlerconfig.CORSConfig{
+		Enabled:        true,
+		AllowedOrigins: []string{"http://allowed.example"},
+		AllowedMethods: []string{"GET", "PUT"},
+		AllowedHeaders: []string{"Content-Type"},
+		MaxAge:         metrics.Interval{Duration: 10 * time.Minute},
+	}
+	rt := Decorate(http.DefaultTransport, CORSHandler(conf))
+
+	req, _ := http.NewRequest(http.MethodOptions, srv.URL, nil)
+	req.Header.Set("Origin", "http://allowed.example")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	res, err := rt.RoundTrip(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "http://allowed.example", res.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "GET, PUT", res.Header.Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Content-Type", res.Header.Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "600", res.Header.Get("Access-Control-Max-Age"))
+
+	req.Header.Set("Origin", "http://other.example")
+	res, err = rt.RoundTrip(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	assert.Empty(t, res.Header.Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORSHandlerRejectsPreflightOfNotAllowedMethodOrHeaders(t *testing.T) {
+	for _, testData := range []struct {
+		name           string
+		allowedHeaders []string
+		method         string
+		headers        string
+		expected       int
+	}{
+		{"allowed method and headers", []string{"Content-Type", "X-Amz-Date"}, "PUT", "content-type, x-amz-date", http.StatusOK},
+		{"not allowed method", []string{"Content-Type"}, "DELETE", "", http.StatusForbidden},
+		{"not allowed header", []string{"Content-Type"}, "PUT", "Content-Type, X-Custom", http.StatusForbidden},
+		{"no headers allowed", nil, "PUT", "X-Custom", http.StatusForbidden},
+		{"no headers requested", nil, "GET", "", http.StatusOK},
+	} {
+		conf := httphandlerconfig.CORSConfig{
+			Enabled:        true,
+			AllowedOrigins: []string{"*"},
+			AllowedMethods: []string{"GET", "PUT"},
+			AllowedHeaders: testData.allowedHeaders,
+		}
+		rt := Decorate(http.DefaultTransport, CORSHandler(conf))
+
+		req, _ := http.NewRequest(http.MethodOptions, "http://localhost/bucket/key", nil)
+		req.Header.Set("Origin", "http://allowed.example")
+		req.Header.Set("Access-Control-Request-Method", testData.method)
+		if testData.headers != "" {
+			req.Header.Set("Access-Control-Request-Headers", testData.headers)
+		}
+		res, err := rt.RoundTrip(req)
+
+		assert.NoError(t, err, testData.name)
+		assert.Equal(t, testData.expected, res.StatusCode, testData.name)
+		assert.NotContains(t, res.Header.Get("Access-Control-Allow-Headers"), "X-Custom", testData.name)
+	}
+}
+
+func TestCORSHandlerDisabledForwardsOptions(t *testing.T) {
+	srv := mkSimpleServer(t)
+	defer srv.Close()
+	rt := Decorate(http.DefaultTransport, CORSHandler(httphandlerconfig.CORSConfig{}))
+
+	req, _ := http.NewRequest(http.MethodOptions, srv.URL, nil)
+	req.Header.Set("Origin", "http://allowed.example")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	res, err := rt.RoundTrip(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Empty(t, res.Header.Get("Access-Control-Allow-Origin"))
+}
+
+func TestMethodAllowlistRejectsOtherMethods(t *testing.T) {
+	var backendCalls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&backendCalls, 1)
+	}))
+	defer srv.Close()
+	rt := Decorate(http.DefaultTransport, MethodAllowlist([]string{"GET", "PUT", "DELETE", "HEAD"}))
+
+	for _, testData := range []struct {
+		method  string
+		allowed bool
+	}{
+		{http.MethodGet, true},
+		{http.MethodHead, true},
+		{http.MethodPut, true},
+		{http.MethodDelete, true},
+		{http.MethodPost, false},
+		{http.MethodOptions, false},
+		{http.MethodPatch, false},
+	} {
+		before := atomic.LoadInt32(&backendCalls)
+		req, _ := http.NewRequest(testData.method, srv.URL+"/bucket/key", nil)
+		res, err := rt.RoundTrip(req)
+
+		assert.NoError(t, err)
+		if testData.allowed {
+			assert.Equal(t, http.StatusOK, res.StatusCode, testData.method)
+			assert.Equal(t, before+1, atomic.LoadInt32(&backendCalls), testData.method)
+			continue
+		}
+		assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode, testData.method)
+		assert.Equal(t, "GET, PUT, DELETE, HEAD", res.Header.Get("Allow"), testData.method)
+		assert.Equal(t, before, atomic.LoadInt32(&backendCalls), testData.method)
+	}
+}
+
+func TestMethodAllowlistAllowsAllMethodsWhenUnset(t *testing.T) {
+	rt := Decorate(http.DefaultTransport, MethodAllowlist(nil))
+
+	assert.Equal(t, http.DefaultTransport, rt)
+}
+
+func TestHopByHopHeadersFilter(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Keep-Alive"))
+		assert.Empty(t, r.Header.Get("Proxy-Authorization"))
+		assert.Empty(t, r.Header.Get("X-Custom-Hop"))
+		assert.Equal(t, "yes", r.Header.Get("Upgrade"))
+		assert.Equal(t, "value", r.Header.Get("X-End-To-End"))
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.Header().Set("X-Response", "true")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	rt := Decorate(http.DefaultTransport, HopByHopHeadersFilter([]string{"upgrade"}))
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Connection", "X-Custom-Hop")
+	req.Header.Set("X-Custom-Hop", "true")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Proxy-Authorization", "secret")
+	req.Header.Set("Upgrade", "yes")
+	req.Header.Set("X-End-To-End", "value")
+	res, err := rt.RoundTrip(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Empty(t, res.Header.Get("Proxy-Authenticate"))
+	assert.Equal(t, "true", res.Header.Get("X-Response"))
+}
+
+func TestHopByHopHeadersFilterKeepsMetadataListedInConnection(t *testing.T) {
+	var forwarded http.Header
+	rt := HopByHopHeadersFilter(nil)(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		forwarded = req.Header
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+	req, _ := http.NewRequest(http.MethodPut, "http://localhost/bucket/key", nil)
+	req.Header.Set("Connection", "x-amz-meta-owner, X-Custom-Hop")
+	req.Header.Set("X-Amz-Meta-Owner", "akubra")
+	req.Header.Set("X-Custom-Hop", "true")
+
+	_, err := rt.RoundTrip(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "akubra", forwarded.Get("X-Amz-Meta-Owner"))
+	assert.Empty(t, forwarded.Get("X-Custom-Hop"))
+}
+
+func TestResponseSizeMetrics(t *testing.T) {
+	bodies := map[string]int{"/small": 10, "/large": 2048}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write(bytes.Repeat([]byte("a"), bodies[r.URL.Path]))
+		assert.Nil(t, err)
+	}))
+	defer srv.Close()
+	rt := Decorate(http.DefaultTransport, ResponseSizeMetrics(1024))
+
+	for path := range bodies {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		res, err := rt.RoundTrip(req)
+		assert.NoError(t, err)
+		_, err = io.Copy(ioutil.Discard, res.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, res.Body.Close())
+	}
+
+	metricsPrefix := "reqs.backend." + metrics.Clean(srv.Listener.Addr().String())
+	histogram, ok := gometrics.Get(metricsPrefix + ".response_bytes").(gometrics.Histogram)
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), histogram.Count())
+	assert.Equal(t, int64(2048), histogram.Max())
+	assert.Equal(t, int64(10), histogram.Min())
+	largeObjects, ok := gometrics.Get(metricsPrefix + ".large_objects").(gometrics.Meter)
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), largeObjects.Count())
+}
+
+func TestBackendHeadersSuplier(t *testing.T) {
+	srv1 := mkSimpleServer(t)
+	defer srv1.Close()
+	srv2 := mkSimpleServer(t)
+	defer srv2.Close()
+	backendHeaders := map[string]shardingconfig.AdditionalHeaders{
+		srv1.Listener.Addr().String(): {"X-Routing-Token": "token1"},
+	}
+	rt := Decorate(http.DefaultTransport, BackendHeadersSuplier(backendHeaders))
+
+	for srv, expected := range map[*httptest.Server]string{srv1: "token1", srv2: ""} {
+		res := sendReq(t, srv, "GET", nil, rt)
+		receivedReqHeaders := make(http.Header)
+		err := json.NewDecoder(res.Body).Decode(&receivedReqHeaders)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, receivedReqHeaders.Get("X-Routing-Token"))
+	}
+}
+
+func TestKeyNormalizerForwardsEquivalentKeysIdentically(t *testing.T) {
+	var forwardedPaths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedPaths = append(forwardedPaths, r.RequestURI)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	rt := Decorate(http.DefaultTransport, KeyNormalizer(true))
+
+	for _, path := range []string{"/bucket/a+b~c%20d", "/bucket/a%2Bb%7Ec%20d", "/bucket/a%2bb~c d"} {
+		req, err := http.NewRequest("GET", srv.URL+path, nil)
+		assert.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, []string{"/bucket/a%2Bb~c%20d", "/bucket/a%2Bb~c%20d", "/bucket/a%2Bb~c%20d"}, forwardedPaths)
+}
+
+func TestKeyNormalizerKeepsEncodedSlashOfKey(t *testing.T) {
+	var forwardedPaths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedPaths = append(forwardedPaths, r.RequestURI)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	rt := Decorate(http.DefaultTransport, KeyNormalizer(true))
+
+	for _, path := range []string{"/bucket/dir%2Fkey", "/bucket/dir%2fkey", "/bucket/dir/key"} {
+		req, err := http.NewRequest("GET", srv.URL+path, nil)
+		assert.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, []string{"/bucket/dir%2Fkey", "/bucket/dir%2Fkey", "/bucket/dir/key"}, forwardedPaths)
+}
+
+func TestChaosInjectorRequiresEnvironmentVariable(t *testing.T) {
+	conf := httphandlerconfig.ChaosConfig{Enabled: true, ErrorRate: 1}
+	defer os.Unsetenv(ChaosEnvVar)
+
+	os.Unsetenv(ChaosEnvVar)
+	_, isChaos := ChaosInjector(conf)(okRoundTripper{}).(*chaosInjector)
+	assert.False(t, isChaos)
+
+	os.Setenv(ChaosEnvVar, "true")
+	_, isChaos = ChaosInjector(conf)(okRoundTripper{}).(*chaosInjector)
+	assert.True(t, isChaos)
+
+	_, isChaos = ChaosInjector(httphandlerconfig.ChaosConfig{})(okRoundTripper{}).(*chaosInjector)
+	assert.False(t, isChaos)
+}
+
+func TestChaosInjectorInjectsFaultsAtConfiguredRate(t *testing.T) {
+	var delays []time.Duration
+	injector := &chaosInjector{
+		conf: httphandlerconfig.ChaosConfig{
+			Enabled:     true,
+			LatencyMs:   50,
+			LatencyRate: 0.3,
+			ErrorRate:   0.1,
+		},
+		roundTripper: okRoundTripper{},
+		random:       rand.New(rand.NewSource(1)).Float64,
+		sleep:        func(d time.Duration) { delays = append(delays, d) },
+	}
+
+	requests := 10000
+	failures := 0
+	for i := 0; i < requests; i++ {
+		req, _ := http.NewRequest("GET", "http://example.com/bucket/key", nil)
+		resp, err := injector.RoundTrip(req)
+		if err != nil {
+			assert.Equal(t, ErrChaosInjected, err)
+			failures++
+			continue
+		}
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	assert.InDelta(t, 0.1, float64(failures)/float64(requests), 0.02)
+	assert.InDelta(t, 0.3, float64(len(delays))/float64(requests), 0.02)
+	for _, delay := range delays {
+		assert.Equal(t, 50*time.Millisecond, delay)
+	}
+}
+
+func mkRangeIgnoringServer(body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, body)
+	}))
+}
+
+func TestRangeEmulatorServesRangeWhenBackendIgnoresIt(t *testing.T) {
+	srv := mkRangeIgnoringServer("0123456789")
+	defer srv.Close()
+	rt := RangeEmulator(http.DefaultTransport)
+
+	for _, testData := range []struct {
+		rangeHeader  string
+		body         string
+		contentRange string
+	}{
+		{"bytes=0-3", "0123", "bytes 0-3/10"},
+		{"bytes=7-", "789", "bytes 7-9/10"},
+		{"bytes=-2", "89", "bytes 8-9/10"},
+		{"bytes=5-100", "56789", "bytes 5-9/10"},
+	} {
+		req, _ := http.NewRequest("GET", srv.URL+"/bucket/key", nil)
+		req.Header.Set("Range", testData.rangeHeader)
+		resp, err := rt.RoundTrip(req)
+		assert.NoError(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode, testData.rangeHeader)
+		assert.Equal(t, testData.body, string(body), testData.rangeHeader)
+		assert.Equal(t, testData.contentRange, resp.Header.Get("Content-Range"), testData.rangeHeader)
+		assert.Equal(t, int64(len(testData.body)), resp.ContentLength, testData.rangeHeader)
+	}
+}
+
+func TestRangeEmulatorRejectsUnsatisfiableRange(t *testing.T) {
+	srv := mkRangeIgnoringServer("0123456789")
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/bucket/key", nil)
+	req.Header.Set("Range", "bytes=20-30")
+	resp, err := RangeEmulator(http.DefaultTransport).RoundTrip(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+	assert.Equal(t, "bytes */10", resp.Header.Get("Content-Range"))
+}
+
+func TestRangeEmulatorPassesPartialContentThrough(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "key", time.Time{}, bytes.NewReader([]byte("0123456789")))
+	}))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/bucket/key", nil)
+	req.Header.Set("Range", "bytes=2-4")
+	resp, err := RangeEmulator(http.DefaultTransport).RoundTrip(req)
+
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "234", string(body))
+	assert.Equal(t, "bytes 2-4/10", resp.Header.Get("Content-Range"))
+}
+
+func TestLocationConstraintRewriterReplacesBucketLocation(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">default</LocationConstraint>`))
+		assert.NoError(t, err)
+	}))
+	defer srv.Close()
+	rt := LocationConstraintRewriter("eu-west-1")(http.DefaultTransport)
+
+	req, _ := http.NewRequest("GET", srv.URL+"/bucket?location", nil)
+	resp, err := rt.RoundTrip(req)
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	location := LocationConstraint{}
+	assert.NoError(t, xml.Unmarshal(body, &location))
+	assert.Equal(t, "eu-west-1", location.Location)
+	assert.Equal(t, int64(len(body)), resp.ContentLength)
+
+	req, _ = http.NewRequest("GET", srv.URL+"/bucket/key?location", nil)
+	resp, err = rt.RoundTrip(req)
+	assert.NoError(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(body), ">default<", "object requests should not be rewritten")
+}
+
+func TestLocationConstraintRewriterReportsRegionOfHeadBucket(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "missing") {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	rt := LocationConstraintRewriter("eu-west-1")(http.DefaultTransport)
+
+	for _, testData := range []struct {
+		path     string
+		expected string
+	}{
+		{"/bucket", "eu-west-1"},
+		{"/missing", ""},
+		{"/bucket/key", ""},
+	} {
+		req, _ := http.NewRequest(http.MethodHead, srv.URL+testData.path, nil)
+		resp, err := rt.RoundTrip(req)
+		assert.NoError(t, err)
+		assert.Equal(t, testData.expected, resp.Header.Get("X-Amz-Bucket-Region"), testData.path)
+	}
+}
+
+func TestBucketRootNormalizerMapsOnlyBucketRootPaths(t *testing.T) {
+	for _, testData := range []struct {
+		mode     string
+		path     string
+		expected string
+	}{
+		{httphandlerconfig.BucketRootWithoutSlash, "/bucket/", "/bucket"},
+		{httphandlerconfig.BucketRootWithoutSlash, "/bucket", "/bucket"},
+		{httphandlerconfig.BucketRootWithSlash, "/bucket", "/bucket/"},
+		{httphandlerconfig.BucketRootWithSlash, "/bucket/", "/bucket/"},
+		{httphandlerconfig.BucketRootWithoutSlash, "/bucket/dir/", "/bucket/dir/"},
+		{httphandlerconfig.BucketRootWithSlash, "/bucket/dir/", "/bucket/dir/"},
+		{httphandlerconfig.BucketRootWithoutSlash, "/bucket//", "/bucket//"},
+		{httphandlerconfig.BucketRootWithoutSlash, "/", "/"},
+	} {
+		var forwarded string
+		rt := BucketRootNormalizer(testData.mode)(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			forwarded = req.URL.Path
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}))
+		req, _ := http.NewRequest("GET", "http://localhost"+testData.path, nil)
+
+		_, err := rt.RoundTrip(req)
+
+		assert.NoError(t, err)
+		assert.Equal(t, testData.expected, forwarded, testData.mode+" "+testData.path)
+	}
+}
+
+func TestPathRewriterAppliesRulesInOrder(t *testing.T) {
+	rules := []httphandlerconfig.RewriteRule{
+		{Match: "^/legacy-bucket/(.*)$", Replace: "/bucket/$1"},
+		{Match: "^/(?P<bucket>[^/]+)/v1/(.*)$", Replace: "/${bucket}/$2"},
+	}
+	for _, testData := range []struct {
+		mode     string
+		path     string
+		expected string
+	}{
+		{httphandlerconfig.RewriteFirstMatch, "/legacy-bucket/key", "/bucket/key"},
+		{httphandlerconfig.RewriteFirstMatch, "/other/v1/dir/key", "/other/dir/key"},
+		{httphandlerconfig.RewriteFirstMatch, "/legacy-bucket/v1/key", "/bucket/v1/key"},
+		{"", "/legacy-bucket/v1/key", "/bucket/v1/key"},
+		{httphandlerconfig.RewriteAllMatches, "/legacy-bucket/v1/key", "/bucket/key"},
+		{httphandlerconfig.RewriteAllMatches, "/bucket/key", "/bucket/key"},
+	} {
+		var forwarded *url.URL
+		rt := PathRewriter(rules, testData.mode)(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			forwarded = req.URL
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}))
+		req, _ := http.NewRequest("GET", "http://localhost"+testData.path+"?acl", nil)
+
+		_, err := rt.RoundTrip(req)
+
+		assert.NoError(t, err)
+		assert.Equal(t, testData.expected, forwarded.Path, testData.mode+" "+testData.path)
+		assert.Equal(t, "acl", forwarded.RawQuery)
+	}
+}
+
+func TestPathRewriterResetsRawPathOfRewrittenPath(t *testing.T) {
+	var forwarded string
+	rt := PathRewriter([]httphandlerconfig.RewriteRule{{Match: "^/old/", Replace: "/new/"}}, "")(
+		roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			forwarded = req.URL.EscapedPath()
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}))
+	req, _ := http.NewRequest("GET", "http://localhost/old/a%2Bb", nil)
+	req.URL.RawPath = "/old/a%2Bb"
+
+	_, err := rt.RoundTrip(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "/new/a+b", forwarded)
+}
+
+func TestPathRewriterCountsRequestsPerRuleMetricLabel(t *testing.T) {
+	rules := []httphandlerconfig.RewriteRule{
+		{Match: "^/legacy-bucket/(.*)$", Replace: "/bucket/$1", MetricLabel: "legacy"},
+		{Match: "^/archive-(a|b)/(.*)$", Replace: "/archive/$2", MetricLabel: "legacy"},
+		{Match: "^/(?P<bucket>[^/]+)/v1/(.*)$", Replace: "/${bucket}/$2"},
+	}
+	rt := PathRewriter(rules, "")(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+	legacy, other := meterCount("reqs.rules.legacy"), meterCount("reqs.rules.other")
+	for _, path := range []string{"/legacy-bucket/key", "/archive-a/key", "/other/v1/key", "/bucket/key"} {
+		req, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+
+		_, err := rt.RoundTrip(req)
+
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, legacy+2, meterCount("reqs.rules.legacy"))
+	assert.Equal(t, other+2, meterCount("reqs.rules.other"))
+	assert.Nil(t, gometrics.Get("reqs.rules.archive"))
+}
+
+func TestBackendHostRewriterRewritesRedirectLocation(t *testing.T) {
+	var backendHost string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "http://"+backendHost+"/bucket/other?x=1")
+		w.Header().Set("Content-Location", "http://"+backendHost+"/bucket/key")
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	}))
+	defer srv.Close()
+	backendURL, _ := url.Parse(srv.URL)
+	backendHost = backendURL.Host
+	client := &http.Client{Transport: BackendHostRewriter(
+		[]string{"Location"}, nil, []shardingconfig.YAMLUrl{{URL: backendURL}})(http.DefaultTransport),
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/bucket/key", nil)
+	req.Host = "s3.example.com"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	resp, err := client.Do(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, "https://s3.example.com/bucket/other?x=1", resp.Header.Get("Location"))
+	assert.Equal(t, "http://"+backendHost+"/bucket/key", resp.Header.Get("Content-Location"),
+		"headers not listed should be kept")
+}
+
+func TestBackendHostRewriterKeepsForeignLocation(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "http://elsewhere.example.com/page")
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer srv.Close()
+	backendURL, _ := url.Parse(srv.URL)
+	rt := BackendHostRewriter([]string{"Location"}, nil, []shardingconfig.YAMLUrl{{URL: backendURL}})(http.DefaultTransport)
+
+	req, _ := http.NewRequest("GET", srv.URL+"/bucket/key", nil)
+	req.Host = "s3.example.com"
+	resp, err := rt.RoundTrip(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "http://elsewhere.example.com/page", resp.Header.Get("Location"))
+}
+
+func completeMultipartUploadResult(location string, padding int) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + strings.Repeat(" ", padding) +
+		`<CompleteMultipartUploadResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">` +
+		`<Location>` + location + `</Location><Bucket>bucket</Bucket><Key>key</Key>` +
+		`<ETag>&quot;3858f62230ac3c915f300c664312c11f-9&quot;</ETag></CompleteMultipartUploadResult>`
+}
+
+func TestBackendHostRewriterRewritesLocationInXMLBody(t *testing.T) {
+	var backendHost string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		padding, _ := strconv.Atoi(r.URL.Query().Get("padding"))
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		_, err := w.Write([]byte(completeMultipartUploadResult("http://"+backendHost+"/bucket/key?a=1&amp;b=2", padding)))
+		assert.NoError(t, err)
+	}))
+	defer srv.Close()
+	backendURL, _ := url.Parse(srv.URL)
+	backendHost = backendURL.Host
+	rt := BackendHostRewriter(nil, []string{httphandlerconfig.CompleteMultipartUpload},
+		[]shardingconfig.YAMLUrl{{URL: backendURL}})(http.DefaultTransport)
+
+	rewritten := completeMultipartUploadResult("https://s3.example.com/bucket/key?a=1&amp;b=2", 0)
+	for _, testData := range []struct {
+		name     string
+		method   string
+		query    string
+		padding  int
+		expected string
+	}{
+		{"complete multipart upload", "POST", "uploadId=1&type=application/xml", 0, rewritten},
+		{"charset in content type", "POST", "uploadId=1&type=application/xml%3B+charset=utf-8", 0, rewritten},
+		{"not configured operation", "GET", "uploadId=1&type=application/xml", 0, ""},
+		{"not XML body", "POST", "uploadId=1&type=text/plain", 0, ""},
+		{"body too large to buffer", "POST", "uploadId=1&type=application/xml&padding=", maxRewrittenXMLBody, ""},
+	} {
+		query := testData.query
+		if testData.padding > 0 {
+			query += strconv.Itoa(testData.padding)
+		}
+		original := completeMultipartUploadResult("http://"+backendHost+"/bucket/key?a=1&amp;b=2", testData.padding)
+		expected := testData.expected
+		if expected == "" {
+			expected = original
+		}
+		req, _ := http.NewRequest(testData.method, srv.URL+"/bucket/key?"+query, nil)
+		req.Host = "s3.example.com"
+		req.Header.Set("X-Forwarded-Proto", "https")
+		resp, err := rt.RoundTrip(req)
+		if !assert.NoError(t, err, testData.name) {
+			continue
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err, testData.name)
+		assert.NoError(t, resp.Body.Close(), testData.name)
+		assert.Equal(t, expected, string(body), testData.name)
+		if resp.ContentLength >= 0 {
+			assert.Equal(t, int64(len(body)), resp.ContentLength, testData.name)
+		}
+	}
+}
+
+func TestAccessLoggingSelectsFieldsPerStatusClass(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &logrus.Logger{
+		Out:       &buf,
+		Formatter: log.PlainTextFormatter{},
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.DebugLevel,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bucket/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, err := w.Write([]byte("OK"))
+		assert.NoError(t, err)
+	}))
+	defer srv.Close()
+	fields := httphandlerconfig.AccessLogFieldsConfig{
+		"2xx": {"method", "path", "status", "bytes"},
+		"5xx": {"method", "path", "status", "error", "duration", "backends"},
+	}
+	rt := Decorate(BackendTimingCollector(true)(http.DefaultTransport),
+		AccessLogging(logger, httphandlerconfig.HealthProbesConfig{}, fields, false))
+
+	for _, testData := range []struct {
+		path   string
+		fields []string
+	}{
+		{"/bucket/ok", []string{"method", "path", "status", "bytes"}},
+		{"/bucket/fail", []string{"method", "path", "status", "error", "duration", "backends"}},
+	} {
+		buf.Reset()
+		req, _ := http.NewRequest("GET", srv.URL+testData.path, nil)
+		resp, err := rt.RoundTrip(req)
+		assert.NoError(t, err)
+		assert.NoError(t, resp.Body.Close())
+
+		entry := make(map[string]interface{})
+		assert.NoError(t, json.Unmarshal(bytes.TrimSpace(buf.Bytes()), &entry))
+		logged := make([]string, 0, len(entry))
+		for field := range entry {
+			logged = append(logged, field)
+		}
+		sort.Strings(logged)
+		expected := append([]string{}, testData.fields...)
+		sort.Strings(expected)
+		assert.Equal(t, expected, logged, testData.path)
+		if backends, ok := entry["backends"].([]interface{}); ok {
+			assert.Len(t, backends, 1)
+			backend := backends[0].(map[string]interface{})
+			assert.Equal(t, float64(http.StatusInternalServerError), backend["status"])
+			assert.Contains(t, backend, "ttfb")
+		}
+	}
+}
+
+func TestViaHeaderModes(t *testing.T) {
+	for _, testData := range []struct {
+		mode             string
+		request, respond []string
+	}{
+		{"", []string{"1.0 client-proxy", "1.1 akubra"}, []string{"1.1 backend-lb", "1.1 akubra"}},
+		{httphandlerconfig.ViaAdd, []string{"1.0 client-proxy", "1.1 akubra"}, []string{"1.1 backend-lb", "1.1 akubra"}},
+		{httphandlerconfig.ViaStrip, nil, nil},
+		{httphandlerconfig.ViaPassthrough, []string{"1.0 client-proxy"}, []string{"1.1 backend-lb"}},
+	} {
+		var forwarded []string
+		rt := ViaHeader(testData.mode)(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			forwarded = req.Header["Via"]
+			return &http.Response{StatusCode: http.StatusOK, ProtoMajor: 1, ProtoMinor: 1,
+				Header: http.Header{"Via": []string{"1.1 backend-lb"}}}, nil
+		}))
+		req, _ := http.NewRequest("GET", "http://localhost/bucket/key", nil)
+		req.Header.Set("Via", "1.0 client-proxy")
+
+		resp, err := rt.RoundTrip(req)
+
+		assert.NoError(t, err)
+		assert.Equal(t, testData.request, forwarded, "request via, mode "+testData.mode)
+		assert.Equal(t, testData.respond, resp.Header["Via"], "response via, mode "+testData.mode)
+	}
+}
@@ -0,0 +1,69 @@
+package httphandler
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/allegro/akubra/log"
+)
+
+// S3Error is S3 compatible error response body
+type S3Error struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestID string   `xml:"RequestId"`
+}
+
+// writeS3Error sends S3 compatible XML error to client
+func writeS3Error(w http.ResponseWriter, statusCode int, code, message, resource, reqID string) {
+	body, err := xml.Marshal(S3Error{
+		Code:      code,
+		Message:   message,
+		Resource:  resource,
+		RequestID: reqID,
+	})
+	if err != nil {
+		log.Printf("Cannot marshal S3 error response %s", err)
+		w.WriteHeader(statusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(statusCode)
+	if _, err := w.Write(append([]byte(xml.Header), body...)); err != nil {
+		log.Printf("Cannot send S3 error response %s", err)
+	}
+}
+
+// s3ErrorResponse builds S3 compatible XML error response for request
+func s3ErrorResponse(req *http.Request, statusCode int, code, message string) *http.Response {
+	reqID, _ := req.Context().Value(log.ContextreqIDKey).(string)
+	body, err := xml.Marshal(S3Error{
+		Code:      code,
+		Message:   message,
+		Resource:  req.URL.Path,
+		RequestID: reqID,
+	})
+	if err != nil {
+		log.Printf("Cannot marshal S3 error response %s", err)
+	}
+	body = append([]byte(xml.Header), body...)
+	header := make(http.Header)
+	header.Set("Content-Type", "application/xml")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	return &http.Response{
+		Status:        http.StatusText(statusCode),
+		StatusCode:    statusCode,
+		Proto:         req.Proto,
+		ProtoMajor:    req.ProtoMajor,
+		ProtoMinor:    req.ProtoMinor,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+		Header:        header,
+	}
+}
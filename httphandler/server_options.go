@@ -0,0 +1,39 @@
+package httphandler
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/allegro/akubra/metrics"
+)
+
+// DefaultAllowedMethods are announced to OPTIONS * requests if
+// AllowedMethods is not set
+var DefaultAllowedMethods = []string{http.MethodGet, http.MethodHead, http.MethodPut,
+	http.MethodPost, http.MethodDelete, http.MethodOptions}
+
+type serverWideOptions struct {
+	allow   string
+	handler http.Handler
+}
+
+func (swo *serverWideOptions) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodOptions || req.RequestURI != "*" {
+		swo.handler.ServeHTTP(w, req)
+		return
+	}
+	metrics.Mark("reqs.global.server_options")
+	w.Header().Set("Allow", swo.allow)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusOK)
+}
+
+// ServerWideOptions wraps handler, so OPTIONS * requests are answered with
+// 200 and Allow header listing allowed methods (DefaultAllowedMethods if
+// list is empty) instead of being routed to backends
+func ServerWideOptions(handler http.Handler, allowed []string) http.Handler {
+	if len(allowed) == 0 {
+		allowed = DefaultAllowedMethods
+	}
+	return &serverWideOptions{allow: strings.Join(allowed, ", "), handler: handler}
+}
@@ -0,0 +1,43 @@
+package httphandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerWideOptionsAnswersOptionsAsterisk(t *testing.T) {
+	routed := 0
+	handler := ServerWideOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routed++
+		w.WriteHeader(http.StatusNotFound)
+	}), nil)
+
+	req := httptest.NewRequest(http.MethodOptions, "*", nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "GET, HEAD, PUT, POST, DELETE, OPTIONS", recorder.Header().Get("Allow"))
+	assert.Equal(t, "0", recorder.Header().Get("Content-Length"))
+	assert.Empty(t, recorder.Body.String())
+	assert.Equal(t, 0, routed, "OPTIONS * should not be routed")
+
+	// OPTIONS of object is routed
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodOptions, "/bucket/key", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, 1, routed)
+}
+
+func TestServerWideOptionsAnnouncesAllowedMethods(t *testing.T) {
+	handler := ServerWideOptions(http.NotFoundHandler(), []string{"GET", "HEAD"})
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodOptions, "*", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "GET, HEAD", recorder.Header().Get("Allow"))
+}
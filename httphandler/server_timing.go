@@ -0,0 +1,116 @@
+package httphandler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/transport"
+)
+
+func formatServerTimingDuration(d time.Duration) string {
+	return fmt.Sprintf("%.3f", float64(d)/float64(time.Millisecond))
+}
+
+// formatServerTiming builds Server-Timing header value
+// (https://www.w3.org/TR/server-timing/) with durations in milliseconds
+func formatServerTiming(timings []transport.BackendTiming, total time.Duration) string {
+	metrics := make([]string, 0, 2*len(timings)+1)
+	for _, timing := range timings {
+		metrics = append(metrics,
+			fmt.Sprintf("backend-dial;dur=%s;desc=%q", formatServerTimingDuration(timing.Dial), timing.Host),
+			fmt.Sprintf("backend-ttfb;dur=%s;desc=%q", formatServerTimingDuration(timing.TTFB), timing.Host))
+	}
+	metrics = append(metrics, "total;dur="+formatServerTimingDuration(total))
+	return strings.Join(metrics, ", ")
+}
+
+type serverTimingHeader struct {
+	roundTripper http.RoundTripper
+}
+
+func (sth *serverTimingHeader) RoundTrip(req *http.Request) (*http.Response, error) {
+	since := time.Now()
+	timing := &transport.ServerTiming{}
+	resp, err := sth.roundTripper.RoundTrip(req.WithContext(
+		context.WithValue(req.Context(), transport.ContextServerTimingKey, timing)))
+	if err != nil {
+		return resp, err
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	resp.Header.Set("Server-Timing", formatServerTiming(timing.Timings(), time.Since(since)))
+	return resp, nil
+}
+
+// ServerTimingHeader creates Decorator which adds Server-Timing header with
+// backend dial, backend time to first byte and total proxy time to responses
+func ServerTimingHeader(enabled bool) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if !enabled {
+			return roundTripper
+		}
+		return &serverTimingHeader{roundTripper: roundTripper}
+	}
+}
+
+type backendTimingCollector struct {
+	roundTripper http.RoundTripper
+}
+
+func (btc *backendTimingCollector) RoundTrip(req *http.Request) (*http.Response, error) {
+	timing, ok := req.Context().Value(transport.ContextServerTimingKey).(*transport.ServerTiming)
+	if !ok {
+		return btc.roundTripper.RoundTrip(req)
+	}
+	since := time.Now()
+	var mx sync.Mutex
+	var dialStart time.Time
+	backendTiming := transport.BackendTiming{Host: req.URL.Host}
+	startDial := func() {
+		mx.Lock()
+		defer mx.Unlock()
+		if dialStart.IsZero() {
+			dialStart = time.Now()
+		}
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart:     func(httptrace.DNSStartInfo) { startDial() },
+		ConnectStart: func(string, string) { startDial() },
+		ConnectDone: func(string, string, error) {
+			mx.Lock()
+			defer mx.Unlock()
+			backendTiming.Dial = time.Since(dialStart)
+		},
+		GotFirstResponseByte: func() {
+			mx.Lock()
+			defer mx.Unlock()
+			backendTiming.TTFB = time.Since(since)
+		},
+	}
+	resp, err := btc.roundTripper.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	mx.Lock()
+	backendTiming.Err = err
+	if resp != nil {
+		backendTiming.StatusCode = resp.StatusCode
+	}
+	timing.Record(backendTiming)
+	mx.Unlock()
+	return resp, err
+}
+
+// BackendTimingCollector creates Decorator which records backend request
+// timings and outcomes for ServerTimingHeader and access log
+func BackendTimingCollector(enabled bool) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if !enabled {
+			return roundTripper
+		}
+		return &backendTimingCollector{roundTripper: roundTripper}
+	}
+}
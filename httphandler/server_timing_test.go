@@ -0,0 +1,59 @@
+package httphandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func serverTimingTransport(t *testing.T, enabled bool) (http.RoundTripper, string, func()) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	backendURL, _ := url.Parse(srv.URL)
+	conf := config.Config{YamlConfig: config.YamlConfig{EmitServerTiming: enabled}}
+	backendRoundTripper := BackendTimingCollector(enabled)(http.DefaultTransport)
+	transp := transport.NewMultiTransport(backendRoundTripper, []url.URL{*backendURL},
+		LateResponseHandler(conf), transport.MultiTransportOptions{})
+	return ServerTimingHeader(enabled)(transp), backendURL.Host, srv.Close
+}
+
+func TestServerTimingHeaderReportsBackendAndTotalTimes(t *testing.T) {
+	rt, backendHost, closeBackend := serverTimingTransport(t, true)
+	defer closeBackend()
+	req, _ := http.NewRequest("GET", "http://localhost/bucket/key", nil)
+
+	resp, err := rt.RoundTrip(req)
+
+	assert.NoError(t, err)
+	duration := `\d+\.\d{3}`
+	expected := regexp.MustCompile(`^backend-dial;dur=` + duration + `;desc="` + regexp.QuoteMeta(backendHost) + `", ` +
+		`backend-ttfb;dur=` + duration + `;desc="` + regexp.QuoteMeta(backendHost) + `", ` +
+		`total;dur=` + duration + `$`)
+	header := resp.Header.Get("Server-Timing")
+	assert.Regexp(t, expected, header)
+	ttfb := regexp.MustCompile(`backend-ttfb;dur=(\d+)\.`).FindStringSubmatch(header)
+	if assert.Len(t, ttfb, 2) {
+		assert.NotEqual(t, "0", ttfb[1], "backend answers after 5ms")
+	}
+}
+
+func TestServerTimingHeaderIsAbsentWhenDisabled(t *testing.T) {
+	rt, _, closeBackend := serverTimingTransport(t, false)
+	defer closeBackend()
+	req, _ := http.NewRequest("GET", "http://localhost/bucket/key", nil)
+
+	resp, err := rt.RoundTrip(req)
+
+	assert.NoError(t, err)
+	_, present := resp.Header["Server-Timing"]
+	assert.False(t, present)
+}
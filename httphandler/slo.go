@@ -0,0 +1,47 @@
+package httphandler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/allegro/akubra/metrics"
+)
+
+type sloRecorder struct {
+	tracker      *metrics.SLOTracker
+	backend      bool
+	roundTripper http.RoundTripper
+}
+
+func (sr *sloRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	since := time.Now()
+	resp, err := sr.roundTripper.RoundTrip(req)
+	key := metrics.SLOOverall
+	if sr.backend {
+		key = req.URL.Host
+	}
+	sr.tracker.Record(key, time.Since(since), err != nil || resp.StatusCode >= http.StatusInternalServerError)
+	return resp, err
+}
+
+func sloTracking(tracker *metrics.SLOTracker, backend bool) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		if tracker == nil {
+			return roundTripper
+		}
+		return &sloRecorder{tracker: tracker, backend: backend, roundTripper: roundTripper}
+	}
+}
+
+// ClientSLOTracking creates Decorator which records time until response
+// headers of client requests in tracker, responses with status 500 and
+// above and errors don't meet SLO. Nil tracker disables it
+func ClientSLOTracking(tracker *metrics.SLOTracker) Decorator {
+	return sloTracking(tracker, false)
+}
+
+// BackendSLOTracking creates Decorator which records backend request times
+// in tracker per backend host, like ClientSLOTracking
+func BackendSLOTracking(tracker *metrics.SLOTracker) Decorator {
+	return sloTracking(tracker, true)
+}
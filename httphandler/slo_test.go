@@ -0,0 +1,40 @@
+package httphandler
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSLOTrackingRecordsClientAndBackendRequests(t *testing.T) {
+	tracker := metrics.NewSLOTracker(50*time.Millisecond, time.Minute)
+	slow := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host == "slow.internal" {
+			time.Sleep(60 * time.Millisecond)
+		}
+		if req.URL.Host == "failing.internal" {
+			return nil, errors.New("connection refused")
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(nil)), Request: req}, nil
+	})
+	backend := Decorate(slow, BackendSLOTracking(tracker))
+	client := Decorate(backend, ClientSLOTracking(tracker))
+
+	for _, host := range []string{"fast.internal", "fast.internal", "slow.internal", "failing.internal"} {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+host+"/bucket/key", nil)
+		_, _ = client.RoundTrip(req)
+	}
+
+	stats := tracker.Stats()
+	assert.Equal(t, metrics.SLOStats{Requests: 4, WithinThreshold: 2, Fraction: 0.5}, stats[metrics.SLOOverall])
+	assert.Equal(t, metrics.SLOStats{Requests: 2, WithinThreshold: 2, Fraction: 1}, stats["fast.internal"])
+	assert.Equal(t, int64(0), stats["slow.internal"].WithinThreshold)
+	assert.Equal(t, int64(0), stats["failing.internal"].WithinThreshold)
+	assert.Equal(t, http.DefaultTransport, Decorate(http.DefaultTransport, ClientSLOTracking(nil)))
+}
@@ -0,0 +1,79 @@
+package httphandler
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/allegro/akubra/log"
+)
+
+// StartupPhase of akubra instance, phases follow in order of declaration
+type StartupPhase string
+
+const (
+	// PhaseBind lasts until Listen address is bound
+	PhaseBind StartupPhase = "bind"
+	// PhaseProbe lasts while backends are probed, requests are already served
+	PhaseProbe StartupPhase = "probe"
+	// PhaseReady is advertised by health check endpoint
+	PhaseReady StartupPhase = "ready"
+)
+
+// Readiness tracks startup phase, health check endpoint responds 503
+// STARTING until PhaseReady
+type Readiness struct {
+	mx    sync.RWMutex
+	phase StartupPhase
+}
+
+// NewReadiness creates Readiness in PhaseBind
+func NewReadiness() *Readiness {
+	return &Readiness{phase: PhaseBind}
+}
+
+// Phase returns current startup phase, nil Readiness is always ready
+func (r *Readiness) Phase() StartupPhase {
+	if r == nil {
+		return PhaseReady
+	}
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return r.phase
+}
+
+// Advance switches to phase and logs it
+func (r *Readiness) Advance(phase StartupPhase) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	log.Printf("Startup phase %s finished, entering %s", r.phase, phase)
+	r.phase = phase
+}
+
+type readinessHandler struct {
+	handler             http.Handler
+	readiness           *Readiness
+	healthCheckEndpoint string
+}
+
+func (rh *readinessHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if rh.readiness.Phase() == PhaseReady || strings.ToLower(req.URL.Path) != rh.healthCheckEndpoint {
+		rh.handler.ServeHTTP(w, req)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = io.WriteString(w, "STARTING")
+}
+
+// ReadinessGate wraps handler, health check endpoint responds with 503
+// STARTING until readiness reaches PhaseReady, other requests are served
+// already. Nil readiness disables it
+func ReadinessGate(handler http.Handler, readiness *Readiness, healthCheckEndpoint string) http.Handler {
+	if readiness == nil {
+		return handler
+	}
+	return &readinessHandler{handler: handler, readiness: readiness, healthCheckEndpoint: healthCheckEndpoint}
+}
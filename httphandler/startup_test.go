@@ -0,0 +1,59 @@
+package httphandler
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthCheckReportsStartupReadyAndDrainingStates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "akubra-startup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "drain")
+	sentinel := NewDrainSentinel(path, time.Second)
+	readiness := NewReadiness()
+	handler := DrainMode(ReadinessGate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}), readiness, "/status/ping"), sentinel, "/status/ping")
+	call := func(path string) *httptest.ResponseRecorder {
+		writer := httptest.NewRecorder()
+		handler.ServeHTTP(writer, httptest.NewRequest(http.MethodGet, path, nil))
+		return writer
+	}
+
+	for _, phase := range []StartupPhase{PhaseBind, PhaseProbe} {
+		if phase != readiness.Phase() {
+			readiness.Advance(phase)
+		}
+		health := call("/status/ping")
+		assert.Equal(t, http.StatusServiceUnavailable, health.Code, string(phase))
+		assert.Equal(t, "STARTING", health.Body.String(), string(phase))
+		assert.Equal(t, http.StatusOK, call("/bucket/key").Code, "requests should be served in %s phase", phase)
+	}
+
+	readiness.Advance(PhaseReady)
+	health := call("/status/ping")
+	assert.Equal(t, http.StatusOK, health.Code)
+	assert.Equal(t, "OK", health.Body.String())
+
+	require.NoError(t, ioutil.WriteFile(path, nil, 0600))
+	sentinel.check()
+	health = call("/status/ping")
+	assert.Equal(t, http.StatusServiceUnavailable, health.Code)
+	assert.Equal(t, "DRAINING", health.Body.String())
+}
+
+func TestReadinessGateIsDisabledWithoutReadiness(t *testing.T) {
+	handler := http.RedirectHandler("/", http.StatusFound)
+	assert.Equal(t, handler, ReadinessGate(handler, nil, "/status/ping"))
+	var readiness *Readiness
+	assert.Equal(t, PhaseReady, readiness.Phase())
+}
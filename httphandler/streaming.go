@@ -0,0 +1,73 @@
+package httphandler
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// flushingWriter pushes response body to client without waiting for
+// http.Server buffer to fill up. With zero interval every write is flushed,
+// otherwise written data is flushed at most interval later
+type flushingWriter struct {
+	writer   io.Writer
+	flusher  http.Flusher
+	interval time.Duration
+	mx       sync.Mutex
+	timer    *time.Timer
+	stopped  bool
+}
+
+func (fw *flushingWriter) Write(p []byte) (int, error) {
+	fw.mx.Lock()
+	defer fw.mx.Unlock()
+	n, err := fw.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if fw.interval <= 0 {
+		fw.flusher.Flush()
+		return n, nil
+	}
+	if fw.timer == nil {
+		fw.timer = time.AfterFunc(fw.interval, fw.delayedFlush)
+	}
+	return n, nil
+}
+
+func (fw *flushingWriter) delayedFlush() {
+	fw.mx.Lock()
+	defer fw.mx.Unlock()
+	fw.timer = nil
+	if !fw.stopped {
+		fw.flusher.Flush()
+	}
+}
+
+// stop cancels pending flush, has to be called before handler returns
+func (fw *flushingWriter) stop() {
+	fw.mx.Lock()
+	defer fw.mx.Unlock()
+	fw.stopped = true
+	if fw.timer != nil {
+		fw.timer.Stop()
+	}
+}
+
+// responseWriter returns writer response body is copied to, flushingWriter
+// if streaming is configured and client connection supports flushing
+func (h *Handler) responseWriter(w http.ResponseWriter) (io.Writer, func()) {
+	flusher, ok := w.(http.Flusher)
+	if !ok || !h.streamImmediately && h.flushInterval <= 0 {
+		return w, func() {}
+	}
+	interval := h.flushInterval
+	if h.streamImmediately {
+		interval = 0
+	}
+	// let client see response status before first body chunk comes
+	flusher.Flush()
+	fw := &flushingWriter{writer: w, flusher: flusher, interval: interval}
+	return fw, fw.stop
+}
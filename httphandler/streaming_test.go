@@ -0,0 +1,70 @@
+package httphandler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type pipeRoundTripper struct {
+	body io.ReadCloser
+}
+
+func (rt pipeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode:    http.StatusPartialContent,
+		Header:        make(http.Header),
+		ContentLength: -1,
+		Body:          rt.body,
+	}, nil
+}
+
+func TestShouldStreamResponseBodyIncrementally(t *testing.T) {
+	for _, testData := range []struct {
+		name              string
+		streamImmediately bool
+		flushInterval     time.Duration
+	}{
+		{"stream immediately", true, 0},
+		{"flush interval", false, 20 * time.Millisecond},
+	} {
+		backendBody, backendWriter := io.Pipe()
+		handler := &Handler{
+			roundTripper:          pipeRoundTripper{body: backendBody},
+			bodyMaxSize:           1024,
+			maxConcurrentRequests: 1,
+			streamImmediately:     testData.streamImmediately,
+			flushInterval:         testData.flushInterval,
+		}
+		srv := httptest.NewServer(handler)
+
+		resp, err := http.Get(srv.URL + "/bucket/video")
+		require.NoError(t, err, testData.name)
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode, testData.name)
+		for _, chunk := range []string{"first range chunk", "second range chunk"} {
+			_, err = backendWriter.Write([]byte(chunk))
+			require.NoError(t, err, testData.name)
+			received := make(chan string, 1)
+			go func() {
+				buf := make([]byte, len(chunk))
+				n, _ := io.ReadFull(resp.Body, buf)
+				received <- string(buf[:n])
+			}()
+			// backend keeps response open, so chunk comes only if flushed
+			select {
+			case got := <-received:
+				assert.Equal(t, chunk, got, testData.name)
+			case <-time.After(time.Second):
+				t.Errorf("%s: chunk %q was not flushed to client", testData.name, chunk)
+			}
+		}
+		assert.NoError(t, backendWriter.Close())
+		assert.NoError(t, resp.Body.Close())
+		srv.Close()
+	}
+}
@@ -0,0 +1,47 @@
+package httphandler
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+type tlsHandshakeListener struct {
+	net.Listener
+	config  *tls.Config
+	mainlog log.Logger
+}
+
+// watchHandshake reports failed handshake, http.Server waits for the same
+// handshake result under its own deadline
+func (tl *tlsHandshakeListener) watchHandshake(conn *tls.Conn) {
+	err := conn.Handshake()
+	// clients (e.g. TCP health checks) closing connection right away are
+	// not TLS failures
+	if err == nil || err == io.EOF {
+		return
+	}
+	metrics.Mark("reqs.global.tls_handshake_failures")
+	tl.mainlog.Printf("TLS handshake with %s failed: %s", conn.RemoteAddr(), err)
+}
+
+func (tl *tlsHandshakeListener) Accept() (net.Conn, error) {
+	conn, err := tl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Server(conn, tl.config)
+	go tl.watchHandshake(tlsConn)
+	return tlsConn, nil
+}
+
+// TLSHandshakeListener works like tls.NewListener, failed handshakes (e.g.
+// unknown SNI, protocol version or cipher suite mismatch) are counted as
+// reqs.global.tls_handshake_failures and logged to mainlog with client
+// address and reason
+func TLSHandshakeListener(listener net.Listener, config *tls.Config, mainlog log.Logger) net.Listener {
+	return &tlsHandshakeListener{Listener: listener, config: config, mainlog: mainlog}
+}
@@ -0,0 +1,57 @@
+package httphandler
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/log"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailedTLSHandshakeIsCountedAndLogged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "akubra-listener-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile, _ := writeClientCertificate(t, dir)
+	tlsConfig, err := ConfigureListenerTLS(config.Config{YamlConfig: config.YamlConfig{
+		TLSCertFile:     certFile,
+		TLSKeyFile:      keyFile,
+		TLSCipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+	}})
+	assert.NoError(t, err)
+	var mainlog lockedBuffer
+	logger := &logrus.Logger{Out: &mainlog, Formatter: log.PlainTextFormatter{}, Hooks: make(logrus.LevelHooks), Level: logrus.DebugLevel}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go func() { _ = srv.Serve(TLSHandshakeListener(listener, tlsConfig, logger)) }()
+	defer srv.Close()
+	failures := meterCount("reqs.global.tls_handshake_failures")
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if assert.NoError(t, err) {
+		assert.NoError(t, conn.Close())
+	}
+	assert.Equal(t, failures, meterCount("reqs.global.tls_handshake_failures"))
+
+	_, err = tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		CipherSuites:       []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA},
+	})
+	assert.Error(t, err)
+
+	waitFor(t, func() bool { return meterCount("reqs.global.tls_handshake_failures") == failures+1 },
+		"failed handshake should be counted")
+	waitFor(t, func() bool {
+		return strings.Contains(string(mainlog.Bytes()), "TLS handshake with 127.0.0.1:") &&
+			strings.Contains(string(mainlog.Bytes()), "no cipher suite supported")
+	}, "failed handshake should be logged with client address and reason")
+}
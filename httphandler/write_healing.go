@@ -0,0 +1,214 @@
+package httphandler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/allegro/akubra/transport"
+)
+
+// DefaultMaxPendingWrites limits number of pending writes if MaxPending is
+// not set
+const DefaultMaxPendingWrites = 10000
+
+type pendingWrite struct {
+	// source is request to backend which accepted write
+	source *http.Request
+	// target is request to backend which failed
+	target  *http.Request
+	healing bool
+}
+
+// PendingWritesHealer keeps writes which failed on some backends in memory
+// and re-attempts them once failed backend accepts another write. Failed
+// PUT is healed by copying object from backend which accepted it, failed
+// DELETE is sent again. Pending writes are lost on restart
+type PendingWritesHealer struct {
+	roundTripper http.RoundTripper
+	syncLog      log.Logger
+	maxPending   int
+	mx           sync.Mutex
+	// pending writes keyed by backend host and object
+	pending map[string]map[string]*pendingWrite
+	count   int
+}
+
+// NewPendingWritesHealer creates PendingWritesHealer sending requests with
+// given backend roundTripper
+func NewPendingWritesHealer(conf shardingconfig.WriteHealingConfig, roundTripper http.RoundTripper, syncLog log.Logger) *PendingWritesHealer {
+	maxPending := conf.MaxPending
+	if maxPending == 0 {
+		maxPending = DefaultMaxPendingWrites
+	}
+	return &PendingWritesHealer{
+		roundTripper: roundTripper,
+		syncLog:      syncLog,
+		maxPending:   maxPending,
+		pending:      make(map[string]map[string]*pendingWrite),
+	}
+}
+
+// healableWrite tells if write can be repeated without its body, writes of
+// subresources and multipart uploads are not
+func healableWrite(req *http.Request) bool {
+	return (req.Method == http.MethodPut || req.Method == http.MethodDelete) && req.URL.RawQuery == ""
+}
+
+func objectKey(req *http.Request) string {
+	return req.Host + req.URL.Path
+}
+
+// healRequest copies request without its body and headers
+func healRequest(req *http.Request) *http.Request {
+	u := *req.URL
+	copied := &http.Request{Method: req.Method, URL: &u, Host: req.Host, Header: http.Header{}}
+	if userAgent := req.Header.Get("User-Agent"); userAgent != "" {
+		copied.Header.Set("User-Agent", userAgent)
+	}
+	ctx := context.WithValue(context.Background(), log.ContextreqIDKey, req.Context().Value(log.ContextreqIDKey))
+	return copied.WithContext(transport.WithLowPriority(ctx))
+}
+
+// WriteDone implements transport.WriteHealer
+func (wh *PendingWritesHealer) WriteDone(outcomes []transport.WriteOutcome) {
+	var source *http.Request
+	for _, outcome := range outcomes {
+		if !outcome.Failed {
+			source = outcome.Request
+			break
+		}
+	}
+	// write failed everywhere, there is no replica to heal from
+	if source == nil {
+		return
+	}
+	var toHeal []*pendingWrite
+	wh.mx.Lock()
+	for _, outcome := range outcomes {
+		host := outcome.Request.URL.Host
+		if outcome.Failed {
+			if healableWrite(outcome.Request) {
+				wh.add(host, &pendingWrite{source: healRequest(source), target: healRequest(outcome.Request)})
+			}
+			continue
+		}
+		// successful write of the same object supersedes pending one
+		if healableWrite(outcome.Request) {
+			wh.remove(host, objectKey(outcome.Request), nil)
+		}
+		for _, pw := range wh.pending[host] {
+			if !pw.healing {
+				pw.healing = true
+				toHeal = append(toHeal, pw)
+			}
+		}
+	}
+	wh.mx.Unlock()
+	for _, pw := range toHeal {
+		wh.heal(pw)
+	}
+}
+
+func (wh *PendingWritesHealer) add(host string, pw *pendingWrite) {
+	key := objectKey(pw.target)
+	backendWrites, ok := wh.pending[host]
+	if !ok {
+		backendWrites = make(map[string]*pendingWrite)
+		wh.pending[host] = backendWrites
+	}
+	if _, replaced := backendWrites[key]; !replaced {
+		if wh.count >= wh.maxPending {
+			metrics.Mark("reqs.global.write_healing.dropped")
+			log.Debugf("Too many pending writes, %s on %s will not be healed", key, host)
+			return
+		}
+		wh.count++
+	}
+	backendWrites[key] = pw
+	metrics.UpdateGauge("reqs.global.write_healing.pending", int64(wh.count))
+}
+
+// remove drops pending write of object, only if it is still expected one
+// when expected is not nil
+func (wh *PendingWritesHealer) remove(host, key string, expected *pendingWrite) {
+	pw, ok := wh.pending[host][key]
+	if !ok || expected != nil && pw != expected {
+		return
+	}
+	delete(wh.pending[host], key)
+	if len(wh.pending[host]) == 0 {
+		delete(wh.pending, host)
+	}
+	wh.count--
+	metrics.UpdateGauge("reqs.global.write_healing.pending", int64(wh.count))
+}
+
+func (wh *PendingWritesHealer) heal(pw *pendingWrite) {
+	host := pw.target.URL.Host
+	var err error
+	if pw.target.Method == http.MethodDelete {
+		err = wh.deleteObject(pw.target)
+	} else {
+		err = copyObject(wh.roundTripper, transport.ReplicaVersion{Request: pw.source}, transport.ReplicaVersion{Request: pw.target})
+	}
+	wh.synclog(pw, err)
+	wh.mx.Lock()
+	pw.healing = false
+	if err == nil {
+		wh.remove(host, objectKey(pw.target), pw)
+	}
+	wh.mx.Unlock()
+	if err != nil {
+		metrics.Mark("reqs.backend." + metrics.Clean(host) + ".write_healing_errors")
+		log.Printf("Cannot heal %s %s on %s: %s", pw.target.Method, pw.target.URL.Path, host, err)
+		return
+	}
+	metrics.Mark("reqs.backend." + metrics.Clean(host) + ".write_healed")
+}
+
+func (wh *PendingWritesHealer) deleteObject(target *http.Request) error {
+	req, err := objectRequest(target.Context(), http.MethodDelete, transport.ReplicaVersion{Request: target})
+	if err != nil {
+		return err
+	}
+	resp, err := wh.roundTripper.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer discardResponseBody(resp)
+	if resp.StatusCode >= http.StatusMultipleChoices && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("backend responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (wh *PendingWritesHealer) synclog(pw *pendingWrite, err error) {
+	if wh.syncLog == nil {
+		return
+	}
+	errorMsg := "Healed pending write"
+	if err != nil {
+		errorMsg = fmt.Sprintf("Healing pending write failed: %s", err)
+	}
+	reqID, _ := pw.target.Context().Value(log.ContextreqIDKey).(string)
+	syncLogMsg := NewSyncLogMessageData(
+		pw.target.Method,
+		pw.target.URL.Host,
+		pw.target.URL.Path,
+		pw.source.URL.Host,
+		pw.target.Header.Get("User-Agent"),
+		reqID,
+		errorMsg,
+		-1)
+	logMsg, marshalErr := json.Marshal(syncLogMsg)
+	if marshalErr != nil {
+		return
+	}
+	wh.syncLog.Println(string(logMsg))
+}
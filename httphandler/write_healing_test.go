@@ -0,0 +1,187 @@
+package httphandler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/allegro/akubra/transport"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// objectStore backend keeps objects in memory and fails given number of
+// upcoming writes
+type objectStore struct {
+	*httptest.Server
+	mx       sync.Mutex
+	objects  map[string]string
+	failures int
+}
+
+func mkObjectStore() *objectStore {
+	store := &objectStore{objects: make(map[string]string)}
+	store.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		store.mx.Lock()
+		defer store.mx.Unlock()
+		if r.Method != http.MethodGet && store.failures > 0 {
+			store.failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		content, exists := store.objects[r.URL.Path]
+		switch {
+		case r.URL.RawQuery != "":
+			// subresources are not stored
+		case r.Method == http.MethodPut:
+			body, _ := ioutil.ReadAll(r.Body)
+			store.objects[r.URL.Path] = string(body)
+		case r.Method == http.MethodDelete:
+			delete(store.objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		case !exists:
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			_, _ = w.Write([]byte(content))
+		}
+	}))
+	return store
+}
+
+func (store *objectStore) object(path string) (string, bool) {
+	store.mx.Lock()
+	defer store.mx.Unlock()
+	content, exists := store.objects[path]
+	return content, exists
+}
+
+func (store *objectStore) failNextWrites(count int) {
+	store.mx.Lock()
+	defer store.mx.Unlock()
+	store.failures = count
+}
+
+func (wh *PendingWritesHealer) pendingCount() int {
+	wh.mx.Lock()
+	defer wh.mx.Unlock()
+	return wh.count
+}
+
+func waitFor(t *testing.T, condition func() bool, msg string) {
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func mkHealingTransport(synclog *lockedBuffer, stores ...*objectStore) (*transport.MultiTransport, *PendingWritesHealer) {
+	urls := make([]url.URL, 0, len(stores))
+	for _, store := range stores {
+		storeURL, _ := url.Parse(store.URL)
+		urls = append(urls, *storeURL)
+	}
+	logger := &logrus.Logger{
+		Out:       synclog,
+		Formatter: log.PlainTextFormatter{},
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.DebugLevel,
+	}
+	healer := NewPendingWritesHealer(shardingconfig.WriteHealingConfig{Enabled: true}, http.DefaultTransport, logger)
+	return transport.NewMultiTransport(http.DefaultTransport, urls, nil,
+		transport.MultiTransportOptions{WriteHealer: healer}), healer
+}
+
+func sendObjectWrite(t *testing.T, transp http.RoundTripper, method, path, body string) {
+	req, _ := http.NewRequest(method, "http://akubra.internal"+path, strings.NewReader(body))
+	resp, err := transp.RoundTrip(req)
+	require.NoError(t, err)
+	_, _ = ioutil.ReadAll(resp.Body)
+	assert.NoError(t, resp.Body.Close())
+}
+
+func TestWriteHealerCopiesObjectOnNextWriteToFailedBackend(t *testing.T) {
+	healthy, flaky := mkObjectStore(), mkObjectStore()
+	defer healthy.Close()
+	defer flaky.Close()
+	synclog := &lockedBuffer{}
+	transp, healer := mkHealingTransport(synclog, healthy, flaky)
+
+	flaky.failNextWrites(1)
+	sendObjectWrite(t, transp, http.MethodPut, "/bucket/key", "data")
+	waitFor(t, func() bool { return healer.pendingCount() == 1 }, "failed write should be pending")
+	_, exists := flaky.object("/bucket/key")
+	assert.False(t, exists)
+
+	sendObjectWrite(t, transp, http.MethodPut, "/bucket/other", "other data")
+	waitFor(t, func() bool { return healer.pendingCount() == 0 }, "pending write should be healed")
+	content, _ := flaky.object("/bucket/key")
+	assert.Equal(t, "data", content)
+	assert.Contains(t, string(synclog.Bytes()), "Healed pending write")
+	assert.Contains(t, string(synclog.Bytes()), `"failedhost":"`+flaky.Listener.Addr().String()+`"`)
+}
+
+func TestWriteHealerRepeatsDeleteOnNextWriteOfSameKey(t *testing.T) {
+	healthy, flaky := mkObjectStore(), mkObjectStore()
+	defer healthy.Close()
+	defer flaky.Close()
+	transp, healer := mkHealingTransport(&lockedBuffer{}, healthy, flaky)
+	sendObjectWrite(t, transp, http.MethodPut, "/bucket/key", "data")
+
+	flaky.failNextWrites(1)
+	sendObjectWrite(t, transp, http.MethodDelete, "/bucket/key", "")
+	waitFor(t, func() bool { return healer.pendingCount() == 1 }, "failed delete should be pending")
+
+	// subresource write does not replace object, pending delete is repeated
+	sendObjectWrite(t, transp, http.MethodPut, "/bucket/key?tagging", "<Tagging/>")
+	waitFor(t, func() bool { return healer.pendingCount() == 0 }, "pending delete should be healed")
+	_, exists := flaky.object("/bucket/key")
+	assert.False(t, exists)
+}
+
+func TestWriteHealerDropsPendingWriteSupersededByNewerWrite(t *testing.T) {
+	healthy, flaky := mkObjectStore(), mkObjectStore()
+	defer healthy.Close()
+	defer flaky.Close()
+	synclog := &lockedBuffer{}
+	transp, healer := mkHealingTransport(synclog, healthy, flaky)
+
+	flaky.failNextWrites(1)
+	sendObjectWrite(t, transp, http.MethodPut, "/bucket/key", "old")
+	waitFor(t, func() bool { return healer.pendingCount() == 1 }, "failed write should be pending")
+
+	sendObjectWrite(t, transp, http.MethodPut, "/bucket/key", "new")
+	waitFor(t, func() bool { return healer.pendingCount() == 0 }, "superseded write should be dropped")
+	content, _ := flaky.object("/bucket/key")
+	assert.Equal(t, "new", content)
+	assert.Empty(t, string(synclog.Bytes()))
+}
+
+func TestWriteHealerIgnoresWritesFailedEverywhere(t *testing.T) {
+	first, second := mkObjectStore(), mkObjectStore()
+	defer first.Close()
+	defer second.Close()
+	healer := NewPendingWritesHealer(shardingconfig.WriteHealingConfig{MaxPending: 1}, http.DefaultTransport, nil)
+	req := func(store *objectStore, path string) *http.Request {
+		r, _ := http.NewRequest(http.MethodPut, store.URL+path, bytes.NewBufferString("data"))
+		return r
+	}
+
+	healer.WriteDone([]transport.WriteOutcome{{Request: req(first, "/bucket/key"), Failed: true}, {Request: req(second, "/bucket/key"), Failed: true}})
+	assert.Equal(t, 0, healer.pendingCount())
+
+	healer.WriteDone([]transport.WriteOutcome{{Request: req(first, "/bucket/key"), Failed: true}, {Request: req(second, "/bucket/key")}})
+	healer.WriteDone([]transport.WriteOutcome{{Request: req(first, "/bucket/other"), Failed: true}, {Request: req(second, "/bucket/other")}})
+	assert.Equal(t, 1, healer.pendingCount(), "pending writes should be limited by MaxPending")
+}
@@ -0,0 +1,113 @@
+package httphandler
+
+import (
+	"bytes"
+	"encoding/xml"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// maxRewrittenXMLBody limits buffered response size, larger bodies are
+// passed unchanged
+const maxRewrittenXMLBody = 1 << 20
+
+var (
+	locationStart = []byte("<Location>")
+	locationEnd   = []byte("</Location>")
+)
+
+// s3Operation names operation of request, empty if it has no XML body worth
+// rewriting
+func s3Operation(req *http.Request) string {
+	if req.Method != http.MethodPost {
+		return ""
+	}
+	query := req.URL.Query()
+	if _, ok := query["uploadId"]; ok {
+		return httphandlerconfig.CompleteMultipartUpload
+	}
+	if req.URL.RawQuery == "" {
+		return httphandlerconfig.PostObject
+	}
+	return ""
+}
+
+func isXMLResponse(resp *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && (mediaType == "application/xml" || mediaType == "text/xml")
+}
+
+// rewriteLocations replaces backend host in URLs of Location elements
+func (bhr *backendHostRewriter) rewriteLocations(body []byte, publicHost, scheme string) ([]byte, bool) {
+	var rewritten bytes.Buffer
+	changed := false
+	for {
+		start := bytes.Index(body, locationStart)
+		if start < 0 {
+			break
+		}
+		start += len(locationStart)
+		end := bytes.Index(body[start:], locationEnd)
+		if end < 0 {
+			break
+		}
+		end += start
+		rewritten.Write(body[:start])
+		value := body[start:end]
+		u, err := url.Parse(html.UnescapeString(string(value)))
+		if err == nil && bhr.backendHosts[u.Host] {
+			u.Host = publicHost
+			u.Scheme = scheme
+			if xml.EscapeText(&rewritten, []byte(u.String())) == nil {
+				changed = true
+				value = nil
+			}
+		}
+		rewritten.Write(value)
+		body = body[end:]
+	}
+	if !changed {
+		return nil, false
+	}
+	rewritten.Write(body)
+	return rewritten.Bytes(), true
+}
+
+// rewriteXMLBody replaces backend host in Location elements of XML responses
+// of configured operations. Bodies over maxRewrittenXMLBody are not modified
+func (bhr *backendHostRewriter) rewriteXMLBody(req *http.Request, resp *http.Response, publicHost, scheme string) {
+	if resp.Body == nil || !bhr.xmlOperations[s3Operation(req)] || !isXMLResponse(resp) ||
+		resp.Header.Get("Content-Encoding") != "" || resp.ContentLength > maxRewrittenXMLBody {
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRewrittenXMLBody+1))
+	if err != nil || len(body) > maxRewrittenXMLBody {
+		if err != nil {
+			log.Debugf("Cannot read %s response body for rewrite: %s", s3Operation(req), err)
+		}
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return
+	}
+	if closeErr := resp.Body.Close(); closeErr != nil {
+		log.Debugf("Cannot close %s response body: %s", s3Operation(req), closeErr)
+	}
+	if rewritten, ok := bhr.rewriteLocations(body, publicHost, scheme); ok {
+		metrics.Mark("reqs.global.xml_rewrites")
+		body = rewritten
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
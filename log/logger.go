@@ -81,6 +81,19 @@ type LoggerConfig struct {
 	Syslog    string       `yaml:"syslog"`
 	Database  sql.DBConfig `yaml:"database"`
 	Level     string       `yaml:"level"`
+	// File is rotated once it grows over MaxSizeMB megabytes or
+	// RotateInterval passes, zero values disable rotation
+	MaxSizeMB      int           `yaml:"maxsizemb,omitempty"`
+	RotateInterval time.Duration `yaml:"rotateinterval,omitempty"`
+	// Number of rotated files kept, zero keeps all of them
+	MaxBackups int `yaml:"maxbackups,omitempty"`
+	// Rotated files are gzipped
+	Compress bool `yaml:"compress,omitempty"`
+}
+
+// rotated tells if log file is rotated
+func (config LoggerConfig) rotated() bool {
+	return config.MaxSizeMB > 0 || config.RotateInterval > 0
 }
 
 func createLogWriter(config LoggerConfig) (io.Writer, error) {
@@ -98,7 +111,13 @@ func createLogWriter(config LoggerConfig) (io.Writer, error) {
 	if config.Stdout {
 		writers = append(writers, os.Stdout)
 	}
-	if config.File != "" {
+	if config.File != "" && config.rotated() {
+		f, err := openRotatingFile(config)
+		if err != nil {
+			return nil, err
+		}
+		writers = append(writers, f)
+	} else if config.File != "" {
 		f, err := os.OpenFile(config.File, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
 		if err != nil {
 			return nil, err
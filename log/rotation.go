@@ -0,0 +1,182 @@
+package log
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat names rotated files, so they sort by rotation time
+const backupTimeFormat = "20060102T150405.000000000"
+
+// rotatingFile is log file rotated once it grows over maxSize bytes or
+// interval passes since it was opened. Rotated file is renamed to backup
+// with timestamp suffix, optionally gzipped, and only maxBackups newest
+// backups are kept
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+	compress   bool
+	now        func() time.Time
+
+	mx           sync.Mutex
+	file         *os.File
+	size         int64
+	opened       time.Time
+	lastRotation time.Time
+	// housekeeping of backups is done in background, one at a time
+	housekeeping sync.WaitGroup
+	queue        chan string
+}
+
+func openRotatingFile(config LoggerConfig) (*rotatingFile, error) {
+	rf := &rotatingFile{
+		path:       config.File,
+		maxSize:    int64(config.MaxSizeMB) << 20,
+		interval:   config.RotateInterval,
+		maxBackups: config.MaxBackups,
+		compress:   config.Compress,
+		now:        time.Now,
+		queue:      make(chan string, 16),
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	go rf.processBackups()
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	rf.file = f
+	rf.size = info.Size()
+	rf.opened = rf.now()
+	return nil
+}
+
+// Write implements io.Writer, file is rotated before write which would
+// exceed its size limit
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mx.Lock()
+	defer rf.mx.Unlock()
+	sizeExceeded := rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize
+	intervalPassed := rf.interval > 0 && rf.now().Sub(rf.opened) >= rf.interval
+	if sizeExceeded || intervalPassed {
+		if err := rf.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot rotate log file %s: %s\n", rf.path, err)
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+	now := rf.now()
+	// backups rotated within the same clock tick would share name
+	if !now.After(rf.lastRotation) {
+		now = rf.lastRotation.Add(time.Nanosecond)
+	}
+	rf.lastRotation = now
+	backup := rf.path + "." + now.UTC().Format(backupTimeFormat)
+	renameErr := os.Rename(rf.path, backup)
+	if err := rf.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	rf.housekeeping.Add(1)
+	rf.queue <- backup
+	return nil
+}
+
+func (rf *rotatingFile) processBackups() {
+	for backup := range rf.queue {
+		if rf.compress {
+			if err := compressFile(backup); err != nil {
+				fmt.Fprintf(os.Stderr, "Cannot compress log file %s: %s\n", backup, err)
+			}
+		}
+		rf.removeOldBackups()
+		rf.housekeeping.Done()
+	}
+}
+
+// compressFile replaces file with its gzipped copy
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = src.Close() }()
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// backups lists rotated files of log, oldest first
+func (rf *rotatingFile) backups() ([]string, error) {
+	matches, err := filepath.Glob(rf.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	backups := make([]string, 0, len(matches))
+	for _, match := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(match, rf.path+"."), ".gz")
+		if _, err := time.Parse(backupTimeFormat, suffix); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+func (rf *rotatingFile) removeOldBackups() {
+	if rf.maxBackups <= 0 {
+		return
+	}
+	backups, err := rf.backups()
+	if err != nil {
+		return
+	}
+	for len(backups) > rf.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot remove log file %s: %s\n", backups[0], err)
+		}
+		backups = backups[1:]
+	}
+}
@@ -0,0 +1,101 @@
+package log
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mkLogDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "akubra-log")
+	require.NoError(t, err)
+	return dir, func() { _ = os.RemoveAll(dir) }
+}
+
+func gunzip(t *testing.T, path string) string {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	content, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	return string(content)
+}
+
+func TestRotatingFileRotatesOnSizeAndCompressesBackups(t *testing.T) {
+	dir, cleanup := mkLogDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "access.log")
+	rf, err := openRotatingFile(LoggerConfig{File: path, MaxSizeMB: 1, MaxBackups: 2, Compress: true})
+	require.NoError(t, err)
+	rf.maxSize = 100
+
+	for _, line := range []string{"first", "second", "third", "fourth"} {
+		_, err = rf.Write([]byte(strings.Repeat(line[:1], 59) + "\n"))
+		require.NoError(t, err)
+	}
+	rf.housekeeping.Wait()
+
+	backups, err := rf.backups()
+	require.NoError(t, err)
+	require.Len(t, backups, 2, "only MaxBackups newest backups should be kept")
+	for i, backup := range backups {
+		assert.True(t, strings.HasSuffix(backup, ".gz"), "backup %s should be compressed", backup)
+		assert.Equal(t, strings.Repeat([]string{"s", "t"}[i], 59)+"\n", gunzip(t, backup))
+	}
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("f", 59)+"\n", string(content))
+}
+
+func TestRotatingFileRotatesOnInterval(t *testing.T) {
+	dir, cleanup := mkLogDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "akubra.log")
+	rf, err := openRotatingFile(LoggerConfig{File: path, RotateInterval: time.Hour})
+	require.NoError(t, err)
+	moment := time.Now()
+	rf.now = func() time.Time { return moment }
+	rf.opened = moment
+
+	_, err = rf.Write([]byte("old\n"))
+	require.NoError(t, err)
+	moment = moment.Add(30 * time.Minute)
+	_, err = rf.Write([]byte("still old\n"))
+	require.NoError(t, err)
+	moment = moment.Add(time.Hour)
+	_, err = rf.Write([]byte("new\n"))
+	require.NoError(t, err)
+	rf.housekeeping.Wait()
+
+	backups, err := rf.backups()
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	backup, err := ioutil.ReadFile(backups[0])
+	require.NoError(t, err)
+	assert.Equal(t, "old\nstill old\n", string(backup))
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "new\n", string(content))
+}
+
+func TestLoggerWritesToRotatedFile(t *testing.T) {
+	dir, cleanup := mkLogDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "access.log")
+	logger, err := NewLogger(LoggerConfig{File: path, PlainText: true, MaxSizeMB: 1, Compress: true})
+	require.NoError(t, err)
+
+	logger.Println("entry")
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "entry\n", string(content))
+}
@@ -1,17 +1,23 @@
 package main
 
 import (
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"time"
 
 	"github.com/alecthomas/kingpin"
 	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/httphandler"
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
 	"github.com/allegro/akubra/metrics"
 	"github.com/allegro/akubra/regions"
+	"github.com/allegro/akubra/storages"
 	_ "github.com/lib/pq"
 	graceful "gopkg.in/tylerb/graceful.v1"
 )
@@ -19,16 +25,44 @@ import (
 // YamlValidationErrorExitCode for problems with YAML config validation
 const YamlValidationErrorExitCode = 20
 
+// SelfTestFailedExitCode for backends unreachable during self test
+const SelfTestFailedExitCode = 21
+
+// SelfTestBackendTimeout limits single backend check duration
+const SelfTestBackendTimeout = 5 * time.Second
+
+// DefaultReadTimeout limits reading client request if ReadTimeout is not set
+const DefaultReadTimeout = 5 * time.Second
+
+// DefaultWriteTimeout limits writing response if WriteTimeout is not set
+const DefaultWriteTimeout = 10 * time.Second
+
+// DefaultListenRetryDelay separates bind attempts if ListenRetry.Delay is not set
+const DefaultListenRetryDelay = time.Second
+
 // TechnicalEndpointGeneralTimeout for /configuration/validate endpoint
 const TechnicalEndpointGeneralTimeout = 5 * time.Second
 
+// TechnicalEndpointPprofWriteTimeout allows collecting CPU profiles and traces
+const TechnicalEndpointPprofWriteTimeout = 60 * time.Second
+
 type service struct {
-	conf config.Config
+	conf     config.Config
+	readOnly *httphandler.ReadOnlySwitch
+	clients  *httphandler.ClientAccounting
+	drain    *httphandler.DrainSentinel
+	preStop  *httphandler.PreStop
+	// drainMetrics reports requests in flight during shutdown
+	drainMetrics *httphandler.DrainMetrics
+	// readiness follows startup phases for health check endpoint
+	readiness *httphandler.Readiness
 }
 
 var (
 	// filled by linker
-	version = "development"
+	version   = "development"
+	commit    = "unknown"
+	buildDate = "unknown"
 
 	// CLI flags
 	configFile = kingpin.
@@ -40,10 +74,35 @@ var (
 			Flag("test-config", "Testing only configuration file from 'config' arg. (app. not starting).").
 			Short('t').
 			Bool()
+	selfTest = kingpin.
+			Flag("selftest", "Check if all backends are reachable before start, exit on failure.").
+			Bool()
 )
 
+// buildInfo describes running build, served on /version technical endpoint
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+}
+
+func currentBuild() buildInfo {
+	return buildInfo{Version: version, Commit: commit, BuildDate: buildDate}
+}
+
+func (bi buildInfo) String() string {
+	return fmt.Sprintf("Akubra (%s version, commit %s, built %s)", bi.Version, bi.Commit, bi.BuildDate)
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(currentBuild()); err != nil {
+		log.Printf("Cannot write version response: %s", err)
+	}
+}
+
 func main() {
-	versionString := fmt.Sprintf("Akubra (%s version)", version)
+	versionString := currentBuild().String()
 	kingpin.Version(versionString)
 	kingpin.Parse()
 	conf, err := config.Configure(*configFile)
@@ -58,6 +117,9 @@ func main() {
 		os.Exit(YamlValidationErrorExitCode)
 	}
 	log.Println("Configuration checked - OK.")
+	if *selfTest && !runSelfTest(conf) {
+		os.Exit(SelfTestFailedExitCode)
+	}
 	if *testConfig {
 		os.Exit(0)
 	}
@@ -65,6 +127,7 @@ func main() {
 	log.Printf("Health check endpoint: %s", conf.HealthCheckEndpoint)
 
 	mainlog := conf.Mainlog
+	mainlog.Println(versionString)
 	mainlog.Printf("starting on port %s", conf.Listen)
 	mainlog.Printf("backends %s", conf.Backends)
 
@@ -76,6 +139,22 @@ func main() {
 	}
 }
 
+// listenWithRetry binds address, after failure it's retried conf.Attempts
+// times conf.Delay apart
+func listenWithRetry(address string, conf httphandlerconfig.ListenRetryConfig, sleep func(time.Duration)) (net.Listener, error) {
+	delay := conf.Delay.Duration
+	if delay == 0 {
+		delay = DefaultListenRetryDelay
+	}
+	listener, err := net.Listen("tcp", address)
+	for attempt := 1; err != nil && attempt <= conf.Attempts; attempt++ {
+		log.Printf("Cannot listen on %s: %s, retry %d/%d in %s", address, err, attempt, conf.Attempts, delay)
+		sleep(delay)
+		listener, err = net.Listen("tcp", address)
+	}
+	return listener, err
+}
+
 func (s *service) start() error {
 	handler, err := regions.NewHandler(s.conf)
 
@@ -89,43 +168,194 @@ func (s *service) start() error {
 		return err
 	}
 
+	readTimeout := s.conf.ReadTimeout.Duration
+	if readTimeout == 0 {
+		readTimeout = DefaultReadTimeout
+	}
+	writeTimeout := s.conf.WriteTimeout.Duration
+	if writeTimeout == 0 {
+		writeTimeout = DefaultWriteTimeout
+	}
+	connections := httphandler.NewConnectionRegistry()
+	reaper := httphandler.NewIdleConnectionReaper(s.conf.ClientIdleTimeout.Duration)
+	go reaper.Run(nil)
+	serverHandler := httphandler.RequestQueue(handler, s.conf.RequestQueue)
+	serverHandler = httphandler.ReadOnlyMode(serverHandler, s.readOnly)
+	serverHandler = httphandler.ClientAccountingHandler(serverHandler, s.clients)
+	serverHandler = httphandler.BodyReadIdleTimeout(serverHandler, connections, s.conf.BodyReadIdleTimeout.Duration, readTimeout)
+	trustedNetworks, err := httphandler.ParseNetworks(s.conf.TrustedNetworks)
+	if err != nil {
+		return err
+	}
+	serverHandler = httphandler.FeatureFlags(serverHandler, trustedNetworks)
+	serverHandler = httphandler.MethodTimeouts(serverHandler, connections,
+		s.conf.ReadRequestTimeout.Duration, s.conf.WriteRequestTimeout.Duration,
+		httphandler.TimeoutOverride{
+			Max:             s.conf.MaxTimeoutOverride.Duration,
+			TrustedNetworks: trustedNetworks,
+			AdminToken:      s.conf.AdminToken,
+		})
+	serverHandler = httphandler.ReadinessGate(serverHandler, s.readiness, s.conf.HealthCheckEndpoint)
+	serverHandler = httphandler.DrainMode(serverHandler, s.drain, s.conf.HealthCheckEndpoint)
+	if s.drain != nil {
+		go s.drain.Watch(nil)
+	}
+	serverHandler = httphandler.ServerWideOptions(serverHandler, s.conf.AllowedMethods)
+	serverHandler = httphandler.HTTP10Connections(serverHandler, s.conf.ForceCloseHTTP10)
+	serverHandler = httphandler.PreStopTracking(serverHandler, s.preStop)
+	serverHandler = httphandler.DrainTracking(serverHandler, s.drainMetrics)
 	srv := &graceful.Server{
 		Server: &http.Server{
 			Addr:         s.conf.Listen,
-			Handler:      handler,
-			ReadTimeout:  5 * time.Second,
-			WriteTimeout: 10 * time.Second,
+			Handler:      serverHandler,
+			ReadTimeout:  readTimeout,
+			WriteTimeout: writeTimeout,
 		},
 		Timeout: 10 * time.Second,
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			connections.ConnState(conn, state)
+			reaper.ConnState(conn, state)
+		},
+		ShutdownInitiated: s.drainMetrics.Start,
 	}
 
 	srv.SetKeepAlivesEnabled(true)
-	listener, err := net.Listen("tcp", s.conf.Listen)
+	listener, err := listenWithRetry(s.conf.Listen, s.conf.ListenRetry, time.Sleep)
 
 	if err != nil {
 		log.Fatalln(err)
 	}
+	listener = httphandler.ClientConnLimitListener(listener, s.conf.ClientConnLimit)
+	if s.conf.AcceptProxyProtocol {
+		listener = httphandler.ProxyProtocolListener(listener, httphandler.ProxyHeaderTimeout)
+	}
+	listener = httphandler.ConnLimitListener(listener, s.conf.MaxConnsPerIP)
+	tlsConfig, err := httphandler.ConfigureListenerTLS(s.conf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if tlsConfig != nil {
+		listener = httphandler.TLSHandshakeListener(listener, tlsConfig, s.conf.Mainlog)
+	}
+	if s.conf.StrictContentLength {
+		listener = httphandler.StrictFramingListener(listener)
+	}
+	if s.conf.LogMalformedRequests {
+		listener = httphandler.MalformedRequestListener(listener)
+	}
+	if s.conf.StartupProbe {
+		s.readiness.Advance(httphandler.PhaseProbe)
+		go s.startupProbe(runSelfTest)
+	} else {
+		s.readiness.Advance(httphandler.PhaseReady)
+	}
+
+	err = srv.Serve(listener)
+	s.drainMetrics.Finish()
+	return err
+}
+
+// startupProbe checks backends with probe and advertises readiness after it,
+// unreachable backends are logged only
+func (s *service) startupProbe(probe func(config.Config) bool) {
+	if !probe(s.conf) {
+		log.Println("Startup probe found unreachable backends")
+	}
+	s.readiness.Advance(httphandler.PhaseReady)
+}
 
-	return srv.Serve(listener)
+func runSelfTest(conf config.Config) bool {
+	httptransp, err := httphandler.ConfigureHTTPTransport(conf)
+	if err != nil {
+		log.Printf("Self test could not configure transport: %s", err)
+		return false
+	}
+	passed := true
+	for _, result := range storages.CheckBackends(conf, httptransp, SelfTestBackendTimeout) {
+		if result.Err != nil {
+			passed = false
+			log.Printf("Self test backend %s - FAIL: %s", result.Backend, result.Err)
+			continue
+		}
+		log.Printf("Self test backend %s - OK", result.Backend)
+	}
+	return passed
 }
 
 func newService(cfg config.Config) *service {
-	return &service{conf: cfg}
+	drain := httphandler.NewDrainSentinel(cfg.DrainSentinelFile, cfg.DrainSentinelInterval.Duration)
+	if drain == nil && cfg.PreStop.Enabled {
+		drain = httphandler.NewForcedDrainSentinel()
+	}
+	return &service{
+		conf:         cfg,
+		readOnly:     httphandler.NewReadOnlySwitch(cfg.ReadOnly),
+		clients:      httphandler.NewClientAccounting(cfg.ClientAccounting),
+		drain:        drain,
+		preStop:      httphandler.NewPreStop(cfg.PreStop, drain),
+		readiness:    httphandler.NewReadiness(),
+		drainMetrics: httphandler.NewDrainMetrics(cfg.DrainMetrics, cfg.Mainlog),
+	}
 }
-func (s *service) startTechnicalEndpoint(conf config.Config) {
-	log.Printf("Starting technical HTTP endpoint on port: %q", conf.TechnicalEndpointListen)
+func adminTokenProtected(token string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		expected := []byte("Bearer " + token)
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func technicalEndpointHandler(conf config.Config, readOnly *httphandler.ReadOnlySwitch, clients *httphandler.ClientAccounting,
+	preStop *httphandler.PreStop) http.Handler {
 	serveMuxHandler := http.NewServeMux()
 	serveMuxHandler.HandleFunc(
 		"/configuration/validate",
 		config.ValidateConfigurationHTTPHandler,
 	)
+	serveMuxHandler.HandleFunc("/version", versionHandler)
+	if conf.AdminToken != "" {
+		serveMuxHandler.HandleFunc("/admin/readonly", adminTokenProtected(conf.AdminToken, readOnly.AdminHandler(true)))
+		serveMuxHandler.HandleFunc("/admin/readwrite", adminTokenProtected(conf.AdminToken, readOnly.AdminHandler(false)))
+		if clients != nil {
+			serveMuxHandler.HandleFunc("/admin/clients", adminTokenProtected(conf.AdminToken, clients.AdminHandler))
+		}
+		if conf.SLO != nil {
+			serveMuxHandler.HandleFunc("/admin/slo", adminTokenProtected(conf.AdminToken, conf.SLO.AdminHandler))
+		}
+		if preStop != nil {
+			serveMuxHandler.HandleFunc("/admin/prestop", adminTokenProtected(conf.AdminToken, preStop.AdminHandler))
+		}
+	}
+	if conf.EnablePprof {
+		serveMuxHandler.HandleFunc("/debug/pprof/", adminTokenProtected(conf.AdminToken, pprof.Index))
+		serveMuxHandler.HandleFunc("/debug/pprof/cmdline", adminTokenProtected(conf.AdminToken, pprof.Cmdline))
+		serveMuxHandler.HandleFunc("/debug/pprof/profile", adminTokenProtected(conf.AdminToken, pprof.Profile))
+		serveMuxHandler.HandleFunc("/debug/pprof/symbol", adminTokenProtected(conf.AdminToken, pprof.Symbol))
+		serveMuxHandler.HandleFunc("/debug/pprof/trace", adminTokenProtected(conf.AdminToken, pprof.Trace))
+	}
+	return serveMuxHandler
+}
+
+func (s *service) startTechnicalEndpoint(conf config.Config) {
+	log.Printf("Starting technical HTTP endpoint on port: %q", conf.TechnicalEndpointListen)
+	writeTimeout := TechnicalEndpointGeneralTimeout
+	if conf.EnablePprof {
+		log.Println("Profiling endpoint /debug/pprof/ enabled")
+		writeTimeout = TechnicalEndpointPprofWriteTimeout
+	}
+	if s.preStop != nil && s.preStop.Timeout()+TechnicalEndpointGeneralTimeout > writeTimeout {
+		writeTimeout = s.preStop.Timeout() + TechnicalEndpointGeneralTimeout
+	}
 	go func() {
 		srv := &graceful.Server{
 			Server: &http.Server{
 				Addr:           conf.TechnicalEndpointListen,
-				Handler:        serveMuxHandler,
+				Handler:        technicalEndpointHandler(conf, s.readOnly, s.clients, s.preStop),
 				MaxHeaderBytes: 512,
-				WriteTimeout:   TechnicalEndpointGeneralTimeout,
+				WriteTimeout:   writeTimeout,
 				ReadTimeout:    TechnicalEndpointGeneralTimeout,
 			},
 			Timeout:      TechnicalEndpointGeneralTimeout,
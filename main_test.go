@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/httphandler"
+	httphandlerconfig "github.com/allegro/akubra/httphandler/config"
+	"github.com/allegro/akubra/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPprofRoutesRegisteredOnlyWhenEnabled(t *testing.T) {
+	for _, testData := range []struct {
+		enabled        bool
+		token          string
+		expectedStatus int
+	}{
+		{false, "Bearer secret", http.StatusNotFound},
+		{true, "Bearer secret", http.StatusOK},
+		{true, "Bearer wrong", http.StatusUnauthorized},
+		{true, "", http.StatusUnauthorized},
+	} {
+		conf := config.Config{YamlConfig: config.YamlConfig{
+			EnablePprof: testData.enabled,
+			AdminToken:  "secret",
+		}}
+		handler := technicalEndpointHandler(conf, httphandler.NewReadOnlySwitch(false), nil, nil)
+		request := httptest.NewRequest(http.MethodGet, "http://localhost/debug/pprof/", nil)
+		request.Header.Set("Authorization", testData.token)
+		writer := httptest.NewRecorder()
+
+		handler.ServeHTTP(writer, request)
+
+		assert.Equal(t, testData.expectedStatus, writer.Code)
+	}
+}
+
+func TestVersionEndpointReturnsBuildInfo(t *testing.T) {
+	defaultVersion, defaultCommit, defaultBuildDate := version, commit, buildDate
+	version, commit, buildDate = "1.2.3", "a1b2c3d", "2017-10-01T12:00:00Z"
+	defer func() { version, commit, buildDate = defaultVersion, defaultCommit, defaultBuildDate }()
+	handler := technicalEndpointHandler(config.Config{}, httphandler.NewReadOnlySwitch(false), nil, nil)
+	request := httptest.NewRequest(http.MethodGet, "http://localhost/version", nil)
+	writer := httptest.NewRecorder()
+
+	handler.ServeHTTP(writer, request)
+
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.Equal(t, "application/json", writer.Header().Get("Content-Type"))
+	info := buildInfo{}
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &info))
+	assert.Equal(t, buildInfo{Version: "1.2.3", Commit: "a1b2c3d", BuildDate: "2017-10-01T12:00:00Z"}, info)
+	assert.Equal(t, "Akubra (1.2.3 version, commit a1b2c3d, built 2017-10-01T12:00:00Z)", info.String())
+}
+
+func TestReadOnlyModeIsSwitchedByAdminEndpoints(t *testing.T) {
+	readOnly := httphandler.NewReadOnlySwitch(false)
+	handler := technicalEndpointHandler(config.Config{YamlConfig: config.YamlConfig{AdminToken: "secret"}}, readOnly, nil, nil)
+	call := func(method, path, token string) int {
+		request := httptest.NewRequest(method, "http://localhost"+path, nil)
+		request.Header.Set("Authorization", token)
+		writer := httptest.NewRecorder()
+		handler.ServeHTTP(writer, request)
+		return writer.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, call(http.MethodPost, "/admin/readonly", "Bearer wrong"))
+	assert.False(t, readOnly.ReadOnly())
+	assert.Equal(t, http.StatusMethodNotAllowed, call(http.MethodGet, "/admin/readonly", "Bearer secret"))
+	assert.Equal(t, http.StatusOK, call(http.MethodPost, "/admin/readonly", "Bearer secret"))
+	assert.True(t, readOnly.ReadOnly())
+	assert.Equal(t, http.StatusOK, call(http.MethodPost, "/admin/readwrite", "Bearer secret"))
+	assert.False(t, readOnly.ReadOnly())
+}
+
+func TestReadOnlyEndpointsRequireAdminToken(t *testing.T) {
+	handler := technicalEndpointHandler(config.Config{}, httphandler.NewReadOnlySwitch(false), nil, nil)
+	request := httptest.NewRequest(http.MethodPost, "http://localhost/admin/readonly", nil)
+	writer := httptest.NewRecorder()
+
+	handler.ServeHTTP(writer, request)
+
+	assert.Equal(t, http.StatusNotFound, writer.Code)
+}
+
+func TestClientsEndpointRequiresAdminToken(t *testing.T) {
+	clients := httphandler.NewClientAccounting(httphandlerconfig.ClientAccountingConfig{Enabled: true})
+	handler := technicalEndpointHandler(config.Config{YamlConfig: config.YamlConfig{AdminToken: "secret"}},
+		httphandler.NewReadOnlySwitch(false), clients, nil)
+	call := func(token string) int {
+		request := httptest.NewRequest(http.MethodGet, "http://localhost/admin/clients", nil)
+		request.Header.Set("Authorization", token)
+		writer := httptest.NewRecorder()
+		handler.ServeHTTP(writer, request)
+		return writer.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, call("Bearer wrong"))
+	assert.Equal(t, http.StatusOK, call("Bearer secret"))
+}
+
+func TestPreStopEndpointRequiresAdminToken(t *testing.T) {
+	preStop := httphandler.NewPreStop(httphandlerconfig.PreStopConfig{Enabled: true}, httphandler.NewForcedDrainSentinel())
+	handler := technicalEndpointHandler(config.Config{YamlConfig: config.YamlConfig{AdminToken: "secret"}},
+		httphandler.NewReadOnlySwitch(false), nil, preStop)
+	call := func(token string) int {
+		request := httptest.NewRequest(http.MethodPost, "http://localhost/admin/prestop", nil)
+		request.Header.Set("Authorization", token)
+		writer := httptest.NewRecorder()
+		handler.ServeHTTP(writer, request)
+		return writer.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, call("Bearer wrong"))
+	assert.Equal(t, http.StatusOK, call("Bearer secret"))
+}
+
+func TestSLOEndpointIsServedWhenThresholdIsSet(t *testing.T) {
+	conf := config.Config{YamlConfig: config.YamlConfig{AdminToken: "secret"}}
+	call := func(conf config.Config) int {
+		request := httptest.NewRequest(http.MethodGet, "http://localhost/admin/slo", nil)
+		request.Header.Set("Authorization", "Bearer secret")
+		writer := httptest.NewRecorder()
+		technicalEndpointHandler(conf, httphandler.NewReadOnlySwitch(false), nil, nil).ServeHTTP(writer, request)
+		return writer.Code
+	}
+
+	assert.Equal(t, http.StatusNotFound, call(conf))
+	conf.SLO = metrics.NewSLOTracker(time.Second, time.Minute)
+	assert.Equal(t, http.StatusOK, call(conf))
+}
+
+func TestListenIsRetriedUntilPortIsReleased(t *testing.T) {
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	address := occupied.Addr().String()
+	var delays []time.Duration
+	sleep := func(delay time.Duration) {
+		delays = append(delays, delay)
+		if len(delays) == 2 {
+			assert.NoError(t, occupied.Close())
+		}
+	}
+
+	listener, err := listenWithRetry(address, httphandlerconfig.ListenRetryConfig{
+		Attempts: 5,
+		Delay:    metrics.Interval{Duration: 10 * time.Millisecond},
+	}, sleep)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Duration{10 * time.Millisecond, 10 * time.Millisecond}, delays)
+	assert.Equal(t, address, listener.Addr().String())
+	assert.NoError(t, listener.Close())
+}
+
+func TestListenFailsAfterRetriesAreExhausted(t *testing.T) {
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer occupied.Close()
+	attempts := 0
+
+	_, err = listenWithRetry(occupied.Addr().String(), httphandlerconfig.ListenRetryConfig{Attempts: 2},
+		func(delay time.Duration) {
+			attempts++
+			assert.Equal(t, DefaultListenRetryDelay, delay)
+		})
+
+	assert.Error(t, err)
+	assert.Equal(t, 2, attempts)
+}
+
+func TestStartupProbeAdvertisesReadinessAfterProbe(t *testing.T) {
+	for _, passed := range []bool{true, false} {
+		s := newService(config.Config{YamlConfig: config.YamlConfig{StartupProbe: true}})
+		assert.Equal(t, httphandler.PhaseBind, s.readiness.Phase())
+		s.readiness.Advance(httphandler.PhaseProbe)
+		probing, release := make(chan struct{}), make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			s.startupProbe(func(config.Config) bool {
+				close(probing)
+				<-release
+				return passed
+			})
+			close(done)
+		}()
+
+		<-probing
+		assert.Equal(t, httphandler.PhaseProbe, s.readiness.Phase())
+		close(release)
+		<-done
+		assert.Equal(t, httphandler.PhaseReady, s.readiness.Phase(), "probe passed: %t", passed)
+	}
+}
@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// LatencyBuckets counts requests in cumulative buckets of configured upper
+// bounds, reqs.global.latency.le_<bound> counts requests which took at most
+// bound and reqs.global.latency.le_inf counts all requests
+type LatencyBuckets struct {
+	bounds   []time.Duration
+	counters []metrics.Counter
+	all      metrics.Counter
+}
+
+func latencyBucketName(bound time.Duration) string {
+	return "reqs.global.latency.le_" + Clean(bound.String())
+}
+
+// NewLatencyBuckets registers bucket counters of ascending bounds, it's nil
+// if no bounds are given
+func NewLatencyBuckets(bounds []time.Duration) *LatencyBuckets {
+	if len(bounds) == 0 {
+		return nil
+	}
+	lb := &LatencyBuckets{
+		bounds:   bounds,
+		counters: make([]metrics.Counter, len(bounds)),
+		all:      metrics.GetOrRegisterCounter("reqs.global.latency.le_inf", metrics.DefaultRegistry),
+	}
+	for i, bound := range bounds {
+		lb.counters[i] = metrics.GetOrRegisterCounter(latencyBucketName(bound), metrics.DefaultRegistry)
+	}
+	return lb
+}
+
+// Observe counts request which took duration in every bucket it fits
+func (lb *LatencyBuckets) Observe(duration time.Duration) {
+	if lb == nil {
+		return
+	}
+	for i := len(lb.bounds) - 1; i >= 0 && duration <= lb.bounds[i]; i-- {
+		lb.counters[i].Inc(1)
+	}
+	lb.all.Inc(1)
+}
@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func bucketCount(t *testing.T, name string) int64 {
+	counter, ok := metrics.DefaultRegistry.Get(name).(metrics.Counter)
+	require.True(t, ok, "%s should be registered", name)
+	return counter.Count()
+}
+
+func TestLatencyBucketsAreRegisteredWithConfiguredBounds(t *testing.T) {
+	buckets := NewLatencyBuckets([]time.Duration{time.Second, 90 * time.Second, 10 * time.Minute})
+	initial := make(map[string]int64)
+	for _, name := range []string{"reqs.global.latency.le_1s", "reqs.global.latency.le_1m30s",
+		"reqs.global.latency.le_10m0s", "reqs.global.latency.le_inf"} {
+		initial[name] = bucketCount(t, name)
+	}
+	for _, latency := range []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Minute, time.Hour} {
+		buckets.Observe(latency)
+	}
+
+	assert.Equal(t, int64(2), bucketCount(t, "reqs.global.latency.le_1s")-initial["reqs.global.latency.le_1s"])
+	assert.Equal(t, int64(2), bucketCount(t, "reqs.global.latency.le_1m30s")-initial["reqs.global.latency.le_1m30s"])
+	assert.Equal(t, int64(3), bucketCount(t, "reqs.global.latency.le_10m0s")-initial["reqs.global.latency.le_10m0s"])
+	assert.Equal(t, int64(4), bucketCount(t, "reqs.global.latency.le_inf")-initial["reqs.global.latency.le_inf"])
+	assert.Nil(t, metrics.DefaultRegistry.Get("reqs.global.latency.le_5s"))
+}
+
+func TestLatencyBucketsAreDisabledWithoutBounds(t *testing.T) {
+	buckets := NewLatencyBuckets(nil)
+	assert.Nil(t, buckets)
+	buckets.Observe(time.Second)
+}
@@ -51,6 +51,18 @@ func UpdateGauge(name string, value int64) {
 	gauge.Update(value)
 }
 
+// UpdateGaugeFloat64 changes GaugeFloat64 value
+func UpdateGaugeFloat64(name string, value float64) {
+	gauge := metrics.GetOrRegisterGaugeFloat64(name, metrics.DefaultRegistry)
+	gauge.Update(value)
+}
+
+// UpdateHistogram creates and updates Histogram
+func UpdateHistogram(name string, value int64) {
+	histogram := metrics.GetOrRegisterHistogram(name, metrics.DefaultRegistry, metrics.NewExpDecaySample(1028, 0.015))
+	histogram.Update(value)
+}
+
 func setupPrefix(cfg Config) string {
 	pfx = cfg.Prefix
 	if pfx == "default" {
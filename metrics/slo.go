@@ -0,0 +1,163 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSLOWindow is sliding window of SLO fractions if SLOWindow is
+	// not set
+	DefaultSLOWindow = 5 * time.Minute
+	// SLOOverall is key of client requests, other keys are backend hosts
+	SLOOverall = "overall"
+	// sloSlots is number of buckets window is divided into
+	sloSlots = 10
+)
+
+type sloSlot struct {
+	slot     int64
+	requests int64
+	within   int64
+}
+
+type sloCounters [sloSlots]sloSlot
+
+func (sc *sloCounters) totals(current int64) (requests, within int64) {
+	for _, s := range sc {
+		if s.slot > current-sloSlots {
+			requests += s.requests
+			within += s.within
+		}
+	}
+	return requests, within
+}
+
+// SLOStats are counts of requests in window
+type SLOStats struct {
+	Requests        int64   `json:"requests"`
+	WithinThreshold int64   `json:"withinThreshold"`
+	Fraction        float64 `json:"fraction"`
+}
+
+func newSLOStats(requests, within int64) SLOStats {
+	stats := SLOStats{Requests: requests, WithinThreshold: within, Fraction: 1}
+	if requests > 0 {
+		stats.Fraction = float64(within) / float64(requests)
+	}
+	return stats
+}
+
+// SLOTracker computes fraction of requests completed under threshold over
+// sliding window, overall and per backend. Fractions are reported in
+// reqs.global.slo and reqs.backend.<host>.slo gauges
+type SLOTracker struct {
+	mx        sync.Mutex
+	threshold time.Duration
+	window    time.Duration
+	slotWidth time.Duration
+	counters  map[string]*sloCounters
+	now       func() time.Time
+}
+
+// NewSLOTracker creates SLOTracker, it's nil if threshold is not set
+func NewSLOTracker(threshold, window time.Duration) *SLOTracker {
+	if threshold <= 0 {
+		return nil
+	}
+	if window <= 0 {
+		window = DefaultSLOWindow
+	}
+	return &SLOTracker{
+		threshold: threshold,
+		window:    window,
+		slotWidth: window / sloSlots,
+		counters:  make(map[string]*sloCounters),
+		now:       time.Now,
+	}
+}
+
+func sloGauge(key string) string {
+	if key == SLOOverall {
+		return "reqs.global.slo"
+	}
+	return "reqs.backend." + Clean(key) + ".slo"
+}
+
+// Record counts request of key which took duration, failed request never
+// meets SLO
+func (st *SLOTracker) Record(key string, duration time.Duration, failed bool) {
+	if st == nil {
+		return
+	}
+	st.mx.Lock()
+	current := st.now().UnixNano() / int64(st.slotWidth)
+	counters, ok := st.counters[key]
+	if !ok {
+		counters = &sloCounters{}
+		st.counters[key] = counters
+	}
+	slot := &counters[current%sloSlots]
+	if slot.slot != current {
+		*slot = sloSlot{slot: current}
+	}
+	slot.requests++
+	if !failed && duration <= st.threshold {
+		slot.within++
+	}
+	stats := newSLOStats(counters.totals(current))
+	st.mx.Unlock()
+	UpdateGaugeFloat64(sloGauge(key), stats.Fraction)
+}
+
+// Stats returns SLO stats of keys with requests in window
+func (st *SLOTracker) Stats() map[string]SLOStats {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+	current := st.now().UnixNano() / int64(st.slotWidth)
+	stats := make(map[string]SLOStats, len(st.counters))
+	for key, counters := range st.counters {
+		requests, within := counters.totals(current)
+		if requests == 0 {
+			delete(st.counters, key)
+			continue
+		}
+		stats[key] = newSLOStats(requests, within)
+	}
+	return stats
+}
+
+type sloReport struct {
+	Threshold string              `json:"threshold"`
+	Window    string              `json:"window"`
+	Overall   SLOStats            `json:"overall"`
+	Backends  map[string]SLOStats `json:"backends"`
+}
+
+// AdminHandler responds to GET request with SLO stats, overall and per
+// backend
+func (st *SLOTracker) AdminHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	stats := st.Stats()
+	report := sloReport{
+		Threshold: st.threshold.String(),
+		Window:    st.window.String(),
+		Overall:   newSLOStats(0, 0),
+		Backends:  make(map[string]SLOStats, len(stats)),
+	}
+	for key, keyStats := range stats {
+		if key == SLOOverall {
+			report.Overall = keyStats
+			continue
+		}
+		report.Backends[key] = keyStats
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(report)
+}
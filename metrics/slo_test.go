@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSLOTrackerComputesFractionsUnderThreshold(t *testing.T) {
+	tracker := NewSLOTracker(100*time.Millisecond, time.Minute)
+	for _, latency := range []time.Duration{10, 50, 100, 150, 90} {
+		tracker.Record(SLOOverall, latency*time.Millisecond, false)
+	}
+	// failed request misses SLO regardless of latency
+	tracker.Record(SLOOverall, time.Millisecond, true)
+	for _, latency := range []time.Duration{10, 300} {
+		tracker.Record("s3.dc1.internal:80", latency*time.Millisecond, false)
+	}
+
+	stats := tracker.Stats()
+	assert.Equal(t, SLOStats{Requests: 6, WithinThreshold: 4, Fraction: 4.0 / 6}, stats[SLOOverall])
+	assert.Equal(t, SLOStats{Requests: 2, WithinThreshold: 1, Fraction: 0.5}, stats["s3.dc1.internal:80"])
+	gauge, ok := metrics.DefaultRegistry.Get("reqs.backend.s3_dc1_internal_80.slo").(metrics.GaugeFloat64)
+	require.True(t, ok)
+	assert.Equal(t, 0.5, gauge.Value())
+}
+
+func TestSLOTrackerForgetsRequestsOutsideWindow(t *testing.T) {
+	tracker := NewSLOTracker(100*time.Millisecond, time.Minute)
+	moment := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	tracker.now = func() time.Time { return moment }
+	for i := 0; i < 3; i++ {
+		tracker.Record(SLOOverall, time.Second, false)
+	}
+
+	moment = moment.Add(30 * time.Second)
+	tracker.Record(SLOOverall, time.Millisecond, false)
+	assert.Equal(t, SLOStats{Requests: 4, WithinThreshold: 1, Fraction: 0.25}, tracker.Stats()[SLOOverall])
+
+	moment = moment.Add(45 * time.Second)
+	tracker.Record(SLOOverall, time.Millisecond, false)
+	assert.Equal(t, SLOStats{Requests: 2, WithinThreshold: 2, Fraction: 1}, tracker.Stats()[SLOOverall])
+
+	moment = moment.Add(2 * time.Minute)
+	assert.Empty(t, tracker.Stats())
+}
+
+func TestSLOTrackerIsDisabledWithoutThreshold(t *testing.T) {
+	tracker := NewSLOTracker(0, time.Minute)
+	assert.Nil(t, tracker)
+	tracker.Record(SLOOverall, time.Millisecond, false)
+}
+
+func TestSLOAdminHandlerReportsOverallAndBackends(t *testing.T) {
+	tracker := NewSLOTracker(100*time.Millisecond, 0)
+	tracker.Record(SLOOverall, time.Millisecond, false)
+	tracker.Record("s3.dc1.internal:80", time.Second, false)
+
+	writer := httptest.NewRecorder()
+	tracker.AdminHandler(writer, httptest.NewRequest(http.MethodGet, "/admin/slo", nil))
+
+	require.Equal(t, http.StatusOK, writer.Code)
+	report := sloReport{}
+	require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &report))
+	assert.Equal(t, "100ms", report.Threshold)
+	assert.Equal(t, "5m0s", report.Window)
+	assert.Equal(t, 1.0, report.Overall.Fraction)
+	assert.Equal(t, map[string]SLOStats{"s3.dc1.internal:80": {Requests: 1, Fraction: 0}}, report.Backends)
+
+	writer = httptest.NewRecorder()
+	tracker.AdminHandler(writer, httptest.NewRequest(http.MethodPost, "/admin/slo", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, writer.Code)
+}
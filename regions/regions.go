@@ -10,6 +10,7 @@ import (
 	"github.com/allegro/akubra/httphandler"
 	"github.com/allegro/akubra/sharding"
 	"github.com/allegro/akubra/storages"
+	"github.com/allegro/akubra/transport"
 )
 
 //Regions container for multiclusters
@@ -57,12 +58,32 @@ func NewHandler(conf config.Config) (http.Handler, error) {
 	if err != nil {
 		return nil, err
 	}
+	storages.WarnCapabilityMismatches(conf, httptransp)
+	storages.PrewarmConnections(conf, httptransp)
+	storages.StartKeepAlivePinger(conf, httptransp)
+	backendRoundTripper := httphandler.DecorateBackendRoundTripper(conf, httptransp)
 	allStorages := &storages.Storages{
 		Conf:      conf,
-		Transport: httptransp,
+		Transport: backendRoundTripper,
 		Clusters:  make(map[string]storages.Cluster),
 	}
-	ringFactory := sharding.NewRingFactory(conf, allStorages, httptransp)
+	if conf.WriteSafeMode {
+		allStorages.Health = storages.StartHealthChecker(conf, httptransp)
+	}
+	if conf.AutoReconcile.Enabled {
+		allStorages.Reconciler = httphandler.NewETagReconciler(conf.AutoReconcile, backendRoundTripper, conf.Synclog)
+	}
+	var writeHealers transport.WriteHealers
+	if conf.WriteHealing.Enabled {
+		writeHealers = append(writeHealers, httphandler.NewPendingWritesHealer(conf.WriteHealing, backendRoundTripper, conf.Synclog))
+	}
+	if conf.AbortOrphanedParts {
+		writeHealers = append(writeHealers, httphandler.NewOrphanedPartsAborter(backendRoundTripper, conf.Synclog))
+	}
+	if len(writeHealers) > 0 {
+		allStorages.WriteHealer = writeHealers
+	}
+	ringFactory := sharding.NewRingFactory(conf, allStorages, backendRoundTripper)
 	regions := &Regions{
 		multiCluters: make(map[string]sharding.ShardsRingAPI),
 	}
@@ -79,6 +100,8 @@ func NewHandler(conf config.Config) (http.Handler, error) {
 			regions.defaultRing = regionRing
 		}
 	}
-	roundTripper := httphandler.DecorateRoundTripper(conf, regions)
-	return httphandler.NewHandlerWithRoundTripper(roundTripper, conf.BodyMaxSize.SizeInBytes, conf.MaxConcurrentRequests)
+	verified := httphandler.Decorate(regions,
+		httphandler.ResponseVerifier(conf.VerificationBackend.URL, conf.VerificationSampleRate, backendRoundTripper))
+	roundTripper := httphandler.DecorateRoundTripper(conf, verified)
+	return httphandler.NewHandlerWithRoundTripper(roundTripper, conf)
 }
@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"net/url"
 	"strings"
+	"time"
 
 	"errors"
 
+	"github.com/allegro/akubra/metrics"
 	units "github.com/docker/go-units"
 )
 
@@ -14,6 +16,18 @@ import (
 type ClusterConfig struct {
 	// Backends should contain s3 backend urls
 	Backends []YAMLUrl `yaml:"Backends"`
+	// SRV resolves cluster backends from DNS SRV record instead of Backends
+	SRV SRVConfig `yaml:"SRV,omitempty"`
+}
+
+// SRVConfig defines DNS SRV record cluster backends are discovered with
+type SRVConfig struct {
+	// Record is SRV record name, e.g. _s3._tcp.storage.internal
+	Record string `yaml:"Record,omitempty"`
+	// Scheme of discovered backends, default http
+	Scheme string `yaml:"Scheme,omitempty"`
+	// RefreshInterval of backends set, default 30s
+	RefreshInterval metrics.Interval `yaml:"RefreshInterval,omitempty"`
 }
 
 // MultiClusterConfig defines region settings for multicluster
@@ -34,9 +48,210 @@ type RegionConfig struct {
 	Default bool `yaml:"Default,omitempty"`
 }
 
+// RetriesConfig defines limits of retrying requests on other clusters
+type RetriesConfig struct {
+	// Budget limits retries to fraction of all requests, e.g. 0.1 allows
+	// at most 10% extra retry load. Zero means no limit
+	Budget float64 `yaml:"Budget,omitempty" validate:"min=0,max=1"`
+	// AcrossBackends makes reads (GET, HEAD) go to cluster backends one by one
+	// instead of all at once, next backend is tried if previous one failed
+	AcrossBackends bool `yaml:"AcrossBackends,omitempty"`
+	// MaxAttempts limits number of backends tried by single read,
+	// zero means all cluster backends
+	MaxAttempts int `yaml:"MaxAttempts,omitempty" validate:"min=0"`
+	// BackendAttempts is number of times idempotent request failed by
+	// backend (with error or 5xx status) is retried on the same backend,
+	// zero disables it
+	BackendAttempts int `yaml:"BackendAttempts,omitempty" validate:"min=0"`
+}
+
+// BackendRetryConfig overrides Retries.BackendAttempts of single backend
+type BackendRetryConfig struct {
+	// Attempts is number of retries of failed request on the backend
+	Attempts int `yaml:"Attempts"`
+}
+
+// OutlierEjectionConfig defines when backend is temporarily excluded from reads
+type OutlierEjectionConfig struct {
+	// ConsecutiveErrors ejects backend after given number of failed requests
+	// in a row (transport errors and 5xx responses), zero disables ejection
+	ConsecutiveErrors int `yaml:"ConsecutiveErrors,omitempty" validate:"min=0"`
+	// EjectionDuration is base ejection time, multiplied by number of
+	// subsequent ejections. Backend is reintroduced gradually during next EjectionDuration
+	EjectionDuration metrics.Interval `yaml:"EjectionDuration,omitempty"`
+	// LatencyThreshold makes slower responses count as errors, zero means no limit
+	LatencyThreshold metrics.Interval `yaml:"LatencyThreshold,omitempty"`
+}
+
+// QuarantineConfig defines when backend timing out repeatedly is excluded
+// from reads. Only timeouts are counted, other failures are ignored
+type QuarantineConfig struct {
+	// TimeoutThreshold quarantines backend after given number of timed out
+	// requests in a row, zero disables quarantine
+	TimeoutThreshold int `yaml:"TimeoutThreshold,omitempty" validate:"min=0"`
+	// Duration of quarantine
+	Duration metrics.Interval `yaml:"Duration,omitempty"`
+}
+
+// HealthCheckConfig defines backend health check request, HEAD on backend
+// URL passing with any status lower than 500 if fields are not set
+type HealthCheckConfig struct {
+	// Method of check request, one of GET, HEAD and OPTIONS
+	Method string `yaml:"Method,omitempty"`
+	// Path of check request, e.g. /healthz or known object
+	Path string `yaml:"Path,omitempty"`
+	// ExpectedStatus is the only status passing the check
+	ExpectedStatus int `yaml:"ExpectedStatus,omitempty"`
+}
+
+// RateLimitConfig caps request rate of backend with token bucket
+type RateLimitConfig struct {
+	// RequestsPerSecond allowed on average
+	RequestsPerSecond float64 `yaml:"RequestsPerSecond"`
+	// Burst of requests allowed at once, RequestsPerSecond (at least 1) if
+	// not set
+	Burst int `yaml:"Burst,omitempty"`
+}
+
+// ConnLimitConfig caps concurrent requests of backend, low priority requests
+// get only LowPriorityShare of ConnLimit and are shed first
+type ConnLimitConfig struct {
+	// ConnLimit is number of requests sent to backend at once
+	ConnLimit int `yaml:"ConnLimit"`
+	// LowPriorityShare of ConnLimit in range (0, 1] low priority requests
+	// may use, default 0.25
+	LowPriorityShare float64 `yaml:"LowPriorityShare,omitempty"`
+}
+
+// AdaptiveThrottlingConfig limits concurrent requests of backends asking
+// clients to slow down (429 Too Many Requests or 503 SlowDown). Limit of
+// backend is multiplied by DecreaseFactor on such response and grows back by
+// one per limit of successful responses
+type AdaptiveThrottlingConfig struct {
+	Enabled bool `yaml:"Enabled,omitempty"`
+	// MaxConcurrency is initial and highest limit, default 100
+	MaxConcurrency int `yaml:"MaxConcurrency,omitempty" validate:"min=0"`
+	// MinConcurrency is lowest limit, default 1
+	MinConcurrency int `yaml:"MinConcurrency,omitempty" validate:"min=0"`
+	// DecreaseFactor in range (0, 1), default 0.5
+	DecreaseFactor float64 `yaml:"DecreaseFactor,omitempty"`
+}
+
+// CapacityWeightsConfig biases object writes away from backends reporting
+// little free capacity in response header
+type CapacityWeightsConfig struct {
+	// Header holding free bytes of backend, e.g. X-Storage-Free-Bytes, empty
+	// disables weighting
+	Header string `yaml:"Header,omitempty"`
+	// Window of exponential moving average of reported free bytes, default 1m
+	Window metrics.Interval `yaml:"Window,omitempty"`
+	// LowWatermark of free capacity, backends below it get proportionally
+	// fewer object writes
+	LowWatermark HumanSizeUnits `yaml:"LowWatermark,omitempty"`
+}
+
+// TombstonesConfig defines how long objects deleted on some backends only
+// are reported as not found, zero TTL disables tombstones
+type TombstonesConfig struct {
+	TTL metrics.Interval `yaml:"TTL,omitempty"`
+	// MaxTombstones kept in memory, default 100000
+	MaxTombstones int `yaml:"MaxTombstones,omitempty" validate:"min=0"`
+}
+
+// SessionAffinityConfig makes reads of client session, identified by header
+// or cookie value, go to the same backend
+type SessionAffinityConfig struct {
+	// Header carrying session id, e.g. client id
+	Header string `yaml:"Header,omitempty"`
+	// Cookie carrying session id, used if Header is not set or missing
+	Cookie string `yaml:"Cookie,omitempty"`
+	// TTL since last read after which session may go to another backend,
+	// default 10m
+	TTL metrics.Interval `yaml:"TTL,omitempty"`
+	// MaxSessions kept in memory, default 100000
+	MaxSessions int `yaml:"MaxSessions,omitempty" validate:"min=0"`
+}
+
+// ErrorBodyConfig defines which backend responses are inspected for S3 error
+// documents. Response with matching document is failed for routing, quorum
+// and outlier ejection regardless of its status
+type ErrorBodyConfig struct {
+	// StatusCodes of inspected responses, empty disables inspection
+	StatusCodes []int `yaml:"StatusCodes,omitempty"`
+	// ContentTypes of inspected responses, application/xml if empty
+	ContentTypes []string `yaml:"ContentTypes,omitempty"`
+	// ErrorCodes treated as failures, any error code if empty
+	ErrorCodes []string `yaml:"ErrorCodes,omitempty"`
+}
+
+const (
+	// ReconcileNewest takes version with most recent Last-Modified as authoritative
+	ReconcileNewest = "newest"
+	// ReconcileMajority takes version held by most backends as authoritative,
+	// ties are resolved by Last-Modified
+	ReconcileMajority = "majority"
+)
+
+// AutoReconcileConfig defines repair of replicas found to hold different
+// object versions. Authoritative version is copied to other backends
+type AutoReconcileConfig struct {
+	// Enabled turns reconciliation on, it writes data to backends
+	Enabled bool `yaml:"Enabled"`
+	// Policy choosing authoritative version, ReconcileNewest if not set
+	Policy string `yaml:"Policy,omitempty"`
+}
+
+// WriteHealingConfig defines best effort repair of writes which failed on
+// some backends. They are kept in memory and re-attempted once failed backend
+// accepts another write
+type WriteHealingConfig struct {
+	// Enabled turns healing on, it writes data to backends
+	Enabled bool `yaml:"Enabled"`
+	// MaxPending limits number of writes kept for healing, 10000 if not set
+	MaxPending int `yaml:"MaxPending,omitempty" validate:"min=0"`
+}
+
+// HeadQuorumConfig makes HEAD requests confirm object existence on quorum of
+// backends instead of any single one
+type HeadQuorumConfig struct {
+	// Quorum is number of backends which have to report object, zero
+	// disables quorum HEAD
+	Quorum int `yaml:"Quorum,omitempty" validate:"min=0"`
+	// ReportReplicas adds X-Akubra-Replicas header with number of backends
+	// having object out of asked ones, if backends disagree
+	ReportReplicas bool `yaml:"ReportReplicas,omitempty"`
+	// VerifyMetadata compares x-amz-meta-* headers of backends having
+	// object, divergence is logged and metadata of most backends is passed
+	VerifyMetadata bool `yaml:"VerifyMetadata,omitempty"`
+	// BucketQuorum is number of backends which have to report bucket to
+	// HEAD bucket request, zero means Quorum applies to buckets as well
+	BucketQuorum int `yaml:"BucketQuorum,omitempty" validate:"min=0"`
+}
+
+// LocalityConfig describes where akubra and backends are placed, it's
+// unrelated to domain based Regions configuration
+type LocalityConfig struct {
+	// Region akubra instance runs in
+	Region string `yaml:"Region,omitempty"`
+	// BackendRegions maps backend host (host:port) to its region name
+	BackendRegions map[string]string `yaml:"BackendRegions,omitempty"`
+}
+
+// IsLocal checks if backend host is placed in the same region as akubra,
+// with no Region configured all backends are local
+func (lc LocalityConfig) IsLocal(host string) bool {
+	if lc.Region == "" {
+		return true
+	}
+	return lc.BackendRegions[host] == lc.Region
+}
+
 // YAMLUrl type fields in yaml configuration will parse urls
 type YAMLUrl struct {
 	*url.URL
+	// AdditionalRequestHeaders are added to requests sent to this cluster
+	// backend, they override global AdditionalRequestHeaders
+	AdditionalRequestHeaders AdditionalHeaders
 }
 
 // SyncLogMethod type fields in yaml configuration will parse list of HTTP methods
@@ -44,6 +259,23 @@ type SyncLogMethod struct {
 	Method string
 }
 
+// DayTime type fields in yaml configuration will parse time of day in "HH:MM" format
+type DayTime struct {
+	// Offset from midnight
+	time.Duration
+}
+
+// MaintenanceWindow defines daily period in which backend is treated as maintained
+type MaintenanceWindow struct {
+	// Backend url, should match one of clusters backends
+	Backend YAMLUrl `yaml:"Backend"`
+	// Start of maintenance window (local time)
+	Start DayTime `yaml:"Start"`
+	// End of maintenance window (local time), may be earlier than Start
+	// if window spans over midnight
+	End DayTime `yaml:"End"`
+}
+
 // AdditionalHeaders type fields in yaml configuration will parse list of special headers
 type AdditionalHeaders map[string]string
 
@@ -52,11 +284,20 @@ type HumanSizeUnits struct {
 	SizeInBytes int64
 }
 
-// UnmarshalYAML for YAMLUrl
+// UnmarshalYAML for YAMLUrl, it's either url string or mapping of URL and
+// AdditionalRequestHeaders
 func (yurl *YAMLUrl) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var s string
 	if err := unmarshal(&s); err != nil {
-		return err
+		var backend struct {
+			URL                      string            `yaml:"URL"`
+			AdditionalRequestHeaders AdditionalHeaders `yaml:"AdditionalRequestHeaders,omitempty"`
+		}
+		if err := unmarshal(&backend); err != nil {
+			return err
+		}
+		s = backend.URL
+		yurl.AdditionalRequestHeaders = backend.AdditionalRequestHeaders
 	}
 	url, err := url.Parse(s)
 	if url.Host == "" {
@@ -83,6 +324,31 @@ func (slm *SyncLogMethod) UnmarshalYAML(unmarshal func(interface{}) error) error
 	return nil
 }
 
+// UnmarshalYAML for DayTime
+func (dt *DayTime) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := time.Parse("15:04", s)
+	if err != nil {
+		return fmt.Errorf("day time should match HH:MM scheme - got %q", s)
+	}
+	dt.Duration = time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute
+	return nil
+}
+
+// Active checks if given moment is within maintenance window
+func (mw MaintenanceWindow) Active(t time.Time) bool {
+	// wall clock is compared, elapsed time since midnight is off by an hour
+	// on days of DST change
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if mw.Start.Duration <= mw.End.Duration {
+		return sinceMidnight >= mw.Start.Duration && sinceMidnight < mw.End.Duration
+	}
+	return sinceMidnight >= mw.Start.Duration || sinceMidnight < mw.End.Duration
+}
+
 // UnmarshalYAML for AdditionalHeaders
 func (ah *AdditionalHeaders) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var headers map[string]string
@@ -0,0 +1,52 @@
+package sharding
+
+import "sync"
+
+const (
+	// retryBudgetTokenScale keeps tokens as integers to avoid float rounding
+	retryBudgetTokenScale = 1000
+	// retryBudgetMaxTokens limits how many retries may be accumulated
+	// during low failure periods
+	retryBudgetMaxTokens = 10 * retryBudgetTokenScale
+)
+
+// retryBudget is token bucket limiting retries to a fraction of requests.
+// Each request deposits ratio of token, each retry withdraws one token.
+// Nil retryBudget allows unlimited retries
+type retryBudget struct {
+	ratio  int64
+	tokens int64
+	mx     sync.Mutex
+}
+
+func newRetryBudget(ratio float64) *retryBudget {
+	if ratio <= 0 {
+		return nil
+	}
+	return &retryBudget{ratio: int64(ratio * retryBudgetTokenScale)}
+}
+
+func (rb *retryBudget) deposit() {
+	if rb == nil {
+		return
+	}
+	rb.mx.Lock()
+	defer rb.mx.Unlock()
+	rb.tokens += rb.ratio
+	if rb.tokens > retryBudgetMaxTokens {
+		rb.tokens = retryBudgetMaxTokens
+	}
+}
+
+func (rb *retryBudget) withdraw() bool {
+	if rb == nil {
+		return true
+	}
+	rb.mx.Lock()
+	defer rb.mx.Unlock()
+	if rb.tokens < retryBudgetTokenScale {
+		return false
+	}
+	rb.tokens -= retryBudgetTokenScale
+	return true
+}
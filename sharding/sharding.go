@@ -16,27 +16,24 @@ import (
 
 // RingFactory produces clients ShardsRing
 type RingFactory struct {
-	conf      config.Config
-	transport http.RoundTripper
-	storages  *storages.Storages
+	conf        config.Config
+	transport   http.RoundTripper
+	storages    *storages.Storages
+	retryBudget *retryBudget
 }
 
-func (rf RingFactory) uniqBackends(regionCfg shardingconfig.RegionConfig) ([]url.URL, error) {
-	allBackendsSet := make(map[shardingconfig.YAMLUrl]bool)
-	for _, clusterConfig := range regionCfg.Clusters {
-		clientCluster, err := rf.storages.GetCluster(clusterConfig.Cluster)
-		if err != nil {
-			return nil, err
-		}
-		for _, backendURL := range clientCluster.Backends {
+func uniqBackends(clusters map[string]storages.Cluster) []url.URL {
+	allBackendsSet := make(map[url.URL]bool)
+	for _, clientCluster := range clusters {
+		for _, backendURL := range clientCluster.CurrentBackends() {
 			allBackendsSet[backendURL] = true
 		}
 	}
 	var uniqBackendsSlice []url.URL
 	for url := range allBackendsSet {
-		uniqBackendsSlice = append(uniqBackendsSlice, *url.URL)
+		uniqBackendsSlice = append(uniqBackendsSlice, url)
 	}
-	return uniqBackendsSlice, nil
+	return uniqBackendsSlice
 }
 
 func (rf RingFactory) getRegionClusters(regionCfg shardingconfig.RegionConfig) map[string]int {
@@ -83,18 +80,23 @@ func (rf RingFactory) RegionRing(regionCfg shardingconfig.RegionConfig) (ShardsR
 		return ShardsRing{}, err
 	}
 	cHashMap := hashring.NewWithWeights(clientClusters)
-	allBackendsSlice, err := rf.uniqBackends(regionCfg)
-	if err != nil {
-		return ShardsRing{}, err
-	}
+	allBackendsSlice := uniqBackends(shardClusterMap)
 
-	respHandler := httphandler.LateResponseHandler(rf.conf)
+	respHandler := httphandler.MultiDeleteResponseHandler(rf.conf,
+		httphandler.ListingResponseHandler(rf.conf, httphandler.LateResponseHandler(rf.conf)))
 
 	allBackendsRoundTripper := transport.NewMultiTransport(
 		rf.transport,
 		allBackendsSlice,
 		respHandler,
-		rf.conf.MaintainedBackends)
+		rf.storages.TransportOptions())
+	for _, cluster := range shardClusterMap {
+		if cluster.Discovery != nil {
+			cluster.Discovery.OnChange(func([]url.URL) {
+				allBackendsRoundTripper.SetBackends(uniqBackends(shardClusterMap))
+			})
+		}
+	}
 	regressionMap, err := rf.createRegressionMap(regionCfg)
 	if err != nil {
 		return ShardsRing{}, nil
@@ -104,14 +106,16 @@ func (rf RingFactory) RegionRing(regionCfg shardingconfig.RegionConfig) (ShardsR
 		shardClusterMap,
 		allBackendsRoundTripper,
 		regressionMap,
-		rf.conf.ClusterSyncLog}, nil
+		rf.conf.ClusterSyncLog,
+		rf.retryBudget}, nil
 }
 
 //NewRingFactory creates ring factory
 func NewRingFactory(conf config.Config, storages *storages.Storages, transport http.RoundTripper) RingFactory {
 	return RingFactory{
-		conf:      conf,
-		storages:  storages,
-		transport: transport,
+		conf:        conf,
+		storages:    storages,
+		transport:   transport,
+		retryBudget: newRetryBudget(conf.Retries.Budget),
 	}
 }
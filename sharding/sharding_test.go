@@ -1,6 +1,7 @@
 package sharding
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -8,12 +9,14 @@ import (
 	"testing"
 
 	"sync/atomic"
+	"time"
 
 	"github.com/allegro/akubra/config"
 	"github.com/allegro/akubra/httphandler"
 	"github.com/allegro/akubra/log"
 	shardingconfig "github.com/allegro/akubra/sharding/config"
 	"github.com/allegro/akubra/storages"
+	"github.com/allegro/akubra/transport"
 	set "github.com/deckarep/golang-set"
 	"github.com/stretchr/testify/assert"
 )
@@ -177,3 +180,189 @@ func TestPutWithTwoClustersAndBucketOnly(t *testing.T) {
 	assert.Equal(t, int32(2), callCount)
 	assert.Equal(t, http.StatusOK, response.StatusCode)
 }
+
+func TestRetryBudgetCapsRegressionCallsUnderSustainedFailure(t *testing.T) {
+	callCount := int32(0)
+	f := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		atomic.AddInt32(&callCount, 1)
+	}
+	regionRing := makeRegionRing([]float64{0, 1}, t, f)
+	regionRing.retryBudget = newRetryBudget(0.1)
+	requestsCount := 100
+	for i := 0; i < requestsCount; i++ {
+		reqURL, _ := url.Parse("http://allegro.pl/b/o")
+		request := &http.Request{
+			URL:    reqURL,
+			Method: "GET",
+		}
+		response, _ := regionRing.DoRequest(request)
+		assert.Equal(t, http.StatusNotFound, response.StatusCode)
+	}
+	assert.Equal(t, int32(requestsCount+requestsCount/10), callCount)
+}
+
+func TestRetryBudgetWithdrawsOnlyDepositedTokens(t *testing.T) {
+	budget := newRetryBudget(0.5)
+	assert.False(t, budget.withdraw())
+	budget.deposit()
+	budget.deposit()
+	assert.True(t, budget.withdraw())
+	assert.False(t, budget.withdraw())
+
+	var unlimited *retryBudget
+	assert.True(t, unlimited.withdraw())
+}
+
+func TestRoutingDecisionIsFilledForRoutingScenarios(t *testing.T) {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	regionRing := makeRegionRing([]float64{0, 1}, t, f)
+	for _, testData := range []struct {
+		method   string
+		path     string
+		expected transport.RoutingDecision
+	}{
+		{"GET", "/b/o", transport.RoutingDecision{Strategy: "consistent-hashing", Retry: true, Candidates: 2}},
+		{"DELETE", "/b/o", transport.RoutingDecision{Strategy: "all-clusters", Retry: false, Candidates: 2}},
+		{"PUT", "/b", transport.RoutingDecision{Strategy: "all-clusters", Retry: false, Candidates: 2}},
+	} {
+		reqURL, _ := url.Parse("http://allegro.pl" + testData.path)
+		decision := &transport.RoutingDecision{}
+		ctx := context.WithValue(context.Background(), transport.ContextRoutingDecisionKey, decision)
+		request := (&http.Request{URL: reqURL, Method: testData.method}).WithContext(ctx)
+
+		_, err := regionRing.DoRequest(request)
+
+		assert.NoError(t, err)
+		assert.Equal(t, testData.expected, *decision)
+	}
+}
+
+func pickClusters(t *testing.T, regionRing ShardsRing, keys []string) map[string]string {
+	picked := make(map[string]string, len(keys))
+	for _, key := range keys {
+		cluster, err := regionRing.Pick(key)
+		assert.NoError(t, err)
+		picked[key] = cluster.Name
+	}
+	return picked
+}
+
+func TestKeysStayOnTheirClusterWhenClusterIsAdded(t *testing.T) {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("/bucket/key-%d", i)
+	}
+	threeClusters := makeRegionRing([]float64{1, 1, 1}, t, f)
+	before := pickClusters(t, threeClusters, keys)
+	assert.Equal(t, before, pickClusters(t, threeClusters, keys))
+	assert.Equal(t, before, pickClusters(t, makeRegionRing([]float64{1, 1, 1}, t, f), keys))
+
+	after := pickClusters(t, makeRegionRing([]float64{1, 1, 1, 1}, t, f), keys)
+	moved := 0
+	for _, key := range keys {
+		if before[key] != after[key] {
+			moved++
+		}
+	}
+	// ideally a quarter of keys moves to new cluster
+	assert.True(t, moved < len(keys)*2/5, "%d of %d keys remapped", moved, len(keys))
+}
+
+// makeReplicatedRegionRing creates two clusters with two backends each,
+// requests received by cluster backends are counted
+func makeReplicatedRegionRing(t *testing.T, handlerfunc func(w http.ResponseWriter, r *http.Request)) (ShardsRing, map[string]*int32) {
+	conf := makePrimaryConfiguration()
+	clusterCalls := make(map[string]*int32)
+	conf.Clusters = make(map[string]shardingconfig.ClusterConfig)
+	regionClusters := []shardingconfig.MultiClusterConfig{}
+	for _, clusterName := range []string{"cluster0", "cluster1"} {
+		calls := int32(0)
+		clusterCalls[clusterName] = &calls
+		backends := []shardingconfig.YAMLUrl{}
+		for i := 0; i < 2; i++ {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				handlerfunc(w, r)
+			}))
+			backendURL, _ := url.Parse(ts.URL)
+			backends = append(backends, shardingconfig.YAMLUrl{URL: backendURL})
+		}
+		conf.Clusters[clusterName] = shardingconfig.ClusterConfig{Backends: backends}
+		regionClusters = append(regionClusters, shardingconfig.MultiClusterConfig{Cluster: clusterName, Weight: 1})
+	}
+	httptransp, err := httphandler.ConfigureHTTPTransport(conf)
+	assert.NoError(t, err)
+	ringStorages := &storages.Storages{Conf: conf, Transport: httptransp, Clusters: make(map[string]storages.Cluster)}
+	regionRing, err := NewRingFactory(conf, ringStorages, httptransp).RegionRing(
+		shardingconfig.RegionConfig{Clusters: regionClusters, Domains: []string{"regiondomain.pl"}})
+	assert.NoError(t, err)
+	return regionRing, clusterCalls
+}
+
+func TestObjectIsReplicatedOnlyWithinItsCluster(t *testing.T) {
+	regionRing, clusterCalls := makeReplicatedRegionRing(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	cluster, err := regionRing.Pick("/bucket/object")
+	assert.NoError(t, err)
+	reqURL, _ := url.Parse("http://regiondomain.pl/bucket/object")
+	request := &http.Request{URL: reqURL, Method: "PUT", Header: http.Header{}}
+	response, err := regionRing.DoRequest(request)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	for clusterName, calls := range clusterCalls {
+		expected := int32(0)
+		if clusterName == cluster.Name {
+			expected = 2
+		}
+		assert.Equal(t, expected, atomic.LoadInt32(calls), clusterName)
+	}
+}
+
+func TestTaggingRequestsFollowObjectReplication(t *testing.T) {
+	for _, testData := range []struct {
+		method string
+		// minimal calls on object cluster and calls on other cluster
+		objectClusterCalls, otherClusterCalls int32
+	}{
+		{"PUT", 2, 0},
+		{"GET", 1, 0},
+		// deletes go to all clusters, as objects do
+		{"DELETE", 2, 2},
+	} {
+		regionRing, clusterCalls := makeReplicatedRegionRing(t, func(w http.ResponseWriter, r *http.Request) {
+			_, tagging := r.URL.Query()["tagging"]
+			assert.True(t, tagging, "tagging subresource should be forwarded")
+			w.WriteHeader(http.StatusOK)
+		})
+		cluster, err := regionRing.Pick("/bucket/object")
+		assert.NoError(t, err)
+
+		reqURL, _ := url.Parse("http://regiondomain.pl/bucket/object?tagging")
+		request := &http.Request{URL: reqURL, Method: testData.method, Header: http.Header{}}
+		response, err := regionRing.DoRequest(request)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, response.StatusCode, testData.method)
+		for clusterName, calls := range clusterCalls {
+			if clusterName == cluster.Name {
+				// first response is returned, other backend may be still counting
+				deadline := time.Now().Add(time.Second)
+				for atomic.LoadInt32(calls) < testData.objectClusterCalls && time.Now().Before(deadline) {
+					time.Sleep(5 * time.Millisecond)
+				}
+				assert.True(t, atomic.LoadInt32(calls) >= testData.objectClusterCalls, testData.method+" "+clusterName)
+				continue
+			}
+			assert.Equal(t, testData.otherClusterCalls, atomic.LoadInt32(calls), testData.method+" "+clusterName)
+		}
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/allegro/akubra/log"
 	"github.com/allegro/akubra/metrics"
 	"github.com/allegro/akubra/storages"
+	"github.com/allegro/akubra/transport"
 	"github.com/serialx/hashring"
 )
 
@@ -30,6 +31,7 @@ type ShardsRing struct {
 	allClustersRoundTripper http.RoundTripper
 	clusterRegressionMap    map[string]storages.Cluster
 	inconsistencyLog        log.Logger
+	retryBudget             *retryBudget
 }
 
 func (sr ShardsRing) isBucketPath(path string) bool {
@@ -104,23 +106,36 @@ func (sr ShardsRing) send(roundTripper http.RoundTripper, req *http.Request) (*h
 	return roundTripper.RoundTrip(req)
 }
 
+func (sr ShardsRing) discardBody(req *http.Request, resp *http.Response) {
+	_, discardErr := io.Copy(ioutil.Discard, resp.Body)
+	if discardErr != nil {
+		reqID, _ := req.Context().Value(log.ContextreqIDKey).(string)
+		log.Printf("Cannot discard response body for req %s, reason: %q",
+			reqID, discardErr.Error())
+	}
+	closeErr := resp.Body.Close()
+	if closeErr != nil {
+		reqID, _ := req.Context().Value(log.ContextreqIDKey).(string)
+		log.Printf("Cannot close response body for req %s, reason: %q",
+			reqID, closeErr.Error())
+	}
+}
+
 func (sr ShardsRing) regressionCall(cl storages.Cluster, req *http.Request) (string, *http.Response, error) {
 	resp, err := sr.send(cl, req)
 	// Do regression call if response status is > 400
 	if (err != nil || resp.StatusCode > 400) && req.Method != http.MethodPut {
 		rcl, ok := sr.clusterRegressionMap[cl.Name]
+		if ok && !sr.retryBudget.withdraw() {
+			metrics.Mark("reqs.global.retries.budget_exhausted")
+			return cl.Name, resp, err
+		}
 		if ok {
-			_, discardErr := io.Copy(ioutil.Discard, resp.Body)
-			if discardErr != nil {
-				reqID, _ := req.Context().Value(log.ContextreqIDKey).(string)
-				log.Printf("Cannot discard response body for req %s, reason: %q",
-					reqID, discardErr.Error())
+			if resp != nil {
+				sr.discardBody(req, resp)
 			}
-			closeErr := resp.Body.Close()
-			if closeErr != nil {
-				reqID, _ := req.Context().Value(log.ContextreqIDKey).(string)
-				log.Printf("Cannot close response body for req %s, reason: %q",
-					reqID, closeErr.Error())
+			if decision := transport.RoutingDecisionFromContext(req); decision != nil {
+				decision.Retry = true
 			}
 			return sr.regressionCall(rcl, req)
 		}
@@ -157,15 +172,29 @@ func (sr ShardsRing) DoRequest(req *http.Request) (resp *http.Response, rerr err
 		}
 	}()
 
+	sr.retryBudget.deposit()
+
 	reqCopy, err := copyRequest(req)
 	if err != nil {
 		return nil, err
 	}
 
+	decision := transport.RoutingDecisionFromContext(reqCopy)
+	if decision != nil {
+		decision.Candidates = len(sr.shardClusterMap)
+	}
+
 	if reqCopy.Method == http.MethodDelete || sr.isBucketPath(reqCopy.URL.Path) {
+		if decision != nil {
+			decision.Strategy = "all-clusters"
+		}
 		return sr.allClustersRoundTripper.RoundTrip(reqCopy)
 	}
 
+	if decision != nil {
+		decision.Strategy = "consistent-hashing"
+	}
+
 	cl, err := sr.Pick(reqCopy.URL.Path)
 	if err != nil {
 		return nil, err
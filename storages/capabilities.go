@@ -0,0 +1,129 @@
+package storages
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/log"
+)
+
+// CapabilityProbeTimeout limits single capability probe duration
+const CapabilityProbeTimeout = 5 * time.Second
+
+// capabilityProbePath is bucket probes are sent to, probes are not signed so
+// backends answer them with AccessDenied or NoSuchBucket if they support
+// the feature
+const capabilityProbePath = "/akubra-capability-probe"
+
+type backendCapability struct {
+	name   string
+	method string
+	path   string
+}
+
+var probedCapabilities = []backendCapability{
+	{"multipart uploads", http.MethodPost, capabilityProbePath + "/probe?uploads"},
+	{"bucket versioning", http.MethodGet, capabilityProbePath + "?versioning"},
+	{"object tagging", http.MethodGet, capabilityProbePath + "/probe?tagging"},
+	{"bucket lifecycle", http.MethodGet, capabilityProbePath + "?lifecycle"},
+}
+
+// CapabilityMismatch lists backends of cluster which support capability and
+// which do not
+type CapabilityMismatch struct {
+	Cluster     string
+	Capability  string
+	Supported   []string
+	Unsupported []string
+}
+
+func (cm CapabilityMismatch) String() string {
+	return fmt.Sprintf("Backends of cluster %q differ in %s support, supported by %s, not supported by %s",
+		cm.Cluster, cm.Capability, strings.Join(cm.Supported, ", "), strings.Join(cm.Unsupported, ", "))
+}
+
+// unsupported tells if response rejects request as not implemented
+func unsupported(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusNotImplemented || resp.StatusCode == http.StatusMethodNotAllowed {
+		return true
+	}
+	s3Error := struct {
+		Code string `xml:"Code"`
+	}{}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&s3Error); err != nil {
+		return false
+	}
+	return s3Error.Code == "NotImplemented" || s3Error.Code == "MethodNotAllowed"
+}
+
+// probeCapability tells if backend supports capability, error means it
+// could not be determined
+func probeCapability(backend string, capability backendCapability, roundTripper http.RoundTripper, timeout time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequest(capability.method, strings.TrimSuffix(backend, "/")+capability.path, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := roundTripper.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+	return !unsupported(resp), nil
+}
+
+// ProbeCapabilities sends cheap unsigned requests to backends of every
+// cluster and reports capabilities not supported by all backends of cluster,
+// writes using them would be replicated inconsistently
+func ProbeCapabilities(conf config.Config, roundTripper http.RoundTripper, timeout time.Duration) []CapabilityMismatch {
+	clusters := make([]string, 0, len(conf.Clusters))
+	for name := range conf.Clusters {
+		clusters = append(clusters, name)
+	}
+	sort.Strings(clusters)
+	var mismatches []CapabilityMismatch
+	for _, name := range clusters {
+		backends := conf.Clusters[name].Backends
+		for _, capability := range probedCapabilities {
+			mismatch := CapabilityMismatch{Cluster: name, Capability: capability.name}
+			for _, backend := range backends {
+				supported, err := probeCapability(backend.String(), capability, roundTripper, timeout)
+				switch {
+				case err != nil:
+					log.Printf("Cannot probe %s support of backend %s: %s", capability.name, backend.Host, err)
+				case supported:
+					mismatch.Supported = append(mismatch.Supported, backend.Host)
+				default:
+					mismatch.Unsupported = append(mismatch.Unsupported, backend.Host)
+				}
+			}
+			if len(mismatch.Supported) > 0 && len(mismatch.Unsupported) > 0 {
+				mismatches = append(mismatches, mismatch)
+			}
+		}
+	}
+	return mismatches
+}
+
+// WarnCapabilityMismatches logs capabilities not supported by all backends
+// of cluster, if ProbeBackendCapabilities is enabled
+func WarnCapabilityMismatches(conf config.Config, roundTripper http.RoundTripper) {
+	if !conf.ProbeBackendCapabilities {
+		return
+	}
+	for _, mismatch := range ProbeCapabilities(conf, roundTripper, CapabilityProbeTimeout) {
+		log.Printf("WARNING: %s", mismatch)
+	}
+}
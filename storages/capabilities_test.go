@@ -0,0 +1,105 @@
+package storages
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/log"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mkCapabilitiesSrv answers probes of unsupported subresources with
+// NotImplemented error and all other requests with AccessDenied
+func mkCapabilitiesSrv(unsupported ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, subresource := range unsupported {
+			if _, ok := r.URL.Query()[subresource]; ok {
+				w.WriteHeader(http.StatusNotImplemented)
+				_, _ = w.Write([]byte("<Error><Code>NotImplemented</Code></Error>"))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("<Error><Code>AccessDenied</Code></Error>"))
+	}))
+}
+
+func capabilitiesConfig(backends ...string) config.Config {
+	urls := make([]shardingconfig.YAMLUrl, 0, len(backends))
+	for _, backend := range backends {
+		backendURL, _ := url.Parse(backend)
+		urls = append(urls, shardingconfig.YAMLUrl{URL: backendURL})
+	}
+	return config.Config{YamlConfig: config.YamlConfig{
+		Clusters:                 map[string]shardingconfig.ClusterConfig{"cluster1": {Backends: urls}},
+		ProbeBackendCapabilities: true,
+	}}
+}
+
+func TestProbeCapabilitiesReportsBackendsDifferingInSupport(t *testing.T) {
+	full, noMultipart := mkCapabilitiesSrv(), mkCapabilitiesSrv("uploads")
+	defer full.Close()
+	defer noMultipart.Close()
+	fullURL, _ := url.Parse(full.URL)
+	noMultipartURL, _ := url.Parse(noMultipart.URL)
+
+	mismatches := ProbeCapabilities(capabilitiesConfig(full.URL, noMultipart.URL), http.DefaultTransport, time.Second)
+
+	require.Len(t, mismatches, 1)
+	assert.Equal(t, CapabilityMismatch{
+		Cluster:     "cluster1",
+		Capability:  "multipart uploads",
+		Supported:   []string{fullURL.Host},
+		Unsupported: []string{noMultipartURL.Host},
+	}, mismatches[0])
+}
+
+func TestProbeCapabilitiesIgnoresCapabilitiesMissingEverywhere(t *testing.T) {
+	first, second := mkCapabilitiesSrv("tagging"), mkCapabilitiesSrv("tagging")
+	defer first.Close()
+	defer second.Close()
+
+	assert.Empty(t, ProbeCapabilities(capabilitiesConfig(first.URL, second.URL), http.DefaultTransport, time.Second))
+}
+
+func TestProbeCapabilitiesSkipsUnreachableBackends(t *testing.T) {
+	reachable, unreachable := mkCapabilitiesSrv(), mkCapabilitiesSrv()
+	defer reachable.Close()
+	unreachable.Close()
+
+	assert.Empty(t, ProbeCapabilities(capabilitiesConfig(reachable.URL, unreachable.URL), http.DefaultTransport, time.Second))
+}
+
+func TestWarnCapabilityMismatchesLogsWarning(t *testing.T) {
+	var logBuffer bytes.Buffer
+	defaultLogger := log.DefaultLogger
+	log.DefaultLogger = &logrus.Logger{
+		Out:       &logBuffer,
+		Formatter: log.PlainTextFormatter{},
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.DebugLevel,
+	}
+	defer func() { log.DefaultLogger = defaultLogger }()
+	full, noVersioning := mkCapabilitiesSrv(), mkCapabilitiesSrv("versioning")
+	defer full.Close()
+	defer noVersioning.Close()
+	conf := capabilitiesConfig(full.URL, noVersioning.URL)
+
+	conf.ProbeBackendCapabilities = false
+	WarnCapabilityMismatches(conf, http.DefaultTransport)
+	assert.Empty(t, logBuffer.String())
+
+	conf.ProbeBackendCapabilities = true
+	WarnCapabilityMismatches(conf, http.DefaultTransport)
+	noVersioningURL, _ := url.Parse(noVersioning.URL)
+	assert.Contains(t, logBuffer.String(), `Backends of cluster "cluster1" differ in bucket versioning support`)
+	assert.Contains(t, logBuffer.String(), "not supported by "+noVersioningURL.Host)
+}
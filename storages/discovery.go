@@ -0,0 +1,160 @@
+package storages
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+)
+
+// DefaultSRVRefreshInterval is used if SRV.RefreshInterval is not set
+const DefaultSRVRefreshInterval = 30 * time.Second
+
+// ErrNoSRVTargets is returned if SRV record resolves to no backends
+var ErrNoSRVTargets = errors.New("SRV record has no targets")
+
+// SRVResolver looks up SRV records, net.DefaultResolver implements it
+type SRVResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// BackendDiscovery keeps cluster backends in sync with DNS SRV record.
+// Backends are kept unchanged if record can't be resolved
+type BackendDiscovery struct {
+	conf      shardingconfig.SRVConfig
+	resolver  SRVResolver
+	mx        sync.Mutex
+	backends  []url.URL
+	listeners []func([]url.URL)
+	done      chan struct{}
+}
+
+// NewBackendDiscovery creates BackendDiscovery without resolving record
+func NewBackendDiscovery(conf shardingconfig.SRVConfig, resolver SRVResolver) *BackendDiscovery {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &BackendDiscovery{conf: conf, resolver: resolver, done: make(chan struct{})}
+}
+
+// Backends returns last resolved backends
+func (bd *BackendDiscovery) Backends() []url.URL {
+	bd.mx.Lock()
+	defer bd.mx.Unlock()
+	return bd.backends
+}
+
+// OnChange registers listener called with new backends whenever they
+// change
+func (bd *BackendDiscovery) OnChange(listener func([]url.URL)) {
+	bd.mx.Lock()
+	defer bd.mx.Unlock()
+	bd.listeners = append(bd.listeners, listener)
+}
+
+func (bd *BackendDiscovery) resolve() ([]url.URL, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), bd.refreshInterval())
+	defer cancel()
+	_, records, err := bd.resolver.LookupSRV(ctx, "", "", bd.conf.Record)
+	if err != nil {
+		return nil, err
+	}
+	scheme := bd.conf.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	uniq := make(map[string]bool, len(records))
+	hosts := make([]string, 0, len(records))
+	for _, record := range records {
+		host := net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+		if !uniq[host] {
+			uniq[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, ErrNoSRVTargets
+	}
+	// sorted, so the same record set always gives the same backends
+	sort.Strings(hosts)
+	backends := make([]url.URL, len(hosts))
+	for i, host := range hosts {
+		backends[i] = url.URL{Scheme: scheme, Host: host}
+	}
+	return backends, nil
+}
+
+func sameBackends(a, b []url.URL) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Refresh resolves SRV record and notifies listeners if backends changed
+func (bd *BackendDiscovery) Refresh() error {
+	backends, err := bd.resolve()
+	metricPrefix := "discovery." + metrics.Clean(bd.conf.Record)
+	if err != nil {
+		metrics.Mark(metricPrefix + ".errors")
+		return err
+	}
+	metrics.UpdateGauge(metricPrefix+".backends", int64(len(backends)))
+	bd.mx.Lock()
+	if sameBackends(bd.backends, backends) {
+		bd.mx.Unlock()
+		return nil
+	}
+	log.Printf("Backends of SRV record %s changed to %v", bd.conf.Record, backends)
+	bd.backends = backends
+	listeners := bd.listeners
+	bd.mx.Unlock()
+	for _, listener := range listeners {
+		listener(backends)
+	}
+	return nil
+}
+
+func (bd *BackendDiscovery) refreshInterval() time.Duration {
+	if bd.conf.RefreshInterval.Duration > 0 {
+		return bd.conf.RefreshInterval.Duration
+	}
+	return DefaultSRVRefreshInterval
+}
+
+// Start refreshes backends every SRV.RefreshInterval until Stop is called
+func (bd *BackendDiscovery) Start() {
+	go func() {
+		ticker := time.NewTicker(bd.refreshInterval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-bd.done:
+				return
+			case <-ticker.C:
+				if err := bd.Refresh(); err != nil {
+					log.Printf("Cannot refresh backends of SRV record %s: %s", bd.conf.Record, err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop ends refreshing
+func (bd *BackendDiscovery) Stop() {
+	close(bd.done)
+}
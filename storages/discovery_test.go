@@ -0,0 +1,133 @@
+package storages
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/metrics"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSRVResolver struct {
+	mx      sync.Mutex
+	records []*net.SRV
+	err     error
+}
+
+func (r *fakeSRVResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return name, r.records, r.err
+}
+
+func (r *fakeSRVResolver) set(err error, servers ...*httptest.Server) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.err = err
+	r.records = nil
+	for _, srv := range servers {
+		host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+		portNumber, _ := strconv.Atoi(port)
+		r.records = append(r.records, &net.SRV{Target: host + ".", Port: uint16(portNumber)})
+	}
+}
+
+func mkNamedBackend(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(name))
+	}))
+}
+
+func hosts(backends []url.URL) []string {
+	result := make([]string, 0, len(backends))
+	for _, backend := range backends {
+		result = append(result, backend.Host)
+	}
+	return result
+}
+
+func get(t *testing.T, roundTripper http.RoundTripper) string {
+	req, _ := http.NewRequest(http.MethodGet, "http://akubra.internal/bucket/key", nil)
+	resp, err := roundTripper.RoundTrip(req)
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, resp.Body.Close())
+	return string(body)
+}
+
+func TestDiscoveredClusterFollowsSRVRecord(t *testing.T) {
+	first, second := mkNamedBackend("first"), mkNamedBackend("second")
+	defer first.Close()
+	defer second.Close()
+	resolver := &fakeSRVResolver{}
+	resolver.set(nil, first, second)
+	st := Storages{
+		Conf: config.Config{YamlConfig: config.YamlConfig{
+			Clusters: map[string]shardingconfig.ClusterConfig{
+				"discovered": {SRV: shardingconfig.SRVConfig{
+					Record:          "_s3._tcp.storage.internal",
+					RefreshInterval: metrics.Interval{Duration: 10 * time.Millisecond},
+				}},
+			},
+		}},
+		Transport: http.DefaultTransport,
+		Clusters:  make(map[string]Cluster),
+		Resolver:  resolver,
+	}
+
+	cluster, err := st.GetCluster("discovered")
+	require.NoError(t, err)
+	defer cluster.Discovery.Stop()
+	assert.Len(t, cluster.CurrentBackends(), 2)
+	assert.Contains(t, hosts(cluster.CurrentBackends()), first.Listener.Addr().String())
+	assert.Contains(t, hosts(cluster.CurrentBackends()), second.Listener.Addr().String())
+
+	resolver.set(nil, second)
+	waitForBackends := func(expected []string) {
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) && !assert.ObjectsAreEqual(expected, hosts(cluster.CurrentBackends())) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		assert.Equal(t, expected, hosts(cluster.CurrentBackends()))
+	}
+	waitForBackends([]string{second.Listener.Addr().String()})
+	assert.Equal(t, "second", get(t, cluster.RoundTripper))
+
+	// failed resolution keeps last backends
+	resolver.set(errors.New("no such host"))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []string{second.Listener.Addr().String()}, hosts(cluster.CurrentBackends()))
+
+	resolver.set(nil, first)
+	waitForBackends([]string{first.Listener.Addr().String()})
+	assert.Equal(t, "first", get(t, cluster.RoundTripper))
+}
+
+func TestDiscoveredClusterRequiresResolvableRecord(t *testing.T) {
+	resolver := &fakeSRVResolver{}
+	resolver.set(nil)
+	st := Storages{
+		Conf: config.Config{YamlConfig: config.YamlConfig{
+			Clusters: map[string]shardingconfig.ClusterConfig{
+				"discovered": {SRV: shardingconfig.SRVConfig{Record: "_s3._tcp.storage.internal"}},
+			},
+		}},
+		Clusters: make(map[string]Cluster),
+		Resolver: resolver,
+	}
+
+	_, err := st.GetCluster("discovered")
+	assert.Error(t, err)
+}
@@ -0,0 +1,79 @@
+package storages
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// DefaultHealthCheckInterval is used if HealthCheckInterval is not set
+const DefaultHealthCheckInterval = 5 * time.Second
+
+// HealthChecker periodically checks all configured backends. Backends are
+// unhealthy until their first check passes
+type HealthChecker struct {
+	mx      sync.RWMutex
+	healthy map[string]bool
+	done    chan struct{}
+}
+
+// Healthy implements transport.BackendHealth
+func (hc *HealthChecker) Healthy(host string) bool {
+	hc.mx.RLock()
+	defer hc.mx.RUnlock()
+	return hc.healthy[host]
+}
+
+func (hc *HealthChecker) update(results []BackendCheckResult) {
+	hc.mx.Lock()
+	defer hc.mx.Unlock()
+	healthyCount := 0
+	for _, result := range results {
+		backendURL, err := url.Parse(result.Backend)
+		if err != nil {
+			continue
+		}
+		healthy := result.Err == nil
+		if hc.healthy[backendURL.Host] != healthy {
+			log.Printf("Backend %s health changed, healthy: %t", backendURL.Host, healthy)
+		}
+		hc.healthy[backendURL.Host] = healthy
+		if healthy {
+			healthyCount++
+		}
+	}
+	metrics.UpdateGauge("backends.healthy", int64(healthyCount))
+}
+
+// Stop ends health checking
+func (hc *HealthChecker) Stop() {
+	close(hc.done)
+}
+
+// StartHealthChecker checks backends right away and then every
+// HealthCheckInterval
+func StartHealthChecker(conf config.Config, roundTripper http.RoundTripper) *HealthChecker {
+	interval := conf.HealthCheckInterval.Duration
+	if interval <= 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	hc := &HealthChecker{healthy: make(map[string]bool), done: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			hc.update(CheckBackends(conf, roundTripper, interval))
+			select {
+			case <-hc.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return hc
+}
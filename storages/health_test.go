@@ -0,0 +1,39 @@
+package storages
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/metrics"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthCheckerFollowsBackendState(t *testing.T) {
+	status := int32(http.StatusServiceUnavailable)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	conf := config.Config{YamlConfig: config.YamlConfig{
+		Clusters: map[string]shardingconfig.ClusterConfig{
+			"cluster1": {Backends: []shardingconfig.YAMLUrl{{URL: backendURL}}},
+		},
+		HealthCheckInterval: metrics.Interval{Duration: 20 * time.Millisecond},
+	}}
+
+	hc := StartHealthChecker(conf, http.DefaultTransport)
+	defer hc.Stop()
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, hc.Healthy(backendURL.Host))
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, hc.Healthy(backendURL.Host))
+}
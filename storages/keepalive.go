@@ -0,0 +1,48 @@
+package storages
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+func pingBackend(backend string, roundTripper http.RoundTripper, timeout time.Duration) {
+	since := time.Now()
+	err := checkBackend(backend, roundTripper, timeout)
+	metrics.UpdateSince("reqs.backend."+metrics.Clean(backend)+".keepalive_ping", since)
+	if err != nil {
+		log.Debugf("Keep-alive ping to %s failed: %s", backend, err)
+		metrics.Mark("reqs.backend." + metrics.Clean(backend) + ".keepalive_ping_error")
+	}
+}
+
+// StartKeepAlivePinger sends HEAD request to every configured backend each
+// KeepAlivePingInterval, so idle connections in pool are not dropped by
+// intermediaries. Returned function stops pinging. Pinger is not started if
+// interval is not set or keep-alives are disabled
+func StartKeepAlivePinger(conf config.Config, roundTripper http.RoundTripper) (stop func()) {
+	interval := conf.KeepAlivePingInterval.Duration
+	if interval <= 0 || conf.DisableKeepAlives {
+		return func() {}
+	}
+	backends := configuredBackends(conf)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				for _, backend := range backends {
+					pingBackend(backend, roundTripper, interval)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
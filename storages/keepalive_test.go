@@ -0,0 +1,75 @@
+package storages
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/metrics"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type pingRecorder struct {
+	mx    sync.Mutex
+	pings []time.Time
+}
+
+func (pr *pingRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pr.mx.Lock()
+	defer pr.mx.Unlock()
+	pr.pings = append(pr.pings, time.Now())
+}
+
+func (pr *pingRecorder) recorded() []time.Time {
+	pr.mx.Lock()
+	defer pr.mx.Unlock()
+	return append([]time.Time{}, pr.pings...)
+}
+
+func keepAliveConfig(backend string, interval time.Duration, disableKeepAlives bool) config.Config {
+	backendURL, _ := url.Parse(backend)
+	return config.Config{YamlConfig: config.YamlConfig{
+		Clusters: map[string]shardingconfig.ClusterConfig{
+			"cluster1": {Backends: []shardingconfig.YAMLUrl{{URL: backendURL}}},
+		},
+		DisableKeepAlives:     disableKeepAlives,
+		KeepAlivePingInterval: metrics.Interval{Duration: interval},
+	}}
+}
+
+func TestKeepAlivePingerPingsBackendsInConfiguredInterval(t *testing.T) {
+	recorder := &pingRecorder{}
+	backend := httptest.NewServer(recorder)
+	defer backend.Close()
+	interval := 50 * time.Millisecond
+
+	stop := StartKeepAlivePinger(keepAliveConfig(backend.URL, interval, false), http.DefaultTransport)
+	time.Sleep(5*interval + interval/2)
+	stop()
+
+	pings := recorder.recorded()
+	assert.True(t, len(pings) >= 3 && len(pings) <= 6, "unexpected number of pings %d", len(pings))
+	for i := 1; i < len(pings); i++ {
+		assert.InDelta(t, interval, pings[i].Sub(pings[i-1]), float64(interval/2))
+	}
+	time.Sleep(2 * interval)
+	assert.Len(t, recorder.recorded(), len(pings), "pinger should stop")
+}
+
+func TestKeepAlivePingerIsDisabledWithoutKeepAlives(t *testing.T) {
+	recorder := &pingRecorder{}
+	backend := httptest.NewServer(recorder)
+	defer backend.Close()
+	interval := 20 * time.Millisecond
+
+	stop := StartKeepAlivePinger(keepAliveConfig(backend.URL, interval, true), http.DefaultTransport)
+	time.Sleep(5 * interval)
+	stop()
+
+	assert.Empty(t, recorder.recorded())
+}
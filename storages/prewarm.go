@@ -0,0 +1,80 @@
+package storages
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// PrewarmTimeout limits time spent on opening connections to single backend
+const PrewarmTimeout = 5 * time.Second
+
+// prewarmBackend sends conns HEAD requests to backend at once. Each request
+// waits for others to get connection before sending, so none of them reuses
+// connection of another one, and all connections land in transport idle pool
+func prewarmBackend(backend string, roundTripper http.RoundTripper, conns int, timeout time.Duration) int {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	acquired := sync.WaitGroup{}
+	acquired.Add(conns)
+	allAcquired := make(chan struct{})
+	go func() {
+		acquired.Wait()
+		close(allAcquired)
+	}()
+
+	warmed := make(chan bool, conns)
+	for i := 0; i < conns; i++ {
+		go func() {
+			once := sync.Once{}
+			trace := &httptrace.ClientTrace{
+				GotConn: func(httptrace.GotConnInfo) {
+					once.Do(acquired.Done)
+					select {
+					case <-allAcquired:
+					case <-ctx.Done():
+					}
+				},
+			}
+			err := checkBackendWithContext(httptrace.WithClientTrace(ctx, trace), backend, roundTripper)
+			once.Do(acquired.Done)
+			if err != nil {
+				log.Debugf("Cannot prewarm connection to %s: %s", backend, err)
+			}
+			warmed <- err == nil
+		}()
+	}
+	count := 0
+	for i := 0; i < conns; i++ {
+		if <-warmed {
+			count++
+		}
+	}
+	return count
+}
+
+// PrewarmConnections opens PrewarmConns idle connections to every configured
+// backend, so first requests do not pay for dialing. Nothing is done if
+// PrewarmConns is not set or keep-alives are disabled
+func PrewarmConnections(conf config.Config, roundTripper http.RoundTripper) {
+	if conf.PrewarmConns <= 0 || conf.DisableKeepAlives {
+		return
+	}
+	wg := sync.WaitGroup{}
+	for _, backend := range configuredBackends(conf) {
+		wg.Add(1)
+		go func(backend string) {
+			defer wg.Done()
+			count := prewarmBackend(backend, roundTripper, conf.PrewarmConns, PrewarmTimeout)
+			metrics.UpdateGauge("reqs.backend."+metrics.Clean(backend)+".prewarmed_conns", int64(count))
+			log.Printf("Prewarmed %d of %d connections to %s", count, conf.PrewarmConns, backend)
+		}(backend)
+	}
+	wg.Wait()
+}
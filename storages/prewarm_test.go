@@ -0,0 +1,90 @@
+package storages
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type connCounter struct {
+	mx    sync.Mutex
+	dials int
+	idle  map[net.Conn]bool
+}
+
+func (cc *connCounter) connState(conn net.Conn, state http.ConnState) {
+	cc.mx.Lock()
+	defer cc.mx.Unlock()
+	if state == http.StateNew {
+		cc.dials++
+	}
+	cc.idle[conn] = state == http.StateIdle
+}
+
+func (cc *connCounter) counts() (dials, idle int) {
+	cc.mx.Lock()
+	defer cc.mx.Unlock()
+	for _, isIdle := range cc.idle {
+		if isIdle {
+			idle++
+		}
+	}
+	return cc.dials, idle
+}
+
+func prewarmConfig(backend string, conns int) config.Config {
+	conf := keepAliveConfig(backend, 0, false)
+	conf.PrewarmConns = conns
+	return conf
+}
+
+func TestPrewarmConnectionsOpensIdleConnections(t *testing.T) {
+	counter := &connCounter{idle: make(map[net.Conn]bool)}
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backend.Config.ConnState = counter.connState
+	backend.Start()
+	defer backend.Close()
+	transport := &http.Transport{MaxIdleConnsPerHost: 10}
+	defer transport.CloseIdleConnections()
+
+	PrewarmConnections(prewarmConfig(backend.URL, 5), transport)
+
+	deadline := time.Now().Add(time.Second)
+	dials, idle := counter.counts()
+	for idle != 5 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		dials, idle = counter.counts()
+	}
+	assert.Equal(t, 5, dials)
+	assert.Equal(t, 5, idle)
+
+	// next concurrent requests take all connections from pool, none is dialed
+	assert.Equal(t, 5, prewarmBackend(backend.URL, transport, 5, time.Second))
+	dials, _ = counter.counts()
+	assert.Equal(t, 5, dials)
+}
+
+func TestPrewarmConnectionsIsDisabledWithoutKeepAlives(t *testing.T) {
+	recorder := &pingRecorder{}
+	backend := httptest.NewServer(recorder)
+	defer backend.Close()
+	conf := prewarmConfig(backend.URL, 5)
+	conf.DisableKeepAlives = true
+
+	PrewarmConnections(conf, http.DefaultTransport)
+
+	assert.Empty(t, recorder.recorded())
+}
+
+func TestPrewarmConnectionsReportsUnreachableBackend(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backend.Close()
+
+	assert.Equal(t, 0, prewarmBackend(backend.URL, http.DefaultTransport, 3, time.Second))
+}
@@ -0,0 +1,97 @@
+package storages
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/allegro/akubra/config"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+)
+
+// BackendCheckResult holds outcome of single backend reachability check
+type BackendCheckResult struct {
+	Backend string
+	Err     error
+}
+
+func configuredBackends(conf config.Config) []string {
+	uniq := make(map[string]bool)
+	for _, clusterConf := range conf.Clusters {
+		for _, backend := range clusterConf.Backends {
+			uniq[backend.String()] = true
+		}
+	}
+	backends := make([]string, 0, len(uniq))
+	for backend := range uniq {
+		backends = append(backends, backend)
+	}
+	sort.Strings(backends)
+	return backends
+}
+
+func checkBackend(backend string, roundTripper http.RoundTripper, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return checkBackendWithContext(ctx, backend, roundTripper)
+}
+
+func checkBackendWithContext(ctx context.Context, backend string, roundTripper http.RoundTripper) error {
+	return checkBackendHealth(ctx, backend, shardingconfig.HealthCheckConfig{}, roundTripper)
+}
+
+// checkBackendHealth sends check request to backend. Without ExpectedStatus
+// any status lower than 500 passes
+func checkBackendHealth(ctx context.Context, backend string, check shardingconfig.HealthCheckConfig, roundTripper http.RoundTripper) error {
+	checkURL, err := url.Parse(backend)
+	if err != nil {
+		return err
+	}
+	if check.Path != "" {
+		checkURL.Path = check.Path
+	}
+	method := check.Method
+	if method == "" {
+		method = http.MethodHead
+	}
+	req, err := http.NewRequest(method, checkURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := roundTripper.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if check.ExpectedStatus != 0 && resp.StatusCode != check.ExpectedStatus {
+		return fmt.Errorf("backend responded with status %d, expected %d", resp.StatusCode, check.ExpectedStatus)
+	}
+	if check.ExpectedStatus == 0 && resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("backend responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// CheckBackends sends check request to every backend defined in clusters
+// configuration, HEAD by default or as configured in BackendHealthChecks.
+// Backend passes default check if it responds with status lower than 500
+func CheckBackends(conf config.Config, roundTripper http.RoundTripper, timeout time.Duration) []BackendCheckResult {
+	backends := configuredBackends(conf)
+	results := make([]BackendCheckResult, 0, len(backends))
+	for _, backend := range backends {
+		var check shardingconfig.HealthCheckConfig
+		if backendURL, err := url.Parse(backend); err == nil {
+			check = conf.BackendHealthChecks[backendURL.Host]
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		results = append(results, BackendCheckResult{
+			Backend: backend,
+			Err:     checkBackendHealth(ctx, backend, check, roundTripper),
+		})
+		cancel()
+	}
+	return results
+}
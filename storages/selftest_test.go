@@ -0,0 +1,86 @@
+package storages
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/config"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckBackendsReportsReachableAndUnreachableBackends(t *testing.T) {
+	reachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodHead, r.Method)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer reachable.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachableURL := unreachable.URL
+	unreachable.Close()
+
+	reachableURL, _ := url.Parse(reachable.URL)
+	closedURL, _ := url.Parse(unreachableURL)
+	conf := config.Config{YamlConfig: config.YamlConfig{
+		Clusters: map[string]shardingconfig.ClusterConfig{
+			"cluster1": {Backends: []shardingconfig.YAMLUrl{{URL: reachableURL}, {URL: closedURL}}},
+			"cluster2": {Backends: []shardingconfig.YAMLUrl{{URL: reachableURL}}},
+		},
+	}}
+
+	results := CheckBackends(conf, http.DefaultTransport, time.Second)
+
+	assert.Len(t, results, 2)
+	for _, result := range results {
+		switch result.Backend {
+		case reachable.URL:
+			assert.NoError(t, result.Err)
+		case unreachableURL:
+			assert.Error(t, result.Err)
+		default:
+			t.Errorf("Unexpected backend %s", result.Backend)
+		}
+	}
+}
+
+func TestCheckBackendsUsesConfiguredHealthChecks(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /healthz":
+			w.WriteHeader(http.StatusNoContent)
+		case "GET /bucket/canary":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	for _, testData := range []struct {
+		name  string
+		check shardingconfig.HealthCheckConfig
+		valid bool
+	}{
+		{"default check", shardingconfig.HealthCheckConfig{}, true},
+		{"healthz endpoint", shardingconfig.HealthCheckConfig{Method: http.MethodGet, Path: "/healthz", ExpectedStatus: http.StatusNoContent}, true},
+		{"known object", shardingconfig.HealthCheckConfig{Method: http.MethodGet, Path: "/bucket/canary", ExpectedStatus: http.StatusOK}, true},
+		{"unexpected status", shardingconfig.HealthCheckConfig{Method: http.MethodGet, Path: "/healthz", ExpectedStatus: http.StatusOK}, false},
+		{"missing object", shardingconfig.HealthCheckConfig{Method: http.MethodHead, Path: "/bucket/missing", ExpectedStatus: http.StatusOK}, false},
+	} {
+		conf := config.Config{YamlConfig: config.YamlConfig{
+			Clusters: map[string]shardingconfig.ClusterConfig{
+				"cluster1": {Backends: []shardingconfig.YAMLUrl{{URL: backendURL}}},
+			},
+			BackendHealthChecks: map[string]shardingconfig.HealthCheckConfig{backendURL.Host: testData.check},
+		}}
+
+		results := CheckBackends(conf, http.DefaultTransport, time.Second)
+
+		assert.Len(t, results, 1)
+		assert.Equal(t, testData.valid, results[0].Err == nil, "%s: %v", testData.name, results[0].Err)
+	}
+}
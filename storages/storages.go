@@ -16,18 +16,77 @@ type Cluster struct {
 	http.RoundTripper
 	Backends []shardingconfig.YAMLUrl
 	Name     string
+	// Discovery keeps backends in sync with SRV record, nil for clusters
+	// with static backends
+	Discovery *BackendDiscovery
 }
 
-//Storages config
+// CurrentBackends returns backends cluster sends requests to
+func (c Cluster) CurrentBackends() []url.URL {
+	if c.Discovery != nil {
+		return c.Discovery.Backends()
+	}
+	backends := make([]url.URL, len(c.Backends))
+	for i, backend := range c.Backends {
+		backends[i] = *backend.URL
+	}
+	return backends
+}
+
+// Storages config
 type Storages struct {
 	Conf      config.Config
 	Transport http.RoundTripper
 	Clusters  map[string]Cluster
+	// Health is consulted in write safe mode
+	Health transport.BackendHealth
+	// Reconciler repairs divergent replicas found by conditional requests
+	Reconciler transport.Reconciler
+	// WriteHealer re-attempts writes which failed on some backends
+	WriteHealer transport.WriteHealer
+	// Resolver looks up SRV records of discovered clusters, nil means
+	// net.DefaultResolver
+	Resolver SRVResolver
+}
+
+// TransportOptions picks MultiTransport options from configuration
+func (st Storages) TransportOptions() transport.MultiTransportOptions {
+	conf := st.Conf
+	return transport.MultiTransportOptions{
+		MaintainedBackends:          conf.MaintainedBackends,
+		MaintenanceSchedule:         conf.MaintenanceSchedule,
+		Retries:                     conf.Retries,
+		Locality:                    conf.Locality,
+		WriteConcurrency:            conf.WriteConcurrency,
+		WriteQuorum:                 conf.WriteQuorum,
+		FailFastWrites:              conf.FailFastWrites,
+		PropagateClientCancellation: conf.PropagateClientCancellation,
+		ConsistentPreconditions:     conf.ConsistentPreconditions,
+		MergeListings:               conf.MergeListings,
+		OutlierEjection:             conf.OutlierEjection,
+		Quarantine:                  conf.Quarantine,
+		ErrorBodies:                 conf.ErrorBodies,
+		BackendRateLimits:           conf.BackendRateLimits,
+		AdaptiveThrottling:          conf.AdaptiveThrottling,
+		CapacityWeights:             conf.CapacityWeights,
+		DeleteTombstones:            conf.DeleteTombstones,
+		ReadFanout:                  conf.ReadFanout,
+		WriteSafeMode:               conf.WriteSafeMode,
+		Health:                      st.Health,
+		Reconciler:                  st.Reconciler,
+		WriteHealer:                 st.WriteHealer,
+		RoutingLog:                  conf.Routinglog,
+		HeadQuorum:                  conf.HeadQuorum,
+		AuthoritativeBackend:        conf.AuthoritativeBackend,
+		RequireContentLength:        conf.RequireContentLength,
+		RechunkBufferLimit:          conf.RechunkBufferLimit.SizeInBytes,
+		SessionAffinity:             conf.SessionAffinity,
+	}
 }
 
 func newMultiBackendCluster(transp http.RoundTripper,
 	multiResponseHandler transport.MultipleResponsesHandler,
-	clusterConf shardingconfig.ClusterConfig, name string, maintainedBackends []shardingconfig.YAMLUrl) Cluster {
+	clusterConf shardingconfig.ClusterConfig, name string, options transport.MultiTransportOptions) Cluster {
 	backends := make([]url.URL, len(clusterConf.Backends))
 
 	for i, backend := range clusterConf.Backends {
@@ -38,25 +97,50 @@ func newMultiBackendCluster(transp http.RoundTripper,
 		transp,
 		backends,
 		multiResponseHandler,
-		maintainedBackends)
+		options)
 
 	return Cluster{
-		multiTransport,
-		clusterConf.Backends,
-		name,
+		RoundTripper: multiTransport,
+		Backends:     clusterConf.Backends,
+		Name:         name,
 	}
 }
 
+// newDiscoveredCluster creates cluster with backends resolved from SRV
+// record, record has to resolve before cluster is created
+func (st Storages) newDiscoveredCluster(multiResponseHandler transport.MultipleResponsesHandler,
+	clusterConf shardingconfig.ClusterConfig, name string) (Cluster, error) {
+	discovery := NewBackendDiscovery(clusterConf.SRV, st.Resolver)
+	if err := discovery.Refresh(); err != nil {
+		return Cluster{}, fmt.Errorf("cannot discover backends of cluster %q: %s", name, err)
+	}
+	multiTransport := transport.NewMultiTransport(
+		st.Transport,
+		discovery.Backends(),
+		multiResponseHandler,
+		st.TransportOptions())
+	discovery.OnChange(multiTransport.SetBackends)
+	discovery.Start()
+	return Cluster{
+		RoundTripper: multiTransport,
+		Name:         name,
+		Discovery:    discovery,
+	}, nil
+}
+
 func (st Storages) initCluster(name string) (Cluster, error) {
 	clusterConf, ok := st.Conf.Clusters[name]
 	if !ok {
 		return Cluster{}, fmt.Errorf("no cluster %q in configuration", name)
 	}
 	respHandler := httphandler.EarliestResponseHandler(st.Conf)
-	return newMultiBackendCluster(st.Transport, respHandler, clusterConf, name, st.Conf.MaintainedBackends), nil
+	if clusterConf.SRV.Record != "" {
+		return st.newDiscoveredCluster(respHandler, clusterConf, name)
+	}
+	return newMultiBackendCluster(st.Transport, respHandler, clusterConf, name, st.TransportOptions()), nil
 }
 
-//GetCluster gets cluster by name or nil if cluster with given name was not found
+// GetCluster gets cluster by name or nil if cluster with given name was not found
 func (st Storages) GetCluster(name string) (Cluster, error) {
 	s3cluster, ok := st.Clusters[name]
 	if ok {
@@ -0,0 +1,162 @@
+package transport
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+)
+
+const (
+	defaultMaxConcurrency = 100
+	defaultDecreaseFactor = 0.5
+)
+
+// concurrencyLimiter keeps number of requests awaiting backend response
+// within limit adjusted with AIMD
+type concurrencyLimiter struct {
+	mx       sync.Mutex
+	limit    float64
+	min      float64
+	max      float64
+	factor   float64
+	inFlight int
+	// released is closed and replaced whenever request slot frees up
+	released     chan struct{}
+	lastDecrease time.Time
+}
+
+func (cl *concurrencyLimiter) acquire(ctx context.Context) error {
+	for {
+		cl.mx.Lock()
+		if cl.inFlight < int(cl.limit) {
+			cl.inFlight++
+			cl.mx.Unlock()
+			return nil
+		}
+		released := cl.released
+		cl.mx.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (cl *concurrencyLimiter) saturated() bool {
+	cl.mx.Lock()
+	defer cl.mx.Unlock()
+	return cl.inFlight >= int(cl.limit)
+}
+
+// release frees request slot and adjusts limit. Limit is decreased once per
+// throttled round, responses to requests sent before last decrease are not
+// counted again
+func (cl *concurrencyLimiter) release(throttled bool, since time.Time) (limit int, decreased bool) {
+	cl.mx.Lock()
+	defer cl.mx.Unlock()
+	cl.inFlight--
+	close(cl.released)
+	cl.released = make(chan struct{})
+	switch {
+	case throttled && since.After(cl.lastDecrease):
+		cl.limit *= cl.factor
+		if cl.limit < cl.min {
+			cl.limit = cl.min
+		}
+		cl.lastDecrease = time.Now()
+		decreased = true
+	case !throttled && cl.limit < cl.max:
+		cl.limit += 1 / cl.limit
+		if cl.limit > cl.max {
+			cl.limit = cl.max
+		}
+	}
+	return int(cl.limit), decreased
+}
+
+// adaptiveThrottling holds concurrency limiters of backends, nil throttling
+// does not limit requests
+type adaptiveThrottling struct {
+	conf     shardingconfig.AdaptiveThrottlingConfig
+	mx       sync.Mutex
+	limiters map[string]*concurrencyLimiter
+}
+
+func newAdaptiveThrottling(conf shardingconfig.AdaptiveThrottlingConfig) *adaptiveThrottling {
+	if !conf.Enabled {
+		return nil
+	}
+	if conf.MaxConcurrency == 0 {
+		conf.MaxConcurrency = defaultMaxConcurrency
+	}
+	if conf.MinConcurrency == 0 {
+		conf.MinConcurrency = 1
+	}
+	if conf.DecreaseFactor == 0 {
+		conf.DecreaseFactor = defaultDecreaseFactor
+	}
+	return &adaptiveThrottling{conf: conf, limiters: make(map[string]*concurrencyLimiter)}
+}
+
+func (at *adaptiveThrottling) limiter(host string) *concurrencyLimiter {
+	at.mx.Lock()
+	defer at.mx.Unlock()
+	cl, ok := at.limiters[host]
+	if !ok {
+		cl = &concurrencyLimiter{
+			limit:    float64(at.conf.MaxConcurrency),
+			min:      float64(at.conf.MinConcurrency),
+			max:      float64(at.conf.MaxConcurrency),
+			factor:   at.conf.DecreaseFactor,
+			released: make(chan struct{}),
+		}
+		at.limiters[host] = cl
+	}
+	return cl
+}
+
+// saturated tells if requests to backend would have to wait for free slot
+func (at *adaptiveThrottling) saturated(host string) bool {
+	return at != nil && at.limiter(host).saturated()
+}
+
+// roundTrip sends request once backend has free request slot
+func (at *adaptiveThrottling) roundTrip(roundTripper http.RoundTripper, req *http.Request) (*http.Response, error) {
+	if at == nil {
+		return roundTripper.RoundTrip(req)
+	}
+	host := req.URL.Host
+	cl := at.limiter(host)
+	if err := cl.acquire(req.Context()); err != nil {
+		return nil, err
+	}
+	since := time.Now()
+	resp, err := roundTripper.RoundTrip(req)
+	throttled := isThrottled(resp)
+	limit, decreased := cl.release(throttled, since)
+	if throttled {
+		metrics.Mark("reqs.backend." + metrics.Clean(host) + ".throttled")
+	}
+	if decreased {
+		log.Debugf("Backend %s asked to slow down, its concurrency limit is now %d", host, limit)
+	}
+	metrics.UpdateGauge("reqs.backend."+metrics.Clean(host)+".concurrency_limit", int64(limit))
+	return resp, err
+}
+
+func isThrottled(resp *http.Response) bool {
+	if resp == nil {
+		return false
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return resp.StatusCode == http.StatusServiceUnavailable && resp.Body != nil &&
+		resp.Header.Get("Content-Encoding") == "" && peekErrorCode(resp) == "SlowDown"
+}
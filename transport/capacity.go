@@ -0,0 +1,106 @@
+package transport
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/metrics"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+)
+
+// DefaultCapacityWindow smooths reported free capacity if Window is not set
+const DefaultCapacityWindow = time.Minute
+
+// ErrBackendNearlyFull is returned for object writes not sent to backend
+// reporting little free capacity
+var ErrBackendNearlyFull = errors.New("backend is nearly full, write skipped")
+
+type freeCapacity struct {
+	bytes   float64
+	updated time.Time
+}
+
+// capacityWeights tracks free capacity reported by backends in response
+// header, smoothed with exponential moving average. Backends below low
+// watermark receive object writes with probability proportional to their
+// free capacity, backend with the most free capacity receives all of them
+type capacityWeights struct {
+	header       string
+	window       time.Duration
+	lowWatermark float64
+	mx           sync.Mutex
+	free         map[string]*freeCapacity
+	now          func() time.Time
+	random       func() float64
+}
+
+func newCapacityWeights(conf shardingconfig.CapacityWeightsConfig) *capacityWeights {
+	if conf.Header == "" || conf.LowWatermark.SizeInBytes <= 0 {
+		return nil
+	}
+	window := conf.Window.Duration
+	if window <= 0 {
+		window = DefaultCapacityWindow
+	}
+	return &capacityWeights{
+		header:       http.CanonicalHeaderKey(conf.Header),
+		window:       window,
+		lowWatermark: float64(conf.LowWatermark.SizeInBytes),
+		free:         make(map[string]*freeCapacity),
+		now:          time.Now,
+		random:       rand.Float64,
+	}
+}
+
+func (cw *capacityWeights) record(host string, resp *http.Response) {
+	if cw == nil || resp == nil {
+		return
+	}
+	reported, err := strconv.ParseFloat(resp.Header.Get(cw.header), 64)
+	if err != nil || reported < 0 {
+		return
+	}
+	cw.mx.Lock()
+	defer cw.mx.Unlock()
+	now := cw.now()
+	free, ok := cw.free[host]
+	if !ok {
+		free = &freeCapacity{bytes: reported}
+		cw.free[host] = free
+	} else {
+		alpha := 1 - math.Exp(-now.Sub(free.updated).Seconds()/cw.window.Seconds())
+		free.bytes += alpha * (reported - free.bytes)
+	}
+	free.updated = now
+	metrics.UpdateGauge("reqs.backend."+metrics.Clean(host)+".free_bytes", int64(free.bytes))
+}
+
+// weight is probability of sending object write to backend
+func (cw *capacityWeights) weight(host string) float64 {
+	free, ok := cw.free[host]
+	if !ok || free.bytes >= cw.lowWatermark {
+		return 1
+	}
+	for _, other := range cw.free {
+		if other.bytes > free.bytes {
+			return free.bytes / cw.lowWatermark
+		}
+	}
+	return 1
+}
+
+// admits tells if write should be sent to backend, only plain object
+// uploads are weighted
+func (cw *capacityWeights) admits(req *http.Request) bool {
+	if cw == nil || req.Method != http.MethodPut || req.URL.RawQuery != "" {
+		return true
+	}
+	cw.mx.Lock()
+	defer cw.mx.Unlock()
+	return cw.random() < cw.weight(req.URL.Host)
+}
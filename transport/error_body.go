@@ -0,0 +1,102 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+)
+
+// maxErrorBodySize limits inspected response size, S3 error documents are
+// small so larger bodies are not read
+const maxErrorBodySize = 64 * 1024
+
+type s3ErrorDocument struct {
+	XMLName xml.Name
+	Code    string `xml:"Code"`
+}
+
+// errorBodyValidator recognizes responses with success status carrying S3
+// error document, which some backends send in degraded states. Nil
+// validator accepts every response
+type errorBodyValidator struct {
+	statusCodes  map[int]bool
+	contentTypes map[string]bool
+	errorCodes   map[string]bool
+}
+
+func newErrorBodyValidator(conf shardingconfig.ErrorBodyConfig) *errorBodyValidator {
+	if len(conf.StatusCodes) == 0 {
+		return nil
+	}
+	contentTypes := conf.ContentTypes
+	if len(contentTypes) == 0 {
+		contentTypes = []string{"application/xml"}
+	}
+	ev := &errorBodyValidator{
+		statusCodes:  make(map[int]bool, len(conf.StatusCodes)),
+		contentTypes: make(map[string]bool, len(contentTypes)),
+		errorCodes:   make(map[string]bool, len(conf.ErrorCodes)),
+	}
+	for _, statusCode := range conf.StatusCodes {
+		ev.statusCodes[statusCode] = true
+	}
+	for _, contentType := range contentTypes {
+		ev.contentTypes[contentType] = true
+	}
+	for _, code := range conf.ErrorCodes {
+		ev.errorCodes[code] = true
+	}
+	return ev
+}
+
+func (ev *errorBodyValidator) inspected(resp *http.Response) bool {
+	if resp == nil || resp.Body == nil || !ev.statusCodes[resp.StatusCode] || resp.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && ev.contentTypes[mediaType]
+}
+
+// peekErrorCode returns code of S3 error document in response body, empty
+// if body is not error document. Read part of body is put back
+func peekErrorCode(resp *http.Response) string {
+	if resp.ContentLength > maxErrorBodySize {
+		return ""
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize+1))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	if err != nil || len(body) > maxErrorBodySize {
+		return ""
+	}
+	document := s3ErrorDocument{}
+	if xml.Unmarshal(body, &document) != nil || document.XMLName.Local != "Error" {
+		return ""
+	}
+	return document.Code
+}
+
+// failed checks if response body is S3 error document with one of
+// ErrorCodes (any code if none configured)
+func (ev *errorBodyValidator) failed(resp *http.Response) bool {
+	if ev == nil || !ev.inspected(resp) {
+		return false
+	}
+	code := peekErrorCode(resp)
+	if code == "" || len(ev.errorCodes) > 0 && !ev.errorCodes[code] {
+		return false
+	}
+	host := resp.Request.URL.Host
+	metrics.Mark("reqs.backend." + metrics.Clean(host) + ".error_bodies")
+	log.Debugf("Backend %s responded with status %d and error %s", host, resp.StatusCode, code)
+	return true
+}
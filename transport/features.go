@@ -0,0 +1,53 @@
+package transport
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/allegro/akubra/log"
+)
+
+// FeatureHeader lists features (comma separated) trusted client enables for
+// its request, e.g. for canary testing of routing behaviours
+const FeatureHeader = "X-Akubra-Feature"
+
+const (
+	// FeatureSequentialReads sends read to backends one by one until one
+	// succeeds, like Retries.AcrossBackends
+	FeatureSequentialReads = "sequential-reads"
+	// FeatureNoSessionAffinity routes read regardless of SessionAffinity
+	FeatureNoSessionAffinity = "no-session-affinity"
+	// FeatureNoHeadQuorum passes first HEAD response regardless of HeadQuorum
+	FeatureNoHeadQuorum = "no-head-quorum"
+)
+
+// Features registers features which may be enabled with FeatureHeader
+var Features = map[string]bool{
+	FeatureSequentialReads:   true,
+	FeatureNoSessionAffinity: true,
+	FeatureNoHeadQuorum:      true,
+}
+
+// ContextFeaturesKey is Request Context Value key of enabled features
+const ContextFeaturesKey = log.ContextKey("ContextFeaturesKey")
+
+// WithFeatures enables features for requests with ctx
+func WithFeatures(ctx context.Context, features []string) context.Context {
+	enabled := make(map[string]bool, len(features))
+	for _, feature := range features {
+		enabled[feature] = true
+	}
+	return context.WithValue(ctx, ContextFeaturesKey, enabled)
+}
+
+// FeatureEnabled tells if feature is enabled by request context
+func FeatureEnabled(req *http.Request, feature string) bool {
+	enabled, ok := req.Context().Value(ContextFeaturesKey).(map[string]bool)
+	return ok && enabled[feature]
+}
+
+// anyFeatureEnabled tells if request context enables some feature
+func anyFeatureEnabled(req *http.Request) bool {
+	enabled, _ := req.Context().Value(ContextFeaturesKey).(map[string]bool)
+	return len(enabled) > 0
+}
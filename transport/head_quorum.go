@@ -0,0 +1,162 @@
+package transport
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// ReplicasHeader reports number of backends having object out of asked ones
+const ReplicasHeader = "X-Akubra-Replicas"
+
+func notFoundResponse(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:     "404 Not Found",
+		StatusCode: http.StatusNotFound,
+		Proto:      req.Proto,
+		ProtoMajor: req.ProtoMajor,
+		ProtoMinor: req.ProtoMinor,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}
+}
+
+// metadataPrefix starts names of user metadata headers
+const metadataPrefix = "X-Amz-Meta-"
+
+// metadataSignature joins user metadata headers sorted by name
+func metadataSignature(header http.Header) string {
+	names := make([]string, 0)
+	for name := range header {
+		if strings.HasPrefix(name, metadataPrefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	entries := make([]string, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, name+":"+strings.Join(header[name], ","))
+	}
+	return strings.Join(entries, "\n")
+}
+
+// orderByMetadata puts responses with user metadata reported by most
+// backends first, so client gets metadata of majority. Divergent metadata is
+// logged and counted
+func orderByMetadata(found []ReqResErrTuple) []ReqResErrTuple {
+	groups := make(map[string][]ReqResErrTuple)
+	signatures := make([]string, 0)
+	for _, resTup := range found {
+		signature := metadataSignature(resTup.Res.Header)
+		if _, ok := groups[signature]; !ok {
+			signatures = append(signatures, signature)
+		}
+		groups[signature] = append(groups[signature], resTup)
+	}
+	if len(groups) < 2 {
+		return found
+	}
+	// stable sort keeps first responding backends first among equal groups
+	sort.SliceStable(signatures, func(i, j int) bool {
+		return len(groups[signatures[i]]) > len(groups[signatures[j]])
+	})
+	ordered := make([]ReqResErrTuple, 0, len(found))
+	divergent := make([]string, 0, len(found))
+	for i, signature := range signatures {
+		ordered = append(ordered, groups[signature]...)
+		if i > 0 {
+			for _, resTup := range groups[signature] {
+				divergent = append(divergent, resTup.Req.URL.Host)
+			}
+		}
+	}
+	sample := found[0].Req
+	reqID, _ := sample.Context().Value(log.ContextreqIDKey).(string)
+	log.Printf("Object %s metadata differs on backends %s from %d other backends, request %s",
+		sample.URL.Path, strings.Join(divergent, ", "), len(groups[signatures[0]]), reqID)
+	metrics.Mark("reqs.global.head_quorum.metadata_divergent")
+	return ordered
+}
+
+// IsBucketHead tells if request checks bucket existence (HEAD /bucket)
+func IsBucketHead(req *http.Request) bool {
+	bucket := strings.Trim(req.URL.Path, "/")
+	return req.Method == http.MethodHead && bucket != "" && !strings.Contains(bucket, "/") && req.URL.RawQuery == ""
+}
+
+// headQuorumGate waits for HEAD responses of all backends and passes found
+// object only if HeadQuorum backends have it
+func (mt *MultiTransport) headQuorumGate(in <-chan ReqResErrTuple) <-chan ReqResErrTuple {
+	return mt.existenceQuorumGate(in, mt.HeadQuorum.Quorum, "Object", "head_quorum", mt.HeadQuorum.VerifyMetadata)
+}
+
+// headBucketQuorumGate waits for HEAD bucket responses of all backends and
+// passes found bucket only if HeadQuorum.BucketQuorum backends have it
+func (mt *MultiTransport) headBucketQuorumGate(in <-chan ReqResErrTuple) <-chan ReqResErrTuple {
+	return mt.existenceQuorumGate(in, mt.HeadQuorum.BucketQuorum, "Bucket", "head_bucket_quorum", false)
+}
+
+// existenceQuorumGate passes found resource only if quorum backends have it.
+// Otherwise not found response is passed first and successful ones are
+// dropped. If no backend responded either way, responses are passed unchanged
+func (mt *MultiTransport) existenceQuorumGate(in <-chan ReqResErrTuple, quorum int, resource, metric string,
+	verifyMetadata bool) <-chan ReqResErrTuple {
+	var found, missing, others []ReqResErrTuple
+	for resTup := range in {
+		switch {
+		case resTup.Err == nil && !resTup.Failed:
+			found = append(found, resTup)
+		case resTup.Res != nil && resTup.Res.StatusCode == http.StatusNotFound:
+			missing = append(missing, resTup)
+		default:
+			others = append(others, resTup)
+		}
+	}
+	total := len(found) + len(missing) + len(others)
+	if quorum > total {
+		quorum = total
+	}
+	ordered := make([]ReqResErrTuple, 0, total)
+	switch {
+	case len(found) >= quorum || len(found)+len(missing) == 0:
+		if verifyMetadata {
+			found = orderByMetadata(found)
+		}
+		ordered = append(append(append(ordered, found...), missing...), others...)
+	default:
+		sample := append(append([]ReqResErrTuple{}, missing...), found...)[0].Req
+		reqID, _ := sample.Context().Value(log.ContextreqIDKey).(string)
+		log.Printf("%s %s found on %d of %d backends, quorum is %d, request %s",
+			resource, sample.URL.Path, len(found), total, quorum, reqID)
+		metrics.Mark("reqs.global." + metric + ".unconfirmed")
+		if len(missing) == 0 {
+			missing = []ReqResErrTuple{{sample, notFoundResponse(sample), nil, true}}
+		}
+		for _, resTup := range found {
+			if closeErr := resTup.Res.Body.Close(); closeErr != nil {
+				log.Debugf("Cannot close HEAD response body: %s", closeErr)
+			}
+		}
+		ordered = append(append(ordered, missing...), others...)
+	}
+	if mt.HeadQuorum.ReportReplicas && len(found) != total {
+		replicas := fmt.Sprintf("%d/%d", len(found), total)
+		for _, resTup := range ordered {
+			if resTup.Res != nil {
+				resTup.Res.Header.Set(ReplicasHeader, replicas)
+			}
+		}
+	}
+	out := make(chan ReqResErrTuple, len(ordered))
+	for _, resTup := range ordered {
+		out <- resTup
+	}
+	close(out)
+	return out
+}
@@ -0,0 +1,33 @@
+package transport
+
+import (
+	"net/http"
+	"strings"
+)
+
+// listingParams are query parameters of ListObjects (V1) request
+var listingParams = map[string]bool{
+	"prefix":        true,
+	"delimiter":     true,
+	"marker":        true,
+	"max-keys":      true,
+	"encoding-type": true,
+}
+
+// IsBucketListing tells if request lists objects of path-style addressed
+// bucket with ListObjects (V1) API
+func IsBucketListing(req *http.Request) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+	bucket := strings.Trim(req.URL.Path, "/")
+	if bucket == "" || strings.Contains(bucket, "/") {
+		return false
+	}
+	for param := range req.URL.Query() {
+		if !listingParams[param] {
+			return false
+		}
+	}
+	return true
+}
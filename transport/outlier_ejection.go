@@ -0,0 +1,106 @@
+package transport
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+)
+
+// maxEjectionMultiplier limits how many times EjectionDuration may grow
+const maxEjectionMultiplier = 10
+
+type backendOutlierStats struct {
+	consecutiveErrors int
+	ejections         int
+	ejectedUntil      time.Time
+}
+
+// outlierDetector tracks backends failures and ejects backends failing
+// repeatedly from reads. Once ejection time passes, backend gets growing
+// share of reads during next EjectionDuration. Nil detector ejects nothing
+type outlierDetector struct {
+	conf   shardingconfig.OutlierEjectionConfig
+	random func() float64
+	mx     sync.Mutex
+	stats  map[string]*backendOutlierStats
+}
+
+func newOutlierDetector(conf shardingconfig.OutlierEjectionConfig) *outlierDetector {
+	if conf.ConsecutiveErrors <= 0 || conf.EjectionDuration.Duration <= 0 {
+		return nil
+	}
+	return &outlierDetector{
+		conf:   conf,
+		random: rand.Float64,
+		stats:  make(map[string]*backendOutlierStats),
+	}
+}
+
+func (od *outlierDetector) backendStats(host string) *backendOutlierStats {
+	stats, ok := od.stats[host]
+	if !ok {
+		stats = &backendOutlierStats{}
+		od.stats[host] = stats
+	}
+	return stats
+}
+
+// record registers request result of backend
+func (od *outlierDetector) record(host string, failed bool, duration time.Duration) {
+	if od == nil {
+		return
+	}
+	if od.conf.LatencyThreshold.Duration > 0 && duration > od.conf.LatencyThreshold.Duration {
+		failed = true
+	}
+	moment := now()
+	od.mx.Lock()
+	defer od.mx.Unlock()
+	stats := od.backendStats(host)
+	if !failed {
+		stats.consecutiveErrors = 0
+		if stats.ejections > 0 && moment.After(stats.ejectedUntil.Add(od.conf.EjectionDuration.Duration)) {
+			stats.ejections = 0
+		}
+		return
+	}
+	stats.consecutiveErrors++
+	if stats.consecutiveErrors < od.conf.ConsecutiveErrors || moment.Before(stats.ejectedUntil) {
+		return
+	}
+	if stats.ejections < maxEjectionMultiplier {
+		stats.ejections++
+	}
+	stats.consecutiveErrors = 0
+	ejectionTime := od.conf.EjectionDuration.Duration * time.Duration(stats.ejections)
+	stats.ejectedUntil = moment.Add(ejectionTime)
+	metrics.Mark("reqs.backend." + metrics.Clean(host) + ".ejected")
+	log.Printf("Backend %s ejected from reads for %s", host, ejectionTime)
+}
+
+// isEjected checks if backend should be skipped by read
+func (od *outlierDetector) isEjected(host string) bool {
+	if od == nil {
+		return false
+	}
+	moment := now()
+	od.mx.Lock()
+	defer od.mx.Unlock()
+	stats, ok := od.stats[host]
+	if !ok || stats.ejectedUntil.IsZero() {
+		return false
+	}
+	if moment.Before(stats.ejectedUntil) {
+		return true
+	}
+	recovery := od.conf.EjectionDuration.Duration
+	elapsed := moment.Sub(stats.ejectedUntil)
+	if elapsed >= recovery {
+		return false
+	}
+	return od.random() >= float64(elapsed)/float64(recovery)
+}
@@ -0,0 +1,148 @@
+package transport
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+var preconditionHeaders = []string{
+	"If-Match",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Unmodified-Since",
+}
+
+func hasPreconditions(req *http.Request) bool {
+	for _, header := range preconditionHeaders {
+		if req.Header.Get(header) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// backendState identifies object state reported by backend
+type backendState struct {
+	statusCode int
+	etag       string
+}
+
+func stateOf(resTup ReqResErrTuple) backendState {
+	if resTup.Res == nil {
+		return backendState{}
+	}
+	return backendState{resTup.Res.StatusCode, resTup.Res.Header.Get("ETag")}
+}
+
+func lastModified(resTup ReqResErrTuple) time.Time {
+	if resTup.Res == nil {
+		return time.Time{}
+	}
+	modified, err := http.ParseTime(resTup.Res.Header.Get("Last-Modified"))
+	if err != nil {
+		return time.Time{}
+	}
+	return modified
+}
+
+// agreedState picks state reported by most backends, ties are resolved in
+// favour of most recently modified state. Transmission errors are chosen only
+// if no backend responded
+func agreedState(tups []ReqResErrTuple) backendState {
+	counts := make(map[backendState]int)
+	newest := make(map[backendState]time.Time)
+	var order []backendState
+	for _, resTup := range tups {
+		state := stateOf(resTup)
+		if _, seen := counts[state]; !seen {
+			order = append(order, state)
+		}
+		counts[state]++
+		if modified := lastModified(resTup); modified.After(newest[state]) {
+			newest[state] = modified
+		}
+	}
+	var agreed backendState
+	for _, state := range order {
+		if agreed == (backendState{}) {
+			agreed = state
+			continue
+		}
+		if state == (backendState{}) {
+			continue
+		}
+		if counts[state] > counts[agreed] ||
+			counts[state] == counts[agreed] && newest[state].After(newest[agreed]) {
+			agreed = state
+		}
+	}
+	return agreed
+}
+
+// ReplicaVersion is object version reported by single backend
+type ReplicaVersion struct {
+	Request      *http.Request
+	ETag         string
+	LastModified time.Time
+}
+
+// Reconciler repairs replicas holding object version different from
+// authoritative one
+type Reconciler interface {
+	Reconcile(versions []ReplicaVersion)
+}
+
+// divergentVersions returns versions reported by backends if they differ in
+// ETag, nil otherwise
+func divergentVersions(tups []ReqResErrTuple) []ReplicaVersion {
+	var versions []ReplicaVersion
+	etags := make(map[string]bool)
+	for _, resTup := range tups {
+		etag := stateOf(resTup).etag
+		if etag == "" || resTup.Res.StatusCode >= http.StatusInternalServerError {
+			continue
+		}
+		etags[etag] = true
+		versions = append(versions, ReplicaVersion{resTup.Req, etag, lastModified(resTup)})
+	}
+	if len(etags) < 2 {
+		return nil
+	}
+	return versions
+}
+
+// preconditionGate waits for all responses of conditional request and passes
+// state agreed by backends majority first. Responses differing from agreed
+// state are marked as failed, so the agreed one is returned to client
+func (mt *MultiTransport) preconditionGate(in <-chan ReqResErrTuple) <-chan ReqResErrTuple {
+	var tups []ReqResErrTuple
+	for resTup := range in {
+		tups = append(tups, resTup)
+	}
+	out := make(chan ReqResErrTuple, len(tups))
+	agreed := agreedState(tups)
+	if versions := divergentVersions(tups); versions != nil && mt.Reconciler != nil {
+		go mt.Reconciler.Reconcile(versions)
+	}
+	var outliers []ReqResErrTuple
+	for _, resTup := range tups {
+		if stateOf(resTup) == agreed {
+			out <- resTup
+			continue
+		}
+		outliers = append(outliers, resTup)
+	}
+	for _, resTup := range outliers {
+		reqID, _ := resTup.Req.Context().Value(log.ContextreqIDKey).(string)
+		log.Printf("Backend %s disagrees on precondition state for request %s, got %v, agreed %v",
+			resTup.Req.URL.Host, reqID, stateOf(resTup), agreed)
+		metrics.Mark("reqs.global.preconditions.divergent")
+		resTup.Failed = true
+		out <- resTup
+	}
+	close(out)
+	return out
+}
@@ -0,0 +1,39 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/allegro/akubra/log"
+)
+
+// PriorityHeader set to PriorityLow by client marks its request as low
+// priority background traffic
+const PriorityHeader = "X-Akubra-Priority"
+
+// PriorityLow is PriorityHeader value of low priority requests
+const PriorityLow = "low"
+
+// ContextPriorityKey is Request Context Value key of request priority
+const ContextPriorityKey = log.ContextKey("ContextPriorityKey")
+
+// ErrBackendConnLimited is returned for low priority backend requests shed
+// because backend connection limit is under pressure, they are not sent
+var ErrBackendConnLimited = errors.New("backend connection limit reached, low priority request shed")
+
+// WithLowPriority marks requests with ctx as low priority, used by akubra's
+// own background traffic
+func WithLowPriority(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ContextPriorityKey, PriorityLow)
+}
+
+// IsLowPriority tells if request is marked as low priority by its context
+// or PriorityHeader
+func IsLowPriority(req *http.Request) bool {
+	if priority, ok := req.Context().Value(ContextPriorityKey).(string); ok && priority == PriorityLow {
+		return true
+	}
+	return strings.EqualFold(req.Header.Get(PriorityHeader), PriorityLow)
+}
@@ -0,0 +1,88 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+)
+
+// isTimeout checks if backend request failed on timeout, e.g. while dialing
+// or awaiting response headers
+func isTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == context.DeadlineExceeded || err == ErrTimeout {
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+type backendTimeouts struct {
+	consecutive      int
+	quarantinedUntil time.Time
+}
+
+// timeoutQuarantine removes backends timing out repeatedly from reads for
+// QuarantineConfig.Duration. Unlike outlierDetector it ignores errors and
+// 5xx responses, so slow backends are quarantined even if they never fail.
+// Nil quarantine excludes nothing
+type timeoutQuarantine struct {
+	conf     shardingconfig.QuarantineConfig
+	mx       sync.Mutex
+	timeouts map[string]*backendTimeouts
+}
+
+func newTimeoutQuarantine(conf shardingconfig.QuarantineConfig) *timeoutQuarantine {
+	if conf.TimeoutThreshold <= 0 || conf.Duration.Duration <= 0 {
+		return nil
+	}
+	return &timeoutQuarantine{conf: conf, timeouts: make(map[string]*backendTimeouts)}
+}
+
+// record registers request result of backend, any response or not timeout
+// error resets timeouts count
+func (tq *timeoutQuarantine) record(host string, err error) {
+	if tq == nil {
+		return
+	}
+	moment := now()
+	tq.mx.Lock()
+	defer tq.mx.Unlock()
+	stats, ok := tq.timeouts[host]
+	if !ok {
+		stats = &backendTimeouts{}
+		tq.timeouts[host] = stats
+	}
+	if !isTimeout(err) {
+		stats.consecutive = 0
+		return
+	}
+	stats.consecutive++
+	if stats.consecutive < tq.conf.TimeoutThreshold || moment.Before(stats.quarantinedUntil) {
+		return
+	}
+	stats.consecutive = 0
+	stats.quarantinedUntil = moment.Add(tq.conf.Duration.Duration)
+	metrics.Mark("reqs.backend." + metrics.Clean(host) + ".quarantined")
+	log.Printf("Backend %s quarantined for %s after %d timeouts", host, tq.conf.Duration.Duration,
+		tq.conf.TimeoutThreshold)
+}
+
+// isQuarantined checks if backend should be skipped by read
+func (tq *timeoutQuarantine) isQuarantined(host string) bool {
+	if tq == nil {
+		return false
+	}
+	moment := now()
+	tq.mx.Lock()
+	defer tq.mx.Unlock()
+	stats, ok := tq.timeouts[host]
+	return ok && moment.Before(stats.quarantinedUntil)
+}
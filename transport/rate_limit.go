@@ -0,0 +1,112 @@
+package transport
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/metrics"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+)
+
+// ErrBackendRateLimited is returned for backend requests exceeding backend
+// rate limit, they are not sent
+var ErrBackendRateLimited = errors.New("backend rate limit exceeded")
+
+// tokenBucket allows rate requests per second on average and burst requests
+// at once
+type tokenBucket struct {
+	mx     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+func newTokenBucket(conf shardingconfig.RateLimitConfig) *tokenBucket {
+	burst := float64(conf.Burst)
+	if burst < 1 {
+		burst = math.Max(1, math.Ceil(conf.RequestsPerSecond))
+	}
+	return &tokenBucket{rate: conf.RequestsPerSecond, burst: burst, tokens: burst, last: time.Now(), now: time.Now}
+}
+
+func (tb *tokenBucket) refill() {
+	now := tb.now()
+	tb.tokens = math.Min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+}
+
+// take consumes token if one is available
+func (tb *tokenBucket) take() bool {
+	tb.mx.Lock()
+	defer tb.mx.Unlock()
+	tb.refill()
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+func (tb *tokenBucket) available() bool {
+	tb.mx.Lock()
+	defer tb.mx.Unlock()
+	tb.refill()
+	return tb.tokens >= 1
+}
+
+// backendRateLimits holds token bucket of every rate limited backend host
+type backendRateLimits map[string]*tokenBucket
+
+func newBackendRateLimits(conf map[string]shardingconfig.RateLimitConfig) backendRateLimits {
+	if len(conf) == 0 {
+		return nil
+	}
+	limits := make(backendRateLimits, len(conf))
+	for host, limit := range conf {
+		limits[host] = newTokenBucket(limit)
+	}
+	return limits
+}
+
+func (rl backendRateLimits) take(host string) bool {
+	bucket, ok := rl[host]
+	return !ok || bucket.take()
+}
+
+// available tells if backend can take request now, without consuming token
+func (rl backendRateLimits) available(host string) bool {
+	bucket, ok := rl[host]
+	return !ok || bucket.available()
+}
+
+// sendToBackend sends request unless rate limit of its backend is exceeded
+// or write is skipped by capacity weights, with adaptive throttling request
+// waits for free slot of backend
+func (mt *MultiTransport) sendToBackend(req *http.Request) (*http.Response, error) {
+	if !mt.rateLimits.take(req.URL.Host) {
+		metrics.Mark("reqs.backend." + metrics.Clean(req.URL.Host) + ".rate_limited")
+		return nil, ErrBackendRateLimited
+	}
+	if !mt.capacity.admits(req) {
+		metrics.Mark("reqs.backend." + metrics.Clean(req.URL.Host) + ".capacity_skipped")
+		return nil, ErrBackendNearlyFull
+	}
+	return mt.throttling.roundTrip(mt.RoundTripper, req)
+}
+
+// recordResult reports backend response to outlier detector, quarantine and
+// capacity weights, requests rejected by rate limit, skipped by capacity
+// weights or shed by connection limit are not backend failures
+func (mt *MultiTransport) recordResult(host string, resp *http.Response, err error, errorBody bool, since time.Time) {
+	if err == ErrBackendRateLimited || err == ErrBackendNearlyFull || err == ErrBackendConnLimited {
+		return
+	}
+	mt.capacity.record(host, resp)
+	mt.outliers.record(host, errorBody || err != nil || resp != nil && resp.StatusCode >= 500, time.Since(since))
+	mt.quarantine.record(host, err)
+}
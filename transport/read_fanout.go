@@ -0,0 +1,113 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/allegro/akubra/metrics"
+)
+
+// cancelOnCloseBody releases request context once response body is closed
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (cb *cancelOnCloseBody) Close() error {
+	err := cb.ReadCloser.Close()
+	cb.cancel()
+	return err
+}
+
+type fanoutResult struct {
+	ReqResErrTuple
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+// sendFastest sends read to at most ReadFanout backends at once and returns
+// first successful response. Requests to other backends are cancelled. If
+// all backends failed, first response (or error if none came) is returned
+func (mt *MultiTransport) sendFastest(req *http.Request, reqs []*http.Request) (*http.Response, error) {
+	if len(reqs) > mt.ReadFanout {
+		reqs = reqs[:mt.ReadFanout]
+	}
+	results := make(chan fanoutResult, len(reqs))
+	cancels := make(map[*http.Request]context.CancelFunc, len(reqs))
+	for _, backendReq := range reqs {
+		ctx, cancel := context.WithCancel(withServerTiming(backendReq.Context(), req.Context()))
+		cancels[backendReq] = cancel
+		go func(backendReq *http.Request, ctx context.Context, cancel context.CancelFunc) {
+			since := time.Now()
+			resp, err := mt.sendToBackend(backendReq.WithContext(ctx))
+			errorBody := mt.errorBodies.failed(resp)
+			// cancelled losers are not backend failures
+			if ctx.Err() == nil {
+				mt.recordResult(backendReq.URL.Host, resp, err, errorBody, since)
+			}
+			failed := errorBody || err != nil || resp != nil && (resp.StatusCode < 200 || resp.StatusCode > 399)
+			resTup := ReqResErrTuple{backendReq, resp, err, failed}
+			collectMetrics(backendReq, resTup, since)
+			results <- fanoutResult{resTup, cancel, ctx.Err() != nil}
+		}(backendReq, ctx, cancel)
+	}
+
+	var fallback *fanoutResult
+	for received := 0; received < len(reqs); received++ {
+		result := <-results
+		if result.Failed {
+			if fallback == nil || fallback.Res == nil && result.Res != nil {
+				fallback.discard()
+				fallback = &result
+				continue
+			}
+			result.discard()
+			continue
+		}
+		for backendReq, cancel := range cancels {
+			if backendReq != result.Req {
+				cancel()
+			}
+		}
+		fallback.discard()
+		go discardLosers(results, len(reqs)-received-1)
+		return result.respond()
+	}
+	return fallback.respond()
+}
+
+// respond returns response which releases request context once read
+func (fr *fanoutResult) respond() (*http.Response, error) {
+	if fr.Res == nil || fr.Res.Body == nil {
+		fr.cancel()
+		return fr.Res, fr.Err
+	}
+	fr.Res.Body = &cancelOnCloseBody{ReadCloser: fr.Res.Body, cancel: fr.cancel}
+	return fr.Res, fr.Err
+}
+
+// discard closes response of request which lost the race
+func (fr *fanoutResult) discard() {
+	if fr == nil {
+		return
+	}
+	metrics.Mark("reqs.global.read_fanout.wasted")
+	// body is not drained, cancelling stops its transfer
+	fr.cancel()
+	if fr.Res != nil && fr.Res.Body != nil {
+		_ = fr.Res.Body.Close()
+	}
+}
+
+// discardLosers waits for cancelled requests and closes their responses
+func discardLosers(results <-chan fanoutResult, pending int) {
+	for i := 0; i < pending; i++ {
+		result := <-results
+		if result.cancelled {
+			metrics.Mark("reqs.global.read_fanout.cancelled")
+		}
+		result.discard()
+	}
+}
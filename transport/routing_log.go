@@ -0,0 +1,80 @@
+package transport
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/allegro/akubra/log"
+)
+
+// RoutingLogMessage describes backend selection made for client request
+type RoutingLogMessage struct {
+	Time   string `json:"ts"`
+	ReqID  string `json:"reqID"`
+	Method string `json:"method"`
+	Host   string `json:"host"`
+	Path   string `json:"path"`
+	// Mode tells how chosen backends are asked, e.g. all at once
+	Mode string `json:"mode"`
+	// Candidates are all backends of request
+	Candidates []string `json:"candidates"`
+	// Chosen are backends request may be sent to, in order they are tried
+	Chosen []string `json:"chosen"`
+}
+
+// ContextRoutingDecisionKey is Request Context Value key for RoutingDecision
+const ContextRoutingDecisionKey = log.ContextKey("ContextRoutingDecisionKey")
+
+// RoutingDecision describes why request was directed to given backends.
+// It's passed by pointer in request context and filled while routing
+type RoutingDecision struct {
+	// Strategy name used for cluster selection
+	Strategy string
+	// Retry is true if request was retried on other cluster or backend
+	Retry bool
+	// Hedge is true if read was sent to several backends at once and the
+	// fastest response was passed (ReadFanout)
+	Hedge bool
+	// Canary is true if client enabled features with FeatureHeader
+	Canary bool
+	// Candidates is size of set clusters were selected from
+	Candidates int
+}
+
+// RoutingDecisionFromContext returns RoutingDecision attached to request
+// context or nil if there is none
+func RoutingDecisionFromContext(req *http.Request) *RoutingDecision {
+	decision, _ := req.Context().Value(ContextRoutingDecisionKey).(*RoutingDecision)
+	return decision
+}
+
+func backendHosts(reqs []*http.Request) []string {
+	hosts := make([]string, 0, len(reqs))
+	for _, req := range reqs {
+		hosts = append(hosts, req.URL.Host)
+	}
+	return hosts
+}
+
+// logRouting writes backend selection to RoutingLog, if it's set
+func (mt *MultiTransport) logRouting(req *http.Request, mode string, candidates, chosen []*http.Request) {
+	if mt.RoutingLog == nil {
+		return
+	}
+	reqID, _ := req.Context().Value(log.ContextreqIDKey).(string)
+	logMsg, err := json.Marshal(RoutingLogMessage{
+		Time:       time.Now().Format(time.RFC3339Nano),
+		ReqID:      reqID,
+		Method:     req.Method,
+		Host:       req.Host,
+		Path:       req.URL.Path,
+		Mode:       mode,
+		Candidates: backendHosts(candidates),
+		Chosen:     backendHosts(chosen),
+	})
+	if err != nil {
+		return
+	}
+	mt.RoutingLog.Println(string(logMsg))
+}
@@ -0,0 +1,135 @@
+package transport
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/metrics"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+)
+
+const (
+	// DefaultSessionAffinityTTL is how long session sticks to backend if
+	// TTL is not set
+	DefaultSessionAffinityTTL = 10 * time.Minute
+	// DefaultMaxSessions limits number of remembered sessions if
+	// MaxSessions is not set
+	DefaultMaxSessions = 100000
+)
+
+type affineBackend struct {
+	host    string
+	expires time.Time
+}
+
+// sessionAffinity sends reads of client session, identified by header or
+// cookie, to the same backend for TTL since last read. Nil affinity sticks
+// nothing
+type sessionAffinity struct {
+	header   string
+	cookie   string
+	ttl      time.Duration
+	max      int
+	mx       sync.Mutex
+	sessions map[string]affineBackend
+	now      func() time.Time
+}
+
+func newSessionAffinity(conf shardingconfig.SessionAffinityConfig) *sessionAffinity {
+	if conf.Header == "" && conf.Cookie == "" {
+		return nil
+	}
+	ttl := conf.TTL.Duration
+	if ttl <= 0 {
+		ttl = DefaultSessionAffinityTTL
+	}
+	max := conf.MaxSessions
+	if max == 0 {
+		max = DefaultMaxSessions
+	}
+	return &sessionAffinity{
+		header:   conf.Header,
+		cookie:   conf.Cookie,
+		ttl:      ttl,
+		max:      max,
+		sessions: make(map[string]affineBackend),
+		now:      time.Now,
+	}
+}
+
+// session identifies client session of request, header takes precedence
+// over cookie
+func (sa *sessionAffinity) session(req *http.Request) string {
+	if sa.header != "" {
+		if session := req.Header.Get(sa.header); session != "" {
+			return session
+		}
+	}
+	if sa.cookie != "" {
+		if cookie, err := req.Cookie(sa.cookie); err == nil {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// order puts request to backend of read session first, other backends
+// follow as fallback. Session of unavailable backend is moved to another
+// one, picked by session hash. It's false for reads without session or
+// with FeatureNoSessionAffinity
+func (sa *sessionAffinity) order(req *http.Request, reqs []*http.Request) ([]*http.Request, bool) {
+	if sa == nil || FeatureEnabled(req, FeatureNoSessionAffinity) {
+		return reqs, false
+	}
+	session := sa.session(req)
+	if session == "" {
+		return reqs, false
+	}
+	sa.mx.Lock()
+	defer sa.mx.Unlock()
+	now := sa.now()
+	chosen := -1
+	if affine, ok := sa.sessions[session]; ok && now.Before(affine.expires) {
+		for i, backendReq := range reqs {
+			if backendReq.URL.Host == affine.host {
+				chosen = i
+				break
+			}
+		}
+		if chosen < 0 {
+			metrics.Mark("reqs.global.session_affinity.moved")
+		}
+	}
+	if chosen < 0 {
+		hash := fnv.New32a()
+		_, _ = hash.Write([]byte(session))
+		chosen = int(hash.Sum32() % uint32(len(reqs)))
+		sa.evictExpired(now)
+	}
+	sa.sessions[session] = affineBackend{host: reqs[chosen].URL.Host, expires: now.Add(sa.ttl)}
+	ordered := make([]*http.Request, 0, len(reqs))
+	ordered = append(ordered, reqs[chosen])
+	ordered = append(ordered, reqs[:chosen]...)
+	return append(ordered, reqs[chosen+1:]...), true
+}
+
+// evictExpired drops expired sessions once there are too many of them, if
+// all of them are live arbitrary ones are dropped
+func (sa *sessionAffinity) evictExpired(now time.Time) {
+	if len(sa.sessions) < sa.max {
+		return
+	}
+	for session, affine := range sa.sessions {
+		if !now.Before(affine.expires) {
+			delete(sa.sessions, session)
+		}
+	}
+	for session := range sa.sessions {
+		if len(sa.sessions) < sa.max {
+			break
+		}
+		delete(sa.sessions, session)
+	}
+}
@@ -0,0 +1,150 @@
+package transport
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/metrics"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/stretchr/testify/require"
+)
+
+// hitCounter counts reads served by backends, failing ones respond 500
+type hitCounter struct {
+	mx      sync.Mutex
+	hits    map[string]int
+	failing map[string]bool
+}
+
+func (hc *hitCounter) server() url.URL {
+	var host string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hc.mx.Lock()
+		defer hc.mx.Unlock()
+		hc.hits[host]++
+		if hc.failing[host] {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	tsURL, _ := url.Parse(ts.URL)
+	host = tsURL.Host
+	return *tsURL
+}
+
+func (hc *hitCounter) reset() map[string]int {
+	hc.mx.Lock()
+	defer hc.mx.Unlock()
+	hits := hc.hits
+	hc.hits = make(map[string]int)
+	return hits
+}
+
+func (hc *hitCounter) fail(host string) {
+	hc.mx.Lock()
+	defer hc.mx.Unlock()
+	hc.failing[host] = true
+}
+
+func mkAffinityTransport(conf shardingconfig.SessionAffinityConfig, options MultiTransportOptions) (*MultiTransport, *hitCounter) {
+	counter := &hitCounter{hits: make(map[string]int), failing: make(map[string]bool)}
+	urls := []url.URL{counter.server(), counter.server(), counter.server()}
+	options.SessionAffinity = conf
+	return NewMultiTransport(http.DefaultTransport, urls, nil, options), counter
+}
+
+func sessionGet(t *testing.T, transp http.RoundTripper, header, cookie string) {
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/bucket/key", nil)
+	if header != "" {
+		req.Header.Set("X-Client-Id", header)
+	}
+	if cookie != "" {
+		req.AddCookie(&http.Cookie{Name: "session", Value: cookie})
+	}
+	resp, err := transp.RoundTrip(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+}
+
+func singleHost(t *testing.T, hits map[string]int, count int) string {
+	require.Len(t, hits, 1, "reads of session should hit one backend")
+	for host, hostHits := range hits {
+		require.Equal(t, count, hostHits)
+		return host
+	}
+	return ""
+}
+
+func TestSessionAffinitySendsReadsOfSessionToSameBackend(t *testing.T) {
+	transp, counter := mkAffinityTransport(shardingconfig.SessionAffinityConfig{Header: "X-Client-Id", Cookie: "session"},
+		MultiTransportOptions{})
+	seen := make(map[string]bool)
+	for _, session := range []string{"client-1", "client-2", "client-3", "client-4", "client-5", "client-6"} {
+		for i := 0; i < 5; i++ {
+			sessionGet(t, transp, session, "")
+		}
+		seen[singleHost(t, counter.reset(), 5)] = true
+
+		for i := 0; i < 3; i++ {
+			sessionGet(t, transp, "", session)
+		}
+		singleHost(t, counter.reset(), 3)
+	}
+	require.True(t, len(seen) > 1, "sessions should be spread over backends")
+
+	// reads without session go to all backends
+	sessionGet(t, transp, "", "")
+	time.Sleep(50 * time.Millisecond)
+	require.Len(t, counter.reset(), 3)
+}
+
+func TestSessionAffinityMovesSessionOffUnhealthyBackend(t *testing.T) {
+	transp, counter := mkAffinityTransport(shardingconfig.SessionAffinityConfig{Header: "X-Client-Id"},
+		MultiTransportOptions{OutlierEjection: shardingconfig.OutlierEjectionConfig{
+			ConsecutiveErrors: 1, EjectionDuration: metrics.Interval{Duration: time.Minute}}})
+	sessionGet(t, transp, "client-1", "")
+	affine := singleHost(t, counter.reset(), 1)
+
+	// failed read falls back to other backend and ejects affine one
+	counter.fail(affine)
+	sessionGet(t, transp, "client-1", "")
+	hits := counter.reset()
+	require.Len(t, hits, 2)
+	require.Equal(t, 1, hits[affine])
+
+	for i := 0; i < 4; i++ {
+		sessionGet(t, transp, "client-1", "")
+	}
+	moved := singleHost(t, counter.reset(), 4)
+	require.NotEqual(t, affine, moved)
+}
+
+func TestSessionAffinityExpiresSessions(t *testing.T) {
+	affinity := newSessionAffinity(shardingconfig.SessionAffinityConfig{Header: "X-Client-Id",
+		TTL: metrics.Interval{Duration: time.Minute}, MaxSessions: 2})
+	moment := time.Now()
+	affinity.now = func() time.Time { return moment }
+	reqs := make([]*http.Request, 0, 3)
+	for _, host := range []string{"backend1:80", "backend2:80", "backend3:80"} {
+		backendReq, _ := http.NewRequest(http.MethodGet, "http://"+host+"/bucket/key", nil)
+		reqs = append(reqs, backendReq)
+	}
+	read := func(session string) {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/bucket/key", nil)
+		req.Header.Set("X-Client-Id", session)
+		_, ok := affinity.order(req, reqs)
+		require.True(t, ok)
+	}
+	read("client-1")
+	read("client-2")
+	require.Len(t, affinity.sessions, 2)
+
+	moment = moment.Add(2 * time.Minute)
+	read("client-3")
+	require.Len(t, affinity.sessions, 1, "expired sessions should be evicted")
+	_, ok := affinity.order(httptest.NewRequest(http.MethodGet, "/bucket/key", nil), reqs)
+	require.False(t, ok)
+}
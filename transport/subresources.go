@@ -0,0 +1,109 @@
+package transport
+
+import "net/http"
+
+// VersionIDHeader carries version ID of written object in backend response
+const VersionIDHeader = "X-Amz-Version-Id"
+
+// authoritativeSubresources are ACL and policy subresources of buckets and
+// objects, they are kept on AuthoritativeBackend only
+var authoritativeSubresources = []string{"acl", "policy"}
+
+// IsAuthoritativeSubresource tells if request reads or writes ACL or policy
+// subresource
+func IsAuthoritativeSubresource(req *http.Request) bool {
+	query := req.URL.Query()
+	for _, subresource := range authoritativeSubresources {
+		if _, ok := query[subresource]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// IsVersionedRequest tells if request addresses object version, lists
+// object versions or reads bucket versioning configuration. Version IDs
+// are assigned by every backend independently, so such requests are
+// answered by AuthoritativeBackend only. Versioning configuration writes are
+// replicated, so every backend keeps versions
+func IsVersionedRequest(req *http.Request) bool {
+	query := req.URL.Query()
+	if _, ok := query["versionId"]; ok {
+		return true
+	}
+	if _, ok := query["versions"]; ok {
+		return true
+	}
+	_, ok := query["versioning"]
+	return ok && isIdempotentRead(req.Method)
+}
+
+// authoritativeRequest picks request to AuthoritativeBackend if req is
+// subresource or versioned request kept there, it's nil otherwise or if
+// backend is not among reqs
+func (mt *MultiTransport) authoritativeRequest(req *http.Request, reqs []*http.Request) *http.Request {
+	if mt.AuthoritativeBackend == "" || !IsAuthoritativeSubresource(req) && !IsVersionedRequest(req) {
+		return nil
+	}
+	return mt.requestToAuthoritative(reqs)
+}
+
+func (mt *MultiTransport) requestToAuthoritative(reqs []*http.Request) *http.Request {
+	for _, backendReq := range reqs {
+		if backendReq.URL.Host == mt.AuthoritativeBackend {
+			return backendReq
+		}
+	}
+	return nil
+}
+
+func setVersionID(resTup ReqResErrTuple, versionID string) {
+	if resTup.Res == nil {
+		return
+	}
+	if versionID == "" {
+		resTup.Res.Header.Del(VersionIDHeader)
+		return
+	}
+	resTup.Res.Header.Set(VersionIDHeader, versionID)
+}
+
+// versionIDGate makes write responses of all backends report version ID
+// assigned by AuthoritativeBackend, as versioned requests are routed there.
+// Successful responses are held until its response comes in
+func (mt *MultiTransport) versionIDGate(in <-chan ReqResErrTuple, reqs []*http.Request) <-chan ReqResErrTuple {
+	if mt.AuthoritativeBackend == "" || mt.requestToAuthoritative(reqs) == nil {
+		return in
+	}
+	out := make(chan ReqResErrTuple, len(reqs))
+	go func() {
+		defer close(out)
+		var held []ReqResErrTuple
+		resolved := false
+		versionID := ""
+		for resTup := range in {
+			switch {
+			case resolved:
+				setVersionID(resTup, versionID)
+			case resTup.Req.URL.Host == mt.AuthoritativeBackend:
+				resolved = true
+				if !resTup.Failed && resTup.Res != nil {
+					versionID = resTup.Res.Header.Get(VersionIDHeader)
+				}
+				for _, heldTup := range held {
+					setVersionID(heldTup, versionID)
+					out <- heldTup
+				}
+				held = nil
+			case !resTup.Failed:
+				held = append(held, resTup)
+				continue
+			}
+			out <- resTup
+		}
+		for _, heldTup := range held {
+			out <- heldTup
+		}
+	}()
+	return out
+}
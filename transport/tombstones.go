@@ -0,0 +1,163 @@
+package transport
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+)
+
+// DefaultMaxTombstones limits number of tombstones if MaxTombstones is not set
+const DefaultMaxTombstones = 100000
+
+const noSuchKeyBody = `<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`
+
+// tombstones remember objects deleted on some backends only, so lagging
+// replicas do not serve them until reconciled. Nil tombstones track nothing
+type tombstones struct {
+	ttl     time.Duration
+	max     int
+	mx      sync.Mutex
+	deleted map[string]time.Time
+	now     func() time.Time
+}
+
+func newTombstones(conf shardingconfig.TombstonesConfig) *tombstones {
+	if conf.TTL.Duration <= 0 {
+		return nil
+	}
+	max := conf.MaxTombstones
+	if max == 0 {
+		max = DefaultMaxTombstones
+	}
+	return &tombstones{ttl: conf.TTL.Duration, max: max, deleted: make(map[string]time.Time), now: time.Now}
+}
+
+// tombstoneKey identifies object of path-style addressed request, bucket
+// requests have no key
+func tombstoneKey(req *http.Request) (string, bool) {
+	if !strings.Contains(strings.Trim(req.URL.Path, "/"), "/") {
+		return "", false
+	}
+	return req.Host + req.URL.Path, true
+}
+
+// bury adds tombstone of object, returned time identifies it
+func (ts *tombstones) bury(key string) time.Time {
+	ts.mx.Lock()
+	defer ts.mx.Unlock()
+	now := ts.now()
+	if _, ok := ts.deleted[key]; !ok && len(ts.deleted) >= ts.max {
+		for k, buried := range ts.deleted {
+			if now.Sub(buried) >= ts.ttl {
+				delete(ts.deleted, k)
+			}
+		}
+		if len(ts.deleted) >= ts.max {
+			metrics.Mark("reqs.global.tombstones.dropped")
+			return time.Time{}
+		}
+	}
+	ts.deleted[key] = now
+	metrics.UpdateGauge("reqs.global.tombstones.count", int64(len(ts.deleted)))
+	return now
+}
+
+// clear removes tombstone of object, only if it is still the given one when
+// buried is not zero
+func (ts *tombstones) clear(key string, buried time.Time) {
+	ts.mx.Lock()
+	defer ts.mx.Unlock()
+	if current, ok := ts.deleted[key]; ok && (buried.IsZero() || current.Equal(buried)) {
+		delete(ts.deleted, key)
+		metrics.UpdateGauge("reqs.global.tombstones.count", int64(len(ts.deleted)))
+	}
+}
+
+func (ts *tombstones) buried(req *http.Request) bool {
+	if ts == nil || req.Method != http.MethodGet && req.Method != http.MethodHead || req.URL.Query().Get("versionId") != "" {
+		return false
+	}
+	key, ok := tombstoneKey(req)
+	if !ok {
+		return false
+	}
+	ts.mx.Lock()
+	defer ts.mx.Unlock()
+	buried, ok := ts.deleted[key]
+	if ok && ts.now().Sub(buried) >= ts.ttl {
+		delete(ts.deleted, key)
+		return false
+	}
+	return ok
+}
+
+func noSuchKeyResponse(req *http.Request) *http.Response {
+	resp := notFoundResponse(req)
+	if req.Method == http.MethodGet {
+		resp.Header.Set("Content-Type", "application/xml")
+		resp.Body = ioutil.NopCloser(strings.NewReader(noSuchKeyBody))
+		resp.ContentLength = int64(len(noSuchKeyBody))
+	}
+	return resp
+}
+
+// recreates tells if write makes object readable again
+func recreates(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodPut:
+		return req.URL.RawQuery == ""
+	case http.MethodPost:
+		return req.URL.Query().Get("uploadId") != ""
+	}
+	return false
+}
+
+// tombstoneGate passes write responses through. First successful DELETE
+// buries object before its response is passed, tombstone is removed if
+// all backends deleted object. Successful write recreating object removes
+// its tombstone
+func (mt *MultiTransport) tombstoneGate(in <-chan ReqResErrTuple, req *http.Request, total int) <-chan ReqResErrTuple {
+	if mt.tombstones == nil || req.Method == http.MethodDelete && req.URL.RawQuery != "" ||
+		req.Method != http.MethodDelete && !recreates(req) {
+		return in
+	}
+	key, ok := tombstoneKey(req)
+	if !ok {
+		return in
+	}
+	out := make(chan ReqResErrTuple, total)
+	go func() {
+		defer close(out)
+		var buried time.Time
+		succeeded, failed := false, false
+		for resTup := range in {
+			if resTup.Failed {
+				failed = true
+			} else if !succeeded {
+				succeeded = true
+				if req.Method == http.MethodDelete {
+					buried = mt.tombstones.bury(key)
+				} else {
+					mt.tombstones.clear(key, time.Time{})
+				}
+			}
+			out <- resTup
+		}
+		if buried.IsZero() {
+			return
+		}
+		if !failed {
+			mt.tombstones.clear(key, buried)
+			return
+		}
+		log.Debugf("Object %s deleted partially, reads will not reach backends for %s", key, mt.tombstones.ttl)
+	}()
+	return out
+}
@@ -97,6 +97,29 @@ func DefaultHandleResponses(in <-chan ReqResErrTuple) ReqResErrTuple {
 // ErrTimeout is returned if TimeoutReader exceeds timeout
 var ErrTimeout = errors.New("Read timeout")
 
+// ErrNoBackendAvailable is returned if all backends are in maintenance
+var ErrNoBackendAvailable = errors.New("No backend available")
+
+// ErrQuorumUnreachable is set on successful writes if too many other backends
+// failed to reach WriteQuorum
+var ErrQuorumUnreachable = errors.New("Write quorum unreachable")
+
+// ErrWritesBlocked is returned for writes in write safe mode if less than
+// WriteQuorum backends are healthy
+var ErrWritesBlocked = errors.New("Writes blocked, too few healthy backends")
+
+// ErrChunkedBodyTooLarge is returned if chunked request body does not fit in
+// RechunkBufferLimit
+var ErrChunkedBodyTooLarge = errors.New("Chunked request body exceeds rechunk buffer limit")
+
+// DefaultRechunkBufferLimit is used if RechunkBufferLimit is not set
+const DefaultRechunkBufferLimit = 64 << 20
+
+// BackendHealth reports backend health checks outcome
+type BackendHealth interface {
+	Healthy(host string) bool
+}
+
 // ErrBodyContentLengthMismatch is returned if request body is shorter than
 // declared ContentLength header
 var ErrBodyContentLengthMismatch = errors.New("Body ContentLength miss match")
@@ -132,9 +155,13 @@ type RequestProcessor func(orig *http.Request, copies []*http.Request)
 // MultiTransport replicates request onto multiple backends
 type MultiTransport struct {
 	http.RoundTripper
-	// Backends is list of target endpoints URL
+	// Backends is list of target endpoints URL, use SetBackends to change
+	// them once MultiTransport serves requests
 	Backends     []url.URL
+	backendsMx   sync.RWMutex
 	SkipBackends map[string]bool
+	// MaintenanceSchedule holds maintenance windows per backend host
+	MaintenanceSchedule map[string][]shardingconfig.MaintenanceWindow
 	// Response handler will get `ReqResErrTuple` in `in` channel
 	// should process all responses and send one to out chan.
 	// Response senf to out chan will be returned from RoundTrip.
@@ -146,18 +173,189 @@ type MultiTransport struct {
 	HandleResponses MultipleResponsesHandler
 	// Process request between replication and sending, useful for changing request headers
 	PreProcessRequest RequestProcessor
+	// Retries defines if reads should be sent to backends one by one
+	Retries shardingconfig.RetriesConfig
+	// Locality makes reads go to backends in akubra region first
+	Locality shardingconfig.LocalityConfig
+	// WriteConcurrency limits number of backends written to at once,
+	// zero means all backends
+	WriteConcurrency int
+	// WriteQuorum is number of backends which have to accept write,
+	// zero means one backend
+	WriteQuorum int
+	// FailFastWrites aborts in-flight writes once WriteQuorum is unreachable
+	FailFastWrites bool
+	// PropagateClientCancellation aborts in-flight writes once client
+	// request is cancelled before RoundTrip returns
+	PropagateClientCancellation bool
+	// ConsistentPreconditions makes conditional requests (If-Match, If-Unmodified-Since, etc.)
+	// go to all backends and respond with state agreed by their majority
+	ConsistentPreconditions bool
+	// WriteSafeMode blocks writes unless at least WriteQuorum backends
+	// are reported healthy by Health
+	WriteSafeMode bool
+	Health        BackendHealth
+	// MergeListings sends bucket listings to all backends, their results
+	// are merged by response handler
+	MergeListings bool
+	// RequireContentLength holds hosts of backends rejecting chunked
+	// uploads, they get buffered chunked bodies with Content-Length
+	RequireContentLength map[string]bool
+	// RechunkBufferLimit limits size of buffered chunked body
+	RechunkBufferLimit int64
+	// AuthoritativeBackend is host of backend ACL and policy subresource and
+	// versioned requests are sent to instead of all backends
+	AuthoritativeBackend string
+	// HeadQuorum makes HEAD requests report object only if quorum of
+	// backends has it
+	HeadQuorum shardingconfig.HeadQuorumConfig
+	// ReadFanout sends reads to that many backends at once and passes
+	// the fastest successful response, zero disables fanout
+	ReadFanout int
+	// Reconciler is notified when backends report different ETags of the
+	// same object, nil disables reconciliation
+	Reconciler Reconciler
+	// WriteHealer is notified of writes outcomes, nil disables healing
+	WriteHealer WriteHealer
+	// RoutingLog records backends chosen for every request, nil disables it
+	RoutingLog log.Logger
+	// outliers ejects failing backends from reads
+	outliers *outlierDetector
+	// quarantine excludes backends timing out repeatedly from reads
+	quarantine *timeoutQuarantine
+	// rateLimits caps request rate of backends
+	rateLimits backendRateLimits
+	// tombstones hide partially deleted objects from reads
+	tombstones *tombstones
+	// throttling limits concurrent requests of backends asking to slow down
+	throttling *adaptiveThrottling
+	// capacity biases object writes away from nearly full backends
+	capacity *capacityWeights
+	// errorBodies marks responses carrying S3 error documents as failed
+	errorBodies *errorBodyValidator
+	// affinity sends reads of client session to the same backend
+	affinity *sessionAffinity
+}
+
+// ContextTriedBackendsKey is Request Context Value key for TriedBackends
+const ContextTriedBackendsKey = log.ContextKey("ContextTriedBackendsKey")
+
+// TriedBackends collects hosts of backends tried by request
+type TriedBackends struct {
+	Hosts []string
+}
+
+func (tb *TriedBackends) contains(host string) bool {
+	for _, tried := range tb.Hosts {
+		if tried == host {
+			return true
+		}
+	}
+	return false
+}
+
+// ContextServerTimingKey is Request Context Value key for ServerTiming
+const ContextServerTimingKey = log.ContextKey("ContextServerTimingKey")
+
+// BackendTiming holds durations of single backend request phases
+type BackendTiming struct {
+	Host string
+	// Dial is time of resolving and connecting, zero for reused connections
+	Dial time.Duration
+	// TTFB is time to first response byte
+	TTFB time.Duration
+	// StatusCode of backend response, zero if request failed
+	StatusCode int
+	Err        error
+}
+
+// ServerTiming collects BackendTimings of all backend requests made for
+// client request
+type ServerTiming struct {
+	mx      sync.Mutex
+	timings []BackendTiming
+}
+
+// Record adds backend timing
+func (st *ServerTiming) Record(timing BackendTiming) {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+	st.timings = append(st.timings, timing)
+}
+
+// Timings returns recorded backend timings
+func (st *ServerTiming) Timings() []BackendTiming {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+	return append([]BackendTiming{}, st.timings...)
+}
+
+// writesBlocked checks if write safe mode is on and less than
+// WriteQuorum backends are healthy
+func (mt *MultiTransport) writesBlocked(req *http.Request) bool {
+	if !mt.WriteSafeMode || mt.Health == nil || isIdempotentRead(req.Method) {
+		return false
+	}
+	quorum := mt.WriteQuorum
+	if quorum < 1 {
+		quorum = 1
+	}
+	healthy := 0
+	for _, backend := range mt.backends() {
+		if mt.Health.Healthy(backend.Host) {
+			healthy++
+		}
+	}
+	return healthy < quorum
+}
+
+// withServerTiming passes ServerTiming of from context to ctx, backend
+// requests do not inherit client request context otherwise
+func withServerTiming(ctx, from context.Context) context.Context {
+	if timing := from.Value(ContextServerTimingKey); timing != nil {
+		return context.WithValue(ctx, ContextServerTimingKey, timing)
+	}
+	return ctx
+}
+
+// propagateCancellation cancels backend requests once client context is
+// done, until returned stop function is called. Writes still in flight
+// after client got its response are left to complete
+func propagateCancellation(client context.Context, cancel context.CancelFunc) (stop func()) {
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-client.Done():
+			metrics.Mark("reqs.global.client_cancellations")
+			log.Debugf("Client cancelled request %s, aborting backend writes", client.Value(log.ContextreqIDKey))
+			cancel()
+		case <-stopped:
+		}
+	}()
+	return func() { close(stopped) }
+}
+
+func isIdempotentRead(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
 }
 
 // ReplicateRequests creates request copies (one per MultiTransport.Bakcends item).
 // New requests will have substituted Host field, original request body will be copied
-// simultaneously
+// simultaneously. Raw query is passed unchanged, as signatures depend on its order
 func (mt *MultiTransport) ReplicateRequests(req *http.Request, cancelFun context.CancelFunc) (reqs []*http.Request, err error) {
-	copiesCount := len(mt.Backends)
+	backends := mt.backends()
+	copiesCount := len(backends)
 	reqs = make([]*http.Request, 0, copiesCount)
 	// We need some read closers
 	bodyBuffer := &bytes.Buffer{}
+	chunked := req.ContentLength < 0 && req.Body != nil && req.Body != http.NoBody
+	limit := req.ContentLength
+	if chunked {
+		// one byte more tells body does not fit in the buffer
+		limit = mt.rechunkBufferLimit() + 1
+	}
 	bodyReader := &TimeoutReader{
-		io.LimitReader(req.Body, req.ContentLength),
+		io.LimitReader(req.Body, limit),
 		time.Second}
 
 	n, cerr := io.Copy(bodyBuffer, bodyReader)
@@ -166,15 +364,24 @@ func (mt *MultiTransport) ReplicateRequests(req *http.Request, cancelFun context
 		cancelFun()
 		return nil, cerr
 	}
+	if chunked && n == limit {
+		cancelFun()
+		metrics.Mark("reqs.global.rechunk_limit_exceeded")
+		return nil, ErrChunkedBodyTooLarge
+	}
 
-	for _, backend := range mt.Backends {
+	for _, backend := range backends {
 		req.URL.Host = backend.Host
+		if backend.Scheme != "" {
+			req.URL.Scheme = backend.Scheme
+		}
 		log.Debugf("Replicate request %s, for %s", req.Context().Value(log.ContextreqIDKey), backend.Host)
 
 		bodyContent := bodyBuffer.Bytes()
 		var newBody io.Reader
 		if len(bodyContent) > 0 {
-			newBody = ioutil.NopCloser(bytes.NewReader(bodyContent))
+			// bytes.Reader lets response handlers reread body with GetBody
+			newBody = bytes.NewReader(bodyContent)
 		}
 		r, rerr := http.NewRequest(req.Method, req.URL.String(), newBody)
 		// Copy request data
@@ -188,12 +395,75 @@ func (mt *MultiTransport) ReplicateRequests(req *http.Request, cancelFun context
 		}
 		r.ContentLength = int64(bodyBuffer.Len())
 		r.TransferEncoding = req.TransferEncoding
+		if chunked && mt.RequireContentLength[backend.Host] {
+			r.TransferEncoding = nil
+		}
+		if len(bodyContent) == 0 && !isIdempotentRead(req.Method) {
+			normalizeEmptyBody(r)
+		}
 		reqs = append(reqs, r)
 	}
 
 	return reqs, err
 }
 
+// normalizeEmptyBody makes zero-byte write (e.g. directory marker PUT) look
+// the same to every backend, whether client sent it chunked or with
+// Content-Length: 0. Expect: 100-continue is dropped, as there is no body to
+// wait with (RFC 7231 5.1.1)
+func normalizeEmptyBody(r *http.Request) {
+	r.Body = nil
+	r.ContentLength = 0
+	r.TransferEncoding = nil
+	r.Header.Del("Expect")
+}
+
+// stubbed out for testing
+var now = time.Now
+
+func (mt *MultiTransport) isMaintained(host string) bool {
+	if mt.SkipBackends[host] {
+		return true
+	}
+	moment := now()
+	for _, window := range mt.MaintenanceSchedule[host] {
+		if window.Active(moment) {
+			return true
+		}
+	}
+	return false
+}
+
+func (mt *MultiTransport) rechunkBufferLimit() int64 {
+	if mt.RechunkBufferLimit > 0 {
+		return mt.RechunkBufferLimit
+	}
+	return DefaultRechunkBufferLimit
+}
+
+// SetBackends replaces backends of MultiTransport, requests in progress
+// are sent to previous ones
+func (mt *MultiTransport) SetBackends(backends []url.URL) {
+	mt.backendsMx.Lock()
+	defer mt.backendsMx.Unlock()
+	mt.Backends = backends
+}
+
+func (mt *MultiTransport) backends() []url.URL {
+	mt.backendsMx.RLock()
+	defer mt.backendsMx.RUnlock()
+	return mt.Backends
+}
+
+func (mt *MultiTransport) allMaintained(backends []url.URL) bool {
+	for _, backend := range backends {
+		if !mt.isMaintained(backend.Host) {
+			return false
+		}
+	}
+	return true
+}
+
 func collectMetrics(req *http.Request, reqresperr ReqResErrTuple, since time.Time) {
 	host := metrics.Clean(req.URL.Host)
 	metrics.UpdateSince("reqs.backend."+host+".all", since)
@@ -217,19 +487,26 @@ func (mt *MultiTransport) sendRequest(
 	ctx := req.Context()
 	o := make(chan ReqResErrTuple)
 	go func() {
-		if mt.SkipBackends[req.URL.Host] {
+		if mt.isMaintained(req.URL.Host) {
 			log.Debugf("Skipping request %s, for %s", req.Context().Value(log.ContextreqIDKey), req.URL.Host)
 			r := ReqResErrTuple{req, nil, fmt.Errorf("Maintained Backend %s", req.URL.Host), true}
 			o <- r
 			return
 		}
 
-		resp, err := mt.RoundTripper.RoundTrip(req.WithContext(context.Background()))
+		backendCtx := withServerTiming(context.Background(), ctx)
+		if (mt.FailFastWrites || mt.PropagateClientCancellation) && !isIdempotentRead(req.Method) {
+			// let quorum gate or client cancellation abort in-flight writes
+			backendCtx = ctx
+		}
+		resp, err := mt.sendToBackend(req.WithContext(backendCtx))
+		errorBody := mt.errorBodies.failed(resp)
+		mt.recordResult(req.URL.Host, resp, err, errorBody, since)
 		// report Non 2XX status codes as errors
 		if err != nil {
 			log.Debugf("Send request error %s, %s", err.Error(), ctx.Value(log.ContextreqIDKey))
 		}
-		failed := err != nil || resp != nil && (resp.StatusCode < 200 || resp.StatusCode > 399)
+		failed := errorBody || err != nil || resp != nil && (resp.StatusCode < 200 || resp.StatusCode > 399)
 		r := ReqResErrTuple{req, resp, err, failed}
 		o <- r
 	}()
@@ -246,26 +523,242 @@ func (mt *MultiTransport) sendRequest(
 	out <- reqresperr
 }
 
+// sendSequentially sends request to backends one by one, until one
+// succeeds or MaxAttempts backends were tried
+func (mt *MultiTransport) sendSequentially(req *http.Request, reqs []*http.Request) (*http.Response, error) {
+	tried, ok := req.Context().Value(ContextTriedBackendsKey).(*TriedBackends)
+	if !ok {
+		tried = &TriedBackends{}
+	}
+	maxAttempts := mt.Retries.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = len(reqs)
+	}
+	var last ReqResErrTuple
+	attempts := 0
+	for _, backendReq := range reqs {
+		if attempts >= maxAttempts {
+			break
+		}
+		host := backendReq.URL.Host
+		if mt.isMaintained(host) || tried.contains(host) {
+			continue
+		}
+		if attempts > 0 {
+			if decision := RoutingDecisionFromContext(req); decision != nil {
+				decision.Retry = true
+			}
+			clearResponsesBody([]ReqResErrTuple{last})
+			log.Debugf("Retrying request %s on backend %s", req.Context().Value(log.ContextreqIDKey), host)
+		}
+		attempts++
+		tried.Hosts = append(tried.Hosts, host)
+		since := time.Now()
+		resp, err := mt.sendToBackend(backendReq.WithContext(withServerTiming(backendReq.Context(), req.Context())))
+		errorBody := mt.errorBodies.failed(resp)
+		mt.recordResult(host, resp, err, errorBody, since)
+		failed := errorBody || err != nil || resp != nil && (resp.StatusCode < 200 || resp.StatusCode > 399)
+		last = ReqResErrTuple{backendReq, resp, err, failed}
+		collectMetrics(backendReq, last, since)
+		if !failed {
+			break
+		}
+	}
+	if attempts == 0 {
+		return nil, ErrNoBackendAvailable
+	}
+	return last.Res, last.Err
+}
+
 // RoundTrip satisfies http.RoundTripper interface
 func (mt *MultiTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	if backends := mt.backends(); len(backends) > 0 && mt.allMaintained(backends) {
+		return nil, ErrNoBackendAvailable
+	}
+	if mt.writesBlocked(req) {
+		metrics.Mark("reqs.global.writes_blocked")
+		return nil, ErrWritesBlocked
+	}
+	if mt.tombstones.buried(req) {
+		metrics.Mark("reqs.global.tombstones.hits")
+		return noSuchKeyResponse(req), nil
+	}
 	bctx, cancelFunc := context.WithCancel(context.Background())
 	bctx = context.WithValue(bctx, log.ContextreqIDKey, req.Context().Value(log.ContextreqIDKey))
+	bctx = withServerTiming(bctx, req.Context())
 	reqs, err := mt.ReplicateRequests(req, cancelFunc)
 	if err != nil {
 		return nil, err
 	}
+	if mt.PropagateClientCancellation && !isIdempotentRead(req.Method) {
+		defer propagateCancellation(req.Context(), cancelFunc)()
+	}
 
-	c := make(chan ReqResErrTuple, len(reqs))
 	if len(reqs) == 0 {
 		return nil, errors.New("No requests provided")
 	}
+	decision := RoutingDecisionFromContext(req)
+	if decision != nil && anyFeatureEnabled(req) {
+		decision.Canary = true
+	}
+
+	if mt.ConsistentPreconditions && hasPreconditions(req) {
+		mt.logRouting(req, "preconditions-majority", reqs, reqs)
+		resTup := mt.HandleResponses(mt.preconditionGate(mt.dispatch(bctx, reqs)))
+		return resTup.Res, resTup.Err
+	}
+
+	headQuorumSkipped := FeatureEnabled(req, FeatureNoHeadQuorum)
+	if IsBucketHead(req) && mt.HeadQuorum.BucketQuorum > 0 && !headQuorumSkipped {
+		mt.logRouting(req, "head-bucket-quorum", reqs, reqs)
+		resTup := mt.HandleResponses(mt.headBucketQuorumGate(mt.dispatch(bctx, reqs)))
+		return resTup.Res, resTup.Err
+	}
+
+	if req.Method == http.MethodHead && mt.HeadQuorum.Quorum > 0 && !headQuorumSkipped {
+		mt.logRouting(req, "head-quorum", reqs, reqs)
+		resTup := mt.HandleResponses(mt.headQuorumGate(mt.dispatch(bctx, reqs)))
+		return resTup.Res, resTup.Err
+	}
+
+	if authoritative := mt.authoritativeRequest(req, reqs); authoritative != nil {
+		chosen := []*http.Request{authoritative}
+		mt.logRouting(req, "authoritative", reqs, chosen)
+		resTup := mt.HandleResponses(mt.dispatch(bctx, chosen))
+		return resTup.Res, resTup.Err
+	}
+
+	if mt.MergeListings && IsBucketListing(req) {
+		chosen := mt.withoutEjected(reqs)
+		mt.logRouting(req, "listing-merge", reqs, chosen)
+		resTup := mt.HandleResponses(mt.dispatch(bctx, chosen))
+		return resTup.Res, resTup.Err
+	}
+
+	candidates := reqs
+	if isIdempotentRead(req.Method) {
+		reqs = mt.withoutEjected(reqs)
+		local, remote := mt.splitByLocality(reqs)
+		ordered := append(append([]*http.Request{}, local...), remote...)
+		if affine, ok := mt.affinity.order(req, mt.withoutMaintained(ordered)); ok {
+			mt.logRouting(req, "session-affinity", candidates, affine)
+			return mt.sendSequentially(req, affine)
+		}
+		if mt.ReadFanout > 0 {
+			if decision != nil && mt.ReadFanout > 1 {
+				decision.Hedge = true
+			}
+			mt.logRouting(req, "read-fanout", candidates, ordered)
+			return mt.sendFastest(req, ordered)
+		}
+		if mt.Retries.AcrossBackends || FeatureEnabled(req, FeatureSequentialReads) {
+			mt.logRouting(req, "sequential", candidates, ordered)
+			return mt.sendSequentially(req, ordered)
+		}
+		if len(local) > 0 && len(remote) > 0 {
+			mt.logRouting(req, "local-first", candidates, ordered)
+			return mt.sendLocalFirst(bctx, local, remote)
+		}
+	}
+
+	mt.logRouting(req, "all", candidates, reqs)
+	resTup := mt.fanOut(bctx, req, reqs)
+	return resTup.Res, resTup.Err
+}
+
+// withoutEjected drops requests to backends ejected as outliers, quarantined,
+// out of rate limit or throttled to their concurrency limit, if all backends
+// are excluded requests are left unchanged
+func (mt *MultiTransport) withoutEjected(reqs []*http.Request) []*http.Request {
+	if mt.outliers == nil && mt.quarantine == nil && mt.rateLimits == nil && mt.throttling == nil {
+		return reqs
+	}
+	healthy := make([]*http.Request, 0, len(reqs))
+	for _, req := range reqs {
+		if !mt.outliers.isEjected(req.URL.Host) && !mt.quarantine.isQuarantined(req.URL.Host) &&
+			mt.rateLimits.available(req.URL.Host) && !mt.throttling.saturated(req.URL.Host) {
+			healthy = append(healthy, req)
+		}
+	}
+	if len(healthy) == 0 {
+		return reqs
+	}
+	return healthy
+}
+
+// withoutMaintained drops requests to maintained backends, if all of them
+// are maintained requests are left unchanged
+func (mt *MultiTransport) withoutMaintained(reqs []*http.Request) []*http.Request {
+	available := make([]*http.Request, 0, len(reqs))
+	for _, req := range reqs {
+		if !mt.isMaintained(req.URL.Host) {
+			available = append(available, req)
+		}
+	}
+	if len(available) == 0 {
+		return reqs
+	}
+	return available
+}
+
+// splitByLocality separates requests to backends in akubra region from the rest
+func (mt *MultiTransport) splitByLocality(reqs []*http.Request) (local, remote []*http.Request) {
+	for _, req := range reqs {
+		if mt.Locality.IsLocal(req.URL.Host) {
+			local = append(local, req)
+		} else {
+			remote = append(remote, req)
+		}
+	}
+	return local, remote
+}
 
+// sendLocalFirst sends read to local backends and falls back to remote ones
+// if none of local backends responded successfully
+func (mt *MultiTransport) sendLocalFirst(bctx context.Context, local, remote []*http.Request) (*http.Response, error) {
+	resTup := mt.fanOut(bctx, nil, local)
+	if !resTup.Failed && resTup.Err == nil {
+		return resTup.Res, nil
+	}
+	clearResponsesBody([]ReqResErrTuple{resTup})
+	metrics.Mark("reqs.global.locality.remote_fallback")
+	resTup = mt.fanOut(bctx, nil, remote)
+	return resTup.Res, resTup.Err
+}
+
+// fanOut sends all requests at once and merges responses with HandleResponses,
+// req is client request of writes
+func (mt *MultiTransport) fanOut(bctx context.Context, req *http.Request, reqs []*http.Request) ReqResErrTuple {
+	if isIdempotentRead(reqs[0].Method) {
+		return mt.HandleResponses(mt.dispatch(bctx, reqs))
+	}
+	if mt.WriteQuorum > 1 {
+		gctx, abort := context.WithCancel(bctx)
+		responses := mt.versionIDGate(mt.dispatch(gctx, reqs), reqs)
+		responses = mt.healingGate(mt.tombstoneGate(responses, req, len(reqs)), len(reqs))
+		return mt.HandleResponses(mt.quorumGate(responses, len(reqs), abort))
+	}
+	responses := mt.versionIDGate(mt.dispatch(bctx, reqs), reqs)
+	return mt.HandleResponses(mt.healingGate(mt.tombstoneGate(responses, req, len(reqs)), len(reqs)))
+}
+
+// dispatch sends requests concurrently (at most WriteConcurrency writes at once)
+// and returns channel of responses closed once all of them come in
+func (mt *MultiTransport) dispatch(bctx context.Context, reqs []*http.Request) <-chan ReqResErrTuple {
+	c := make(chan ReqResErrTuple, len(reqs))
+	concurrency := len(reqs)
+	if mt.WriteConcurrency > 0 && mt.WriteConcurrency < concurrency && !isIdempotentRead(reqs[0].Method) {
+		concurrency = mt.WriteConcurrency
+	}
+	slots := make(chan struct{}, concurrency)
 	wg := sync.WaitGroup{}
 	for _, req := range reqs {
 		wg.Add(1)
 		r := req.WithContext(bctx)
 		go func() {
+			slots <- struct{}{}
 			mt.sendRequest(r, c)
+			<-slots
 			wg.Done()
 		}()
 	}
@@ -275,8 +768,108 @@ func (mt *MultiTransport) RoundTrip(req *http.Request) (resp *http.Response, err
 		wg.Wait()
 		close(c)
 	}()
-	resTup := mt.HandleResponses(c)
-	return resTup.Res, resTup.Err
+	return c
+}
+
+func unreachableQuorumFailure(resTup ReqResErrTuple) ReqResErrTuple {
+	if resTup.Failed {
+		return resTup
+	}
+	clearResponsesBody([]ReqResErrTuple{resTup})
+	if resTup.Res != nil && resTup.Res.Body != nil {
+		_ = resTup.Res.Body.Close()
+	}
+	return ReqResErrTuple{resTup.Req, nil, ErrQuorumUnreachable, true}
+}
+
+// quorumGate holds write responses until WriteQuorum backends succeeded.
+// Held successes are passed before held failures, so response chosen by
+// HandleResponses does not depend on order responses came in. Once quorum
+// cannot be reached, successful responses are turned into failures and, if
+// FailFastWrites is set, in-flight writes are aborted
+func (mt *MultiTransport) quorumGate(in <-chan ReqResErrTuple, total int, abort context.CancelFunc) <-chan ReqResErrTuple {
+	quorum := mt.WriteQuorum
+	if quorum > total {
+		quorum = total
+	}
+	out := make(chan ReqResErrTuple, total)
+	go func() {
+		defer close(out)
+		var held, heldFailures []ReqResErrTuple
+		succeeded, failed := 0, 0
+		reached, unreachable := false, false
+		for resTup := range in {
+			switch {
+			case reached || unreachable && resTup.Failed:
+				out <- resTup
+			case unreachable:
+				out <- unreachableQuorumFailure(resTup)
+			case !resTup.Failed:
+				succeeded++
+				held = append(held, resTup)
+				if succeeded >= quorum {
+					reached = true
+					for _, heldTup := range append(held, heldFailures...) {
+						out <- heldTup
+					}
+					held, heldFailures = nil, nil
+				}
+			default:
+				failed++
+				heldFailures = append(heldFailures, resTup)
+				if failed > total-quorum {
+					unreachable = true
+					metrics.Mark("reqs.global.writes.quorum_unreachable")
+					if mt.FailFastWrites {
+						abort()
+					}
+					for _, heldTup := range held {
+						out <- unreachableQuorumFailure(heldTup)
+					}
+					for _, heldTup := range heldFailures {
+						out <- heldTup
+					}
+					held, heldFailures = nil, nil
+				}
+			}
+		}
+		for _, heldTup := range heldFailures {
+			out <- heldTup
+		}
+	}()
+	return out
+}
+
+// MultiTransportOptions groups configurable MultiTransport behaviours
+type MultiTransportOptions struct {
+	MaintainedBackends          []shardingconfig.YAMLUrl
+	MaintenanceSchedule         []shardingconfig.MaintenanceWindow
+	Retries                     shardingconfig.RetriesConfig
+	Locality                    shardingconfig.LocalityConfig
+	WriteConcurrency            int
+	WriteQuorum                 int
+	FailFastWrites              bool
+	PropagateClientCancellation bool
+	ConsistentPreconditions     bool
+	MergeListings               bool
+	OutlierEjection             shardingconfig.OutlierEjectionConfig
+	Quarantine                  shardingconfig.QuarantineConfig
+	ErrorBodies                 shardingconfig.ErrorBodyConfig
+	BackendRateLimits           map[string]shardingconfig.RateLimitConfig
+	AdaptiveThrottling          shardingconfig.AdaptiveThrottlingConfig
+	CapacityWeights             shardingconfig.CapacityWeightsConfig
+	DeleteTombstones            shardingconfig.TombstonesConfig
+	ReadFanout                  int
+	WriteSafeMode               bool
+	Health                      BackendHealth
+	Reconciler                  Reconciler
+	WriteHealer                 WriteHealer
+	RoutingLog                  log.Logger
+	HeadQuorum                  shardingconfig.HeadQuorumConfig
+	AuthoritativeBackend        string
+	RequireContentLength        []string
+	RechunkBufferLimit          int64
+	SessionAffinity             shardingconfig.SessionAffinityConfig
 }
 
 // NewMultiTransport creates *MultiTransport. If requestsPreprocesor or responseHandler
@@ -284,21 +877,56 @@ func (mt *MultiTransport) RoundTrip(req *http.Request) (resp *http.Response, err
 func NewMultiTransport(roundTripper http.RoundTripper,
 	backends []url.URL,
 	responsesHandler MultipleResponsesHandler,
-	maintainedBackends []shardingconfig.YAMLUrl) *MultiTransport {
+	options MultiTransportOptions) *MultiTransport {
 	if responsesHandler == nil {
 		responsesHandler = DefaultHandleResponses
 	}
 	if roundTripper == nil {
 		roundTripper = http.DefaultTransport
 	}
-	mb := make(map[string]bool, len(maintainedBackends))
-	for _, yurl := range maintainedBackends {
+	mb := make(map[string]bool, len(options.MaintainedBackends))
+	for _, yurl := range options.MaintainedBackends {
 		mb[yurl.Host] = true
 	}
+	requireContentLength := make(map[string]bool, len(options.RequireContentLength))
+	for _, host := range options.RequireContentLength {
+		requireContentLength[host] = true
+	}
+	schedule := make(map[string][]shardingconfig.MaintenanceWindow, len(options.MaintenanceSchedule))
+	for _, window := range options.MaintenanceSchedule {
+		schedule[window.Backend.Host] = append(schedule[window.Backend.Host], window)
+	}
 
 	return &MultiTransport{
-		RoundTripper:    roundTripper,
-		Backends:        backends,
-		SkipBackends:    mb,
-		HandleResponses: responsesHandler}
+		RoundTripper:                roundTripper,
+		Backends:                    backends,
+		SkipBackends:                mb,
+		MaintenanceSchedule:         schedule,
+		HandleResponses:             responsesHandler,
+		Retries:                     options.Retries,
+		Locality:                    options.Locality,
+		WriteConcurrency:            options.WriteConcurrency,
+		WriteQuorum:                 options.WriteQuorum,
+		FailFastWrites:              options.FailFastWrites,
+		PropagateClientCancellation: options.PropagateClientCancellation,
+		ConsistentPreconditions:     options.ConsistentPreconditions,
+		MergeListings:               options.MergeListings,
+		WriteSafeMode:               options.WriteSafeMode,
+		Health:                      options.Health,
+		Reconciler:                  options.Reconciler,
+		WriteHealer:                 options.WriteHealer,
+		RoutingLog:                  options.RoutingLog,
+		HeadQuorum:                  options.HeadQuorum,
+		AuthoritativeBackend:        options.AuthoritativeBackend,
+		RequireContentLength:        requireContentLength,
+		RechunkBufferLimit:          options.RechunkBufferLimit,
+		ReadFanout:                  options.ReadFanout,
+		outliers:                    newOutlierDetector(options.OutlierEjection),
+		quarantine:                  newTimeoutQuarantine(options.Quarantine),
+		errorBodies:                 newErrorBodyValidator(options.ErrorBodies),
+		rateLimits:                  newBackendRateLimits(options.BackendRateLimits),
+		throttling:                  newAdaptiveThrottling(options.AdaptiveThrottling),
+		capacity:                    newCapacityWeights(options.CapacityWeights),
+		tombstones:                  newTombstones(options.DeleteTombstones),
+		affinity:                    newSessionAffinity(options.SessionAffinity)}
 }
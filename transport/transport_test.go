@@ -2,14 +2,26 @@ package transport
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
 )
 
@@ -140,3 +152,1579 @@ func TestRequestMultiplication(t *testing.T) {
 		t.Errorf("Should get ErrTimeout or ErrBodyContentLengthMismatch")
 	}
 }
+
+func TestMaintenanceScheduleExcludesBackendWithinWindow(t *testing.T) {
+	stream := []byte("some body")
+	urls := mkDummySrvs(2, stream, t)
+	maintainedURL := urls[0]
+	window := shardingconfig.MaintenanceWindow{
+		Backend: shardingconfig.YAMLUrl{URL: &maintainedURL},
+		Start:   shardingconfig.DayTime{Duration: 1 * time.Hour},
+		End:     shardingconfig.DayTime{Duration: 3 * time.Hour},
+	}
+	transp := NewMultiTransport(http.DefaultTransport, urls, nil,
+		MultiTransportOptions{MaintenanceSchedule: []shardingconfig.MaintenanceWindow{window}})
+	defer func() { now = time.Now }()
+
+	now = func() time.Time { return time.Date(2017, 10, 1, 2, 0, 0, 0, time.Local) }
+	require.True(t, transp.isMaintained(maintainedURL.Host))
+	require.False(t, transp.isMaintained(urls[1].Host))
+
+	now = func() time.Time { return time.Date(2017, 10, 1, 4, 0, 0, 0, time.Local) }
+	require.False(t, transp.isMaintained(maintainedURL.Host))
+}
+
+func TestMaintenanceWindowSpanningMidnight(t *testing.T) {
+	window := shardingconfig.MaintenanceWindow{
+		Start: shardingconfig.DayTime{Duration: 23 * time.Hour},
+		End:   shardingconfig.DayTime{Duration: 1 * time.Hour},
+	}
+	require.True(t, window.Active(time.Date(2017, 10, 1, 23, 30, 0, 0, time.Local)))
+	require.True(t, window.Active(time.Date(2017, 10, 1, 0, 30, 0, 0, time.Local)))
+	require.False(t, window.Active(time.Date(2017, 10, 1, 12, 0, 0, 0, time.Local)))
+}
+
+func TestMaintenanceWindowFollowsWallClockOnDSTChange(t *testing.T) {
+	warsaw, err := time.LoadLocation("Europe/Warsaw")
+	require.NoError(t, err)
+	window := shardingconfig.MaintenanceWindow{
+		Start: shardingconfig.DayTime{Duration: 4 * time.Hour},
+		End:   shardingconfig.DayTime{Duration: 5 * time.Hour},
+	}
+	// clocks moved forward at 2:00 on 26th March 2017
+	require.True(t, window.Active(time.Date(2017, 3, 26, 4, 30, 0, 0, warsaw)))
+	require.False(t, window.Active(time.Date(2017, 3, 26, 5, 30, 0, 0, warsaw)))
+}
+
+func mkStatusSrv(status int, calls *int32) url.URL {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		w.WriteHeader(status)
+	}))
+	urlN, _ := url.Parse(ts.URL)
+	return *urlN
+}
+
+func TestRetryAcrossBackendsTriesNextBackendOnFailure(t *testing.T) {
+	var failingCalls, healthyCalls int32
+	urls := []url.URL{
+		mkStatusSrv(http.StatusInternalServerError, &failingCalls),
+		mkStatusSrv(http.StatusOK, &healthyCalls),
+	}
+	transp := NewMultiTransport(http.DefaultTransport, urls, nil,
+		MultiTransportOptions{Retries: shardingconfig.RetriesConfig{AcrossBackends: true}})
+
+	tried := &TriedBackends{}
+	req, _ := http.NewRequest("GET", "http://example.com/bucket/key", nil)
+	req = req.WithContext(context.WithValue(req.Context(), ContextTriedBackendsKey, tried))
+	resp, err := transp.RoundTrip(req)
+
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, int32(1), failingCalls)
+	require.Equal(t, int32(1), healthyCalls)
+	require.Equal(t, []string{urls[0].Host, urls[1].Host}, tried.Hosts)
+}
+
+func TestRoutingDecisionRecordsRetryHedgeAndCanary(t *testing.T) {
+	for _, testData := range []struct {
+		name     string
+		options  MultiTransportOptions
+		failing  bool
+		features []string
+		expected RoutingDecision
+	}{
+		{"retried on next backend", MultiTransportOptions{Retries: shardingconfig.RetriesConfig{AcrossBackends: true}},
+			true, nil, RoutingDecision{Retry: true}},
+		{"hedged read", MultiTransportOptions{ReadFanout: 2}, false, nil, RoutingDecision{Hedge: true}},
+		{"canary feature", MultiTransportOptions{}, false, []string{FeatureSequentialReads}, RoutingDecision{Canary: true}},
+		{"plain read", MultiTransportOptions{}, false, nil, RoutingDecision{}},
+	} {
+		var calls int32
+		firstStatus := http.StatusOK
+		if testData.failing {
+			firstStatus = http.StatusInternalServerError
+		}
+		urls := []url.URL{mkStatusSrv(firstStatus, &calls), mkStatusSrv(http.StatusOK, &calls)}
+		transp := NewMultiTransport(http.DefaultTransport, urls, nil, testData.options)
+
+		decision := &RoutingDecision{}
+		ctx := context.WithValue(context.Background(), ContextRoutingDecisionKey, decision)
+		if testData.features != nil {
+			ctx = WithFeatures(ctx, testData.features)
+		}
+		req, _ := http.NewRequest("GET", "http://example.com/bucket/key", nil)
+		resp, err := transp.RoundTrip(req.WithContext(ctx))
+
+		require.NoError(t, err, testData.name)
+		require.Equal(t, http.StatusOK, resp.StatusCode, testData.name)
+		require.Equal(t, testData.expected, *decision, testData.name)
+	}
+}
+
+func TestRetryAcrossBackendsRespectsMaxAttempts(t *testing.T) {
+	var failingCalls, healthyCalls int32
+	urls := []url.URL{
+		mkStatusSrv(http.StatusInternalServerError, &failingCalls),
+		mkStatusSrv(http.StatusOK, &healthyCalls),
+	}
+	transp := NewMultiTransport(http.DefaultTransport, urls, nil,
+		MultiTransportOptions{Retries: shardingconfig.RetriesConfig{AcrossBackends: true, MaxAttempts: 1}})
+
+	req, _ := http.NewRequest("GET", "http://example.com/bucket/key", nil)
+	resp, err := transp.RoundTrip(req)
+
+	require.NoError(t, err)
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	require.Equal(t, int32(1), failingCalls)
+	require.Equal(t, int32(0), healthyCalls)
+}
+
+func TestReadsPreferLocalRegionBackends(t *testing.T) {
+	var localCalls, remoteCalls int32
+	local := mkStatusSrv(http.StatusOK, &localCalls)
+	remote := mkStatusSrv(http.StatusOK, &remoteCalls)
+	locality := shardingconfig.LocalityConfig{
+		Region:         "dc1",
+		BackendRegions: map[string]string{local.Host: "dc1", remote.Host: "dc2"},
+	}
+	transp := NewMultiTransport(http.DefaultTransport, []url.URL{remote, local}, nil,
+		MultiTransportOptions{Locality: locality})
+
+	req, _ := http.NewRequest("GET", "http://example.com/bucket/key", nil)
+	resp, err := transp.RoundTrip(req)
+
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, int32(1), localCalls)
+	require.Equal(t, int32(0), remoteCalls)
+}
+
+func TestReadsFallBackToRemoteRegionWhenLocalFails(t *testing.T) {
+	var localCalls, remoteCalls int32
+	local := mkStatusSrv(http.StatusInternalServerError, &localCalls)
+	remote := mkStatusSrv(http.StatusOK, &remoteCalls)
+	locality := shardingconfig.LocalityConfig{
+		Region:         "dc1",
+		BackendRegions: map[string]string{local.Host: "dc1", remote.Host: "dc2"},
+	}
+	transp := NewMultiTransport(http.DefaultTransport, []url.URL{local, remote}, nil,
+		MultiTransportOptions{Locality: locality})
+
+	req, _ := http.NewRequest("GET", "http://example.com/bucket/key", nil)
+	resp, err := transp.RoundTrip(req)
+
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, int32(1), localCalls)
+	require.Equal(t, int32(1), remoteCalls)
+}
+
+func TestWritesGoToAllRegions(t *testing.T) {
+	var localCalls, remoteCalls int32
+	local := mkStatusSrv(http.StatusOK, &localCalls)
+	remote := mkStatusSrv(http.StatusOK, &remoteCalls)
+	locality := shardingconfig.LocalityConfig{
+		Region:         "dc1",
+		BackendRegions: map[string]string{local.Host: "dc1", remote.Host: "dc2"},
+	}
+	waitForAll := func(in <-chan ReqResErrTuple) (last ReqResErrTuple) {
+		for resTup := range in {
+			last = resTup
+		}
+		return last
+	}
+	transp := NewMultiTransport(http.DefaultTransport, []url.URL{local, remote}, waitForAll,
+		MultiTransportOptions{Locality: locality})
+
+	req, _ := http.NewRequest("PUT", "http://example.com/bucket/key", bytes.NewBufferString("data"))
+	_, err := transp.RoundTrip(req)
+
+	require.NoError(t, err)
+	require.Equal(t, int32(1), localCalls)
+	require.Equal(t, int32(1), remoteCalls)
+}
+
+type concurrencyTracker struct {
+	inFlight, max int32
+	bodies        chan string
+}
+
+func (ct *concurrencyTracker) server(expected int32) url.URL {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&ct.inFlight, 1)
+		for {
+			max := atomic.LoadInt32(&ct.max)
+			if current <= max || atomic.CompareAndSwapInt32(&ct.max, max, current) {
+				break
+			}
+		}
+		// wait a while for other writes to come in
+		deadline := time.Now().Add(300 * time.Millisecond)
+		for atomic.LoadInt32(&ct.inFlight) < expected && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		ct.bodies <- string(body)
+		atomic.AddInt32(&ct.inFlight, -1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	urlN, _ := url.Parse(ts.URL)
+	return *urlN
+}
+
+func testWriteFanOut(t *testing.T, backendsCount, writeConcurrency int) *concurrencyTracker {
+	tracker := &concurrencyTracker{bodies: make(chan string, backendsCount)}
+	expected := int32(backendsCount)
+	if writeConcurrency > 0 {
+		expected = int32(writeConcurrency)
+	}
+	urls := make([]url.URL, backendsCount)
+	for i := range urls {
+		urls[i] = tracker.server(expected)
+	}
+	waitForAll := func(in <-chan ReqResErrTuple) (last ReqResErrTuple) {
+		for resTup := range in {
+			last = resTup
+		}
+		return last
+	}
+	transp := NewMultiTransport(http.DefaultTransport, urls, waitForAll,
+		MultiTransportOptions{WriteConcurrency: writeConcurrency})
+
+	req, _ := http.NewRequest("PUT", "http://example.com/bucket/key", bytes.NewBufferString("payload"))
+	_, err := transp.RoundTrip(req)
+	require.NoError(t, err)
+
+	close(tracker.bodies)
+	for body := range tracker.bodies {
+		require.Equal(t, "payload", body)
+	}
+	return tracker
+}
+
+func TestWritesFanOutToAllBackendsConcurrently(t *testing.T) {
+	tracker := testWriteFanOut(t, 5, 0)
+	require.Equal(t, int32(5), tracker.max)
+}
+
+func TestWriteConcurrencyLimitsSimultaneousWrites(t *testing.T) {
+	tracker := testWriteFanOut(t, 5, 2)
+	require.Equal(t, int32(2), tracker.max)
+}
+
+func mkHangingSrv(aborted chan struct{}) url.URL {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// server notices closed connection once request body is consumed
+		_, _ = ioutil.ReadAll(r.Body)
+		select {
+		case <-r.Context().Done():
+			close(aborted)
+		case <-time.After(5 * time.Second):
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	urlN, _ := url.Parse(ts.URL)
+	return *urlN
+}
+
+// mkDelayedSrv responds with its name after delay, cancelled requests are
+// counted instead
+func mkDelayedSrv(name string, status int, delay time.Duration, calls, cancelled *int32) url.URL {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		select {
+		case <-time.After(delay):
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(name))
+		case <-r.Context().Done():
+			atomic.AddInt32(cancelled, 1)
+		}
+	}))
+	urlN, _ := url.Parse(ts.URL)
+	return *urlN
+}
+
+func TestFailFastWritesAbortsWhenQuorumUnreachable(t *testing.T) {
+	var failingCalls int32
+	aborted := make(chan struct{})
+	urls := []url.URL{
+		mkStatusSrv(http.StatusInternalServerError, &failingCalls),
+		mkStatusSrv(http.StatusInternalServerError, &failingCalls),
+		mkHangingSrv(aborted),
+	}
+	transp := NewMultiTransport(http.DefaultTransport, urls, nil,
+		MultiTransportOptions{WriteQuorum: 2, FailFastWrites: true})
+
+	since := time.Now()
+	req, _ := http.NewRequest("PUT", "http://example.com/bucket/key", bytes.NewBufferString("data"))
+	resp, err := transp.RoundTrip(req)
+
+	require.True(t, time.Since(since) < time.Second, "write should not wait for hanging backend")
+	require.True(t, err != nil || resp.StatusCode == http.StatusInternalServerError)
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Error("in-flight write was not aborted")
+	}
+}
+
+func TestWriteQuorumFailsWhenNotEnoughBackendsSucceed(t *testing.T) {
+	var calls int32
+	urls := []url.URL{
+		mkStatusSrv(http.StatusInternalServerError, &calls),
+		mkStatusSrv(http.StatusInternalServerError, &calls),
+		mkStatusSrv(http.StatusOK, &calls),
+	}
+	transp := NewMultiTransport(http.DefaultTransport, urls, nil, MultiTransportOptions{WriteQuorum: 2})
+
+	req, _ := http.NewRequest("PUT", "http://example.com/bucket/key", bytes.NewBufferString("data"))
+	resp, err := transp.RoundTrip(req)
+
+	require.True(t, err != nil || resp.StatusCode == http.StatusInternalServerError)
+}
+
+func TestWriteQuorumSucceedsWhenReached(t *testing.T) {
+	var calls, cancelled int32
+	// failure comes in before successes reach quorum
+	urls := []url.URL{
+		mkStatusSrv(http.StatusInternalServerError, &calls),
+		mkDelayedSrv("ok", http.StatusOK, 50*time.Millisecond, &calls, &cancelled),
+		mkDelayedSrv("ok", http.StatusOK, 50*time.Millisecond, &calls, &cancelled),
+	}
+	transp := NewMultiTransport(http.DefaultTransport, urls, nil,
+		MultiTransportOptions{WriteQuorum: 2, FailFastWrites: true})
+
+	req, _ := http.NewRequest("PUT", "http://example.com/bucket/key", bytes.NewBufferString("data"))
+	resp, err := transp.RoundTrip(req)
+
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestClientCancellationAbortsAllInFlightWrites(t *testing.T) {
+	aborted := []chan struct{}{make(chan struct{}), make(chan struct{}), make(chan struct{})}
+	urls := []url.URL{mkHangingSrv(aborted[0]), mkHangingSrv(aborted[1]), mkHangingSrv(aborted[2])}
+	transp := NewMultiTransport(http.DefaultTransport, urls, nil,
+		MultiTransportOptions{PropagateClientCancellation: true})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	since := time.Now()
+	req, _ := http.NewRequest("PUT", "http://example.com/bucket/key", bytes.NewBufferString("data"))
+	_, err := transp.RoundTrip(req.WithContext(ctx))
+
+	require.True(t, time.Since(since) < time.Second, "write should not wait for hanging backends")
+	require.Error(t, err)
+	for i, backendAborted := range aborted {
+		select {
+		case <-backendAborted:
+		case <-time.After(time.Second):
+			t.Errorf("in-flight write to backend %d was not aborted", i)
+		}
+	}
+}
+
+func mkObjectSrv(modified time.Time, etag string) url.URL {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+		if since, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil && modified.After(since) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if match := r.Header.Get("If-Match"); match != "" && match != etag {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	urlN, _ := url.Parse(ts.URL)
+	return *urlN
+}
+
+func TestConsistentPreconditionsFollowBackendsMajority(t *testing.T) {
+	older := time.Date(2017, 10, 1, 10, 0, 0, 0, time.UTC)
+	newer := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	unmodifiedSince := time.Date(2017, 10, 1, 11, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+
+	for _, testData := range []struct {
+		name     string
+		backends []url.URL
+		header   string
+		value    string
+		expected int
+	}{
+		{"majority modified", []url.URL{mkObjectSrv(older, `"a"`), mkObjectSrv(newer, `"b"`), mkObjectSrv(newer, `"b"`)},
+			"If-Unmodified-Since", unmodifiedSince, http.StatusPreconditionFailed},
+		{"majority unmodified", []url.URL{mkObjectSrv(newer, `"b"`), mkObjectSrv(older, `"a"`), mkObjectSrv(older, `"a"`)},
+			"If-Unmodified-Since", unmodifiedSince, http.StatusOK},
+		{"majority matching etag", []url.URL{mkObjectSrv(newer, `"b"`), mkObjectSrv(older, `"a"`), mkObjectSrv(older, `"a"`)},
+			"If-Match", `"a"`, http.StatusOK},
+		{"tie resolved by newest state", []url.URL{mkObjectSrv(older, `"a"`), mkObjectSrv(newer, `"b"`)},
+			"If-Match", `"a"`, http.StatusPreconditionFailed},
+	} {
+		transp := NewMultiTransport(http.DefaultTransport, testData.backends, nil,
+			MultiTransportOptions{ConsistentPreconditions: true})
+		for _, method := range []string{"GET", "PUT"} {
+			req, _ := http.NewRequest(method, "http://example.com/bucket/key", nil)
+			req.Header.Set(testData.header, testData.value)
+			resp, err := transp.RoundTrip(req)
+
+			require.NoError(t, err, testData.name)
+			require.Equal(t, testData.expected, resp.StatusCode, "%s %s", method, testData.name)
+		}
+	}
+}
+
+type reconcilerFunc func(versions []ReplicaVersion)
+
+func (f reconcilerFunc) Reconcile(versions []ReplicaVersion) {
+	f(versions)
+}
+
+func TestConsistentPreconditionsReportDivergentETagsToReconciler(t *testing.T) {
+	older := time.Date(2017, 10, 1, 10, 0, 0, 0, time.UTC)
+	newer := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	reported := make(chan []ReplicaVersion, 2)
+	reconciler := reconcilerFunc(func(versions []ReplicaVersion) { reported <- versions })
+
+	for _, testData := range []struct {
+		backends  []url.URL
+		divergent bool
+	}{
+		{[]url.URL{mkObjectSrv(older, `"a"`), mkObjectSrv(newer, `"b"`)}, true},
+		{[]url.URL{mkObjectSrv(newer, `"b"`), mkObjectSrv(newer, `"b"`)}, false},
+	} {
+		transp := NewMultiTransport(http.DefaultTransport, testData.backends, nil,
+			MultiTransportOptions{ConsistentPreconditions: true, Reconciler: reconciler})
+		req, _ := http.NewRequest("GET", "http://example.com/bucket/key", nil)
+		req.Header.Set("If-Match", `"b"`)
+		_, err := transp.RoundTrip(req)
+		require.NoError(t, err)
+
+		if !testData.divergent {
+			select {
+			case versions := <-reported:
+				t.Errorf("Replicas with the same ETag reported as divergent: %v", versions)
+			case <-time.After(50 * time.Millisecond):
+			}
+			continue
+		}
+		select {
+		case versions := <-reported:
+			require.Len(t, versions, 2)
+			modified := map[string]time.Time{`"a"`: older, `"b"`: newer}
+			for _, version := range versions {
+				require.True(t, modified[version.ETag].Equal(version.LastModified), "%v", version)
+				delete(modified, version.ETag)
+			}
+		case <-time.After(time.Second):
+			t.Error("Divergent replicas were not reported")
+		}
+	}
+}
+
+func TestHeadQuorumConfirmsObjectOnQuorumOfBackends(t *testing.T) {
+	for _, testData := range []struct {
+		name     string
+		statuses []int
+		quorum   int
+		expected int
+		replicas string
+	}{
+		{"quorum found", []int{http.StatusOK, http.StatusOK, http.StatusNotFound}, 2, http.StatusOK, "2/3"},
+		{"all found", []int{http.StatusOK, http.StatusOK, http.StatusOK}, 2, http.StatusOK, ""},
+		{"missing on majority", []int{http.StatusOK, http.StatusNotFound, http.StatusNotFound}, 2, http.StatusNotFound, "1/3"},
+		{"unconfirmed because of errors", []int{http.StatusOK, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+			2, http.StatusNotFound, "1/3"},
+		{"quorum capped to backends number", []int{http.StatusOK, http.StatusOK}, 3, http.StatusOK, ""},
+		{"no backend responded", []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable}, 2,
+			http.StatusServiceUnavailable, "0/2"},
+	} {
+		var calls int32
+		urls := make([]url.URL, 0, len(testData.statuses))
+		for _, status := range testData.statuses {
+			urls = append(urls, mkStatusSrv(status, &calls))
+		}
+		transp := NewMultiTransport(http.DefaultTransport, urls, nil, MultiTransportOptions{
+			HeadQuorum: shardingconfig.HeadQuorumConfig{Quorum: testData.quorum, ReportReplicas: true},
+		})
+
+		req, _ := http.NewRequest(http.MethodHead, "http://example.com/bucket/key", nil)
+		resp, err := transp.RoundTrip(req)
+
+		require.NoError(t, err, testData.name)
+		require.Equal(t, testData.expected, resp.StatusCode, testData.name)
+		require.Equal(t, testData.replicas, resp.Header.Get(ReplicasHeader), testData.name)
+		require.Equal(t, int32(len(testData.statuses)), atomic.LoadInt32(&calls), testData.name)
+	}
+}
+
+func TestHeadBucketQuorumConfirmsBucketOnQuorumOfBackends(t *testing.T) {
+	for _, testData := range []struct {
+		name     string
+		statuses []int
+		path     string
+		expected int
+	}{
+		{"bucket on quorum", []int{http.StatusOK, http.StatusOK, http.StatusNotFound}, "/bucket", http.StatusOK},
+		{"bucket with slash on quorum", []int{http.StatusOK, http.StatusNotFound, http.StatusOK}, "/bucket/", http.StatusOK},
+		{"bucket missing on majority", []int{http.StatusOK, http.StatusNotFound, http.StatusNotFound}, "/bucket",
+			http.StatusNotFound},
+		{"bucket unconfirmed because of errors", []int{http.StatusOK, http.StatusServiceUnavailable, http.StatusNotFound},
+			"/bucket", http.StatusNotFound},
+		{"object uses own quorum", []int{http.StatusOK, http.StatusNotFound, http.StatusNotFound}, "/bucket/key",
+			http.StatusOK},
+	} {
+		var calls int32
+		urls := make([]url.URL, 0, len(testData.statuses))
+		for _, status := range testData.statuses {
+			urls = append(urls, mkStatusSrv(status, &calls))
+		}
+		transp := NewMultiTransport(http.DefaultTransport, urls, nil, MultiTransportOptions{
+			HeadQuorum: shardingconfig.HeadQuorumConfig{Quorum: 1, BucketQuorum: 2},
+		})
+
+		req, _ := http.NewRequest(http.MethodHead, "http://example.com"+testData.path, nil)
+		resp, err := transp.RoundTrip(req)
+
+		require.NoError(t, err, testData.name)
+		require.Equal(t, testData.expected, resp.StatusCode, testData.name)
+		require.Equal(t, int32(len(testData.statuses)), atomic.LoadInt32(&calls), testData.name)
+	}
+}
+
+func TestMetadataHeadersReachAllBackendsUnchanged(t *testing.T) {
+	var mx sync.Mutex
+	received := make([]http.Header, 0, 3)
+	urls := make([]url.URL, 0, 3)
+	for i := 0; i < 3; i++ {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mx.Lock()
+			received = append(received, r.Header)
+			mx.Unlock()
+		}))
+		defer ts.Close()
+		tsURL, _ := url.Parse(ts.URL)
+		urls = append(urls, *tsURL)
+	}
+	transp := NewMultiTransport(http.DefaultTransport, urls, nil, MultiTransportOptions{})
+
+	req, _ := http.NewRequest(http.MethodPut, "http://example.com/bucket/key", strings.NewReader("data"))
+	req.Header.Set("x-amz-meta-owner", "Akubra Team")
+	req.Header["X-Amz-Meta-Tags"] = []string{"a", "b, c"}
+	req.Header.Set("X-Amz-Meta-Encoded", "=?UTF-8?B?xbzDs8WCdw==?=")
+	resp, err := transp.RoundTrip(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		mx.Lock()
+		count := len(received)
+		mx.Unlock()
+		if count == 3 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	mx.Lock()
+	defer mx.Unlock()
+	require.Len(t, received, 3)
+	for _, header := range received {
+		require.Equal(t, []string{"Akubra Team"}, header["X-Amz-Meta-Owner"])
+		require.Equal(t, []string{"a", "b, c"}, header["X-Amz-Meta-Tags"])
+		require.Equal(t, []string{"=?UTF-8?B?xbzDs8WCdw==?="}, header["X-Amz-Meta-Encoded"])
+	}
+}
+
+func mkMetadataSrv(owner string) url.URL {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amz-Meta-Owner", owner)
+	}))
+	tsURL, _ := url.Parse(ts.URL)
+	return *tsURL
+}
+
+func TestHeadQuorumPassesMetadataOfMostBackends(t *testing.T) {
+	var logBuffer bytes.Buffer
+	defaultLogger := log.DefaultLogger
+	log.DefaultLogger = &logrus.Logger{
+		Out:       &logBuffer,
+		Formatter: log.PlainTextFormatter{},
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.DebugLevel,
+	}
+	defer func() { log.DefaultLogger = defaultLogger }()
+	divergent := mkMetadataSrv("mallory")
+	urls := []url.URL{divergent, mkMetadataSrv("alice"), mkMetadataSrv("alice")}
+	transp := NewMultiTransport(http.DefaultTransport, urls, nil, MultiTransportOptions{
+		HeadQuorum: shardingconfig.HeadQuorumConfig{Quorum: 2, VerifyMetadata: true},
+	})
+
+	for i := 0; i < 5; i++ {
+		req, _ := http.NewRequest(http.MethodHead, "http://example.com/bucket/key", nil)
+		resp, err := transp.RoundTrip(req)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "alice", resp.Header.Get("X-Amz-Meta-Owner"))
+	}
+	require.Contains(t, logBuffer.String(), "Object /bucket/key metadata differs on backends "+divergent.Host+" from 2 other backends")
+}
+
+func TestHeadQuorumReportsReplicasOnlyIfEnabled(t *testing.T) {
+	var calls int32
+	urls := []url.URL{mkStatusSrv(http.StatusOK, &calls), mkStatusSrv(http.StatusNotFound, &calls)}
+	transp := NewMultiTransport(http.DefaultTransport, urls, nil, MultiTransportOptions{
+		HeadQuorum: shardingconfig.HeadQuorumConfig{Quorum: 2},
+	})
+
+	req, _ := http.NewRequest(http.MethodHead, "http://example.com/bucket/key", nil)
+	resp, err := transp.RoundTrip(req)
+
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.Empty(t, resp.Header.Get(ReplicasHeader))
+}
+
+func TestOutlierDetectorEjectsAndGraduallyReintroducesBackend(t *testing.T) {
+	detector := newOutlierDetector(shardingconfig.OutlierEjectionConfig{
+		ConsecutiveErrors: 3,
+		EjectionDuration:  metrics.Interval{Duration: 10 * time.Second},
+	})
+	moment := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return moment }
+	defer func() { now = time.Now }()
+	draw := 0.0
+	detector.random = func() float64 { return draw }
+
+	detector.record("backend", true, time.Millisecond)
+	detector.record("backend", true, time.Millisecond)
+	require.False(t, detector.isEjected("backend"))
+	detector.record("backend", true, time.Millisecond)
+	require.True(t, detector.isEjected("backend"))
+
+	// reintroduction: after ejection backend gets growing share of reads
+	moment = moment.Add(12 * time.Second)
+	draw = 0.1
+	require.False(t, detector.isEjected("backend"))
+	draw = 0.5
+	require.True(t, detector.isEjected("backend"))
+	moment = moment.Add(8 * time.Second)
+	require.False(t, detector.isEjected("backend"))
+
+	// subsequent ejection lasts longer
+	for i := 0; i < 3; i++ {
+		detector.record("backend", true, time.Millisecond)
+	}
+	moment = moment.Add(15 * time.Second)
+	require.True(t, detector.isEjected("backend"))
+}
+
+func TestOutlierDetectorTreatsSlowResponsesAsErrors(t *testing.T) {
+	detector := newOutlierDetector(shardingconfig.OutlierEjectionConfig{
+		ConsecutiveErrors: 2,
+		EjectionDuration:  metrics.Interval{Duration: 10 * time.Second},
+		LatencyThreshold:  metrics.Interval{Duration: time.Second},
+	})
+	detector.record("backend", false, 2*time.Second)
+	detector.record("backend", false, time.Millisecond)
+	detector.record("backend", false, 2*time.Second)
+	require.False(t, detector.isEjected("backend"))
+	detector.record("backend", false, 2*time.Second)
+	require.True(t, detector.isEjected("backend"))
+}
+
+func TestReadsSkipEjectedBackend(t *testing.T) {
+	var failingCalls, healthyCalls int32
+	urls := []url.URL{
+		mkStatusSrv(http.StatusInternalServerError, &failingCalls),
+		mkStatusSrv(http.StatusOK, &healthyCalls),
+	}
+	transp := NewMultiTransport(http.DefaultTransport, urls, nil, MultiTransportOptions{
+		Retries: shardingconfig.RetriesConfig{AcrossBackends: true},
+		OutlierEjection: shardingconfig.OutlierEjectionConfig{
+			ConsecutiveErrors: 2,
+			EjectionDuration:  metrics.Interval{Duration: time.Minute},
+		},
+	})
+
+	for i := 0; i < 5; i++ {
+		req, _ := http.NewRequest("GET", "http://example.com/bucket/key", nil)
+		resp, err := transp.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	require.Equal(t, int32(2), failingCalls)
+	require.Equal(t, int32(5), healthyCalls)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestQuarantineCountsOnlyTimeouts(t *testing.T) {
+	quarantine := newTimeoutQuarantine(shardingconfig.QuarantineConfig{
+		TimeoutThreshold: 2,
+		Duration:         metrics.Interval{Duration: 10 * time.Second},
+	})
+	moment := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return moment }
+	defer func() { now = time.Now }()
+
+	quarantine.record("backend", fmt.Errorf("connection refused"))
+	quarantine.record("backend", fmt.Errorf("connection refused"))
+	require.False(t, quarantine.isQuarantined("backend"), "errors should not be counted")
+
+	quarantine.record("backend", timeoutError{})
+	quarantine.record("backend", nil)
+	quarantine.record("backend", &url.Error{Op: "Get", URL: "http://backend", Err: timeoutError{}})
+	require.False(t, quarantine.isQuarantined("backend"), "response should reset timeouts count")
+	quarantine.record("backend", context.DeadlineExceeded)
+	require.True(t, quarantine.isQuarantined("backend"))
+	require.False(t, quarantine.isQuarantined("other"))
+
+	moment = moment.Add(10 * time.Second)
+	require.False(t, quarantine.isQuarantined("backend"))
+}
+
+func TestReadsSkipQuarantinedBackend(t *testing.T) {
+	var slowCalls, healthyCalls int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&slowCalls, 1)
+		time.Sleep(200 * time.Millisecond)
+	}))
+	slowURL, _ := url.Parse(slow.URL)
+	urls := []url.URL{*slowURL, mkStatusSrv(http.StatusOK, &healthyCalls)}
+	roundTripper := &http.Transport{ResponseHeaderTimeout: 20 * time.Millisecond}
+	transp := NewMultiTransport(roundTripper, urls, nil, MultiTransportOptions{
+		Retries: shardingconfig.RetriesConfig{AcrossBackends: true},
+		Quarantine: shardingconfig.QuarantineConfig{
+			TimeoutThreshold: 2,
+			Duration:         metrics.Interval{Duration: time.Minute},
+		},
+	})
+
+	for i := 0; i < 5; i++ {
+		req, _ := http.NewRequest("GET", "http://example.com/bucket/key", nil)
+		resp, err := transp.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	require.Equal(t, int32(2), atomic.LoadInt32(&slowCalls))
+	require.Equal(t, int32(5), atomic.LoadInt32(&healthyCalls))
+}
+
+func TestReadFanoutPassesFastestSuccessfulResponse(t *testing.T) {
+	for _, testData := range []struct {
+		name       string
+		readFanout int
+		failFast   bool
+		expected   string
+		calls      int32
+		cancelled  int32
+	}{
+		{"fastest wins", 3, false, "fast", 3, 2},
+		{"fast failure is skipped", 3, true, "medium", 3, 1},
+		{"fanout is bounded", 2, false, "medium", 2, 1},
+	} {
+		var calls, cancelled int32
+		fastStatus := http.StatusOK
+		if testData.failFast {
+			fastStatus = http.StatusInternalServerError
+		}
+		urls := []url.URL{
+			mkDelayedSrv("medium", http.StatusOK, 100*time.Millisecond, &calls, &cancelled),
+			mkDelayedSrv("slow", http.StatusOK, 2*time.Second, &calls, &cancelled),
+			mkDelayedSrv("fast", fastStatus, time.Millisecond, &calls, &cancelled),
+		}
+		transp := NewMultiTransport(http.DefaultTransport, urls, nil, MultiTransportOptions{ReadFanout: testData.readFanout})
+
+		req, _ := http.NewRequest("GET", "http://example.com/bucket/key", nil)
+		started := time.Now()
+		resp, err := transp.RoundTrip(req)
+		require.NoError(t, err, testData.name)
+		require.Equal(t, http.StatusOK, resp.StatusCode, testData.name)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err, testData.name)
+		require.NoError(t, resp.Body.Close(), testData.name)
+		require.Equal(t, testData.expected, string(body), testData.name)
+		require.True(t, time.Since(started) < time.Second, testData.name)
+		require.Equal(t, testData.calls, atomic.LoadInt32(&calls), testData.name)
+		// slower backends' requests are cancelled
+		for i := 0; i < 100 && atomic.LoadInt32(&cancelled) < testData.cancelled; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.Equal(t, testData.cancelled, atomic.LoadInt32(&cancelled), testData.name)
+	}
+}
+
+type fakeHealth struct {
+	mx      sync.Mutex
+	healthy map[string]bool
+}
+
+func (fh *fakeHealth) Healthy(host string) bool {
+	fh.mx.Lock()
+	defer fh.mx.Unlock()
+	return fh.healthy[host]
+}
+
+func (fh *fakeHealth) set(host string, healthy bool) {
+	fh.mx.Lock()
+	defer fh.mx.Unlock()
+	fh.healthy[host] = healthy
+}
+
+func TestWriteSafeModeBlocksWritesBelowQuorum(t *testing.T) {
+	var calls int32
+	urls := []url.URL{
+		mkStatusSrv(http.StatusOK, &calls),
+		mkStatusSrv(http.StatusOK, &calls),
+		mkStatusSrv(http.StatusOK, &calls),
+	}
+	health := &fakeHealth{healthy: map[string]bool{urls[0].Host: true}}
+	transp := NewMultiTransport(http.DefaultTransport, urls, nil,
+		MultiTransportOptions{WriteQuorum: 2, WriteSafeMode: true, Health: health})
+
+	req, _ := http.NewRequest("PUT", "http://example.com/bucket/key", bytes.NewBufferString("data"))
+	_, err := transp.RoundTrip(req)
+	require.Equal(t, ErrWritesBlocked, err)
+	require.Equal(t, int32(0), atomic.LoadInt32(&calls))
+
+	req, _ = http.NewRequest("GET", "http://example.com/bucket/key", nil)
+	resp, err := transp.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, "reads should be served")
+
+	health.set(urls[1].Host, true)
+	req, _ = http.NewRequest("PUT", "http://example.com/bucket/key", bytes.NewBufferString("data"))
+	resp, err = transp.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, "writes should resume once quorum is healthy")
+}
+
+const internalErrorBody = `<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>InternalError</Code><Message>We encountered an internal error.</Message></Error>`
+
+// mkErrorBodySrv responds with status 200 and S3 error document
+func mkErrorBodySrv(calls *int32) url.URL {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		w.Header().Set("Content-Type", "application/xml")
+		_, _ = w.Write([]byte(internalErrorBody))
+	}))
+	urlN, _ := url.Parse(ts.URL)
+	return *urlN
+}
+
+func TestErrorBodyValidatorRecognizesConfiguredErrors(t *testing.T) {
+	validator := newErrorBodyValidator(shardingconfig.ErrorBodyConfig{
+		StatusCodes: []int{http.StatusOK},
+		ErrorCodes:  []string{"InternalError", "SlowDown"},
+	})
+	for _, testData := range []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		failed      bool
+	}{
+		{"configured error code", http.StatusOK, "application/xml", internalErrorBody, true},
+		{"content type with charset", http.StatusOK, "application/xml; charset=utf-8", internalErrorBody, true},
+		{"other error code", http.StatusOK, "application/xml", "<Error><Code>NoSuchKey</Code></Error>", false},
+		{"not inspected status", http.StatusCreated, "application/xml", internalErrorBody, false},
+		{"not inspected content type", http.StatusOK, "text/plain", internalErrorBody, false},
+		{"regular document", http.StatusOK, "application/xml", "<ListBucketResult><Name>bucket</Name></ListBucketResult>", false},
+		{"not xml", http.StatusOK, "application/xml", "InternalError", false},
+	} {
+		req, _ := http.NewRequest("GET", "http://backend:8080/bucket/key", nil)
+		resp := &http.Response{
+			Request:       req,
+			StatusCode:    testData.status,
+			Header:        http.Header{"Content-Type": []string{testData.contentType}},
+			ContentLength: -1,
+			Body:          ioutil.NopCloser(bytes.NewBufferString(testData.body)),
+		}
+		require.Equal(t, testData.failed, validator.failed(resp), testData.name)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, testData.body, string(body), testData.name)
+	}
+	require.False(t, newErrorBodyValidator(shardingconfig.ErrorBodyConfig{}).failed(nil))
+}
+
+func TestErrorBodiesAreFailuresForRoutingAndQuorum(t *testing.T) {
+	options := MultiTransportOptions{
+		WriteQuorum: 2,
+		Retries:     shardingconfig.RetriesConfig{AcrossBackends: true},
+		ErrorBodies: shardingconfig.ErrorBodyConfig{StatusCodes: []int{http.StatusOK}},
+	}
+	var errorCalls, healthyCalls int32
+	urls := []url.URL{mkErrorBodySrv(&errorCalls), mkStatusSrv(http.StatusOK, &healthyCalls)}
+	succeeded := 0
+	countSucceeded := func(in <-chan ReqResErrTuple) (first ReqResErrTuple) {
+		for resTup := range in {
+			if !resTup.Failed {
+				succeeded++
+				first = resTup
+			}
+		}
+		return first
+	}
+	transp := NewMultiTransport(http.DefaultTransport, urls, countSucceeded, options)
+
+	req, _ := http.NewRequest("GET", "http://example.com/bucket/key", nil)
+	resp, err := transp.RoundTrip(req)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Empty(t, body, "read should be retried on healthy backend")
+	require.Equal(t, int32(1), atomic.LoadInt32(&errorCalls))
+	require.Equal(t, int32(1), atomic.LoadInt32(&healthyCalls))
+
+	req, _ = http.NewRequest("PUT", "http://example.com/bucket/key", bytes.NewBufferString("data"))
+	succeeded = 0
+	_, err = transp.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, 0, succeeded, "write quorum should not be reached")
+}
+
+func TestTokenBucketCapsBackendRequestRate(t *testing.T) {
+	now := time.Now()
+	limits := newBackendRateLimits(map[string]shardingconfig.RateLimitConfig{
+		"limited": {RequestsPerSecond: 2, Burst: 3},
+	})
+	limits["limited"].now = func() time.Time { return now }
+	limits["limited"].last = now
+
+	for i := 0; i < 3; i++ {
+		require.True(t, limits.take("limited"), "burst should be allowed")
+	}
+	require.False(t, limits.available("limited"))
+	require.False(t, limits.take("limited"))
+	require.True(t, limits.take("other"), "backends without limit are not capped")
+
+	now = now.Add(time.Second)
+	require.True(t, limits.take("limited"))
+	require.True(t, limits.take("limited"))
+	require.False(t, limits.take("limited"), "only 2 requests per second should be refilled")
+
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		require.True(t, limits.take("limited"))
+	}
+	require.False(t, limits.take("limited"), "tokens should not exceed burst")
+}
+
+func TestReadsSkipRateLimitedBackend(t *testing.T) {
+	var limitedCalls, healthyCalls int32
+	urls := []url.URL{mkStatusSrv(http.StatusOK, &limitedCalls), mkStatusSrv(http.StatusOK, &healthyCalls)}
+	transp := NewMultiTransport(http.DefaultTransport, urls, nil, MultiTransportOptions{
+		Retries: shardingconfig.RetriesConfig{AcrossBackends: true},
+		BackendRateLimits: map[string]shardingconfig.RateLimitConfig{
+			urls[0].Host: {RequestsPerSecond: 0.001, Burst: 2},
+		},
+	})
+
+	for i := 0; i < 5; i++ {
+		req, _ := http.NewRequest("GET", "http://example.com/bucket/key", nil)
+		resp, err := transp.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	require.Equal(t, int32(2), atomic.LoadInt32(&limitedCalls))
+	require.Equal(t, int32(3), atomic.LoadInt32(&healthyCalls))
+}
+
+func TestWritesFailOnRateLimitedBackend(t *testing.T) {
+	var limitedCalls, healthyCalls int32
+	urls := []url.URL{mkStatusSrv(http.StatusOK, &limitedCalls), mkStatusSrv(http.StatusOK, &healthyCalls)}
+	transp := NewMultiTransport(http.DefaultTransport, urls, nil, MultiTransportOptions{
+		WriteQuorum: 2,
+		BackendRateLimits: map[string]shardingconfig.RateLimitConfig{
+			urls[0].Host: {RequestsPerSecond: 0.001, Burst: 1},
+		},
+	})
+	write := func() (*http.Response, error) {
+		req, _ := http.NewRequest("PUT", "http://example.com/bucket/key", bytes.NewBufferString("data"))
+		return transp.RoundTrip(req)
+	}
+
+	resp, err := write()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = write()
+	require.True(t, err != nil || resp.StatusCode >= http.StatusInternalServerError)
+	require.Equal(t, int32(1), atomic.LoadInt32(&limitedCalls))
+	require.Equal(t, int32(2), atomic.LoadInt32(&healthyCalls))
+}
+
+func TestIsBucketListing(t *testing.T) {
+	for _, testData := range []struct {
+		method, path string
+		listing      bool
+	}{
+		{"GET", "/bucket", true},
+		{"GET", "/bucket/?prefix=a&delimiter=%2F&marker=b&max-keys=10&encoding-type=url", true},
+		{"GET", "/bucket?list-type=2", false},
+		{"GET", "/bucket?acl", false},
+		{"GET", "/bucket/key", false},
+		{"GET", "/", false},
+		{"DELETE", "/bucket", false},
+	} {
+		req, _ := http.NewRequest(testData.method, "http://example.com"+testData.path, nil)
+		require.Equal(t, testData.listing, IsBucketListing(req), testData.method+" "+testData.path)
+	}
+}
+
+func TestConcurrencyLimiterDecreasesOncePerThrottledRound(t *testing.T) {
+	throttling := newAdaptiveThrottling(shardingconfig.AdaptiveThrottlingConfig{Enabled: true, MaxConcurrency: 8})
+	limiter := throttling.limiter("backend")
+	round := func(throttled bool, requests int) int {
+		since := time.Now()
+		limit := 0
+		for i := 0; i < requests; i++ {
+			require.NoError(t, limiter.acquire(context.Background()))
+		}
+		for i := 0; i < requests; i++ {
+			limit, _ = limiter.release(throttled, since)
+		}
+		return limit
+	}
+
+	require.Equal(t, 4, round(true, 8), "responses of one round should decrease limit once")
+	require.Equal(t, 2, round(true, 4))
+	require.Equal(t, 1, round(true, 2))
+	require.Equal(t, 1, round(true, 1), "limit should not drop below MinConcurrency")
+	require.False(t, limiter.saturated())
+
+	limit := 1
+	for i := 0; i < 10; i++ {
+		limit = round(false, limit)
+	}
+	require.Equal(t, 8, limit, "limit should grow back to MaxConcurrency")
+}
+
+// mkThrottlingSrv responds with 503 SlowDown while throttle is set and
+// tracks highest number of concurrent requests
+func mkThrottlingSrv(throttle *int32, peak *int32) url.URL {
+	var current int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		concurrent := atomic.AddInt32(&current, 1)
+		defer atomic.AddInt32(&current, -1)
+		for {
+			highest := atomic.LoadInt32(peak)
+			if concurrent <= highest || atomic.CompareAndSwapInt32(peak, highest, concurrent) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		if atomic.LoadInt32(throttle) == 1 {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(`<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`))
+		}
+	}))
+	urlN, _ := url.Parse(ts.URL)
+	return *urlN
+}
+
+func TestAdaptiveThrottlingBacksOffAndRecovers(t *testing.T) {
+	var throttle, peak int32
+	urls := []url.URL{mkThrottlingSrv(&throttle, &peak)}
+	transp := NewMultiTransport(http.DefaultTransport, urls, nil, MultiTransportOptions{
+		AdaptiveThrottling: shardingconfig.AdaptiveThrottlingConfig{Enabled: true, MaxConcurrency: 8},
+	})
+	burst := func(requests int) {
+		atomic.StoreInt32(&peak, 0)
+		wg := sync.WaitGroup{}
+		for i := 0; i < requests; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req, _ := http.NewRequest("GET", "http://example.com/bucket/key", nil)
+				resp, err := transp.RoundTrip(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				_, _ = ioutil.ReadAll(resp.Body)
+				_ = resp.Body.Close()
+			}()
+		}
+		wg.Wait()
+	}
+
+	burst(8)
+	require.Equal(t, int32(8), atomic.LoadInt32(&peak))
+
+	atomic.StoreInt32(&throttle, 1)
+	for i := 0; i < 4; i++ {
+		burst(8)
+	}
+	burst(8)
+	require.Equal(t, int32(1), atomic.LoadInt32(&peak), "throttled backend should get one request at a time")
+
+	atomic.StoreInt32(&throttle, 0)
+	for i := 0; i < 8; i++ {
+		burst(8)
+	}
+	burst(8)
+	require.Equal(t, int32(8), atomic.LoadInt32(&peak), "backend should recover its concurrency")
+}
+
+// mkLaggingSrv serves every object and fails deletes while failDeletes is set
+func mkLaggingSrv(failDeletes *int32, reads *int32) url.URL {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodDelete && atomic.LoadInt32(failDeletes) == 1:
+			w.WriteHeader(http.StatusInternalServerError)
+		case r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodGet || r.Method == http.MethodHead:
+			atomic.AddInt32(reads, 1)
+			_, _ = w.Write([]byte("data"))
+		}
+	}))
+	urlN, _ := url.Parse(ts.URL)
+	return *urlN
+}
+
+// passFirstSuccessful responds as soon as any backend succeeded, like
+// production response handlers do
+func passFirstSuccessful(in <-chan ReqResErrTuple) ReqResErrTuple {
+	var last ReqResErrTuple
+	for resTup := range in {
+		if !resTup.Failed {
+			go func() {
+				for range in {
+				}
+			}()
+			return resTup
+		}
+		last = resTup
+	}
+	return last
+}
+
+func TestTombstonesHidePartiallyDeletedObjectWithinTTL(t *testing.T) {
+	var healthyFails, laggingFails, reads int32 = 0, 1, 0
+	urls := []url.URL{mkLaggingSrv(&healthyFails, &reads), mkLaggingSrv(&laggingFails, &reads)}
+	transp := NewMultiTransport(http.DefaultTransport, urls, passFirstSuccessful, MultiTransportOptions{
+		DeleteTombstones: shardingconfig.TombstonesConfig{TTL: metrics.Interval{Duration: 100 * time.Millisecond}},
+	})
+	send := func(method, path string) *http.Response {
+		req, _ := http.NewRequest(method, "http://example.com"+path, nil)
+		resp, err := transp.RoundTrip(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	send("DELETE", "/bucket/key")
+	resp := send("GET", "/bucket/key")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	require.Contains(t, string(body), "<Code>NoSuchKey</Code>")
+	require.Equal(t, http.StatusNotFound, send("HEAD", "/bucket/key").StatusCode)
+	require.Equal(t, int32(0), atomic.LoadInt32(&reads), "reads of deleted object should not reach backends")
+	require.Equal(t, http.StatusOK, send("GET", "/bucket/key?versionId=1").StatusCode)
+	require.Equal(t, http.StatusOK, send("GET", "/bucket/other").StatusCode)
+
+	time.Sleep(150 * time.Millisecond)
+	require.Equal(t, http.StatusOK, send("GET", "/bucket/key").StatusCode, "tombstone should expire")
+}
+
+func TestTombstonesAreRemovedOnCompleteDeleteAndRewrite(t *testing.T) {
+	var healthyFails, laggingFails, reads int32 = 0, 1, 0
+	urls := []url.URL{mkLaggingSrv(&healthyFails, &reads), mkLaggingSrv(&laggingFails, &reads)}
+	transp := NewMultiTransport(http.DefaultTransport, urls, passFirstSuccessful, MultiTransportOptions{
+		DeleteTombstones: shardingconfig.TombstonesConfig{TTL: metrics.Interval{Duration: time.Minute}},
+	})
+	send := func(method, path string) int {
+		req, _ := http.NewRequest(method, "http://example.com"+path, bytes.NewBufferString(""))
+		resp, err := transp.RoundTrip(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	send("DELETE", "/bucket/rewritten")
+	send("PUT", "/bucket/rewritten?tagging")
+	require.Equal(t, http.StatusNotFound, send("GET", "/bucket/rewritten"), "subresource write should keep tombstone")
+	send("PUT", "/bucket/rewritten")
+	require.Equal(t, http.StatusOK, send("GET", "/bucket/rewritten"))
+
+	atomic.StoreInt32(&laggingFails, 0)
+	send("DELETE", "/bucket/deleted")
+	deadline := time.Now().Add(time.Second)
+	for transp.tombstones.buried(&http.Request{Method: "GET", Host: "example.com", URL: &url.URL{Path: "/bucket/deleted"}}) {
+		require.True(t, time.Now().Before(deadline), "tombstone of deleted object should be removed")
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRoutingLogRecordsCandidatesAndChosenBackends(t *testing.T) {
+	var limitedCalls, healthyCalls int32
+	urls := []url.URL{mkStatusSrv(http.StatusOK, &limitedCalls), mkStatusSrv(http.StatusOK, &healthyCalls)}
+	var routingLog bytes.Buffer
+	transp := NewMultiTransport(http.DefaultTransport, urls, nil, MultiTransportOptions{
+		Retries: shardingconfig.RetriesConfig{AcrossBackends: true},
+		BackendRateLimits: map[string]shardingconfig.RateLimitConfig{
+			urls[0].Host: {RequestsPerSecond: 0.001, Burst: 1},
+		},
+		RoutingLog: &logrus.Logger{
+			Out:       &routingLog,
+			Formatter: log.PlainTextFormatter{},
+			Hooks:     make(logrus.LevelHooks),
+			Level:     logrus.DebugLevel,
+		},
+	})
+	send := func(method string) {
+		req, _ := http.NewRequest(method, "http://example.com/bucket/key", bytes.NewBufferString(""))
+		req = req.WithContext(context.WithValue(req.Context(), log.ContextreqIDKey, "req-"+method))
+		resp, err := transp.RoundTrip(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+	}
+
+	send("PUT")
+	send("GET")
+
+	var messages []RoutingLogMessage
+	for _, line := range strings.Split(strings.TrimSpace(routingLog.String()), "\n") {
+		message := RoutingLogMessage{}
+		require.NoError(t, json.Unmarshal([]byte(line), &message), line)
+		messages = append(messages, message)
+	}
+	hosts := []string{urls[0].Host, urls[1].Host}
+	require.Len(t, messages, 2)
+	require.Equal(t, "req-PUT", messages[0].ReqID)
+	require.Equal(t, "PUT", messages[0].Method)
+	require.Equal(t, "/bucket/key", messages[0].Path)
+	require.Equal(t, "all", messages[0].Mode)
+	require.Equal(t, hosts, messages[0].Candidates)
+	require.Equal(t, hosts, messages[0].Chosen)
+	require.Equal(t, "req-GET", messages[1].ReqID)
+	require.Equal(t, "sequential", messages[1].Mode)
+	require.Equal(t, hosts, messages[1].Candidates)
+	require.Equal(t, []string{urls[1].Host}, messages[1].Chosen, "rate limited backend should not be chosen")
+}
+
+func TestACLAndPolicyRequestsGoToAuthoritativeBackend(t *testing.T) {
+	calls := make([]int32, 3)
+	urls := []url.URL{
+		mkStatusSrv(http.StatusOK, &calls[0]),
+		mkStatusSrv(http.StatusOK, &calls[1]),
+		mkStatusSrv(http.StatusOK, &calls[2]),
+	}
+	transp := NewMultiTransport(http.DefaultTransport, urls, nil,
+		MultiTransportOptions{AuthoritativeBackend: urls[1].Host})
+
+	for _, testData := range []struct{ method, path string }{
+		{"GET", "/bucket?acl"},
+		{"PUT", "/bucket/key?acl"},
+		{"GET", "/bucket?policy"},
+		{"DELETE", "/bucket?policy"},
+	} {
+		req, _ := http.NewRequest(testData.method, "http://example.com"+testData.path, nil)
+		resp, err := transp.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.NoError(t, resp.Body.Close())
+	}
+	require.Equal(t, []int32{0, 4, 0}, []int32{atomic.LoadInt32(&calls[0]), atomic.LoadInt32(&calls[1]), atomic.LoadInt32(&calls[2])})
+
+	req, _ := http.NewRequest(http.MethodPut, "http://example.com/bucket/key", bytes.NewBufferString("data"))
+	resp, err := transp.RoundTrip(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&calls[0]) == 0 || atomic.LoadInt32(&calls[2]) == 0 {
+		require.True(t, time.Now().Before(deadline), "object write should be replicated")
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestIsAuthoritativeSubresource(t *testing.T) {
+	for _, testData := range []struct {
+		path          string
+		authoritative bool
+	}{
+		{"/bucket?acl", true},
+		{"/bucket/key?acl=", true},
+		{"/bucket?policy", true},
+		{"/bucket/key?versionId=1&acl", true},
+		{"/bucket?prefix=acl", false},
+		{"/bucket/acl", false},
+		{"/bucket?tagging", false},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com"+testData.path, nil)
+		require.Equal(t, testData.authoritative, IsAuthoritativeSubresource(req), testData.path)
+	}
+}
+
+func mkVersioningSrv(versionID string, calls *int32) url.URL {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		if r.Method == http.MethodPut && r.URL.RawQuery == "" {
+			w.Header().Set(VersionIDHeader, versionID)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	urlN, _ := url.Parse(ts.URL)
+	return *urlN
+}
+
+func TestVersionedRequestsGoToAuthoritativeBackend(t *testing.T) {
+	calls := make([]int32, 3)
+	urls := []url.URL{
+		mkVersioningSrv("v0", &calls[0]),
+		mkVersioningSrv("v1", &calls[1]),
+		mkVersioningSrv("v2", &calls[2]),
+	}
+	transp := NewMultiTransport(http.DefaultTransport, urls, nil,
+		MultiTransportOptions{AuthoritativeBackend: urls[1].Host})
+	countCalls := func() []int32 {
+		return []int32{atomic.LoadInt32(&calls[0]), atomic.LoadInt32(&calls[1]), atomic.LoadInt32(&calls[2])}
+	}
+
+	for _, testData := range []struct{ method, path string }{
+		{"GET", "/bucket/key?versionId=v1"},
+		{"HEAD", "/bucket/key?versionId=v1"},
+		{"DELETE", "/bucket/key?versionId=v1"},
+		{"GET", "/bucket?versions"},
+		{"GET", "/bucket?versioning"},
+	} {
+		req, _ := http.NewRequest(testData.method, "http://example.com"+testData.path, nil)
+		resp, err := transp.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.NoError(t, resp.Body.Close())
+	}
+	require.Equal(t, []int32{0, 5, 0}, countCalls())
+
+	req, _ := http.NewRequest(http.MethodPut, "http://example.com/bucket?versioning", bytes.NewBufferString("<VersioningConfiguration/>"))
+	resp, err := transp.RoundTrip(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&calls[0]) == 0 || atomic.LoadInt32(&calls[2]) == 0 {
+		require.True(t, time.Now().Before(deadline), "versioning configuration write should be replicated")
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	for i := 0; i < 5; i++ {
+		req, _ := http.NewRequest(http.MethodPut, "http://example.com/bucket/key", bytes.NewBufferString("data"))
+		resp, err := transp.RoundTrip(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, "v1", resp.Header.Get(VersionIDHeader), "client should get version ID of authoritative backend")
+	}
+}
+
+func TestIsVersionedRequest(t *testing.T) {
+	for _, testData := range []struct {
+		method    string
+		path      string
+		versioned bool
+	}{
+		{"GET", "/bucket/key?versionId=1", true},
+		{"DELETE", "/bucket/key?versionId=1", true},
+		{"GET", "/bucket?versions&prefix=a", true},
+		{"GET", "/bucket?versioning", true},
+		{"PUT", "/bucket?versioning", false},
+		{"GET", "/bucket/key", false},
+		{"GET", "/bucket?prefix=versionId", false},
+	} {
+		req, _ := http.NewRequest(testData.method, "http://example.com"+testData.path, nil)
+		require.Equal(t, testData.versioned, IsVersionedRequest(req), "%s %s", testData.method, testData.path)
+	}
+}
+
+func mkCapacitySrv(freeBytes string, writes *int32) url.URL {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			atomic.AddInt32(writes, 1)
+		}
+		w.Header().Set("X-Storage-Free-Bytes", freeBytes)
+	}))
+	urlN, _ := url.Parse(ts.URL)
+	return *urlN
+}
+
+// passFirstSuccessfulOfAll waits for all backend responses
+func passFirstSuccessfulOfAll(in <-chan ReqResErrTuple) ReqResErrTuple {
+	var chosen ReqResErrTuple
+	for resTup := range in {
+		if chosen.Res == nil && !resTup.Failed {
+			chosen = resTup
+			continue
+		}
+		if resTup.Res != nil {
+			_ = resTup.Res.Body.Close()
+		}
+		if chosen.Res == nil {
+			chosen = resTup
+		}
+	}
+	return chosen
+}
+
+func TestNearlyFullBackendReceivesProportionallyFewerWrites(t *testing.T) {
+	var fullWrites, freeWrites int32
+	urls := []url.URL{mkCapacitySrv("100", &fullWrites), mkCapacitySrv("100000", &freeWrites)}
+	transp := NewMultiTransport(http.DefaultTransport, urls, passFirstSuccessfulOfAll, MultiTransportOptions{
+		CapacityWeights: shardingconfig.CapacityWeightsConfig{
+			Header:       "X-Storage-Free-Bytes",
+			LowWatermark: shardingconfig.HumanSizeUnits{SizeInBytes: 1000},
+		},
+	})
+	transp.capacity.random = rand.New(rand.NewSource(1)).Float64
+	send := func(method string) {
+		req, _ := http.NewRequest(method, "http://example.com/bucket/key", bytes.NewBufferString("data"))
+		resp, err := transp.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.NoError(t, resp.Body.Close())
+	}
+
+	// backends report free capacity with every response
+	send(http.MethodGet)
+	for i := 0; i < 500; i++ {
+		send(http.MethodPut)
+	}
+
+	require.Equal(t, int32(500), atomic.LoadInt32(&freeWrites))
+	// nearly full backend has 10% of low watermark free
+	require.InDelta(t, 50, atomic.LoadInt32(&fullWrites), 25)
+}
+
+func TestCapacityWeightsSmoothReportedFreeBytes(t *testing.T) {
+	weights := newCapacityWeights(shardingconfig.CapacityWeightsConfig{
+		Header:       "X-Storage-Free-Bytes",
+		Window:       metrics.Interval{Duration: time.Minute},
+		LowWatermark: shardingconfig.HumanSizeUnits{SizeInBytes: 1000},
+	})
+	moment := time.Now()
+	weights.now = func() time.Time { return moment }
+	report := func(host, free string) {
+		weights.record(host, &http.Response{Header: http.Header{"X-Storage-Free-Bytes": []string{free}}})
+	}
+
+	report("full", "0")
+	report("free", "5000")
+	require.Equal(t, 0.0, weights.weight("full"))
+	require.Equal(t, 1.0, weights.weight("free"))
+
+	// single report does not move average much within window
+	moment = moment.Add(time.Second)
+	report("full", "10000")
+	require.InDelta(t, 0.165, weights.weight("full"), 0.01)
+
+	moment = moment.Add(10 * time.Minute)
+	report("full", "10000")
+	require.Equal(t, 1.0, weights.weight("full"))
+
+	report("unknown", "not a number")
+	require.Equal(t, 1.0, weights.weight("unknown"))
+}
+
+type receivedUpload struct {
+	body          string
+	contentLength int64
+	chunked       bool
+}
+
+func mkUploadSrv(requireContentLength bool, uploads chan receivedUpload) url.URL {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunked := len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked"
+		body, _ := ioutil.ReadAll(r.Body)
+		uploads <- receivedUpload{string(body), r.ContentLength, chunked}
+		if requireContentLength && chunked {
+			w.WriteHeader(http.StatusLengthRequired)
+		}
+	}))
+	urlN, _ := url.Parse(ts.URL)
+	return *urlN
+}
+
+func chunkedUpload(body string) *http.Request {
+	req, _ := http.NewRequest(http.MethodPut, "http://example.com/bucket/key", ioutil.NopCloser(strings.NewReader(body)))
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	return req
+}
+
+func TestChunkedUploadIsSentWithContentLengthToBackendRequiringIt(t *testing.T) {
+	lengthRequired, chunkedAccepted := make(chan receivedUpload, 1), make(chan receivedUpload, 1)
+	urls := []url.URL{mkUploadSrv(true, lengthRequired), mkUploadSrv(false, chunkedAccepted)}
+	transp := NewMultiTransport(http.DefaultTransport, urls, passFirstSuccessfulOfAll, MultiTransportOptions{
+		RequireContentLength: []string{urls[0].Host},
+		WriteQuorum:          2,
+	})
+
+	resp, err := transp.RoundTrip(chunkedUpload("chunked data"))
+
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, receivedUpload{"chunked data", 12, false}, <-lengthRequired)
+	require.Equal(t, receivedUpload{"chunked data", -1, true}, <-chunkedAccepted)
+}
+
+type receivedEmptyPut struct {
+	contentLength string
+	chunked       bool
+	expect        string
+	size          int
+}
+
+func mkETagSrv(puts chan receivedEmptyPut) url.URL {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		puts <- receivedEmptyPut{r.Header.Get("Content-Length"), len(r.TransferEncoding) > 0, r.Header.Get("Expect"), len(body)}
+		w.Header().Set("ETag", fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum(body))))
+	}))
+	urlN, _ := url.Parse(ts.URL)
+	return *urlN
+}
+
+func TestZeroBytePutIsReplicatedWithContentLength(t *testing.T) {
+	puts := make(chan receivedEmptyPut, 4)
+	urls := []url.URL{mkETagSrv(puts), mkETagSrv(puts)}
+	transp := NewMultiTransport(http.DefaultTransport, urls, passFirstSuccessfulOfAll, MultiTransportOptions{WriteQuorum: 2})
+	withLength, _ := http.NewRequest(http.MethodPut, "http://example.com/bucket/dir/", http.NoBody)
+	withLength.Header.Set("Expect", "100-continue")
+
+	for _, req := range []*http.Request{withLength, chunkedUpload("")} {
+		resp, err := transp.RoundTrip(req)
+
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, `"d41d8cd98f00b204e9800998ecf8427e"`, resp.Header.Get("ETag"))
+		for range urls {
+			require.Equal(t, receivedEmptyPut{"0", false, "", 0}, <-puts)
+		}
+	}
+}
+
+func TestChunkedUploadAboveRechunkBufferLimitIsRejected(t *testing.T) {
+	uploads := make(chan receivedUpload, 1)
+	urls := []url.URL{mkUploadSrv(true, uploads)}
+	transp := NewMultiTransport(http.DefaultTransport, urls, nil, MultiTransportOptions{
+		RequireContentLength: []string{urls[0].Host},
+		RechunkBufferLimit:   8,
+	})
+
+	_, err := transp.RoundTrip(chunkedUpload("12345678"))
+	require.NoError(t, err)
+	require.Equal(t, receivedUpload{"12345678", 8, false}, <-uploads)
+
+	_, err = transp.RoundTrip(chunkedUpload("123456789"))
+	require.Equal(t, ErrChunkedBodyTooLarge, err)
+	require.Len(t, uploads, 0)
+}
@@ -0,0 +1,45 @@
+package transport
+
+import "net/http"
+
+// WriteOutcome tells if write sent to backend failed
+type WriteOutcome struct {
+	Request *http.Request
+	Failed  bool
+}
+
+// WriteHealer re-attempts writes which failed on some backends
+type WriteHealer interface {
+	// WriteDone is called once all backends responded to write, request
+	// bodies are already consumed
+	WriteDone(outcomes []WriteOutcome)
+}
+
+// WriteHealers notifies every WriteHealer in order
+type WriteHealers []WriteHealer
+
+// WriteDone implements WriteHealer
+func (whs WriteHealers) WriteDone(outcomes []WriteOutcome) {
+	for _, healer := range whs {
+		healer.WriteDone(outcomes)
+	}
+}
+
+// healingGate passes responses through and reports write outcomes to
+// WriteHealer once all of them came in. Without WriteHealer in is returned
+func (mt *MultiTransport) healingGate(in <-chan ReqResErrTuple, total int) <-chan ReqResErrTuple {
+	if mt.WriteHealer == nil {
+		return in
+	}
+	out := make(chan ReqResErrTuple, total)
+	go func() {
+		defer close(out)
+		outcomes := make([]WriteOutcome, 0, total)
+		for resTup := range in {
+			outcomes = append(outcomes, WriteOutcome{Request: resTup.Req, Failed: resTup.Failed})
+			out <- resTup
+		}
+		go mt.WriteHealer.WriteDone(outcomes)
+	}()
+	return out
+}